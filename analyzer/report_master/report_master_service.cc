@@ -19,6 +19,7 @@
 
 #include "analyzer/report_master/report_master_service.h"
 
+#include <chrono>
 #include <memory>
 #include <numeric>
 #include <string>
@@ -67,6 +68,11 @@ DEFINE_string(tls_key_file, "",
 DEFINE_bool(
     enable_report_scheduling, false,
     "Should the ReportMaster run all reports automatically on a schedule?");
+DEFINE_int32(report_scheduling_interval_seconds, 17 * 60,
+             "If enable_report_scheduling=true, how often the ReportMaster "
+             "checks whether it is time to run a scheduled report. Tests use "
+             "a short interval in order to observe scheduled reports and "
+             "their exports promptly.");
 
 // Stackdriver metric constants
 namespace {
@@ -245,6 +251,8 @@ grpc::Status MakeReportMetadata(const std::string& report_id_string,
   }
 
   metadata->set_one_off(metadata_lite->one_off());
+  metadata->set_report_finalization_days(
+      report_config->scheduling().report_finalization_days());
   metadata->mutable_info_messages()->Swap(
       metadata_lite->mutable_info_messages());
 
@@ -312,8 +320,9 @@ ReportMasterService::CreateFromFlagsOrDie() {
     // ownership of the ReportMasterService.
     std::shared_ptr<ReportStarter> report_starter(
         new ReportStarter(report_master_service.get()));
-    std::unique_ptr<ReportScheduler> report_scheduler(
-        new ReportScheduler(config_manager, report_store, report_starter));
+    std::unique_ptr<ReportScheduler> report_scheduler(new ReportScheduler(
+        config_manager, report_store, report_starter,
+        std::chrono::seconds(FLAGS_report_scheduling_interval_seconds)));
     // We start the scheduler thread.
     report_scheduler->Start();
     // We give ownership of the ReportScheduler to the ReportMaster.
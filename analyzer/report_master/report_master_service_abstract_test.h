@@ -640,6 +640,11 @@ class ReportMasterServiceAbstractTest : public ::testing::Test {
 
     EXPECT_TRUE(metadata.one_off());
 
+    // Only ReportConfig 1 specifies report_finalization_days.
+    uint32_t expected_finalization_days =
+        (expected_report_config_id == 1 ? 3 : 0);
+    EXPECT_EQ(expected_finalization_days, metadata.report_finalization_days());
+
     // Check info_messages.
     if (check_completed && expect_joint_report) {
       ASSERT_NE(0, metadata.info_messages_size());
@@ -43,6 +43,7 @@ from tools.process_starter import DEFAULT_SHUFFLER_PUBLIC_KEY_PEM
 from tools.process_starter import DEFAULT_ANALYZER_SERVICE_PORT
 from tools.process_starter import DEFAULT_SHUFFLER_PORT
 from tools.process_starter import DEFAULT_REPORT_MASTER_PORT
+from tools.process_starter import DEFAULT_FAKE_GCS_PORT
 from tools.process_starter import DEMO_CONFIG_DIR
 from tools.process_starter import LOCALHOST_TLS_CERT_FILE
 from tools.process_starter import LOCALHOST_TLS_KEY_FILE
@@ -63,6 +64,8 @@ GRPC_PEM_ROOTS = os.path.join(THIS_DIR, "third_party", "grpc",
 CONFIG_SUBMODULE_PATH = os.path.join(THIS_DIR, "third_party", "config")
 CONFIG_BINARY_PROTO = os.path.join(OUT_DIR, 'third_party', 'config',
     'cobalt_config.binproto')
+E2E_REPORT_TOLERANCES_FILE = os.path.join(THIS_DIR, 'end_to_end_tests',
+    'report_tolerances.json')
 
 _logger = logging.getLogger()
 _verbose_count = 0
@@ -193,6 +196,7 @@ def _test(args):
         and not args.production_dir)
     start_cobalt_processes = ((test_dir in NEEDS_COBALT_PROCESSES)
         and not args.cobalt_on_personal_cluster and not args.production_dir)
+    fake_gcs_port = 0
     test_args = None
     if (test_dir == 'gtests_cloud_bt'):
       if not os.path.exists(bt_admin_service_account_credentials_file):
@@ -277,6 +281,7 @@ def _test(args):
               process_starter.OBSERVATION_QUERIER_PATH),
           "-test_app_path=%s" % process_starter.TEST_APP_PATH,
           "-config_bin_proto_path=%s" % CONFIG_BINARY_PROTO,
+          "-report_tolerances_file=%s" % E2E_REPORT_TOLERANCES_FILE,
           "-sub_process_v=%d"%_verbose_count
       ]
       use_tls = _parse_bool(args.use_tls)
@@ -306,6 +311,14 @@ def _test(args):
         test_args = test_args + [
           "-do_shuffler_threshold_test=false",
         ]
+      if start_cobalt_processes:
+        # When we run the Report Master locally it exports its reports to a
+        # fake Google Cloud Storage server run by the test, which checks the
+        # exported reports.
+        fake_gcs_port = DEFAULT_FAKE_GCS_PORT
+        test_args = test_args + [
+          "-fake_gcs_port=%d" % fake_gcs_port,
+        ]
     print '********************************************************'
     this_failure_list = []
     for attempt in range(num_times_to_try):
@@ -316,6 +329,7 @@ def _test(args):
           bigtable_instance_id=bigtable_instance_id,
           verbose_count=_verbose_count,
           vmodule=_vmodule,
+          fake_gcs_port=fake_gcs_port,
           use_tls=_parse_bool(args.use_tls),
           tls_cert_file=args.tls_cert_file,
           tls_key_file=args.tls_key_file,
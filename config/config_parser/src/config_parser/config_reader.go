@@ -21,6 +21,10 @@ import (
 // It is assumed that <rootDir>/projects.yaml contains the customers and projects list. (see project_list.go)
 // It is assumed that <rootDir>/<customerName>/<projectName>/config.yaml
 // contains the configuration for a project. (see project_config.go)
+// The ids deleted from a project may be listed in
+// <rootDir>/<customerName>/<projectName>/tombstones.yaml. (see tombstones.go)
+// The encoding templates shared by the projects are defined in
+// <rootDir>/shared/*.yaml. (see encoding_templates.go)
 func ReadConfigFromDir(rootDir string) (c config.CobaltConfig, err error) {
 	r, err := newConfigReaderForDir(rootDir)
 	if err != nil {
@@ -98,9 +102,18 @@ func GetConfigFilesListFromConfigDir(rootDir string) (files []string, err error)
 
 	files = append(files, r.customersFilePath())
 
+	sharedFiles, err := r.sharedEncodingsFilePaths()
+	if err != nil {
+		return files, err
+	}
+	files = append(files, sharedFiles...)
+
 	for i, _ := range l {
 		c := &(l[i])
 		files = append(files, r.projectFilePath(c.customerName, c.projectName))
+		if _, err := os.Stat(r.tombstonesFilePath(c.customerName, c.projectName)); err == nil {
+			files = append(files, r.tombstonesFilePath(c.customerName, c.projectName))
+		}
 	}
 	return files, nil
 }
@@ -113,6 +126,14 @@ type configReader interface {
 	// Returns the yaml representation of the configuration for a particular project.
 	// See project_config.go
 	Project(customerName string, projectName string) (string, error)
+	// Returns the yaml representation of the tombstones of a particular
+	// project or an empty string if the project has none.
+	// See tombstones.go
+	Tombstones(customerName string, projectName string) (string, error)
+	// Returns the yaml representations of the files defining the shared
+	// encoding templates or nil if there are none.
+	// See encoding_templates.go
+	SharedEncodings() ([]string, error)
 }
 
 // configDirReader is an implementation of configReader where the configuration
@@ -168,6 +189,44 @@ func (r *configDirReader) Project(customerName string, projectName string) (stri
 	return string(projectConfig), nil
 }
 
+func (r *configDirReader) tombstonesFilePath(customerName string, projectName string) string {
+	// A project's tombstones are at <rootDir>/<customerName>/<projectName>/tombstones.yaml
+	return filepath.Join(r.configDir, customerName, projectName, "tombstones.yaml")
+}
+
+func (r *configDirReader) Tombstones(customerName string, projectName string) (string, error) {
+	tombstones, err := ioutil.ReadFile(r.tombstonesFilePath(customerName, projectName))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(tombstones), nil
+}
+
+func (r *configDirReader) sharedEncodingsFilePaths() ([]string, error) {
+	// The shared encoding templates are in <rootDir>/shared/*.yaml
+	return filepath.Glob(filepath.Join(r.configDir, "shared", "*.yaml"))
+}
+
+func (r *configDirReader) SharedEncodings() ([]string, error) {
+	paths, err := r.sharedEncodingsFilePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, path := range paths {
+		file, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, string(file))
+	}
+	return files, nil
+}
+
 func readProjectsList(r configReader, l *[]projectConfig) (err error) {
 	// First, we get and parse the customer list.
 	customerListYaml, err := r.Customers()
@@ -179,7 +238,7 @@ func readProjectsList(r configReader, l *[]projectConfig) (err error) {
 		return err
 	}
 
-	return nil
+	return validateProjectList(*l)
 }
 
 // readConfig reads and parses the configuration for all projects from a configReader.
@@ -205,6 +264,9 @@ func readProjectConfig(r configReader, c *projectConfig) (err error) {
 	if err != nil {
 		return err
 	}
+	if configYaml, err = expandEncodingTemplates(r, configYaml); err != nil {
+		return err
+	}
 	return parseProjectConfig(configYaml, c)
 }
 
@@ -10,8 +10,10 @@ import (
 )
 
 type memConfigReader struct {
-	customers string
-	projects  map[string]string
+	customers       string
+	projects        map[string]string
+	tombstones      map[string]string
+	sharedEncodings []string
 }
 
 func (r memConfigReader) Customers() (string, error) {
@@ -27,6 +29,14 @@ func (r memConfigReader) Project(customerName string, projectName string) (strin
 	return yaml, nil
 }
 
+func (r memConfigReader) Tombstones(customerName string, projectName string) (string, error) {
+	return r.tombstones[customerName+"|"+projectName], nil
+}
+
+func (r memConfigReader) SharedEncodings() ([]string, error) {
+	return r.sharedEncodings, nil
+}
+
 func (r *memConfigReader) SetProject(customerName string, projectName string, yaml string) {
 	if r.projects == nil {
 		r.projects = map[string]string{}
@@ -35,6 +45,13 @@ func (r *memConfigReader) SetProject(customerName string, projectName string, ya
 	r.projects[key] = yaml
 }
 
+func (r *memConfigReader) SetTombstones(customerName string, projectName string, yaml string) {
+	if r.tombstones == nil {
+		r.tombstones = map[string]string{}
+	}
+	r.tombstones[customerName+"|"+projectName] = yaml
+}
+
 const customersYaml = `
 - customer_name: fuchsia
   customer_id: 1
@@ -0,0 +1,153 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements parsing and validating the contacts of the projects
+// listed in projects.yaml, and exporting them as a JSON mapping from projects
+// to their owners for on-call tooling.
+//
+// The contacts of a project are given either as a yaml list:
+//
+//   contacts:
+//   - alice@example.com
+//   - bob@example.com
+//
+// or, for compatibility, as a comma-separated string:
+//
+//   contact: alice@example.com,bob@example.com
+
+package config_parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var emailRegexp = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@([a-zA-Z0-9-]+\.)+[a-zA-Z]{2,}$`)
+
+// parseContacts returns the contacts of the project projectName, given either
+// in the contacts or in the contact field of p.
+func parseContacts(p map[string]interface{}, projectName string) ([]string, error) {
+	listAsI, hasList := p["contacts"]
+	v, hasString := p["contact"]
+	if hasList && hasString {
+		return nil, fmt.Errorf("Project %v has both contact and contacts. Only one of them may be specified.", projectName)
+	}
+
+	var contacts []string
+	if hasList {
+		list, ok := listAsI.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Contacts '%v' for project %v are not a yaml list.", listAsI, projectName)
+		}
+		for _, v := range list {
+			contact, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Contact '%v' for project %v is not a string.", v, projectName)
+			}
+			contacts = append(contacts, strings.TrimSpace(contact))
+		}
+	} else if hasString {
+		contact, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Contact '%v' for project %v is not a string.", v, projectName)
+		}
+		for _, c := range strings.Split(contact, ",") {
+			contacts = append(contacts, strings.TrimSpace(c))
+		}
+	} else {
+		return nil, fmt.Errorf("Missing contact for project %v.", projectName)
+	}
+
+	for _, c := range contacts {
+		if c == "" {
+			return nil, fmt.Errorf("Project %v has an empty contact.", projectName)
+		}
+	}
+	return contacts, nil
+}
+
+// validateContacts checks that the contacts of all projects in l are email
+// addresses whose domain is one of allowedDomains.
+func validateContacts(l []projectConfig, allowedDomains []string) error {
+	domains := map[string]bool{}
+	for _, d := range allowedDomains {
+		domains[strings.ToLower(d)] = true
+	}
+
+	for _, c := range l {
+		for _, contact := range c.contacts {
+			if !emailRegexp.MatchString(contact) {
+				return fmt.Errorf("Contact '%v' for project %v of customer %v is not an email address.", contact, c.projectName, c.customerName)
+			}
+			domain := strings.ToLower(contact[strings.LastIndex(contact, "@")+1:])
+			if !domains[domain] {
+				return fmt.Errorf("Contact '%v' for project %v of customer %v is not in an allowed domain. The allowed domains are %v.", contact, c.projectName, c.customerName, strings.Join(allowedDomains, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateContactsInDir checks that the contacts of all projects listed in
+// <rootDir>/projects.yaml are email addresses whose domain is one of
+// allowedDomains.
+func ValidateContactsInDir(rootDir string, allowedDomains []string) error {
+	l, err := readProjectsListFromDir(rootDir)
+	if err != nil {
+		return err
+	}
+	return validateContacts(l, allowedDomains)
+}
+
+// ProjectOwnership identifies a project and the people responsible for it.
+type ProjectOwnership struct {
+	CustomerName string   `json:"customer_name"`
+	CustomerId   uint32   `json:"customer_id"`
+	ProjectName  string   `json:"project_name"`
+	ProjectId    uint32   `json:"project_id"`
+	Contacts     []string `json:"contacts"`
+}
+
+// ownership returns the ProjectOwnership of each project in l.
+func ownership(l []projectConfig) []ProjectOwnership {
+	o := []ProjectOwnership{}
+	for _, c := range l {
+		o = append(o, ProjectOwnership{
+			CustomerName: c.customerName,
+			CustomerId:   c.customerId,
+			ProjectName:  c.projectName,
+			ProjectId:    c.projectId,
+			Contacts:     c.contacts,
+		})
+	}
+	return o
+}
+
+// OwnershipJSONFromDir returns the ProjectOwnership of each project listed in
+// <rootDir>/projects.yaml as a JSON array, in the order in which the projects
+// are listed.
+func OwnershipJSONFromDir(rootDir string) ([]byte, error) {
+	l, err := readProjectsListFromDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(ownership(l), "", "  ")
+}
+
+// readProjectsListFromDir reads the list of projects in
+// <rootDir>/projects.yaml.
+func readProjectsListFromDir(rootDir string) ([]projectConfig, error) {
+	r, err := newConfigReaderForDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := []projectConfig{}
+	if err = readProjectsList(r, &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests that contacts are accepted as a yaml list and as a comma-separated
+// string.
+func TestParseContacts(t *testing.T) {
+	y := `
+- name: ledger
+  id: 1
+  contacts:
+  - ben@example.com
+  - etienne@example.com
+- name: zircon
+  id: 2
+  contact: yvonne@example.com, zoe@example.com
+`
+
+	l := []projectConfig{}
+	if err := parseProjectListForTest(y, &l); err != nil {
+		t.Fatal(err)
+	}
+
+	e := [][]string{
+		{"ben@example.com", "etienne@example.com"},
+		{"yvonne@example.com", "zoe@example.com"},
+	}
+	for i, c := range l {
+		if !reflect.DeepEqual(e[i], c.contacts) {
+			t.Errorf("%v != %v", e[i], c.contacts)
+		}
+	}
+}
+
+// Tests that invalid contact fields are rejected.
+func TestParseContactsInvalid(t *testing.T) {
+	for _, y := range []string{
+		// Both contact and contacts.
+		`
+- name: ledger
+  id: 1
+  contact: ben@example.com
+  contacts:
+  - ben@example.com
+`,
+		// No contact.
+		`
+- name: ledger
+  id: 1
+`,
+		// Contacts is not a list.
+		`
+- name: ledger
+  id: 1
+  contacts: ben@example.com
+`,
+		// Empty contact.
+		`
+- name: ledger
+  id: 1
+  contact: ben@example.com,
+`,
+		// Contact is not a string.
+		`
+- name: ledger
+  id: 1
+  contacts:
+  - [ben@example.com]
+`,
+	} {
+		l := []projectConfig{}
+		if err := parseProjectListForTest(y, &l); err == nil {
+			t.Errorf("Accepted invalid contacts in %v", y)
+		}
+	}
+}
+
+// Tests that contacts must be email addresses in an allowed domain.
+func TestValidateContacts(t *testing.T) {
+	allowedDomains := []string{"example.com", "Example.org"}
+	for _, test := range []struct {
+		contacts []string
+		valid    bool
+	}{
+		{[]string{"ben@example.com"}, true},
+		{[]string{"ben@example.com", "yvonne@EXAMPLE.org"}, true},
+		{[]string{"ben"}, false},
+		{[]string{"ben@example.com", "yvonne@example.net"}, false},
+		{[]string{"ben@sub.example.com"}, false},
+		{[]string{"Ben <ben@example.com>"}, false},
+	} {
+		l := []projectConfig{{customerName: "fuchsia", projectName: "ledger", contacts: test.contacts}}
+		err := validateContacts(l, allowedDomains)
+		if test.valid && err != nil {
+			t.Errorf("Rejected contacts %v: %v", test.contacts, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Accepted contacts %v", test.contacts)
+		}
+	}
+}
+
+// Tests the contact validation and the ownership export of a config directory.
+func TestContactsFromDir(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+
+	projects := `
+- customer_name: fuchsia
+  customer_id: 20
+  projects:
+  - name: ledger
+    id: 1
+    contacts:
+    - ben@example.com
+    - etienne@example.com
+`
+	if err := ioutil.WriteFile(filepath.Join(configDir, "projects.yaml"), []byte(projects), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateContactsInDir(configDir, []string{"example.com"}); err != nil {
+		t.Errorf("Rejected valid contacts: %v", err)
+	}
+	if err := ValidateContactsInDir(configDir, []string{"example.org"}); err == nil {
+		t.Errorf("Accepted contacts outside of the allowed domains")
+	}
+
+	out, err := OwnershipJSONFromDir(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o []ProjectOwnership
+	if err := json.Unmarshal(out, &o); err != nil {
+		t.Fatalf("Invalid ownership JSON %s: %v", out, err)
+	}
+	e := []ProjectOwnership{{
+		CustomerName: "fuchsia",
+		CustomerId:   20,
+		ProjectName:  "ledger",
+		ProjectId:    1,
+		Contacts:     []string{"ben@example.com", "etienne@example.com"},
+	}}
+	if !reflect.DeepEqual(e, o) {
+		t.Errorf("%v != %v", e, o)
+	}
+}
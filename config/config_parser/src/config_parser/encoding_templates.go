@@ -0,0 +1,175 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements shared encoding templates. See expandEncodingTemplates
+// for details.
+
+package config_parser
+
+import (
+	"config"
+	"fmt"
+	yaml "github.com/go-yaml/yaml"
+	"yamlpb"
+)
+
+// encodingTemplates maps the names of shared encoding templates to their
+// definitions as parsed by the go-yaml package.
+type encodingTemplates map[string]map[interface{}]interface{}
+
+// parseEncodingTemplates parses the yaml files of the shared encoding
+// templates. (See expandEncodingTemplates) Each file contains a list of
+// templates. A template is an encoding config without ids and with a name
+// which is unique across all files, e.g.:
+//
+//	# <rootDir>/shared/rappor.yaml
+//	- name: basic_rappor_strings
+//	  basic_rappor:
+//	    prob_0_becoming_1: 0.1
+//	    prob_1_stays_1: 0.9
+//	    string_categories:
+//	      category:
+//	      - A
+//	      - B
+func parseEncodingTemplates(files []string) (t encodingTemplates, err error) {
+	t = encodingTemplates{}
+	for _, file := range files {
+		var entries []map[interface{}]interface{}
+		if err := yaml.Unmarshal([]byte(file), &entries); err != nil {
+			return nil, fmt.Errorf("Error while parsing the shared encodings yaml: %v", err)
+		}
+
+		for i, entry := range entries {
+			name, ok := entry["name"].(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("Shared encoding entry number %v does not have a name.", i)
+			}
+			if _, ok := t[name]; ok {
+				return nil, fmt.Errorf("Shared encoding name '%v' is repeated. Shared encoding names must be unique.", name)
+			}
+
+			template := map[interface{}]interface{}{}
+			for k, v := range entry {
+				switch k {
+				case "name":
+					continue
+				case "id", "customer_id", "project_id":
+					return nil, fmt.Errorf("Shared encoding '%v' sets %v. The ids are assigned by the projects using the template.", name, k)
+				}
+				template[k] = v
+			}
+
+			// We parse the template on its own so that errors are reported
+			// against the template rather than each project using it.
+			if err := unmarshalEncodingConfig(template, &config.EncodingConfig{}); err != nil {
+				return nil, fmt.Errorf("Error while parsing shared encoding '%v': %v", name, err)
+			}
+			t[name] = template
+		}
+	}
+	return t, nil
+}
+
+// unmarshalEncodingConfig populates e from m, the definition of an encoding
+// config as parsed by the go-yaml package.
+func unmarshalEncodingConfig(m map[interface{}]interface{}, e *config.EncodingConfig) error {
+	y, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return yamlpb.UnmarshalString(string(y), e)
+}
+
+// expandEncodingTemplates returns the yaml of a project config in which the
+// encoding configs that refer to a shared encoding template are replaced by a
+// copy of the template.
+//
+// Many projects use identical encodings. Rather than copying them, a project
+// may refer to a template defined in the yaml files in the shared directory
+// (See configDirReader.SharedEncodings) by setting only the id of the encoding
+// and the name of the template:
+//
+//	encoding_configs:
+//	- id: 1
+//	  template: basic_rappor_strings
+//
+// The encoding config then has that id and the parameters of the template.
+// Such an entry may not override any of the parameters of the template, so
+// that all projects using a template encode their data in the same way.
+//
+// configYaml is returned unchanged if it does not refer to any template, in
+// which case the shared templates are not read.
+func expandEncodingTemplates(r configReader, configYaml string) (string, error) {
+	var m map[interface{}]interface{}
+	if err := yaml.Unmarshal([]byte(configYaml), &m); err != nil {
+		// The error is reported by parseProjectConfig.
+		return configYaml, nil
+	}
+
+	entries, ok := m["encoding_configs"].([]interface{})
+	if !ok || !usesEncodingTemplates(entries) {
+		return configYaml, nil
+	}
+
+	files, err := r.SharedEncodings()
+	if err != nil {
+		return "", err
+	}
+	t, err := parseEncodingTemplates(files)
+	if err != nil {
+		return "", err
+	}
+
+	for i, e := range entries {
+		entry, ok := e.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		v, ok := entry["template"]
+		if !ok {
+			continue
+		}
+
+		name, _ := v.(string)
+		template, ok := t[name]
+		if !ok {
+			return "", fmt.Errorf("Encoding config entry number %v refers to unknown shared encoding '%v'.", i, v)
+		}
+
+		expanded := map[interface{}]interface{}{}
+		for k, v := range template {
+			expanded[k] = v
+		}
+		for k, v := range entry {
+			switch k {
+			case "template":
+				continue
+			case "id":
+				expanded[k] = v
+			default:
+				return "", fmt.Errorf("Encoding config entry number %v uses shared encoding '%v' and must not set %v.", i, name, k)
+			}
+		}
+		entries[i] = expanded
+	}
+
+	y, err := yaml.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(y), nil
+}
+
+// usesEncodingTemplates returns true if any of the encoding config entries
+// refers to a shared encoding template.
+func usesEncodingTemplates(entries []interface{}) bool {
+	for _, e := range entries {
+		if entry, ok := e.(map[interface{}]interface{}); ok {
+			if _, ok := entry["template"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config"
+	proto "github.com/golang/protobuf/proto"
+	"testing"
+)
+
+const sharedEncodingsYaml = `
+- name: basic_rappor_half
+  basic_rappor:
+    prob_0_becomes_1: 0.5
+    prob_1_stays_1: 0.5
+- name: forculus_20
+  forculus:
+    threshold: 20
+`
+
+const templatedProjectConfigYaml = `
+encoding_configs:
+- id: 1
+  template: basic_rappor_half
+- id: 2
+  basic_rappor:
+    prob_0_becomes_1: 0.25
+    prob_1_stays_1: 0.75
+- id: 3
+  template: forculus_20
+`
+
+// Tests that readProjectConfig expands the shared encoding templates.
+func TestReadProjectConfigWithEncodingTemplates(t *testing.T) {
+	r := memConfigReader{sharedEncodings: []string{sharedEncodingsYaml}}
+	r.SetProject("customer", "project", templatedProjectConfigYaml)
+	c := projectConfig{
+		customerName: "customer",
+		customerId:   10,
+		projectName:  "project",
+		projectId:    5,
+	}
+	if err := readProjectConfig(r, &c); err != nil {
+		t.Fatalf("Error reading project config: %v", err)
+	}
+
+	e := []*config.EncodingConfig{
+		&config.EncodingConfig{
+			CustomerId: 10,
+			ProjectId:  5,
+			Id:         1,
+			Config: &config.EncodingConfig_BasicRappor{
+				BasicRappor: &config.BasicRapporConfig{
+					Prob_0Becomes_1: 0.5,
+					Prob_1Stays_1:   0.5,
+				},
+			},
+		},
+		&config.EncodingConfig{
+			CustomerId: 10,
+			ProjectId:  5,
+			Id:         2,
+			Config: &config.EncodingConfig_BasicRappor{
+				BasicRappor: &config.BasicRapporConfig{
+					Prob_0Becomes_1: 0.25,
+					Prob_1Stays_1:   0.75,
+				},
+			},
+		},
+		&config.EncodingConfig{
+			CustomerId: 10,
+			ProjectId:  5,
+			Id:         3,
+			Config: &config.EncodingConfig_Forculus{
+				Forculus: &config.ForculusConfig{
+					Threshold: 20,
+				},
+			},
+		},
+	}
+	if len(c.projectConfig.EncodingConfigs) != len(e) {
+		t.Fatalf("Got %v encoding configs, expected %v.", len(c.projectConfig.EncodingConfigs), len(e))
+	}
+	for i := range e {
+		if !proto.Equal(e[i], c.projectConfig.EncodingConfigs[i]) {
+			t.Errorf("Got encoding config %v, expected %v.", c.projectConfig.EncodingConfigs[i], e[i])
+		}
+	}
+}
+
+// Tests that a project config without templates does not need shared encodings.
+func TestExpandEncodingTemplatesUnchanged(t *testing.T) {
+	r := memConfigReader{sharedEncodings: []string{"not: a list"}}
+	if y, err := expandEncodingTemplates(r, projectConfigYaml); err != nil || y != projectConfigYaml {
+		t.Errorf("expandEncodingTemplates changed a config without templates: %v", err)
+	}
+}
+
+// Tests that invalid uses of templates are rejected.
+func TestExpandEncodingTemplatesErrors(t *testing.T) {
+	cases := []struct {
+		shared  string
+		project string
+	}{
+		// Unknown template.
+		{sharedEncodingsYaml, "encoding_configs:\n- id: 1\n  template: unknown\n"},
+		// A template's parameters may not be overridden.
+		{sharedEncodingsYaml, "encoding_configs:\n- id: 1\n  template: forculus_20\n  forculus:\n    threshold: 10\n"},
+		// Repeated template name.
+		{sharedEncodingsYaml + sharedEncodingsYaml, "encoding_configs:\n- id: 1\n  template: forculus_20\n"},
+		// Template without a name.
+		{"- forculus:\n    threshold: 20\n", "encoding_configs:\n- id: 1\n  template: forculus_20\n"},
+		// Template with an id.
+		{"- name: forculus_20\n  id: 3\n  forculus:\n    threshold: 20\n", "encoding_configs:\n- id: 1\n  template: forculus_20\n"},
+		// Invalid template.
+		{"- name: forculus_20\n  forculus:\n    no_such_field: 20\n", "encoding_configs:\n- id: 1\n  template: forculus_20\n"},
+	}
+	for i, c := range cases {
+		r := memConfigReader{sharedEncodings: []string{c.shared}}
+		if _, err := expandEncodingTemplates(r, c.project); err == nil {
+			t.Errorf("Case %v: accepted invalid use of templates.", i)
+		}
+	}
+}
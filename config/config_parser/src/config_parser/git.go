@@ -8,20 +8,44 @@ package config_parser
 
 import (
 	"config"
+	"config_validator"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 )
 
 // Clones the specified repository to the specified destination.
 func cloneRepo(repoUrl string, destination string, gitTimeout time.Duration) error {
-	cmd := exec.Command("git", "clone",
+	return runGit(gitTimeout, "clone",
 		// Truncate the history to the latest commit.
 		"--depth", "1",
 		repoUrl, destination)
+}
+
+// Checks out the branch, tag or full commit hash repoRef of the specified
+// repository in the specified destination. Only that commit is fetched.
+func checkoutRef(repoUrl string, repoRef string, destination string, gitTimeout time.Duration) error {
+	// git would parse a ref such as --upload-pack=<command> as an option.
+	if repoRef == "" || strings.HasPrefix(repoRef, "-") {
+		return fmt.Errorf("invalid ref %q", repoRef)
+	}
+	if err := runGit(gitTimeout, "init", "-q", destination); err != nil {
+		return err
+	}
+	if err := runGit(gitTimeout, "-C", destination, "fetch", "-q", "--depth", "1", "--", repoUrl, repoRef); err != nil {
+		return err
+	}
+	return runGit(gitTimeout, "-C", destination, "checkout", "-q", "FETCH_HEAD")
+}
+
+// Runs git with the specified arguments and waits at most gitTimeout for it to
+// finish.
+func runGit(gitTimeout time.Duration, args ...string) error {
+	cmd := exec.Command("git", args...)
 
 	// *exec.ExitError is the documented return type of Cmd.Run().
 	if err := cmd.Start(); err != nil {
@@ -50,6 +74,45 @@ func cloneRepo(repoUrl string, destination string, gitTimeout time.Duration) err
 	return nil
 }
 
+// Returns whether ref is a full commit hash rather than a branch or tag.
+func isCommitHash(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, r := range ref {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks that the commit checked out in the repository at repoPath is
+// pinnedCommit. If pinnedCommit is empty and repoRef is a full commit hash,
+// repoRef is the pinned commit. Returns the commit checked out.
+func checkPinnedCommit(repoPath string, repoRef string, pinnedCommit string) (string, error) {
+	commit, err := repoHead(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if pinnedCommit == "" && isCommitHash(repoRef) {
+		pinnedCommit = repoRef
+	}
+	if pinnedCommit != "" && commit != strings.ToLower(pinnedCommit) {
+		return commit, fmt.Errorf("the checked out commit %v does not match the pinned commit %v", commit, pinnedCommit)
+	}
+	return commit, nil
+}
+
+// Returns the commit checked out in the repository at repoPath.
+func repoHead(repoPath string) (string, error) {
+	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // Only allow URLs served over HTTPS.
 func checkUrl(repoUrl string) (err error) {
 	u, err := url.Parse(repoUrl)
@@ -66,23 +129,43 @@ func checkUrl(repoUrl string) (err error) {
 
 // ReadConfigFromRepo clones repoUrl into a temporary directory and reads the
 // configuration from it. For the organization expected of the repository, see
-// ReadConfigFromDir in config_reader.go.
+// ReadConfigFromDir in config_reader.go. It also returns the commit from which
+// the configuration was read and the tombstones of the projects (see
+// tombstones.go).
+// repoRef is the branch, tag or full commit hash to read. If it is empty, the
+// default branch of the repository is read.
+// If pinnedCommit is not empty, or if repoRef is a full commit hash, an error is
+// returned unless the commit read is that commit. This lets build systems
+// reproduce exact versions of the registry, even if a tag is moved.
 // gitTimeout is the maximum amount of time to wait for a git command to finish.
-func ReadConfigFromRepo(repoUrl string, gitTimeout time.Duration) (c config.CobaltConfig, err error) {
+func ReadConfigFromRepo(repoUrl string, repoRef string, pinnedCommit string, gitTimeout time.Duration) (c config.CobaltConfig, tombstones []config_validator.Tombstones, commit string, err error) {
 	if err = checkUrl(repoUrl); err != nil {
-		return c, err
+		return c, tombstones, commit, err
 	}
 
 	repoPath, err := ioutil.TempDir(os.TempDir(), "cobalt_config")
 	if err != nil {
-		return c, err
+		return c, tombstones, commit, err
 	}
 
 	defer os.RemoveAll(repoPath)
 
-	if err := cloneRepo(repoUrl, repoPath, gitTimeout); err != nil {
-		return c, fmt.Errorf("Error cloning repository (%v): %v", repoUrl, err)
+	if repoRef == "" {
+		if err := cloneRepo(repoUrl, repoPath, gitTimeout); err != nil {
+			return c, tombstones, commit, fmt.Errorf("Error cloning repository (%v): %v", repoUrl, err)
+		}
+	} else if err := checkoutRef(repoUrl, repoRef, repoPath, gitTimeout); err != nil {
+		return c, tombstones, commit, fmt.Errorf("Error checking out %v of repository (%v): %v", repoRef, repoUrl, err)
+	}
+
+	if commit, err = checkPinnedCommit(repoPath, repoRef, pinnedCommit); err != nil {
+		return c, tombstones, commit, fmt.Errorf("Error reading the commit of repository (%v): %v", repoUrl, err)
+	}
+
+	if c, err = ReadConfigFromDir(repoPath); err != nil {
+		return c, tombstones, commit, err
 	}
 
-	return ReadConfigFromDir(repoPath)
+	tombstones, err = ReadTombstonesFromDir(repoPath)
+	return c, tombstones, commit, err
 }
@@ -0,0 +1,136 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs git in dir and returns its trimmed output.
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Creates a repository in a temporary directory with two commits on the branch
+// main, the first of which is tagged v1. Returns the directory and the hashes of
+// the two commits.
+func makeTestRepo(t *testing.T) (dir string, first string, second string) {
+	dir, err := ioutil.TempDir("", "config_repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The caller only removes the repository if it is returned.
+	defer func() {
+		if t.Failed() {
+			os.RemoveAll(dir)
+		}
+	}()
+	gitOutput(t, dir, "init", "-q", "-b", "main")
+	for i, contents := range []string{"version 1", "version 2"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "projects.yaml"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gitOutput(t, dir, "add", "projects.yaml")
+		gitOutput(t, dir, "commit", "-q", "-m", contents)
+		if i == 0 {
+			gitOutput(t, dir, "tag", "v1")
+			first = gitOutput(t, dir, "rev-parse", "HEAD")
+		}
+	}
+	return dir, first, gitOutput(t, dir, "rev-parse", "HEAD")
+}
+
+func TestCheckoutRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo, first, second := makeTestRepo(t)
+	defer os.RemoveAll(repo)
+
+	for _, test := range []struct {
+		ref  string
+		want string
+	}{
+		{"main", second},
+		{"v1", first},
+		{first, first},
+	} {
+		dest, err := ioutil.TempDir("", "config_checkout")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dest)
+
+		if err := checkoutRef("file://"+repo, test.ref, dest, time.Minute); err != nil {
+			t.Fatalf("checkoutRef(%v): %v", test.ref, err)
+		}
+		if commit, err := checkPinnedCommit(dest, test.ref, ""); err != nil || commit != test.want {
+			t.Errorf("checkPinnedCommit(%v): got (%v, %v), expected %v", test.ref, commit, err, test.want)
+		}
+	}
+
+	dest, err := ioutil.TempDir("", "config_checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	marker := filepath.Join(dest, "marker")
+	if err := checkoutRef("file://"+repo, "--upload-pack=touch "+marker+";git-upload-pack", dest, time.Minute); err == nil {
+		t.Errorf("checkoutRef() accepted a ref starting with -")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("checkoutRef() ran the command given as the upload pack")
+	}
+}
+
+func TestCheckPinnedCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo, first, second := makeTestRepo(t)
+	defer os.RemoveAll(repo)
+
+	if _, err := checkPinnedCommit(repo, "main", second); err != nil {
+		t.Errorf("Pinned to the checked out commit: got %v", err)
+	}
+	if _, err := checkPinnedCommit(repo, "main", first); err == nil {
+		t.Errorf("Pinned to another commit: expected an error")
+	}
+	if _, err := checkPinnedCommit(repo, first, ""); err == nil {
+		t.Errorf("Referenced another commit by its hash: expected an error")
+	}
+	if _, err := checkPinnedCommit(repo, "v1", ""); err != nil {
+		t.Errorf("A tag is not a pinned commit: got %v", err)
+	}
+}
+
+func TestIsCommitHash(t *testing.T) {
+	for ref, want := range map[string]bool{
+		"main": false,
+		"v1.2": false,
+		"0123456789abcdef0123456789abcdef01234567":  true,
+		"0123456789abcdef0123456789abcdef0123456":   false,
+		"0123456789abcdef0123456789abcdef0123456g":  false,
+		"0123456789abcdef0123456789abcdef012345678": false,
+	} {
+		if got := isCommitHash(ref); got != want {
+			t.Errorf("isCommitHash(%v): got %v, expected %v", ref, got, want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements the markdown documentation output of the cobalt config
+// parser.
+
+package config_parser
+
+import (
+	"bytes"
+	"config"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// projectKey identifies a project in the merged registry.
+type projectKey struct {
+	customerId uint32
+	projectId  uint32
+}
+
+// projectEntries holds the parts of the registry that belong to one project.
+type projectEntries struct {
+	metrics   []*config.Metric
+	encodings []*config.EncodingConfig
+	reports   []*config.ReportConfig
+}
+
+// Outputs human-readable markdown documentation of the registry. For each
+// project, the metrics, encodings and reports are listed in tables sorted by
+// id.
+func MarkdownOutput(c *config.CobaltConfig) (outputBytes []byte, err error) {
+	projects := map[projectKey]*projectEntries{}
+	get := func(customerId, projectId uint32) *projectEntries {
+		k := projectKey{customerId, projectId}
+		if projects[k] == nil {
+			projects[k] = &projectEntries{}
+		}
+		return projects[k]
+	}
+	for _, m := range c.MetricConfigs {
+		p := get(m.CustomerId, m.ProjectId)
+		p.metrics = append(p.metrics, m)
+	}
+	for _, e := range c.EncodingConfigs {
+		p := get(e.CustomerId, e.ProjectId)
+		p.encodings = append(p.encodings, e)
+	}
+	for _, r := range c.ReportConfigs {
+		p := get(r.CustomerId, r.ProjectId)
+		p.reports = append(p.reports, r)
+	}
+
+	keys := make([]projectKey, 0, len(projects))
+	for k := range projects {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].customerId != keys[j].customerId {
+			return keys[i].customerId < keys[j].customerId
+		}
+		return keys[i].projectId < keys[j].projectId
+	})
+
+	out := new(bytes.Buffer)
+	out.WriteString("# Cobalt Registry\n")
+	for _, k := range keys {
+		p := projects[k]
+		out.WriteString(fmt.Sprintf("\n## Customer %d, Project %d\n", k.customerId, k.projectId))
+		writeMetricsTable(out, p.metrics)
+		writeEncodingsTable(out, p.encodings)
+		writeReportsTable(out, p.reports)
+	}
+	return out.Bytes(), nil
+}
+
+func writeMetricsTable(out *bytes.Buffer, metrics []*config.Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Id < metrics[j].Id })
+
+	out.WriteString("\n### Metrics\n\n")
+	out.WriteString("| Id | Name | Description | Parts |\n")
+	out.WriteString("|---|---|---|---|\n")
+	for _, m := range metrics {
+		names := make([]string, 0, len(m.Parts))
+		for name := range m.Parts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		parts := make([]string, 0, len(names))
+		for _, name := range names {
+			part := m.Parts[name]
+			s := fmt.Sprintf("**%s** (%s)", name, part.DataType)
+			if part.Description != "" {
+				s += ": " + part.Description
+			}
+			parts = append(parts, s)
+		}
+		writeRow(out, fmt.Sprint(m.Id), m.Name, m.Description, strings.Join(parts, "<br>"))
+	}
+}
+
+func writeEncodingsTable(out *bytes.Buffer, encodings []*config.EncodingConfig) {
+	if len(encodings) == 0 {
+		return
+	}
+	sort.Slice(encodings, func(i, j int) bool { return encodings[i].Id < encodings[j].Id })
+
+	out.WriteString("\n### Encodings\n\n")
+	out.WriteString("| Id | Name | Type | Parameters |\n")
+	out.WriteString("|---|---|---|---|\n")
+	for _, e := range encodings {
+		encodingType, params := describeEncoding(e)
+		writeRow(out, fmt.Sprint(e.Id), e.Name, encodingType, strings.Join(params, "<br>"))
+	}
+}
+
+// describeEncoding returns the name of the encoding used by |e| and a list of
+// its parameters.
+func describeEncoding(e *config.EncodingConfig) (encodingType string, params []string) {
+	switch c := e.Config.(type) {
+	case *config.EncodingConfig_Forculus:
+		return "Forculus", []string{
+			fmt.Sprintf("threshold: %d", c.Forculus.Threshold),
+			fmt.Sprintf("epoch_type: %s", c.Forculus.EpochType),
+		}
+	case *config.EncodingConfig_Rappor:
+		return "String RAPPOR", []string{
+			fmt.Sprintf("num_bloom_bits: %d", c.Rappor.NumBloomBits),
+			fmt.Sprintf("num_hashes: %d", c.Rappor.NumHashes),
+			fmt.Sprintf("num_cohorts: %d", c.Rappor.NumCohorts),
+			fmt.Sprintf("prob_0_becomes_1: %v", c.Rappor.Prob_0Becomes_1),
+			fmt.Sprintf("prob_1_stays_1: %v", c.Rappor.Prob_1Stays_1),
+		}
+	case *config.EncodingConfig_BasicRappor:
+		params = []string{
+			fmt.Sprintf("prob_0_becomes_1: %v", c.BasicRappor.Prob_0Becomes_1),
+			fmt.Sprintf("prob_1_stays_1: %v", c.BasicRappor.Prob_1Stays_1),
+		}
+		if categories := c.BasicRappor.GetStringCategories(); categories != nil {
+			params = append(params, fmt.Sprintf("string_categories: %s", strings.Join(categories.Category, ", ")))
+		}
+		if categories := c.BasicRappor.GetIntRangeCategories(); categories != nil {
+			params = append(params, fmt.Sprintf("int_range_categories: [%d, %d]", categories.First, categories.Last))
+		}
+		if categories := c.BasicRappor.GetIndexedCategories(); categories != nil {
+			params = append(params, fmt.Sprintf("indexed_categories: %d", categories.NumCategories))
+		}
+		return "Basic RAPPOR", params
+	case *config.EncodingConfig_NoOpEncoding:
+		return "No-op", nil
+	default:
+		return "Unknown", nil
+	}
+}
+
+func writeReportsTable(out *bytes.Buffer, reports []*config.ReportConfig) {
+	if len(reports) == 0 {
+		return
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Id < reports[j].Id })
+
+	out.WriteString("\n### Reports\n\n")
+	out.WriteString("| Id | Name | Description | Metric | Type | Variables | Schedule | Exports |\n")
+	out.WriteString("|---|---|---|---|---|---|---|---|\n")
+	for _, r := range reports {
+		variables := make([]string, 0, len(r.Variable))
+		for _, v := range r.Variable {
+			s := v.MetricPart
+			if labels := v.GetIndexLabels().GetLabels(); len(labels) > 0 {
+				s += fmt.Sprintf(" (%d index labels)", len(labels))
+			}
+			if candidates := v.GetRapporCandidates().GetCandidates(); len(candidates) > 0 {
+				s += fmt.Sprintf(" (%d RAPPOR candidates)", len(candidates))
+			}
+			variables = append(variables, s)
+		}
+
+		schedule := ""
+		if r.Scheduling != nil {
+			schedule = fmt.Sprintf("%s, finalized after %d days",
+				r.Scheduling.AggregationEpochType, r.Scheduling.ReportFinalizationDays)
+		}
+
+		exports := make([]string, 0, len(r.ExportConfigs))
+		for _, e := range r.ExportConfigs {
+			s := "unknown serialization"
+			if e.GetCsv() != nil {
+				s = "CSV"
+			}
+			if gcs := e.GetGcs(); gcs != nil {
+				s += fmt.Sprintf(" to gs://%s", gcs.Bucket)
+			}
+			exports = append(exports, s)
+		}
+
+		writeRow(out, fmt.Sprint(r.Id), r.Name, r.Description, fmt.Sprint(r.MetricId), r.ReportType.String(),
+			strings.Join(variables, "<br>"), schedule, strings.Join(exports, "<br>"))
+	}
+}
+
+// writeRow writes a markdown table row containing |cells|.
+func writeRow(out *bytes.Buffer, cells ...string) {
+	for i, cell := range cells {
+		cells[i] = escapeCell(cell)
+	}
+	out.WriteString("| ")
+	out.WriteString(strings.Join(cells, " | "))
+	out.WriteString(" |\n")
+}
+
+// escapeCell makes |s| safe to use as the content of a markdown table cell.
+func escapeCell(s string) string {
+	s = strings.Replace(s, "|", "\\|", -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
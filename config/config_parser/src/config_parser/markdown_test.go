@@ -0,0 +1,81 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownOutput(t *testing.T) {
+	c := &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			&config.Metric{
+				CustomerId:  2,
+				ProjectId:   1,
+				Id:          12,
+				Name:        "Module views",
+				Description: "Tracks each | view of a module.",
+				Parts: map[string]*config.MetricPart{
+					"url": &config.MetricPart{Description: "The URL."},
+				},
+			},
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 1, Name: "Rare events"},
+		},
+		EncodingConfigs: []*config.EncodingConfig{
+			&config.EncodingConfig{
+				CustomerId: 2,
+				ProjectId:  1,
+				Id:         3,
+				Name:       "Forculus",
+				Config: &config.EncodingConfig_Forculus{
+					Forculus: &config.ForculusConfig{Threshold: 20},
+				},
+			},
+		},
+		ReportConfigs: []*config.ReportConfig{
+			&config.ReportConfig{
+				CustomerId: 2,
+				ProjectId:  1,
+				Id:         5,
+				Name:       "Module views report",
+				MetricId:   12,
+				Variable:   []*config.ReportVariable{&config.ReportVariable{MetricPart: "url"}},
+				Scheduling: &config.ReportSchedulingConfig{ReportFinalizationDays: 3},
+				ExportConfigs: []*config.ReportExportConfig{
+					&config.ReportExportConfig{
+						ExportSerialization: &config.ReportExportConfig_Csv{Csv: &config.CSVSerializationConfig{}},
+						ExportLocation:      &config.ReportExportConfig_Gcs{Gcs: &config.GCSExportLocation{Bucket: "my-bucket"}},
+					},
+				},
+			},
+		},
+	}
+
+	outputBytes, err := MarkdownOutput(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(outputBytes)
+
+	expected := []string{
+		"| 12 | Module views | Tracks each \\| view of a module. | **url** (STRING): The URL. |\n",
+		"| 3 | Forculus | Forculus | threshold: 20<br>epoch_type: DAY |\n",
+		"| 5 | Module views report |  | 12 | HISTOGRAM | url | DAY, finalized after 3 days | CSV to gs://my-bucket |\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected the output to contain\n%v\ngot:\n%v", e, out)
+		}
+	}
+
+	// Projects are sorted by customer and project id.
+	first := strings.Index(out, "## Customer 1, Project 1")
+	second := strings.Index(out, "## Customer 2, Project 1")
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("Projects are missing or out of order:\n%v", out)
+	}
+}
@@ -9,10 +9,15 @@ package config_parser
 import (
 	"bytes"
 	"config"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"sort"
 	"strings"
+	"time"
 )
 
 type OutputFormatter func(c *config.CobaltConfig) (outputBytes []byte, err error)
@@ -36,6 +41,13 @@ func Base64Output(c *config.CobaltConfig) (outputBytes []byte, err error) {
 	return outputBytes, nil
 }
 
+// Outputs the proto in the canonical JSON encoding of protocol buffers so that
+// it can be consumed without protobuf libraries.
+func JsonOutput(c *config.CobaltConfig) (outputBytes []byte, err error) {
+	marshaler := protojson.MarshalOptions{Multiline: true, Indent: "  "}
+	return marshaler.Marshal(proto.MessageV2(c))
+}
+
 // writeIdConstants prints out a list of constants to be used in testing. It
 // uses the Name attribute of each Metric, Report, and Encoding to construct the
 // constants.
@@ -55,29 +67,139 @@ func writeIdConstants(out *bytes.Buffer, constType string, entries map[string]ui
 	out.WriteString("\n")
 }
 
+// namedIds holds the ids of the named metrics, reports and encodings of a
+// registry, keyed by name.
+type namedIds struct {
+	metrics   map[string]uint32
+	reports   map[string]uint32
+	encodings map[string]uint32
+}
+
+// getNamedIds returns the ids of the named metrics, reports and encodings of c.
+// It returns an error if two metrics, reports or encodings have the same name.
+func getNamedIds(c *config.CobaltConfig) (ids namedIds, err error) {
+	ids.metrics = make(map[string]uint32)
+	for _, metric := range c.MetricConfigs {
+		if metric.Name != "" {
+			if _, ok := ids.metrics[metric.Name]; ok {
+				return ids, fmt.Errorf("Duplicate metric name found %v", metric.Name)
+			}
+			ids.metrics[metric.Name] = metric.Id
+		}
+	}
+
+	ids.reports = make(map[string]uint32)
+	for _, report := range c.ReportConfigs {
+		if report.Name != "" {
+			if _, ok := ids.reports[report.Name]; ok {
+				return ids, fmt.Errorf("Duplicate report name found %v", report.Name)
+			}
+			ids.reports[report.Name] = report.Id
+		}
+	}
+
+	ids.encodings = make(map[string]uint32)
+	for _, encoding := range c.EncodingConfigs {
+		if encoding.Name != "" {
+			if _, ok := ids.encodings[encoding.Name]; ok {
+				return ids, fmt.Errorf("Duplicate encoding name found %v", encoding.Name)
+			}
+			ids.encodings[encoding.Name] = encoding.Id
+		}
+	}
+	return ids, nil
+}
+
+// writeSortedIdConstants writes the metric, report and encoding ID constants
+// of ids, sorted by name so that the output does not depend on the iteration
+// order of the maps. declare returns the declaration of the constant for the
+// entry of type constType ("Metric", "Report" or "Encoding") with the given
+// name and id.
+func writeSortedIdConstants(out *bytes.Buffer, ids namedIds, declare func(name, constType string, id uint32) string) {
+	for _, group := range []struct {
+		constType string
+		entries   map[string]uint32
+	}{{"Metric", ids.metrics}, {"Report", ids.reports}, {"Encoding", ids.encodings}} {
+		if len(group.entries) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(group.entries))
+		for name := range group.entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out.WriteString(fmt.Sprintf("// %s ID Constants\n", group.constType))
+		for _, name := range names {
+			out.WriteString(declare(name, group.constType, group.entries[name]))
+		}
+		out.WriteString("\n")
+	}
+}
+
+// writeLicense writes the license of the generated file as comments in the
+// syntax shared by C++, Dart and Rust.
+func writeLicense(out *bytes.Buffer) {
+	out.WriteString("// Copyright 2018 The Fuchsia Authors. All rights reserved.\n")
+	out.WriteString("// Use of this source code is governed by a BSD-style license that can be\n")
+	out.WriteString("// found in the LICENSE file.\n\n")
+}
+
+// writeGeneratedFrom writes a comment stating that the file was generated from
+// the YAML in configLocation.
+func writeGeneratedFrom(out *bytes.Buffer, configLocation string) {
+	out.WriteString("// This file was generated by Cobalt's Config Parser based on the\n")
+	out.WriteString("// configuration YAML in the following location:\n")
+	out.WriteString(fmt.Sprintf("// %s\n", configLocation))
+	out.WriteString("// Edit the YAML at that location to make changes.\n\n")
+}
+
+// BuildMetadata describes how a registry was generated. It is included in the
+// C++ output so that clients can log which registry they carry.
+type BuildMetadata struct {
+	// The time at which the registry was generated.
+	GenerationTime time.Time
+
+	// The commit of the repository from which the registry was read. Empty if
+	// the registry was not read from a repository.
+	SourceCommit string
+}
+
+// writeBuildMetadata writes constants and accessor functions for the hash of
+// the serialized registry in configBytes and for the fields of metadata.
+func writeBuildMetadata(out *bytes.Buffer, configBytes []byte, metadata BuildMetadata) {
+	hash := sha256.Sum256(configBytes)
+	out.WriteString("// Build metadata of this registry.\n")
+	out.WriteString("// The hex-encoded SHA-256 hash of the serialized CobaltConfig proto message.\n")
+	out.WriteString(fmt.Sprintf("const char kRegistryHash[] = \"%s\";\n", hex.EncodeToString(hash[:])))
+	out.WriteString("// The time at which the registry was generated, in seconds since the Unix epoch.\n")
+	out.WriteString(fmt.Sprintf("const int64_t kRegistryGenerationTimeSeconds = %d;\n", metadata.GenerationTime.Unix()))
+	out.WriteString("// The commit from which the registry was read. Empty if unknown.\n")
+	out.WriteString(fmt.Sprintf("const char kRegistrySourceCommit[] = \"%s\";\n\n", metadata.SourceCommit))
+	out.WriteString("inline const char* RegistryHash() { return kRegistryHash; }\n")
+	out.WriteString("inline int64_t RegistryGenerationTimeSeconds() { return kRegistryGenerationTimeSeconds; }\n")
+	out.WriteString("inline const char* RegistrySourceCommit() { return kRegistrySourceCommit; }\n\n")
+}
+
 // Returns an output formatter that will output the contents of a C++ header
 // file that contains a variable declaration for a string literal that contains
-// the base64-encoding of the serialized proto.
+// the base64-encoding of the serialized proto, along with build metadata.
 //
 // varName will be the name of the variable containing the base64-encoded serialized proto.
 // namespace is a list of nested namespaces inside of which the variable will be defined.
 // configLocation is the location of the YAML that was parsed.
-func CppOutputFactory(varName string, namespace []string, configLocation string) OutputFormatter {
+// metadata is the build metadata to include in the output.
+func CppOutputFactory(varName string, namespace []string, configLocation string, metadata BuildMetadata) OutputFormatter {
 	return func(c *config.CobaltConfig) (outputBytes []byte, err error) {
-		b64Bytes, err := Base64Output(c)
+		configBytes, err := BinaryOutput(c)
 		if err != nil {
 			return outputBytes, err
 		}
+		b64Bytes := []byte(base64.StdEncoding.EncodeToString(configBytes))
 
 		out := new(bytes.Buffer)
-		out.WriteString("// Copyright 2018 The Fuchsia Authors. All rights reserved.\n")
-		out.WriteString("// Use of this source code is governed by a BSD-style license that can be\n")
-		out.WriteString("// found in the LICENSE file.\n\n")
+		writeLicense(out)
 		out.WriteString("#pragma once\n\n")
-		out.WriteString("// This file was generated by Cobalt's Config Parser based on the\n")
-		out.WriteString("// configuration YAML in the following location:\n")
-		out.WriteString(fmt.Sprintf("// %s\n", configLocation))
-		out.WriteString("// Edit the YAML at that location to make changes.\n\n")
+		writeGeneratedFrom(out, configLocation)
 
 		for _, name := range namespace {
 			out.WriteString("namespace ")
@@ -85,41 +207,18 @@ func CppOutputFactory(varName string, namespace []string, configLocation string)
 			out.WriteString(" {\n")
 		}
 
-		metrics := make(map[string]uint32)
-		for _, metric := range c.MetricConfigs {
-			if metric.Name != "" {
-				if _, ok := metrics[metric.Name]; ok {
-					return outputBytes, fmt.Errorf("Duplicate metric name found %v", metric.Name)
-				}
-				metrics[metric.Name] = metric.Id
-			}
+		ids, err := getNamedIds(c)
+		if err != nil {
+			return outputBytes, err
 		}
 		// Write out the 'Metric' constants (e.g. kTestMetricId)
-		writeIdConstants(out, "Metric", metrics)
-
-		reports := make(map[string]uint32)
-		for _, report := range c.ReportConfigs {
-			if report.Name != "" {
-				if _, ok := reports[report.Name]; ok {
-					return outputBytes, fmt.Errorf("Duplicate report name found %v", report.Name)
-				}
-				reports[report.Name] = report.Id
-			}
-		}
+		writeIdConstants(out, "Metric", ids.metrics)
 		// Write out the 'Report' constants (e.g. kTestReportId)
-		writeIdConstants(out, "Report", reports)
-
-		encodings := make(map[string]uint32)
-		for _, encoding := range c.EncodingConfigs {
-			if encoding.Name != "" {
-				if _, ok := encodings[encoding.Name]; ok {
-					return outputBytes, fmt.Errorf("Duplicate encoding name found %v", encoding.Name)
-				}
-				encodings[encoding.Name] = encoding.Id
-			}
-		}
+		writeIdConstants(out, "Report", ids.reports)
 		// Write out the 'Encoding' constants (e.g. kTestEncodingId)
-		writeIdConstants(out, "Encoding", encodings)
+		writeIdConstants(out, "Encoding", ids.encodings)
+
+		writeBuildMetadata(out, configBytes, metadata)
 
 		out.WriteString("// The base64 encoding of the bytes of a serialized CobaltConfig proto message.\n")
 		out.WriteString("const char ")
@@ -136,3 +235,106 @@ func CppOutputFactory(varName string, namespace []string, configLocation string)
 		return out.Bytes(), nil
 	}
 }
+
+// Returns an output formatter that will output the contents of a Dart library
+// that contains a constant for the base64-encoding of the serialized proto,
+// along with the ID constants and the build metadata, analogous to the C++
+// output.
+//
+// varName will be the name of the constant containing the base64-encoded serialized proto.
+// libraryPath is the list of components of the name of the library, which may be empty.
+// configLocation is the location of the YAML that was parsed.
+// metadata is the build metadata to include in the output.
+func DartOutputFactory(varName string, libraryPath []string, configLocation string, metadata BuildMetadata) OutputFormatter {
+	return func(c *config.CobaltConfig) (outputBytes []byte, err error) {
+		configBytes, err := BinaryOutput(c)
+		if err != nil {
+			return outputBytes, err
+		}
+		ids, err := getNamedIds(c)
+		if err != nil {
+			return outputBytes, err
+		}
+
+		out := new(bytes.Buffer)
+		writeLicense(out)
+		writeGeneratedFrom(out, configLocation)
+		if len(libraryPath) > 0 {
+			out.WriteString(fmt.Sprintf("library %s;\n\n", strings.Join(libraryPath, ".")))
+		}
+
+		writeSortedIdConstants(out, ids, func(name, constType string, id uint32) string {
+			return fmt.Sprintf("const int k%s%sId = %d;\n", strings.Replace(name, " ", "", -1), constType, id)
+		})
+
+		hash := sha256.Sum256(configBytes)
+		out.WriteString("// Build metadata of this registry.\n")
+		out.WriteString("// The hex-encoded SHA-256 hash of the serialized CobaltConfig proto message.\n")
+		out.WriteString(fmt.Sprintf("const String kRegistryHash = '%s';\n", hex.EncodeToString(hash[:])))
+		out.WriteString("// The time at which the registry was generated, in seconds since the Unix epoch.\n")
+		out.WriteString(fmt.Sprintf("const int kRegistryGenerationTimeSeconds = %d;\n", metadata.GenerationTime.Unix()))
+		out.WriteString("// The commit from which the registry was read. Empty if unknown.\n")
+		out.WriteString(fmt.Sprintf("const String kRegistrySourceCommit = '%s';\n\n", metadata.SourceCommit))
+
+		out.WriteString("// The base64 encoding of the bytes of a serialized CobaltConfig proto message.\n")
+		out.WriteString(fmt.Sprintf("const String %s = '%s';\n", varName, base64.StdEncoding.EncodeToString(configBytes)))
+		return out.Bytes(), nil
+	}
+}
+
+// Returns an output formatter that will output the contents of a Rust source
+// file that contains a constant for the base64-encoding of the serialized
+// proto, along with the ID constants and the build metadata, analogous to the
+// C++ output.
+//
+// varName will be the name of the constant containing the base64-encoded serialized proto.
+// modulePath is a list of nested modules inside of which the constants will be defined.
+// configLocation is the location of the YAML that was parsed.
+// metadata is the build metadata to include in the output.
+func RustOutputFactory(varName string, modulePath []string, configLocation string, metadata BuildMetadata) OutputFormatter {
+	return func(c *config.CobaltConfig) (outputBytes []byte, err error) {
+		configBytes, err := BinaryOutput(c)
+		if err != nil {
+			return outputBytes, err
+		}
+		ids, err := getNamedIds(c)
+		if err != nil {
+			return outputBytes, err
+		}
+
+		out := new(bytes.Buffer)
+		writeLicense(out)
+		writeGeneratedFrom(out, configLocation)
+
+		for _, name := range modulePath {
+			out.WriteString("pub mod ")
+			out.WriteString(name)
+			out.WriteString(" {\n")
+		}
+
+		writeSortedIdConstants(out, ids, func(name, constType string, id uint32) string {
+			constName := strings.ToUpper(strings.Join(strings.Fields(name), "_") + "_" + constType + "_ID")
+			return fmt.Sprintf("pub const %s: u32 = %d;\n", constName, id)
+		})
+
+		hash := sha256.Sum256(configBytes)
+		out.WriteString("// Build metadata of this registry.\n")
+		out.WriteString("// The hex-encoded SHA-256 hash of the serialized CobaltConfig proto message.\n")
+		out.WriteString(fmt.Sprintf("pub const REGISTRY_HASH: &str = \"%s\";\n", hex.EncodeToString(hash[:])))
+		out.WriteString("// The time at which the registry was generated, in seconds since the Unix epoch.\n")
+		out.WriteString(fmt.Sprintf("pub const REGISTRY_GENERATION_TIME_SECONDS: i64 = %d;\n", metadata.GenerationTime.Unix()))
+		out.WriteString("// The commit from which the registry was read. Empty if unknown.\n")
+		out.WriteString(fmt.Sprintf("pub const REGISTRY_SOURCE_COMMIT: &str = \"%s\";\n\n", metadata.SourceCommit))
+
+		out.WriteString("// The base64 encoding of the bytes of a serialized CobaltConfig proto message.\n")
+		out.WriteString("#[allow(non_upper_case_globals)]\n")
+		out.WriteString(fmt.Sprintf("pub const %s: &str = \"%s\";\n", varName, base64.StdEncoding.EncodeToString(configBytes)))
+
+		for i := len(modulePath) - 1; i >= 0; i-- {
+			out.WriteString("} // mod ")
+			out.WriteString(modulePath[i])
+			out.WriteString("\n")
+		}
+		return out.Bytes(), nil
+	}
+}
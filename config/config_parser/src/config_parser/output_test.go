@@ -0,0 +1,194 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCppOutputBuildMetadata(t *testing.T) {
+	c := &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 1, Name: "Rare events"},
+		},
+	}
+	metadata := BuildMetadata{
+		GenerationTime: time.Unix(1520000000, 0),
+		SourceCommit:   "0123456789abcdef",
+	}
+
+	outputBytes, err := CppOutputFactory("config", []string{"a", "b"}, "some/location", metadata)(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(outputBytes)
+
+	configBytes, err := BinaryOutput(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(configBytes)
+
+	expected := []string{
+		"const char kRegistryHash[] = \"" + hex.EncodeToString(hash[:]) + "\";\n",
+		"const int64_t kRegistryGenerationTimeSeconds = 1520000000;\n",
+		"const char kRegistrySourceCommit[] = \"0123456789abcdef\";\n",
+		"inline const char* RegistryHash() { return kRegistryHash; }\n",
+		"inline int64_t RegistryGenerationTimeSeconds() { return kRegistryGenerationTimeSeconds; }\n",
+		"inline const char* RegistrySourceCommit() { return kRegistrySourceCommit; }\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected the output to contain\n%v\ngot:\n%v", e, out)
+		}
+	}
+
+	// The build metadata is inside the namespaces.
+	if strings.Index(out, "namespace b {") > strings.Index(out, "kRegistryHash") ||
+		strings.Index(out, "} // a") < strings.Index(out, "RegistrySourceCommit()") {
+		t.Errorf("Expected the build metadata to be inside the namespaces, got:\n%v", out)
+	}
+}
+
+func TestJsonOutput(t *testing.T) {
+	c := &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 1, Name: "Rare events"},
+		},
+	}
+
+	outputBytes, err := JsonOutput(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(outputBytes), "\"Rare events\"") {
+		t.Errorf("Expected the output to contain the metric name, got:\n%s", outputBytes)
+	}
+
+	parsed := &config.CobaltConfig{}
+	if err := protojson.Unmarshal(outputBytes, proto.MessageV2(parsed)); err != nil {
+		t.Fatalf("Error in parsing the output: %v", err)
+	}
+	if !proto.Equal(parsed, c) {
+		t.Errorf("Expected the output to parse to\n%v\ngot:\n%v", c, parsed)
+	}
+}
+
+func TestDartOutput(t *testing.T) {
+	c := &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 2, Name: "Rare events"},
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 1, Name: "Common events"},
+		},
+	}
+	metadata := BuildMetadata{
+		GenerationTime: time.Unix(1520000000, 0),
+		SourceCommit:   "0123456789abcdef",
+	}
+
+	outputBytes, err := DartOutputFactory("config", []string{"cobalt", "registry"}, "some/location", metadata)(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(outputBytes)
+
+	configBytes, err := BinaryOutput(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(configBytes)
+
+	expected := []string{
+		"library cobalt.registry;\n",
+		"const int kCommoneventsMetricId = 1;\nconst int kRareeventsMetricId = 2;\n",
+		"const String kRegistryHash = '" + hex.EncodeToString(hash[:]) + "';\n",
+		"const int kRegistryGenerationTimeSeconds = 1520000000;\n",
+		"const String kRegistrySourceCommit = '0123456789abcdef';\n",
+		"const String config = '" + base64.StdEncoding.EncodeToString(configBytes) + "';\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected the output to contain\n%v\ngot:\n%v", e, out)
+		}
+	}
+
+	outputBytes, err = DartOutputFactory("config", nil, "some/location", metadata)(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(outputBytes), "library") {
+		t.Errorf("Expected no library directive without a library path, got:\n%s", outputBytes)
+	}
+}
+
+func TestRustOutput(t *testing.T) {
+	c := &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 1, Name: "Rare events"},
+		},
+		ReportConfigs: []*config.ReportConfig{
+			&config.ReportConfig{CustomerId: 1, ProjectId: 1, Id: 3, Name: "Test"},
+		},
+	}
+	metadata := BuildMetadata{
+		GenerationTime: time.Unix(1520000000, 0),
+		SourceCommit:   "0123456789abcdef",
+	}
+
+	outputBytes, err := RustOutputFactory("CONFIG", []string{"a", "b"}, "some/location", metadata)(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(outputBytes)
+
+	configBytes, err := BinaryOutput(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(configBytes)
+
+	expected := []string{
+		"pub mod a {\npub mod b {\n",
+		"pub const RARE_EVENTS_METRIC_ID: u32 = 1;\n",
+		"pub const TEST_REPORT_ID: u32 = 3;\n",
+		"pub const REGISTRY_HASH: &str = \"" + hex.EncodeToString(hash[:]) + "\";\n",
+		"pub const REGISTRY_GENERATION_TIME_SECONDS: i64 = 1520000000;\n",
+		"pub const REGISTRY_SOURCE_COMMIT: &str = \"0123456789abcdef\";\n",
+		"pub const CONFIG: &str = \"" + base64.StdEncoding.EncodeToString(configBytes) + "\";\n",
+		"} // mod b\n} // mod a\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected the output to contain\n%v\ngot:\n%v", e, out)
+		}
+	}
+}
+
+func TestDuplicateNameOutput(t *testing.T) {
+	c := &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 1, Name: "Rare events"},
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 2, Name: "Rare events"},
+		},
+	}
+	formatters := map[string]OutputFormatter{
+		"cpp":  CppOutputFactory("config", nil, "some/location", BuildMetadata{}),
+		"dart": DartOutputFactory("config", nil, "some/location", BuildMetadata{}),
+		"rust": RustOutputFactory("CONFIG", nil, "some/location", BuildMetadata{}),
+	}
+	for name, formatter := range formatters {
+		if _, err := formatter(c); err == nil {
+			t.Errorf("Expected the %v output to fail for duplicate metric names", name)
+		}
+	}
+}
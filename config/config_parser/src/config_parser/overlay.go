@@ -0,0 +1,183 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements environment-specific overlays of the Cobalt
+// configuration. See ApplyOverlayFromDir for details.
+
+package config_parser
+
+import (
+	"config"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ApplyOverlayFromDir applies the overlay stored in overlayDir to the
+// configuration c which was read from configDir. (See ReadConfigFromDir)
+//
+// An overlay lets an environment such as staging or prod use its own report
+// export configs without duplicating the metric and encoding definitions of
+// the base configuration. It has the same layout as configDir without the
+// projects.yaml file: <overlayDir>/<customerName>/<projectName>/config.yaml
+// may contain report_configs entries which set only an id and export_configs.
+// The export configs of the report with that id in the base configuration are
+// replaced by those of the overlay. Projects without an overlay are unchanged.
+func ApplyOverlayFromDir(c *config.CobaltConfig, configDir string, overlayDir string) error {
+	r, err := newConfigDirReader(configDir)
+	if err != nil {
+		return err
+	}
+
+	o, err := newConfigDirReader(overlayDir)
+	if err != nil {
+		return err
+	}
+
+	l := []projectConfig{}
+	if err := readProjectsList(r, &l); err != nil {
+		return err
+	}
+
+	if err := checkOverlayProjects(overlayDir, l); err != nil {
+		return err
+	}
+
+	for i := range l {
+		p := &l[i]
+		overlayYaml, err := o.Project(p.customerName, p.projectName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := parseProjectConfig(overlayYaml, p); err != nil {
+			return fmt.Errorf("Error reading overlay for %v %v: %v", p.customerName, p.projectName, err)
+		}
+
+		if err := applyProjectOverlay(c, p); err != nil {
+			return fmt.Errorf("Error applying overlay for %v %v: %v", p.customerName, p.projectName, err)
+		}
+	}
+
+	return nil
+}
+
+// GetOverlayFilesListFromOverlayDir returns the list of files in overlayDir
+// which constitute the overlay of the configuration in configDir. (See
+// ApplyOverlayFromDir) The purpose is generating a list of dependencies.
+func GetOverlayFilesListFromOverlayDir(configDir string, overlayDir string) (files []string, err error) {
+	r, err := newConfigDirReader(configDir)
+	if err != nil {
+		return files, err
+	}
+
+	o, err := newConfigDirReader(overlayDir)
+	if err != nil {
+		return files, err
+	}
+
+	l := []projectConfig{}
+	if err := readProjectsList(r, &l); err != nil {
+		return files, err
+	}
+
+	for _, p := range l {
+		path := o.projectFilePath(p.customerName, p.projectName)
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// checkOverlayProjects checks that every customer and project directory in
+// overlayDir corresponds to a project in l. This catches overlays which would
+// otherwise be silently ignored because of a misspelled name.
+func checkOverlayProjects(overlayDir string, l []projectConfig) error {
+	projects := map[string]map[string]bool{}
+	for _, p := range l {
+		if projects[p.customerName] == nil {
+			projects[p.customerName] = map[string]bool{}
+		}
+		projects[p.customerName][p.projectName] = true
+	}
+
+	customerDirs, err := ioutil.ReadDir(overlayDir)
+	if err != nil {
+		return err
+	}
+
+	for _, customerDir := range customerDirs {
+		if !customerDir.IsDir() {
+			continue
+		}
+		customerProjects, ok := projects[customerDir.Name()]
+		if !ok {
+			return fmt.Errorf("Overlay contains customer '%v' which is not in the customer list.", customerDir.Name())
+		}
+
+		projectDirs, err := ioutil.ReadDir(filepath.Join(overlayDir, customerDir.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, projectDir := range projectDirs {
+			if projectDir.IsDir() && !customerProjects[projectDir.Name()] {
+				return fmt.Errorf("Overlay contains project '%v' which is not a project of customer '%v'.", projectDir.Name(), customerDir.Name())
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyProjectOverlay replaces the export configs of the reports in c with
+// those in the parsed overlay p. It returns an error if the overlay does
+// anything other than override the export configs of existing reports.
+func applyProjectOverlay(c *config.CobaltConfig, p *projectConfig) error {
+	if len(p.projectConfig.MetricConfigs) > 0 || len(p.projectConfig.EncodingConfigs) > 0 {
+		return fmt.Errorf("Overlays may only override report export configs but metric or encoding configs were found.")
+	}
+
+	reports := map[uint32]*config.ReportConfig{}
+	for _, r := range c.ReportConfigs {
+		if r.CustomerId == p.customerId && r.ProjectId == p.projectId {
+			reports[r.Id] = r
+		}
+	}
+
+	// Set of report ids in the overlay. Used to detect duplicates.
+	overlayIds := map[uint32]bool{}
+
+	for i, o := range p.projectConfig.ReportConfigs {
+		if overlayIds[o.Id] {
+			return fmt.Errorf("Report id '%v' is repeated in overlay report config entry number %v. Report ids must be unique.", o.Id, i)
+		}
+		overlayIds[o.Id] = true
+
+		r, ok := reports[o.Id]
+		if !ok {
+			return fmt.Errorf("Overlay report config entry number %v overrides report id '%v' which is not in the base config.", i, o.Id)
+		}
+
+		// Only the id and the export configs may be set in an overlay.
+		rest := proto.Clone(o).(*config.ReportConfig)
+		rest.CustomerId = 0
+		rest.ProjectId = 0
+		rest.Id = 0
+		rest.ExportConfigs = nil
+		if !proto.Equal(rest, &config.ReportConfig{}) {
+			return fmt.Errorf("Overlay report config entry number %v for report id '%v' sets fields other than 'id' and 'export_configs'.", i, o.Id)
+		}
+
+		r.ExportConfigs = o.ExportConfigs
+	}
+
+	return nil
+}
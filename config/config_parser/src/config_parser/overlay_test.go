@@ -0,0 +1,164 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseBaseConfig returns the CobaltConfig for projectConfigYaml as project 5
+// of customer 10.
+func parseBaseConfig(t *testing.T) config.CobaltConfig {
+	p := projectConfig{customerId: 10, projectId: 5}
+	if err := parseProjectConfig(projectConfigYaml, &p); err != nil {
+		t.Fatalf("Error parsing base config: %v", err)
+	}
+	return mergeConfigs([]projectConfig{p})
+}
+
+// parseOverlay returns the parsed overlay y for project 5 of customer 10.
+func parseOverlay(t *testing.T, y string) *projectConfig {
+	p := &projectConfig{customerId: 10, projectId: 5}
+	if err := parseProjectConfig(y, p); err != nil {
+		t.Fatalf("Error parsing overlay: %v", err)
+	}
+	return p
+}
+
+func TestApplyProjectOverlay(t *testing.T) {
+	c := parseBaseConfig(t)
+	o := parseOverlay(t, `
+report_configs:
+- id: 2
+  export_configs:
+  - csv: {}
+    gcs:
+      bucket: "fuchsia-cobalt-reports-prod"
+`)
+	if err := applyProjectOverlay(&c, o); err != nil {
+		t.Fatalf("Error applying overlay: %v", err)
+	}
+
+	if bucket := c.ReportConfigs[0].ExportConfigs[0].GetGcs().Bucket; bucket != "fuchsia-cobalt-reports-p2-test-app" {
+		t.Errorf("Report 1 should not be changed by the overlay. Got bucket %v", bucket)
+	}
+	if bucket := c.ReportConfigs[1].ExportConfigs[0].GetGcs().Bucket; bucket != "fuchsia-cobalt-reports-prod" {
+		t.Errorf("Unexpected bucket for report 2: %v", bucket)
+	}
+	if c.ReportConfigs[1].Name != "Fuchsia Module Daily Launch Counts" {
+		t.Errorf("Only the export configs should be overridden. Got name %v", c.ReportConfigs[1].Name)
+	}
+}
+
+func TestApplyProjectOverlayConflicts(t *testing.T) {
+	overlays := map[string]string{
+		"metric configs": `
+metric_configs:
+- id: 1
+  name: "Other name"
+`,
+		"unknown report": `
+report_configs:
+- id: 3
+  export_configs:
+  - csv: {}
+`,
+		"repeated report": `
+report_configs:
+- id: 1
+  export_configs:
+  - csv: {}
+- id: 1
+  export_configs:
+  - csv: {}
+`,
+		"other fields": `
+report_configs:
+- id: 1
+  metric_id: 2
+  export_configs:
+  - csv: {}
+`,
+	}
+
+	for name, y := range overlays {
+		c := parseBaseConfig(t)
+		if err := applyProjectOverlay(&c, parseOverlay(t, y)); err == nil {
+			t.Errorf("Expected an error for an overlay with %v.", name)
+		}
+	}
+}
+
+func TestApplyOverlayFromDir(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "cobalt_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+
+	overlayDir, err := ioutil.TempDir("", "cobalt_overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(overlayDir)
+
+	writeFile := func(path string, contents string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile(filepath.Join(configDir, "projects.yaml"), customersYaml)
+	writeFile(filepath.Join(configDir, "fuchsia", "ledger", "config.yaml"), projectConfigYaml)
+	writeFile(filepath.Join(configDir, "fuchsia", "module_usage_tracking", "config.yaml"), projectConfigYaml)
+	writeFile(filepath.Join(configDir, "test_customer", "test_project", "config.yaml"), projectConfigYaml)
+	writeFile(filepath.Join(overlayDir, "fuchsia", "ledger", "config.yaml"), `
+report_configs:
+- id: 1
+  export_configs:
+  - csv: {}
+    gcs:
+      bucket: "ledger-prod"
+`)
+
+	c, err := ReadConfigFromDir(configDir)
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if err := ApplyOverlayFromDir(&c, configDir, overlayDir); err != nil {
+		t.Fatalf("Error applying overlay: %v", err)
+	}
+
+	for _, r := range c.ReportConfigs {
+		expected := "fuchsia-cobalt-reports-p2-test-app"
+		if r.CustomerId == 1 && r.ProjectId == 100 && r.Id == 1 {
+			expected = "ledger-prod"
+		}
+		if bucket := r.ExportConfigs[0].GetGcs().Bucket; bucket != expected {
+			t.Errorf("Report (%v, %v, %v): got bucket %v, expected %v", r.CustomerId, r.ProjectId, r.Id, bucket, expected)
+		}
+	}
+
+	files, err := GetOverlayFilesListFromOverlayDir(configDir, overlayDir)
+	if err != nil {
+		t.Fatalf("Error listing overlay files: %v", err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join(overlayDir, "fuchsia", "ledger", "config.yaml") {
+		t.Errorf("Unexpected overlay files: %v", files)
+	}
+
+	// An overlay for a project that is not in the customer list is an error.
+	writeFile(filepath.Join(overlayDir, "fuchsia", "ledgr", "config.yaml"), "")
+	if err := ApplyOverlayFromDir(&c, configDir, overlayDir); err == nil {
+		t.Errorf("Expected an error for an overlay of an unknown project.")
+	}
+}
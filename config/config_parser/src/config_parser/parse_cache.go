@@ -0,0 +1,160 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements a cache of parsed and validated project configs. See
+// ReadConfigFromDirWithCache for details.
+
+package config_parser
+
+import (
+	"config"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ParseCache stores the parsed configs of projects that were found to be
+// valid in a directory. An entry is keyed by a hash of the parser version, the
+// project's ids and the content of the project's config.yaml, in which the
+// shared encoding templates are expanded. An entry is thus found again only if
+// neither the project's config, the templates it uses nor the parser changed.
+type ParseCache struct {
+	dir           string
+	parserVersion string
+}
+
+// NewParseCache returns a ParseCache that stores its entries in dir, which is
+// created if it does not exist. parserVersion must change whenever the parsing
+// or the validation of project configs changes.
+func NewParseCache(dir string, parserVersion string) (*ParseCache, error) {
+	if parserVersion == "" {
+		return nil, fmt.Errorf("The parser version of a parse cache must not be empty.")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ParseCache{dir: dir, parserVersion: parserVersion}, nil
+}
+
+// key returns the cache key for the project c whose config is configYaml.
+func (pc *ParseCache) key(c *projectConfig, configYaml string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00", pc.parserVersion, c.customerId, c.projectId)
+	h.Write([]byte(configYaml))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (pc *ParseCache) entryPath(key string) string {
+	return filepath.Join(pc.dir, key+".pb")
+}
+
+// get returns the project config stored for key. It returns false if there is
+// no such entry or the entry cannot be read, in which case the project is
+// simply parsed again.
+func (pc *ParseCache) get(key string) (c config.CobaltConfig, ok bool) {
+	data, err := ioutil.ReadFile(pc.entryPath(key))
+	if err != nil {
+		return c, false
+	}
+	if err := proto.Unmarshal(data, &c); err != nil {
+		return c, false
+	}
+	return c, true
+}
+
+// put stores the project config c for key. The entry is written to a
+// temporary file first so that concurrent readers never see a partial entry.
+func (pc *ParseCache) put(key string, c *config.CobaltConfig) error {
+	data, err := proto.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(pc.dir, key)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), pc.entryPath(key))
+}
+
+// ReadConfigFromDirWithCache reads the whole configuration for Cobalt from a
+// directory on the file system like ReadConfigFromDir. The config of a project
+// that has an entry in cache is taken from the cache. The config of any other
+// project is parsed and, if validate is not nil, passed to validate and added
+// to the cache if it is valid. Since the cache only contains valid project
+// configs the caller only needs to validate the result if validate is nil.
+func ReadConfigFromDirWithCache(rootDir string, cache *ParseCache, validate func(*config.CobaltConfig) error) (c config.CobaltConfig, err error) {
+	r, err := newConfigReaderForDir(rootDir)
+	if err != nil {
+		return c, err
+	}
+
+	l := []projectConfig{}
+	if err := readConfigWithCache(r, &l, cache, validate); err != nil {
+		return c, err
+	}
+
+	return mergeConfigs(l), nil
+}
+
+// readConfigWithCache reads and parses the configuration for all projects from
+// a configReader, using cache as described in ReadConfigFromDirWithCache.
+func readConfigWithCache(r configReader, l *[]projectConfig, cache *ParseCache, validate func(*config.CobaltConfig) error) (err error) {
+	if err = readProjectsList(r, l); err != nil {
+		return err
+	}
+
+	for i, _ := range *l {
+		c := &((*l)[i])
+		if err = readProjectConfigWithCache(r, c, cache, validate); err != nil {
+			return fmt.Errorf("Error reading config for %v %v: %v", c.customerName, c.projectName, err)
+		}
+	}
+
+	return nil
+}
+
+// readProjectConfigWithCache reads the configuration of a particular project,
+// using cache as described in ReadConfigFromDirWithCache.
+func readProjectConfigWithCache(r configReader, c *projectConfig, cache *ParseCache, validate func(*config.CobaltConfig) error) (err error) {
+	configYaml, err := r.Project(c.customerName, c.projectName)
+	if err != nil {
+		return err
+	}
+	// The key is computed after the expansion so that a change to a shared
+	// encoding template invalidates the entries of the projects using it.
+	if configYaml, err = expandEncodingTemplates(r, configYaml); err != nil {
+		return err
+	}
+
+	key := cache.key(c, configYaml)
+	if cached, ok := cache.get(key); ok {
+		c.projectConfig = cached
+		return nil
+	}
+
+	if err = parseProjectConfig(configYaml, c); err != nil {
+		return err
+	}
+	// Only configs that were validated are added to the cache.
+	if validate == nil {
+		return nil
+	}
+	if err = validate(&c.projectConfig); err != nil {
+		return err
+	}
+	return cache.put(key, &c.projectConfig)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Tests that unchanged projects are taken from the parse cache.
+func TestReadConfigWithCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewParseCache(dir, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := memConfigReader{customers: customersYaml}
+	r.SetProject("fuchsia", "ledger", projectConfigYaml)
+	r.SetProject("fuchsia", "module_usage_tracking", projectConfigYaml)
+	r.SetProject("test_customer", "test_project", projectConfigYaml)
+
+	numValidated := 0
+	validate := func(c *config.CobaltConfig) error {
+		numValidated++
+		return nil
+	}
+
+	read := func(cache *ParseCache) []projectConfig {
+		l := []projectConfig{}
+		if err := readConfigWithCache(r, &l, cache, validate); err != nil {
+			t.Fatalf("Error reading config: %v", err)
+		}
+		return l
+	}
+
+	read(cache)
+	if numValidated != 3 {
+		t.Errorf("Expected 3 projects to be validated. Got %v.", numValidated)
+	}
+
+	// Nothing changed, all projects come from the cache.
+	numValidated = 0
+	l := read(cache)
+	if numValidated != 0 {
+		t.Errorf("Expected no project to be validated. Got %v.", numValidated)
+	}
+	for _, c := range l {
+		if 2 != len(c.projectConfig.MetricConfigs) {
+			t.Errorf("Unexpected number of metric configs for %v: %v", c.projectName, len(c.projectConfig.MetricConfigs))
+		}
+		for _, m := range c.projectConfig.MetricConfigs {
+			if m.CustomerId != c.customerId || m.ProjectId != c.projectId {
+				t.Errorf("Unexpected ids for metric %v of %v: (%v, %v)", m.Id, c.projectName, m.CustomerId, m.ProjectId)
+			}
+		}
+	}
+
+	// Only the changed project is parsed again.
+	numValidated = 0
+	r.SetProject("fuchsia", "ledger", projectConfigYaml+"\n# A comment.\n")
+	read(cache)
+	if numValidated != 1 {
+		t.Errorf("Expected 1 project to be validated. Got %v.", numValidated)
+	}
+
+	// A new parser version invalidates the cache.
+	cache, err = NewParseCache(dir, "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numValidated = 0
+	read(cache)
+	if numValidated != 3 {
+		t.Errorf("Expected 3 projects to be validated. Got %v.", numValidated)
+	}
+}
+
+// Tests that invalid projects are not added to the parse cache.
+func TestReadConfigWithCacheInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewParseCache(dir, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := memConfigReader{customers: customersYaml}
+	r.SetProject("fuchsia", "ledger", projectConfigYaml)
+	r.SetProject("fuchsia", "module_usage_tracking", projectConfigYaml)
+	r.SetProject("test_customer", "test_project", projectConfigYaml)
+
+	invalid := func(c *config.CobaltConfig) error {
+		return fmt.Errorf("invalid")
+	}
+	for i := 0; i < 2; i++ {
+		l := []projectConfig{}
+		if err := readConfigWithCache(r, &l, cache, invalid); err == nil {
+			t.Errorf("Expected an error for an invalid config.")
+		}
+	}
+
+	// Without validation nothing is added to the cache.
+	l := []projectConfig{}
+	if err := readConfigWithCache(r, &l, cache, nil); err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("Expected an empty cache. Got %v, %v.", files, err)
+	}
+}
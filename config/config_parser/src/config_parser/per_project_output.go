@@ -0,0 +1,165 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements writing the output of the cobalt config parser to one
+// file per project. See WritePerProjectOutput for details.
+
+package config_parser
+
+import (
+	"bytes"
+	"config"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The name of the manifest written by WritePerProjectOutput.
+const PerProjectManifestName = "index.json"
+
+// ProjectOutputFile describes the file holding the config of one project in
+// the manifest written by WritePerProjectOutput.
+type ProjectOutputFile struct {
+	CustomerId uint32 `json:"customer_id"`
+	ProjectId  uint32 `json:"project_id"`
+	// The name of the file, relative to the output directory.
+	File string `json:"file"`
+	// The hex-encoded SHA256 hash of the contents of the file.
+	Sha256 string `json:"sha256"`
+}
+
+// PerProjectManifest is the manifest written by WritePerProjectOutput.
+type PerProjectManifest struct {
+	Projects []ProjectOutputFile `json:"projects"`
+}
+
+// splitConfigByProject returns the part of c that belongs to each project,
+// along with the keys of the projects sorted by customer id and project id.
+func splitConfigByProject(c *config.CobaltConfig) (keys []projectKey, projects map[projectKey]*config.CobaltConfig) {
+	projects = map[projectKey]*config.CobaltConfig{}
+	get := func(customerId, projectId uint32) *config.CobaltConfig {
+		k := projectKey{customerId, projectId}
+		if projects[k] == nil {
+			projects[k] = &config.CobaltConfig{}
+			keys = append(keys, k)
+		}
+		return projects[k]
+	}
+	for _, e := range c.EncodingConfigs {
+		p := get(e.CustomerId, e.ProjectId)
+		p.EncodingConfigs = append(p.EncodingConfigs, e)
+	}
+	for _, m := range c.MetricConfigs {
+		p := get(m.CustomerId, m.ProjectId)
+		p.MetricConfigs = append(p.MetricConfigs, m)
+	}
+	for _, r := range c.ReportConfigs {
+		p := get(r.CustomerId, r.ProjectId)
+		p.ReportConfigs = append(p.ReportConfigs, r)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].customerId != keys[j].customerId {
+			return keys[i].customerId < keys[j].customerId
+		}
+		return keys[i].projectId < keys[j].projectId
+	})
+	return keys, projects
+}
+
+// WritePerProjectOutput writes the config of each project in c, formatted by
+// outputFormatter, to the file <customer id>_<project id>.<extension> in
+// outDir, which is created if it does not exist. It also writes a manifest
+// named PerProjectManifestName listing the files.
+//
+// A file whose contents did not change is not rewritten so that its
+// modification time is preserved and build systems do not rebuild the targets
+// that depend on it. The files of projects listed in the previous manifest
+// that are no longer in c are removed.
+func WritePerProjectOutput(c *config.CobaltConfig, outputFormatter OutputFormatter, outDir string, extension string) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	manifest := PerProjectManifest{Projects: []ProjectOutputFile{}}
+	written := map[string]bool{}
+	keys, projects := splitConfigByProject(c)
+	for _, k := range keys {
+		outputBytes, err := outputFormatter(projects[k])
+		if err != nil {
+			return fmt.Errorf("Error formatting the config of customer %d, project %d: %v", k.customerId, k.projectId, err)
+		}
+		name := fmt.Sprintf("%d_%d.%s", k.customerId, k.projectId, extension)
+		if err := writeFileIfChanged(filepath.Join(outDir, name), outputBytes); err != nil {
+			return err
+		}
+		hash := sha256.Sum256(outputBytes)
+		manifest.Projects = append(manifest.Projects, ProjectOutputFile{
+			CustomerId: k.customerId,
+			ProjectId:  k.projectId,
+			File:       name,
+			Sha256:     hex.EncodeToString(hash[:]),
+		})
+		written[name] = true
+	}
+
+	manifestPath := filepath.Join(outDir, PerProjectManifestName)
+	if previous, err := readPerProjectManifest(manifestPath); err == nil {
+		for _, p := range previous.Projects {
+			if !written[p.File] && filepath.Base(p.File) == p.File {
+				if err := os.Remove(filepath.Join(outDir, p.File)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileIfChanged(manifestPath, append(manifestBytes, '\n'))
+}
+
+// readPerProjectManifest reads the manifest at path.
+func readPerProjectManifest(path string) (m PerProjectManifest, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// writeFileIfChanged writes data to the file at path unless it already
+// contains data. The file is written to a temporary file first and then
+// renamed so that readers never see a partial file.
+func writeFileIfChanged(path string, data []byte) error {
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
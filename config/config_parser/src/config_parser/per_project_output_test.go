@@ -0,0 +1,130 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func perProjectTestConfig() *config.CobaltConfig {
+	return &config.CobaltConfig{
+		EncodingConfigs: []*config.EncodingConfig{
+			&config.EncodingConfig{CustomerId: 2, ProjectId: 1, Id: 1},
+			&config.EncodingConfig{CustomerId: 1, ProjectId: 5, Id: 1},
+		},
+		MetricConfigs: []*config.Metric{
+			&config.Metric{CustomerId: 1, ProjectId: 5, Id: 1, Name: "a"},
+			&config.Metric{CustomerId: 1, ProjectId: 5, Id: 2, Name: "b"},
+			&config.Metric{CustomerId: 2, ProjectId: 1, Id: 1, Name: "c"},
+		},
+		ReportConfigs: []*config.ReportConfig{
+			&config.ReportConfig{CustomerId: 1, ProjectId: 5, Id: 1},
+		},
+	}
+}
+
+func TestSplitConfigByProject(t *testing.T) {
+	c := perProjectTestConfig()
+	keys, projects := splitConfigByProject(c)
+
+	if want := []projectKey{{1, 5}, {2, 1}}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys: got %v, expected %v", keys, want)
+	}
+	p := projects[projectKey{1, 5}]
+	if len(p.EncodingConfigs) != 1 || len(p.MetricConfigs) != 2 || len(p.ReportConfigs) != 1 {
+		t.Errorf("customer 1, project 5: got %v", p)
+	}
+	p = projects[projectKey{2, 1}]
+	if len(p.EncodingConfigs) != 1 || len(p.MetricConfigs) != 1 || len(p.ReportConfigs) != 0 {
+		t.Errorf("customer 2, project 1: got %v", p)
+	}
+}
+
+func TestWritePerProjectOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "per_project_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := perProjectTestConfig()
+	if err := WritePerProjectOutput(c, BinaryOutput, dir, "pb"); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readPerProjectManifest(filepath.Join(dir, PerProjectManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Projects) != 2 || manifest.Projects[0].File != "1_5.pb" || manifest.Projects[1].File != "2_1.pb" {
+		t.Fatalf("Unexpected manifest %v", manifest)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "2_1.pb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p config.CobaltConfig
+	if err := proto.Unmarshal(data, &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.MetricConfigs) != 1 || p.MetricConfigs[0].Name != "c" {
+		t.Errorf("Unexpected config of customer 2, project 1: %v", p)
+	}
+
+	// Files whose contents do not change are not rewritten.
+	old := time.Unix(1500000000, 0)
+	for _, name := range []string{"1_5.pb", "2_1.pb"} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.MetricConfigs[0].Name = "changed"
+	c.MetricConfigs = c.MetricConfigs[:2]
+	c.EncodingConfigs = c.EncodingConfigs[1:]
+	if err := WritePerProjectOutput(c, BinaryOutput, dir, "pb"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "1_5.pb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Equal(old) {
+		t.Errorf("The changed project was not rewritten.")
+	}
+
+	// The file of the removed project is removed.
+	if _, err := os.Stat(filepath.Join(dir, "2_1.pb")); !os.IsNotExist(err) {
+		t.Errorf("The file of the removed project still exists: %v", err)
+	}
+	manifest, err = readPerProjectManifest(filepath.Join(dir, PerProjectManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Projects) != 1 || manifest.Projects[0].File != "1_5.pb" {
+		t.Errorf("Unexpected manifest %v", manifest)
+	}
+
+	// Writing the same config again leaves the files untouched.
+	if err := os.Chtimes(filepath.Join(dir, "1_5.pb"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePerProjectOutput(c, BinaryOutput, dir, "pb"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(filepath.Join(dir, "1_5.pb")); err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Errorf("The unchanged project was rewritten.")
+	}
+}
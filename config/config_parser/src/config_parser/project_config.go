@@ -20,6 +20,7 @@ package config_parser
 
 import (
 	"config"
+	"config_validator"
 	"fmt"
 	"yamlpb"
 )
@@ -30,8 +31,9 @@ type projectConfig struct {
 	customerId    uint32
 	projectName   string
 	projectId     uint32
-	contact       string
+	contacts      []string
 	projectConfig config.CobaltConfig
+	tombstones    config_validator.Tombstones
 }
 
 // Parse the configuration for one project from the yaml string provided into
@@ -99,6 +99,27 @@ func parseCustomerList(content string, l *[]projectConfig) (err error) {
 
 }
 
+// validateProjectList checks that each (customer_id, project_id) pair in the
+// merged list of projects l identifies a single project. The checks in
+// parseCustomerList and populateProjectList only catch duplicates within a
+// single customer list or project list, whereas l may combine the projects of
+// several lists.
+func validateProjectList(l []projectConfig) error {
+	projects := map[projectKey]*projectConfig{}
+	for i := range l {
+		c := &l[i]
+		k := projectKey{c.customerId, c.projectId}
+		if other, ok := projects[k]; ok {
+			if other.customerName != c.customerName {
+				return fmt.Errorf("Customer id %v and project id %v are registered under both customer '%v' and customer '%v'. (customer_id, project_id) pairs must be globally unique.", c.customerId, c.projectId, other.customerName, c.customerName)
+			}
+			return fmt.Errorf("Customer id %v and project id %v are registered for both project '%v' and project '%v' of customer '%v'. (customer_id, project_id) pairs must be globally unique.", c.customerId, c.projectId, other.projectName, c.projectName, c.customerName)
+		}
+		projects[k] = c
+	}
+	return nil
+}
+
 // populateProjectList populates a list of cobalt projects given in the form of
 // a map as returned by a call to yaml.Unmarshal. For more details, see
 // populateProjectConfig. This function also validates that project names and
@@ -137,9 +158,9 @@ func populateProjectList(y []interface{}, l *[]projectConfig) (err error) {
 
 // populateProjectConfig populates a cobalt project given in the form of a map
 // as returned by a call to yaml.Unmarshal. It populates the name, projectId and
-// contact fields of the projectConfig it returns. It also validates those
+// contacts fields of the projectConfig it returns. It also validates those
 // values. The project id must be a positive integer. The project must have
-// name, id and contact fields.
+// name, id and contact or contacts fields. See contacts.go.
 func populateProjectConfig(p map[string]interface{}, c *projectConfig) (err error) {
 	v, ok := p["name"]
 	if !ok {
@@ -165,13 +186,8 @@ func populateProjectConfig(p map[string]interface{}, c *projectConfig) (err erro
 	}
 	c.projectId = uint32(projectId)
 
-	v, ok = p["contact"]
-	if !ok {
-		return fmt.Errorf("Missing contact for project %v.", c.projectName)
-	}
-	c.contact, ok = v.(string)
-	if !ok {
-		return fmt.Errorf("Contact '%v' for project %v is not a string.", v, c.projectName)
+	if c.contacts, err = parseContacts(p, c.projectName); err != nil {
+		return err
 	}
 
 	return nil
@@ -43,14 +43,14 @@ func TestParseCustomerList(t *testing.T) {
 			customerId:   20,
 			projectName:  "ledger",
 			projectId:    1,
-			contact:      "ben",
+			contacts:     []string{"ben"},
 		},
 		projectConfig{
 			customerName: "test_project",
 			customerId:   25,
 			projectName:  "ledger",
 			projectId:    1,
-			contact:      "ben",
+			contacts:     []string{"ben"},
 		},
 	}
 
@@ -234,12 +234,12 @@ func TestPopulateProjectList(t *testing.T) {
 		projectConfig{
 			projectName: "ledger",
 			projectId:   1,
-			contact:     "ben,etienne",
+			contacts:    []string{"ben", "etienne"},
 		},
 		projectConfig{
 			projectName: "zircon",
 			projectId:   2,
-			contact:     "yvonne",
+			contacts:    []string{"yvonne"},
 		},
 	}
 	if !reflect.DeepEqual(e, l) {
@@ -282,6 +282,31 @@ func TestDuplicateProjectValuesValidation(t *testing.T) {
 	}
 }
 
+// Tests that (customer_id, project_id) pairs repeated in the merged project
+// list result in errors.
+func TestValidateProjectList(t *testing.T) {
+	l := []projectConfig{
+		projectConfig{customerName: "fuchsia", customerId: 20, projectName: "ledger", projectId: 1},
+		projectConfig{customerName: "fuchsia", customerId: 20, projectName: "zircon", projectId: 2},
+		projectConfig{customerName: "test_project", customerId: 25, projectName: "ledger", projectId: 1},
+	}
+	if err := validateProjectList(l); err != nil {
+		t.Errorf("Rejected valid project list: %v", err)
+	}
+
+	// The same pair under two customer names.
+	dup := append(l, projectConfig{customerName: "other", customerId: 20, projectName: "ledger", projectId: 1})
+	if err := validateProjectList(dup); err == nil {
+		t.Errorf("Accepted list with a (customer_id, project_id) pair under two customer names.")
+	}
+
+	// The same pair for two projects of the same customer.
+	dup = append(l[:2:2], projectConfig{customerName: "fuchsia", customerId: 20, projectName: "other", projectId: 2})
+	if err := validateProjectList(dup); err == nil {
+		t.Errorf("Accepted list with a (customer_id, project_id) pair for two projects.")
+	}
+}
+
 // Allows tests to specify inputs in yaml when testing populateProjectConfig.
 func parseProjectConfigForTest(content string, c *projectConfig) (err error) {
 	var y map[string]interface{}
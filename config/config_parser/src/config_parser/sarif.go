@@ -0,0 +1,213 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements reporting validation findings in the Static Analysis
+// Results Interchange Format (SARIF) 2.1.0, so that code review tools can
+// display them on the lines of the project configs they refer to.
+
+package config_parser
+
+import (
+	"config"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ValidationFinding describes why the config of a project is invalid.
+type ValidationFinding struct {
+	// The path of the config.yaml of the project, relative to the config
+	// directory and using forward slashes.
+	File string
+	// The line of File the finding refers to, starting at 1, or 0 if it is
+	// not known.
+	Line    int
+	Message string
+}
+
+// ValidateProjectsInDir reads the config of each project listed in
+// <rootDir>/projects.yaml separately and passes it to validate. It returns a
+// finding for each project whose config cannot be parsed or is invalid. An
+// error is returned only if the list of projects cannot be read.
+//
+// Since validate stops at the first problem, there is at most one finding per
+// project. Problems that span several projects are not found.
+func ValidateProjectsInDir(rootDir string, validate func(*config.CobaltConfig) error) (findings []ValidationFinding, err error) {
+	r, err := newConfigReaderForDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	return validateProjects(r, validate)
+}
+
+// validateProjects validates the projects read from r as described in
+// ValidateProjectsInDir.
+func validateProjects(r configReader, validate func(*config.CobaltConfig) error) (findings []ValidationFinding, err error) {
+	l := []projectConfig{}
+	if err = readProjectsList(r, &l); err != nil {
+		return nil, err
+	}
+
+	for i := range l {
+		c := &l[i]
+		file := filepath.ToSlash(filepath.Join(c.customerName, c.projectName, "config.yaml"))
+		configYaml, err := r.Project(c.customerName, c.projectName)
+		if err != nil {
+			findings = append(findings, ValidationFinding{File: file, Message: err.Error()})
+			continue
+		}
+
+		if err = readProjectConfig(r, c); err == nil {
+			err = validate(&c.projectConfig)
+		}
+		if err != nil {
+			findings = append(findings, ValidationFinding{
+				File:    file,
+				Line:    findingLine(configYaml, err.Error()),
+				Message: err.Error(),
+			})
+		}
+	}
+	return findings, nil
+}
+
+// Matches the line number in the errors of the yaml parser.
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// Matches the name of a metric, report or encoding in a project config.
+var nameLine = regexp.MustCompile(`^\s*(?:-\s*)?name:\s*(?:"([^"]+)"|'([^']+)'|(\S+))`)
+
+// findingLine makes a best effort to find the line of configYaml that the
+// error message refers to. It returns the line reported by the yaml parser if
+// there is one. Otherwise it returns the line defining the longest name that
+// is mentioned in message, or 0 if there is none.
+func findingLine(configYaml string, message string) int {
+	if m := yamlErrorLine.FindStringSubmatch(message); m != nil {
+		if line, err := strconv.Atoi(m[1]); err == nil {
+			return line
+		}
+	}
+
+	line, longest := 0, 0
+	for i, l := range strings.Split(configYaml, "\n") {
+		m := nameLine.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		name := m[1] + m[2] + m[3]
+		if len(name) > longest && strings.Contains(message, name) {
+			line, longest = i+1, len(name)
+		}
+	}
+	return line
+}
+
+// The subset of the SARIF 2.1.0 object model that is used by SarifOutput.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	Id               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	Uri       string `json:"uri"`
+	UriBaseId string `json:"uriBaseId"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+const (
+	sarifSchema        = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion       = "2.1.0"
+	sarifInvalidConfig = "invalid-project-config"
+)
+
+// SarifOutput returns findings as a SARIF log of a single run of the tool
+// config_parser with the given version. The locations of the findings are
+// relative to the base %SRCROOT%, the config directory. A log without results
+// is returned if there are no findings so that code review tools can clear
+// findings that were fixed.
+func SarifOutput(findings []ValidationFinding, version string) ([]byte, error) {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:    "config_parser",
+			Version: version,
+			Rules: []sarifRule{{
+				Id:               sarifInvalidConfig,
+				ShortDescription: sarifMessage{"The Cobalt config of the project is invalid."},
+			}},
+		}},
+		Results: []sarifResult{},
+	}
+
+	for _, f := range findings {
+		location := sarifLocation{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{Uri: f.File, UriBaseId: "%SRCROOT%"},
+		}}
+		if f.Line > 0 {
+			location.PhysicalLocation.Region = &sarifRegion{StartLine: f.Line}
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleId:    sarifInvalidConfig,
+			Level:     "error",
+			Message:   sarifMessage{f.Message},
+			Locations: []sarifLocation{location},
+		})
+	}
+
+	out, err := json.MarshalIndent(sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs:    []sarifRun{run},
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Error serializing the SARIF log: %v", err)
+	}
+	return out, nil
+}
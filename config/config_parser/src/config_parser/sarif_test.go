@@ -0,0 +1,102 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Tests that each invalid project yields a finding that points to the
+// offending line of its config.
+func TestValidateProjects(t *testing.T) {
+	r := memConfigReader{customers: customersYaml}
+	r.SetProject("fuchsia", "ledger", projectConfigYaml)
+	r.SetProject("fuchsia", "module_usage_tracking", "metric_configs:\n- id: 1\n  name: [\n")
+	r.SetProject("test_customer", "test_project", projectConfigYaml)
+
+	validate := func(c *config.CobaltConfig) error {
+		if c.MetricConfigs[0].CustomerId == 100 {
+			return fmt.Errorf("Error validating metric %v: invalid.", c.MetricConfigs[1].Name)
+		}
+		return nil
+	}
+	findings, err := validateProjects(r, validate)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("Expected 2 findings. Got %v.", findings)
+	}
+
+	// The yaml parser reports the line of the syntax error.
+	if findings[0].File != "fuchsia/module_usage_tracking/config.yaml" || findings[0].Line == 0 {
+		t.Errorf("Unexpected finding for the parse error: %v", findings[0])
+	}
+	// The line of the metric named in the error.
+	expected := ValidationFinding{
+		File:    "test_customer/test_project/config.yaml",
+		Line:    11,
+		Message: "Error validating metric Module views: invalid.",
+	}
+	if findings[1] != expected {
+		t.Errorf("Expected finding %v. Got %v.", expected, findings[1])
+	}
+}
+
+// Tests the line lookup for messages without a known line.
+func TestFindingLine(t *testing.T) {
+	yaml := "- id: 1\n  name: Foo\n- id: 2\n  name: 'FooBar'\n"
+	if line := findingLine(yaml, "Error validating report FooBar (2): bad."); line != 4 {
+		t.Errorf("Expected line 4. Got %v.", line)
+	}
+	if line := findingLine(yaml, "Error validating report Foo (1): bad."); line != 2 {
+		t.Errorf("Expected line 2. Got %v.", line)
+	}
+	if line := findingLine(yaml, "Encoding id '0' is invalid."); line != 0 {
+		t.Errorf("Expected line 0. Got %v.", line)
+	}
+}
+
+// Tests that the findings are serialized as a SARIF log.
+func TestSarifOutput(t *testing.T) {
+	out, err := SarifOutput([]ValidationFinding{
+		{File: "a/b/config.yaml", Line: 3, Message: "bad"},
+		{File: "a/c/config.yaml", Message: "worse"},
+	}, "v1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var log sarifLog
+	if err := json.Unmarshal(out, &log); err != nil {
+		t.Fatalf("Unable to parse the output: %v", err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 || log.Runs[0].Tool.Driver.Version != "v1" {
+		t.Fatalf("Unexpected log: %s", out)
+	}
+	results := log.Runs[0].Results
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results. Got %s.", out)
+	}
+	if !reflect.DeepEqual(results[0].Locations[0].PhysicalLocation.Region, &sarifRegion{StartLine: 3}) {
+		t.Errorf("Expected the first result to start at line 3. Got %s.", out)
+	}
+	if results[1].Locations[0].PhysicalLocation.Region != nil || results[1].Message.Text != "worse" {
+		t.Errorf("Expected the second result to have no region. Got %s.", out)
+	}
+
+	// A log without findings has an empty list of results.
+	out, err = SarifOutput(nil, "v1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := json.Unmarshal(out, &log); err != nil || log.Runs[0].Results == nil {
+		t.Errorf("Expected an empty list of results. Got %s.", out)
+	}
+}
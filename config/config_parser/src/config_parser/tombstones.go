@@ -0,0 +1,87 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements reading the tombstones of Cobalt projects. A project
+// may list the ids of its deleted metrics, encodings and reports in
+// <rootDir>/<customerName>/<projectName>/tombstones.yaml:
+//
+//   metric_ids: [3, 7]
+//   encoding_ids: [2]
+//   report_ids: [4]
+//
+// The validator rejects configs that reuse one of those ids. See
+// config_validator.ValidateTombstones.
+
+package config_parser
+
+import (
+	"config_validator"
+	"fmt"
+	yaml "github.com/go-yaml/yaml"
+)
+
+// parseTombstones parses the tombstones of a project from the yaml string
+// provided into the tombstones field in projectConfig.
+func parseTombstones(y string, c *projectConfig) (err error) {
+	var m map[string][]uint32
+	if err := yaml.Unmarshal([]byte(y), &m); err != nil {
+		return fmt.Errorf("Error while parsing the yaml for the tombstones: %v", err)
+	}
+
+	c.tombstones = config_validator.Tombstones{CustomerId: c.customerId, ProjectId: c.projectId}
+	for k, ids := range m {
+		switch k {
+		case "metric_ids":
+			c.tombstones.MetricIds = ids
+		case "encoding_ids":
+			c.tombstones.EncodingIds = ids
+		case "report_ids":
+			c.tombstones.ReportIds = ids
+		default:
+			return fmt.Errorf("Unknown field '%v' in the tombstones. Only metric_ids, encoding_ids and report_ids are allowed.", k)
+		}
+	}
+
+	return nil
+}
+
+// readTombstones reads and parses the tombstones of all projects in |l| from
+// a configReader.
+func readTombstones(r configReader, l []projectConfig) (err error) {
+	for i := range l {
+		c := &l[i]
+		tombstonesYaml, err := r.Tombstones(c.customerName, c.projectName)
+		if err != nil {
+			return err
+		}
+		if err = parseTombstones(tombstonesYaml, c); err != nil {
+			return fmt.Errorf("Error reading tombstones for %v %v: %v", c.customerName, c.projectName, err)
+		}
+	}
+	return nil
+}
+
+// ReadTombstonesFromDir reads the tombstones of all projects whose
+// configuration is stored in a directory on the file system. See
+// ReadConfigFromDir for the organization of the directory.
+func ReadTombstonesFromDir(rootDir string) (tombstones []config_validator.Tombstones, err error) {
+	r, err := newConfigReaderForDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := []projectConfig{}
+	if err = readProjectsList(r, &l); err != nil {
+		return nil, err
+	}
+
+	if err = readTombstones(r, l); err != nil {
+		return nil, err
+	}
+
+	for _, c := range l {
+		tombstones = append(tombstones, c.tombstones)
+	}
+	return tombstones, nil
+}
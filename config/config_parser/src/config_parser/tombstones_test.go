@@ -0,0 +1,88 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_parser
+
+import (
+	"config_validator"
+	"reflect"
+	"testing"
+)
+
+// Tests that the tombstones of a project are parsed and tagged with the ids
+// of the project.
+func TestParseTombstones(t *testing.T) {
+	y := `
+metric_ids: [3, 7]
+encoding_ids: [2]
+report_ids:
+- 4
+- 5
+`
+	c := projectConfig{customerId: 10, projectId: 5}
+	if err := parseTombstones(y, &c); err != nil {
+		t.Fatalf("Error parsing tombstones: %v", err)
+	}
+
+	expected := config_validator.Tombstones{
+		CustomerId:  10,
+		ProjectId:   5,
+		MetricIds:   []uint32{3, 7},
+		EncodingIds: []uint32{2},
+		ReportIds:   []uint32{4, 5},
+	}
+	if !reflect.DeepEqual(expected, c.tombstones) {
+		t.Errorf("%v != %v", expected, c.tombstones)
+	}
+}
+
+// Tests that an empty tombstones file is accepted.
+func TestParseTombstonesEmpty(t *testing.T) {
+	c := projectConfig{customerId: 10, projectId: 5}
+	if err := parseTombstones("", &c); err != nil {
+		t.Fatalf("Error parsing empty tombstones: %v", err)
+	}
+
+	expected := config_validator.Tombstones{CustomerId: 10, ProjectId: 5}
+	if !reflect.DeepEqual(expected, c.tombstones) {
+		t.Errorf("%v != %v", expected, c.tombstones)
+	}
+}
+
+// Tests that unknown fields and invalid ids are rejected.
+func TestParseTombstonesInvalid(t *testing.T) {
+	for _, y := range []string{
+		"metric_id: [3]",
+		"metric_ids: [a]",
+		"metric_ids: 3",
+	} {
+		c := projectConfig{}
+		if err := parseTombstones(y, &c); err == nil {
+			t.Errorf("Accepted invalid tombstones: %v", y)
+		}
+	}
+}
+
+// Tests that the tombstones are read for each project.
+func TestReadTombstones(t *testing.T) {
+	r := memConfigReader{}
+	r.SetTombstones("fuchsia", "ledger", "metric_ids: [1]")
+	l := []projectConfig{
+		projectConfig{customerName: "fuchsia", customerId: 1, projectName: "ledger", projectId: 100},
+		projectConfig{customerName: "fuchsia", customerId: 1, projectName: "module_usage_tracking", projectId: 101},
+	}
+	if err := readTombstones(r, l); err != nil {
+		t.Fatalf("Error reading tombstones: %v", err)
+	}
+
+	expected := []config_validator.Tombstones{
+		config_validator.Tombstones{CustomerId: 1, ProjectId: 100, MetricIds: []uint32{1}},
+		config_validator.Tombstones{CustomerId: 1, ProjectId: 101},
+	}
+	for i := range l {
+		if !reflect.DeepEqual(expected[i], l[i].tombstones) {
+			t.Errorf("%v != %v", expected[i], l[i].tombstones)
+		}
+	}
+}
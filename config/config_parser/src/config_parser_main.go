@@ -11,11 +11,14 @@ import (
 	"config"
 	"config_parser"
 	"config_validator"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,20 +27,50 @@ import (
 
 var (
 	repoUrl        = flag.String("repo_url", "", "URL of the repository containing the config. Exactly one of 'repo_url', 'config_file' or 'config_dir' must be specified.")
+	repoRef        = flag.String("repo_ref", "", "Branch, tag or full commit hash of 'repo_url' from which the config is read. Defaults to the default branch. If it is a commit hash, the config is only read from that commit. Requires 'repo_url'.")
+	repoCommit     = flag.String("repo_commit", "", "Full hash of the commit from which the config must be read. The program exits with an error if 'repo_ref' resolves to another commit, e.g. because a tag was moved. Requires 'repo_url'.")
 	configDir      = flag.String("config_dir", "", "Directory containing the config. Exactly one of 'repo_url', 'config_file' or 'config_dir' must be specified.")
 	configFile     = flag.String("config_file", "", "File containing the config for a single project. Exactly one of 'repo_url', 'config_file' or 'config_dir' must be specified.")
 	outFile        = flag.String("output_file", "", "File to which the serialized config should be written. Defaults to stdout.")
+	perProjectDir  = flag.String("per_project_output_dir", "", "Directory to which the config of each (customer, project) is written to a separate file named <customer_id>_<project_id>.<ext> in the format specified by 'out_format', along with a manifest index.json listing the files. Files whose contents did not change are not rewritten. Cannot be used with 'output_file', 'check_only' and -dep_file.")
 	checkOnly      = flag.Bool("check_only", false, "Only check that the configuration is valid.")
 	skipValidation = flag.Bool("skip_validation", false, "Skip validating the config, write it no matter what.")
 	gitTimeoutSec  = flag.Int64("git_timeout", 60, "How many seconds should I wait on git commands?")
 	customerId     = flag.Int64("customer_id", -1, "Customer Id for the config to be read. Must be set if and only if 'config_file' is set.")
 	projectId      = flag.Int64("project_id", -1, "Project Id for the config to be read. Must be set if and only if 'config_file' is set.")
-	outFormat      = flag.String("out_format", "bin", "Specifies the output format. Supports 'bin' (serialized proto), 'b64' (serialized proto to base 64) and 'cpp' (ta C++ file containing a variable with a base64-encoded serialized proto.)")
-	varName        = flag.String("var_name", "config", "When using the 'cpp' output format, this will specify the variable name to be used in the output.")
-	namespace      = flag.String("namespace", "", "When using the 'cpp' output format, this will specify the comma-separated namespace within which the config variable must be places.")
+	outFormat      = flag.String("out_format", "bin", "Specifies the output format. Supports 'bin' (serialized proto), 'b64' (serialized proto to base 64), 'cpp' (ta C++ file containing a variable with a base64-encoded serialized proto and build metadata.), 'dart' and 'rust' (a Dart library or Rust source file with the same contents as the 'cpp' output), 'json' (the proto in the canonical protobuf JSON encoding) and 'markdown' (human-readable documentation of the registry)")
+	varName        = flag.String("var_name", "config", "When using the 'cpp', 'dart' or 'rust' output format, this will specify the variable name to be used in the output.")
+	namespace      = flag.String("namespace", "", "When using the 'cpp' output format, this will specify the comma-separated namespace within which the config variable must be places. When using the 'dart' output format, the components are joined with '.' into the library name and when using the 'rust' output format they are the nested modules within which the constants are defined.")
+	overlayDir     = flag.String("overlay_dir", "", "Directory containing an environment-specific overlay of the config in 'config_dir'. Report export configs found in the overlay replace those of the config. Requires -config_dir.")
 	depFile        = flag.String("dep_file", "", "Generate a depfile (see gn documentation) that lists all the project configuration files. Requires -output_file and -config_dir.")
+	printVersion   = flag.Bool("version", false, "Print the version of this binary and exit.")
+	parseCacheDir  = flag.String("parse_cache_dir", "", "Directory in which the parsed configs of valid projects are cached. Projects whose config.yaml did not change since they were cached are neither parsed nor validated again. Requires -config_dir and cannot be used with -overlay_dir, 'customer_id' and 'project_id'.")
+
+	sarifFile = flag.String("sarif_file", "", "File to which the validation findings of the projects in -config_dir are written in the SARIF format so that code review tools can display them on the lines of the configs. The program exits with an error after writing the file if there are findings. Requires -config_dir and cannot be used with -skip_validation, 'customer_id' and 'project_id'.")
+
+	contactDomains = flag.String("contact_domains", "", "Comma-separated list of email domains. If set, the contacts of all projects in -config_dir must be email addresses in one of these domains. Requires -config_dir and cannot be used with -skip_validation.")
+	ownershipFile  = flag.String("ownership_file", "", "File to which the customer and project names and ids of the projects in -config_dir are written in JSON along with their contacts, for use by on-call tooling. Requires -config_dir.")
+)
+
+// The version and source commit of this binary. They are set at link time with
+// -ldflags "-X main.version=<version> -X main.commit=<commit>".
+var (
+	version = "unknown"
+	commit  = "unknown"
 )
 
+// The extension of the files written with -per_project_output_dir for each
+// 'out_format'.
+var outputExtensions = map[string]string{
+	"bin":      "pb",
+	"b64":      "b64",
+	"cpp":      "h",
+	"dart":     "dart",
+	"rust":     "rs",
+	"json":     "json",
+	"markdown": "md",
+}
+
 // Write a depfile listing the files in 'files' at the location specified by
 // outFile.
 func writeDepFile(outFile string, files []string, depFile string) error {
@@ -51,13 +84,88 @@ func writeDepFile(outFile string, files []string, depFile string) error {
 	return err
 }
 
+// generationTime returns the time to record as the generation time of the
+// output. For reproducible builds this is taken from the SOURCE_DATE_EPOCH
+// environment variable if it is set.
+func generationTime() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			glog.Exitf("SOURCE_DATE_EPOCH must be an integer: %v", err)
+		}
+		return time.Unix(seconds, 0)
+	}
+	return time.Now()
+}
+
+// parserVersion returns a fingerprint of the parser for use as the version of
+// the parse cache. It is the hash of this binary and, if it is specified, of
+// the binary used by the common validations so that the cache is invalidated
+// whenever either of them is rebuilt. The project ID partition that is
+// enforced is also part of the hash since it changes which projects are valid.
+func parserVersion() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	files := []string{executable}
+	if f := flag.Lookup("config_validator_bin"); f != nil && f.Value.String() != "" {
+		files = append(files, f.Value.String())
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		in, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, in)
+		in.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if f := flag.Lookup("enforce_id_partition"); f != nil {
+		fmt.Fprintf(h, "\x00%s", f.Value.String())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readConfigFromDirWithCache reads the config from configDir using the parse
+// cache in cacheDir. Unless -skip_validation is set the projects that are not
+// found in the cache are validated one by one.
+func readConfigFromDirWithCache(configDir string, cacheDir string) (c config.CobaltConfig, err error) {
+	version, err := parserVersion()
+	if err != nil {
+		return c, err
+	}
+	cache, err := config_parser.NewParseCache(cacheDir, version)
+	if err != nil {
+		return c, err
+	}
+	validate := config_validator.ValidateConfig
+	if *skipValidation {
+		validate = nil
+	}
+	return config_parser.ReadConfigFromDirWithCache(configDir, cache, validate)
+}
+
 func main() {
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Printf("config_parser version %s, commit %s\n", version, commit)
+		os.Exit(0)
+	}
+
 	if (*repoUrl == "") == (*configDir == "") == (*configFile == "") {
 		glog.Exit("Exactly one of 'repo_url', 'config_file' and 'config_dir' must be set.")
 	}
 
+	if (*repoRef != "" || *repoCommit != "") && *repoUrl == "" {
+		glog.Exit("'repo_ref' and 'repo_commit' require 'repo_url'.")
+	}
+
 	if *configFile == "" && *configDir == "" && (*customerId >= 0 || *projectId >= 0) {
 		glog.Exit("'customer_id' and 'project_id' must be set if and only if 'config_file' or 'config_dir' are set.")
 	}
@@ -70,6 +178,10 @@ func main() {
 		glog.Exit("'output_file' does not make sense if 'check_only' is set.")
 	}
 
+	if *perProjectDir != "" && (*outFile != "" || *checkOnly || *depFile != "") {
+		glog.Exit("-per_project_output_dir cannot be used with 'output_file', 'check_only' and -dep_file.")
+	}
+
 	if *depFile != "" && *configDir == "" {
 		glog.Exit("-dep_file requires -config_dir")
 	}
@@ -78,6 +190,26 @@ func main() {
 		glog.Exit("-dep_file requires -output_file")
 	}
 
+	if *overlayDir != "" && (*configDir == "" || *customerId >= 0 || *projectId >= 0) {
+		glog.Exit("-overlay_dir requires -config_dir and cannot be used with 'customer_id' and 'project_id'.")
+	}
+
+	if *parseCacheDir != "" && (*configDir == "" || *overlayDir != "" || *customerId >= 0 || *projectId >= 0) {
+		glog.Exit("-parse_cache_dir requires -config_dir and cannot be used with -overlay_dir, 'customer_id' and 'project_id'.")
+	}
+
+	if *sarifFile != "" && (*configDir == "" || *skipValidation || *customerId >= 0 || *projectId >= 0) {
+		glog.Exit("-sarif_file requires -config_dir and cannot be used with -skip_validation, 'customer_id' and 'project_id'.")
+	}
+
+	if *contactDomains != "" && (*configDir == "" || *skipValidation) {
+		glog.Exit("-contact_domains requires -config_dir and cannot be used with -skip_validation.")
+	}
+
+	if *ownershipFile != "" && *configDir == "" {
+		glog.Exit("-ownership_file requires -config_dir.")
+	}
+
 	var configLocation string
 	if *repoUrl != "" {
 		configLocation = *repoUrl
@@ -93,37 +225,68 @@ func main() {
 			glog.Exit(err)
 		}
 
+		if *overlayDir != "" {
+			overlayFiles, err := config_parser.GetOverlayFilesListFromOverlayDir(configLocation, *overlayDir)
+			if err != nil {
+				glog.Exit(err)
+			}
+			files = append(files, overlayFiles...)
+		}
+
 		if err := writeDepFile(*outFile, files, *depFile); err != nil {
 			glog.Exit(err)
 		}
 	}
 
-	var outputFormatter config_parser.OutputFormatter
-	switch *outFormat {
-	case "bin":
-		outputFormatter = config_parser.BinaryOutput
-	case "b64":
-		outputFormatter = config_parser.Base64Output
-	case "cpp":
-		namespaceList := []string{}
-		if *namespace != "" {
-			namespaceList = strings.Split(*namespace, ",")
+	// The projects are validated one by one so that each finding can be
+	// attributed to the config of a project.
+	if *sarifFile != "" {
+		findings, err := config_parser.ValidateProjectsInDir(*configDir, config_validator.ValidateConfig)
+		if err != nil {
+			glog.Exit(err)
+		}
+		out, err := config_parser.SarifOutput(findings, version)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if err := ioutil.WriteFile(*sarifFile, out, 0644); err != nil {
+			glog.Exit(err)
+		}
+		if len(findings) > 0 {
+			glog.Exitf("Found %d invalid projects. See %s.", len(findings), *sarifFile)
+		}
+	}
+
+	if *contactDomains != "" {
+		if err := config_parser.ValidateContactsInDir(*configDir, strings.Split(*contactDomains, ",")); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	if *ownershipFile != "" {
+		out, err := config_parser.OwnershipJSONFromDir(*configDir)
+		if err != nil {
+			glog.Exit(err)
+		}
+		if err := ioutil.WriteFile(*ownershipFile, out, 0644); err != nil {
+			glog.Exit(err)
 		}
-		outputFormatter = config_parser.CppOutputFactory(*varName, namespaceList, configLocation)
-	default:
-		glog.Exitf("'%v' is an invalid out_format parameter. 'bin', 'b64' and 'cpp' are the only valid values for out_format.", *outFormat)
 	}
 
 	// First, we parse the configuration from the specified location.
 	var c config.CobaltConfig
+	var tombstones []config_validator.Tombstones
 	var err error
+	buildMetadata := config_parser.BuildMetadata{GenerationTime: generationTime()}
 	if *repoUrl != "" {
 		gitTimeout := time.Duration(*gitTimeoutSec) * time.Second
-		c, err = config_parser.ReadConfigFromRepo(*repoUrl, gitTimeout)
+		c, tombstones, buildMetadata.SourceCommit, err = config_parser.ReadConfigFromRepo(*repoUrl, *repoRef, *repoCommit, gitTimeout)
 	} else if *configFile != "" {
 		c, err = config_parser.ReadConfigFromYaml(*configFile, uint32(*customerId), uint32(*projectId))
 	} else if *customerId >= 0 && *projectId >= 0 {
 		c, err = config_parser.ReadProjectConfigFromDir(*configDir, uint32(*customerId), uint32(*projectId))
+	} else if *parseCacheDir != "" {
+		c, err = readConfigFromDirWithCache(*configDir, *parseCacheDir)
 	} else {
 		c, err = config_parser.ReadConfigFromDir(*configDir)
 	}
@@ -132,10 +295,66 @@ func main() {
 		glog.Exit(err)
 	}
 
+	// The tombstones of the projects are read from the same directory as the
+	// config. A single config file has no tombstones.
+	if *configDir != "" {
+		if tombstones, err = config_parser.ReadTombstonesFromDir(*configDir); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	if *overlayDir != "" {
+		if err = config_parser.ApplyOverlayFromDir(&c, *configDir, *overlayDir); err != nil {
+			glog.Exit(err)
+		}
+	}
+
 	if !*skipValidation {
-		if err = config_validator.ValidateConfig(&c); err != nil {
+		// With a parse cache the projects have already been validated one by
+		// one. See readConfigFromDirWithCache.
+		if *parseCacheDir == "" {
+			if err = config_validator.ValidateConfig(&c); err != nil {
+				glog.Exit(err)
+			}
+		}
+
+		if err = config_validator.ValidateTombstones(&c, tombstones); err != nil {
+			glog.Exit(err)
+		}
+	}
+
+	var outputFormatter config_parser.OutputFormatter
+	switch *outFormat {
+	case "bin":
+		outputFormatter = config_parser.BinaryOutput
+	case "b64":
+		outputFormatter = config_parser.Base64Output
+	case "cpp", "dart", "rust":
+		namespaceList := []string{}
+		if *namespace != "" {
+			namespaceList = strings.Split(*namespace, ",")
+		}
+		switch *outFormat {
+		case "cpp":
+			outputFormatter = config_parser.CppOutputFactory(*varName, namespaceList, configLocation, buildMetadata)
+		case "dart":
+			outputFormatter = config_parser.DartOutputFactory(*varName, namespaceList, configLocation, buildMetadata)
+		case "rust":
+			outputFormatter = config_parser.RustOutputFactory(*varName, namespaceList, configLocation, buildMetadata)
+		}
+	case "json":
+		outputFormatter = config_parser.JsonOutput
+	case "markdown":
+		outputFormatter = config_parser.MarkdownOutput
+	default:
+		glog.Exitf("'%v' is an invalid out_format parameter. 'bin', 'b64', 'cpp', 'dart', 'rust', 'json' and 'markdown' are the only valid values for out_format.", *outFormat)
+	}
+
+	if *perProjectDir != "" {
+		if err = config_parser.WritePerProjectOutput(&c, outputFormatter, *perProjectDir, outputExtensions[*outFormat]); err != nil {
 			glog.Exit(err)
 		}
+		os.Exit(0)
 	}
 
 	// Then, we serialize the configuration.
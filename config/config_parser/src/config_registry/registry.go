@@ -0,0 +1,126 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package config_registry provides indexed lookups into a CobaltConfig.
+//
+// The repeated fields of a CobaltConfig list the metrics, encodings and
+// reports of all projects. A Registry is built once from a parsed
+// CobaltConfig and answers lookups by id in constant time, so that the
+// validator and the Go services embedding the config do not have to scan the
+// repeated fields.
+package config_registry
+
+import (
+	"config"
+)
+
+// key identifies a metric, encoding or report within a CobaltConfig.
+type key struct {
+	customerId uint32
+	projectId  uint32
+	id         uint32
+}
+
+// projectKey identifies a project within a CobaltConfig.
+type projectKey struct {
+	customerId uint32
+	projectId  uint32
+}
+
+// Registry indexes the contents of a CobaltConfig. A Registry must not be
+// modified after it has been built and neither may the CobaltConfig it was
+// built from, but it may be used concurrently by multiple goroutines.
+type Registry struct {
+	config *config.CobaltConfig
+
+	metrics   map[key]*config.Metric
+	encodings map[key]*config.EncodingConfig
+	reports   map[key]*config.ReportConfig
+
+	// The reports of each metric, keyed by the id of the metric.
+	reportsByMetric map[key][]*config.ReportConfig
+
+	// The encodings of each project.
+	encodingsByProject map[projectKey][]*config.EncodingConfig
+}
+
+// NewRegistry returns the Registry for |c|. If an id is repeated, which the
+// validator rejects, lookups by that id return the first entry with it.
+func NewRegistry(c *config.CobaltConfig) *Registry {
+	if c == nil {
+		panic("c is nil")
+	}
+
+	r := &Registry{
+		config:             c,
+		metrics:            make(map[key]*config.Metric, len(c.MetricConfigs)),
+		encodings:          make(map[key]*config.EncodingConfig, len(c.EncodingConfigs)),
+		reports:            make(map[key]*config.ReportConfig, len(c.ReportConfigs)),
+		reportsByMetric:    make(map[key][]*config.ReportConfig),
+		encodingsByProject: make(map[projectKey][]*config.EncodingConfig),
+	}
+
+	for _, m := range c.MetricConfigs {
+		k := key{m.CustomerId, m.ProjectId, m.Id}
+		if _, ok := r.metrics[k]; !ok {
+			r.metrics[k] = m
+		}
+	}
+
+	for _, e := range c.EncodingConfigs {
+		k := key{e.CustomerId, e.ProjectId, e.Id}
+		if _, ok := r.encodings[k]; !ok {
+			r.encodings[k] = e
+		}
+		p := projectKey{e.CustomerId, e.ProjectId}
+		r.encodingsByProject[p] = append(r.encodingsByProject[p], e)
+	}
+
+	for _, report := range c.ReportConfigs {
+		k := key{report.CustomerId, report.ProjectId, report.Id}
+		if _, ok := r.reports[k]; !ok {
+			r.reports[k] = report
+		}
+		m := key{report.CustomerId, report.ProjectId, report.MetricId}
+		r.reportsByMetric[m] = append(r.reportsByMetric[m], report)
+	}
+
+	return r
+}
+
+// Config returns the CobaltConfig the Registry was built from.
+func (r *Registry) Config() *config.CobaltConfig {
+	return r.config
+}
+
+// GetMetric returns the metric with the given ids or nil if there is none.
+func (r *Registry) GetMetric(customerId, projectId, id uint32) *config.Metric {
+	return r.metrics[key{customerId, projectId, id}]
+}
+
+// GetEncoding returns the encoding config with the given ids or nil if there
+// is none.
+func (r *Registry) GetEncoding(customerId, projectId, id uint32) *config.EncodingConfig {
+	return r.encodings[key{customerId, projectId, id}]
+}
+
+// GetReport returns the report config with the given ids or nil if there is
+// none.
+func (r *Registry) GetReport(customerId, projectId, id uint32) *config.ReportConfig {
+	return r.reports[key{customerId, projectId, id}]
+}
+
+// ReportsForMetric returns the report configs of the metric with the given
+// ids in the order in which they appear in the CobaltConfig. The result must
+// not be modified.
+func (r *Registry) ReportsForMetric(customerId, projectId, metricId uint32) []*config.ReportConfig {
+	return r.reportsByMetric[key{customerId, projectId, metricId}]
+}
+
+// EncodingsForProject returns the encoding configs of the project with the
+// given ids in the order in which they appear in the CobaltConfig. The result
+// must not be modified.
+func (r *Registry) EncodingsForProject(customerId, projectId uint32) []*config.EncodingConfig {
+	return r.encodingsByProject[projectKey{customerId, projectId}]
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_registry
+
+import (
+	"config"
+	"testing"
+)
+
+func makeTestConfig() *config.CobaltConfig {
+	return &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			{CustomerId: 1, ProjectId: 1, Id: 1, Name: "a"},
+			{CustomerId: 1, ProjectId: 2, Id: 1, Name: "b"},
+			{CustomerId: 1, ProjectId: 1, Id: 1, Name: "duplicate"},
+		},
+		EncodingConfigs: []*config.EncodingConfig{
+			{CustomerId: 1, ProjectId: 1, Id: 1},
+			{CustomerId: 1, ProjectId: 1, Id: 2},
+			{CustomerId: 2, ProjectId: 1, Id: 1},
+		},
+		ReportConfigs: []*config.ReportConfig{
+			{CustomerId: 1, ProjectId: 1, Id: 1, MetricId: 1, Name: "r1"},
+			{CustomerId: 1, ProjectId: 1, Id: 2, MetricId: 1, Name: "r2"},
+			{CustomerId: 1, ProjectId: 2, Id: 1, MetricId: 1, Name: "r3"},
+		},
+	}
+}
+
+// Tests the lookups of single entries by id.
+func TestGet(t *testing.T) {
+	c := makeTestConfig()
+	r := NewRegistry(c)
+
+	if r.Config() != c {
+		t.Errorf("Config() did not return the config the registry was built from.")
+	}
+
+	if m := r.GetMetric(1, 2, 1); m != c.MetricConfigs[1] {
+		t.Errorf("GetMetric(1, 2, 1) = %v, expected %v", m, c.MetricConfigs[1])
+	}
+	// The first of repeated entries is returned.
+	if m := r.GetMetric(1, 1, 1); m != c.MetricConfigs[0] {
+		t.Errorf("GetMetric(1, 1, 1) = %v, expected %v", m, c.MetricConfigs[0])
+	}
+	if m := r.GetMetric(2, 1, 1); m != nil {
+		t.Errorf("GetMetric(2, 1, 1) = %v, expected nil", m)
+	}
+
+	if e := r.GetEncoding(2, 1, 1); e != c.EncodingConfigs[2] {
+		t.Errorf("GetEncoding(2, 1, 1) = %v, expected %v", e, c.EncodingConfigs[2])
+	}
+	if e := r.GetEncoding(1, 2, 1); e != nil {
+		t.Errorf("GetEncoding(1, 2, 1) = %v, expected nil", e)
+	}
+
+	if report := r.GetReport(1, 1, 2); report != c.ReportConfigs[1] {
+		t.Errorf("GetReport(1, 1, 2) = %v, expected %v", report, c.ReportConfigs[1])
+	}
+	if report := r.GetReport(1, 1, 3); report != nil {
+		t.Errorf("GetReport(1, 1, 3) = %v, expected nil", report)
+	}
+}
+
+// Tests the lookups of the reports of a metric and the encodings of a project.
+func TestIndexes(t *testing.T) {
+	c := makeTestConfig()
+	r := NewRegistry(c)
+
+	reports := r.ReportsForMetric(1, 1, 1)
+	if len(reports) != 2 || reports[0] != c.ReportConfigs[0] || reports[1] != c.ReportConfigs[1] {
+		t.Errorf("ReportsForMetric(1, 1, 1) = %v, expected the first two reports", reports)
+	}
+	if reports := r.ReportsForMetric(1, 2, 1); len(reports) != 1 || reports[0] != c.ReportConfigs[2] {
+		t.Errorf("ReportsForMetric(1, 2, 1) = %v, expected the third report", reports)
+	}
+	if reports := r.ReportsForMetric(1, 1, 2); len(reports) != 0 {
+		t.Errorf("ReportsForMetric(1, 1, 2) = %v, expected no reports", reports)
+	}
+
+	encodings := r.EncodingsForProject(1, 1)
+	if len(encodings) != 2 || encodings[0] != c.EncodingConfigs[0] || encodings[1] != c.EncodingConfigs[1] {
+		t.Errorf("EncodingsForProject(1, 1) = %v, expected the first two encodings", encodings)
+	}
+	if encodings := r.EncodingsForProject(3, 1); len(encodings) != 0 {
+		t.Errorf("EncodingsForProject(3, 1) = %v, expected no encodings", encodings)
+	}
+}
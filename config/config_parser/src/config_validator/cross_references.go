@@ -0,0 +1,104 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements a validation pass that cross-references the metric
+// parts used by report variables with the encodings that are able to encode
+// them, in order to reject reports whose Observations cannot be produced by
+// any encoding of their project.
+
+package config_validator
+
+import (
+	"config"
+	"config_registry"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// metricPartKey identifies a part of a metric.
+type metricPartKey struct {
+	customerId uint32
+	projectId  uint32
+	metricId   uint32
+	part       string
+}
+
+// crossReferences links each metric part referenced by a report variable to
+// the encodings of its project that can encode it and to the reports that
+// reference it.
+type crossReferences struct {
+	// The metric parts in the order in which they are first referenced.
+	parts     []metricPartKey
+	dataTypes map[metricPartKey]config.MetricPart_DataType
+	encodings map[metricPartKey][]*config.EncodingConfig
+	reports   map[metricPartKey][]*config.ReportConfig
+}
+
+// buildCrossReferences builds the crossReferences of |c|. Report variables
+// that refer to unknown metrics or metric parts are skipped since they are
+// reported by validateConfiguredReports.
+func buildCrossReferences(c *config.CobaltConfig) *crossReferences {
+	registry := config_registry.NewRegistry(c)
+	refs := &crossReferences{
+		dataTypes: map[metricPartKey]config.MetricPart_DataType{},
+		encodings: map[metricPartKey][]*config.EncodingConfig{},
+		reports:   map[metricPartKey][]*config.ReportConfig{},
+	}
+
+	for _, report := range c.ReportConfigs {
+		metric := registry.GetMetric(report.CustomerId, report.ProjectId, report.MetricId)
+		if metric == nil {
+			continue
+		}
+		for _, v := range report.Variable {
+			if v == nil {
+				continue
+			}
+			p, ok := metric.Parts[v.MetricPart]
+			if !ok || p == nil {
+				continue
+			}
+
+			k := metricPartKey{report.CustomerId, report.ProjectId, report.MetricId, v.MetricPart}
+			if _, ok := refs.dataTypes[k]; !ok {
+				refs.parts = append(refs.parts, k)
+				refs.dataTypes[k] = p.DataType
+				for _, e := range registry.EncodingsForProject(k.customerId, k.projectId) {
+					if canEncodeDataType(e, p.DataType) {
+						refs.encodings[k] = append(refs.encodings[k], e)
+					}
+				}
+			}
+			if reports := refs.reports[k]; len(reports) == 0 || reports[len(reports)-1] != report {
+				refs.reports[k] = append(refs.reports[k], report)
+			}
+		}
+	}
+	return refs
+}
+
+// validateCrossReferences checks that every metric part referenced by a report
+// variable can be encoded by at least one encoding of its project. Otherwise
+// no Observation could ever be produced for the report.
+func validateCrossReferences(c *config.CobaltConfig) (err error) {
+	refs := buildCrossReferences(c)
+
+	for _, k := range refs.parts {
+		if len(refs.encodings[k]) > 0 {
+			continue
+		}
+
+		reportIds := make([]string, 0, len(refs.reports[k]))
+		for _, report := range refs.reports[k] {
+			reportIds = append(reportIds, formatId(report.CustomerId, report.ProjectId, report.Id))
+		}
+		sort.Strings(reportIds)
+		return fmt.Errorf("Metric part '%v' of metric %v is referenced by report(s) %v but none of the encodings of project (%d, %d) can encode values of type %v.",
+			k.part, formatId(k.customerId, k.projectId, k.metricId), strings.Join(reportIds, ", "), k.customerId, k.projectId,
+			config.MetricPart_DataType_name[int32(refs.dataTypes[k])])
+	}
+
+	return nil
+}
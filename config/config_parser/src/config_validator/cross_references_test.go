@@ -0,0 +1,74 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_validator
+
+import (
+	"config"
+	"strings"
+	"testing"
+)
+
+func TestValidateCrossReferences(t *testing.T) {
+	partVariable := &config.ReportVariable{MetricPart: "part"}
+
+	otherProjectConfig := makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM, partVariable), stringRappor())
+	otherProjectConfig.EncodingConfigs[0].ProjectId = 2
+
+	var tests = []struct {
+		config      *config.CobaltConfig
+		expectedErr string
+	}{
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM, partVariable), stringRappor()),
+			expectedErr: "",
+		},
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM, partVariable)),
+			expectedErr: "Metric part 'part' of metric (1, 1, 1) is referenced by report(s) (1, 1, 1) but none of the encodings of project (1, 1) can encode values of type STRING.",
+		},
+		{
+			// Forculus cannot encode integers.
+			config:      makeComputabilityConfig(config.MetricPart_INT, makeComputabilityReport(config.ReportType_RAW_DUMP, partVariable), forculusWeekly()),
+			expectedErr: "can encode values of type INT",
+		},
+		{
+			// Encodings of other projects are not used.
+			config:      otherProjectConfig,
+			expectedErr: "none of the encodings of project (1, 1)",
+		},
+		{
+			// Reports without variables do not reference any metric part.
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM)),
+			expectedErr: "",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateCrossReferences(tt.config)
+		if tt.expectedErr == "" {
+			if err != nil {
+				t.Errorf("validateCrossReferences(%+v): unexpected error %v", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+			t.Errorf("validateCrossReferences(%+v): expected %v, actual %v", tt.config, tt.expectedErr, err)
+		}
+	}
+}
+
+// Tests that all the reports referencing a metric part that cannot be encoded
+// are named in the error.
+func TestValidateCrossReferencesNamesAllReports(t *testing.T) {
+	c := makeComputabilityConfig(config.MetricPart_INT, makeComputabilityReport(config.ReportType_RAW_DUMP, &config.ReportVariable{MetricPart: "part"}), forculusWeekly())
+	other := makeComputabilityReport(config.ReportType_RAW_DUMP, &config.ReportVariable{MetricPart: "part"})
+	other.Id = 2
+	c.ReportConfigs = append(c.ReportConfigs, other)
+
+	err := validateCrossReferences(c)
+	if err == nil || !strings.Contains(err.Error(), "report(s) (1, 1, 1), (1, 1, 2)") {
+		t.Errorf("validateCrossReferences(): expected both reports to be named, actual %v", err)
+	}
+}
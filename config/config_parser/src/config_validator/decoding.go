@@ -0,0 +1,137 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements a validation pass that simulates report generation on
+// the ReportMaster in order to reject report configs that can never be
+// computed.
+
+package config_validator
+
+import (
+	"config"
+	"config_registry"
+	"fmt"
+)
+
+// canEncodeDataType returns true if |e| is able to encode values of metric
+// parts of type |t|. This mirrors the checks performed by the Encoder.
+func canEncodeDataType(e *config.EncodingConfig, t config.MetricPart_DataType) bool {
+	switch c := e.Config.(type) {
+	case *config.EncodingConfig_Forculus:
+		return t == config.MetricPart_STRING || t == config.MetricPart_BLOB
+	case *config.EncodingConfig_Rappor:
+		return t == config.MetricPart_STRING
+	case *config.EncodingConfig_BasicRappor:
+		switch c.BasicRappor.Categories.(type) {
+		case *config.BasicRapporConfig_StringCategories:
+			return t == config.MetricPart_STRING
+		case *config.BasicRapporConfig_IntRangeCategories:
+			return t == config.MetricPart_INT
+		case *config.BasicRapporConfig_IndexedCategories:
+			return t == config.MetricPart_INDEX
+		}
+		return false
+	case *config.EncodingConfig_NoOpEncoding:
+		return true
+	}
+	return false
+}
+
+// decodingError returns a non-nil error explaining why Observations of the
+// metric part |p| encoded using |e| cannot be decoded for the variable |v| of
+// the report |c|, or nil if they can.
+func decodingError(c *config.ReportConfig, v *config.ReportVariable, p *config.MetricPart, e *config.EncodingConfig) error {
+	if c.ReportType == config.ReportType_RAW_DUMP || p.IntBuckets != nil {
+		// Raw dumps and integer bucket distributions only support unencoded values.
+		if _, ok := e.Config.(*config.EncodingConfig_NoOpEncoding); !ok {
+			return fmt.Errorf("encoding %v is not a no_op_encoding", e.Id)
+		}
+		return nil
+	}
+
+	switch x := e.Config.(type) {
+	case *config.EncodingConfig_Forculus:
+		if c.Scheduling != nil && c.Scheduling.AggregationEpochType != x.Forculus.EpochType {
+			return fmt.Errorf("Forculus encoding %v uses epoch type %v but the report aggregates over epoch type %v",
+				e.Id, x.Forculus.EpochType, c.Scheduling.AggregationEpochType)
+		}
+	case *config.EncodingConfig_Rappor:
+		if v.RapporCandidates == nil || len(v.RapporCandidates.Candidates) == 0 {
+			return fmt.Errorf("String RAPPOR encoding %v requires RAPPOR candidates", e.Id)
+		}
+	}
+	return nil
+}
+
+// validateReportComputable checks that report generation for |c| does not
+// inevitably fail on the ReportMaster. |encodings| is the list of encodings
+// registered in the same project as |c|.
+func validateReportComputable(c *config.ReportConfig, m *config.Metric, encodings []*config.EncodingConfig) error {
+	numVariables := len(c.Variable)
+	switch c.ReportType {
+	case config.ReportType_HISTOGRAM:
+		if numVariables != 1 {
+			return fmt.Errorf("Reports of type HISTOGRAM must have exactly one variable. Found %v.", numVariables)
+		}
+	case config.ReportType_JOINT:
+		return fmt.Errorf("Reports of type JOINT are not supported by the ReportMaster.")
+	case config.ReportType_RAW_DUMP:
+		if numVariables == 0 {
+			return fmt.Errorf("Reports of type RAW_DUMP must have at least one variable.")
+		}
+	}
+
+	for i, v := range c.Variable {
+		if v == nil {
+			// This is reported by validateReportVariables.
+			continue
+		}
+		p, ok := m.Parts[v.MetricPart]
+		if !ok || p == nil {
+			continue
+		}
+
+		// Observations for this variable may be encoded using any of the
+		// project's encodings that support the data type of the metric part. The
+		// report is only rejected if none of them can be decoded.
+		var errs []error
+		for _, e := range encodings {
+			if !canEncodeDataType(e, p.DataType) {
+				continue
+			}
+			err := decodingError(c, v, p, e)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("Report variable %v (metric part '%v') cannot be decoded using any of the encodings of the project: %v", i, v.MetricPart, errs)
+		}
+	}
+
+	return nil
+}
+
+// validateReportsComputable simulates report generation for every report in
+// |c|. See validateReportComputable.
+func validateReportsComputable(c *config.CobaltConfig) (err error) {
+	registry := config_registry.NewRegistry(c)
+
+	for _, report := range c.ReportConfigs {
+		metric := registry.GetMetric(report.CustomerId, report.ProjectId, report.MetricId)
+		if metric == nil {
+			// This is reported by validateConfiguredReports.
+			continue
+		}
+
+		encodings := registry.EncodingsForProject(report.CustomerId, report.ProjectId)
+		if err := validateReportComputable(report, metric, encodings); err != nil {
+			return fmt.Errorf("Report %v (%v) can never be generated: %v", report.Name, formatId(report.CustomerId, report.ProjectId, report.Id), err)
+		}
+	}
+
+	return nil
+}
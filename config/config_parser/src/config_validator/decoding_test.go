@@ -0,0 +1,122 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_validator
+
+import (
+	"config"
+	"strings"
+	"testing"
+)
+
+// makeComputabilityConfig returns a config with a single metric with a single
+// metric part of type |t|, the given |encodings| and the given |report|.
+func makeComputabilityConfig(t config.MetricPart_DataType, report *config.ReportConfig, encodings ...*config.EncodingConfig) *config.CobaltConfig {
+	metric := makeMetric(1, nil)
+	metric.Parts = map[string]*config.MetricPart{"part": &config.MetricPart{DataType: t}}
+	for i, e := range encodings {
+		e.CustomerId = 1
+		e.ProjectId = 1
+		e.Id = uint32(i + 1)
+	}
+	return &config.CobaltConfig{
+		EncodingConfigs: encodings,
+		MetricConfigs:   []*config.Metric{metric},
+		ReportConfigs:   []*config.ReportConfig{report},
+	}
+}
+
+func makeComputabilityReport(reportType config.ReportType, variables ...*config.ReportVariable) *config.ReportConfig {
+	report := makeReport(1, 1, nil)
+	report.ReportType = reportType
+	report.Variable = variables
+	return report
+}
+
+func forculusWeekly() *config.EncodingConfig {
+	return &config.EncodingConfig{
+		Config: &config.EncodingConfig_Forculus{Forculus: &config.ForculusConfig{Threshold: 20, EpochType: config.EpochType_WEEK}},
+	}
+}
+
+func stringRappor() *config.EncodingConfig {
+	return &config.EncodingConfig{
+		Config: &config.EncodingConfig_Rappor{Rappor: &config.RapporConfig{NumBloomBits: 8, NumHashes: 2}},
+	}
+}
+
+func noOp() *config.EncodingConfig {
+	return &config.EncodingConfig{
+		Config: &config.EncodingConfig_NoOpEncoding{NoOpEncoding: &config.NoOpEncodingConfig{}},
+	}
+}
+
+func TestValidateReportsComputable(t *testing.T) {
+	partVariable := &config.ReportVariable{MetricPart: "part"}
+	candidatesVariable := &config.ReportVariable{
+		MetricPart:       "part",
+		RapporCandidates: &config.RapporCandidateList{Candidates: []string{"hello"}},
+	}
+	weeklyReport := makeComputabilityReport(config.ReportType_HISTOGRAM, partVariable)
+	weeklyReport.Scheduling = &config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_WEEK}
+	dailyReport := makeComputabilityReport(config.ReportType_HISTOGRAM, partVariable)
+	dailyReport.Scheduling = &config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_DAY}
+
+	var tests = []struct {
+		config      *config.CobaltConfig
+		expectedErr string
+	}{
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM)),
+			expectedErr: "exactly one variable",
+		},
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_JOINT, partVariable, partVariable)),
+			expectedErr: "JOINT",
+		},
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM, partVariable), stringRappor()),
+			expectedErr: "requires RAPPOR candidates",
+		},
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM, candidatesVariable), stringRappor()),
+			expectedErr: "",
+		},
+		{
+			// The observations may have been encoded using the NoOp encoding.
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_HISTOGRAM, partVariable), stringRappor(), noOp()),
+			expectedErr: "",
+		},
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, dailyReport, forculusWeekly()),
+			expectedErr: "epoch type",
+		},
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, weeklyReport, forculusWeekly()),
+			expectedErr: "",
+		},
+		{
+			config:      makeComputabilityConfig(config.MetricPart_STRING, makeComputabilityReport(config.ReportType_RAW_DUMP, partVariable), forculusWeekly()),
+			expectedErr: "not a no_op_encoding",
+		},
+		{
+			// Forculus cannot encode integers so it is not a candidate encoding.
+			config:      makeComputabilityConfig(config.MetricPart_INT, makeComputabilityReport(config.ReportType_RAW_DUMP, partVariable), forculusWeekly()),
+			expectedErr: "",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateReportsComputable(tt.config)
+		if tt.expectedErr == "" {
+			if err != nil {
+				t.Errorf("validateReportsComputable(%+v): unexpected error %v", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+			t.Errorf("validateReportsComputable(%+v): expected %v, actual %v", tt.config, tt.expectedErr, err)
+		}
+	}
+}
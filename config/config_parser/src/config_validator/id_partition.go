@@ -0,0 +1,108 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// This file implements a validation pass that enforces the partition of the
+// project IDs between tests and production: project IDs from 0 through 99 are
+// reserved for tests and must never be used for real projects while project IDs
+// greater than or equal to 100 are for real projects and must never be used in
+// tests. The end-to-end tests may run against the production instance of Cobalt
+// and rely on this partition to never touch real customer data.
+
+package config_validator
+
+import (
+	"config"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// The smallest project ID of a real project.
+	firstProductionProjectId = 100
+
+	// The values of -enforce_id_partition.
+	idPartitionTest       = "test"
+	idPartitionProduction = "prod"
+)
+
+var (
+	enforceIdPartition = flag.String("enforce_id_partition", "", fmt.Sprintf("If '%s', all the project IDs of the registry must be below %d, "+
+		"which are reserved for tests. If '%s', all of them must be at least %d, which are reserved for real projects. By default the "+
+		"project IDs are not checked.", idPartitionTest, firstProductionProjectId, idPartitionProduction, firstProductionProjectId))
+)
+
+// projectIdKey identifies a project.
+type projectIdKey struct {
+	customerId uint32
+	projectId  uint32
+}
+
+// validateIdPartition checks the project IDs of all the entries of |c| against
+// the partition specified by -enforce_id_partition.
+func validateIdPartition(c *config.CobaltConfig) error {
+	return checkIdPartition(c, *enforceIdPartition)
+}
+
+// checkIdPartition checks that all the entries of |c| belong to projects whose
+// IDs are in the part of the partition named by |partition|: idPartitionTest,
+// idPartitionProduction or "" to accept any project ID. The error lists every
+// project that violates the partition along with its entries.
+func checkIdPartition(c *config.CobaltConfig, partition string) error {
+	var allowed func(projectId uint32) bool
+	var policy string
+	switch partition {
+	case "":
+		return nil
+	case idPartitionTest:
+		allowed = func(projectId uint32) bool { return projectId < firstProductionProjectId }
+		policy = fmt.Sprintf("this is a test registry and project IDs greater than or equal to %d are reserved for real projects. "+
+			"Use a project ID below %d.", firstProductionProjectId, firstProductionProjectId)
+	case idPartitionProduction:
+		allowed = func(projectId uint32) bool { return projectId >= firstProductionProjectId }
+		policy = fmt.Sprintf("this is a production registry and project IDs below %d are reserved for tests. "+
+			"Use a project ID greater than or equal to %d.", firstProductionProjectId, firstProductionProjectId)
+	default:
+		return fmt.Errorf("-enforce_id_partition must be '%s', '%s' or empty, not '%s'.", idPartitionTest, idPartitionProduction, partition)
+	}
+
+	violations := map[projectIdKey][]string{}
+	add := func(customerId, projectId uint32, entry string) {
+		if !allowed(projectId) {
+			k := projectIdKey{customerId, projectId}
+			violations[k] = append(violations[k], entry)
+		}
+	}
+	for _, e := range c.EncodingConfigs {
+		add(e.CustomerId, e.ProjectId, "encoding "+formatId(e.CustomerId, e.ProjectId, e.Id))
+	}
+	for _, m := range c.MetricConfigs {
+		add(m.CustomerId, m.ProjectId, "metric "+formatId(m.CustomerId, m.ProjectId, m.Id))
+	}
+	for _, r := range c.ReportConfigs {
+		add(r.CustomerId, r.ProjectId, "report "+formatId(r.CustomerId, r.ProjectId, r.Id))
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	keys := make([]projectIdKey, 0, len(violations))
+	for k := range violations {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].customerId != keys[j].customerId {
+			return keys[i].customerId < keys[j].customerId
+		}
+		return keys[i].projectId < keys[j].projectId
+	})
+
+	messages := make([]string, len(keys))
+	for i, k := range keys {
+		messages[i] = fmt.Sprintf("Project (%d, %d) of %s violates the project ID partition: %s",
+			k.customerId, k.projectId, strings.Join(violations[k], ", "), policy)
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "\n"))
+}
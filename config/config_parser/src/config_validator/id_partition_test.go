@@ -0,0 +1,66 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_validator
+
+import (
+	"config"
+	"strings"
+	"testing"
+)
+
+func makeIdPartitionConfig(projectIds ...uint32) *config.CobaltConfig {
+	c := &config.CobaltConfig{}
+	for _, projectId := range projectIds {
+		c.EncodingConfigs = append(c.EncodingConfigs, &config.EncodingConfig{CustomerId: 1, ProjectId: projectId, Id: 1})
+		c.MetricConfigs = append(c.MetricConfigs, &config.Metric{CustomerId: 1, ProjectId: projectId, Id: 2})
+		c.ReportConfigs = append(c.ReportConfigs, &config.ReportConfig{CustomerId: 1, ProjectId: projectId, Id: 3})
+	}
+	return c
+}
+
+func TestCheckIdPartition(t *testing.T) {
+	var tests = []struct {
+		config      *config.CobaltConfig
+		partition   string
+		expectedErr []string
+	}{
+		{makeIdPartitionConfig(1, 100), "", nil},
+		{makeIdPartitionConfig(0, 99), "test", nil},
+		{makeIdPartitionConfig(100, 1000), "prod", nil},
+		{
+			makeIdPartitionConfig(1, 100, 150), "test",
+			[]string{
+				"Project (1, 100) of encoding (1, 100, 1), metric (1, 100, 2), report (1, 100, 3) violates the project ID partition: " +
+					"this is a test registry and project IDs greater than or equal to 100 are reserved for real projects. Use a project ID below 100.",
+				"Project (1, 150) of encoding (1, 150, 1)",
+			},
+		},
+		{
+			makeIdPartitionConfig(100, 99), "prod",
+			[]string{"Project (1, 99) of encoding (1, 99, 1), metric (1, 99, 2), report (1, 99, 3) violates the project ID partition: " +
+				"this is a production registry and project IDs below 100 are reserved for tests."},
+		},
+		{makeIdPartitionConfig(1), "staging", []string{"-enforce_id_partition must be 'test', 'prod' or empty"}},
+	}
+
+	for _, tt := range tests {
+		err := checkIdPartition(tt.config, tt.partition)
+		if len(tt.expectedErr) == 0 {
+			if err != nil {
+				t.Errorf("checkIdPartition(%v): got error %v", tt.partition, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("checkIdPartition(%v): expected an error", tt.partition)
+			continue
+		}
+		for _, expected := range tt.expectedErr {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("checkIdPartition(%v): got error %q, expected it to contain %q", tt.partition, err, expected)
+			}
+		}
+	}
+}
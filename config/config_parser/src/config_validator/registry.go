@@ -0,0 +1,64 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_validator
+
+import (
+	"config"
+	"fmt"
+	"sync"
+)
+
+// A Validation checks a CobaltConfig against an additional policy and returns
+// an error describing the first violation.
+type Validation func(config *config.CobaltConfig) error
+
+type registeredValidation struct {
+	name       string
+	validation Validation
+}
+
+var (
+	registryMu            sync.Mutex
+	registeredValidations []registeredValidation
+)
+
+// RegisterValidation registers |validation| to be run by ValidateConfig after
+// the built-in checks. This lets downstream forks enforce their own policies,
+// such as naming conventions or required ownership metadata, without patching
+// ValidateConfig: they register their validations in the init() function of a
+// file added to the main package, which may be guarded by a build tag.
+//
+// The validations run in the order in which they were registered. |name|
+// identifies the validation in the errors it returns. Registering a nil
+// validation, or two validations with the same name, panics.
+func RegisterValidation(name string, validation Validation) {
+	if validation == nil {
+		panic("config_validator: RegisterValidation of a nil validation " + name)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, v := range registeredValidations {
+		if v.name == name {
+			panic("config_validator: RegisterValidation called twice for " + name)
+		}
+	}
+	registeredValidations = append(registeredValidations, registeredValidation{name, validation})
+}
+
+// runRegisteredValidations runs the validations registered with
+// RegisterValidation and returns the first error.
+func runRegisteredValidations(config *config.CobaltConfig) error {
+	registryMu.Lock()
+	validations := registeredValidations
+	registryMu.Unlock()
+
+	for _, v := range validations {
+		if err := v.validation(config); err != nil {
+			return fmt.Errorf("Error in validation %s: %v", v.name, err)
+		}
+	}
+	return nil
+}
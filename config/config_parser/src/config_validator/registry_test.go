@@ -0,0 +1,68 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_validator
+
+import (
+	"config"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Tests that the registered validations run in order after the built-in
+// checks.
+func TestRegisterValidation(t *testing.T) {
+	defer func(saved []registeredValidation) { registeredValidations = saved }(registeredValidations)
+	registeredValidations = nil
+
+	var calls []string
+	RegisterValidation("owners", func(c *config.CobaltConfig) error {
+		calls = append(calls, "owners")
+		return nil
+	})
+	RegisterValidation("naming", func(c *config.CobaltConfig) error {
+		calls = append(calls, "naming")
+		for _, m := range c.MetricConfigs {
+			if !strings.HasPrefix(m.Name, "org_") {
+				return fmt.Errorf("Metric %s does not start with org_", m.Name)
+			}
+		}
+		return nil
+	})
+
+	c := &config.CobaltConfig{}
+	if err := ValidateConfig(c); err != nil {
+		t.Errorf("Rejected a config that satisfies the registered validations: %v", err)
+	}
+	if strings.Join(calls, ",") != "owners,naming" {
+		t.Errorf("Got calls %v, expected [owners naming]", calls)
+	}
+
+	c.MetricConfigs = []*config.Metric{
+		&config.Metric{CustomerId: 1, ProjectId: 1, Id: 1, Name: "metric"},
+	}
+	err := runRegisteredValidations(c)
+	if err == nil {
+		t.Fatalf("Accepted a config that violates a registered validation")
+	}
+	if !strings.Contains(err.Error(), "naming") {
+		t.Errorf("Got error [%v], expected it to name the validation", err)
+	}
+}
+
+// Tests that registering two validations with the same name panics.
+func TestRegisterValidationTwice(t *testing.T) {
+	defer func(saved []registeredValidation) { registeredValidations = saved }(registeredValidations)
+	registeredValidations = nil
+
+	validation := func(c *config.CobaltConfig) error { return nil }
+	RegisterValidation("policy", validation)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a validation twice did not panic")
+		}
+	}()
+	RegisterValidation("policy", validation)
+}
@@ -6,21 +6,17 @@ package config_validator
 
 import (
 	"config"
+	"config_registry"
 	"fmt"
 	"github.com/golang/glog"
 )
 
 func validateConfiguredReports(config *config.CobaltConfig) (err error) {
-	// Mapping of metric ids to their order in the MetricConfigs slice.
-	metrics := map[string]uint32{}
+	registry := config_registry.NewRegistry(config)
 
 	// Set of report ids. Used to detect duplicates.
 	reportIds := map[string]bool{}
 
-	for i, metric := range config.MetricConfigs {
-		metrics[formatId(metric.CustomerId, metric.ProjectId, metric.Id)] = uint32(i)
-	}
-
 	for i, report := range config.ReportConfigs {
 		if report.Id == 0 {
 			return fmt.Errorf("Error validating report %v: Report id '0' is invalid.", report.Name)
@@ -32,12 +28,16 @@ func validateConfiguredReports(config *config.CobaltConfig) (err error) {
 		}
 		reportIds[reportKey] = true
 
-		metricKey := formatId(report.CustomerId, report.ProjectId, report.MetricId)
-		if _, ok := metrics[metricKey]; !ok {
-			return fmt.Errorf("Error validating report %v (%v): There is no metric id %v.", report.Name, report.Id, metricKey)
+		metric := registry.GetMetric(report.CustomerId, report.ProjectId, report.MetricId)
+		if metric == nil {
+			return fmt.Errorf("Error validating report %v (%v): There is no metric id %v.", report.Name, report.Id,
+				formatId(report.CustomerId, report.ProjectId, report.MetricId))
+		}
+
+		if err := validateReportScheduling(report.Scheduling); err != nil {
+			return fmt.Errorf("Error validating report %v (%v): %v", report.Name, report.Id, err)
 		}
 
-		metric := config.MetricConfigs[metrics[metricKey]]
 		if err := validateReportVariables(report, metric); err != nil {
 			return fmt.Errorf("Error validating report %v (%v): %v", report.Name, report.Id, err)
 		}
@@ -56,6 +56,42 @@ func validateConfiguredReports(config *config.CobaltConfig) (err error) {
 	return nil
 }
 
+// The largest report_finalization_days the ReportMaster accepts.
+const maxReportFinalizationDays = 20
+
+// The smallest report_finalization_days allowed for each aggregation epoch.
+// Observations for the last day of a multi-day epoch keep arriving after that
+// day ends, so such a report must not be finalized on its last day.
+var minReportFinalizationDays = map[config.EpochType]uint32{
+	config.EpochType_DAY:   0,
+	config.EpochType_WEEK:  1,
+	config.EpochType_MONTH: 1,
+}
+
+// Checks that the report scheduling parameters are consistent with each other.
+// A report without scheduling parameters is never scheduled and is accepted.
+func validateReportScheduling(s *config.ReportSchedulingConfig) (err error) {
+	if s == nil {
+		return nil
+	}
+
+	minDays, ok := minReportFinalizationDays[s.AggregationEpochType]
+	if !ok {
+		return fmt.Errorf("Unknown aggregation_epoch_type %v.", s.AggregationEpochType)
+	}
+
+	if s.ReportFinalizationDays > maxReportFinalizationDays {
+		return fmt.Errorf("report_finalization_days is %v but must be at most %v.", s.ReportFinalizationDays, maxReportFinalizationDays)
+	}
+
+	if s.ReportFinalizationDays < minDays {
+		return fmt.Errorf("report_finalization_days is %v but must be at least %v for aggregation_epoch_type %v.",
+			s.ReportFinalizationDays, minDays, s.AggregationEpochType)
+	}
+
+	return nil
+}
+
 // Checks that the report variables are compatible with the specific metric.
 func validateReportVariables(c *config.ReportConfig, m *config.Metric) (err error) {
 	if len(c.Variable) == 0 {
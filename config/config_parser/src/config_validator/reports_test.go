@@ -160,3 +160,45 @@ func TestValidateUniqueReportIds(t *testing.T) {
 		t.Error("Accepted non-unique report id.")
 	}
 }
+
+// Tests that the report scheduling parameters are validated.
+func TestValidateReportScheduling(t *testing.T) {
+	valid := []*config.ReportSchedulingConfig{
+		nil,
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_DAY, ReportFinalizationDays: 0},
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_DAY, ReportFinalizationDays: 20},
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_WEEK, ReportFinalizationDays: 1},
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_MONTH, ReportFinalizationDays: 3},
+	}
+	for _, s := range valid {
+		if err := validateReportScheduling(s); err != nil {
+			t.Errorf("Rejected valid scheduling %v: %v", s, err)
+		}
+	}
+
+	invalid := []*config.ReportSchedulingConfig{
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_DAY, ReportFinalizationDays: 21},
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_WEEK, ReportFinalizationDays: 0},
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_MONTH, ReportFinalizationDays: 0},
+		&config.ReportSchedulingConfig{AggregationEpochType: config.EpochType(7), ReportFinalizationDays: 1},
+	}
+	for _, s := range invalid {
+		if err := validateReportScheduling(s); err == nil {
+			t.Errorf("Accepted invalid scheduling %v.", s)
+		}
+	}
+}
+
+// Tests that a report with inconsistent scheduling parameters is rejected.
+func TestValidateConfiguredReportsScheduling(t *testing.T) {
+	report := makeReport(1, 1, nil)
+	report.Scheduling = &config.ReportSchedulingConfig{AggregationEpochType: config.EpochType_WEEK}
+	config := &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{makeMetric(1, nil)},
+		ReportConfigs: []*config.ReportConfig{report},
+	}
+
+	if err := validateConfiguredReports(config); err == nil {
+		t.Error("Accepted a weekly report with no report finalization days.")
+	}
+}
@@ -6,6 +6,7 @@ package config_validator
 
 import (
 	"config"
+	"config_registry"
 	"fmt"
 )
 
@@ -23,15 +24,14 @@ func containsSystemProfileField(metric *config.Metric, e config.SystemProfileFie
 // validateSystemProfileFields makes sure that all system_profile_fields used in
 // reports are present in their associated metrics.
 func validateSystemProfileFields(config *config.CobaltConfig) error {
-	metrics := map[string]uint32{}
-
-	for i, metric := range config.MetricConfigs {
-		key := formatId(metric.CustomerId, metric.ProjectId, metric.Id)
-		metrics[key] = uint32(i)
-	}
+	registry := config_registry.NewRegistry(config)
 
 	for _, report := range config.ReportConfigs {
-		metric := config.MetricConfigs[metrics[formatId(report.CustomerId, report.ProjectId, report.MetricId)]]
+		metric := registry.GetMetric(report.CustomerId, report.ProjectId, report.MetricId)
+		if metric == nil {
+			// This is reported by validateConfiguredReports.
+			continue
+		}
 		for _, field := range report.SystemProfileField {
 			if !containsSystemProfileField(metric, field) {
 				metricId := formatId(metric.CustomerId, metric.ProjectId, metric.Id)
@@ -0,0 +1,61 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_validator
+
+import (
+	"config"
+	"fmt"
+)
+
+// Tombstones lists the ids of the metrics, encodings and reports that have
+// been deleted from a project. These ids must never be reused: data collected
+// for the deleted entry would otherwise be mixed into the reports of the new
+// one.
+type Tombstones struct {
+	CustomerId  uint32
+	ProjectId   uint32
+	MetricIds   []uint32
+	EncodingIds []uint32
+	ReportIds   []uint32
+}
+
+// ValidateTombstones returns an error if a metric, encoding or report in
+// |config| uses an id that is listed in the |tombstones| of its project.
+func ValidateTombstones(config *config.CobaltConfig, tombstones []Tombstones) (err error) {
+	metricIds := map[string]bool{}
+	encodingIds := map[string]bool{}
+	reportIds := map[string]bool{}
+	for _, t := range tombstones {
+		for _, id := range t.MetricIds {
+			metricIds[formatId(t.CustomerId, t.ProjectId, id)] = true
+		}
+		for _, id := range t.EncodingIds {
+			encodingIds[formatId(t.CustomerId, t.ProjectId, id)] = true
+		}
+		for _, id := range t.ReportIds {
+			reportIds[formatId(t.CustomerId, t.ProjectId, id)] = true
+		}
+	}
+
+	for _, metric := range config.MetricConfigs {
+		if key := formatId(metric.CustomerId, metric.ProjectId, metric.Id); metricIds[key] {
+			return fmt.Errorf("Metric %v reuses the id %s of a deleted metric. Ids listed in tombstones.yaml must not be reused.", metric.Name, key)
+		}
+	}
+
+	for _, encoding := range config.EncodingConfigs {
+		if key := formatId(encoding.CustomerId, encoding.ProjectId, encoding.Id); encodingIds[key] {
+			return fmt.Errorf("Encoding %v reuses the id %s of a deleted encoding. Ids listed in tombstones.yaml must not be reused.", encoding.Name, key)
+		}
+	}
+
+	for _, report := range config.ReportConfigs {
+		if key := formatId(report.CustomerId, report.ProjectId, report.Id); reportIds[key] {
+			return fmt.Errorf("Report %v reuses the id %s of a deleted report. Ids listed in tombstones.yaml must not be reused.", report.Name, key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package config_validator
+
+import (
+	"config"
+	"testing"
+)
+
+func makeTombstonesTestConfig() *config.CobaltConfig {
+	return &config.CobaltConfig{
+		MetricConfigs: []*config.Metric{
+			&config.Metric{CustomerId: 1, ProjectId: 1, Id: 2, Name: "metric"},
+		},
+		EncodingConfigs: []*config.EncodingConfig{
+			&config.EncodingConfig{CustomerId: 1, ProjectId: 1, Id: 3},
+		},
+		ReportConfigs: []*config.ReportConfig{
+			&config.ReportConfig{CustomerId: 1, ProjectId: 1, Id: 4, Name: "report"},
+		},
+	}
+}
+
+// Tests that ids that are not tombstoned in the project of an entry are
+// accepted.
+func TestValidateTombstonesAccepted(t *testing.T) {
+	tombstones := []Tombstones{
+		Tombstones{CustomerId: 1, ProjectId: 1, MetricIds: []uint32{1}, EncodingIds: []uint32{1}, ReportIds: []uint32{1}},
+		// The same ids, retired in another project.
+		Tombstones{CustomerId: 1, ProjectId: 2, MetricIds: []uint32{2}, EncodingIds: []uint32{3}, ReportIds: []uint32{4}},
+	}
+	if err := ValidateTombstones(makeTombstonesTestConfig(), tombstones); err != nil {
+		t.Errorf("Rejected a config that does not reuse tombstoned ids: %v", err)
+	}
+}
+
+// Tests that the reuse of a tombstoned metric, encoding or report id is
+// rejected.
+func TestValidateTombstonesReuse(t *testing.T) {
+	for _, tombstones := range []Tombstones{
+		Tombstones{CustomerId: 1, ProjectId: 1, MetricIds: []uint32{2}},
+		Tombstones{CustomerId: 1, ProjectId: 1, EncodingIds: []uint32{3}},
+		Tombstones{CustomerId: 1, ProjectId: 1, ReportIds: []uint32{4}},
+	} {
+		if err := ValidateTombstones(makeTombstonesTestConfig(), []Tombstones{tombstones}); err == nil {
+			t.Errorf("Accepted a config that reuses an id in %v.", tombstones)
+		}
+	}
+}
@@ -30,9 +30,25 @@ func ValidateConfig(config *config.CobaltConfig) (err error) {
 		return
 	}
 
+	if err = validateCrossReferences(config); err != nil {
+		return
+	}
+
+	if err = validateReportsComputable(config); err != nil {
+		return
+	}
+
+	if err = validateIdPartition(config); err != nil {
+		return
+	}
+
 	if err = runCommonValidations(config); err != nil {
 		return
 	}
 
+	if err = runRegisteredValidations(config); err != nil {
+		return
+	}
+
 	return nil
 }
@@ -302,15 +302,22 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os/exec"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"analyzer/report_master"
+	"config"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
 	"report_client"
 )
 
@@ -381,9 +388,99 @@ var (
 		"the Observations on to the Analyzer. If the Shuffler has been configured to use a threshold other than 100 then set this flag to false "+
 		"and we will skip that part of the test.")
 
+	reportTolerancesFile = flag.String("report_tolerances_file", "", "Optional. A JSON file containing a reportTolerances "+
+		"specifying how far the values in the generated reports may be from the expected values. If not specified "+
+		"defaultReportTolerances is used.")
+
+	fakeGcsPort = flag.Int("fake_gcs_port", 0, "If positive, a fake Google Cloud Storage server is started on this port and "+
+		"TestExportedReports checks the reports that the ReportMaster exports to it. The ReportMaster must have been started "+
+		"with report scheduling enabled and with COBALT_GCS_EMULATOR_URL pointing at the fake server.")
+
 	reportClient *report_client.ReportClient
+
+	fakeGcs *fakeGcsServer
+
+	tolerances = defaultReportTolerances
 )
 
+// A Tolerance specifies how far a value in a generated report may be from
+// its expected value. The allowed distance is the sum of |Epsilon| and
+// |NumStdDevs| standard deviations, where the standard deviation is computed
+// from the parameters of the encoding.
+type Tolerance struct {
+	Epsilon    float64 `json:"epsilon"`
+	NumStdDevs float64 `json:"num_std_devs"`
+}
+
+// within returns true if |val| is within the tolerance |t| of |expected|
+// given the standard deviation |stdDev|.
+func (t Tolerance) within(val, expected, stdDev float64) bool {
+	return math.Abs(val-expected) <= t.Epsilon+t.NumStdDevs*stdDev
+}
+
+// reportTolerances is read from the file specified by -report_tolerances_file.
+// The tests use these tolerances rather than hardcoded ranges so that they are
+// robust to changes of the parameters of the encodings in the registry.
+type reportTolerances struct {
+	// The tolerance for the count estimates of Basic RAPPOR reports.
+	BasicRapporCountEstimate Tolerance `json:"basic_rappor_count_estimate"`
+
+	// The tolerance for the standard errors of Basic RAPPOR reports. The
+	// standard error is displayed with three decimal places so |Epsilon| should
+	// be at least 0.0005.
+	BasicRapporStdError Tolerance `json:"basic_rappor_std_error"`
+}
+
+var defaultReportTolerances = reportTolerances{
+	BasicRapporCountEstimate: Tolerance{NumStdDevs: 6},
+	BasicRapporStdError:      Tolerance{Epsilon: 0.001},
+}
+
+// loadReportTolerances reads the reportTolerances from the JSON file at |path|.
+func loadReportTolerances(path string) (reportTolerances, error) {
+	var t reportTolerances
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// getBasicRapporConfig reads the BasicRapporConfig with the given
+// |encodingConfigId| from the serialized CobaltConfig specified by
+// -config_bin_proto_path.
+func getBasicRapporConfig(encodingConfigId uint32) (*config.BasicRapporConfig, error) {
+	data, err := ioutil.ReadFile(*configBinProtoPath)
+	if err != nil {
+		return nil, err
+	}
+	cobaltConfig := config.CobaltConfig{}
+	if err := proto.Unmarshal(data, &cobaltConfig); err != nil {
+		return nil, err
+	}
+	for _, e := range cobaltConfig.EncodingConfigs {
+		if e.CustomerId != customerId || e.ProjectId != projectId || e.Id != encodingConfigId {
+			continue
+		}
+		if basicRappor := e.GetBasicRappor(); basicRappor != nil {
+			return basicRappor, nil
+		}
+		return nil, fmt.Errorf("EncodingConfig (%d, %d, %d) is not Basic RAPPOR.", customerId, projectId, encodingConfigId)
+	}
+	return nil, fmt.Errorf("EncodingConfig (%d, %d, %d) not found.", customerId, projectId, encodingConfigId)
+}
+
+// basicRapporStdError returns the standard error the Basic RAPPOR analyzer
+// computes for a category with |y| 1 bits out of |n| Observations, encoded
+// with |p| = prob_0_becomes_1 and |q| = prob_1_stays_1. This mirrors
+// algorithms/rappor/basic_rappor_analyzer.cc.
+func basicRapporStdError(y, n, p, q float64) float64 {
+	return math.Sqrt(y*(1.0-(q+p))+n*p*q) / math.Abs(q-p)
+}
+
 // Prints a big warning banner on the console and counts down 10 seconds
 // allowing the user to hit conrol-c and cancel. Uses ANSI control characters
 // in order to achieve color and animation.
@@ -429,6 +526,20 @@ func init() {
 
 	reportClient = report_client.NewReportClient(customerId, projectId, *reportMasterUri, *useTls, *skipOauth, *reportMasterRootCerts)
 
+	if *reportTolerancesFile != "" {
+		var err error
+		if tolerances, err = loadReportTolerances(*reportTolerancesFile); err != nil {
+			panic(fmt.Sprintf("Error loading report tolerances [%v].", err))
+		}
+	}
+
+	if *fakeGcsPort > 0 {
+		var err error
+		if fakeGcs, err = startFakeGcsServer(*fakeGcsPort); err != nil {
+			panic(fmt.Sprintf("Error starting the fake GCS server [%v].", err))
+		}
+	}
+
 	if *bigtableToolPath != "" {
 		// Since we are about to delete data from a real bigtable let's give a user a chance
 		// to cancel if something horrible has gone wrong.
@@ -734,12 +845,12 @@ func sendUnencodedDeviceObservations(index int, numClients uint, repeatCount uin
 // that spans all day indices. It then waits for the report generation to complete
 // and returns the Report.
 func getReport(reportConfigId uint32, includeStdErr bool, t *testing.T) *report_master.Report {
-	reportId, err := reportClient.StartCompleteReport(reportConfigId)
+	reportId, err := reportClient.StartCompleteReport(context.Background(), reportConfigId)
 	if err != nil {
 		t.Fatalf("reportConfigId=%d, err=%v", reportConfigId, err)
 	}
 
-	report, err := reportClient.GetReport(reportId, 10*time.Second)
+	report, err := reportClient.GetReport(context.Background(), reportId, 10*time.Second)
 	if err != nil {
 		t.Fatalf("reportConfigId=%d, err=%v", reportConfigId, err)
 	}
@@ -827,18 +938,26 @@ www.FFFF.com,CobaltE2EBoardName2,36.000
 // 24 hours of the day.
 func TestBasicRapporEncodingOfHours(t *testing.T) {
 	fmt.Println("TestBasicRapporEncodingOfHours")
-	sendBasicRapporHourObservations(8, 501, 1, t)
-	sendBasicRapporHourObservations(9, 1002, 1, t)
-	sendBasicRapporHourObservations(10, 503, 1, t)
-	sendBasicRapporHourObservations(16, 504, 1, t)
-	sendBasicRapporHourObservations(17, 1005, 1, t)
-	sendBasicRapporHourObservations(18, 506, 1, t)
+	// The number of clients that send each hour. All other hours are not sent.
+	numClientsByHour := map[int]uint{8: 501, 9: 1002, 10: 503, 16: 504, 17: 1005, 18: 506}
+	for _, hour := range []int{8, 9, 10, 16, 17, 18} {
+		sendBasicRapporHourObservations(hour, numClientsByHour[hour], 1, t)
+	}
 
 	// There should now be 4021 Observations sent to the Analyzer for metric 2.
 	// We wait for them.
-	if err := waitForObservations(hourMetricId, 4021); err != nil {
+	const numObservations = 4021
+	if err := waitForObservations(hourMetricId, numObservations); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	basicRapporConfig, err := getBasicRapporConfig(basicRapporStringsEncodingConfigId)
+	if err != nil {
 		t.Fatalf("%s", err)
 	}
+	p := float64(basicRapporConfig.Prob_0Becomes_1)
+	q := float64(basicRapporConfig.Prob_1Stays_1)
+	n := float64(numObservations)
 
 	report := getReport(hourReportConfigId, true, t)
 	if report.Metadata.State != report_master.ReportState_COMPLETED_SUCCESSFULLY {
@@ -866,31 +985,26 @@ func TestBasicRapporEncodingOfHours(t *testing.T) {
 			t.Errorf("Error parsing %s as float: %v", rows[hour][1], err)
 			continue
 		}
-		switch hour {
-		case 8:
-			fallthrough
-		case 10:
-			fallthrough
-		case 16:
-			fallthrough
-		case 18:
-			if val < 10.0 || val > 1000.0 {
-				t.Errorf("For hour %d unexpected val: %v", hour, val)
-			}
-		case 9:
-			fallthrough
-		case 17:
-			if val < 500.0 || val > 2000.0 {
-				t.Errorf("For hour %d unexpected val: %v", hour, val)
-			}
-		default:
-			if val > 100.0 {
-				t.Errorf("Val larger than expected: %v", val)
-				continue
-			}
+		stdErr, err := strconv.ParseFloat(rows[hour][2], 32)
+		if err != nil {
+			t.Errorf("Error parsing %s as float: %v", rows[hour][2], err)
+			continue
 		}
-		if rows[hour][2] != "23.779" {
-			t.Errorf("rows[hour][2]=%s", rows[hour][2])
+
+		// The count estimate should be close to the true count. Its standard
+		// deviation is the standard error for the expected number of 1 bits.
+		expectedCount := float64(numClientsByHour[hour])
+		expectedY := expectedCount*q + (n-expectedCount)*p
+		if !tolerances.BasicRapporCountEstimate.within(val, expectedCount, basicRapporStdError(expectedY, n, p, q)) {
+			t.Errorf("For hour %d unexpected val: %v, expected %v", hour, val, expectedCount)
+		}
+
+		// The standard error is a deterministic function of the number of 1 bits
+		// which we recover from the count estimate.
+		y := val*(q-p) + p*n
+		expectedStdErr := basicRapporStdError(y, n, p, q)
+		if !tolerances.BasicRapporStdError.within(stdErr, expectedStdErr, 0) {
+			t.Errorf("For hour %d unexpected std err: %v, expected %.3f", hour, stdErr, expectedStdErr)
 		}
 	}
 }
@@ -1073,3 +1187,104 @@ func TestUnencodedDeviceIndexes(t *testing.T) {
 
 	}
 }
+
+// The GCS bucket to which the registered report configs of (customerID=1,
+// projectID=1) are exported.
+const exportBucket = "fuchsia-cobalt-reports-test1-rudominer"
+
+// An exportCheck checks the contents of an exported report.
+type exportCheck func(contents string) error
+
+// exportChecks maps the ids of the report configs whose exported reports are
+// checked by TestExportedReports to the checks of their exported reports for
+// the current day. Add an entry here in order to check the export of a
+// further report config.
+var exportChecks = map[uint32]exportCheck{
+	urlReportConfigId: expectExportedRows("date,url,count,err",
+		"www.CCCC.com,20.000,",
+		"www.DDDD.com,21.000,",
+		"www.EEEE.com,44.000,",
+		"www.FFFF.com,69.000,"),
+}
+
+// expectExportedRows returns an exportCheck which checks that an exported
+// CSV report for the current day consists of the given header row followed by
+// one row for each of |rowPrefixes|, in order. The date column is prepended
+// to each of |rowPrefixes|.
+func expectExportedRows(header string, rowPrefixes ...string) exportCheck {
+	return func(contents string) error {
+		now := time.Now().UTC()
+		date := fmt.Sprintf("%d-%d-%d", now.Year(), now.Month(), now.Day())
+		rows := strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+		if len(rows) != len(rowPrefixes)+1 {
+			return fmt.Errorf("expected %d rows, got %d", len(rowPrefixes)+1, len(rows))
+		}
+		if rows[0] != header {
+			return fmt.Errorf("expected header %q, got %q", header, rows[0])
+		}
+		for i, prefix := range rowPrefixes {
+			prefix = date + "," + prefix
+			if !strings.HasPrefix(rows[i+1], prefix) {
+				return fmt.Errorf("expected row %d to start with %q, got %q", i+1, prefix, rows[i+1])
+			}
+		}
+		return nil
+	}
+}
+
+// exportedReportName returns the name of the object to which the report for
+// the current day of the report config (1, 1, |reportConfigId|) is exported.
+func exportedReportName(reportConfigId uint32) string {
+	return fmt.Sprintf("%d_%d_%d/report_%d_%d_%d_%s.csv", customerId, projectId, reportConfigId,
+		customerId, projectId, reportConfigId, time.Now().UTC().Format("20060102"))
+}
+
+// The ReportMaster periodically generates the reports for the current day
+// and exports them to the fake GCS server. We check that the reports of the
+// report configs in |exportChecks| arrive there with the expected names and
+// contents. This test must run after the tests above have sent their
+// Observations.
+func TestExportedReports(t *testing.T) {
+	fmt.Println("TestExportedReports")
+	if fakeGcs == nil {
+		t.Skip("-fake_gcs_port was not specified")
+	}
+	// The scheduled reports are for the current day in UTC whereas the
+	// Observations were sent for the current day in local time.
+	if now := time.Now(); now.Format("20060102") != now.UTC().Format("20060102") {
+		t.Skip("The current day in local time differs from the current day in UTC")
+	}
+
+	// Scheduled reports are regenerated and re-exported until they are
+	// finalized, so earlier exports may precede some of the Observations. We
+	// wait until every exported report passes its check.
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		failures := []string{}
+		for reportConfigId, check := range exportChecks {
+			name := exportedReportName(reportConfigId)
+			o, ok := fakeGcs.getObject(exportBucket, name)
+			if !ok {
+				failures = append(failures, fmt.Sprintf("%s was not exported. Exported: %v", name, fakeGcs.objectNames(exportBucket)))
+				continue
+			}
+			if o.mimeType != "text/csv" {
+				failures = append(failures, fmt.Sprintf("%s has mime type %q", name, o.mimeType))
+				continue
+			}
+			if err := check(o.contents); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v. Contents:[%s]", name, err, o.contents))
+			}
+		}
+		if len(failures) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, f := range failures {
+				t.Error(f)
+			}
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+A fake of the subset of the Google Cloud Storage JSON API that the
+ReportMaster uses to export reports. When the end-to-end test is run against
+locally started Cobalt processes, the ReportMaster is started with report
+scheduling enabled and with the environment variable COBALT_GCS_EMULATOR_URL
+pointing at this server, so that the scheduled reports are exported here
+rather than to Google Cloud Storage. TestExportedReports then checks the
+naming and the contents of the exported reports.
+
+The server supports:
+- GET  .../b/<bucket>                                  (ping a bucket)
+- POST .../b/<bucket>/o?uploadType=media&name=<name>   (simple upload)
+- POST .../b/<bucket>/o?uploadType=multipart           (multipart upload)
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A gcsObject is an object uploaded to the fake GCS server.
+type gcsObject struct {
+	mimeType string
+	contents string
+}
+
+// fakeGcsServer stores the objects uploaded to it in memory, keyed by bucket
+// and object name. Later uploads of an object replace earlier ones, as in
+// Google Cloud Storage.
+type fakeGcsServer struct {
+	// mu protects |objects|.
+	mu      sync.Mutex
+	objects map[string]map[string]gcsObject
+}
+
+// startFakeGcsServer starts a fakeGcsServer listening on localhost:|port|.
+func startFakeGcsServer(port int) (*fakeGcsServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeGcsServer{objects: make(map[string]map[string]gcsObject)}
+	go http.Serve(listener, s)
+	return s, nil
+}
+
+// getObject returns the object |name| in |bucket| and whether it exists.
+func (s *fakeGcsServer) getObject(bucket, name string) (gcsObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[bucket][name]
+	return o, ok
+}
+
+// objectNames returns the names of the objects in |bucket|.
+func (s *fakeGcsServer) objectNames(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for name := range s.objects[bucket] {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *fakeGcsServer) putObject(bucket, name string, o gcsObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects[bucket] == nil {
+		s.objects[bucket] = make(map[string]gcsObject)
+	}
+	s.objects[bucket][name] = o
+}
+
+func (s *fakeGcsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The path is of the form [upload/]storage/v1/b/<bucket>[/o].
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	i := 0
+	for i < len(parts) && parts[i] != "b" {
+		i++
+	}
+	rest := parts[i:]
+	switch {
+	case r.Method == "GET" && len(rest) == 2:
+		writeJSON(w, map[string]string{"kind": "storage#bucket", "name": rest[1]})
+	case r.Method == "POST" && len(rest) == 3 && rest[2] == "o":
+		s.upload(w, r, rest[1])
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported request %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+	}
+}
+
+// upload handles an upload of an object to |bucket|.
+func (s *fakeGcsServer) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	name := r.URL.Query().Get("name")
+	var o gcsObject
+	switch uploadType := r.URL.Query().Get("uploadType"); uploadType {
+	case "media":
+		contents, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o = gcsObject{mimeType: r.Header.Get("Content-Type"), contents: string(contents)}
+	case "multipart":
+		var err error
+		if name, o, err = readMultipartUpload(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported uploadType %q", uploadType), http.StatusBadRequest)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Missing object name", http.StatusBadRequest)
+		return
+	}
+
+	s.putObject(bucket, name, o)
+	writeJSON(w, map[string]string{"kind": "storage#object", "bucket": bucket, "name": name, "contentType": o.mimeType})
+}
+
+// readMultipartUpload reads the body of a multipart upload, whose first part
+// is the JSON metadata of the object and whose second part is its contents.
+func readMultipartUpload(r *http.Request) (string, gcsObject, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", gcsObject{}, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", gcsObject{}, err
+	}
+	var metadata struct {
+		Name        string `json:"name"`
+		ContentType string `json:"contentType"`
+	}
+	if err := json.NewDecoder(part).Decode(&metadata); err != nil {
+		return "", gcsObject{}, err
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		return "", gcsObject{}, err
+	}
+	contents, err := ioutil.ReadAll(part)
+	if err != nil {
+		return "", gcsObject{}, err
+	}
+	mimeType := metadata.ContentType
+	if mimeType == "" {
+		mimeType = part.Header.Get("Content-Type")
+	}
+	return metadata.Name, gcsObject{mimeType: mimeType, contents: string(contents)}, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,512 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package implementing the ShufflerAdmin gRPC service whose definition can be
+found in shuffler/shuffler_admin.proto.
+
+The admin service lets operators and tests inspect and manage a running
+Shuffler. Since its RPCs modify the state of the Shuffler and export its
+Observations, it listens on localhost by default and is only started if its
+callers are authenticated. See ServerConfig.
+*/
+
+package admin
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"dispatcher"
+	"receiver"
+	"shuffler"
+	"snapshot"
+	"storage"
+	"util"
+	"util/gcs"
+	"util/stackdriver"
+)
+
+const (
+	startAdminServerFailed = "admin-start-server-failed"
+)
+
+var adminServerSingleton *AdminServer
+
+// DispatchScheduler reports when the Dispatcher last sent and will next send
+// Observations to the Analyzer and how many ObservationBatches it has sent. It
+// is implemented by *dispatcher.Dispatcher.
+type DispatchScheduler interface {
+	NextDispatchTime() time.Time
+	LastDispatchTime() time.Time
+	NumBatchesSent() uint64
+	NumBatchesFailed() uint64
+}
+
+// ServerConfig specifies the configuration options for setting up the admin
+// Grpc server.
+type ServerConfig struct {
+	// Connection uses TLS if true, else plain TCP
+	EnableTLS bool
+	// The TLS cert file
+	CertFile string
+	// The TLS key file
+	KeyFile string
+	// The host name or IP address the admin server listens on. If empty the
+	// server only listens on localhost.
+	Host string
+	// The admin server port
+	Port int
+	// If not empty, callers must send this token in the authorization
+	// metadata, see TokenCredentials
+	Token string
+	// If not empty, callers must present a TLS client certificate signed by a
+	// CA in this file. Requires EnableTLS
+	ClientCAFile string
+	// The local directory or the Cloud Storage path of the form
+	// gs://<bucket>[/<prefix>] below which ExportBucket writes, or empty if
+	// exports are disabled
+	ExportLocation string
+	// Writes the snapshots requested by CreateSnapshot, or nil if snapshots
+	// are disabled
+	Snapshotter *snapshot.Snapshotter
+	// The counts of EncryptedMessages processed by the receiver reported by
+	// GetShufflerStats, or nil if they are not reported
+	ReceiverStats *receiver.ReceiverStats
+}
+
+// AdminServer implements the ShufflerAdmin service.
+type AdminServer struct {
+	config          ServerConfig
+	loadedConfig    *shuffler.ShufflerConfig
+	effectiveConfig *shuffler.ShufflerConfig
+	batchSize       int
+	scheduler       DispatchScheduler
+	denylist        *receiver.MetricDenylist
+	store           storage.Store
+
+	// The uploader for exports to Cloud Storage, created upon the first such
+	// export. |gcsMu| protects |gcs|.
+	gcsMu sync.Mutex
+	gcs   *gcs.Uploader
+}
+
+// newAdminServer returns an AdminServer that reports |loadedConfig| with the
+// |analyzerURL| override applied. If |analyzerURL| is empty the URL from
+// |loadedConfig| is used. |denylist| is the MetricDenylist used by the
+// receiver and |store| is the Shuffler data store.
+func newAdminServer(config ServerConfig, loadedConfig *shuffler.ShufflerConfig, analyzerURL string,
+	batchSize int, scheduler DispatchScheduler, denylist *receiver.MetricDenylist, store storage.Store) *AdminServer {
+	if loadedConfig == nil {
+		panic("loadedConfig is nil")
+	}
+
+	if scheduler == nil {
+		panic("scheduler is nil")
+	}
+
+	if denylist == nil {
+		panic("denylist is nil")
+	}
+
+	if store == nil {
+		panic("store is nil")
+	}
+
+	effectiveConfig := proto.Clone(loadedConfig).(*shuffler.ShufflerConfig)
+	if effectiveConfig.GlobalConfig == nil {
+		effectiveConfig.GlobalConfig = &shuffler.Policy{}
+	}
+	if analyzerURL != "" {
+		effectiveConfig.GlobalConfig.AnalyzerUrl = analyzerURL
+	}
+
+	return &AdminServer{
+		config:          config,
+		loadedConfig:    loadedConfig,
+		effectiveConfig: effectiveConfig,
+		batchSize:       batchSize,
+		scheduler:       scheduler,
+		denylist:        denylist,
+		store:           store,
+	}
+}
+
+// GetEffectiveConfig returns the configuration the Shuffler process is using,
+// along with values derived from it.
+func (s *AdminServer) GetEffectiveConfig(ctx context.Context,
+	request *shuffler.GetEffectiveConfigRequest) (*shuffler.EffectiveConfig, error) {
+	glog.V(4).Infoln("GetEffectiveConfig() is invoked.")
+
+	// The Dispatcher never sleeps for a negative duration so an overdue
+	// dispatch is imminent.
+	nextDispatchTime := s.scheduler.NextDispatchTime()
+	if now := time.Now(); nextDispatchTime.Before(now) {
+		nextDispatchTime = now
+	}
+
+	// The denylist may have been modified at runtime.
+	effectiveConfig := proto.Clone(s.effectiveConfig).(*shuffler.ShufflerConfig)
+	effectiveConfig.MetricDenylist = s.denylist.Get().Metrics
+
+	return &shuffler.EffectiveConfig{
+		LoadedConfig:            s.loadedConfig,
+		EffectiveConfig:         effectiveConfig,
+		NextDispatchTimeSeconds: nextDispatchTime.Unix(),
+		DispatchThreshold:       s.effectiveConfig.GetGlobalConfig().Threshold,
+		BatchSize:               uint32(s.batchSize),
+		PolicyThresholds:        policyThresholds(s.effectiveConfig),
+	}, nil
+}
+
+// policyThresholds returns the threshold that dispatcher.PolicyFor() applies
+// to the metrics of each policy override in |config|, ordered by metrics.
+func policyThresholds(config *shuffler.ShufflerConfig) []*shuffler.PolicyThreshold {
+	var keys []*cobalt.ObservationMetadata
+	for _, o := range config.GetPolicyOverrides() {
+		m := o.GetMetrics()
+		key := &cobalt.ObservationMetadata{
+			CustomerId: m.GetCustomerId(),
+			ProjectId:  m.GetProjectId(),
+			MetricId:   m.GetMetricId(),
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lessBucket(keys[i], keys[j])
+	})
+
+	var thresholds []*shuffler.PolicyThreshold
+	for i, key := range keys {
+		// Several overrides for the same metrics are reported once.
+		if i > 0 && proto.Equal(key, keys[i-1]) {
+			continue
+		}
+		thresholds = append(thresholds, &shuffler.PolicyThreshold{
+			Metrics: &shuffler.MetricKey{
+				CustomerId: key.CustomerId,
+				ProjectId:  key.ProjectId,
+				MetricId:   key.MetricId,
+			},
+			Threshold: dispatcher.PolicyFor(config, key).GetThreshold(),
+		})
+	}
+	return thresholds
+}
+
+// GetMetricDenylist returns the current metric denylist and the number of
+// Observations dropped so far.
+func (s *AdminServer) GetMetricDenylist(ctx context.Context,
+	request *shuffler.GetMetricDenylistRequest) (*shuffler.MetricDenylist, error) {
+	glog.V(4).Infoln("GetMetricDenylist() is invoked.")
+	return s.denylist.Get(), nil
+}
+
+// SetMetricDenylist replaces the metric denylist with the metrics in |request|.
+func (s *AdminServer) SetMetricDenylist(ctx context.Context,
+	request *shuffler.MetricDenylist) (*shuffler.MetricDenylist, error) {
+	glog.Infof("SetMetricDenylist() is invoked with %d metrics.", len(request.GetMetrics()))
+	s.denylist.Set(request.GetMetrics())
+	return s.denylist.Get(), nil
+}
+
+// GetDispatchHistory returns the dispatch history of the buckets matching
+// |request|, sorted by bucket.
+func (s *AdminServer) GetDispatchHistory(ctx context.Context,
+	request *shuffler.GetDispatchHistoryRequest) (*shuffler.DispatchHistoryList, error) {
+	glog.V(4).Infoln("GetDispatchHistory() is invoked.")
+
+	histories, err := s.store.GetDispatchHistories()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in reading the dispatch history: %v", err)
+	}
+
+	response := &shuffler.DispatchHistoryList{}
+	for _, history := range histories {
+		if matchesBucket(history.GetBucket(), request.GetMetric(), request.GetDayIndex()) {
+			response.Buckets = append(response.Buckets, history)
+		}
+	}
+	sort.Slice(response.Buckets, func(i, j int) bool {
+		return lessBucket(response.Buckets[i].GetBucket(), response.Buckets[j].GetBucket())
+	})
+	return response, nil
+}
+
+// GetDropAudit returns the counts of deliberately dropped Observations of the
+// buckets matching |request|, sorted by bucket.
+func (s *AdminServer) GetDropAudit(ctx context.Context,
+	request *shuffler.GetDropAuditRequest) (*shuffler.DropAuditList, error) {
+	glog.V(4).Infoln("GetDropAudit() is invoked.")
+
+	audits, err := s.store.GetDropAudits()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in reading the drop audits: %v", err)
+	}
+
+	response := &shuffler.DropAuditList{}
+	for _, audit := range audits {
+		if matchesBucket(audit.GetBucket(), request.GetMetric(), request.GetDayIndex()) {
+			response.Buckets = append(response.Buckets, audit)
+		}
+	}
+	sort.Slice(response.Buckets, func(i, j int) bool {
+		return lessBucket(response.Buckets[i].GetBucket(), response.Buckets[j].GetBucket())
+	})
+	return response, nil
+}
+
+// GetUsage returns the usage records of the projects matching |request| for
+// the requested range of days, sorted by customer and project.
+func (s *AdminServer) GetUsage(ctx context.Context,
+	request *shuffler.GetUsageRequest) (*shuffler.UsageList, error) {
+	glog.V(4).Infoln("GetUsage() is invoked.")
+
+	if request.GetLastDayIndex() != 0 && request.GetFirstDayIndex() > request.GetLastDayIndex() {
+		return nil, grpc.Errorf(codes.InvalidArgument, "first_day_index %d is after last_day_index %d", request.GetFirstDayIndex(), request.GetLastDayIndex())
+	}
+
+	usages, err := s.store.GetUsage()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in reading the usage: %v", err)
+	}
+
+	response := &shuffler.UsageList{}
+	for _, usage := range usages {
+		if request.GetCustomerId() != 0 && usage.GetCustomerId() != request.GetCustomerId() {
+			continue
+		}
+		if request.GetProjectId() != 0 && usage.GetProjectId() != request.GetProjectId() {
+			continue
+		}
+		var records []*shuffler.UsageRecord
+		for _, record := range usage.GetRecords() {
+			if record.GetDayIndex() < request.GetFirstDayIndex() {
+				continue
+			}
+			if request.GetLastDayIndex() != 0 && record.GetDayIndex() > request.GetLastDayIndex() {
+				continue
+			}
+			records = append(records, record)
+		}
+		if len(records) > 0 {
+			usage.Records = records
+			response.Usage = append(response.Usage, usage)
+		}
+	}
+	sort.Slice(response.Usage, func(i, j int) bool {
+		a, b := response.Usage[i], response.Usage[j]
+		if a.GetCustomerId() != b.GetCustomerId() {
+			return a.GetCustomerId() < b.GetCustomerId()
+		}
+		return a.GetProjectId() < b.GetProjectId()
+	})
+	return response, nil
+}
+
+// GetShufflerStats returns the number of Observations buffered in the store
+// and the counts of processed EncryptedMessages and dispatched
+// ObservationBatches.
+func (s *AdminServer) GetShufflerStats(ctx context.Context,
+	request *shuffler.GetShufflerStatsRequest) (*shuffler.ShufflerStats, error) {
+	glog.V(4).Infoln("GetShufflerStats() is invoked.")
+
+	response := &shuffler.ShufflerStats{}
+	var countErr error
+	err := s.store.ForEachKey(func(bucket *cobalt.ObservationMetadata) bool {
+		numObservations, err := s.store.GetNumObservations(bucket)
+		if err != nil {
+			countErr = err
+			return false
+		}
+		response.NumBuckets++
+		response.NumObservations += uint64(numObservations)
+		if request.GetIncludeBuckets() {
+			response.Buckets = append(response.Buckets, &shuffler.BucketSize{
+				Bucket:          bucket,
+				NumObservations: uint64(numObservations),
+			})
+		}
+		return true
+	})
+	if err == nil {
+		err = countErr
+	}
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in counting the Observations: %v", err)
+	}
+	sort.Slice(response.Buckets, func(i, j int) bool {
+		return lessBucket(response.Buckets[i].GetBucket(), response.Buckets[j].GetBucket())
+	})
+
+	if lastDispatchTime := s.scheduler.LastDispatchTime(); !lastDispatchTime.IsZero() {
+		response.LastDispatchTimeSeconds = lastDispatchTime.Unix()
+	}
+	response.NumBatchesSent = s.scheduler.NumBatchesSent()
+	response.NumBatchesFailed = s.scheduler.NumBatchesFailed()
+
+	if s.config.ReceiverStats != nil {
+		response.NumEnvelopesReceived = s.config.ReceiverStats.NumEnvelopes()
+		response.NumDecryptionFailures = s.config.ReceiverStats.NumDecryptionFailures()
+	}
+	return response, nil
+}
+
+// GetVersion returns the version and commit the Shuffler binary was built
+// from and the time at which the process started.
+func (s *AdminServer) GetVersion(ctx context.Context,
+	request *shuffler.GetVersionRequest) (*shuffler.VersionInfo, error) {
+	glog.V(4).Infoln("GetVersion() is invoked.")
+	return &shuffler.VersionInfo{
+		Version:          util.Version,
+		Commit:           util.Commit,
+		StartTimeSeconds: util.StartTime.Unix(),
+	}, nil
+}
+
+// Scrub deletes the corrupted Observations from the store and returns the
+// number of Observations that were checked and deleted.
+func (s *AdminServer) Scrub(ctx context.Context,
+	request *shuffler.ScrubRequest) (*shuffler.ScrubResponse, error) {
+	glog.Infoln("Scrub() is invoked.")
+	numChecked, numDeleted, err := s.store.Scrub()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in scrubbing the store after checking %d Observations: %v", numChecked, err)
+	}
+	glog.Infof("Scrub() checked %d Observations and deleted %d corrupted ones.", numChecked, numDeleted)
+	return &shuffler.ScrubResponse{
+		NumChecked: uint64(numChecked),
+		NumDeleted: uint64(numDeleted),
+	}, nil
+}
+
+// CreateSnapshot writes a snapshot of the store and returns its URI.
+func (s *AdminServer) CreateSnapshot(ctx context.Context,
+	request *shuffler.CreateSnapshotRequest) (*shuffler.SnapshotInfo, error) {
+	glog.Infoln("CreateSnapshot() is invoked.")
+	if s.config.Snapshotter == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Snapshots are disabled, specify -snapshot_location to enable them")
+	}
+	info, err := s.config.Snapshotter.Snapshot()
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in writing the snapshot: %v", err)
+	}
+	return info, nil
+}
+
+// matchesBucket returns true if |bucket| belongs to |metric|, unless it is
+// nil, and has the day index |dayIndex|, unless it is zero.
+func matchesBucket(bucket *cobalt.ObservationMetadata, metric *shuffler.MetricKey, dayIndex uint32) bool {
+	if metric != nil {
+		if bucket.GetCustomerId() != metric.CustomerId || bucket.GetProjectId() != metric.ProjectId ||
+			bucket.GetMetricId() != metric.MetricId {
+			return false
+		}
+	}
+	if dayIndex != 0 && bucket.GetDayIndex() != dayIndex {
+		return false
+	}
+	return true
+}
+
+// lessBucket orders buckets by metric and then by day index. Buckets that only
+// differ in their SystemProfile are ordered by their text representation.
+func lessBucket(a, b *cobalt.ObservationMetadata) bool {
+	if a.GetCustomerId() != b.GetCustomerId() {
+		return a.GetCustomerId() < b.GetCustomerId()
+	}
+	if a.GetProjectId() != b.GetProjectId() {
+		return a.GetProjectId() < b.GetProjectId()
+	}
+	if a.GetMetricId() != b.GetMetricId() {
+		return a.GetMetricId() < b.GetMetricId()
+	}
+	if a.GetDayIndex() != b.GetDayIndex() {
+		return a.GetDayIndex() < b.GetDayIndex()
+	}
+	return proto.CompactTextString(a) < proto.CompactTextString(b)
+}
+
+// Run serves incoming admin requests and blocks forever unless a fatal error
+// occurs in the network layer. |loadedConfig| is the ShufflerConfig as read at
+// startup and |analyzerURL| is the value of the -analyzer_uri flag, or empty if
+// it was not passed. |denylist| is the MetricDenylist used by the receiver and
+// |store| is the Shuffler data store. Run will result in a fatal error if
+// invoked twice within the same process.
+func Run(config *ServerConfig, loadedConfig *shuffler.ShufflerConfig, analyzerURL string,
+	batchSize int, scheduler DispatchScheduler, denylist *receiver.MetricDenylist, store storage.Store) {
+	if config == nil {
+		glog.Fatal("Invalid admin server config, exiting.")
+	}
+
+	if loadedConfig == nil {
+		glog.Fatal("Invalid shuffler config, exiting.")
+	}
+
+	if scheduler == nil {
+		glog.Fatal("Invalid dispatch scheduler, exiting.")
+	}
+
+	if denylist == nil {
+		glog.Fatal("Invalid metric denylist, exiting.")
+	}
+
+	if store == nil {
+		glog.Fatal("Invalid data store handle, exiting.")
+	}
+
+	if adminServerSingleton != nil {
+		glog.Fatal("Run() must not be invoked twice, exiting.")
+	}
+
+	adminServerSingleton = newAdminServer(*config, loadedConfig, analyzerURL, batchSize, scheduler, denylist, store)
+	adminServerSingleton.startServer()
+}
+
+// startServer sets up and starts the grpc server using configuration from
+// |AdminServer.config|. The server is not started unless its callers are
+// authenticated, since its RPCs modify the state of the Shuffler and export
+// its Observations.
+func (s *AdminServer) startServer() {
+	opts, err := serverOptions(&s.config)
+	if err != nil {
+		stackdriver.LogCountMetric(startAdminServerFailed, "Grpc: Invalid admin server config:", err)
+		return
+	}
+	host := s.config.Host
+	if host == "" {
+		host = "localhost"
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(s.config.Port))
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		stackdriver.LogCountMetric(startAdminServerFailed, "Grpc: Error in accepting connections on [", address, "]:", err)
+		return
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	shuffler.RegisterShufflerAdminServer(grpcServer, s)
+	glog.Infof("Shuffler admin service is listening on %s.", address)
+	grpcServer.Serve(lis)
+}
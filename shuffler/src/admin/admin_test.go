@@ -0,0 +1,507 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"receiver"
+	"shuffler"
+	"snapshot"
+	"storage"
+	"util"
+)
+
+// fakeScheduler is a DispatchScheduler that returns fixed times and counts.
+type fakeScheduler struct {
+	nextDispatchTime time.Time
+	lastDispatchTime time.Time
+	numBatchesSent   uint64
+	numBatchesFailed uint64
+}
+
+func (f *fakeScheduler) NextDispatchTime() time.Time {
+	return f.nextDispatchTime
+}
+
+func (f *fakeScheduler) LastDispatchTime() time.Time {
+	return f.lastDispatchTime
+}
+
+func (f *fakeScheduler) NumBatchesSent() uint64 {
+	return f.numBatchesSent
+}
+
+func (f *fakeScheduler) NumBatchesFailed() uint64 {
+	return f.numBatchesFailed
+}
+
+func makeLoadedConfig() *shuffler.ShufflerConfig {
+	return &shuffler.ShufflerConfig{
+		GlobalConfig: &shuffler.Policy{
+			FrequencyInHours: 24,
+			Threshold:        100,
+			AnalyzerUrl:      "analyzer-from-config:443",
+			DisposalAgeDays:  4,
+		},
+	}
+}
+
+// Tests that GetEffectiveConfig() applies the analyzer URL override and
+// reports the derived values.
+func TestGetEffectiveConfig(t *testing.T) {
+	loadedConfig := makeLoadedConfig()
+	nextDispatchTime := time.Now().Add(10 * time.Hour)
+	s := newAdminServer(ServerConfig{}, loadedConfig, "analyzer-from-flag:443", 1000,
+		&fakeScheduler{nextDispatchTime: nextDispatchTime}, receiver.NewMetricDenylist(nil), storage.NewMemStore())
+
+	response, err := s.GetEffectiveConfig(context.Background(), &shuffler.GetEffectiveConfigRequest{})
+	if err != nil {
+		t.Fatalf("GetEffectiveConfig() failed: %v", err)
+	}
+
+	if !proto.Equal(response.LoadedConfig, makeLoadedConfig()) {
+		t.Errorf("got loaded config [%v], expected [%v]", response.LoadedConfig, makeLoadedConfig())
+	}
+
+	if got := response.EffectiveConfig.GetGlobalConfig().AnalyzerUrl; got != "analyzer-from-flag:443" {
+		t.Errorf("got effective analyzer url [%v], expected [analyzer-from-flag:443]", got)
+	}
+
+	// Overriding the analyzer URL must not modify the loaded config.
+	if got := loadedConfig.GetGlobalConfig().AnalyzerUrl; got != "analyzer-from-config:443" {
+		t.Errorf("got loaded analyzer url [%v], expected [analyzer-from-config:443]", got)
+	}
+
+	if response.NextDispatchTimeSeconds != nextDispatchTime.Unix() {
+		t.Errorf("got next dispatch time [%v], expected [%v]", response.NextDispatchTimeSeconds, nextDispatchTime.Unix())
+	}
+
+	if response.DispatchThreshold != 100 {
+		t.Errorf("got dispatch threshold [%v], expected [100]", response.DispatchThreshold)
+	}
+
+	if response.BatchSize != 1000 {
+		t.Errorf("got batch size [%v], expected [1000]", response.BatchSize)
+	}
+
+	if len(response.PolicyThresholds) != 0 {
+		t.Errorf("got policy thresholds %v, expected none", response.PolicyThresholds)
+	}
+}
+
+// Tests that GetEffectiveConfig() reports the threshold that applies to the
+// metrics of each policy override.
+func TestGetEffectiveConfigPolicyThresholds(t *testing.T) {
+	config := makeLoadedConfig()
+	config.PolicyOverrides = []*shuffler.PolicyOverride{
+		{Metrics: &shuffler.MetricKey{CustomerId: 1, ProjectId: 2, MetricId: 3}, Policy: &shuffler.Policy{Threshold: 10}},
+		{Metrics: &shuffler.MetricKey{CustomerId: 1}, Policy: &shuffler.Policy{Threshold: 50}},
+		// Only the first override for the same metrics applies.
+		{Metrics: &shuffler.MetricKey{CustomerId: 1}, Policy: &shuffler.Policy{Threshold: 60}},
+		// An override without a policy does not apply.
+		{Metrics: &shuffler.MetricKey{CustomerId: 1, ProjectId: 4}},
+	}
+	s := newAdminServer(ServerConfig{}, config, "", 1000,
+		&fakeScheduler{}, receiver.NewMetricDenylist(nil), storage.NewMemStore())
+
+	response, err := s.GetEffectiveConfig(context.Background(), &shuffler.GetEffectiveConfigRequest{})
+	if err != nil {
+		t.Fatalf("GetEffectiveConfig() failed: %v", err)
+	}
+	expected := []*shuffler.PolicyThreshold{
+		{Metrics: &shuffler.MetricKey{CustomerId: 1}, Threshold: 50},
+		{Metrics: &shuffler.MetricKey{CustomerId: 1, ProjectId: 2, MetricId: 3}, Threshold: 10},
+		{Metrics: &shuffler.MetricKey{CustomerId: 1, ProjectId: 4}, Threshold: 50},
+	}
+	if len(response.PolicyThresholds) != len(expected) {
+		t.Fatalf("got policy thresholds %v, expected %v", response.PolicyThresholds, expected)
+	}
+	for i, threshold := range response.PolicyThresholds {
+		if !proto.Equal(threshold, expected[i]) {
+			t.Errorf("got policy threshold %v, expected %v", threshold, expected[i])
+		}
+	}
+	if response.DispatchThreshold != 100 {
+		t.Errorf("got dispatch threshold [%v], expected [100]", response.DispatchThreshold)
+	}
+}
+
+// Tests that without an override the effective config equals the loaded
+// config.
+func TestGetEffectiveConfigNoOverride(t *testing.T) {
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{}, receiver.NewMetricDenylist(nil), storage.NewMemStore())
+
+	response, err := s.GetEffectiveConfig(context.Background(), &shuffler.GetEffectiveConfigRequest{})
+	if err != nil {
+		t.Fatalf("GetEffectiveConfig() failed: %v", err)
+	}
+
+	if !proto.Equal(response.EffectiveConfig, makeLoadedConfig()) {
+		t.Errorf("got effective config [%v], expected [%v]", response.EffectiveConfig, makeLoadedConfig())
+	}
+}
+
+// Tests that an overdue dispatch is reported as happening now.
+func TestGetEffectiveConfigOverdueDispatch(t *testing.T) {
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{nextDispatchTime: time.Time{}},
+		receiver.NewMetricDenylist(nil), storage.NewMemStore())
+
+	before := time.Now().Unix()
+	response, err := s.GetEffectiveConfig(context.Background(), &shuffler.GetEffectiveConfigRequest{})
+	if err != nil {
+		t.Fatalf("GetEffectiveConfig() failed: %v", err)
+	}
+	after := time.Now().Unix()
+
+	if response.NextDispatchTimeSeconds < before || response.NextDispatchTimeSeconds > after {
+		t.Errorf("got next dispatch time [%v], expected a value in [%v, %v]", response.NextDispatchTimeSeconds, before, after)
+	}
+}
+
+// Tests that the metric denylist can be modified and that the effective
+// config reflects the modification.
+func TestSetMetricDenylist(t *testing.T) {
+	loadedConfig := makeLoadedConfig()
+	loadedConfig.MetricDenylist = []*shuffler.MetricKey{{CustomerId: 1, ProjectId: 1, MetricId: 1}}
+	s := newAdminServer(ServerConfig{}, loadedConfig, "", 1000, &fakeScheduler{},
+		receiver.NewMetricDenylist(loadedConfig.MetricDenylist), storage.NewMemStore())
+
+	response, err := s.GetMetricDenylist(context.Background(), &shuffler.GetMetricDenylistRequest{})
+	if err != nil {
+		t.Fatalf("GetMetricDenylist() failed: %v", err)
+	}
+	if len(response.Metrics) != 1 || !proto.Equal(response.Metrics[0], loadedConfig.MetricDenylist[0]) {
+		t.Errorf("got denylist %v, expected %v", response.Metrics, loadedConfig.MetricDenylist)
+	}
+
+	newDenylist := []*shuffler.MetricKey{{CustomerId: 1, ProjectId: 1, MetricId: 2}, {CustomerId: 1, ProjectId: 1, MetricId: 3}}
+	response, err = s.SetMetricDenylist(context.Background(), &shuffler.MetricDenylist{Metrics: newDenylist})
+	if err != nil {
+		t.Fatalf("SetMetricDenylist() failed: %v", err)
+	}
+	if !proto.Equal(response, &shuffler.MetricDenylist{Metrics: newDenylist}) {
+		t.Errorf("got denylist %v, expected %v", response, newDenylist)
+	}
+
+	config, err := s.GetEffectiveConfig(context.Background(), &shuffler.GetEffectiveConfigRequest{})
+	if err != nil {
+		t.Fatalf("GetEffectiveConfig() failed: %v", err)
+	}
+	if !proto.Equal(&shuffler.MetricDenylist{Metrics: config.EffectiveConfig.MetricDenylist},
+		&shuffler.MetricDenylist{Metrics: newDenylist}) {
+		t.Errorf("got effective denylist %v, expected %v", config.EffectiveConfig.MetricDenylist, newDenylist)
+	}
+	if len(config.LoadedConfig.MetricDenylist) != 1 {
+		t.Errorf("the loaded config was modified: %v", config.LoadedConfig)
+	}
+}
+
+// Tests that GetDispatchHistory() filters and sorts the dispatch histories
+// from the store.
+func TestGetDispatchHistory(t *testing.T) {
+	store := storage.NewMemStore()
+	buckets := []*cobalt.ObservationMetadata{
+		{CustomerId: 1, ProjectId: 1, MetricId: 2, DayIndex: 101},
+		{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 101},
+		{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 100},
+	}
+	for i, bucket := range buckets {
+		record := &shuffler.DispatchRecord{DispatchTimeSeconds: int64(i), NumObservationsSent: 10}
+		if err := store.AddDispatchRecord(bucket, record, 10); err != nil {
+			t.Fatalf("AddDispatchRecord() failed: %v", err)
+		}
+	}
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{},
+		receiver.NewMetricDenylist(nil), store)
+
+	testCases := []struct {
+		request  *shuffler.GetDispatchHistoryRequest
+		expected []*cobalt.ObservationMetadata
+	}{
+		{&shuffler.GetDispatchHistoryRequest{}, []*cobalt.ObservationMetadata{buckets[2], buckets[1], buckets[0]}},
+		{&shuffler.GetDispatchHistoryRequest{Metric: &shuffler.MetricKey{CustomerId: 1, ProjectId: 1, MetricId: 1}},
+			[]*cobalt.ObservationMetadata{buckets[2], buckets[1]}},
+		{&shuffler.GetDispatchHistoryRequest{DayIndex: 101}, []*cobalt.ObservationMetadata{buckets[1], buckets[0]}},
+		{&shuffler.GetDispatchHistoryRequest{Metric: &shuffler.MetricKey{CustomerId: 1, ProjectId: 1, MetricId: 3}}, nil},
+	}
+	for _, tc := range testCases {
+		response, err := s.GetDispatchHistory(context.Background(), tc.request)
+		if err != nil {
+			t.Fatalf("GetDispatchHistory(%v) failed: %v", tc.request, err)
+		}
+		if len(response.Buckets) != len(tc.expected) {
+			t.Errorf("GetDispatchHistory(%v): got %d buckets, expected %d", tc.request, len(response.Buckets), len(tc.expected))
+			continue
+		}
+		for i, history := range response.Buckets {
+			if !proto.Equal(history.Bucket, tc.expected[i]) {
+				t.Errorf("GetDispatchHistory(%v): got bucket [%v] at position %d, expected [%v]", tc.request, history.Bucket, i, tc.expected[i])
+			}
+			if len(history.Records) != 1 {
+				t.Errorf("GetDispatchHistory(%v): got records %v, expected a single record", tc.request, history.Records)
+			}
+		}
+	}
+}
+
+// Tests that GetDropAudit() filters and sorts the drop audits from the store.
+func TestGetDropAudit(t *testing.T) {
+	store := storage.NewMemStore()
+	buckets := []*cobalt.ObservationMetadata{
+		{CustomerId: 1, ProjectId: 1, MetricId: 2, DayIndex: 101},
+		{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 101},
+		{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 100},
+	}
+	for _, bucket := range buckets {
+		if err := store.AddDropCount(bucket, 102, shuffler.DropRecord_RANDOM_DROP, 5); err != nil {
+			t.Fatalf("AddDropCount() failed: %v", err)
+		}
+	}
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{},
+		receiver.NewMetricDenylist(nil), store)
+
+	testCases := []struct {
+		request  *shuffler.GetDropAuditRequest
+		expected []*cobalt.ObservationMetadata
+	}{
+		{&shuffler.GetDropAuditRequest{}, []*cobalt.ObservationMetadata{buckets[2], buckets[1], buckets[0]}},
+		{&shuffler.GetDropAuditRequest{Metric: &shuffler.MetricKey{CustomerId: 1, ProjectId: 1, MetricId: 1}},
+			[]*cobalt.ObservationMetadata{buckets[2], buckets[1]}},
+		{&shuffler.GetDropAuditRequest{DayIndex: 101}, []*cobalt.ObservationMetadata{buckets[1], buckets[0]}},
+		{&shuffler.GetDropAuditRequest{Metric: &shuffler.MetricKey{CustomerId: 1, ProjectId: 1, MetricId: 3}}, nil},
+	}
+	for _, tc := range testCases {
+		response, err := s.GetDropAudit(context.Background(), tc.request)
+		if err != nil {
+			t.Fatalf("GetDropAudit(%v) failed: %v", tc.request, err)
+		}
+		if len(response.Buckets) != len(tc.expected) {
+			t.Errorf("GetDropAudit(%v): got %d buckets, expected %d", tc.request, len(response.Buckets), len(tc.expected))
+			continue
+		}
+		for i, audit := range response.Buckets {
+			if !proto.Equal(audit.Bucket, tc.expected[i]) {
+				t.Errorf("GetDropAudit(%v): got bucket [%v] at position %d, expected [%v]", tc.request, audit.Bucket, i, tc.expected[i])
+			}
+			if len(audit.Records) != 1 || audit.Records[0].ArrivalDayIndex != 102 || audit.Records[0].NumObservations != 5 {
+				t.Errorf("GetDropAudit(%v): got records %v, expected a single record of 5 observations", tc.request, audit.Records)
+			}
+		}
+	}
+}
+
+// Tests that GetUsage() filters and sorts the usage from the store.
+func TestGetUsage(t *testing.T) {
+	tenant := func(customerId, projectId uint32) storage.Tenant {
+		return storage.Tenant{CustomerId: customerId, ProjectId: projectId}
+	}
+	store := storage.NewMemStore()
+	projects := []storage.Tenant{tenant(2, 1), tenant(1, 2), tenant(1, 1)}
+	for _, p := range projects {
+		for _, dayIndex := range []uint32{100, 101, 102} {
+			if err := store.AddUsage(p.CustomerId, p.ProjectId, &shuffler.UsageRecord{DayIndex: dayIndex, NumObservationsReceived: 5}); err != nil {
+				t.Fatalf("AddUsage() failed: %v", err)
+			}
+		}
+	}
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{},
+		receiver.NewMetricDenylist(nil), store)
+
+	testCases := []struct {
+		request      *shuffler.GetUsageRequest
+		expected     []storage.Tenant
+		expectedDays []uint32
+	}{
+		{&shuffler.GetUsageRequest{}, []storage.Tenant{tenant(1, 1), tenant(1, 2), tenant(2, 1)}, []uint32{100, 101, 102}},
+		{&shuffler.GetUsageRequest{CustomerId: 1}, []storage.Tenant{tenant(1, 1), tenant(1, 2)}, []uint32{100, 101, 102}},
+		{&shuffler.GetUsageRequest{CustomerId: 1, ProjectId: 2, FirstDayIndex: 101}, []storage.Tenant{tenant(1, 2)}, []uint32{101, 102}},
+		{&shuffler.GetUsageRequest{FirstDayIndex: 101, LastDayIndex: 101}, []storage.Tenant{tenant(1, 1), tenant(1, 2), tenant(2, 1)}, []uint32{101}},
+		{&shuffler.GetUsageRequest{FirstDayIndex: 103}, nil, nil},
+	}
+	for _, tc := range testCases {
+		response, err := s.GetUsage(context.Background(), tc.request)
+		if err != nil {
+			t.Fatalf("GetUsage(%v) failed: %v", tc.request, err)
+		}
+		if len(response.Usage) != len(tc.expected) {
+			t.Errorf("GetUsage(%v): got %d projects, expected %d", tc.request, len(response.Usage), len(tc.expected))
+			continue
+		}
+		for i, usage := range response.Usage {
+			if tenant(usage.CustomerId, usage.ProjectId) != tc.expected[i] {
+				t.Errorf("GetUsage(%v): got project (%d, %d) at position %d, expected %v", tc.request, usage.CustomerId, usage.ProjectId, i, tc.expected[i])
+			}
+			var days []uint32
+			for _, record := range usage.Records {
+				days = append(days, record.DayIndex)
+			}
+			if !reflect.DeepEqual(days, tc.expectedDays) {
+				t.Errorf("GetUsage(%v): got days %v, expected %v", tc.request, days, tc.expectedDays)
+			}
+		}
+	}
+
+	if _, err := s.GetUsage(context.Background(), &shuffler.GetUsageRequest{FirstDayIndex: 102, LastDayIndex: 101}); err == nil {
+		t.Errorf("GetUsage() succeeded for an empty range of days")
+	}
+}
+
+// Tests that GetVersion() reports the build info of the binary.
+// Tests that GetShufflerStats() reports the sizes of the buckets in the store
+// and the counts of the scheduler.
+func TestGetShufflerStats(t *testing.T) {
+	store := storage.NewMemStore()
+	buckets := []*cobalt.ObservationMetadata{
+		{CustomerId: 1, ProjectId: 1, MetricId: 2, DayIndex: 100},
+		{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 100},
+	}
+	for i, bucket := range buckets {
+		for j := 0; j <= i; j++ {
+			if err := store.AddAllObservations([]*cobalt.ObservationBatch{
+				{MetaData: bucket, EncryptedObservation: []*cobalt.EncryptedMessage{{Ciphertext: []byte("c")}}},
+			}, storage.Arrival{DayIndex: 100}); err != nil {
+				t.Fatalf("AddAllObservations() failed: %v", err)
+			}
+		}
+	}
+	lastDispatchTime := time.Unix(1000, 0)
+	scheduler := &fakeScheduler{lastDispatchTime: lastDispatchTime, numBatchesSent: 5, numBatchesFailed: 1}
+	s := newAdminServer(ServerConfig{ReceiverStats: &receiver.ReceiverStats{}}, makeLoadedConfig(), "", 1000, scheduler,
+		receiver.NewMetricDenylist(nil), store)
+
+	response, err := s.GetShufflerStats(context.Background(), &shuffler.GetShufflerStatsRequest{})
+	if err != nil {
+		t.Fatalf("GetShufflerStats() failed: %v", err)
+	}
+	expected := &shuffler.ShufflerStats{
+		NumBuckets:              2,
+		NumObservations:         3,
+		LastDispatchTimeSeconds: 1000,
+		NumBatchesSent:          5,
+		NumBatchesFailed:        1,
+	}
+	if !proto.Equal(response, expected) {
+		t.Errorf("got stats [%v], expected [%v]", response, expected)
+	}
+
+	response, err = s.GetShufflerStats(context.Background(), &shuffler.GetShufflerStatsRequest{IncludeBuckets: true})
+	if err != nil {
+		t.Fatalf("GetShufflerStats() failed: %v", err)
+	}
+	if len(response.Buckets) != 2 {
+		t.Fatalf("got %d buckets, expected 2", len(response.Buckets))
+	}
+	if !proto.Equal(response.Buckets[0].Bucket, buckets[1]) || response.Buckets[0].NumObservations != 2 {
+		t.Errorf("got bucket [%v], expected [%v] with 2 Observations", response.Buckets[0], buckets[1])
+	}
+	if !proto.Equal(response.Buckets[1].Bucket, buckets[0]) || response.Buckets[1].NumObservations != 1 {
+		t.Errorf("got bucket [%v], expected [%v] with 1 Observation", response.Buckets[1], buckets[0])
+	}
+
+	// Without a dispatch cycle the last dispatch time is reported as zero.
+	s = newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{},
+		receiver.NewMetricDenylist(nil), storage.NewMemStore())
+	response, err = s.GetShufflerStats(context.Background(), &shuffler.GetShufflerStatsRequest{})
+	if err != nil {
+		t.Fatalf("GetShufflerStats() failed: %v", err)
+	}
+	if !proto.Equal(response, &shuffler.ShufflerStats{}) {
+		t.Errorf("got stats [%v], expected empty stats", response)
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{}, receiver.NewMetricDenylist(nil), storage.NewMemStore())
+
+	response, err := s.GetVersion(context.Background(), &shuffler.GetVersionRequest{})
+	if err != nil {
+		t.Fatalf("GetVersion() failed: %v", err)
+	}
+
+	if response.Version != util.Version || response.Commit != util.Commit {
+		t.Errorf("got version [%v] and commit [%v], expected [%v] and [%v]", response.Version, response.Commit, util.Version, util.Commit)
+	}
+
+	if response.StartTimeSeconds <= 0 || response.StartTimeSeconds > time.Now().Unix() {
+		t.Errorf("got start time [%v], expected a time in the past", response.StartTimeSeconds)
+	}
+}
+
+// Tests that Scrub() reports the number of Observations checked in the store.
+func TestScrub(t *testing.T) {
+	store := storage.NewMemStore()
+	batch := storage.NewObservationBatchForMetadata(storage.NewObservationMetaData(1), 5)
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{}, receiver.NewMetricDenylist(nil), store)
+
+	response, err := s.Scrub(context.Background(), &shuffler.ScrubRequest{})
+	if err != nil {
+		t.Fatalf("Scrub() failed: %v", err)
+	}
+	if response.NumChecked != 5 || response.NumDeleted != 0 {
+		t.Errorf("got response [%v], expected 5 checked and 0 deleted Observations", response)
+	}
+}
+
+// fakeSnapshotStore is a snapshot.Store that writes a fixed content.
+type fakeSnapshotStore struct{}
+
+func (f fakeSnapshotStore) WriteSnapshot(w io.Writer) (uint64, error) {
+	_, err := io.WriteString(w, "rows")
+	return 4, err
+}
+
+// Tests that CreateSnapshot() fails unless snapshots are enabled and then
+// returns the URI of the snapshot written.
+func TestCreateSnapshot(t *testing.T) {
+	s := newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000, &fakeScheduler{}, receiver.NewMetricDenylist(nil), storage.NewMemStore())
+	if _, err := s.CreateSnapshot(context.Background(), &shuffler.CreateSnapshotRequest{}); grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CreateSnapshot() without a Snapshotter: got error %v, expected FailedPrecondition", err)
+	}
+
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotter, err := snapshot.NewSnapshotter([]snapshot.NamedStore{{Name: "default", Store: fakeSnapshotStore{}}}, dir, 1)
+	if err != nil {
+		t.Fatalf("NewSnapshotter() failed: %v", err)
+	}
+	s = newAdminServer(ServerConfig{Snapshotter: snapshotter}, makeLoadedConfig(), "", 1000, &fakeScheduler{},
+		receiver.NewMetricDenylist(nil), storage.NewMemStore())
+	info, err := s.CreateSnapshot(context.Background(), &shuffler.CreateSnapshotRequest{})
+	if err != nil {
+		t.Fatalf("CreateSnapshot() failed: %v", err)
+	}
+	if !strings.HasPrefix(info.Uri, dir+"/") || info.NumRows != 4 || info.NumBytes != 4 {
+		t.Errorf("got snapshot info [%v], expected a snapshot in %s of 4 rows and 4 bytes", info, dir)
+	}
+}
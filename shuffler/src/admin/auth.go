@@ -0,0 +1,153 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// The metadata key and the scheme of the token that authenticates callers of
+// the admin service.
+const (
+	authorizationKey    = "authorization"
+	authorizationScheme = "Bearer "
+)
+
+// ReadTokenFile returns the token stored in the file |path|, without
+// surrounding whitespace.
+func ReadTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("The token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// tokenAuthenticator rejects the RPCs whose metadata does not hold |token| as
+// a bearer token.
+type tokenAuthenticator struct {
+	token []byte
+}
+
+// authenticate returns an Unauthenticated error unless the metadata of |ctx|
+// holds the token of |a|.
+func (a *tokenAuthenticator) authenticate(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return grpc.Errorf(codes.Unauthenticated, "The request has no %s metadata.", authorizationKey)
+	}
+	for _, value := range md[authorizationKey] {
+		if !strings.HasPrefix(value, authorizationScheme) {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(value, authorizationScheme)), a.token) == 1 {
+			return nil
+		}
+	}
+	return grpc.Errorf(codes.Unauthenticated, "The request does not hold a valid token.")
+}
+
+func (a *tokenAuthenticator) unaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *tokenAuthenticator) streamInterceptor(srv interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.authenticate(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// TokenCredentials are the credentials of a client of the admin service that
+// is authenticated by a token. See ServerConfig.Token.
+type TokenCredentials struct {
+	token string
+}
+
+// NewTokenCredentials returns the TokenCredentials for |token|, to be passed
+// to grpc.WithPerRPCCredentials().
+func NewTokenCredentials(token string) *TokenCredentials {
+	return &TokenCredentials{token: token}
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (c *TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorizationKey: authorizationScheme + c.token}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials. The token
+// may be sent without TLS to an admin service on localhost.
+func (c *TokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// serverOptions returns the options of the grpc server of the admin service
+// for |config|, which authenticate the callers with mTLS if
+// |config.ClientCAFile| is set and with a token if |config.Token| is set.
+// Returns an error if neither is set.
+func serverOptions(config *ServerConfig) ([]grpc.ServerOption, error) {
+	if config.Token == "" && config.ClientCAFile == "" {
+		return nil, fmt.Errorf("Neither a token nor a client CA is specified to authenticate callers.")
+	}
+	if config.ClientCAFile != "" && !config.EnableTLS {
+		return nil, fmt.Errorf("Authenticating callers by their certificates requires TLS.")
+	}
+
+	var opts []grpc.ServerOption
+	if config.EnableTLS {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the TLS certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if config.ClientCAFile != "" {
+			pem, err := ioutil.ReadFile(config.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read the client CA: %v", err)
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("No certificates found in the client CA file %s", config.ClientCAFile)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if config.Token != "" {
+		a := &tokenAuthenticator{token: []byte(config.Token)}
+		opts = append(opts, grpc.UnaryInterceptor(a.unaryInterceptor), grpc.StreamInterceptor(a.streamInterceptor))
+	}
+	return opts, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"receiver"
+	"shuffler"
+	"storage"
+)
+
+// Tests that the admin server is not configured unless its callers are
+// authenticated.
+func TestServerOptions(t *testing.T) {
+	for _, config := range []ServerConfig{
+		{},
+		{EnableTLS: true},
+		{ClientCAFile: "ca.pem"},
+	} {
+		if _, err := serverOptions(&config); err == nil {
+			t.Errorf("serverOptions(%+v) succeeded, expected an error", config)
+		}
+	}
+	if opts, err := serverOptions(&ServerConfig{Token: "secret"}); err != nil || len(opts) == 0 {
+		t.Errorf("serverOptions() with a token: got (%v, %v), expected the interceptors", opts, err)
+	}
+}
+
+// Tests that only the RPCs holding the token are served.
+func TestTokenAuthentication(t *testing.T) {
+	opts, err := serverOptions(&ServerConfig{Token: "secret"})
+	if err != nil {
+		t.Fatalf("serverOptions() failed: %v", err)
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	server := grpc.NewServer(opts...)
+	shuffler.RegisterShufflerAdminServer(server, newAdminServer(ServerConfig{}, makeLoadedConfig(), "", 1000,
+		&fakeScheduler{}, receiver.NewMetricDenylist(nil), storage.NewMemStore()))
+	go server.Serve(lis)
+	defer server.Stop()
+
+	for _, tc := range []struct {
+		opts []grpc.DialOption
+		code codes.Code
+	}{
+		{nil, codes.Unauthenticated},
+		{[]grpc.DialOption{grpc.WithPerRPCCredentials(NewTokenCredentials("wrong"))}, codes.Unauthenticated},
+		{[]grpc.DialOption{grpc.WithPerRPCCredentials(NewTokenCredentials("secret"))}, codes.OK},
+	} {
+		conn, err := grpc.Dial(lis.Addr().String(), append(tc.opts, grpc.WithInsecure())...)
+		if err != nil {
+			t.Fatalf("Dial() failed: %v", err)
+		}
+		_, err = shuffler.NewShufflerAdminClient(conn).GetVersion(context.Background(), &shuffler.GetVersionRequest{})
+		if grpc.Code(err) != tc.code {
+			t.Errorf("GetVersion() returned %v, expected code %v", err, tc.code)
+		}
+		conn.Close()
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "admin_token")
+	if err != nil {
+		t.Fatalf("TempFile() failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+	if token, err := ReadTokenFile(f.Name()); err != nil || token != "secret" {
+		t.Errorf("ReadTokenFile() = (%q, %v), expected secret", token, err)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte(" \n"), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if _, err := ReadTokenFile(f.Name()); err == nil {
+		t.Errorf("ReadTokenFile() succeeded for an empty file")
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+	"util/gcs"
+)
+
+// ExportBucket writes the Observations of the bucket with key |request.Bucket|
+// to |request.Destination| without deleting them. See WriteExport for the
+// format of the exported data. The destination must be inside the
+// |ExportLocation| of the server config.
+func (s *AdminServer) ExportBucket(ctx context.Context,
+	request *shuffler.ExportBucketRequest) (*shuffler.ExportBucketResponse, error) {
+	glog.Infof("ExportBucket() is invoked for bucket [%v] and destination %s.", request.GetBucket(), request.GetDestination())
+
+	bucket := request.GetBucket()
+	if bucket == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "The bucket to export is not set.")
+	}
+	if request.GetDestination() == "" {
+		return nil, grpc.Errorf(codes.InvalidArgument, "The destination of the export is not set.")
+	}
+	if s.config.ExportLocation == "" {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Exports are disabled since no export location is configured.")
+	}
+	if err := checkExportDestination(s.config.ExportLocation, request.GetDestination()); err != nil {
+		return nil, grpc.Errorf(codes.PermissionDenied, "Invalid destination %s: %v", request.GetDestination(), err)
+	}
+	batchSize := int(request.GetBatchSize())
+	if batchSize == 0 {
+		batchSize = s.batchSize
+	}
+
+	numObservations, err := s.store.GetNumObservations(bucket)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in reading the bucket: %v", err)
+	}
+	if numObservations == 0 {
+		return nil, grpc.Errorf(codes.NotFound, "The bucket [%v] does not contain any Observations.", bucket)
+	}
+
+	iterator, err := s.store.GetObservations(bucket)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in reading the bucket: %v", err)
+	}
+	defer iterator.Release()
+
+	response, err := s.writeExportDestination(ctx, request.GetDestination(), func(w io.Writer) (*shuffler.ExportBucketResponse, error) {
+		return WriteExport(w, bucket, iterator, batchSize)
+	})
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in writing the export to %s: %v", request.GetDestination(), err)
+	}
+	glog.Infof("Exported %d Observations in %d batches to %s.", response.NumObservations, response.NumBatches, request.GetDestination())
+	return response, nil
+}
+
+// checkExportDestination returns an error unless |destination| names a file
+// below the local directory |location| or an object below the Cloud Storage
+// path |location| of the form gs://<bucket>[/<prefix>].
+func checkExportDestination(location, destination string) error {
+	if strings.HasPrefix(location, gcs.Prefix) {
+		bucket, prefix, err := gcs.ParsePath(location)
+		if err != nil {
+			return err
+		}
+		destinationBucket, object, err := gcs.ParseObject(destination)
+		if err != nil {
+			return err
+		}
+		if destinationBucket != bucket || !strings.HasPrefix(object, prefix) {
+			return fmt.Errorf("not an object below %s", location)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(destination, gcs.Prefix) {
+		return fmt.Errorf("not a file below %s", location)
+	}
+	// The directory of the destination must be below |location| once any
+	// symbolic links are resolved. The file itself is created by
+	// writeExportDestination() without following a symbolic link.
+	dir, err := resolvePath(location)
+	if err != nil {
+		return err
+	}
+	parent, err := resolvePath(filepath.Dir(destination))
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dir, parent); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("not a file below %s", location)
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path of |path| with any symbolic links
+// resolved.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// writeExportDestination creates |destination|, which is either a local file
+// that does not exist yet or a Cloud Storage object of the form
+// gs://<bucket>/<object>, and streams to it the data written by |write|.
+// Returns the response of |write|. A local file is removed if |write| fails,
+// and an upload to Cloud Storage is abandoned if |ctx| is cancelled.
+func (s *AdminServer) writeExportDestination(ctx context.Context, destination string,
+	write func(w io.Writer) (*shuffler.ExportBucketResponse, error)) (*shuffler.ExportBucketResponse, error) {
+	if !strings.HasPrefix(destination, gcs.Prefix) {
+		f, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w := bufio.NewWriter(f)
+		response, err := write(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(destination)
+			return nil, err
+		}
+		return response, nil
+	}
+
+	bucket, object, err := gcs.ParseObject(destination)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := s.gcsUploader()
+	if err != nil {
+		return nil, err
+	}
+
+	// The export is uploaded while it is being written. If writing fails the
+	// upload fails as well, and the object is not created.
+	r, w := io.Pipe()
+	var response *shuffler.ExportBucketResponse
+	written := make(chan error, 1)
+	go func() {
+		var err error
+		response, err = write(w)
+		w.CloseWithError(err)
+		written <- err
+	}()
+	err = uploader.Upload(ctx, bucket, object, r, "application/octet-stream", "")
+	// Unblocks write() if the upload failed before reading all of the data.
+	r.CloseWithError(fmt.Errorf("The upload failed."))
+	writeErr := <-written
+	if err != nil {
+		return nil, err
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	return response, nil
+}
+
+// gcsUploader returns the uploader for exports to Cloud Storage, which is
+// created upon the first such export.
+func (s *AdminServer) gcsUploader() (*gcs.Uploader, error) {
+	s.gcsMu.Lock()
+	defer s.gcsMu.Unlock()
+	if s.gcs == nil {
+		uploader, err := gcs.NewDefaultUploader()
+		if err != nil {
+			return nil, err
+		}
+		s.gcs = uploader
+	}
+	return s.gcs, nil
+}
+
+// WriteExport writes the ObservationVals produced by |iterator| to |w| as
+// ObservationBatches with the key |bucket| and at most |batchSize|
+// Observations each. Each serialized ObservationBatch is preceded by its size
+// in bytes as an unsigned varint. Returns the number of Observations and
+// batches written.
+func WriteExport(w io.Writer, bucket *cobalt.ObservationMetadata, iterator storage.Iterator,
+	batchSize int) (*shuffler.ExportBucketResponse, error) {
+	if batchSize <= 0 {
+		panic("batchSize must be positive")
+	}
+
+	response := &shuffler.ExportBucketResponse{}
+	batch := &cobalt.ObservationBatch{MetaData: bucket}
+	flush := func() error {
+		if len(batch.EncryptedObservation) == 0 {
+			return nil
+		}
+		if err := writeDelimited(w, batch); err != nil {
+			return err
+		}
+		response.NumObservations += uint32(len(batch.EncryptedObservation))
+		response.NumBatches++
+		batch.EncryptedObservation = nil
+		return nil
+	}
+
+	for iterator.Next() {
+		obVal, err := iterator.Get()
+		if err != nil {
+			return nil, err
+		}
+		batch.EncryptedObservation = append(batch.EncryptedObservation, obVal.EncryptedObservation)
+		if len(batch.EncryptedObservation) == batchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// ReadExport reads the ObservationBatches written by WriteExport from |r|.
+func ReadExport(r io.Reader) ([]*cobalt.ObservationBatch, error) {
+	br := bufio.NewReader(r)
+	var batches []*cobalt.ObservationBatch
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return batches, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the size of batch %d: %v", len(batches), err)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("Unable to read batch %d: %v", len(batches), err)
+		}
+		batch := &cobalt.ObservationBatch{}
+		if err := proto.Unmarshal(data, batch); err != nil {
+			return nil, fmt.Errorf("Unable to parse batch %d: %v", len(batches), err)
+		}
+		batches = append(batches, batch)
+	}
+}
+
+// writeDelimited writes the size of the serialization of |batch| as an
+// unsigned varint followed by the serialization to |w|.
+func writeDelimited(w io.Writer, batch *cobalt.ObservationBatch) error {
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(proto.EncodeVarint(uint64(len(data)))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"cobalt"
+	"receiver"
+	"shuffler"
+	"storage"
+	"util/gcs"
+)
+
+// makeExportServer returns an AdminServer that exports below |location| and
+// its store, which holds |numObservations| Observations in the bucket
+// NewObservationMetaData(1).
+func makeExportServer(t *testing.T, location string, numObservations int) (*AdminServer, *storage.MemStore) {
+	store := storage.NewMemStore()
+	batch := storage.NewObservationBatchForMetadata(storage.NewObservationMetaData(1), numObservations)
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+	return newAdminServer(ServerConfig{ExportLocation: location}, makeLoadedConfig(), "", 4, &fakeScheduler{},
+		receiver.NewMetricDenylist(nil), store), store
+}
+
+// Tests that ExportBucket() writes the Observations of a bucket to a file in
+// batches without deleting them.
+func TestExportBucketToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, store := makeExportServer(t, dir, 10)
+	destination := filepath.Join(dir, "bucket.export")
+
+	bucket := storage.NewObservationMetaData(1)
+	response, err := s.ExportBucket(context.Background(), &shuffler.ExportBucketRequest{
+		Bucket:      bucket,
+		Destination: destination,
+	})
+	if err != nil {
+		t.Fatalf("ExportBucket() failed: %v", err)
+	}
+	if response.NumObservations != 10 || response.NumBatches != 3 {
+		t.Errorf("got %d observations in %d batches, expected 10 in 3", response.NumObservations, response.NumBatches)
+	}
+
+	f, err := os.Open(destination)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer f.Close()
+	batches, err := ReadExport(f)
+	if err != nil {
+		t.Fatalf("ReadExport() failed: %v", err)
+	}
+	numObservations := 0
+	for _, batch := range batches {
+		if !proto.Equal(batch.MetaData, bucket) {
+			t.Errorf("got batch metadata [%v], expected [%v]", batch.MetaData, bucket)
+		}
+		if len(batch.EncryptedObservation) > 4 {
+			t.Errorf("got a batch of %d observations, expected at most 4", len(batch.EncryptedObservation))
+		}
+		numObservations += len(batch.EncryptedObservation)
+	}
+	if len(batches) != 3 || numObservations != 10 {
+		t.Errorf("read %d observations in %d batches, expected 10 in 3", numObservations, len(batches))
+	}
+
+	// The bucket is unchanged.
+	storage.CheckNumObservations(t, store, bucket, 10)
+
+	// An existing file is not overwritten.
+	if _, err := s.ExportBucket(context.Background(), &shuffler.ExportBucketRequest{
+		Bucket:      bucket,
+		Destination: destination,
+	}); err == nil {
+		t.Errorf("ExportBucket() succeeded for an existing file")
+	}
+}
+
+// Tests that ExportBucket() uploads the export to Cloud Storage.
+func TestExportBucketToGCS(t *testing.T) {
+	s, _ := makeExportServer(t, "gs://exports/replay", 5)
+
+	var uploaded []byte
+	var path, name string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		name = r.URL.Query().Get("name")
+		uploaded, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	s.gcs = gcs.NewUploader(server.Client(), server.URL+"/")
+
+	response, err := s.ExportBucket(context.Background(), &shuffler.ExportBucketRequest{
+		Bucket:      storage.NewObservationMetaData(1),
+		Destination: "gs://exports/replay/bucket.export",
+		BatchSize:   2,
+	})
+	if err != nil {
+		t.Fatalf("ExportBucket() failed: %v", err)
+	}
+	if response.NumObservations != 5 || response.NumBatches != 3 {
+		t.Errorf("got %d observations in %d batches, expected 5 in 3", response.NumObservations, response.NumBatches)
+	}
+	if path != "/b/exports/o" || name != "replay/bucket.export" {
+		t.Errorf("got upload of object %s to %s, expected replay/bucket.export to /b/exports/o", name, path)
+	}
+	batches, err := ReadExport(bytes.NewReader(uploaded))
+	if err != nil {
+		t.Fatalf("ReadExport() failed: %v", err)
+	}
+	if len(batches) != 3 {
+		t.Errorf("read %d batches, expected 3", len(batches))
+	}
+}
+
+// Tests that ExportBucket() rejects invalid requests.
+func TestExportBucketErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, _ := makeExportServer(t, dir, 5)
+	destination := filepath.Join(dir, "bucket.export")
+
+	requests := []*shuffler.ExportBucketRequest{
+		{Destination: destination},
+		{Bucket: storage.NewObservationMetaData(1)},
+		{Bucket: storage.NewObservationMetaData(2), Destination: destination},
+	}
+	for _, request := range requests {
+		if _, err := s.ExportBucket(context.Background(), request); err == nil {
+			t.Errorf("ExportBucket(%v) succeeded, expected an error", request)
+		}
+	}
+	if _, err := os.Stat(destination); err == nil {
+		t.Errorf("A rejected ExportBucket() created %s", destination)
+	}
+}
+
+// Tests that ExportBucket() only writes below the configured export location.
+func TestExportBucketDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(os.TempDir(), filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Symlink() failed: %v", err)
+	}
+
+	for _, test := range []struct {
+		location    string
+		destination string
+	}{
+		{"", filepath.Join(dir, "bucket.export")},
+		{dir, filepath.Join(os.TempDir(), "bucket.export")},
+		{dir, filepath.Join(dir, "..", "bucket.export")},
+		{dir, filepath.Join(dir, "link", "bucket.export")},
+		{dir, dir},
+		{dir, "gs://exports/bucket.export"},
+		{"gs://exports/replay", "gs://exports/replay"},
+		{"gs://exports/replay", "gs://exports/replay/"},
+		{"gs://exports/replay", "gs://exports/replay2/bucket.export"},
+		{"gs://exports/replay", "gs://exports/bucket.export"},
+		{"gs://exports/replay", "gs://other/replay/bucket.export"},
+		{"gs://exports/replay", filepath.Join(dir, "bucket.export")},
+		{"gs://exports", "gs://exports"},
+	} {
+		s, _ := makeExportServer(t, test.location, 5)
+		if _, err := s.ExportBucket(context.Background(), &shuffler.ExportBucketRequest{
+			Bucket:      storage.NewObservationMetaData(1),
+			Destination: test.destination,
+		}); err == nil {
+			t.Errorf("ExportBucket() to %s succeeded with the export location %q, expected an error",
+				test.destination, test.location)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(os.TempDir(), "bucket.export")); err == nil {
+		t.Errorf("ExportBucket() wrote outside the export location")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This file contains a program that simulates the dispatch cycles of a Shuffler
+under a candidate Policy, so that operators can tune |threshold|,
+|frequency_in_hours|, |disposal_age_days| and |p_observation_drop| before
+changing the production config.
+
+The ingest statistics are read from -ingest_stats_file, a text file with a line
+<customer>,<project>,<metric>,<observations per day> for each metric, e.g. as
+computed from the ingestion audit log of the receiver. The candidate Policy is
+the global config of -config_file, if specified, with the values of the policy
+flags that are set taking precedence.
+
+For each metric the program prints the number of Observations that arrived,
+were dropped, dispatched, disposed of or are still buffered at the end of the
+simulation, the number and sizes of the dispatches, the number of hours for
+which the dispatched Observations were buffered and the fraction of the arrived
+Observations that were disposed of.
+
+The simulation assumes that Observations arrive at constant rates with the day
+index of their arrival and ignores the SystemProfiles, which may split the
+buckets of a metric further, as well as the bandwidth shares of the priority
+classes. Its results are therefore optimistic for metrics with many
+SystemProfiles.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	"shuffler"
+	"shuffler_config"
+)
+
+var (
+	ingestStatsFile = flag.String("ingest_stats_file", "", "A text file with a line <customer>,<project>,<metric>,<observations per day> for each metric.")
+	configFile      = flag.String("config_file", "", "A Shuffler config file whose global config is the candidate Policy. Defaults to the Shuffler's default config.")
+	days            = flag.Int("days", 14, "The number of days that are simulated.")
+
+	frequencyInHours = flag.Int("frequency_in_hours", -1, "If not negative, overrides |frequency_in_hours| of the candidate Policy.")
+	threshold        = flag.Int("threshold", -1, "If not negative, overrides |threshold| of the candidate Policy.")
+	disposalAgeDays  = flag.Int("disposal_age_days", -1, "If not negative, overrides |disposal_age_days| of the candidate Policy.")
+	pObservationDrop = flag.Float64("p_observation_drop", -1, "If not negative, overrides |p_observation_drop| of the candidate Policy.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *ingestStatsFile == "" {
+		glog.Exit("-ingest_stats_file is required.")
+	}
+	if *days <= 0 {
+		glog.Exit("-days must be positive.")
+	}
+
+	f, err := os.Open(*ingestStatsFile)
+	if err != nil {
+		glog.Exit(err)
+	}
+	rates, err := parseIngestRates(f)
+	f.Close()
+	if err != nil {
+		glog.Exitf("Invalid -ingest_stats_file: %v", err)
+	}
+
+	policy := candidatePolicy()
+	if policy.PObservationDrop < 0 || policy.PObservationDrop > 1 {
+		glog.Exitf("Invalid p_observation_drop [%v], expected a value in [0.0, 1.0].", policy.PObservationDrop)
+	}
+	glog.Infof("Simulating %d days of the policy: %v", *days, proto.CompactTextString(policy))
+
+	s := newSimulation(policy, rates)
+	s.run(*days * 24)
+	if err := printStats(os.Stdout, s.stats); err != nil {
+		glog.Exit(err)
+	}
+}
+
+// candidatePolicy returns the Policy to simulate as specified by the flags.
+func candidatePolicy() *shuffler.Policy {
+	// The same default as that of the Shuffler.
+	policy := &shuffler.Policy{
+		FrequencyInHours: 24,
+		PObservationDrop: 0.0,
+		Threshold:        500,
+		DisposalAgeDays:  4,
+	}
+	if *configFile != "" {
+		config, err := shuffler_config.LoadConfig(*configFile)
+		if err != nil {
+			glog.Exit("Error loading shuffler config file: [", *configFile, "]: ", err)
+		}
+		if config.GetGlobalConfig() == nil {
+			glog.Exitf("The shuffler config file [%s] has no global config.", *configFile)
+		}
+		policy = config.GetGlobalConfig()
+	}
+
+	if *frequencyInHours >= 0 {
+		policy.FrequencyInHours = uint32(*frequencyInHours)
+	}
+	if *threshold >= 0 {
+		policy.Threshold = uint32(*threshold)
+	}
+	if *disposalAgeDays >= 0 {
+		policy.DisposalAgeDays = uint32(*disposalAgeDays)
+	}
+	if *pObservationDrop >= 0 {
+		policy.PObservationDrop = float32(*pObservationDrop)
+	}
+	return policy
+}
@@ -0,0 +1,324 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"shuffler"
+)
+
+// metricKey identifies a metric.
+type metricKey struct {
+	customerId uint32
+	projectId  uint32
+	metricId   uint32
+}
+
+func (k metricKey) String() string {
+	return fmt.Sprintf("%d/%d/%d", k.customerId, k.projectId, k.metricId)
+}
+
+// parseIngestRates parses the number of Observations received per day for
+// each metric from |r|. Each line has the form
+// <customer>,<project>,<metric>,<observations per day>. Empty lines and lines
+// starting with '#' are ignored.
+func parseIngestRates(r io.Reader) (map[metricKey]float64, error) {
+	rates := make(map[metricKey]float64)
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected <customer>,<project>,<metric>,<observations per day>, got [%s]", lineNumber, line)
+		}
+		var ids [3]uint32
+		for i := range ids {
+			id, err := strconv.ParseUint(strings.TrimSpace(fields[i]), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid id [%s]", lineNumber, fields[i])
+			}
+			ids[i] = uint32(id)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(fields[3]), 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("line %d: invalid number of observations per day [%s]", lineNumber, fields[3])
+		}
+		k := metricKey{ids[0], ids[1], ids[2]}
+		if _, ok := rates[k]; ok {
+			return nil, fmt.Errorf("line %d: metric %v is listed twice", lineNumber, k)
+		}
+		rates[k] = rate
+	}
+	return rates, scanner.Err()
+}
+
+// cohort is a number of Observations of a bucket that arrived in the same hour.
+type cohort struct {
+	arrivalHour int
+	num         uint64
+}
+
+// bucket holds the buffered Observations of a metric for a day index. The
+// simulation assumes that the day index of an Observation is the day on which
+// it arrives and ignores the SystemProfile, which may split a bucket further.
+type bucket struct {
+	metric  metricKey
+	cohorts []cohort
+	size    uint64
+}
+
+type bucketKey struct {
+	metric   metricKey
+	dayIndex int
+}
+
+// metricStats are the results of the simulation for a single metric.
+type metricStats struct {
+	numArrived    uint64
+	numDropped    uint64
+	numDispatched uint64
+	numDisposed   uint64
+	numBuffered   uint64
+
+	numDispatches   int
+	maxDispatchSize uint64
+
+	// The sum over the dispatched Observations of the number of hours for which
+	// they were buffered, and the maximum.
+	totalLatencyHours uint64
+	maxLatencyHours   int
+}
+
+// meanDispatchSize returns the average number of Observations per dispatched
+// bucket.
+func (s *metricStats) meanDispatchSize() float64 {
+	if s.numDispatches == 0 {
+		return 0
+	}
+	return float64(s.numDispatched) / float64(s.numDispatches)
+}
+
+// meanLatencyHours returns the average number of hours for which the
+// dispatched Observations were buffered.
+func (s *metricStats) meanLatencyHours() float64 {
+	if s.numDispatched == 0 {
+		return 0
+	}
+	return float64(s.totalLatencyHours) / float64(s.numDispatched)
+}
+
+// disposalRate returns the fraction of the arrived Observations that were
+// disposed of without being dispatched.
+func (s *metricStats) disposalRate() float64 {
+	if s.numArrived == 0 {
+		return 0
+	}
+	return float64(s.numDisposed) / float64(s.numArrived)
+}
+
+// simulation models the dispatcher and the disposal goroutine of a Shuffler
+// that buffers Observations arriving at constant rates, in steps of one hour.
+type simulation struct {
+	policy *shuffler.Policy
+	rates  map[metricKey]float64
+
+	hour    int
+	buckets map[bucketKey]*bucket
+	stats   map[metricKey]*metricStats
+
+	// The fractional Observations carried over to the next hour, or to the next
+	// dispatch, so that the rates are met exactly on average.
+	arrivalCarry map[metricKey]float64
+	dropCarry    map[metricKey]float64
+}
+
+// newSimulation returns a simulation of |policy| with Observations arriving
+// at |rates| per day.
+func newSimulation(policy *shuffler.Policy, rates map[metricKey]float64) *simulation {
+	if policy == nil {
+		panic("policy is nil")
+	}
+
+	s := &simulation{
+		policy:       policy,
+		rates:        rates,
+		buckets:      make(map[bucketKey]*bucket),
+		stats:        make(map[metricKey]*metricStats),
+		arrivalCarry: make(map[metricKey]float64),
+		dropCarry:    make(map[metricKey]float64),
+	}
+	for k := range rates {
+		s.stats[k] = &metricStats{}
+	}
+	return s
+}
+
+// run simulates |hours| hours.
+func (s *simulation) run(hours int) {
+	for i := 0; i < hours; i++ {
+		s.step()
+	}
+	for _, b := range s.buckets {
+		s.stats[b.metric].numBuffered += b.size
+	}
+}
+
+// step simulates the arrival of one hour of Observations followed by the
+// dispatch, if one is due at the end of the hour, and the disposal.
+func (s *simulation) step() {
+	day := s.hour / 24
+	for k, rate := range s.rates {
+		stats := s.stats[k]
+		s.arrivalCarry[k] += rate / 24
+		numArrived := uint64(s.arrivalCarry[k])
+		s.arrivalCarry[k] -= float64(numArrived)
+		stats.numArrived += numArrived
+		if numArrived == 0 {
+			continue
+		}
+		key := bucketKey{k, day}
+		b, ok := s.buckets[key]
+		if !ok {
+			b = &bucket{metric: k}
+			s.buckets[key] = b
+		}
+		b.cohorts = append(b.cohorts, cohort{s.hour, numArrived})
+		b.size += numArrived
+	}
+	s.hour++
+
+	// A frequency of zero dispatches continuously, which is approximated by
+	// dispatching every hour.
+	if frequency := int(s.policy.FrequencyInHours); frequency == 0 || s.hour%frequency == 0 {
+		s.dispatch()
+	}
+	s.dispose()
+}
+
+// dispatch dispatches the buckets that hold at least |Threshold| Observations.
+// As in the dispatcher, a fraction |PObservationDrop| of the Observations of a
+// bucket is dropped first and the bucket is only dispatched if the
+// Observations that are kept reach |Threshold|; otherwise it is left for a
+// later dispatch after its stale Observations are disposed of.
+func (s *simulation) dispatch() {
+	for key, b := range s.buckets {
+		if b.size < uint64(s.policy.Threshold) {
+			continue
+		}
+		carry := s.dropCarry[b.metric]
+		kept := make([]cohort, len(b.cohorts))
+		var numKept uint64
+		for i, c := range b.cohorts {
+			carry += float64(c.num) * float64(s.policy.PObservationDrop)
+			numDropped := uint64(carry)
+			if numDropped > c.num {
+				numDropped = c.num
+			}
+			carry -= float64(numDropped)
+			kept[i] = cohort{c.arrivalHour, c.num - numDropped}
+			numKept += c.num - numDropped
+		}
+		if numKept < uint64(s.policy.Threshold) {
+			s.disposeStale(key, b)
+			continue
+		}
+		s.dropCarry[b.metric] = carry
+
+		stats := s.stats[b.metric]
+		stats.numDropped += b.size - numKept
+		stats.numDispatches++
+		stats.numDispatched += numKept
+		if numKept > stats.maxDispatchSize {
+			stats.maxDispatchSize = numKept
+		}
+		for _, c := range kept {
+			latency := s.hour - c.arrivalHour
+			stats.totalLatencyHours += uint64(latency) * c.num
+			if latency > stats.maxLatencyHours {
+				stats.maxLatencyHours = latency
+			}
+		}
+		delete(s.buckets, key)
+	}
+}
+
+// dispose deletes the Observations of the buckets below |Threshold| that
+// arrived more than |DisposalAgeDays| days before the current day.
+func (s *simulation) dispose() {
+	for key, b := range s.buckets {
+		if b.size < uint64(s.policy.Threshold) {
+			s.disposeStale(key, b)
+		}
+	}
+}
+
+// disposeStale deletes the Observations of |b| that arrived more than
+// |DisposalAgeDays| days before the current day.
+func (s *simulation) disposeStale(key bucketKey, b *bucket) {
+	day := s.hour / 24
+	stats := s.stats[b.metric]
+	kept := b.cohorts[:0]
+	for _, c := range b.cohorts {
+		if day-c.arrivalHour/24 > int(s.policy.DisposalAgeDays) {
+			stats.numDisposed += c.num
+			b.size -= c.num
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	b.cohorts = kept
+	if b.size == 0 {
+		delete(s.buckets, key)
+	}
+}
+
+// printStats writes a table of |stats| to |w|, sorted by metric.
+func printStats(w io.Writer, stats map[metricKey]*metricStats) error {
+	keys := make([]metricKey, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.customerId != b.customerId {
+			return a.customerId < b.customerId
+		}
+		if a.projectId != b.projectId {
+			return a.projectId < b.projectId
+		}
+		return a.metricId < b.metricId
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "metric\tarrived\tdropped\tdispatched\tdisposed\tbuffered\tdispatches\tmean size\tmax size\tmean latency (h)\tmax latency (h)\tdisposal rate\t")
+	for _, k := range keys {
+		s := stats[k]
+		fmt.Fprintf(tw, "%v\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f\t%d\t%.1f\t%d\t%.3f\t\n",
+			k, s.numArrived, s.numDropped, s.numDispatched, s.numDisposed, s.numBuffered,
+			s.numDispatches, s.meanDispatchSize(), s.maxDispatchSize,
+			s.meanLatencyHours(), s.maxLatencyHours, s.disposalRate())
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"shuffler"
+)
+
+var (
+	busyMetric  = metricKey{1, 2, 3}
+	quietMetric = metricKey{1, 2, 4}
+)
+
+// Tests parsing the ingest statistics.
+func TestParseIngestRates(t *testing.T) {
+	rates, err := parseIngestRates(strings.NewReader("# customer,project,metric,per day\n1,2,3,2400\n\n1, 2, 4, 0.5\n"))
+	if err != nil {
+		t.Fatalf("parseIngestRates() failed: %v", err)
+	}
+	expected := map[metricKey]float64{busyMetric: 2400, quietMetric: 0.5}
+	if !reflect.DeepEqual(rates, expected) {
+		t.Errorf("got rates %v, expected %v", rates, expected)
+	}
+
+	for _, invalid := range []string{"1,2,3", "1,2,x,5", "1,2,3,-1", "1,2,3,4\n1,2,3,5"} {
+		if _, err := parseIngestRates(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error for [%s]", invalid)
+		}
+	}
+}
+
+// Tests that a metric above the threshold is dispatched once per dispatch
+// cycle and that its latency is measured from the arrival hour.
+func TestSimulateDispatch(t *testing.T) {
+	s := newSimulation(&shuffler.Policy{
+		FrequencyInHours: 24,
+		Threshold:        500,
+		DisposalAgeDays:  4,
+		PObservationDrop: 0.5,
+	}, map[metricKey]float64{busyMetric: 4800})
+	s.run(48)
+
+	stats := s.stats[busyMetric]
+	if stats.numArrived != 9600 || stats.numDropped != 4800 || stats.numDispatched != 4800 || stats.numBuffered != 0 {
+		t.Errorf("got unexpected counts %+v", stats)
+	}
+	if stats.numDispatches != 2 || stats.maxDispatchSize != 2400 || stats.meanDispatchSize() != 2400 {
+		t.Errorf("got unexpected dispatch sizes %+v", stats)
+	}
+	// The Observations arriving in hours 0 to 23 are dispatched at the end of
+	// hour 23 and are buffered for 24 to 1 hours.
+	if stats.meanLatencyHours() != 12.5 || stats.maxLatencyHours != 24 {
+		t.Errorf("got mean latency %v and max latency %v, expected 12.5 and 24", stats.meanLatencyHours(), stats.maxLatencyHours)
+	}
+}
+
+// Tests that a bucket whose kept Observations do not reach the threshold is not
+// dispatched and that its Observations are disposed of after
+// |disposal_age_days|.
+func TestSimulateDropBelowThreshold(t *testing.T) {
+	s := newSimulation(&shuffler.Policy{
+		FrequencyInHours: 24,
+		Threshold:        3000,
+		DisposalAgeDays:  1,
+		PObservationDrop: 0.5,
+	}, map[metricKey]float64{busyMetric: 4800})
+	s.run(4 * 24)
+
+	// At the end of day 3 the Observations of days 0 to 2 have been disposed.
+	stats := s.stats[busyMetric]
+	if stats.numArrived != 19200 || stats.numDropped != 0 || stats.numDispatched != 0 || stats.numDisposed != 14400 || stats.numBuffered != 4800 {
+		t.Errorf("got unexpected counts %+v", stats)
+	}
+	if rate := stats.disposalRate(); rate != 0.75 {
+		t.Errorf("got disposal rate %v, expected 0.75", rate)
+	}
+}
+
+// Tests that the Observations of a metric below the threshold are disposed of
+// after |disposal_age_days|.
+func TestSimulateDisposal(t *testing.T) {
+	s := newSimulation(&shuffler.Policy{
+		FrequencyInHours: 1,
+		Threshold:        500,
+		DisposalAgeDays:  1,
+	}, map[metricKey]float64{quietMetric: 24})
+	s.run(5 * 24)
+
+	// At the end of day 4 the Observations of days 0 to 3 have been disposed.
+	stats := s.stats[quietMetric]
+	if stats.numArrived != 120 || stats.numDispatched != 0 || stats.numDisposed != 96 || stats.numBuffered != 24 {
+		t.Errorf("got unexpected counts %+v", stats)
+	}
+	if rate := stats.disposalRate(); rate != 0.8 {
+		t.Errorf("got disposal rate %v, expected 0.8", rate)
+	}
+}
@@ -22,6 +22,10 @@ package dispatcher
 
 import (
 	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -29,11 +33,13 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 
 	"analyzer/analyzer_service"
 	"cobalt"
 	"shuffler"
 	"storage"
+	"util"
 	"util/stackdriver"
 )
 
@@ -44,11 +50,53 @@ const dispatchDelay = 1 * time.Second
 // duration between each invocation of Dispatch().
 const minWaitTime = 1 * time.Second
 
+// The disposal of stale Observations runs in its own goroutine and wakes up
+// once every DefaultDisposalInterval unless SetDisposalSchedule() is invoked.
+const DefaultDisposalInterval = 1 * time.Hour
+
+// During disposal we sleep for DefaultDisposalDelay between buckets and
+// between delete batches within a bucket, unless SetDisposalSchedule() is
+// invoked, so that disposal of a large stale bucket does not saturate the
+// store.
+const DefaultDisposalDelay = 100 * time.Millisecond
+
+// DefaultDeleteChunkSize is the largest number of Observations deleted from
+// the store in a single write unless SetDeleteChunkSize() is invoked.
+const DefaultDeleteChunkSize = 1000
+
+// The number of most recent dispatch attempts recorded per bucket.
+const dispatchHistoryLength = 10
+
+// The dispatch history of a bucket is deleted once its most recent dispatch
+// attempt is older than |dispatchHistoryRetention|.
+const dispatchHistoryRetention = 30 * 24 * time.Hour
+
+// The size in bytes of the random id of a dummy Observation, which matches the
+// random ids generated by the Encoder.
+const dummyRandomIdSize = 8
+
+// The drop audit of a bucket is deleted once the most recent day on which
+// Observations of the bucket were dropped is older than |dropAuditRetention|.
+const dropAuditRetention = 30 * 24 * time.Hour
+
+// The keys of the outgoing gRPC metadata that identify the customer and
+// project of the ObservationBatch sent to the Analyzer.
+const (
+	customerIdMetadataKey = "cobalt-customer-id"
+	projectIdMetadataKey  = "cobalt-project-id"
+)
+
 const (
 	dispatchFailed              = "dispatcher-dispatch-failed"
 	dispatchBucketFailed        = "dispatcher-dispatch-bucket-failed"
 	deleteOldObservationsFailed = "dispatcher-delete-old-observations-failed"
 	makeBatchFailed             = "dispatcher-make-batch-failed"
+	disposeFailed               = "dispatcher-dispose-failed"
+	recordDispatchFailed        = "dispatcher-record-dispatch-failed"
+	pruneDispatchHistoryFailed  = "dispatcher-prune-dispatch-history-failed"
+	pruneDropAuditFailed        = "dispatcher-prune-drop-audit-failed"
+	escalateFailed              = "dispatcher-escalate-failed"
+	escalatedBucket             = "dispatcher-escalated-bucket"
 )
 
 // AnalyzerTransport is an interface for Analyzer where the observations get
@@ -68,15 +116,21 @@ type AnalyzerTransport interface {
 // |cc.CAFile| is optional. If non-empty it should specify the path to a file
 // containing a PEM encoding of root certificates to use for TLS.
 //
+// |TLSServerName| is optional. If non-empty the certificate of the Analyzer is
+// verified for this name instead of the host in |URL|, e.g. when connecting
+// through a load balancer whose certificate names differ from the dialed
+// address.
+//
 // |URL| specifies the url for the analyzer.
 //
 // |Timeout| specifies the time duration to terminate the client
 // grpc connection to analyzer.
 type GrpcClientConfig struct {
-	EnableTLS bool
-	CAFile    string
-	Timeout   time.Duration
-	URL       string
+	EnableTLS     bool
+	CAFile        string
+	TLSServerName string
+	Timeout       time.Duration
+	URL           string
 }
 
 // GrpcAnalyzerTransport sends data to Analyzer specified by Grpc |clientConfig|
@@ -84,10 +138,16 @@ type GrpcClientConfig struct {
 //
 // |conn| handle is used for closing and re-establishing grpc connections when
 // dispatcher toggles between send and wait modes.
+//
+// GrpcAnalyzerTransport is thread-safe so that several buckets can be
+// dispatched concurrently.
 type GrpcAnalyzerTransport struct {
 	clientConfig *GrpcClientConfig
-	conn         *grpc.ClientConn
-	client       analyzer_service.AnalyzerClient
+
+	// mu protects |conn| and |client|.
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	client analyzer_service.AnalyzerClient
 }
 
 // NewGrpcAnalyzerTransport establishes a Grpc connection to the Analyzer
@@ -114,7 +174,8 @@ func NewGrpcAnalyzerTransport(clientConfig *GrpcClientConfig) *GrpcAnalyzerTrans
 // parameters or ignored, otherwise TLS is used.
 //
 // |CAFile| is optional. If non-empty it should specify the path to a file
-// containing a PEM encoding of root certificates to use for TLS.
+// containing a PEM encoding of root certificates to use for TLS. So is
+// |TLSServerName|, which overrides the name the certificate is verified for.
 //
 // Returns a non-nil error on failure.
 func (g *GrpcAnalyzerTransport) connect() (err error) {
@@ -128,12 +189,12 @@ func (g *GrpcAnalyzerTransport) connect() (err error) {
 		var creds credentials.TransportCredentials
 		if g.clientConfig.CAFile != "" {
 			var err error
-			creds, err = credentials.NewClientTLSFromFile(g.clientConfig.CAFile, "")
+			creds, err = credentials.NewClientTLSFromFile(g.clientConfig.CAFile, g.clientConfig.TLSServerName)
 			if err != nil {
 				return grpc.Errorf(codes.Internal, "Failed to create TLS credentials %v", err)
 			}
 		} else {
-			creds = credentials.NewClientTLSFromCert(nil, "")
+			creds = credentials.NewClientTLSFromCert(nil, g.clientConfig.TLSServerName)
 		}
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 	} else {
@@ -143,18 +204,27 @@ func (g *GrpcAnalyzerTransport) connect() (err error) {
 	opts = append(opts, grpc.WithTimeout(g.clientConfig.Timeout))
 
 	glog.V(4).Infoln("Dialing", g.clientConfig.URL, "...")
-	g.conn, err = grpc.Dial(g.clientConfig.URL, opts...)
+	conn, err := grpc.Dial(g.clientConfig.URL, opts...)
 	if err != nil {
 		return grpc.Errorf(codes.Internal, "Error in establishing connection to Analyzer [%v]: %v", g.clientConfig.URL, err)
 	}
 
-	g.client = analyzer_service.NewAnalyzerClient(g.conn)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Another worker may have reconnected in the meantime.
+	if g.conn != nil {
+		g.conn.Close()
+	}
+	g.conn = conn
+	g.client = analyzer_service.NewAnalyzerClient(conn)
 
 	return nil
 }
 
 // close closes all the grpc underlying connections to Analyzer.
 func (g *GrpcAnalyzerTransport) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	if g.conn != nil {
 		g.conn.Close()
 	}
@@ -194,35 +264,75 @@ func shouldReconnect(err error) bool {
 	return false
 }
 
-// sendToAnalyzer sends |obBatch| using the given AnalyzerTransport. It
-// implements a simple retry and reconnect logic: In case of a send failure,
-// depending on the returned error code, it may try up to |numAttempts| times
-// with a sleep between attempts of |sleepMillis| ms. Also depending on the
-// error code it may disconnect and reconnect.
+// sendToAnalyzer sends |obBatch| using the given AnalyzerTransport. In case
+// of a send failure, depending on the returned error code, it retries up to
+// the |maxAttempts| of |policy| with an exponential backoff between attempts.
+// If |policy| is nil the defaults of AnalyzerRetryPolicy apply. Also depending
+// on the error code it may disconnect and reconnect.
+//
+// If |breaker|, which may be nil, is open the batch is not sent and
+// errCircuitOpen is returned. Otherwise the outcome is recorded in |breaker|.
+// Failures for which retrying is not appropriate, e.g. a batch rejected by the
+// Analyzer, do not count towards opening |breaker|, since the Analyzer is
+// reachable.
+//
+// The attempts, retries, reconnects and the eventual outcome are counted in
+// |stats|.
 func sendToAnalyzer(t AnalyzerTransport, obBatch *cobalt.ObservationBatch,
-	numAttempts int, sleepMillis int) (err error) {
-	// We implement a simple-minded retry strategy: Try a few times with a
-	// few seconds wait in between attempts. We don't bother with exponential
-	// backoff or jitter or anything else fancy. This strategy is sufficient
-	// given that if the send fails then in the next iteration of the Shuffler's
-	// Run() loop it will attempt to send all unsent observations.
-	for i := 0; i < numAttempts; i++ {
+	policy *retryPolicy, breaker *circuitBreaker, stats *sendStats) (err error) {
+	if stats == nil {
+		panic("stats is nil")
+	}
+
+	if !breaker.allow() {
+		stats.rejected++
+		return errCircuitOpen
+	}
+	if policy == nil {
+		policy = newRetryPolicy(nil)
+	}
+
+	defer func() {
+		if err == nil {
+			stats.succeeded++
+		} else {
+			stats.failed++
+		}
+		breaker.record(err == nil || !shouldRetry(err))
+	}()
+
+	// Retrying is not essential since if the send fails then in the next
+	// iteration of the Shuffler's Run() loop it will attempt to send all unsent
+	// observations, but it avoids delaying the batch by a whole dispatch cycle
+	// after a transient failure.
+	for attempt := 1; ; attempt++ {
+		stats.attempts++
 		err = t.send(obBatch)
-		if err == nil || i == (numAttempts-1) || !shouldRetry(err) {
+		if err == nil || attempt >= policy.maxAttempts || !shouldRetry(err) {
 			return err
 		}
+		stats.retries[grpc.Code(err)]++
 		if shouldReconnect(err) {
+			stats.reconnects++
 			t.close()
 			err = t.connect()
 			if err != nil {
 				glog.Errorf("Unable to reestablish a connection to the Analyzer: %v", err)
 			}
 		}
-		glog.V(3).Infof("send attempt failed. Sleeping for %v milliseconds", sleepMillis)
-		time.Sleep(time.Duration(sleepMillis) * time.Millisecond)
+		backoff := policy.backoff(attempt)
+		glog.V(3).Infof("send attempt failed. Sleeping for %v", backoff)
+		time.Sleep(backoff)
 	}
-	// Control never reaches this point
-	return nil
+}
+
+// projectContext returns a new context whose outgoing gRPC metadata identifies
+// the customer and project of |om| for billing.
+func projectContext(om *cobalt.ObservationMetadata) context.Context {
+	md := metadata.Pairs(
+		customerIdMetadataKey, strconv.FormatUint(uint64(om.GetCustomerId()), 10),
+		projectIdMetadataKey, strconv.FormatUint(uint64(om.GetProjectId()), 10))
+	return metadata.NewOutgoingContext(context.Background(), md)
 }
 
 // send forwards a given ObservationBatch to Analyzer using the AddObservations
@@ -236,15 +346,19 @@ func (g *GrpcAnalyzerTransport) send(obBatch *cobalt.ObservationBatch) error {
 		return grpc.Errorf(codes.InvalidArgument, "ObservationBatch is not set.")
 	}
 
-	if g.conn == nil || g.client == nil {
+	g.mu.Lock()
+	client := g.client
+	g.mu.Unlock()
+	if client == nil {
 		return grpc.Errorf(codes.Internal, "Cannot send: Not currently connected to Analyzer")
 	}
 
 	// Shuffler forwards a new context, so as to break the context correlation
 	// between originating request and the shuffled request that is being
-	// forwarded.
+	// forwarded. It only carries the project of the batch, which the batch
+	// reveals anyway, so that the cost of the request can be attributed to it.
 	glog.V(3).Infof("sending batch of %d observations to the analyzer.", len(obBatch.GetEncryptedObservation()))
-	_, err := g.client.AddObservations(context.Background(), obBatch)
+	_, err := client.AddObservations(projectContext(obBatch.GetMetaData()), obBatch)
 	if err != nil {
 		glog.Errorf("AddObservations call failed with error: %v", err)
 		return err
@@ -262,15 +376,102 @@ type Dispatcher struct {
 	batchSize         int
 	analyzerTransport AnalyzerTransport
 	lastDispatchTime  time.Time
+
+	// The largest number of Observations deleted from |store| in a single
+	// DeleteValues call.
+	deleteChunkSize int
+
+	// mu protects |lastDispatchTime| and the counts below, which are read by
+	// the admin service.
+	mu sync.Mutex
+
+	// The start of the most recent dispatch cycle, which unlike
+	// |lastDispatchTime| is not set by SetStartSchedule(), the numbers of
+	// ObservationBatches sent and failed in all dispatch cycles, and the number
+	// of Observations dropped by |observationDrop|.
+	lastDispatchCycle      time.Time
+	numBatchesSent         uint64
+	numBatchesFailed       uint64
+	numObservationsDropped uint64
+
+	// The dispatch and the disposal goroutines lease each bucket in the store
+	// before working on it, so that a bucket is never dispatched and disposed
+	// of at the same time, nor dispatched by the Dispatchers of several
+	// Shufflers sharing the store. The leases are held by |leaseOwner| and
+	// expire after |leaseTTL|. See leases.go.
+	leaseOwner string
+	leaseTTL   time.Duration
+
+	// How often the disposal goroutine runs and how long it sleeps between
+	// buckets and delete batches. See SetDisposalSchedule().
+	disposalInterval time.Duration
+	disposalDelay    time.Duration
+
+	// If not nil, the ciphertext sizes of dispatched Observations are recorded
+	// in |observationSizes|.
+	observationSizes *util.ObservationSizes
+
+	// If not nil, the order in which Observations are sent is recorded in
+	// |shuffleAudit|. See EnableShuffleAudit().
+	shuffleAudit *shuffleAudit
+
+	// The first dispatch is delayed by a random duration of at most
+	// |startJitter| and, if |startPhase| is not negative, aligned to it. See
+	// SetStartSchedule().
+	startJitter time.Duration
+	startPhase  time.Duration
+
+	// If not nil, the Observations that are sent successfully are counted per
+	// project for usage accounting. See EnableUsageMetering().
+	usageMeter *storage.UsageMeter
+
+	// If not nil, the encryption schemes of the Observations that are sent
+	// successfully are recorded in |encryptionStats|.
+	encryptionStats *EncryptionStats
+
+	// Encrypts the dummy Observations that pad escalated buckets for the
+	// Analyzer. See SetDummyEncrypter().
+	dummyEncrypter *util.EncryptedMessageMaker
+
+	// If positive, the number of buckets dispatched concurrently, overriding
+	// |dispatch_concurrency| in |config|. See SetDispatchConcurrency().
+	dispatchConcurrency int
+
+	// How sending a batch to the Analyzer is retried, and the circuit breaker
+	// that stops sending to a failing Analyzer, which is nil if disabled. See
+	// SetRetryPolicy().
+	retryPolicy *retryPolicy
+	breaker     *circuitBreaker
+
+	// If not nil, the Observations of the buckets being dispatched are dropped
+	// at random as specified by |p_observation_drop| of the global policy.
+	observationDrop *observationDrop
+
+	// The start of the dispatch cycle in which the buckets of each policy in
+	// |config| were last due, keyed by the scope of the policy. See
+	// duePolicies(). Only accessed by the dispatch goroutine.
+	policyDueTimes map[metricKey]time.Time
+
+	// |stop| is closed by Stop() to make the dispatch and the disposal
+	// goroutines return once they are done with their current bucket.
+	// |running| counts those goroutines.
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+
+	// |started| is closed by Start() once the first dispatch is scheduled.
+	started chan struct{}
 }
 
 var dispatcherSingleton *Dispatcher
 
-// Start function either routes the incoming request from Encoder to next
-// Shuffler or to the Analyzer, if the dispatch criteria is met. If the
-// dispatch criteria is not met, the incoming Observation is buffered locally
-// for the next dispatch attempt.
-func Start(config *shuffler.ShufflerConfig, store storage.Store, batchSize int, analyzerTransport AnalyzerTransport) {
+// NewDispatcher returns a new Dispatcher that sends the Observations in
+// |store| to the Analyzer using |analyzerTransport| according to |config|, in
+// ObservationBatches of size at most |batchSize|. If |observationSizes| is not
+// nil the ciphertext sizes of the dispatched Observations are recorded in it.
+// The returned Dispatcher does not do anything until Start() is invoked.
+func NewDispatcher(config *shuffler.ShufflerConfig, store storage.Store, batchSize int, analyzerTransport AnalyzerTransport,
+	observationSizes *util.ObservationSizes) *Dispatcher {
 	if store == nil {
 		glog.Fatal("Invalid data store handle, exiting.")
 	}
@@ -287,19 +488,237 @@ func Start(config *shuffler.ShufflerConfig, store storage.Store, batchSize int,
 		glog.Fatal("Invalid batch size.")
 	}
 
-	if dispatcherSingleton != nil {
-		glog.Fatal("Start() must not be invoked twice, exiting.")
+	var drop *observationDrop
+	if p := config.GetGlobalConfig().GetPObservationDrop(); p > 0 {
+		if p > 1 {
+			glog.Fatalf("Invalid p_observation_drop [%v], expected a value in [0.0, 1.0].", p)
+		}
+		glog.Infof("Dropping dispatched Observations with probability %v.", p)
+		drop = newObservationDrop(float64(p), &util.SecureRandom{})
 	}
 
-	// invoke dispatcher
-	dispatcherSingleton := &Dispatcher{
+	return &Dispatcher{
 		store:             store,
 		config:            config,
 		batchSize:         batchSize,
 		analyzerTransport: analyzerTransport,
 		lastDispatchTime:  time.Time{},
+		deleteChunkSize:   DefaultDeleteChunkSize,
+		leaseOwner:        newLeaseOwner(),
+		leaseTTL:          DefaultLeaseTTL,
+		disposalInterval:  DefaultDisposalInterval,
+		disposalDelay:     DefaultDisposalDelay,
+		observationSizes:  observationSizes,
+		startPhase:        -1,
+		policyDueTimes:    make(map[metricKey]time.Time),
+		retryPolicy:       newRetryPolicy(config.GetGlobalConfig().GetAnalyzerRetryPolicy()),
+		breaker:           newCircuitBreaker(config.GetGlobalConfig().GetAnalyzerRetryPolicy()),
+		observationDrop:   drop,
+		stop:              make(chan struct{}),
+		started:           make(chan struct{}),
+	}
+}
+
+// SetStartSchedule sets when the first dispatch occurs, which by default is
+// immediately after Start() is invoked. Shufflers that are restarted together
+// would otherwise dispatch at the same times, causing load spikes in the
+// Analyzer.
+//
+// If |phase| is not negative the dispatches are aligned to |phase| past the
+// start of each dispatch interval, counted from midnight UTC for intervals
+// that divide a day. For example with a |frequency_in_hours| of 24 and a
+// |phase| of 3 hours the Shuffler dispatches at 03:00 UTC. The first dispatch
+// is additionally delayed by a random duration of at most |maxJitter|. Must be
+// invoked before Start().
+func (d *Dispatcher) SetStartSchedule(maxJitter time.Duration, phase time.Duration) {
+	if maxJitter < 0 {
+		panic("maxJitter must not be negative")
+	}
+	d.startJitter = maxJitter
+	d.startPhase = phase
+}
+
+// SetDeleteChunkSize sets the largest number of Observations that are deleted
+// from the store in a single write, both after a batch has been sent to the
+// Analyzer and during disposal. Smaller chunks avoid large writes that stall
+// the receiver at the cost of more writes. Must be invoked before Start().
+func (d *Dispatcher) SetDeleteChunkSize(deleteChunkSize int) {
+	if deleteChunkSize <= 0 {
+		panic("deleteChunkSize must be positive")
+	}
+	d.deleteChunkSize = deleteChunkSize
+}
+
+// SetDisposalSchedule sets how often stale Observations are disposed of, and
+// how long the disposal sleeps between buckets and between delete batches
+// within a bucket, which limits the rate at which it writes to the store. The
+// first disposal runs when Start() is invoked. Must be invoked before Start().
+func (d *Dispatcher) SetDisposalSchedule(interval time.Duration, delay time.Duration) {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	if delay < 0 {
+		panic("delay must not be negative")
+	}
+	d.disposalInterval = interval
+	d.disposalDelay = delay
+}
+
+// EnableShuffleAudit makes the Dispatcher write a transcript of the order in
+// which it sends Observations to |w|. Each Observation is identified by the
+// HMAC-SHA256 of its ciphertext under |key|. Comparing the transcript with the
+// order in which Observations arrived allows verifying that dispatching breaks
+// the arrival order. Must be invoked before Start().
+func (d *Dispatcher) EnableShuffleAudit(key []byte, w io.Writer) {
+	d.shuffleAudit = newShuffleAudit(key, w)
+}
+
+// EnableUsageMetering makes the Dispatcher count the Observations it sends
+// successfully, and the size of their ciphertexts, in |usageMeter| on the day
+// they are sent. Must be invoked before Start().
+func (d *Dispatcher) EnableUsageMetering(usageMeter *storage.UsageMeter) {
+	d.usageMeter = usageMeter
+}
+
+// EnableEncryptionStats makes the Dispatcher record the encryption schemes of
+// the Observations it sends successfully in |encryptionStats|. Must be invoked
+// before Start().
+func (d *Dispatcher) EnableEncryptionStats(encryptionStats *EncryptionStats) {
+	d.encryptionStats = encryptionStats
+}
+
+// SetDummyEncrypter sets the EncryptedMessageMaker used to encrypt the dummy
+// Observations with which buckets that are dispatched below the threshold are
+// padded if |pad_escalated_buckets| is set in the config. |dummyEncrypter|
+// must encrypt for the Analyzer. Must be invoked before Start().
+func (d *Dispatcher) SetDummyEncrypter(dummyEncrypter *util.EncryptedMessageMaker) {
+	d.dummyEncrypter = dummyEncrypter
+}
+
+// SetDispatchConcurrency sets the number of buckets that are dispatched to the
+// Analyzer concurrently, overriding |dispatch_concurrency| in the config. The
+// batches of a single bucket are still sent one at a time. Must be invoked
+// before Start().
+func (d *Dispatcher) SetDispatchConcurrency(dispatchConcurrency int) {
+	if dispatchConcurrency <= 0 {
+		panic("dispatchConcurrency must be positive")
+	}
+	d.dispatchConcurrency = dispatchConcurrency
+}
+
+// SetRetryPolicy sets how sending a batch to the Analyzer is retried and when
+// the Dispatcher stops sending to a failing Analyzer, overriding
+// |analyzer_retry_policy| in the config. Must be invoked before Start().
+func (d *Dispatcher) SetRetryPolicy(policy *shuffler.AnalyzerRetryPolicy) {
+	d.retryPolicy = newRetryPolicy(policy)
+	d.breaker = newCircuitBreaker(policy)
+}
+
+// concurrency returns the number of buckets that are dispatched concurrently.
+func (d *Dispatcher) concurrency() int {
+	if d.dispatchConcurrency > 0 {
+		return d.dispatchConcurrency
+	}
+	if n := d.config.GetGlobalConfig().DispatchConcurrency; n > 0 {
+		return int(n)
+	}
+	return 1
+}
+
+// Start function either routes the incoming request from Encoder to next
+// Shuffler or to the Analyzer, if the dispatch criteria is met. If the
+// dispatch criteria is not met, the incoming Observation is buffered locally
+// for the next dispatch attempt. Start blocks until Stop() is invoked and will
+// result in a fatal error if invoked twice within the same process.
+func (d *Dispatcher) Start() {
+	if dispatcherSingleton != nil {
+		glog.Fatal("Start() must not be invoked twice, exiting.")
+	}
+	d.running.Add(2)
+
+	// invoke dispatcher
+	dispatcherSingleton = d
+	var jitter time.Duration
+	if d.startJitter > 0 {
+		jitter = time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(d.startJitter)))
+	}
+	d.mu.Lock()
+	d.scheduleFirstDispatch(time.Now(), jitter)
+	glog.Infof("The first dispatch is due at %v.", d.nextDispatchTime())
+	d.mu.Unlock()
+	close(d.started)
+	go func() {
+		defer d.running.Done()
+		d.runDisposal()
+	}()
+	defer d.running.Done()
+	d.Run()
+}
+
+// Started returns a channel that is closed once Start() has been invoked and
+// the Dispatcher has scheduled its first dispatch.
+func (d *Dispatcher) Started() <-chan struct{} {
+	return d.started
+}
+
+// Stop makes the Dispatcher stop after the buckets that are currently being
+// dispatched or disposed of, and waits until Start() has returned. The
+// remaining buckets are left in the store. Stop returns immediately if Start()
+// has not been invoked.
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.running.Wait()
+}
+
+// stopping returns true just in case Stop() has been invoked.
+func (d *Dispatcher) stopping() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
 	}
-	dispatcherSingleton.Run()
+}
+
+// NextDispatchTime returns the time at which the next dispatch is due. Note
+// that this may be in the past.
+func (d *Dispatcher) NextDispatchTime() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nextDispatchTime()
+}
+
+// LastDispatchTime returns the time at which the most recent dispatch cycle
+// started, or the zero time if there was none yet.
+func (d *Dispatcher) LastDispatchTime() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastDispatchCycle
+}
+
+// NumBatchesSent returns the number of ObservationBatches that have been sent
+// to the Analyzer since the Dispatcher was created.
+func (d *Dispatcher) NumBatchesSent() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.numBatchesSent
+}
+
+// NumBatchesFailed returns the number of ObservationBatches that could not be
+// sent to the Analyzer since the Dispatcher was created.
+func (d *Dispatcher) NumBatchesFailed() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.numBatchesFailed
+}
+
+// NumObservationsDropped returns the number of Observations that have been
+// dropped at random as specified by |p_observation_drop| since the Dispatcher
+// was created.
+func (d *Dispatcher) NumObservationsDropped() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.numObservationsDropped
 }
 
 // Run dispatches stored observations to the Analyzer per each
@@ -308,7 +727,7 @@ func Start(config *shuffler.ShufflerConfig, store storage.Store, batchSize int,
 // dispatch attempt.
 //
 // The underlying grpc connection to analyzer is closed when the dispatcher
-// goes to sleep mode.
+// goes to sleep mode. Run returns when Stop() is invoked.
 func (d *Dispatcher) Run() {
 	for {
 		waitTime := d.computeWaitTime(time.Now())
@@ -324,7 +743,13 @@ func (d *Dispatcher) Run() {
 		}
 
 		glog.V(5).Infof("Dispatcher sleeping for [%v]...", waitTime)
-		time.Sleep(waitTime)
+		select {
+		case <-time.After(waitTime):
+		case <-d.stop:
+			d.analyzerTransport.close()
+			glog.Infoln("The dispatcher has stopped.")
+			return
+		}
 
 		if shouldDisconnectWhileSleeping {
 			glog.V(3).Infoln("Re-establish grpc connection to Analyzer before the next dispatch...")
@@ -335,7 +760,10 @@ func (d *Dispatcher) Run() {
 			}
 		}
 
+		d.mu.Lock()
 		d.lastDispatchTime = time.Now()
+		d.lastDispatchCycle = d.lastDispatchTime
+		d.mu.Unlock()
 		d.dispatch(dispatchDelay)
 	}
 }
@@ -343,19 +771,37 @@ func (d *Dispatcher) Run() {
 // Dispatch sends encoded observations to the Analyzer based on the following
 // criteria:
 // 1. The dispatch interval between attempts should be atleast
-//    |frequency_in_hours| as specified in the Shuffler configuration.
+//    |frequency_in_hours| as specified in the Shuffler configuration. Each
+//    bucket follows the most specific policy for its metric, see
+//    |policy_overrides|, and is only considered if its policy is due.
 // 2. If frequency is met, Shuffler sends |ObservationBatch| to the Analyzer for
 //    each |ObservationMetadata| key if and only if:
 //    - The batch contains atleast |threshold| number of Observations, and
 //    - For each eligible batch, the Observations in that batch will be
-//      dispatched to the Analyzer and deleted from the Shuffler, and
-//    - For each batch whose Observations are not dispatched to the Analyzer
-//      because the batch size is too small, the Shuffler will delete those
-//      Observations from the batch whose age is at least |disposal_age_days|
-//      specified in the configuration.
+//      dispatched to the Analyzer and deleted from the Shuffler.
+//    A batch below the threshold is eligible as well once its oldest
+//    Observation is at least |escalation_age_days| old, in which case it is
+//    padded with dummy Observations if |pad_escalated_buckets| is set.
+// 3. The eligible batches are dispatched in the order of the priority classes
+//    of their metrics, subject to the bandwidth shares of the classes.
+// 4. Up to |dispatch_concurrency| buckets are dispatched concurrently. See
+//    SetDispatchConcurrency().
+// 5. Each Observation of a dispatched bucket is dropped with probability
+//    |p_observation_drop| before it is put into a batch. The dropped
+//    Observations are deleted and counted in the DropAudit of the bucket.
+//    A dropped Observation does not count towards |threshold|: if fewer than
+//    |threshold| Observations of a bucket that is not escalated are kept,
+//    none of them is sent or dropped and the bucket is left for a later
+//    cycle. See dispatchBucket().
+//
+// Batches whose Observations are not dispatched because the batch size is too
+// small and that are not escalated are left for the disposal goroutine. See
+// dispose().
 //
-// Between between buckets, and between the batches of a single bucket, we sleep
-// for |sleepDuration|.
+// Between buckets dispatched by the same worker, and between the batches of a
+// single bucket, we sleep for |sleepDuration|. Once Stop() is invoked no
+// further buckets are started, but the buckets that are being dispatched are
+// finished.
 func (d *Dispatcher) dispatch(sleepDuration time.Duration) {
 	if d.store == nil {
 		panic("Store handle is nil.")
@@ -366,57 +812,272 @@ func (d *Dispatcher) dispatch(sleepDuration time.Duration) {
 	}
 
 	glog.V(5).Infoln("Start dispatching ...")
-	keys, err := d.store.GetKeys()
-	if err != nil {
-		stackdriver.LogCountMetricf(dispatchFailed, "GetKeys() failed with error: %v", err)
-		return
-	}
+	stats := newSendStats()
+	defer stats.log()
 
 	// Each bucket is either dispatched or disposed based on config and if there
-	// are errors, processing proceeds to the next bucket in the pipeline.
-	for _, key := range keys {
+	// are errors, processing proceeds to the next bucket in the pipeline. The
+	// keys are visited lazily since there may be a very large number of buckets,
+	// and only the keys of the buckets that are due are queued.
+	queue := newDispatchQueue(d.config)
+	now := time.Now()
+	currentDayIndex := storage.GetDayIndexUtc(now)
+	due := duePolicies(d.config, now, d.policyDueTimes)
+	err := d.store.ForEachKey(func(key *cobalt.ObservationMetadata) bool {
+		// Each bucket follows the most specific policy for its metric, and is
+		// only considered in the cycles in which that policy is due.
+		scope, policy := policyFor(d.config, key)
+		if !due[scope] {
+			return true
+		}
+
 		// Fetch bucket size for each key.
 		//
 		// We use the value returned from GetNumObservations() to determine whether
 		// or not to dispatch a bucket. But it's important to note that this value
 		// is not necessarily exactly equal to the number of Observations in the
-		// Store. This is because new Observations are being added to the store and
-		// the the count is being incremented asynchronously with this method and
-		// non-transactionally. In particular note that it is possible that the
-		// value returned from GetNumObservations() may, temporarily, be negative.
-		// We do maintain the following invariant: Let n = the value returned from
-		// GetNumObservations(). Then an invocation of GetObservations() by this
-		// same thread immediately afterwards will find at least n Observations.
-		// (The reason this invariant holds is that this is the only thread that
-		// ever deletes from the store or decrements the count. All other threads
-		// first add to the store, commit, and then increment the count.) This
-		// allows us to use the result of GetNumObservations() for conservative
-		// thresholding: We will not dispatch a bucket unless GetNumObservations()
-		// returns a value at least as large as the threshold.
+		// Store. This is because new Observations are being added to the store
+		// concurrently with this method, and the count is only incremented once
+		// they have been committed. We do maintain the following invariant: Let
+		// n = the value returned from GetNumObservations(). Then an invocation of
+		// GetObservations() by this same thread immediately afterwards will find
+		// at least n Observations. (The reason this invariant holds is that this
+		// is the only thread that ever deletes dispatchable Observations from the
+		// store or decrements their count. All other threads first add to the
+		// store, commit, and then increment the count.) This allows us to use the
+		// result of GetNumObservations() for conservative thresholding: We will
+		// not dispatch a bucket unless GetNumObservations() returns a value at
+		// least as large as the threshold.
 		bucketSize, err := d.store.GetNumObservations(key)
 		glog.V(5).Infof("Bucket size from store: [%d]", bucketSize)
 		if err != nil {
 			stackdriver.LogCountMetricf(dispatchFailed, "GetNumObservations() failed for key: %v with error: %v", key, err)
-			continue
+			return true
 		}
 
-		// Compare bucket size to the configured limit.
-		if uint32(bucketSize) >= d.config.GetGlobalConfig().Threshold {
-			// Dispatch bucket associated with |key| and delete it after sending.
-			err := d.dispatchBucket(key, sleepDuration)
+		// Compare bucket size to the configured limit. Buckets below the
+		// threshold are handled by the disposal goroutine unless they are
+		// escalated.
+		threshold := policy.GetThreshold()
+		if uint32(bucketSize) < threshold {
+			escalate, err := d.shouldEscalate(key, bucketSize, policy.GetEscalationAgeDays(), currentDayIndex)
 			if err != nil {
-				stackdriver.LogCountMetricf(dispatchFailed, "dispatchBucket() failed for key: %v with error: %v", key, err)
-				continue
+				stackdriver.LogCountMetricf(escalateFailed, "Unable to check the age of the bucket for key: %v: %v", key, err)
+				return true
 			}
-		} else {
-			// If threshold policy is not met, loop through the messages and check
-			// if any messages are in the queue for more than the allowed duration
-			// |disposal_age_days|. If found, discard them, otherwise queue it back
-			// in the store for the next dispatch event.
-			err = d.deleteOldObservations(key, storage.GetDayIndexUtc(time.Now()), d.config.GetGlobalConfig().DisposalAgeDays)
-			if err != nil {
-				stackdriver.LogCountMetricf(dispatchFailed, "Error in filtering Observations for key [%v]: %v", key, err)
+			if !escalate {
+				return true
 			}
+			stackdriver.LogCountMetricf(escalatedBucket, "Dispatching the bucket for key: %v with %d Observations below the threshold of %d since it holds Observations at least %d days old.",
+				key, bucketSize, threshold, policy.GetEscalationAgeDays())
+		}
+		queue.add(key, int(bucketSize))
+		return true
+	})
+	if err != nil {
+		stackdriver.LogCountMetricf(dispatchFailed, "ForEachKey() failed with error: %v", err)
+	}
+
+	// The due buckets are dispatched in the order of the priority classes of
+	// their metrics by a pool of workers. See dispatchQueue. Each worker counts
+	// its sends in its own sendStats, which are added to |stats| once all the
+	// workers are done.
+	buckets := make(chan pendingBucket)
+	workerStats := make([]*sendStats, d.concurrency())
+	var wg sync.WaitGroup
+	for i := range workerStats {
+		workerStats[i] = newSendStats()
+		wg.Add(1)
+		go func(stats *sendStats) {
+			defer wg.Done()
+			for bucket := range buckets {
+				if !d.stopping() {
+					d.dispatchPendingBucket(bucket, sleepDuration, stats)
+				}
+			}
+		}(workerStats[i])
+	}
+	for bucket, ok := queue.next(); ok && !d.stopping(); bucket, ok = queue.next() {
+		buckets <- bucket
+	}
+	close(buckets)
+	wg.Wait()
+	for _, s := range workerStats {
+		stats.add(s)
+	}
+	d.mu.Lock()
+	d.numBatchesSent += uint64(stats.succeeded)
+	d.numBatchesFailed += uint64(stats.failed)
+	d.mu.Unlock()
+}
+
+// dispatchPendingBucket dispatches |bucket| unless it is leased by the disposal
+// goroutine or the circuit breaker is open, and then sleeps for
+// |sleepDuration|. It may be invoked by several workers concurrently, each
+// with its own |stats|, but never for the same bucket since the bucket is
+// leased while it is dispatched.
+func (d *Dispatcher) dispatchPendingBucket(bucket pendingBucket, sleepDuration time.Duration, stats *sendStats) {
+	key := bucket.key
+	// While the Analyzer is failing the bucket is left for the next dispatch
+	// event.
+	if d.breaker.isOpen() {
+		glog.V(4).Infof("The circuit breaker is open, skipping bucket [%v].", key)
+		stats.skipped++
+		return
+	}
+	// If the disposal goroutine or another Shuffler is currently working on
+	// this bucket we leave it for the next dispatch event rather than waiting.
+	if !d.tryLease(key, dispatchLeaseSuffix) {
+		glog.V(4).Infof("Bucket [%v] is leased by the disposal goroutine or another Shuffler, skipping.", key)
+		return
+	}
+	// The bucket was queued below the threshold only if it is escalated.
+	_, policy := policyFor(d.config, key)
+	escalated := uint32(bucket.size) < policy.GetThreshold()
+	// Dispatch bucket associated with |key| and delete it after sending.
+	err := d.dispatchBucket(key, escalated, sleepDuration, stats)
+	d.releaseLease(key, dispatchLeaseSuffix)
+	if err != nil {
+		stackdriver.LogCountMetricf(dispatchFailed, "dispatchBucket() failed for key: %v with error: %v", key, err)
+		return
+	}
+	time.Sleep(sleepDuration)
+}
+
+// runDisposal invokes dispose() immediately and then once every
+// |disposalInterval|. It runs in its own goroutine so that disposal of large
+// stale buckets does not delay the dispatch of healthy ones. It returns when
+// Stop() is invoked.
+func (d *Dispatcher) runDisposal() {
+	for {
+		d.dispose(storage.GetDayIndexUtc(time.Now()), d.disposalDelay)
+		d.pruneDispatchHistory(time.Now())
+		d.pruneDropAudits(time.Now())
+		select {
+		case <-time.After(d.disposalInterval):
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// pruneDispatchHistory deletes the dispatch histories whose most recent record
+// is older than |dispatchHistoryRetention| at |currentTime|.
+func (d *Dispatcher) pruneDispatchHistory(currentTime time.Time) {
+	histories, err := d.store.GetDispatchHistories()
+	if err != nil {
+		stackdriver.LogCountMetricf(pruneDispatchHistoryFailed, "GetDispatchHistories() failed with error: %v", err)
+		return
+	}
+
+	cutoff := currentTime.Add(-dispatchHistoryRetention).Unix()
+	for _, history := range histories {
+		records := history.GetRecords()
+		if len(records) > 0 && records[len(records)-1].DispatchTimeSeconds >= cutoff {
+			continue
+		}
+		if err := d.store.DeleteDispatchHistory(history.GetBucket()); err != nil {
+			stackdriver.LogCountMetricf(pruneDispatchHistoryFailed, "DeleteDispatchHistory() failed for key: %v with error: %v", history.GetBucket(), err)
+		}
+	}
+}
+
+// pruneDropAudits deletes the drop audits whose most recent record is for an
+// arrival day older than |dropAuditRetention| at |currentTime|.
+func (d *Dispatcher) pruneDropAudits(currentTime time.Time) {
+	audits, err := d.store.GetDropAudits()
+	if err != nil {
+		stackdriver.LogCountMetricf(pruneDropAuditFailed, "GetDropAudits() failed with error: %v", err)
+		return
+	}
+
+	cutoff := storage.GetDayIndexUtc(currentTime.Add(-dropAuditRetention))
+	for _, audit := range audits {
+		records := audit.GetRecords()
+		if len(records) > 0 && records[len(records)-1].ArrivalDayIndex >= cutoff {
+			continue
+		}
+		if err := d.store.DeleteDropAudit(audit.GetBucket()); err != nil {
+			stackdriver.LogCountMetricf(pruneDropAuditFailed, "DeleteDropAudit() failed for key: %v with error: %v", audit.GetBucket(), err)
+		}
+	}
+}
+
+// shouldEscalate returns true just in case the bucket for |key|, of size
+// |bucketSize|, should be dispatched although it is below the threshold
+// because its policy has a positive |escalationAgeDays| and the bucket holds
+// an Observation that arrived at least that many days before
+// |currentDayIndex|.
+func (d *Dispatcher) shouldEscalate(key *cobalt.ObservationMetadata, bucketSize int, escalationAgeDays uint32, currentDayIndex uint32) (bool, error) {
+	if escalationAgeDays == 0 || bucketSize <= 0 {
+		return false, nil
+	}
+
+	iterator, err := d.store.GetObservations(key)
+	if err != nil {
+		return false, err
+	}
+	for iterator.Next() {
+		obVal, err := iterator.Get()
+		if err != nil {
+			return false, err
+		}
+		if obVal.ArrivalDayIndex+escalationAgeDays <= currentDayIndex {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dispose loops through all buckets whose size is below the configured
+// threshold and deletes those Observations whose age is at least
+// |disposal_age_days| specified in the configuration. The remaining
+// Observations are queued back in the store for the next dispatch event.
+// The buckets that are kept below the threshold by |p_observation_drop| are
+// disposed of by dispatchBucket().
+//
+// A bucket is skipped if the dispatcher currently holds its lease. Between
+// buckets, and between the delete batches of a single bucket, we sleep for
+// |sleepDuration|.
+func (d *Dispatcher) dispose(currentDayIndex uint32, sleepDuration time.Duration) {
+	if d.store == nil {
+		panic("Store handle is nil.")
+	}
+
+	if d.config == nil {
+		panic("Shuffler config is nil.")
+	}
+
+	glog.V(5).Infoln("Start disposing ...")
+	keys, err := d.store.GetKeys()
+	if err != nil {
+		stackdriver.LogCountMetricf(disposeFailed, "GetKeys() failed with error: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		if d.stopping() {
+			return
+		}
+		bucketSize, err := d.store.GetNumObservations(key)
+		if err != nil {
+			stackdriver.LogCountMetricf(disposeFailed, "GetNumObservations() failed for key: %v with error: %v", key, err)
+			continue
+		}
+		_, policy := policyFor(d.config, key)
+		if uint32(bucketSize) >= policy.GetThreshold() {
+			// This bucket will be dispatched in its entirety.
+			continue
+		}
+
+		if !d.tryLease(key, disposalLeaseSuffix) {
+			glog.V(4).Infof("Bucket [%v] is leased by the dispatcher or another Shuffler, skipping.", key)
+			continue
+		}
+		err = d.deleteOldObservations(key, currentDayIndex, policy.GetDisposalAgeDays(), sleepDuration)
+		d.releaseLease(key, disposalLeaseSuffix)
+		if err != nil {
+			stackdriver.LogCountMetricf(disposeFailed, "Error in filtering Observations for key [%v]: %v", key, err)
 		}
 		time.Sleep(sleepDuration)
 	}
@@ -425,8 +1086,16 @@ func (d *Dispatcher) dispatch(sleepDuration time.Duration) {
 // dispatchBucket dispatches the ObservationBatch associated with |key| in
 // chunks of size |batchSize| to Analyzer using grpc transport.
 //
-// We sleep for |sleepDuration| between batches.
-func (d *Dispatcher) dispatchBucket(key *cobalt.ObservationMetadata, sleepDuration time.Duration) error {
+// The Observations dropped with |p_observation_drop| do not count towards the
+// threshold: unless the bucket is |escalated|, nothing is sent or dropped if
+// fewer than |threshold| Observations are kept, and the bucket is left for a
+// later dispatch cycle after its stale Observations are disposed of. If the
+// bucket is |escalated| and its policy pads escalated buckets, dummy
+// Observations making up for the Observations missing to the threshold are
+// shuffled into the first chunk that is sent successfully. We sleep for
+// |sleepDuration| between batches. The outcomes of the sends are counted in
+// |stats|.
+func (d *Dispatcher) dispatchBucket(key *cobalt.ObservationMetadata, escalated bool, sleepDuration time.Duration, stats *sendStats) error {
 	if key == nil {
 		panic("key is nil")
 	}
@@ -439,41 +1108,236 @@ func (d *Dispatcher) dispatchBucket(key *cobalt.ObservationMetadata, sleepDurati
 	iterator, err := d.store.GetObservations(key)
 	if err != nil {
 		stackdriver.LogCountMetricf(dispatchBucketFailed, "GetObservations() failed for key: %v with error: %v", key, err)
+		d.recordDispatch(key, &shuffler.DispatchRecord{
+			DispatchTimeSeconds: time.Now().Unix(),
+			Result:              shuffler.DispatchRecord_FAILED,
+			Error:               err.Error(),
+		})
+		return err
+	}
+	defer iterator.Release()
+	var dropping *droppingIterator
+	if d.observationDrop != nil {
+		dropping = newDroppingIterator(iterator, d.observationDrop)
+		iterator = dropping
+	}
+
+	// The number of Observations kept is only known once they have been read.
+	// If it matters, the batches holding the first |threshold| Observations
+	// are made before any of them is sent.
+	_, policy := policyFor(d.config, key)
+	threshold := int(policy.GetThreshold())
+	pad := escalated && policy.GetPadEscalatedBuckets()
+	var held []heldBatch
+	numHeld := 0
+	if pad || (dropping != nil && !escalated) {
+		for numHeld < threshold {
+			obVals, batch := makeBatch(key, iterator, d.batchSize, policy.GetDayIndexNormalization())
+			if len(obVals) == 0 {
+				break
+			}
+			held = append(held, heldBatch{obVals, batch})
+			numHeld += len(obVals)
+		}
+	}
+	if numHeld < threshold && dropping != nil && !escalated {
+		// The draws are discarded along with the batches, so that the
+		// Observations that were not dropped count towards the threshold
+		// again in the next dispatch cycle.
+		glog.V(4).Infof("Only %d Observations of the bucket for key: %v are kept after the drop, below the threshold of %d. Leaving the bucket for the next dispatch cycle.",
+			numHeld, key, threshold)
+		// dispose() skips the buckets at or above the threshold, so the stale
+		// Observations of this bucket are disposed of here, under its lease.
+		if err := d.deleteOldObservations(key, storage.GetDayIndexUtc(time.Now()), policy.GetDisposalAgeDays(), sleepDuration); err != nil {
+			stackdriver.LogCountMetricf(disposeFailed, "Error in filtering Observations for key [%v]: %v", key, err)
+		}
+		return nil
+	}
+	numDummies := 0
+	if pad && numHeld < threshold {
+		numDummies = threshold - numHeld
+	}
+
+	record := &shuffler.DispatchRecord{DispatchTimeSeconds: time.Now().Unix()}
+	defer d.recordDispatch(key, record)
+
+	var audit *bucketAudit
+	if d.shuffleAudit != nil {
+		audit = d.shuffleAudit.startBucket(key, record.DispatchTimeSeconds)
+		defer audit.finish()
+	}
+
+	dummies, err := d.makeDummyObservations(numDummies)
+	if err != nil {
+		stackdriver.LogCountMetricf(dispatchBucketFailed, "Unable to make dummy Observations for key: %v: %v", key, err)
+		record.Result = shuffler.DispatchRecord_FAILED
+		record.Error = err.Error()
 		return err
 	}
 
 	// send the shuffled bucket to Analyzer in chunks. If the bucket is too
 	// big, send it in multiple chunks of size |batchSize|.
 	batchID := 0
+	numFailedBatches := 0
 	for {
 		batchID++
 		glog.V(4).Infof("sending observations to Analyzer in chunks, batch [%d] in progress...", batchID)
-		obVals, batchTosend := makeBatch(key, iterator, d.batchSize)
+		var obVals []*shuffler.ObservationVal
+		var batchTosend *cobalt.ObservationBatch
+		if len(held) > 0 {
+			obVals, batchTosend = held[0].obVals, held[0].batch
+			held = held[1:]
+		} else {
+			obVals, batchTosend = makeBatch(key, iterator, d.batchSize, policy.GetDayIndexNormalization())
+		}
+		if dropping != nil {
+			d.discardDropped(key, dropping.takeDropped())
+		}
 		if len(obVals) == 0 {
 			// If makeBatch() returned an empty batch then the iteration is done.
 			break
 		}
-		sendErr := sendToAnalyzer(d.analyzerTransport, batchTosend, 4, 2500)
+		if policy.GetForwardArrivalWindow() {
+			batchTosend.ArrivalWindow = makeArrivalWindow(obVals)
+		}
+		// The dummy Observations are only sent to the Analyzer. They are not
+		// recorded in the statistics below.
+		paddedBatch := batchTosend
+		if len(dummies) > 0 {
+			if paddedBatch, err = padBatch(batchTosend, dummies); err != nil {
+				stackdriver.LogCountMetricf(dispatchBucketFailed, "Unable to pad the batch for key: %v: %v", key, err)
+				numFailedBatches++
+				record.Error = err.Error()
+				continue
+			}
+		}
+		// The lease on the bucket is renewed before each batch is sent, so that
+		// it does not expire while a large bucket is being sent. If it was
+		// lost, another Shuffler may be sending the bucket.
+		if !d.tryLease(key, dispatchLeaseSuffix) {
+			glog.Warningf("The lease on the bucket for key: %v was lost, leaving the remaining batches for the next dispatch cycle.", key)
+			numFailedBatches++
+			record.Error = "the lease on the bucket was lost"
+			break
+		}
+		sendErr := sendToAnalyzer(d.analyzerTransport, paddedBatch, d.retryPolicy, d.breaker, stats)
+		if sendErr == errCircuitOpen {
+			// The remaining batches are left for the next dispatch cycle.
+			glog.V(4).Infof("The circuit breaker is open, not sending the bucket for key: %v", key)
+			numFailedBatches++
+			record.Error = sendErr.Error()
+			break
+		}
 		if sendErr == nil {
+			record.NumObservationsSent += uint32(len(obVals))
+			record.NumDummyObservationsSent += uint32(len(dummies))
+			dummies = nil
+			if d.observationSizes != nil {
+				for _, o := range batchTosend.EncryptedObservation {
+					d.observationSizes.Add(key, len(o.GetCiphertext()))
+				}
+			}
+			if audit != nil {
+				audit.recordSent(obVals)
+			}
+			if d.usageMeter != nil {
+				d.usageMeter.AddDispatched(batchTosend, storage.GetDayIndexUtc(time.Now()))
+			}
+			if d.encryptionStats != nil {
+				d.encryptionStats.add(batchTosend)
+			}
 			// After successful send, delete the observations from the local
-			// datastore.
-			if err := d.store.DeleteValues(key, obVals); err != nil {
+			// datastore before the next batch is sent. Large batches are
+			// deleted in chunks of |deleteChunkSize|.
+			if err := storage.DeleteValuesInChunks(d.store, key, obVals, d.deleteChunkSize); err != nil {
 				stackdriver.LogCountMetricf(dispatchBucketFailed, "Error in deleting dispatched observations from the store for key: %v", key)
 			}
 		} else {
 			stackdriver.LogCountMetricf(dispatchBucketFailed, "Error in transmitting data to Analyzer for key [%v]: %v", key, sendErr)
+			numFailedBatches++
+			record.Error = sendErr.Error()
 		}
 		time.Sleep(sleepDuration)
 	}
 
+	if numFailedBatches > 0 {
+		if record.NumObservationsSent > 0 {
+			record.Result = shuffler.DispatchRecord_PARTIALLY_FAILED
+		} else {
+			record.Result = shuffler.DispatchRecord_FAILED
+		}
+	}
+
 	return nil
 }
 
+// A heldBatch is a batch made by makeBatch() that has not been sent yet.
+type heldBatch struct {
+	obVals []*shuffler.ObservationVal
+	batch  *cobalt.ObservationBatch
+}
+
+// makeDummyObservations returns |n| dummy Observations encrypted for the
+// Analyzer. A dummy Observation has a random id but no parts.
+func (d *Dispatcher) makeDummyObservations(n int) ([]*cobalt.EncryptedMessage, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if d.dummyEncrypter == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "pad_escalated_buckets is set but there is no key to encrypt dummy Observations with")
+	}
+
+	var random util.SecureRandom
+	dummies := make([]*cobalt.EncryptedMessage, n)
+	for i := range dummies {
+		randomId, err := random.RandomBytes(dummyRandomIdSize)
+		if err != nil {
+			return nil, err
+		}
+		if dummies[i], err = d.dummyEncrypter.Encrypt(&cobalt.Observation{RandomId: randomId}); err != nil {
+			return nil, err
+		}
+	}
+	return dummies, nil
+}
+
+// padBatch returns a copy of |batch| in which |dummies| are inserted at
+// uniformly random positions among its Observations.
+func padBatch(batch *cobalt.ObservationBatch, dummies []*cobalt.EncryptedMessage) (*cobalt.ObservationBatch, error) {
+	observations := make([]*cobalt.EncryptedMessage, 0, len(batch.EncryptedObservation)+len(dummies))
+	observations = append(observations, batch.EncryptedObservation...)
+	observations = append(observations, dummies...)
+
+	// Fisher-Yates shuffle.
+	var random util.SecureRandom
+	for i := len(observations) - 1; i > 0; i-- {
+		j, err := random.RandomUint63(uint64(i + 1))
+		if err != nil {
+			return nil, err
+		}
+		observations[i], observations[j] = observations[j], observations[i]
+	}
+
+	padded := *batch
+	padded.EncryptedObservation = observations
+	return &padded, nil
+}
+
+// recordDispatch appends |record| to the dispatch history of the bucket for
+// |key|.
+func (d *Dispatcher) recordDispatch(key *cobalt.ObservationMetadata, record *shuffler.DispatchRecord) {
+	if err := d.store.AddDispatchRecord(key, record, dispatchHistoryLength); err != nil {
+		stackdriver.LogCountMetricf(recordDispatchFailed, "AddDispatchRecord() failed for key: %v with error: %v", key, err)
+	}
+}
+
 // deleteOldObservations deletes the observations for a given |key| from the
 // store if the age of the observation is greater than the configured value
 // |disposalAgeInDays|.
+//
+// We sleep for |sleepDuration| between delete batches.
 func (d *Dispatcher) deleteOldObservations(key *cobalt.ObservationMetadata,
-	currentDayIndex uint32, disposalAgeInDays uint32) error {
+	currentDayIndex uint32, disposalAgeInDays uint32, sleepDuration time.Duration) error {
 	if key == nil {
 		panic("key is nil")
 	}
@@ -488,8 +1352,8 @@ func (d *Dispatcher) deleteOldObservations(key *cobalt.ObservationMetadata,
 		return nil
 	}
 
-	// We delete stale Observations iteratively in batches of size at most 1000.
-	const maxDeleteBatchSize = 1000
+	// We delete stale Observations iteratively in batches of size at most
+	// |deleteChunkSize|.
 	for {
 		var staleObVals []*shuffler.ObservationVal
 		for iterator.Next() {
@@ -500,7 +1364,7 @@ func (d *Dispatcher) deleteOldObservations(key *cobalt.ObservationMetadata,
 			}
 			if currentDayIndex-obVal.ArrivalDayIndex > disposalAgeInDays {
 				staleObVals = append(staleObVals, obVal)
-				if len(staleObVals) == maxDeleteBatchSize {
+				if len(staleObVals) == d.deleteChunkSize {
 					break
 				}
 			}
@@ -511,6 +1375,7 @@ func (d *Dispatcher) deleteOldObservations(key *cobalt.ObservationMetadata,
 		} else if err := d.store.DeleteValues(key, staleObVals); err != nil {
 			return fmt.Errorf("Error [%v] in deleting old observations for metadata: %v", err, key)
 		}
+		time.Sleep(sleepDuration)
 	}
 
 	return nil
@@ -523,14 +1388,41 @@ func (d *Dispatcher) computeWaitTime(currentTime time.Time) (waitTime time.Durat
 		panic("Dispatcher is not set")
 	}
 
-	dispatchInterval := time.Duration(d.config.GetGlobalConfig().FrequencyInHours) * time.Hour
-	nextDispatchTime := d.lastDispatchTime.Add(dispatchInterval)
-	return nextDispatchTime.Sub(currentTime)
+	return d.nextDispatchTime().Sub(currentTime)
+}
+
+// scheduleFirstDispatch sets |lastDispatchTime| such that the first dispatch
+// after |now| is due at the time given by |startPhase|, delayed by |jitter|.
+// |lastDispatchTime| is left unchanged, so that the first dispatch is due
+// immediately, if no start schedule was set.
+func (d *Dispatcher) scheduleFirstDispatch(now time.Time, jitter time.Duration) {
+	if d.startJitter == 0 && d.startPhase < 0 {
+		return
+	}
+	dispatchInterval := dispatchCycleInterval(d.config)
+	first := now
+	if d.startPhase >= 0 && dispatchInterval > 0 {
+		first = now.Truncate(dispatchInterval).Add(d.startPhase % dispatchInterval)
+		if first.Before(now) {
+			first = first.Add(dispatchInterval)
+		}
+	}
+	d.lastDispatchTime = first.Add(jitter).Add(-dispatchInterval)
+}
+
+// nextDispatchTime returns the time at which the next dispatch is due based on
+// |lastDispatchTime| and the configured dispatch frequency.
+func (d *Dispatcher) nextDispatchTime() time.Time {
+	dispatchInterval := dispatchCycleInterval(d.config)
+	return d.lastDispatchTime.Add(dispatchInterval)
 }
 
 // makeBatch returns a new ObservationBatch for |key| consisting of the next
-// chunk of observations from |iterator| of size at most |batchSize|.
-func makeBatch(key *cobalt.ObservationMetadata, iterator storage.Iterator, batchSize int) ([]*shuffler.ObservationVal, *cobalt.ObservationBatch) {
+// chunk of observations from |iterator| of size at most |batchSize|. The day
+// index of the metadata of the batch is rewritten as specified by
+// |normalization|. |key| itself is not modified.
+func makeBatch(key *cobalt.ObservationMetadata, iterator storage.Iterator, batchSize int,
+	normalization shuffler.DayIndexNormalization) ([]*shuffler.ObservationVal, *cobalt.ObservationBatch) {
 	if batchSize <= 0 {
 		panic("batchSize must be positive.")
 	}
@@ -550,10 +1442,72 @@ func makeBatch(key *cobalt.ObservationMetadata, iterator storage.Iterator, batch
 		}
 	}
 
+	metadata := key
+	if dayIndex := normalizeDayIndex(key.DayIndex, obVals, normalization); dayIndex != key.DayIndex {
+		normalized := *key
+		normalized.DayIndex = dayIndex
+		metadata = &normalized
+	}
+
 	batch := cobalt.ObservationBatch{
-		MetaData:             key,
+		MetaData:             metadata,
 		EncryptedObservation: encryptedMessages,
 	}
 
 	return obVals, &batch
 }
+
+// normalizeDayIndex returns the day index that is sent to the Analyzer in
+// place of |dayIndex| for a batch of |obVals| according to |normalization|.
+func normalizeDayIndex(dayIndex uint32, obVals []*shuffler.ObservationVal, normalization shuffler.DayIndexNormalization) uint32 {
+	switch normalization {
+	case shuffler.DayIndexNormalization_ARRIVAL_DAY_INDEX:
+		var arrivalDayIndex uint32
+		for _, obVal := range obVals {
+			if obVal.GetArrivalDayIndex() > arrivalDayIndex {
+				arrivalDayIndex = obVal.GetArrivalDayIndex()
+			}
+		}
+		if arrivalDayIndex > 0 {
+			return arrivalDayIndex
+		}
+	case shuffler.DayIndexNormalization_WEEK_DAY_INDEX:
+		// Day zero was a Thursday which is 4 days after Sunday. The days before
+		// the first Sunday belong to week zero, which starts on day zero.
+		if dayIndex < 3 {
+			return 0
+		}
+		return (dayIndex+4)/7*7 - 4
+	}
+	return dayIndex
+}
+
+// makeArrivalWindow returns the ArrivalWindow covering the arrival times of
+// |obVals|, widened to hour boundaries, or nil if none of |obVals| has an
+// arrival time.
+func makeArrivalWindow(obVals []*shuffler.ObservationVal) *cobalt.ArrivalWindow {
+	const hourSeconds = int64(time.Hour / time.Second)
+
+	var window *cobalt.ArrivalWindow
+	for _, obVal := range obVals {
+		arrivalTime := obVal.GetArrivalTimeSeconds()
+		if arrivalTime <= 0 {
+			continue
+		}
+		start := arrivalTime - arrivalTime%hourSeconds
+		if window == nil {
+			window = &cobalt.ArrivalWindow{
+				EarliestArrivalTimeSeconds: start,
+				LatestArrivalTimeSeconds:   start + hourSeconds,
+			}
+			continue
+		}
+		if start < window.EarliestArrivalTimeSeconds {
+			window.EarliestArrivalTimeSeconds = start
+		}
+		if start+hourSeconds > window.LatestArrivalTimeSeconds {
+			window.LatestArrivalTimeSeconds = start + hourSeconds
+		}
+	}
+	return window
+}
@@ -15,17 +15,23 @@
 package dispatcher
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"cobalt"
 	"shuffler"
 	"storage"
+	"util"
 
+	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 )
 
 // This is a fake Analyzer transport client that just caches the Observations
@@ -95,7 +101,7 @@ func makeTestStore(numObservations int, currentDayIndex uint32, useMemStore bool
 			EncryptedObservation: storage.MakeRandomEncryptedMsgs(numObservations / 4),
 		}
 
-		if err = store.AddAllObservations([]*cobalt.ObservationBatch{batch}, di); err != nil {
+		if err = store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.Arrival{DayIndex: di}); err != nil {
 			return nil, nil, nil, err
 		}
 	}
@@ -151,9 +157,33 @@ func newTestDispatcher(store storage.Store, batchSize int, threshold int) *Dispa
 		batchSize:         batchSize,
 		analyzerTransport: &analyzerTransport,
 		lastDispatchTime:  time.Now(),
+		deleteChunkSize:   DefaultDeleteChunkSize,
+		leaseOwner:        "test-dispatcher",
+		leaseTTL:          DefaultLeaseTTL,
+		disposalInterval:  DefaultDisposalInterval,
+		disposalDelay:     DefaultDisposalDelay,
+		startPhase:        -1,
+		policyDueTimes:    make(map[metricKey]time.Time),
+		stop:              make(chan struct{}),
+		started:           make(chan struct{}),
 	}
 }
 
+// deleteRecordingStore is a Store that records the sizes of the DeleteValues
+// calls made on it and the number of batches sent before each call.
+type deleteRecordingStore struct {
+	storage.Store
+	analyzer    *fakeAnalyzerTransport
+	deleteSizes []int
+	numSent     []int
+}
+
+func (s *deleteRecordingStore) DeleteValues(om *cobalt.ObservationMetadata, obVals []*shuffler.ObservationVal) error {
+	s.deleteSizes = append(s.deleteSizes, len(obVals))
+	s.numSent = append(s.numSent, s.analyzer.numSent)
+	return s.Store.DeleteValues(om, obVals)
+}
+
 // getAnalyzerTransport returns analyzerTransport handle from the given
 // Dispatcher |d|.
 func getAnalyzerTransport(d *Dispatcher) *fakeAnalyzerTransport {
@@ -187,7 +217,7 @@ func doTestDeleteOldObservations(t *testing.T, useMemStore bool) {
 
 	// Dispose off any older messages that have a dayIndex less than "4".
 	disposalAgeInDays := uint32(4)
-	err = d.deleteOldObservations(key, currentDayIndex, disposalAgeInDays)
+	err = d.deleteOldObservations(key, currentDayIndex, disposalAgeInDays, 1*time.Millisecond)
 	if err != nil {
 		t.Errorf("Expected successful update, got error [%v]", err)
 		return
@@ -204,7 +234,7 @@ func doTestDeleteOldObservations(t *testing.T, useMemStore bool) {
 
 	// Dispose off any older messages that have a dayIndex less than "2".
 	disposalAgeInDays = uint32(2)
-	err = d.deleteOldObservations(key, currentDayIndex, disposalAgeInDays)
+	err = d.deleteOldObservations(key, currentDayIndex, disposalAgeInDays, 1*time.Millisecond)
 	if err != nil {
 		t.Errorf("Expected successful update, got error [%v]", err)
 		return
@@ -221,7 +251,7 @@ func doTestDeleteOldObservations(t *testing.T, useMemStore bool) {
 
 	// Dispose off all messages by specifying dayIndex "0".
 	disposalAgeInDays = uint32(0)
-	err = d.deleteOldObservations(key, currentDayIndex, disposalAgeInDays)
+	err = d.deleteOldObservations(key, currentDayIndex, disposalAgeInDays, 1*time.Millisecond)
 	if err != nil {
 		t.Errorf("Expected successful update, got error [%v]", err)
 		return
@@ -352,6 +382,122 @@ func doTestDispatchBasedOnThresholds(t *testing.T, useMemStore bool) {
 	}
 }
 
+// doTestDispose tests that dispose() deletes stale observations from buckets
+// below the threshold and skips buckets that are leased.
+func doTestDispose(t *testing.T, useMemStore bool) {
+	const num = 40
+	const currentDayIndex = 10
+
+	store, key, _, err := makeTestStore(num, currentDayIndex, useMemStore)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+
+	// The bucket is below the threshold and so is eligible for disposal.
+	d := newTestDispatcher(store, num, num+1)
+	d.config.GlobalConfig.DisposalAgeDays = 2
+
+	// While the bucket is leased by another Shuffler nothing is deleted.
+	if acquired, err := store.TryLease(key, "other-dispatcher", time.Minute); err != nil || !acquired {
+		t.Fatalf("TryLease: got (%v, %v), expected to acquire the lease for key [%v]", acquired, err, key)
+	}
+	d.dispose(currentDayIndex, 1*time.Millisecond)
+	storage.CheckNumObservations(t, store, key, num)
+	if err := store.ReleaseLease(key, "other-dispatcher"); err != nil {
+		t.Fatalf("ReleaseLease: got error %v", err)
+	}
+
+	// Once the lease is released the stale half of the bucket is deleted.
+	d.dispose(currentDayIndex, 1*time.Millisecond)
+	storage.CheckNumObservations(t, store, key, num/2)
+
+	// dispose() must not hold on to the lease.
+	if acquired, err := store.TryLease(key, "other-dispatcher", time.Minute); err != nil || !acquired {
+		t.Errorf("TryLease: got (%v, %v), expected dispose() to release the lease for key [%v]", acquired, err, key)
+	}
+
+	// dispose() never sends anything to the Analyzer.
+	if analyzer := getAnalyzerTransport(d); analyzer.numSent != 0 {
+		t.Errorf("unexpected number of analyzer send calls, got [%d], want [0]", analyzer.numSent)
+	}
+
+	storage.ResetStoreForTesting(store, true)
+}
+
+func TestDisposeForMemStore(t *testing.T) {
+	doTestDispose(t, true)
+}
+
+func TestDisposeForLevelDBStore(t *testing.T) {
+	doTestDispose(t, false)
+}
+
+// Tests that runDisposal() disposes of stale Observations as soon as it is
+// invoked rather than after the first interval, and returns upon Stop().
+func TestRunDisposal(t *testing.T) {
+	const num = 40
+	currentDayIndex := storage.GetDayIndexUtc(time.Now())
+	store, key, _, err := makeTestStore(num, currentDayIndex, true)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+	d := newTestDispatcher(store, num, num+1)
+	d.config.GlobalConfig.DisposalAgeDays = 2
+	d.SetDisposalSchedule(time.Hour, time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		d.runDisposal()
+		close(stopped)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if n, _ := store.GetNumObservations(key); n == num/2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the stale Observations were not disposed of")
+		}
+	}
+	d.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runDisposal() did not return after Stop()")
+	}
+}
+
+// Tests that a bucket leased by another Shuffler is left for the next
+// dispatch cycle, and that the lease is not held after the bucket has been
+// dispatched.
+func TestDispatchSkipsLeasedBucket(t *testing.T) {
+	const num = 40
+	store, key, _, err := makeTestStore(num, storage.GetDayIndexUtc(time.Now()), true)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+	d := newTestDispatcher(store, num, num)
+
+	if acquired, err := store.TryLease(key, "other-dispatcher", time.Minute); err != nil || !acquired {
+		t.Fatalf("TryLease: got (%v, %v), expected to acquire the lease for key [%v]", acquired, err, key)
+	}
+	d.dispatchPendingBucket(pendingBucket{key: key, size: num}, time.Millisecond, newSendStats())
+	storage.CheckNumObservations(t, store, key, num)
+	if analyzer := getAnalyzerTransport(d); analyzer.numSent != 0 {
+		t.Errorf("got %d batches sent for a leased bucket, expected none", analyzer.numSent)
+	}
+
+	if err := store.ReleaseLease(key, "other-dispatcher"); err != nil {
+		t.Fatalf("ReleaseLease: got error %v", err)
+	}
+	d.dispatchPendingBucket(pendingBucket{key: key, size: num}, time.Millisecond, newSendStats())
+	if analyzer := getAnalyzerTransport(d); analyzer.numSent != 1 {
+		t.Errorf("got %d batches sent, expected 1", analyzer.numSent)
+	}
+	if acquired, err := store.TryLease(key, "other-dispatcher", time.Minute); err != nil || !acquired {
+		t.Errorf("TryLease: got (%v, %v), expected dispatchPendingBucket() to release the lease for key [%v]", acquired, err, key)
+	}
+}
+
 func TestDeleteOldObservationsForMemStore(t *testing.T) {
 	doTestDeleteOldObservations(t, true)
 }
@@ -368,6 +514,58 @@ func TestDispatchInBatchesForLevelDBStore(t *testing.T) {
 	doTestDispatchInBatches(t, false)
 }
 
+// doTestDeleteInChunks tests that dispatched and stale Observations are
+// deleted in chunks of at most |deleteChunkSize| and that the Observations of
+// a batch are deleted before the next batch is sent.
+func doTestDeleteInChunks(t *testing.T, useMemStore bool) {
+	const num = 40
+	const currentDayIndex = 10
+
+	store, key, _, err := makeTestStore(num, currentDayIndex, useMemStore)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+	d := newTestDispatcher(store, 20, 0)
+	d.SetDeleteChunkSize(8)
+	recorder := &deleteRecordingStore{Store: store, analyzer: getAnalyzerTransport(d)}
+	d.store = recorder
+
+	if err := d.dispatchBucket(key, false, time.Millisecond, newSendStats()); err != nil {
+		t.Fatalf("dispatchBucket() failed: %v", err)
+	}
+	if expected := []int{8, 8, 4, 8, 8, 4}; !reflect.DeepEqual(recorder.deleteSizes, expected) {
+		t.Errorf("got deletes of sizes %v, expected %v", recorder.deleteSizes, expected)
+	}
+	if expected := []int{1, 1, 1, 2, 2, 2}; !reflect.DeepEqual(recorder.numSent, expected) {
+		t.Errorf("got deletes after %v sent batches, expected %v", recorder.numSent, expected)
+	}
+	storage.ResetStoreForTesting(store, true)
+
+	// Disposal uses the same chunk size.
+	store, key, _, err = makeTestStore(num, currentDayIndex, useMemStore)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+	recorder = &deleteRecordingStore{Store: store, analyzer: getAnalyzerTransport(d)}
+	d.store = recorder
+	if err := d.deleteOldObservations(key, currentDayIndex, 0, time.Millisecond); err != nil {
+		t.Fatalf("deleteOldObservations() failed: %v", err)
+	}
+	if expected := []int{8, 8, 8, 8, 8}; !reflect.DeepEqual(recorder.deleteSizes, expected) {
+		t.Errorf("got deletes of sizes %v, expected %v", recorder.deleteSizes, expected)
+	}
+	storage.CheckNumObservations(t, store, key, 0)
+	storage.ResetStoreForTesting(store, true)
+}
+
+func TestDeleteInChunksForMemStore(t *testing.T) {
+	doTestDeleteInChunks(t, true)
+}
+
+func TestDeleteInChunksForLevelDBStore(t *testing.T) {
+	doTestDeleteInChunks(t, false)
+}
+
 func TestThresholdBasedDispatchForMemStore(t *testing.T) {
 	doTestDispatchBasedOnThresholds(t, true)
 }
@@ -376,6 +574,204 @@ func TestThresholdBasedDispatchForLevelDBStore(t *testing.T) {
 	doTestDispatchBasedOnThresholds(t, false)
 }
 
+// TestDispatchHistory tests that dispatchBucket() records the outcome of each
+// dispatch and that pruneDispatchHistory() deletes stale histories.
+func TestDispatchHistory(t *testing.T) {
+	const num = 40
+	store, key, _, err := makeTestStore(num, 10, true)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+	defer storage.ResetStoreForTesting(store, true)
+
+	d := newTestDispatcher(store, 10, 0)
+	// The first batch fails with a non-retryable error.
+	transport := makeFakeAnalyzerTransport([]codes.Code{codes.InvalidArgument})
+	d.analyzerTransport = &transport
+	start := time.Now().Unix()
+	d.dispatch(1 * time.Millisecond)
+	d.dispatch(1 * time.Millisecond)
+
+	histories, err := store.GetDispatchHistories()
+	if err != nil {
+		t.Fatalf("GetDispatchHistories() failed: %v", err)
+	}
+	if len(histories) != 1 || !reflect.DeepEqual(histories[0].Bucket, key) {
+		t.Fatalf("got histories %v, expected a single history for bucket [%v]", histories, key)
+	}
+	records := histories[0].Records
+	if len(records) != 2 {
+		t.Fatalf("got records %v, expected 2 records", records)
+	}
+	if records[0].Result != shuffler.DispatchRecord_PARTIALLY_FAILED || records[0].NumObservationsSent != 30 || records[0].Error == "" {
+		t.Errorf("got first record [%v], expected a partial failure with 30 observations sent", records[0])
+	}
+	if records[1].Result != shuffler.DispatchRecord_SUCCEEDED || records[1].NumObservationsSent != 10 {
+		t.Errorf("got second record [%v], expected a success with 10 observations sent", records[1])
+	}
+	for _, record := range records {
+		if record.DispatchTimeSeconds < start {
+			t.Errorf("got dispatch time [%v], expected at least [%v]", record.DispatchTimeSeconds, start)
+		}
+	}
+
+	// A recent history is kept.
+	d.pruneDispatchHistory(time.Now())
+	if histories, _ := store.GetDispatchHistories(); len(histories) != 1 {
+		t.Errorf("got %d histories, expected 1", len(histories))
+	}
+
+	// A stale history is deleted.
+	d.pruneDispatchHistory(time.Now().Add(dispatchHistoryRetention + time.Hour))
+	if histories, _ := store.GetDispatchHistories(); len(histories) != 0 {
+		t.Errorf("got %d histories, expected 0", len(histories))
+	}
+}
+
+// TestPruneDropAudits tests that pruneDropAudits() deletes the drop audits
+// without a recent record.
+func TestPruneDropAudits(t *testing.T) {
+	store := storage.NewMemStore()
+	recent := storage.NewObservationMetaData(1)
+	stale := storage.NewObservationMetaData(2)
+	today := storage.GetDayIndexUtc(time.Now())
+	if err := store.AddDropCount(recent, today-40, shuffler.DropRecord_RANDOM_DROP, 1); err != nil {
+		t.Fatalf("AddDropCount() failed: %v", err)
+	}
+	if err := store.AddDropCount(recent, today, shuffler.DropRecord_RANDOM_DROP, 1); err != nil {
+		t.Fatalf("AddDropCount() failed: %v", err)
+	}
+	if err := store.AddDropCount(stale, today-40, shuffler.DropRecord_RANDOM_DROP, 1); err != nil {
+		t.Fatalf("AddDropCount() failed: %v", err)
+	}
+
+	d := newTestDispatcher(store, 10, 0)
+	d.pruneDropAudits(time.Now())
+	audits, err := store.GetDropAudits()
+	if err != nil {
+		t.Fatalf("GetDropAudits() failed: %v", err)
+	}
+	if len(audits) != 1 || !reflect.DeepEqual(audits[0].Bucket, recent) || len(audits[0].Records) != 2 {
+		t.Errorf("got audits %v, expected only the audit of bucket [%v] with both records", audits, recent)
+	}
+}
+
+// makeEscalationTestStore returns a MemStore holding a bucket of |num|
+// Observations that arrived |staleDays| ago and a bucket of |num| Observations
+// that arrived today, and the keys of the two buckets.
+func makeEscalationTestStore(t *testing.T, num int, staleDays int) (storage.Store, *cobalt.ObservationMetadata, *cobalt.ObservationMetadata) {
+	store := storage.NewMemStore()
+	stale := storage.NewObservationMetaData(1)
+	recent := storage.NewObservationMetaData(2)
+	staleArrival := storage.NewArrival(time.Now().Add(-time.Duration(staleDays)*24*time.Hour), "shuffler-1")
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{storage.NewObservationBatchForMetadata(stale, num)}, staleArrival); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{storage.NewObservationBatchForMetadata(recent, num)}, storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+	return store, stale, recent
+}
+
+// TestDispatchEscalatesStaleBuckets tests that a bucket below the threshold is
+// dispatched once its oldest Observation reaches |escalation_age_days|.
+func TestDispatchEscalatesStaleBuckets(t *testing.T) {
+	const num = 5
+	store, stale, recent := makeEscalationTestStore(t, num, 3)
+	d := newTestDispatcher(store, 100, 2*num)
+	d.config.GlobalConfig.EscalationAgeDays = 2
+	analyzer := getAnalyzerTransport(d)
+	d.dispatch(1 * time.Millisecond)
+
+	if len(analyzer.obBatch) != 1 || !reflect.DeepEqual(analyzer.obBatch[0].MetaData, stale) {
+		t.Fatalf("got batches %v, expected a single batch for the stale bucket [%v]", analyzer.obBatch, stale)
+	}
+	if n := len(analyzer.obBatch[0].EncryptedObservation); n != num {
+		t.Errorf("got %d observations, expected %d observations without padding", n, num)
+	}
+	storage.CheckNumObservations(t, store, stale, 0)
+	storage.CheckNumObservations(t, store, recent, num)
+}
+
+// TestDispatchPadsEscalatedBuckets tests that escalated buckets are padded
+// with dummy Observations up to the threshold if |pad_escalated_buckets| is
+// set.
+func TestDispatchPadsEscalatedBuckets(t *testing.T) {
+	const num = 5
+	const threshold = 2 * num
+	store, stale, recent := makeEscalationTestStore(t, num, 3)
+	original, err := store.GetObservations(stale)
+	if err != nil {
+		t.Fatalf("GetObservations() failed: %v", err)
+	}
+	ciphertexts := make(map[string]bool)
+	for original.Next() {
+		obVal, err := original.Get()
+		if err != nil {
+			t.Fatalf("Get() failed: %v", err)
+		}
+		ciphertexts[string(obVal.EncryptedObservation.Ciphertext)] = true
+	}
+
+	d := newTestDispatcher(store, 100, threshold)
+	d.config.GlobalConfig.EscalationAgeDays = 2
+	d.config.GlobalConfig.PadEscalatedBuckets = true
+	d.SetDummyEncrypter(util.NewEncryptedMessageMaker("", cobalt.EncryptedMessage_NONE))
+	analyzer := getAnalyzerTransport(d)
+	d.dispatch(1 * time.Millisecond)
+
+	if len(analyzer.obBatch) != 1 || len(analyzer.obBatch[0].EncryptedObservation) != threshold {
+		t.Fatalf("got batches %v, expected a single batch of %d observations", analyzer.obBatch, threshold)
+	}
+	numDummies := 0
+	for _, em := range analyzer.obBatch[0].EncryptedObservation {
+		if ciphertexts[string(em.Ciphertext)] {
+			continue
+		}
+		numDummies++
+		var observation cobalt.Observation
+		if err := proto.Unmarshal(em.Ciphertext, &observation); err != nil {
+			t.Fatalf("got an invalid dummy observation: %v", err)
+		}
+		if len(observation.Parts) != 0 || len(observation.RandomId) != dummyRandomIdSize {
+			t.Errorf("got dummy observation [%v], expected a random id and no parts", &observation)
+		}
+	}
+	if numDummies != threshold-num {
+		t.Errorf("got %d dummy observations, expected %d", numDummies, threshold-num)
+	}
+	storage.CheckNumObservations(t, store, stale, 0)
+	storage.CheckNumObservations(t, store, recent, num)
+
+	histories, err := store.GetDispatchHistories()
+	if err != nil {
+		t.Fatalf("GetDispatchHistories() failed: %v", err)
+	}
+	if len(histories) != 1 || len(histories[0].Records) != 1 {
+		t.Fatalf("got histories %v, expected a single record", histories)
+	}
+	if record := histories[0].Records[0]; record.NumObservationsSent != num || record.NumDummyObservationsSent != threshold-num {
+		t.Errorf("got record [%v], expected %d observations and %d dummy observations sent", record, num, threshold-num)
+	}
+}
+
+// TestDispatchPadsEscalatedBucketsWithoutEncrypter tests that an escalated
+// bucket is not sent unpadded if it cannot be padded.
+func TestDispatchPadsEscalatedBucketsWithoutEncrypter(t *testing.T) {
+	const num = 5
+	store, stale, _ := makeEscalationTestStore(t, num, 3)
+	d := newTestDispatcher(store, 100, 2*num)
+	d.config.GlobalConfig.EscalationAgeDays = 2
+	d.config.GlobalConfig.PadEscalatedBuckets = true
+	analyzer := getAnalyzerTransport(d)
+	d.dispatch(1 * time.Millisecond)
+
+	if analyzer.numSent != 0 {
+		t.Errorf("unexpected number of analyzer send calls, got [%d], want [0]", analyzer.numSent)
+	}
+	storage.CheckNumObservations(t, store, stale, num)
+}
+
 func TestComputeWaitTime(t *testing.T) {
 	// create a test dispatcher with all defaults
 	d := newTestDispatcher(storage.NewMemStore(), 1, 0)
@@ -434,6 +830,285 @@ func TestComputeWaitTime(t *testing.T) {
 	}
 }
 
+func TestNextDispatchTime(t *testing.T) {
+	d := newTestDispatcher(storage.NewMemStore(), 1, 0)
+	d.config.GlobalConfig.FrequencyInHours = uint32(24)
+	d.lastDispatchTime = time.Now().Add(time.Duration(-20) * time.Hour)
+
+	expected := d.lastDispatchTime.Add(time.Duration(24) * time.Hour)
+	if nextDispatchTime := d.NextDispatchTime(); !nextDispatchTime.Equal(expected) {
+		t.Errorf("got next dispatch time [%v], expected [%v]", nextDispatchTime, expected)
+	}
+}
+
+func TestScheduleFirstDispatch(t *testing.T) {
+	d := newTestDispatcher(storage.NewMemStore(), 1, 0)
+	d.config.GlobalConfig.FrequencyInHours = uint32(24)
+	now := time.Date(2018, time.March, 1, 10, 30, 0, 0, time.UTC)
+
+	// Without a start schedule the first dispatch is due immediately.
+	d.lastDispatchTime = time.Time{}
+	d.scheduleFirstDispatch(now, 0)
+	if waitTime := d.computeWaitTime(now); waitTime > 0 {
+		t.Errorf("got wait time %v without a start schedule, expected <= 0", waitTime)
+	}
+
+	// The first dispatch is aligned to the phase and delayed by the jitter.
+	d.SetStartSchedule(time.Hour, 3*time.Hour)
+	d.scheduleFirstDispatch(now, 20*time.Minute)
+	expected := time.Date(2018, time.March, 2, 3, 20, 0, 0, time.UTC)
+	if next := d.nextDispatchTime(); !next.Equal(expected) {
+		t.Errorf("got first dispatch at [%v], expected [%v]", next, expected)
+	}
+
+	// A phase later in the current interval is used on the same day.
+	d.SetStartSchedule(0, 14*time.Hour)
+	d.scheduleFirstDispatch(now, 0)
+	expected = time.Date(2018, time.March, 1, 14, 0, 0, 0, time.UTC)
+	if next := d.nextDispatchTime(); !next.Equal(expected) {
+		t.Errorf("got first dispatch at [%v], expected [%v]", next, expected)
+	}
+
+	// Without a phase only the jitter delays the first dispatch.
+	d.SetStartSchedule(time.Hour, -1)
+	d.scheduleFirstDispatch(now, 20*time.Minute)
+	if waitTime := d.computeWaitTime(now); waitTime != 20*time.Minute {
+		t.Errorf("got wait time %v, expected 20m", waitTime)
+	}
+}
+
+// TestMakeArrivalWindow tests that makeArrivalWindow() widens the arrival
+// times to hour boundaries and ignores unknown arrival times.
+func TestMakeArrivalWindow(t *testing.T) {
+	hour := time.Date(2018, time.March, 1, 10, 0, 0, 0, time.UTC).Unix()
+	obVals := []*shuffler.ObservationVal{
+		{ArrivalTimeSeconds: hour + 1800},
+		{ArrivalTimeSeconds: 0},
+		{ArrivalTimeSeconds: hour + 2*3600 + 5},
+		{ArrivalTimeSeconds: hour + 10},
+	}
+	window := makeArrivalWindow(obVals)
+	if window == nil {
+		t.Fatal("got nil window, expected a window")
+	}
+	if window.EarliestArrivalTimeSeconds != hour {
+		t.Errorf("got earliest arrival time [%d], expected [%d]", window.EarliestArrivalTimeSeconds, hour)
+	}
+	if window.LatestArrivalTimeSeconds != hour+3*3600 {
+		t.Errorf("got latest arrival time [%d], expected [%d]", window.LatestArrivalTimeSeconds, hour+3*3600)
+	}
+
+	if window := makeArrivalWindow([]*shuffler.ObservationVal{{}}); window != nil {
+		t.Errorf("got window [%v], expected nil", window)
+	}
+}
+
+// TestDispatchForwardsArrivalWindow tests that an ArrivalWindow is attached to
+// the dispatched batches only if the config asks for it.
+func TestDispatchForwardsArrivalWindow(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		store := storage.NewMemStore()
+		om := storage.NewObservationMetaData(22)
+		arrival := storage.NewArrival(time.Now(), "shuffler-1")
+		batch := storage.NewObservationBatchForMetadata(om, 10)
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, arrival); err != nil {
+			t.Fatalf("AddAllObservations: got error %v, expected success", err)
+		}
+
+		d := newTestDispatcher(store, 10, 0)
+		d.config.GlobalConfig.ForwardArrivalWindow = forward
+		analyzer := getAnalyzerTransport(d)
+		d.dispatch(1 * time.Millisecond)
+
+		if len(analyzer.obBatch) != 1 {
+			t.Fatalf("got %d batches, expected 1", len(analyzer.obBatch))
+		}
+		window := analyzer.obBatch[0].ArrivalWindow
+		if !forward {
+			if window != nil {
+				t.Errorf("got window [%v], expected nil", window)
+			}
+			continue
+		}
+		if window == nil || window.EarliestArrivalTimeSeconds > arrival.TimeSeconds ||
+			window.LatestArrivalTimeSeconds <= arrival.TimeSeconds {
+			t.Errorf("got window [%v], expected a window containing [%d]", window, arrival.TimeSeconds)
+		}
+	}
+}
+
+// TestDispatchMetersUsage tests that the dispatched Observations are counted by
+// the UsageMeter.
+func TestDispatchMetersUsage(t *testing.T) {
+	store := storage.NewMemStore()
+	om := storage.NewObservationMetaData(22)
+	batch := storage.NewObservationBatchForMetadata(om, 10)
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	var numBytes uint64
+	for _, o := range batch.EncryptedObservation {
+		numBytes += uint64(len(o.Ciphertext))
+	}
+
+	d := newTestDispatcher(store, 4, 0)
+	d.EnableUsageMetering(storage.NewUsageMeter(store))
+	d.dispatch(1 * time.Millisecond)
+	if err := d.usageMeter.Flush(); err != nil {
+		t.Fatalf("Flush: got error %v, expected success", err)
+	}
+
+	usages, err := store.GetUsage()
+	if err != nil {
+		t.Fatalf("GetUsage: got error %v, expected success", err)
+	}
+	if len(usages) != 1 || len(usages[0].Records) != 1 {
+		t.Fatalf("got usage %v, expected a single record", usages)
+	}
+	if usages[0].CustomerId != om.CustomerId || usages[0].ProjectId != om.ProjectId {
+		t.Errorf("got usage of project (%d, %d), expected (%d, %d)", usages[0].CustomerId, usages[0].ProjectId, om.CustomerId, om.ProjectId)
+	}
+	record := usages[0].Records[0]
+	if record.NumObservationsDispatched != 10 || record.NumBytesDispatched != numBytes {
+		t.Errorf("got record [%v], expected 10 observations and %d bytes dispatched", record, numBytes)
+	}
+}
+
+// concurrentAnalyzerTransport is a thread-safe fake Analyzer transport that
+// records the largest number of sends in flight at the same time, and whether
+// two sends of the same bucket were ever in flight at the same time.
+type concurrentAnalyzerTransport struct {
+	// The duration of a send.
+	sendDuration time.Duration
+
+	mu              sync.Mutex
+	inFlight        map[uint32]bool
+	maxInFlight     int
+	overlapping     bool
+	numSentByMetric map[uint32]int
+}
+
+func newConcurrentAnalyzerTransport(sendDuration time.Duration) *concurrentAnalyzerTransport {
+	return &concurrentAnalyzerTransport{
+		sendDuration:    sendDuration,
+		inFlight:        make(map[uint32]bool),
+		numSentByMetric: make(map[uint32]int),
+	}
+}
+
+func (a *concurrentAnalyzerTransport) send(obBatch *cobalt.ObservationBatch) error {
+	metricId := obBatch.GetMetaData().GetMetricId()
+	a.mu.Lock()
+	if a.inFlight[metricId] {
+		a.overlapping = true
+	}
+	a.inFlight[metricId] = true
+	if len(a.inFlight) > a.maxInFlight {
+		a.maxInFlight = len(a.inFlight)
+	}
+	a.mu.Unlock()
+
+	time.Sleep(a.sendDuration)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inFlight, metricId)
+	a.numSentByMetric[metricId] += len(obBatch.GetEncryptedObservation())
+	return nil
+}
+
+func (a *concurrentAnalyzerTransport) close() {}
+
+func (a *concurrentAnalyzerTransport) connect() error {
+	return nil
+}
+
+// TestDispatchConcurrently tests that buckets are dispatched concurrently by
+// up to |dispatch_concurrency| workers while the batches of each bucket are
+// sent one at a time, and that the shuffle audit transcripts of the buckets
+// are not interleaved.
+func TestDispatchConcurrently(t *testing.T) {
+	const numBuckets = 8
+	const num = 10
+	const concurrency = 4
+	store := storage.NewMemStore()
+	for i := 1; i <= numBuckets; i++ {
+		batch := storage.NewObservationBatchForMetadata(storage.NewObservationMetaData(i), num)
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+	}
+
+	d := newTestDispatcher(store, 3, 0)
+	d.config.GlobalConfig.DispatchConcurrency = concurrency
+	analyzer := newConcurrentAnalyzerTransport(5 * time.Millisecond)
+	d.analyzerTransport = analyzer
+	var transcript bytes.Buffer
+	d.EnableShuffleAudit([]byte("audit-key"), &transcript)
+	d.dispatch(1 * time.Millisecond)
+
+	for i := 1; i <= numBuckets; i++ {
+		if n := analyzer.numSentByMetric[uint32(i)]; n != num {
+			t.Errorf("got %d observations sent for metric %d, expected %d", n, i, num)
+		}
+		storage.CheckNumObservations(t, store, storage.NewObservationMetaData(i), 0)
+	}
+	if analyzer.overlapping {
+		t.Errorf("got concurrent sends of batches of the same bucket")
+	}
+	if analyzer.maxInFlight < 2 || analyzer.maxInFlight > concurrency {
+		t.Errorf("got at most %d buckets dispatched concurrently, expected between 2 and %d", analyzer.maxInFlight, concurrency)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(transcript.String(), "\n"), "\n")
+	if len(lines) != numBuckets*(num+1) {
+		t.Fatalf("got %d transcript lines, expected %d", len(lines), numBuckets*(num+1))
+	}
+	for i := 0; i < len(lines); i += num + 1 {
+		if !strings.HasPrefix(lines[i], "# ") {
+			t.Errorf("got transcript line [%v], expected a bucket header", lines[i])
+		}
+		for _, line := range lines[i+1 : i+num+1] {
+			if strings.HasPrefix(line, "# ") {
+				t.Errorf("got interleaved transcript [%v]", transcript.String())
+				return
+			}
+		}
+	}
+}
+
+// TestDispatchConcurrency tests that SetDispatchConcurrency() overrides
+// |dispatch_concurrency| in the config and that buckets are dispatched one at
+// a time by default.
+func TestDispatchConcurrency(t *testing.T) {
+	d := newTestDispatcher(storage.NewMemStore(), 1, 0)
+	if n := d.concurrency(); n != 1 {
+		t.Errorf("got concurrency %d by default, expected 1", n)
+	}
+	d.config.GlobalConfig.DispatchConcurrency = 3
+	if n := d.concurrency(); n != 3 {
+		t.Errorf("got concurrency %d, expected 3 from the config", n)
+	}
+	d.SetDispatchConcurrency(5)
+	if n := d.concurrency(); n != 5 {
+		t.Errorf("got concurrency %d, expected 5 from SetDispatchConcurrency()", n)
+	}
+}
+
+func TestProjectContext(t *testing.T) {
+	ctx := projectContext(&cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 42, MetricId: 3})
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		t.Fatalf("got no outgoing metadata")
+	}
+	if got := md[customerIdMetadataKey]; !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("got customer id %v, expected [1]", got)
+	}
+	if got := md[projectIdMetadataKey]; !reflect.DeepEqual(got, []string{"42"}) {
+		t.Errorf("got project id %v, expected [42]", got)
+	}
+}
+
 func TestMakeBatch(t *testing.T) {
 	dayIndex := storage.GetDayIndexUtc(time.Now())
 	key := &cobalt.ObservationMetadata{
@@ -453,7 +1128,7 @@ func TestMakeBatch(t *testing.T) {
 	// Retrieve a chunk of size 5 and assert the starting msg and the size of the
 	// batch returned.
 	chunkSize := 5
-	_, obBatch := makeBatch(key, iterator, chunkSize)
+	_, obBatch := makeBatch(key, iterator, chunkSize, shuffler.DayIndexNormalization_KEEP_DAY_INDEX)
 	encMsgList := obBatch.EncryptedObservation
 	if len(encMsgList) != chunkSize {
 		t.Errorf("Got chunk of size [%v], expected [%d]", len(encMsgList), chunkSize)
@@ -467,7 +1142,7 @@ func TestMakeBatch(t *testing.T) {
 	for i := 0; i < 17; i++ {
 		iterator.Next()
 	}
-	_, obBatch = makeBatch(key, iterator, chunkSize)
+	_, obBatch = makeBatch(key, iterator, chunkSize, shuffler.DayIndexNormalization_KEEP_DAY_INDEX)
 	encMsgList = obBatch.EncryptedObservation
 	if len(encMsgList) != 3 {
 		t.Errorf("Got chunk size [%v], expected chunk size [3]", len(encMsgList))
@@ -523,7 +1198,8 @@ func TestSendToAnalyzer(t *testing.T) {
 			codes.DeadlineExceeded,
 			codes.OK})
 	batch := cobalt.ObservationBatch{}
-	err := sendToAnalyzer(&transport, &batch, 4, 1)
+	stats := newSendStats()
+	err := sendToAnalyzer(&transport, &batch, testRetryPolicy(4), nil, stats)
 	if err != nil {
 		t.Errorf("Got unexpected error: %v", err)
 	}
@@ -540,7 +1216,7 @@ func TestSendToAnalyzer(t *testing.T) {
 			codes.Internal,
 			codes.Canceled,
 			codes.Internal})
-	err = sendToAnalyzer(&transport, &batch, 4, 1)
+	err = sendToAnalyzer(&transport, &batch, testRetryPolicy(4), nil, stats)
 	if err == nil {
 		t.Errorf("Expected an error")
 	}
@@ -558,7 +1234,7 @@ func TestSendToAnalyzer(t *testing.T) {
 			codes.InvalidArgument,
 			codes.Canceled,
 			codes.Internal})
-	err = sendToAnalyzer(&transport, &batch, 4, 1)
+	err = sendToAnalyzer(&transport, &batch, testRetryPolicy(4), nil, stats)
 	if err == nil {
 		t.Errorf("Expected an error")
 	}
@@ -578,7 +1254,7 @@ func TestSendToAnalyzer(t *testing.T) {
 			codes.Internal,
 			codes.Internal,
 			codes.Internal})
-	err = sendToAnalyzer(&transport, &batch, 4, 1)
+	err = sendToAnalyzer(&transport, &batch, testRetryPolicy(4), nil, stats)
 	if err == nil {
 		t.Errorf("Expected an error")
 	}
@@ -595,9 +1271,189 @@ func TestSendToAnalyzer(t *testing.T) {
 			codes.Internal,
 			codes.Internal,
 			codes.Internal})
-	err = sendToAnalyzer(&transport, &batch, 4, 1)
+	err = sendToAnalyzer(&transport, &batch, testRetryPolicy(4), nil, stats)
 	if err != nil {
 		t.Errorf("Got unexpected error: %v", err)
 	}
 	expectCounts(1, 0, 0, &transport, t)
+
+	// |stats| accumulates the outcomes of all of the sends above.
+	if stats.attempts != 15 || stats.reconnects != 5 || stats.succeeded != 2 || stats.failed != 3 {
+		t.Errorf("Got attempts=%d reconnects=%d succeeded=%d failed=%d, expected 15, 5, 2, 3",
+			stats.attempts, stats.reconnects, stats.succeeded, stats.failed)
+	}
+	expectedRetries := map[codes.Code]int{
+		codes.Aborted:          2,
+		codes.Canceled:         1,
+		codes.DeadlineExceeded: 2,
+		codes.Internal:         5,
+	}
+	if !reflect.DeepEqual(stats.retries, expectedRetries) {
+		t.Errorf("Got retries %v, expected %v", stats.retries, expectedRetries)
+	}
+}
+
+// TestMakeBatchNormalizesDayIndex tests that makeBatch() rewrites the day index
+// of the batch metadata without modifying the key.
+func TestMakeBatchNormalizesDayIndex(t *testing.T) {
+	// Day 17594 was Sunday, March 4 2018.
+	const sunday = uint32(17594)
+	key := &cobalt.ObservationMetadata{
+		CustomerId: uint32(1),
+		ProjectId:  uint32(11),
+		MetricId:   uint32(111),
+		DayIndex:   sunday + 3,
+	}
+	obVals := storage.MakeRandomObservationVals(3)
+	obVals[0].ArrivalDayIndex = sunday + 5
+	obVals[1].ArrivalDayIndex = sunday + 6
+	obVals[2].ArrivalDayIndex = 0
+
+	cases := []struct {
+		normalization shuffler.DayIndexNormalization
+		expected      uint32
+	}{
+		{shuffler.DayIndexNormalization_KEEP_DAY_INDEX, sunday + 3},
+		{shuffler.DayIndexNormalization_ARRIVAL_DAY_INDEX, sunday + 6},
+		{shuffler.DayIndexNormalization_WEEK_DAY_INDEX, sunday},
+	}
+	for _, c := range cases {
+		_, obBatch := makeBatch(key, storage.NewMemStoreIterator(obVals), 10, c.normalization)
+		if obBatch.MetaData.DayIndex != c.expected {
+			t.Errorf("%v: got day index [%d], expected [%d]", c.normalization, obBatch.MetaData.DayIndex, c.expected)
+		}
+		if obBatch.MetaData.MetricId != key.MetricId {
+			t.Errorf("%v: got metadata [%v], expected the metadata of [%v]", c.normalization, obBatch.MetaData, key)
+		}
+		if key.DayIndex != sunday+3 {
+			t.Fatalf("%v: the key was modified: [%v]", c.normalization, key)
+		}
+	}
+}
+
+// TestNormalizeDayIndex tests the week coarsening of normalizeDayIndex() at
+// the boundaries of weeks.
+func TestNormalizeDayIndex(t *testing.T) {
+	cases := []struct {
+		dayIndex uint32
+		expected uint32
+	}{
+		// Day zero was a Thursday.
+		{0, 0},
+		{2, 0},
+		{3, 3},
+		{9, 3},
+		{10, 10},
+		{17594, 17594},
+		{17600, 17594},
+		{17601, 17601},
+	}
+	for _, c := range cases {
+		if got := normalizeDayIndex(c.dayIndex, nil, shuffler.DayIndexNormalization_WEEK_DAY_INDEX); got != c.expected {
+			t.Errorf("normalizeDayIndex(%d) = %d, expected %d", c.dayIndex, got, c.expected)
+		}
+	}
+
+	// Without arrival days the day index is kept.
+	if got := normalizeDayIndex(5, []*shuffler.ObservationVal{{}}, shuffler.DayIndexNormalization_ARRIVAL_DAY_INDEX); got != 5 {
+		t.Errorf("normalizeDayIndex(5) = %d, expected 5", got)
+	}
+}
+
+// stoppingAnalyzerTransport is a fake Analyzer transport that invokes Stop()
+// on |dispatcher| from within the first send.
+type stoppingAnalyzerTransport struct {
+	fakeAnalyzerTransport
+	dispatcher *Dispatcher
+}
+
+func (a *stoppingAnalyzerTransport) send(obBatch *cobalt.ObservationBatch) error {
+	if a.numSent == 0 {
+		go a.dispatcher.Stop()
+		<-a.dispatcher.stop
+	}
+	return a.fakeAnalyzerTransport.send(obBatch)
+}
+
+// Tests that once Stop() is invoked the bucket that is being dispatched is
+// finished but no further buckets are dispatched.
+func TestDispatchStops(t *testing.T) {
+	const numBuckets = 4
+	const num = 10
+	store := storage.NewMemStore()
+	for i := 1; i <= numBuckets; i++ {
+		batch := storage.NewObservationBatchForMetadata(storage.NewObservationMetaData(i), num)
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+	}
+
+	d := newTestDispatcher(store, 3, 0)
+	analyzer := &stoppingAnalyzerTransport{dispatcher: d}
+	d.analyzerTransport = analyzer
+	d.dispatch(0)
+
+	// The first bucket was sent in 4 batches.
+	if analyzer.numSent != 4 {
+		t.Errorf("got %d batches sent, expected 4", analyzer.numSent)
+	}
+	keys, err := store.GetKeys()
+	if err != nil {
+		t.Fatalf("GetKeys() failed: %v", err)
+	}
+	numLeft := 0
+	for _, key := range keys {
+		n, err := store.GetNumObservations(key)
+		if err != nil {
+			t.Fatalf("GetNumObservations() failed: %v", err)
+		}
+		numLeft += n
+	}
+	if numLeft != (numBuckets-1)*num {
+		t.Errorf("got %d observations left in the store, expected %d", numLeft, (numBuckets-1)*num)
+	}
+}
+
+// Tests that Run() returns when Stop() is invoked while it is waiting for the
+// next dispatch.
+func TestRunStops(t *testing.T) {
+	d := newTestDispatcher(storage.NewMemStore(), 3, 0)
+	d.config.GlobalConfig.FrequencyInHours = 24
+	done := make(chan struct{})
+	go func() {
+		d.Run()
+		close(done)
+	}()
+	d.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after Stop()")
+	}
+}
+
+// Tests that the numbers of ObservationBatches sent and failed are added up
+// over dispatch cycles.
+func TestDispatchCounts(t *testing.T) {
+	store := storage.NewMemStore()
+	d := newTestDispatcher(store, 3, 0)
+	analyzer := &fakeAnalyzerTransport{errorsToReturn: []error{grpc.Errorf(codes.InvalidArgument, "")}}
+	d.analyzerTransport = analyzer
+	if !d.LastDispatchTime().IsZero() {
+		t.Errorf("got last dispatch time %v before the first dispatch, expected none", d.LastDispatchTime())
+	}
+
+	for cycle := 1; cycle <= 2; cycle++ {
+		batch := storage.NewObservationBatchForMetadata(storage.NewObservationMetaData(cycle), 10)
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+		d.dispatch(0)
+	}
+	if d.NumBatchesSent() != uint64(analyzer.numSent) {
+		t.Errorf("got %d batches sent, expected %d", d.NumBatchesSent(), analyzer.numSent)
+	}
+	if d.NumBatchesFailed() != 1 {
+		t.Errorf("got %d batches failed, expected 1", d.NumBatchesFailed())
+	}
 }
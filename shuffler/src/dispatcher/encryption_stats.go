@@ -0,0 +1,145 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"cobalt"
+	"shuffler"
+	"util/stackdriver"
+)
+
+const (
+	encryptionSchemeCount       = "dispatcher-encryption-scheme-count"
+	plaintextForEncryptedMetric = "dispatcher-plaintext-for-encrypted-metric"
+)
+
+// EncryptionStats tracks the distribution of the encryption schemes of the
+// Observations that the Dispatcher sends to the Analyzer, per metric. Once per
+// interval the distributions are logged as Stackdriver metrics. In addition
+// each sent ObservationBatch that contains plaintext Observations of a metric
+// that requires encryption is logged immediately, since a misconfigured client
+// would otherwise silently downgrade the security of the pipeline.
+type EncryptionStats struct {
+	// If true all metrics require encryption, otherwise only those in
+	// |required|.
+	requireAll bool
+	required   map[metricKey]bool
+
+	// mu protects |counts|.
+	mu sync.Mutex
+
+	// The number of Observations sent with each scheme for each metric in the
+	// current interval.
+	counts map[metricKey]map[cobalt.EncryptedMessage_EncryptionScheme]uint64
+}
+
+// NewEncryptionStats returns an EncryptionStats for the metrics that require
+// encryption according to |config|.
+func NewEncryptionStats(config *shuffler.ShufflerConfig) *EncryptionStats {
+	if config == nil {
+		panic("config is nil")
+	}
+
+	s := &EncryptionStats{
+		requireAll: config.GetGlobalConfig().GetRequireEncryption(),
+		required:   make(map[metricKey]bool),
+		counts:     make(map[metricKey]map[cobalt.EncryptedMessage_EncryptionScheme]uint64),
+	}
+	for _, p := range config.GetMetricPolicies() {
+		if p.RequireEncryption {
+			m := p.GetMetric()
+			s.required[metricKey{m.GetCustomerId(), m.GetProjectId(), m.GetMetricId()}] = true
+		}
+	}
+	return s
+}
+
+// add records the schemes of the Observations in |batch|, which was sent to
+// the Analyzer, and logs an alert if the metric of |batch| requires encryption
+// but some of its Observations are plaintext. Returns the number of such
+// plaintext Observations.
+func (s *EncryptionStats) add(batch *cobalt.ObservationBatch) int {
+	m := batch.GetMetaData()
+	key := metricKey{m.GetCustomerId(), m.GetProjectId(), m.GetMetricId()}
+
+	s.mu.Lock()
+	if s.counts[key] == nil {
+		s.counts[key] = make(map[cobalt.EncryptedMessage_EncryptionScheme]uint64)
+	}
+	numPlaintext := 0
+	for _, o := range batch.EncryptedObservation {
+		s.counts[key][o.GetScheme()]++
+		if o.GetScheme() == cobalt.EncryptedMessage_NONE {
+			numPlaintext++
+		}
+	}
+	s.mu.Unlock()
+
+	if numPlaintext == 0 || !(s.requireAll || s.required[key]) {
+		return 0
+	}
+	stackdriver.LogCountMetricf(plaintextForEncryptedMetric,
+		"Metric: %d/%d/%d Sent %d of %d Observations in plaintext although the metric requires encryption.",
+		key.customerId, key.projectId, key.metricId, numPlaintext, len(batch.EncryptedObservation))
+	return numPlaintext
+}
+
+// Run invokes Flush() once every |interval|. It never returns.
+func (s *EncryptionStats) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.Flush()
+	}
+}
+
+// Flush logs the number of Observations sent with each scheme for each metric
+// in the current interval and starts a new interval.
+func (s *EncryptionStats) Flush() {
+	s.mu.Lock()
+	counts := s.counts
+	s.counts = make(map[metricKey]map[cobalt.EncryptedMessage_EncryptionScheme]uint64)
+	s.mu.Unlock()
+
+	keys := make([]metricKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.customerId != b.customerId {
+			return a.customerId < b.customerId
+		}
+		if a.projectId != b.projectId {
+			return a.projectId < b.projectId
+		}
+		return a.metricId < b.metricId
+	})
+	for _, key := range keys {
+		schemes := make([]int, 0, len(counts[key]))
+		for scheme := range counts[key] {
+			schemes = append(schemes, int(scheme))
+		}
+		sort.Ints(schemes)
+		for _, scheme := range schemes {
+			n := counts[key][cobalt.EncryptedMessage_EncryptionScheme(scheme)]
+			stackdriver.LogIntStackdriverMetricf(encryptionSchemeCount, int(n), "Metric: %d/%d/%d Scheme: %v Count: %d",
+				key.customerId, key.projectId, key.metricId, cobalt.EncryptedMessage_EncryptionScheme(scheme), n)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+)
+
+// makeSchemeBatch returns an ObservationBatch for metric (1, 1, |metricId|)
+// with |numPlaintext| plaintext and |numHybrid| encrypted Observations.
+func makeSchemeBatch(metricId uint32, numPlaintext int, numHybrid int) *cobalt.ObservationBatch {
+	batch := &cobalt.ObservationBatch{
+		MetaData: &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: metricId},
+	}
+	for i := 0; i < numPlaintext; i++ {
+		batch.EncryptedObservation = append(batch.EncryptedObservation, &cobalt.EncryptedMessage{Scheme: cobalt.EncryptedMessage_NONE})
+	}
+	for i := 0; i < numHybrid; i++ {
+		batch.EncryptedObservation = append(batch.EncryptedObservation, &cobalt.EncryptedMessage{Scheme: cobalt.EncryptedMessage_HYBRID_ECDH_V1})
+	}
+	return batch
+}
+
+// Tests that EncryptionStats counts the schemes per metric and reports the
+// plaintext Observations of the metrics that require encryption only.
+func TestEncryptionStats(t *testing.T) {
+	s := NewEncryptionStats(&shuffler.ShufflerConfig{
+		MetricPolicies: []*shuffler.MetricPolicy{
+			{Metric: &shuffler.MetricKey{CustomerId: 1, ProjectId: 1, MetricId: 1}, RequireEncryption: true},
+			{Metric: &shuffler.MetricKey{CustomerId: 1, ProjectId: 1, MetricId: 2}},
+		},
+	})
+
+	if n := s.add(makeSchemeBatch(1, 2, 3)); n != 2 {
+		t.Errorf("add: got %d plaintext Observations for a metric requiring encryption, expected 2", n)
+	}
+	if n := s.add(makeSchemeBatch(1, 0, 4)); n != 0 {
+		t.Errorf("add: got %d plaintext Observations for an encrypted batch, expected 0", n)
+	}
+	if n := s.add(makeSchemeBatch(2, 5, 0)); n != 0 {
+		t.Errorf("add: got %d plaintext Observations for a metric not requiring encryption, expected 0", n)
+	}
+
+	expected := map[metricKey]map[cobalt.EncryptedMessage_EncryptionScheme]uint64{
+		{1, 1, 1}: {cobalt.EncryptedMessage_NONE: 2, cobalt.EncryptedMessage_HYBRID_ECDH_V1: 7},
+		{1, 1, 2}: {cobalt.EncryptedMessage_NONE: 5},
+	}
+	if len(s.counts) != len(expected) {
+		t.Fatalf("got counts %v, expected %v", s.counts, expected)
+	}
+	for key, counts := range expected {
+		for scheme, n := range counts {
+			if s.counts[key][scheme] != n {
+				t.Errorf("got %d Observations with scheme %v for metric %v, expected %d", s.counts[key][scheme], scheme, key, n)
+			}
+		}
+	}
+
+	s.Flush()
+	if len(s.counts) != 0 {
+		t.Errorf("got counts %v after Flush(), expected none", s.counts)
+	}
+}
+
+// Tests that all metrics require encryption if the global policy says so.
+func TestEncryptionStatsRequireAll(t *testing.T) {
+	s := NewEncryptionStats(&shuffler.ShufflerConfig{
+		GlobalConfig: &shuffler.Policy{RequireEncryption: true},
+	})
+	if n := s.add(makeSchemeBatch(3, 1, 1)); n != 1 {
+		t.Errorf("add: got %d plaintext Observations, expected 1", n)
+	}
+}
+
+// Tests that the Dispatcher records the schemes of the Observations it sends.
+func TestDispatchRecordsEncryptionStats(t *testing.T) {
+	store := storage.NewMemStore()
+	om := storage.NewObservationMetaData(23)
+	batch := storage.NewObservationBatchForMetadata(om, 10)
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+
+	d := newTestDispatcher(store, 4, 0)
+	d.EnableEncryptionStats(NewEncryptionStats(d.config))
+	d.dispatch(1 * time.Millisecond)
+
+	var total uint64
+	for _, n := range d.encryptionStats.counts[metricKey{om.CustomerId, om.ProjectId, om.MetricId}] {
+		total += n
+	}
+	if total != 10 {
+		t.Errorf("got %d Observations in the encryption stats, expected 10", total)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"cobalt"
+	"util"
+	"util/stackdriver"
+)
+
+// DefaultLeaseTTL is the time after which the lease of a Dispatcher on a
+// bucket expires unless it is released or renewed, e.g. because the Shuffler
+// crashed while dispatching the bucket. The lease is renewed before each
+// batch of the bucket is sent, so it only needs to exceed the time taken to
+// send a batch.
+const DefaultLeaseTTL = 10 * time.Minute
+
+// The owners of the leases taken by the dispatch and the disposal goroutines
+// of a Dispatcher are its |leaseOwner| with these suffixes, so that the two
+// goroutines never work on the same bucket either.
+const (
+	dispatchLeaseSuffix = "/dispatch"
+	disposalLeaseSuffix = "/dispose"
+)
+
+const leaseFailed = "dispatcher-lease-failed"
+
+// newLeaseOwner returns a name that identifies a Dispatcher among those of all
+// Shufflers sharing its store, made of the host name, the process id and
+// random bytes.
+func newLeaseOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	var random util.SecureRandom
+	suffix, err := random.RandomBytes(8)
+	if err != nil {
+		// The host name and the process id are unique among running Shufflers
+		// unless they run in containers.
+		return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// tryLease acquires or renews the lease on the bucket for |key| in the store
+// for the goroutine of the Dispatcher identified by |suffix| and returns true,
+// or returns false if the lease is held by another goroutine or Dispatcher or
+// the store fails.
+func (d *Dispatcher) tryLease(key *cobalt.ObservationMetadata, suffix string) bool {
+	acquired, err := d.store.TryLease(key, d.leaseOwner+suffix, d.leaseTTL)
+	if err != nil {
+		stackdriver.LogCountMetricf(leaseFailed, "TryLease() failed for key: %v with error: %v", key, err)
+		return false
+	}
+	return acquired
+}
+
+// releaseLease releases the lease on the bucket for |key| held by the
+// goroutine of the Dispatcher identified by |suffix|. If the store fails the
+// lease expires after |leaseTTL|.
+func (d *Dispatcher) releaseLease(key *cobalt.ObservationMetadata, suffix string) {
+	if err := d.store.ReleaseLease(key, d.leaseOwner+suffix); err != nil {
+		stackdriver.LogCountMetricf(leaseFailed, "ReleaseLease() failed for key: %v with error: %v", key, err)
+	}
+}
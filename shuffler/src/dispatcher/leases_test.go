@@ -0,0 +1,107 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"cobalt"
+	"storage"
+)
+
+// doTestConcurrentDispatchers tests that two Dispatchers sharing |store|, as
+// those of several Shufflers sharing a database do, dispatching the same
+// buckets at the same time send each Observation exactly once.
+func doTestConcurrentDispatchers(t *testing.T, store storage.Store) {
+	const numBuckets = 20
+	const numPerBucket = 30
+	var buckets []pendingBucket
+	for i := 0; i < numBuckets; i++ {
+		om := storage.NewObservationMetaData(100 + i)
+		batch := storage.NewObservationBatchForMetadata(om, numPerBucket)
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.NewArrival(time.Now(), "")); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+		buckets = append(buckets, pendingBucket{key: om, size: numPerBucket})
+	}
+
+	dispatchers := []*Dispatcher{newTestDispatcher(store, 10, 1), newTestDispatcher(store, 10, 1)}
+	dispatchers[1].leaseOwner = "other-test-dispatcher"
+	var wg sync.WaitGroup
+	for _, d := range dispatchers {
+		wg.Add(1)
+		go func(d *Dispatcher) {
+			defer wg.Done()
+			for _, bucket := range buckets {
+				d.dispatchPendingBucket(bucket, time.Millisecond, newSendStats())
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	sent := make(map[string]bool)
+	for _, d := range dispatchers {
+		for _, batch := range getAnalyzerTransport(d).obBatch {
+			for _, o := range batch.EncryptedObservation {
+				if sent[string(o.Ciphertext)] {
+					t.Errorf("Observation [%v] of bucket [%v] was sent twice", o, batch.MetaData)
+				}
+				sent[string(o.Ciphertext)] = true
+			}
+		}
+	}
+	if len(sent) != numBuckets*numPerBucket {
+		t.Errorf("got %d Observations sent, expected %d", len(sent), numBuckets*numPerBucket)
+	}
+	if total, err := store.GetTotalNumObservations(); err != nil || total != 0 {
+		t.Errorf("GetTotalNumObservations: got (%d, %v), expected 0", total, err)
+	}
+}
+
+func TestConcurrentDispatchersForMemStore(t *testing.T) {
+	store := storage.NewMemStore()
+	doTestConcurrentDispatchers(t, store)
+	storage.ResetStoreForTesting(store, true)
+}
+
+// This test requires a PostgreSQL database, whose connection string is given
+// by the environment variable SHUFFLER_TEST_POSTGRES_URL, and is skipped
+// otherwise. All data in the tables of the store is deleted.
+func TestConcurrentDispatchersForPostgresStore(t *testing.T) {
+	url := os.Getenv("SHUFFLER_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("SHUFFLER_TEST_POSTGRES_URL is not set.")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	store, err := storage.NewPostgresStore(db)
+	if err != nil {
+		t.Fatalf("Failed to create a PostgreSQL store instance: %v", err)
+	}
+	defer store.Close()
+	if err := store.EraseAllData(); err != nil {
+		t.Fatalf("Failed to erase the PostgreSQL store: %v", err)
+	}
+	doTestConcurrentDispatchers(t, store)
+	storage.ResetStoreForTesting(store, true)
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+	"util"
+	"util/stackdriver"
+)
+
+const (
+	observationDropFailed = "dispatcher-observation-drop-failed"
+	observationsDropped   = "dispatcher-observations-dropped"
+)
+
+// The random numbers drawn for each Observation are in [0, dropResolution).
+const dropResolution = 1 << 32
+
+// observationDrop drops each Observation of the buckets being dispatched with
+// a fixed probability, as specified by |Policy.p_observation_drop|, before it
+// is put into an ObservationBatch.
+type observationDrop struct {
+	// An Observation is dropped if the random number drawn for it is less than
+	// |threshold|.
+	threshold uint64
+	random    util.Random
+}
+
+// newObservationDrop returns an observationDrop that drops each Observation
+// with probability |probability|, which must be in the range [0.0, 1.0], using
+// |random| as the source of randomness.
+func newObservationDrop(probability float64, random util.Random) *observationDrop {
+	if probability < 0 || probability > 1 {
+		panic(fmt.Sprintf("Invalid drop probability [%v]", probability))
+	}
+	if random == nil {
+		panic("random is nil")
+	}
+
+	return &observationDrop{
+		threshold: uint64(probability * dropResolution),
+		random:    random,
+	}
+}
+
+// drop returns true if an Observation should be dropped. If no random number
+// can be drawn the Observation is kept.
+func (o *observationDrop) drop() bool {
+	n, err := o.random.RandomUint63(dropResolution)
+	if err != nil {
+		stackdriver.LogCountMetricf(observationDropFailed, "Drawing a random number failed: %v", err)
+		return false
+	}
+	return n < o.threshold
+}
+
+// droppingIterator is a storage.Iterator that skips the ObservationVals
+// dropped by |drop| and collects them in |dropped|. Entries for which Get()
+// fails are passed on to the caller.
+type droppingIterator struct {
+	storage.Iterator
+	drop    *observationDrop
+	dropped []*shuffler.ObservationVal
+}
+
+// newDroppingIterator returns a droppingIterator over the entries of |iter|.
+func newDroppingIterator(iter storage.Iterator, drop *observationDrop) *droppingIterator {
+	return &droppingIterator{
+		Iterator: iter,
+		drop:     drop,
+	}
+}
+
+// Next advances the iterator to the next entry that is not dropped.
+func (it *droppingIterator) Next() bool {
+	for it.Iterator.Next() {
+		obVal, err := it.Iterator.Get()
+		if err != nil || !it.drop.drop() {
+			return true
+		}
+		it.dropped = append(it.dropped, obVal)
+	}
+	return false
+}
+
+// takeDropped returns the ObservationVals dropped since the last invocation.
+func (it *droppingIterator) takeDropped() []*shuffler.ObservationVal {
+	dropped := it.dropped
+	it.dropped = nil
+	return dropped
+}
+
+// discardDropped deletes |dropped|, the ObservationVals of the bucket for |key|
+// that were dropped, from the store and adds their number to the DropAudit of
+// the bucket for each day on which they arrived.
+func (d *Dispatcher) discardDropped(key *cobalt.ObservationMetadata, dropped []*shuffler.ObservationVal) {
+	if len(dropped) == 0 {
+		return
+	}
+	glog.V(4).Infof("Dropped %d Observations at random for metadata [%v].", len(dropped), key)
+	stackdriver.LogCountMetricf(observationsDropped, "Dropped %d Observations at random for metadata [%v].", len(dropped), key)
+	d.mu.Lock()
+	d.numObservationsDropped += uint64(len(dropped))
+	d.mu.Unlock()
+
+	if err := storage.DeleteValuesInChunks(d.store, key, dropped, d.deleteChunkSize); err != nil {
+		stackdriver.LogCountMetricf(dispatchBucketFailed, "Error in deleting dropped observations from the store for key: %v", key)
+	}
+
+	perDay := make(map[uint32]uint64)
+	for _, obVal := range dropped {
+		perDay[obVal.ArrivalDayIndex]++
+	}
+	days := make([]int, 0, len(perDay))
+	for day := range perDay {
+		days = append(days, int(day))
+	}
+	sort.Ints(days)
+	for _, day := range days {
+		n := perDay[uint32(day)]
+		if err := d.store.AddDropCount(key, uint32(day), shuffler.DropRecord_RANDOM_DROP, n); err != nil {
+			stackdriver.LogCountMetricf(observationDropFailed, "Recording %d dropped Observations failed for key: %v: %v", n, key, err)
+		}
+	}
+}
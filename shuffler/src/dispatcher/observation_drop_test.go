@@ -0,0 +1,209 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+	"util"
+)
+
+// Tests that the empirical drop rate of an observationDrop matches its
+// probability.
+func TestObservationDropRate(t *testing.T) {
+	const numDraws = 100000
+	for _, p := range []float64{0.0, 0.1, 0.5, 0.9, 1.0} {
+		drop := newObservationDrop(p, util.NewDeterministicRandom(int64(1)))
+		numDropped := 0
+		for i := 0; i < numDraws; i++ {
+			if drop.drop() {
+				numDropped++
+			}
+		}
+		// Five standard deviations of the binomial distribution.
+		tolerance := 5 * math.Sqrt(numDraws*p*(1-p))
+		if got, want := float64(numDropped), numDraws*p; math.Abs(got-want) > tolerance {
+			t.Errorf("p = %v: got %v dropped Observations, expected %v +/- %v", p, got, want, tolerance)
+		}
+	}
+}
+
+// Tests that the dropped Observations of a dispatched bucket are not sent, are
+// deleted from the store and are counted in its DropAudit and by the
+// Dispatcher.
+func TestDispatchDropsObservations(t *testing.T) {
+	const numObservations = 1000
+	const p = 0.25
+	store := storage.NewMemStore()
+	om := storage.NewObservationMetaData(31)
+	batch := storage.NewObservationBatchForMetadata(om, numObservations)
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+
+	d := newTestDispatcher(store, 100, 0)
+	d.observationDrop = newObservationDrop(p, util.NewDeterministicRandom(int64(1)))
+	d.dispatch(0)
+
+	numSent := 0
+	for _, b := range getAnalyzerTransport(d).obBatch {
+		numSent += len(b.EncryptedObservation)
+	}
+	numDropped := int(d.NumObservationsDropped())
+	if numSent+numDropped != numObservations {
+		t.Errorf("got %d Observations sent and %d dropped, expected %d in total", numSent, numDropped, numObservations)
+	}
+	tolerance := 5 * math.Sqrt(numObservations*p*(1-p))
+	if math.Abs(float64(numDropped)-numObservations*p) > tolerance {
+		t.Errorf("got %d dropped Observations, expected %v +/- %v", numDropped, numObservations*p, tolerance)
+	}
+	if keys, err := store.GetKeys(); err != nil || len(keys) != 0 {
+		t.Errorf("GetKeys: got (%v, %v), expected an empty store", keys, err)
+	}
+
+	audits, err := store.GetDropAudits()
+	if err != nil {
+		t.Fatalf("GetDropAudits() failed: %v", err)
+	}
+	if len(audits) != 1 || len(audits[0].Records) != 1 {
+		t.Fatalf("got audits %v, expected a single record", audits)
+	}
+	record := audits[0].Records[0]
+	if record.ArrivalDayIndex != 10 || record.Reason != shuffler.DropRecord_RANDOM_DROP || record.NumObservations != uint64(numDropped) {
+		t.Errorf("got record %v, expected %d Observations dropped at random on day 10", record, numDropped)
+	}
+}
+
+// Tests that the dropped Observations do not count towards the threshold: a
+// bucket is dispatched if the Observations that are kept reach the threshold,
+// and is left untouched otherwise.
+func TestDispatchDropBeforeThreshold(t *testing.T) {
+	const numObservations = 1000
+	const p = 0.25
+	for _, test := range []struct {
+		threshold  int
+		dispatched bool
+	}{
+		{numObservations / 2, true},
+		{numObservations, false},
+	} {
+		store := storage.NewMemStore()
+		om := storage.NewObservationMetaData(33)
+		batch := storage.NewObservationBatchForMetadata(om, numObservations)
+		arrival := storage.Arrival{DayIndex: storage.GetDayIndexUtc(time.Now())}
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, arrival); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+
+		d := newTestDispatcher(store, 100, test.threshold)
+		d.observationDrop = newObservationDrop(p, util.NewDeterministicRandom(int64(1)))
+		d.dispatch(0)
+
+		numSent := 0
+		for _, b := range getAnalyzerTransport(d).obBatch {
+			numSent += len(b.EncryptedObservation)
+		}
+		numDropped := int(d.NumObservationsDropped())
+		histories, err := store.GetDispatchHistories()
+		if err != nil {
+			t.Fatalf("GetDispatchHistories() failed: %v", err)
+		}
+		if !test.dispatched {
+			if numSent != 0 || numDropped != 0 || len(histories) != 0 {
+				t.Errorf("threshold %d: got %d Observations sent, %d dropped and histories %v, expected none",
+					test.threshold, numSent, numDropped, histories)
+			}
+			storage.CheckNumObservations(t, store, om, numObservations)
+			continue
+		}
+		if numSent < test.threshold || numSent+numDropped != numObservations {
+			t.Errorf("threshold %d: got %d Observations sent and %d dropped, expected at least %d sent and %d in total",
+				test.threshold, numSent, numDropped, test.threshold, numObservations)
+		}
+		if len(histories) != 1 {
+			t.Errorf("threshold %d: got histories %v, expected one", test.threshold, histories)
+		}
+	}
+}
+
+// Tests that dispose() skips a bucket at the threshold even if Observations
+// are dropped, so that its stale Observations all reach dispatch.
+func TestDisposeWithObservationDrop(t *testing.T) {
+	const num = 40
+	currentDayIndex := storage.GetDayIndexUtc(time.Now())
+	store, key, _, err := makeTestStore(num, currentDayIndex, true)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+
+	d := newTestDispatcher(store, num, num/2)
+	d.config.GlobalConfig.DisposalAgeDays = 2
+	d.observationDrop = newObservationDrop(0.25, util.NewDeterministicRandom(int64(1)))
+	d.dispose(currentDayIndex, time.Millisecond)
+	storage.CheckNumObservations(t, store, key, num)
+
+	d.dispatch(0)
+	numSent := 0
+	for _, b := range getAnalyzerTransport(d).obBatch {
+		numSent += len(b.EncryptedObservation)
+	}
+	if numDropped := int(d.NumObservationsDropped()); numSent+numDropped != num {
+		t.Errorf("got %d Observations sent and %d dropped, expected %d in total", numSent, numDropped, num)
+	}
+}
+
+// Tests that the stale Observations of a bucket that the drop keeps below the
+// threshold are disposed of when it is dispatched.
+func TestDispatchDisposesBucketBelowThresholdAfterDrop(t *testing.T) {
+	const num = 40
+	currentDayIndex := storage.GetDayIndexUtc(time.Now())
+	store, key, _, err := makeTestStore(num, currentDayIndex, true)
+	if err != nil {
+		t.Fatalf("got error [%v] in test store setup", err)
+	}
+
+	d := newTestDispatcher(store, num, num)
+	d.config.GlobalConfig.DisposalAgeDays = 2
+	d.observationDrop = newObservationDrop(0.5, util.NewDeterministicRandom(int64(1)))
+	d.dispatch(0)
+	if n := getAnalyzerTransport(d).numSent; n != 0 {
+		t.Errorf("got %d batches sent, expected none", n)
+	}
+	storage.CheckNumObservations(t, store, key, num/2)
+}
+
+// Tests that no Observations are dropped without an observationDrop.
+func TestDispatchWithoutObservationDrop(t *testing.T) {
+	store := storage.NewMemStore()
+	om := storage.NewObservationMetaData(32)
+	batch := storage.NewObservationBatchForMetadata(om, 50)
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+
+	d := newTestDispatcher(store, 20, 0)
+	d.dispatch(0)
+	if n := d.NumObservationsDropped(); n != 0 {
+		t.Errorf("got %d dropped Observations, expected none", n)
+	}
+	if n := getAnalyzerTransport(d).numSent; n != 3 {
+		t.Errorf("got %d batches sent, expected 3", n)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"time"
+
+	"cobalt"
+	"shuffler"
+)
+
+// policyFor returns the Policy that applies to the bucket for |key| in
+// |config| and the scope of that Policy: the metrics field of the most
+// specific PolicyOverride that matches |key|, or the zero metricKey if the
+// |global_config| applies. See |policy_overrides| in config.proto.
+func policyFor(config *shuffler.ShufflerConfig, key *cobalt.ObservationMetadata) (metricKey, *shuffler.Policy) {
+	scope, policy := metricKey{}, config.GetGlobalConfig()
+	specificity := 0
+	for _, o := range config.GetPolicyOverrides() {
+		m := o.GetMetrics()
+		if m.GetCustomerId() != key.CustomerId || o.GetPolicy() == nil {
+			continue
+		}
+		s := 1
+		if m.GetProjectId() != 0 {
+			if m.GetProjectId() != key.ProjectId {
+				continue
+			}
+			s = 2
+			if m.GetMetricId() != 0 {
+				if m.GetMetricId() != key.MetricId {
+					continue
+				}
+				s = 3
+			}
+		} else if m.GetMetricId() != 0 {
+			// A metric id without a project id does not identify a metric.
+			continue
+		}
+		if s > specificity {
+			scope = metricKey{m.GetCustomerId(), m.GetProjectId(), m.GetMetricId()}
+			policy = o.GetPolicy()
+			specificity = s
+		}
+	}
+	return scope, policy
+}
+
+// PolicyFor returns the Policy that applies to the bucket for |key| in
+// |config|.
+func PolicyFor(config *shuffler.ShufflerConfig, key *cobalt.ObservationMetadata) *shuffler.Policy {
+	_, policy := policyFor(config, key)
+	return policy
+}
+
+// dispatchCycleInterval returns the interval between dispatch cycles, which is the
+// shortest of the |frequency_in_hours| of the policies in |config|.
+func dispatchCycleInterval(config *shuffler.ShufflerConfig) time.Duration {
+	hours := config.GetGlobalConfig().GetFrequencyInHours()
+	for _, o := range config.GetPolicyOverrides() {
+		if p := o.GetPolicy(); p != nil && p.FrequencyInHours < hours {
+			hours = p.FrequencyInHours
+		}
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// duePolicies returns the scopes of the policies in |config| whose buckets
+// are due in the dispatch cycle starting at |now|, i.e. those that were last
+// due at least |frequency_in_hours| before |now|, and records that they were
+// due at |now| in |lastDue|.
+func duePolicies(config *shuffler.ShufflerConfig, now time.Time, lastDue map[metricKey]time.Time) map[metricKey]bool {
+	due := make(map[metricKey]bool)
+	check := func(scope metricKey, policy *shuffler.Policy) {
+		last, ok := lastDue[scope]
+		if ok && now.Sub(last) < time.Duration(policy.GetFrequencyInHours())*time.Hour {
+			return
+		}
+		due[scope] = true
+		lastDue[scope] = now
+	}
+	check(metricKey{}, config.GetGlobalConfig())
+	for _, o := range config.GetPolicyOverrides() {
+		if p := o.GetPolicy(); p != nil {
+			m := o.GetMetrics()
+			check(metricKey{m.GetCustomerId(), m.GetProjectId(), m.GetMetricId()}, p)
+		}
+	}
+	return due
+}
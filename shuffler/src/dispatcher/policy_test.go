@@ -0,0 +1,122 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+)
+
+// makeOverrideConfig returns a ShufflerConfig with a global policy and
+// overrides for customer 1, for project (1, 2) and for metric (1, 2, 3), whose
+// thresholds are 10, 20, 30 and 40 and whose frequencies are 24, 12, 6 and 1
+// hours.
+func makeOverrideConfig() *shuffler.ShufflerConfig {
+	return &shuffler.ShufflerConfig{
+		GlobalConfig: &shuffler.Policy{FrequencyInHours: 24, Threshold: 10},
+		PolicyOverrides: []*shuffler.PolicyOverride{
+			{Metrics: &shuffler.MetricKey{CustomerId: 1, ProjectId: 2, MetricId: 3}, Policy: &shuffler.Policy{FrequencyInHours: 1, Threshold: 40}},
+			{Metrics: &shuffler.MetricKey{CustomerId: 1}, Policy: &shuffler.Policy{FrequencyInHours: 12, Threshold: 20}},
+			{Metrics: &shuffler.MetricKey{CustomerId: 1, ProjectId: 2}, Policy: &shuffler.Policy{FrequencyInHours: 6, Threshold: 30}},
+		},
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	config := makeOverrideConfig()
+	for _, test := range []struct {
+		key       *cobalt.ObservationMetadata
+		scope     metricKey
+		threshold uint32
+	}{
+		{&cobalt.ObservationMetadata{CustomerId: 2, ProjectId: 2, MetricId: 3}, metricKey{}, 10},
+		{&cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 3}, metricKey{1, 0, 0}, 20},
+		{&cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 2, MetricId: 4}, metricKey{1, 2, 0}, 30},
+		{&cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 2, MetricId: 3}, metricKey{1, 2, 3}, 40},
+	} {
+		scope, policy := policyFor(config, test.key)
+		if scope != test.scope || policy.Threshold != test.threshold {
+			t.Errorf("got scope %v and threshold %d for [%v], want %v and %d", scope, policy.Threshold, test.key, test.scope, test.threshold)
+		}
+	}
+}
+
+func TestDispatchCycleInterval(t *testing.T) {
+	config := makeOverrideConfig()
+	if got := dispatchCycleInterval(config); got != time.Hour {
+		t.Errorf("got interval %v, want 1h", got)
+	}
+	config.PolicyOverrides = nil
+	if got := dispatchCycleInterval(config); got != 24*time.Hour {
+		t.Errorf("got interval %v, want 24h", got)
+	}
+}
+
+// Tests that each policy is due once its frequency has elapsed since it was
+// last due.
+func TestDuePolicies(t *testing.T) {
+	config := makeOverrideConfig()
+	lastDue := make(map[metricKey]time.Time)
+	start := time.Now()
+	for _, test := range []struct {
+		hours int
+		due   map[metricKey]bool
+	}{
+		{0, map[metricKey]bool{{}: true, {1, 0, 0}: true, {1, 2, 0}: true, {1, 2, 3}: true}},
+		{1, map[metricKey]bool{{1, 2, 3}: true}},
+		{6, map[metricKey]bool{{1, 2, 0}: true, {1, 2, 3}: true}},
+		{12, map[metricKey]bool{{1, 0, 0}: true, {1, 2, 0}: true, {1, 2, 3}: true}},
+		{13, map[metricKey]bool{{1, 2, 3}: true}},
+		{24, map[metricKey]bool{{}: true, {1, 0, 0}: true, {1, 2, 0}: true, {1, 2, 3}: true}},
+	} {
+		due := duePolicies(config, start.Add(time.Duration(test.hours)*time.Hour), lastDue)
+		if !reflect.DeepEqual(due, test.due) {
+			t.Errorf("got due policies %v after %d hours, want %v", due, test.hours, test.due)
+		}
+	}
+}
+
+// Tests that the buckets of a metric are dispatched according to the most
+// specific policy for the metric.
+func TestDispatchWithPolicyOverrides(t *testing.T) {
+	const num = 15
+	store := storage.NewMemStore()
+	for _, id := range []int{1, 2} {
+		batch := storage.NewObservationBatchForMetadata(storage.NewObservationMetaData(id), num)
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+	}
+
+	// The global threshold of 10 lets the bucket of metric 1 through while
+	// the override for customer 2 holds the bucket of metric 2 back.
+	d := newTestDispatcher(store, 100, 10)
+	d.config.PolicyOverrides = []*shuffler.PolicyOverride{
+		{Metrics: &shuffler.MetricKey{CustomerId: 2}, Policy: &shuffler.Policy{Threshold: 20}},
+	}
+	analyzer := getAnalyzerTransport(d)
+	d.dispatch(1 * time.Millisecond)
+
+	if len(analyzer.obBatch) != 1 || analyzer.obBatch[0].MetaData.MetricId != 1 {
+		t.Fatalf("got batches %v, expected a single batch for metric 1", analyzer.obBatch)
+	}
+	storage.CheckNumObservations(t, store, storage.NewObservationMetaData(1), 0)
+	storage.CheckNumObservations(t, store, storage.NewObservationMetaData(2), num)
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"cobalt"
+	"shuffler"
+)
+
+// The priority classes ordered from highest to lowest priority.
+var priorityOrder = []shuffler.DispatchPriority{
+	shuffler.DispatchPriority_HIGH_PRIORITY,
+	shuffler.DispatchPriority_NORMAL_PRIORITY,
+	shuffler.DispatchPriority_LOW_PRIORITY,
+}
+
+// metricKey is the comparable form of a shuffler.MetricKey.
+type metricKey struct {
+	customerId uint32
+	projectId  uint32
+	metricId   uint32
+}
+
+// pendingBucket is a bucket that is due to be dispatched in the current
+// dispatch cycle.
+type pendingBucket struct {
+	key  *cobalt.ObservationMetadata
+	size int
+}
+
+// priorityClassQueue holds the pending buckets of a priority class and the
+// number of Observations dispatched for the class in the current cycle.
+type priorityClassQueue struct {
+	priority shuffler.DispatchPriority
+	share    float64
+	sent     int
+	buckets  []pendingBucket
+}
+
+// dispatchQueue orders the buckets that are due in a dispatch cycle by the
+// priority of their metrics and the bandwidth shares of the priority classes
+// as described in config.proto.
+type dispatchQueue struct {
+	priorities map[metricKey]shuffler.DispatchPriority
+	// Ordered from highest to lowest priority.
+	classes []*priorityClassQueue
+}
+
+// newDispatchQueue returns an empty dispatchQueue for the metric policies and
+// priority classes in |config|.
+func newDispatchQueue(config *shuffler.ShufflerConfig) *dispatchQueue {
+	q := &dispatchQueue{
+		priorities: make(map[metricKey]shuffler.DispatchPriority),
+	}
+	for _, p := range config.GetMetricPolicies() {
+		m := p.GetMetric()
+		q.priorities[metricKey{m.GetCustomerId(), m.GetProjectId(), m.GetMetricId()}] = p.Priority
+	}
+	for _, priority := range priorityOrder {
+		class := &priorityClassQueue{priority: priority}
+		for _, c := range config.GetPriorityClasses() {
+			if c.Priority == priority && c.BandwidthShare > 0 {
+				class.share = float64(c.BandwidthShare)
+			}
+		}
+		q.classes = append(q.classes, class)
+	}
+	return q
+}
+
+// add appends the bucket for |key| of size |size| to the queue of the
+// priority class of its metric. Buckets of metrics with an unknown priority
+// are treated as NORMAL_PRIORITY.
+func (q *dispatchQueue) add(key *cobalt.ObservationMetadata, size int) {
+	priority := q.priorities[metricKey{key.CustomerId, key.ProjectId, key.MetricId}]
+	class := q.class(priority)
+	if class == nil {
+		class = q.class(shuffler.DispatchPriority_NORMAL_PRIORITY)
+	}
+	class.buckets = append(class.buckets, pendingBucket{key, size})
+}
+
+// class returns the queue of the priority class |priority| or nil if there is
+// no such class.
+func (q *dispatchQueue) class(priority shuffler.DispatchPriority) *priorityClassQueue {
+	for _, c := range q.classes {
+		if c.priority == priority {
+			return c
+		}
+	}
+	return nil
+}
+
+// next removes and returns the bucket that should be dispatched next and
+// charges its size to its priority class. Returns false if the queue is
+// empty.
+func (q *dispatchQueue) next() (pendingBucket, bool) {
+	var chosen *priorityClassQueue
+	for _, c := range q.classes {
+		if len(c.buckets) == 0 {
+			continue
+		}
+		if chosen == nil {
+			chosen = c
+			continue
+		}
+		// A class with a positive share is preferred over one without. Among
+		// classes with a positive share the one that is furthest behind its
+		// share is preferred. Otherwise the earlier, higher priority class wins.
+		switch {
+		case chosen.share <= 0 && c.share > 0:
+			chosen = c
+		case chosen.share > 0 && c.share > 0 && float64(c.sent)/c.share < float64(chosen.sent)/chosen.share:
+			chosen = c
+		}
+	}
+	if chosen == nil {
+		return pendingBucket{}, false
+	}
+
+	bucket := chosen.buckets[0]
+	chosen.buckets = chosen.buckets[1:]
+	chosen.sent += bucket.size
+	return bucket, true
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+)
+
+// makePriorityConfig returns a ShufflerConfig in which metric 1 has
+// HIGH_PRIORITY, metric 3 has LOW_PRIORITY and all other metrics have
+// NORMAL_PRIORITY. The classes have the given bandwidth |shares|.
+func makePriorityConfig(shares map[shuffler.DispatchPriority]float32) *shuffler.ShufflerConfig {
+	config := &shuffler.ShufflerConfig{
+		MetricPolicies: []*shuffler.MetricPolicy{
+			{Metric: &shuffler.MetricKey{CustomerId: 1, ProjectId: 1, MetricId: 1}, Priority: shuffler.DispatchPriority_HIGH_PRIORITY},
+			{Metric: &shuffler.MetricKey{CustomerId: 3, ProjectId: 3, MetricId: 3}, Priority: shuffler.DispatchPriority_LOW_PRIORITY},
+		},
+	}
+	for priority, share := range shares {
+		config.PriorityClasses = append(config.PriorityClasses, &shuffler.PriorityClass{Priority: priority, BandwidthShare: share})
+	}
+	return config
+}
+
+// drainDispatchQueue returns the metric ids of the buckets in the order in
+// which |q| returns them.
+func drainDispatchQueue(q *dispatchQueue) []uint32 {
+	var metricIds []uint32
+	for bucket, ok := q.next(); ok; bucket, ok = q.next() {
+		metricIds = append(metricIds, bucket.key.MetricId)
+	}
+	return metricIds
+}
+
+func TestDispatchQueueStrictPriority(t *testing.T) {
+	q := newDispatchQueue(makePriorityConfig(nil))
+	for _, id := range []int{3, 2, 1, 4, 1} {
+		q.add(storage.NewObservationMetaData(id), 10)
+	}
+	if got, want := drainDispatchQueue(q), []uint32{1, 1, 2, 4, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
+
+func TestDispatchQueueBandwidthShares(t *testing.T) {
+	// HIGH_PRIORITY gets a quarter and LOW_PRIORITY three quarters of the
+	// Observations while both have buckets waiting. NORMAL_PRIORITY has no share
+	// and waits for the others.
+	q := newDispatchQueue(makePriorityConfig(map[shuffler.DispatchPriority]float32{
+		shuffler.DispatchPriority_HIGH_PRIORITY: 1,
+		shuffler.DispatchPriority_LOW_PRIORITY:  3,
+	}))
+	for i := 0; i < 4; i++ {
+		q.add(storage.NewObservationMetaData(1), 10)
+		q.add(storage.NewObservationMetaData(2), 10)
+		q.add(storage.NewObservationMetaData(3), 10)
+	}
+	want := []uint32{1, 3, 3, 3, 1, 3, 1, 1, 2, 2, 2, 2}
+	if got := drainDispatchQueue(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
+
+func TestDispatchQueueEmpty(t *testing.T) {
+	q := newDispatchQueue(&shuffler.ShufflerConfig{})
+	if _, ok := q.next(); ok {
+		t.Errorf("expected an empty queue")
+	}
+}
+
+// TestDispatchByPriority tests that dispatch() sends the buckets of
+// HIGH_PRIORITY metrics first.
+func TestDispatchByPriority(t *testing.T) {
+	store := storage.NewMemStore()
+	defer storage.ResetStoreForTesting(store, true)
+	for _, id := range []int{3, 2, 1} {
+		batch := &cobalt.ObservationBatch{
+			MetaData:             storage.NewObservationMetaData(id),
+			EncryptedObservation: storage.MakeRandomEncryptedMsgs(5),
+		}
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.Arrival{DayIndex: 10}); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+	}
+
+	d := newTestDispatcher(store, 10, 0)
+	policies := makePriorityConfig(nil)
+	d.config.MetricPolicies = policies.MetricPolicies
+	d.dispatch(1 * time.Millisecond)
+
+	var got []uint32
+	for _, batch := range getAnalyzerTransport(d).obBatch {
+		got = append(got, batch.MetaData.MetricId)
+	}
+	if want := []uint32{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got dispatch order %v, want %v", got, want)
+	}
+}
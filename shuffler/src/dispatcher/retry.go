@@ -0,0 +1,194 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"shuffler"
+	"util/stackdriver"
+)
+
+// The defaults of the fields of an AnalyzerRetryPolicy that are zero.
+const (
+	defaultMaxAttempts            = 4
+	defaultInitialBackoff         = 2500 * time.Millisecond
+	defaultBackoffMultiplier      = 2.0
+	defaultMaxBackoff             = 60 * time.Second
+	defaultCircuitBreakerCooldown = 300 * time.Second
+)
+
+const circuitBreakerOpened = "dispatcher-circuit-breaker-opened"
+
+// errCircuitOpen is returned by sendToAnalyzer() for the batches that are not
+// sent because the circuit breaker is open.
+var errCircuitOpen = grpc.Errorf(codes.Unavailable, "Not sending to the Analyzer while the circuit breaker is open")
+
+// retryPolicy is an AnalyzerRetryPolicy with the defaults applied.
+type retryPolicy struct {
+	maxAttempts       int
+	initialBackoff    time.Duration
+	backoffMultiplier float64
+	maxBackoff        time.Duration
+	jitter            float64
+
+	// Returns a random number in [0.0, 1.0). Replaced in tests.
+	random func() float64
+}
+
+// newRetryPolicy returns the retryPolicy specified by |p|, which may be nil.
+func newRetryPolicy(p *shuffler.AnalyzerRetryPolicy) *retryPolicy {
+	r := &retryPolicy{
+		maxAttempts:       defaultMaxAttempts,
+		initialBackoff:    defaultInitialBackoff,
+		backoffMultiplier: defaultBackoffMultiplier,
+		maxBackoff:        defaultMaxBackoff,
+		jitter:            float64(p.GetJitter()),
+		random:            rand.Float64,
+	}
+	if p.GetMaxAttempts() > 0 {
+		r.maxAttempts = int(p.GetMaxAttempts())
+	}
+	if p.GetInitialBackoffMs() > 0 {
+		r.initialBackoff = time.Duration(p.GetInitialBackoffMs()) * time.Millisecond
+	}
+	if p.GetBackoffMultiplier() > 0 {
+		r.backoffMultiplier = float64(p.GetBackoffMultiplier())
+	}
+	if p.GetMaxBackoffMs() > 0 {
+		r.maxBackoff = time.Duration(p.GetMaxBackoffMs()) * time.Millisecond
+	}
+	return r
+}
+
+// backoff returns the delay before the attempt following the failed attempt
+// number |attempt|, counted from 1. The delay grows exponentially up to
+// |maxBackoff| and is then reduced by a random fraction of at most |jitter|.
+func (r *retryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(r.initialBackoff)
+	for i := 1; i < attempt && delay < float64(r.maxBackoff); i++ {
+		delay *= r.backoffMultiplier
+	}
+	if delay > float64(r.maxBackoff) {
+		delay = float64(r.maxBackoff)
+	}
+	return time.Duration(delay * (1 - r.jitter*r.random()))
+}
+
+// circuitBreaker stops the sending of batches to the Analyzer after
+// |threshold| consecutive batches failed, for |cooldown|. It is then
+// half-open: a single batch is let through to probe the Analyzer, and the
+// circuit breaker closes if the probe succeeds and opens again otherwise.
+//
+// A nil circuitBreaker never stops the sending of batches. circuitBreaker is
+// thread-safe since it is shared by the dispatch workers.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	// The clock. Replaced in tests.
+	now func() time.Time
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// The number of consecutive batches that failed.
+	failures int
+
+	// If not zero, the circuit breaker is open until |openUntil|.
+	openUntil time.Time
+
+	// Whether a probe is in flight while the circuit breaker is half-open.
+	probing bool
+}
+
+// newCircuitBreaker returns the circuitBreaker specified by |p|, which may be
+// nil, or nil if the circuit breaker is disabled.
+func newCircuitBreaker(p *shuffler.AnalyzerRetryPolicy) *circuitBreaker {
+	if p.GetCircuitBreakerThreshold() == 0 {
+		return nil
+	}
+	b := &circuitBreaker{
+		threshold: int(p.GetCircuitBreakerThreshold()),
+		cooldown:  defaultCircuitBreakerCooldown,
+		now:       time.Now,
+	}
+	if p.GetCircuitBreakerCooldownSeconds() > 0 {
+		b.cooldown = time.Duration(p.GetCircuitBreakerCooldownSeconds()) * time.Second
+	}
+	return b
+}
+
+// isOpen returns true if no batch may be sent now, without claiming the probe
+// of a half-open circuit breaker.
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.now().Before(b.openUntil) || b.probing
+}
+
+// allow returns true if a batch may be sent now. Once the cool-down has
+// passed it returns true for a single probe until the outcome of the probe is
+// recorded.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records whether sending a batch that was allowed succeeded.
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		if !b.openUntil.IsZero() {
+			glog.Info("The Analyzer is reachable again, closing the circuit breaker.")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+		stackdriver.LogCountMetricf(circuitBreakerOpened, "%d consecutive batches could not be sent to the Analyzer, not sending for %v.",
+			b.failures, b.cooldown)
+	}
+	b.probing = false
+}
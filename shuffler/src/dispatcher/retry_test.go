@@ -0,0 +1,172 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+)
+
+// testRetryPolicy returns a retryPolicy that makes up to |maxAttempts|
+// attempts and sleeps for a millisecond between them.
+func testRetryPolicy(maxAttempts int) *retryPolicy {
+	return newRetryPolicy(&shuffler.AnalyzerRetryPolicy{
+		MaxAttempts:      uint32(maxAttempts),
+		InitialBackoffMs: 1,
+		MaxBackoffMs:     1,
+	})
+}
+
+// TestNewRetryPolicy checks that the defaults apply to the fields of an
+// AnalyzerRetryPolicy that are not set.
+func TestNewRetryPolicy(t *testing.T) {
+	r := newRetryPolicy(nil)
+	if r.maxAttempts != 4 || r.initialBackoff != 2500*time.Millisecond || r.backoffMultiplier != 2 ||
+		r.maxBackoff != time.Minute || r.jitter != 0 {
+		t.Errorf("Got %+v for the default policy", r)
+	}
+
+	r = newRetryPolicy(&shuffler.AnalyzerRetryPolicy{
+		MaxAttempts:       6,
+		InitialBackoffMs:  100,
+		BackoffMultiplier: 3,
+		MaxBackoffMs:      1000,
+		Jitter:            0.5,
+	})
+	if r.maxAttempts != 6 || r.initialBackoff != 100*time.Millisecond || r.backoffMultiplier != 3 ||
+		r.maxBackoff != time.Second || r.jitter != 0.5 {
+		t.Errorf("Got %+v for a custom policy", r)
+	}
+}
+
+// TestBackoff checks that the backoff grows exponentially up to the maximum
+// and that the jitter shortens it by at most the configured fraction.
+func TestBackoff(t *testing.T) {
+	r := newRetryPolicy(&shuffler.AnalyzerRetryPolicy{
+		InitialBackoffMs:  100,
+		BackoffMultiplier: 3,
+		MaxBackoffMs:      1000,
+	})
+	for attempt, expected := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  300 * time.Millisecond,
+		3:  900 * time.Millisecond,
+		4:  time.Second,
+		50: time.Second,
+	} {
+		if got := r.backoff(attempt); got != expected {
+			t.Errorf("backoff(%d)=%v, expected %v", attempt, got, expected)
+		}
+	}
+
+	r.jitter = 0.5
+	r.random = func() float64 { return 0.5 }
+	if got := r.backoff(2); got != 225*time.Millisecond {
+		t.Errorf("backoff(2)=%v with jitter, expected %v", got, 225*time.Millisecond)
+	}
+	r.random = func() float64 { return 0 }
+	if got := r.backoff(2); got != 300*time.Millisecond {
+		t.Errorf("backoff(2)=%v with jitter, expected %v", got, 300*time.Millisecond)
+	}
+}
+
+// TestCircuitBreaker checks that the circuit breaker opens after the
+// threshold of consecutive failures, lets a single probe through after the
+// cool-down and closes again once a probe succeeds.
+func TestCircuitBreaker(t *testing.T) {
+	if newCircuitBreaker(nil) != nil || newCircuitBreaker(&shuffler.AnalyzerRetryPolicy{}) != nil {
+		t.Errorf("Expected no circuit breaker if the threshold is not set")
+	}
+
+	b := newCircuitBreaker(&shuffler.AnalyzerRetryPolicy{CircuitBreakerThreshold: 2, CircuitBreakerCooldownSeconds: 60})
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+
+	// A success resets the count of consecutive failures.
+	for _, success := range []bool{false, true, false} {
+		if !b.allow() {
+			t.Fatalf("Expected the circuit breaker to be closed")
+		}
+		b.record(success)
+	}
+	if !b.allow() {
+		t.Fatalf("Expected the circuit breaker to be closed")
+	}
+	b.record(false)
+	if !b.isOpen() || b.allow() {
+		t.Fatalf("Expected the circuit breaker to be open after 2 consecutive failures")
+	}
+
+	// After the cool-down only a single probe is let through, and the
+	// circuit breaker opens again if it fails.
+	now = now.Add(time.Minute)
+	if b.isOpen() || !b.allow() {
+		t.Fatalf("Expected a probe after the cool-down")
+	}
+	if !b.isOpen() || b.allow() {
+		t.Errorf("Expected a single probe")
+	}
+	b.record(false)
+	now = now.Add(59 * time.Second)
+	if b.allow() {
+		t.Fatalf("Expected the circuit breaker to open again after a failed probe")
+	}
+
+	now = now.Add(time.Second)
+	if !b.allow() {
+		t.Fatalf("Expected a probe after the cool-down")
+	}
+	b.record(true)
+	if b.isOpen() || !b.allow() || !b.allow() {
+		t.Errorf("Expected the circuit breaker to close after a successful probe")
+	}
+}
+
+// TestSendToAnalyzerCircuitBreaker checks that sendToAnalyzer() records its
+// outcomes in the circuit breaker and does not send while it is open.
+func TestSendToAnalyzerCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(&shuffler.AnalyzerRetryPolicy{CircuitBreakerThreshold: 2})
+	batch := cobalt.ObservationBatch{}
+	stats := newSendStats()
+
+	// A batch rejected by the Analyzer does not count towards the threshold.
+	transport := makeFakeAnalyzerTransport([]codes.Code{codes.InvalidArgument})
+	if err := sendToAnalyzer(&transport, &batch, testRetryPolicy(2), b, stats); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v, expected %v", err, codes.InvalidArgument)
+	}
+	for i := 0; i < 2; i++ {
+		transport = makeFakeAnalyzerTransport([]codes.Code{codes.Unavailable, codes.Unavailable})
+		if err := sendToAnalyzer(&transport, &batch, testRetryPolicy(2), b, stats); grpc.Code(err) != codes.Unavailable {
+			t.Errorf("Got %v, expected %v", err, codes.Unavailable)
+		}
+		expectCounts(2, 0, 0, &transport, t)
+	}
+
+	transport = makeFakeAnalyzerTransport(nil)
+	if err := sendToAnalyzer(&transport, &batch, testRetryPolicy(2), b, stats); err != errCircuitOpen {
+		t.Errorf("Got %v, expected %v", err, errCircuitOpen)
+	}
+	expectCounts(0, 0, 0, &transport, t)
+
+	if stats.attempts != 5 || stats.failed != 3 || stats.rejected != 1 {
+		t.Errorf("Got attempts=%d failed=%d rejected=%d, expected 5, 3, 1", stats.attempts, stats.failed, stats.rejected)
+	}
+}
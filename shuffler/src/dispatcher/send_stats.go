@@ -0,0 +1,108 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"sort"
+
+	"google.golang.org/grpc/codes"
+
+	"util/stackdriver"
+)
+
+const (
+	sendAttempts   = "dispatcher-send-attempts"
+	sendRetries    = "dispatcher-send-retries"
+	sendReconnects = "dispatcher-send-reconnects"
+	sendSucceeded  = "dispatcher-send-succeeded"
+	sendFailed     = "dispatcher-send-failed"
+	sendRejected   = "dispatcher-send-rejected"
+	bucketsSkipped = "dispatcher-buckets-skipped"
+)
+
+// sendStats counts the outcomes of the invocations of sendToAnalyzer() during
+// one dispatch cycle. It lets us quantify how often sends are retried and how
+// often the reconnect workaround for CB-132 fires.
+//
+// sendStats is not thread-safe. Each dispatch worker counts its sends in its
+// own sendStats, which are added up at the end of the dispatch cycle.
+type sendStats struct {
+	// The number of invocations of send() on the AnalyzerTransport.
+	attempts int
+
+	// The number of retries, keyed by the gRPC status code of the failed
+	// attempt that caused them.
+	retries map[codes.Code]int
+
+	// The number of times the connection to the Analyzer was re-established.
+	reconnects int
+
+	// The number of ObservationBatches that were eventually sent successfully
+	// and the number that were given up on.
+	succeeded int
+	failed    int
+
+	// The number of ObservationBatches that were not sent and the number of
+	// buckets that were not dispatched because the circuit breaker was open.
+	rejected int
+	skipped  int
+}
+
+// newSendStats returns a sendStats with all counts set to zero.
+func newSendStats() *sendStats {
+	return &sendStats{
+		retries: make(map[codes.Code]int),
+	}
+}
+
+// add adds the counts in |o| to those in |s|.
+func (s *sendStats) add(o *sendStats) {
+	s.attempts += o.attempts
+	for code, n := range o.retries {
+		s.retries[code] += n
+	}
+	s.reconnects += o.reconnects
+	s.succeeded += o.succeeded
+	s.failed += o.failed
+	s.rejected += o.rejected
+	s.skipped += o.skipped
+}
+
+// log writes the counts in |s| as Stackdriver metrics. Nothing is logged if no
+// sends were attempted or avoided.
+func (s *sendStats) log() {
+	if s.attempts == 0 && s.rejected == 0 && s.skipped == 0 {
+		return
+	}
+	stackdriver.LogIntStackdriverMetricf(sendAttempts, s.attempts, "Send attempts in this dispatch cycle: %d", s.attempts)
+
+	retryCodes := make([]int, 0, len(s.retries))
+	for code := range s.retries {
+		retryCodes = append(retryCodes, int(code))
+	}
+	sort.Ints(retryCodes)
+	for _, code := range retryCodes {
+		n := s.retries[codes.Code(code)]
+		stackdriver.LogIntStackdriverMetricf(sendRetries, n, "Retries after %v in this dispatch cycle: %d", codes.Code(code), n)
+	}
+
+	stackdriver.LogIntStackdriverMetricf(sendReconnects, s.reconnects, "Reconnects in this dispatch cycle: %d", s.reconnects)
+	stackdriver.LogIntStackdriverMetricf(sendSucceeded, s.succeeded, "Batches sent in this dispatch cycle: %d", s.succeeded)
+	stackdriver.LogIntStackdriverMetricf(sendFailed, s.failed, "Batches failed in this dispatch cycle: %d", s.failed)
+	if s.rejected > 0 || s.skipped > 0 {
+		stackdriver.LogIntStackdriverMetricf(sendRejected, s.rejected, "Batches not sent due to the circuit breaker in this dispatch cycle: %d", s.rejected)
+		stackdriver.LogIntStackdriverMetricf(bucketsSkipped, s.skipped, "Buckets skipped due to the circuit breaker in this dispatch cycle: %d", s.skipped)
+	}
+}
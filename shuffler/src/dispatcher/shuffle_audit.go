@@ -0,0 +1,113 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"cobalt"
+	"shuffler"
+	"util/stackdriver"
+)
+
+const (
+	shuffleAuditFailed = "dispatcher-shuffle-audit-failed"
+)
+
+// shuffleAudit writes a transcript of the order in which the Dispatcher sends
+// Observations to the Analyzer. This lets an auditor verify that shuffling
+// breaks the arrival order of the Observations.
+//
+// The transcript contains a header line starting with '#' for each dispatch of
+// a bucket, followed by one line per Observation sent, in the order sent. Each
+// of those lines holds the hex encoded HMAC-SHA256 of the ciphertext of the
+// Observation under the audit key. Only a party that knows the audit key and
+// the ciphertexts it submitted, such as a test, can find its Observations in
+// the transcript and compare their order with the order in which it submitted
+// them. The hashes are deterministic so that the same ciphertext always has
+// the same entry.
+type shuffleAudit struct {
+	key []byte
+
+	// mu serializes the writes to |w|.
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newShuffleAudit returns a shuffleAudit that writes the transcript to |w|
+// using the HMAC key |key|.
+func newShuffleAudit(key []byte, w io.Writer) *shuffleAudit {
+	if len(key) == 0 {
+		panic("key is empty")
+	}
+	if w == nil {
+		panic("w is nil")
+	}
+	return &shuffleAudit{key: key, w: w}
+}
+
+// shuffleAuditHash returns the hex encoded HMAC-SHA256 of |ciphertext| under
+// |key|.
+func shuffleAuditHash(key []byte, ciphertext []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ciphertext)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A bucketAudit collects the transcript of a single dispatch of a bucket. The
+// transcript is written by finish() in a single write so that the transcripts
+// of buckets that are dispatched concurrently are not interleaved.
+type bucketAudit struct {
+	audit *shuffleAudit
+	lines []byte
+}
+
+// startBucket returns the bucketAudit for a dispatch of the bucket for |key|,
+// starting with its header line.
+func (a *shuffleAudit) startBucket(key *cobalt.ObservationMetadata, dispatchTimeSeconds int64) *bucketAudit {
+	return &bucketAudit{
+		audit: a,
+		lines: []byte(fmt.Sprintf("# %d/%d/%d %d %d\n",
+			key.CustomerId, key.ProjectId, key.MetricId, key.DayIndex, dispatchTimeSeconds)),
+	}
+}
+
+// recordSent adds a line for each of |obVals|, which have just been sent in
+// that order.
+func (b *bucketAudit) recordSent(obVals []*shuffler.ObservationVal) {
+	for _, obVal := range obVals {
+		b.lines = append(b.lines, shuffleAuditHash(b.audit.key, obVal.GetEncryptedObservation().GetCiphertext())...)
+		b.lines = append(b.lines, '\n')
+	}
+}
+
+// finish writes the transcript of the dispatch.
+func (b *bucketAudit) finish() {
+	b.audit.write(string(b.lines))
+}
+
+func (a *shuffleAudit) write(s string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := io.WriteString(a.w, s); err != nil {
+		stackdriver.LogCountMetricf(shuffleAuditFailed, "Unable to write the shuffle audit transcript: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"cobalt"
+	"storage"
+)
+
+// kendallTau returns Kendall's rank correlation coefficient between the
+// positions of |ranks| and their values. It is 1 if |ranks| is sorted, -1 if
+// it is sorted in reverse and close to 0 if it is a random permutation.
+func kendallTau(ranks []int) float64 {
+	concordant, discordant := 0, 0
+	for i := 0; i < len(ranks); i++ {
+		for j := i + 1; j < len(ranks); j++ {
+			if ranks[i] < ranks[j] {
+				concordant++
+			} else {
+				discordant++
+			}
+		}
+	}
+	n := len(ranks)
+	return float64(concordant-discordant) / float64(n*(n-1)/2)
+}
+
+// doTestShuffleAudit adds Observations to a single bucket one at a time,
+// dispatches the bucket with the shuffle audit enabled and verifies, using the
+// transcript, that the dispatch order is not correlated with the arrival
+// order.
+func doTestShuffleAudit(t *testing.T, useMemStore bool) {
+	const num = 200
+	var store storage.Store
+	var err error
+	if useMemStore {
+		store = storage.NewMemStore()
+	} else {
+		if store, err = storage.NewLevelDBStore("/tmp/dispatcher_audit_db"); err != nil {
+			t.Fatalf("got error [%v] in test store setup", err)
+		}
+	}
+	defer storage.ResetStoreForTesting(store, true)
+
+	auditKey := []byte("audit-key")
+	key := storage.NewObservationMetaData(23)
+	arrivalIndex := make(map[string]int)
+	for i := 0; i < num; i++ {
+		ciphertext := []byte(fmt.Sprintf("observation-%d", i))
+		arrivalIndex[shuffleAuditHash(auditKey, ciphertext)] = i
+		batch := &cobalt.ObservationBatch{
+			MetaData:             key,
+			EncryptedObservation: []*cobalt.EncryptedMessage{&cobalt.EncryptedMessage{Ciphertext: ciphertext}},
+		}
+		if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch}, storage.Arrival{DayIndex: 10}); err != nil {
+			t.Fatalf("AddAllObservations() failed: %v", err)
+		}
+	}
+
+	d := newTestDispatcher(store, 50, 0)
+	var transcript bytes.Buffer
+	d.EnableShuffleAudit(auditKey, &transcript)
+	if err := d.dispatchBucket(key, false, 1*time.Millisecond, newSendStats()); err != nil {
+		t.Fatalf("dispatchBucket() failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(transcript.String(), "\n"), "\n")
+	if len(lines) != num+1 || !strings.HasPrefix(lines[0], "# 23/23/23 ") {
+		t.Fatalf("got transcript [%v], expected a bucket header and %d entries", transcript.String(), num)
+	}
+	var ranks []int
+	for _, line := range lines[1:] {
+		i, ok := arrivalIndex[line]
+		if !ok {
+			t.Fatalf("got unknown transcript entry [%v]", line)
+		}
+		delete(arrivalIndex, line)
+		ranks = append(ranks, i)
+	}
+
+	// For a random permutation of 200 elements the standard deviation of
+	// Kendall's tau is about 0.05.
+	if tau := kendallTau(ranks); math.Abs(tau) > 0.25 {
+		t.Errorf("got Kendall's tau [%v] between the arrival and the dispatch order, expected the order to be shuffled", tau)
+	}
+}
+
+func TestShuffleAuditForMemStore(t *testing.T) {
+	doTestShuffleAudit(t, true)
+}
+
+func TestShuffleAuditForLevelDBStore(t *testing.T) {
+	doTestShuffleAudit(t, false)
+}
+
+func TestKendallTau(t *testing.T) {
+	if tau := kendallTau([]int{0, 1, 2, 3}); tau != 1 {
+		t.Errorf("got %v, expected 1", tau)
+	}
+	if tau := kendallTau([]int{3, 2, 1, 0}); tau != -1 {
+		t.Errorf("got %v, expected -1", tau)
+	}
+}
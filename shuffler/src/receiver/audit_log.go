@@ -0,0 +1,216 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cobalt"
+)
+
+const auditLogFilePrefix = "ingestion_audit_"
+
+// auditRecord is the entry written to the audit log for each incoming
+// Envelope. It deliberately contains only aggregate information about what
+// was ingested: it must never contain ciphertexts, Observation contents,
+// SystemProfiles or anything that identifies the sender.
+type auditRecord struct {
+	// The arrival time of the Envelope in RFC 3339 format, with a precision of
+	// one second.
+	ArrivalTime string `json:"arrival_time"`
+
+	// "OK" if the Envelope was successfully decrypted, otherwise a short
+	// description of the failure.
+	DecryptResult string `json:"decrypt_result"`
+
+	// The size in bytes of the serialized EncryptedMessage.
+	SizeBytes int `json:"size_bytes"`
+
+	NumBatches      int `json:"num_batches"`
+	NumObservations int `json:"num_observations"`
+
+	// One entry per ObservationBatch in the Envelope.
+	Batches []auditBatch `json:"batches,omitempty"`
+}
+
+// auditBatch describes a single ObservationBatch within an Envelope.
+type auditBatch struct {
+	CustomerId      uint32 `json:"customer_id"`
+	ProjectId       uint32 `json:"project_id"`
+	MetricId        uint32 `json:"metric_id"`
+	NumObservations int    `json:"num_observations"`
+}
+
+// newAuditRecord returns the auditRecord for an EncryptedMessage of size
+// |sizeBytes| that arrived at |arrivalTime|. If |decryptErr| is nil then
+// |envelope| is the result of decrypting it.
+func newAuditRecord(arrivalTime time.Time, sizeBytes int, envelope *cobalt.Envelope, decryptErr error) *auditRecord {
+	record := &auditRecord{
+		ArrivalTime:   arrivalTime.UTC().Truncate(time.Second).Format(time.RFC3339),
+		DecryptResult: "OK",
+		SizeBytes:     sizeBytes,
+	}
+	if decryptErr != nil {
+		record.DecryptResult = fmt.Sprintf("decryption failed: %v", decryptErr)
+		return record
+	}
+
+	for _, batch := range envelope.GetBatch() {
+		numObservations := len(batch.GetEncryptedObservation())
+		record.NumBatches++
+		record.NumObservations += numObservations
+		record.Batches = append(record.Batches, auditBatch{
+			CustomerId:      batch.GetMetaData().GetCustomerId(),
+			ProjectId:       batch.GetMetaData().GetProjectId(),
+			MetricId:        batch.GetMetaData().GetMetricId(),
+			NumObservations: numObservations,
+		})
+	}
+	return record
+}
+
+// auditLog is an append-only log of auditRecords, one JSON object per line,
+// stored in rotating files in a directory. A new file is started once the
+// current one reaches |maxFileSize| bytes. If |maxFiles| is positive the
+// oldest files are deleted so that at most |maxFiles| files are kept.
+type auditLog struct {
+	dir         string
+	maxFileSize int64
+	maxFiles    int
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	file     *os.File
+	fileSize int64
+	// The number of files created by this process. Used to make the file names
+	// unique.
+	numFiles int
+}
+
+// newAuditLog returns an auditLog that writes to files in |dir|, creating
+// |dir| if necessary.
+func newAuditLog(dir string, maxFileSize int64, maxFiles int) (*auditLog, error) {
+	if maxFileSize <= 0 {
+		return nil, fmt.Errorf("maxFileSize must be positive.")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+	}, nil
+}
+
+// write appends |record| to the log.
+func (l *auditLog) write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil || l.fileSize+int64(len(line)) > l.maxFileSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.fileSize += int64(n)
+	return err
+}
+
+// rotate closes the current file, if any, opens a new one and deletes old
+// files. Must be invoked with |mu| held.
+func (l *auditLog) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	// File names sort in creation order.
+	l.numFiles++
+	name := fmt.Sprintf("%s%s_%06d.log", auditLogFilePrefix, time.Now().UTC().Format("20060102T150405Z"), l.numFiles)
+	file, err := os.OpenFile(filepath.Join(l.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.fileSize = 0
+
+	return l.deleteOldFiles()
+}
+
+// deleteOldFiles deletes the oldest audit log files in |dir| so that at most
+// |maxFiles| remain. Must be invoked with |mu| held.
+func (l *auditLog) deleteOldFiles() error {
+	if l.maxFiles <= 0 {
+		return nil
+	}
+	names, err := l.fileNames()
+	if err != nil {
+		return err
+	}
+	for len(names) > l.maxFiles {
+		if err := os.Remove(filepath.Join(l.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// fileNames returns the names of the audit log files in |dir|, oldest first.
+func (l *auditLog) fileNames() ([]string, error) {
+	d, err := os.Open(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	all, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range all {
+		if strings.HasPrefix(name, auditLogFilePrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// close closes the current file.
+func (l *auditLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
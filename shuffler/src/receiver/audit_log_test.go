@@ -0,0 +1,175 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	shufflerpb "cobalt"
+	"storage"
+	"util"
+)
+
+// readAuditRecords returns all of the records in the audit log files in |dir|,
+// oldest first.
+func readAuditRecords(t *testing.T, l *auditLog) []auditRecord {
+	names, err := l.fileNames()
+	if err != nil {
+		t.Fatalf("fileNames() failed: %v", err)
+	}
+	var records []auditRecord
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(l.dir, name))
+		if err != nil {
+			t.Fatalf("Open() failed: %v", err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("Unable to parse audit record [%s]: %v", scanner.Text(), err)
+			}
+			records = append(records, record)
+		}
+		f.Close()
+	}
+	return records
+}
+
+func makeTestAuditLog(t *testing.T, maxFileSize int64, maxFiles int) *auditLog {
+	dir, err := ioutil.TempDir("", "receiver_audit_log")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	l, err := newAuditLog(dir, maxFileSize, maxFiles)
+	if err != nil {
+		t.Fatalf("newAuditLog() failed: %v", err)
+	}
+	return l
+}
+
+// Tests that Process() writes an audit record for each Envelope and that the
+// records do not contain the ciphertexts.
+func TestProcessWritesAuditLog(t *testing.T) {
+	l := makeTestAuditLog(t, 1024*1024, 0)
+	defer os.RemoveAll(l.dir)
+	defer l.close()
+
+	shuffler := &ShufflerServer{
+		store:     storage.NewMemStore(),
+		decrypter: util.NewMessageDecrypter(""),
+		auditLog:  l,
+	}
+
+	envelope := makeEnvelope(3, 4).envelope
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	eMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+	if _, err := shuffler.Process(context.Background(), eMsg); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+
+	// An EncryptedMessage that cannot be decrypted.
+	badMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: []byte("not an envelope"),
+		Scheme:     shufflerpb.EncryptedMessage_HYBRID_ECDH_V1,
+	}
+	if _, err := shuffler.Process(context.Background(), badMsg); err == nil {
+		t.Fatalf("Process() succeeded for an invalid EncryptedMessage")
+	}
+
+	records := readAuditRecords(t, l)
+	if len(records) != 2 {
+		t.Fatalf("got %d audit records, expected 2", len(records))
+	}
+
+	r := records[0]
+	if r.DecryptResult != "OK" || r.NumBatches != 3 || r.NumObservations != 12 || r.SizeBytes != proto.Size(eMsg) {
+		t.Errorf("unexpected audit record: %+v", r)
+	}
+	for i, b := range r.Batches {
+		metadata := envelope.Batch[i].MetaData
+		if b.CustomerId != metadata.CustomerId || b.ProjectId != metadata.ProjectId ||
+			b.MetricId != metadata.MetricId || b.NumObservations != 4 {
+			t.Errorf("unexpected audit batch %d: %+v", i, b)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, r.ArrivalTime); err != nil {
+		t.Errorf("unexpected arrival time [%s]: %v", r.ArrivalTime, err)
+	}
+
+	if r := records[1]; r.DecryptResult == "OK" || r.NumBatches != 0 || len(r.Batches) != 0 {
+		t.Errorf("unexpected audit record: %+v", r)
+	}
+
+	// No ciphertext may be present in the log.
+	names, _ := l.fileNames()
+	contents, err := ioutil.ReadFile(filepath.Join(l.dir, names[0]))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	for _, batch := range envelope.Batch {
+		for _, o := range batch.EncryptedObservation {
+			if strings.Contains(string(contents), fmt.Sprintf("%x", o.Ciphertext)) ||
+				strings.Contains(string(contents), string(o.Ciphertext)) {
+				t.Errorf("the audit log contains a ciphertext")
+			}
+		}
+	}
+}
+
+// Tests that the audit log rotates files and deletes the oldest ones.
+func TestAuditLogRotation(t *testing.T) {
+	record := newAuditRecord(time.Now(), 10, &shufflerpb.Envelope{}, nil)
+	line, _ := json.Marshal(record)
+	// Each file holds two records.
+	l := makeTestAuditLog(t, int64(2*(len(line)+1)), 3)
+	defer os.RemoveAll(l.dir)
+	defer l.close()
+
+	for i := 0; i < 9; i++ {
+		if err := l.write(record); err != nil {
+			t.Fatalf("write() failed: %v", err)
+		}
+	}
+
+	names, err := l.fileNames()
+	if err != nil {
+		t.Fatalf("fileNames() failed: %v", err)
+	}
+	if len(names) != 3 {
+		t.Errorf("got files %v, expected 3 files", names)
+	}
+	// The 9 records were written to 5 files of which the last 3 remain.
+	if records := readAuditRecords(t, l); len(records) != 5 {
+		t.Errorf("got %d records, expected 5", len(records))
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"storage"
+	"util/stackdriver"
+)
+
+const (
+	measureBacklogFailed = "reciever-measure-backlog-failed"
+
+	// The key of the trailer in which the number of seconds after which an
+	// Encoder should retry a throttled request is returned.
+	retryAfterKey = "retry-after"
+)
+
+// BackpressureConfig specifies when Backpressure throttles ingestion. A
+// watermark that is not positive is ignored.
+type BackpressureConfig struct {
+	// Ingestion is throttled once the store holds at least |MaxObservations|
+	// Observations and resumes once it holds fewer than |ResumeObservations|.
+	MaxObservations    int64
+	ResumeObservations int64
+	// Ingestion is throttled once the files in |Dirs| take up at least
+	// |MaxDiskBytes| bytes and resumes once they take up fewer than
+	// |ResumeDiskBytes| bytes.
+	Dirs            []string
+	MaxDiskBytes    int64
+	ResumeDiskBytes int64
+	// The backlog is measured this often.
+	PollInterval time.Duration
+	// Returned to throttled Encoders as the time after which they should retry.
+	RetryAfter time.Duration
+}
+
+// Backpressure throttles ingestion while the backlog of Observations in the
+// store is too large, for example because the Analyzer is unavailable and the
+// dispatcher cannot drain the store. While ingestion is throttled, incoming
+// Envelopes are rejected with Unavailable so that Encoders keep their
+// Observations and retry later, instead of the Shuffler running out of disk.
+//
+// The backlog is measured periodically once Start() is invoked. Ingestion is throttled as
+// soon as any high watermark is reached and resumes only once the backlog is
+// below all low watermarks, so that the Shuffler does not flip between the
+// two states.
+type Backpressure struct {
+	config BackpressureConfig
+	store  storage.Store
+
+	// mu protects |throttled|.
+	mu        sync.RWMutex
+	throttled bool
+
+	// The number of Envelopes rejected while ingestion was throttled.
+	// Accessed atomically.
+	numThrottled uint64
+
+	// |stop| is closed by Stop() to make the goroutine started by Start()
+	// return, and |running| waits for it.
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+}
+
+// NewBackpressure returns a Backpressure that measures the backlog of |store|
+// as specified by |config|. The low watermarks must not be larger than the
+// corresponding high watermarks.
+func NewBackpressure(config BackpressureConfig, store storage.Store) *Backpressure {
+	if store == nil {
+		panic("store is nil")
+	}
+	if config.ResumeObservations > config.MaxObservations || config.ResumeDiskBytes > config.MaxDiskBytes {
+		panic("a low watermark is larger than its high watermark")
+	}
+
+	return &Backpressure{
+		config: config,
+		store:  store,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start starts measuring the backlog once every |PollInterval| in a new
+// goroutine, until Stop() is invoked.
+func (b *Backpressure) Start() {
+	b.running.Add(1)
+	go func() {
+		defer b.running.Done()
+		for {
+			b.update()
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(b.config.PollInterval):
+			}
+		}
+	}()
+}
+
+// Stop stops measuring the backlog and waits until the store is no longer
+// used, so that it can be closed. Stop returns immediately if Start() has not
+// been invoked.
+func (b *Backpressure) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	b.running.Wait()
+}
+
+// update measures the backlog and throttles or resumes ingestion accordingly.
+// If the backlog cannot be measured the current state is kept.
+func (b *Backpressure) update() {
+	numObservations, err := b.countObservations()
+	if err != nil {
+		stackdriver.LogCountMetricf(measureBacklogFailed, "Unable to count the Observations in the store: %v", err)
+		return
+	}
+	diskBytes, err := b.diskUsage()
+	if err != nil {
+		stackdriver.LogCountMetricf(measureBacklogFailed, "Unable to measure the disk usage of the store: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.throttled {
+		if reached(numObservations, b.config.MaxObservations) || reached(diskBytes, b.config.MaxDiskBytes) {
+			glog.Warningf("Throttling ingestion: the store holds %d Observations in %d bytes.", numObservations, diskBytes)
+			b.throttled = true
+		}
+		return
+	}
+	if !reached(numObservations, b.config.ResumeObservations) && !reached(diskBytes, b.config.ResumeDiskBytes) {
+		glog.Infof("Resuming ingestion: the store holds %d Observations in %d bytes.", numObservations, diskBytes)
+		b.throttled = false
+	}
+}
+
+// reached returns true if |watermark| is positive and |value| is at least
+// |watermark|.
+func reached(value int64, watermark int64) bool {
+	return watermark > 0 && value >= watermark
+}
+
+// countObservations returns the number of Observations in the store, or 0 if
+// there is no watermark on the number of Observations.
+func (b *Backpressure) countObservations() (int64, error) {
+	if b.config.MaxObservations <= 0 {
+		return 0, nil
+	}
+	return b.store.GetTotalNumObservations()
+}
+
+// diskUsage returns the total size of the files in |Dirs|, or 0 if there is
+// no watermark on the disk usage.
+func (b *Backpressure) diskUsage() (int64, error) {
+	if b.config.MaxDiskBytes <= 0 {
+		return 0, nil
+	}
+
+	var total int64
+	for _, dir := range b.config.Dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Files are removed concurrently by compactions.
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// A trailerSetter sets the trailer of an RPC. grpc.ServerStream is a
+// trailerSetter for streaming RPCs and unaryTrailer for unary RPCs.
+type trailerSetter interface {
+	SetTrailer(metadata.MD)
+}
+
+// unaryTrailer is the trailerSetter of the unary RPC with the context |ctx|.
+type unaryTrailer struct {
+	ctx context.Context
+}
+
+func (u unaryTrailer) SetTrailer(md metadata.MD) {
+	if err := grpc.SetTrailer(u.ctx, md); err != nil {
+		glog.V(4).Infof("Unable to set the trailer: %v", err)
+	}
+}
+
+// check returns an Unavailable error if ingestion is throttled and sets the
+// retry-after trailer of the RPC to |RetryAfter| with |trailer|. Otherwise it
+// returns nil.
+func (b *Backpressure) check(trailer trailerSetter) error {
+	b.mu.RLock()
+	throttled := b.throttled
+	b.mu.RUnlock()
+	if !throttled {
+		return nil
+	}
+
+	atomic.AddUint64(&b.numThrottled, 1)
+	retryAfter := strconv.Itoa(int(b.config.RetryAfter.Seconds()))
+	trailer.SetTrailer(metadata.Pairs(retryAfterKey, retryAfter))
+	return grpc.Errorf(codes.Unavailable, "The Shuffler is throttling ingestion, retry after %s seconds.", retryAfter)
+}
+
+// NumThrottledEnvelopes returns the number of Envelopes that have been
+// rejected while ingestion was throttled.
+func (b *Backpressure) NumThrottledEnvelopes() uint64 {
+	return atomic.LoadUint64(&b.numThrottled)
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	shufflerpb "cobalt"
+	"storage"
+	"util"
+)
+
+// addObservations adds |num| Observations to a single bucket of |store|.
+func addObservations(t *testing.T, store storage.Store, num int) {
+	batch := storage.NewObservationBatchForMetadata(storage.NewObservationMetaData(1), num)
+	if err := store.AddAllObservations([]*shufflerpb.ObservationBatch{batch}, storage.NewArrival(time.Now(), "")); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+}
+
+// Tests that Backpressure throttles ingestion at the high watermark on the
+// number of Observations and resumes only below the low watermark.
+func TestBackpressureObservations(t *testing.T) {
+	store := storage.NewMemStore()
+	b := NewBackpressure(BackpressureConfig{
+		MaxObservations:    10,
+		ResumeObservations: 5,
+		RetryAfter:         time.Minute,
+	}, store)
+
+	addObservations(t, store, 9)
+	b.update()
+	if err := b.check(unaryTrailer{context.Background()}); err != nil {
+		t.Errorf("ingestion is throttled below the high watermark: %v", err)
+	}
+
+	addObservations(t, store, 1)
+	b.update()
+	if err := b.check(unaryTrailer{context.Background()}); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("got error [%v] at the high watermark, expected Unavailable", err)
+	}
+
+	// Ingestion stays throttled until the backlog is below the low watermark.
+	storage.ResetStoreForTesting(store, false)
+	addObservations(t, store, 5)
+	b.update()
+	if err := b.check(unaryTrailer{context.Background()}); err == nil {
+		t.Errorf("ingestion resumed at the low watermark")
+	}
+	storage.ResetStoreForTesting(store, false)
+	addObservations(t, store, 4)
+	b.update()
+	if err := b.check(unaryTrailer{context.Background()}); err != nil {
+		t.Errorf("ingestion is throttled below the low watermark: %v", err)
+	}
+
+	if n := b.NumThrottledEnvelopes(); n != 2 {
+		t.Errorf("got %d throttled envelopes, expected 2", n)
+	}
+}
+
+// countingStore is a Store that counts the invocations of
+// GetTotalNumObservations().
+type countingStore struct {
+	storage.Store
+	numCounts int32
+}
+
+func (s *countingStore) GetTotalNumObservations() (int64, error) {
+	atomic.AddInt32(&s.numCounts, 1)
+	return s.Store.GetTotalNumObservations()
+}
+
+// Tests that the backlog is measured periodically once Backpressure is
+// started, and that the store is no longer used once it is stopped.
+func TestBackpressureStartAndStop(t *testing.T) {
+	store := &countingStore{Store: storage.NewMemStore()}
+	b := NewBackpressure(BackpressureConfig{MaxObservations: 10, PollInterval: time.Millisecond}, store)
+	b.Start()
+	for atomic.LoadInt32(&store.numCounts) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Stop()
+
+	numCounts := atomic.LoadInt32(&store.numCounts)
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&store.numCounts); n != numCounts {
+		t.Errorf("the backlog was measured %d times after Stop(), expected none", n-numCounts)
+	}
+	// Stop() may be invoked again.
+	b.Stop()
+}
+
+// Tests that Backpressure throttles ingestion when the files in its
+// directories reach the high watermark on the disk usage.
+func TestBackpressureDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backpressure_test")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatalf("Mkdir() failed: %v", err)
+	}
+
+	b := NewBackpressure(BackpressureConfig{
+		Dirs:            []string{dir},
+		MaxDiskBytes:    100,
+		ResumeDiskBytes: 50,
+	}, storage.NewMemStore())
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, 60), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	b.update()
+	if err := b.check(unaryTrailer{context.Background()}); err != nil {
+		t.Errorf("ingestion is throttled below the high watermark: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 40), 0600); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	b.update()
+	if err := b.check(unaryTrailer{context.Background()}); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("got error [%v] at the high watermark, expected Unavailable", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "a")); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	b.update()
+	if err := b.check(unaryTrailer{context.Background()}); err != nil {
+		t.Errorf("ingestion is throttled below the low watermark: %v", err)
+	}
+}
+
+// Tests that Process() rejects Envelopes without storing them while ingestion
+// is throttled.
+func TestProcessWithBackpressure(t *testing.T) {
+	store := storage.NewMemStore()
+	b := NewBackpressure(BackpressureConfig{MaxObservations: 1}, store)
+	addObservations(t, store, 1)
+	b.update()
+
+	s := &ShufflerServer{
+		store:     store,
+		config:    ServerConfig{Backpressure: b},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	envelopeData := makeEnvelope(1, 5)
+	data, err := proto.Marshal(envelopeData.envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	if _, err := s.Process(context.Background(), &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("got error [%v], expected Unavailable", err)
+	}
+	storage.CheckNumObservations(t, store, &envelopeData.expectedBucketKeys[0], 0)
+}
+
+// Tests that ProcessStream() rejects a stream while ingestion is throttled and
+// sets the retry-after trailer of the stream.
+func TestProcessStreamWithBackpressure(t *testing.T) {
+	store := storage.NewMemStore()
+	b := NewBackpressure(BackpressureConfig{MaxObservations: 1, RetryAfter: time.Minute}, store)
+	addObservations(t, store, 1)
+	b.update()
+
+	s := &ShufflerServer{
+		store:     store,
+		config:    ServerConfig{Backpressure: b},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	stream := &fakeProcessStream{chunks: makeChunks(t, makeEnvelope(1, 5).envelope, 1000000)}
+	if err := s.ProcessStream(stream); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("got error [%v], expected Unavailable", err)
+	}
+	if got := stream.trailer[retryAfterKey]; len(got) != 1 || got[0] != "60" {
+		t.Errorf("got retry-after trailer %v, expected [60]", got)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"cobalt"
+	"shuffler"
+)
+
+// metricKey is the comparable form of a shuffler.MetricKey.
+type metricKey struct {
+	customerId uint32
+	projectId  uint32
+	metricId   uint32
+}
+
+func (k metricKey) toProto() *shuffler.MetricKey {
+	return &shuffler.MetricKey{
+		CustomerId: k.customerId,
+		ProjectId:  k.projectId,
+		MetricId:   k.metricId,
+	}
+}
+
+// MetricDenylist is a set of metrics for which the receiver discards incoming
+// Observations while counting them. It may be modified at runtime and is safe
+// for concurrent use.
+type MetricDenylist struct {
+	// mu protects the fields below.
+	mu      sync.RWMutex
+	metrics map[metricKey]bool
+	// The number of Observations dropped per metric. Counts are kept when a
+	// metric is removed from the denylist.
+	dropped map[metricKey]uint64
+}
+
+// NewMetricDenylist returns a MetricDenylist containing |metrics|.
+func NewMetricDenylist(metrics []*shuffler.MetricKey) *MetricDenylist {
+	d := &MetricDenylist{
+		dropped: make(map[metricKey]uint64),
+	}
+	d.Set(metrics)
+	return d
+}
+
+// Set replaces the contents of the denylist with |metrics|.
+func (d *MetricDenylist) Set(metrics []*shuffler.MetricKey) {
+	m := make(map[metricKey]bool)
+	for _, k := range metrics {
+		if k != nil {
+			m[metricKey{k.CustomerId, k.ProjectId, k.MetricId}] = true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metrics = m
+	glog.Infof("The metric denylist now contains %d metrics.", len(m))
+}
+
+// Get returns the contents of the denylist and the number of Observations
+// dropped so far, both sorted by metric.
+func (d *MetricDenylist) Get() *shuffler.MetricDenylist {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	result := &shuffler.MetricDenylist{}
+	for _, k := range sortedKeys(d.metrics) {
+		result.Metrics = append(result.Metrics, k.toProto())
+	}
+	dropped := make(map[metricKey]bool)
+	for k := range d.dropped {
+		dropped[k] = true
+	}
+	for _, k := range sortedKeys(dropped) {
+		result.Dropped = append(result.Dropped, &shuffler.DroppedObservationCount{
+			Metric:          k.toProto(),
+			NumObservations: d.dropped[k],
+		})
+	}
+	return result
+}
+
+// filter returns the elements of |batches| whose metric is not on the
+// denylist. The Observations in the other batches are counted.
+func (d *MetricDenylist) filter(batches []*cobalt.ObservationBatch) []*cobalt.ObservationBatch {
+	d.mu.RLock()
+	empty := len(d.metrics) == 0
+	d.mu.RUnlock()
+	if empty {
+		return batches
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var kept []*cobalt.ObservationBatch
+	for _, b := range batches {
+		m := b.GetMetaData()
+		k := metricKey{m.GetCustomerId(), m.GetProjectId(), m.GetMetricId()}
+		if d.metrics[k] {
+			d.dropped[k] += uint64(len(b.GetEncryptedObservation()))
+			glog.V(4).Infof("Dropped %d Observations for denylisted metric %v.", len(b.GetEncryptedObservation()), k)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	return kept
+}
+
+// sortedKeys returns the keys of |m| in ascending order.
+func sortedKeys(m map[metricKey]bool) []metricKey {
+	keys := make([]metricKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].customerId != keys[j].customerId {
+			return keys[i].customerId < keys[j].customerId
+		}
+		if keys[i].projectId != keys[j].projectId {
+			return keys[i].projectId < keys[j].projectId
+		}
+		return keys[i].metricId < keys[j].metricId
+	})
+	return keys
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	shufflerpb "cobalt"
+	"shuffler"
+	"storage"
+	"util"
+)
+
+// Tests that Process() drops and counts the Observations for metrics on the
+// denylist and stores the others.
+func TestProcessWithMetricDenylist(t *testing.T) {
+	envelopeData := makeEnvelope(3, 5)
+	envelope := envelopeData.envelope
+	// Deny the metric of the second batch.
+	denied := envelope.Batch[1].MetaData
+	denylist := NewMetricDenylist([]*shuffler.MetricKey{{
+		CustomerId: denied.CustomerId,
+		ProjectId:  denied.ProjectId,
+		MetricId:   denied.MetricId,
+	}})
+
+	store := storage.NewMemStore()
+	s := &ShufflerServer{
+		store:     store,
+		config:    ServerConfig{MetricDenylist: denylist},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	eMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+	if _, err := s.Process(context.Background(), eMsg); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+
+	for i := range envelope.Batch {
+		key := envelopeData.expectedBucketKeys[i]
+		expected := 5
+		if i == 1 {
+			expected = 0
+		}
+		storage.CheckNumObservations(t, store, &key, expected)
+	}
+
+	counts := denylist.Get().Dropped
+	if len(counts) != 1 || counts[0].NumObservations != 5 || counts[0].Metric.MetricId != denied.MetricId {
+		t.Errorf("unexpected dropped counts: %v", counts)
+	}
+
+	// An Envelope containing only denied Observations is accepted.
+	denylist.Set([]*shuffler.MetricKey{
+		{CustomerId: envelope.Batch[0].MetaData.CustomerId, ProjectId: envelope.Batch[0].MetaData.ProjectId, MetricId: envelope.Batch[0].MetaData.MetricId},
+		{CustomerId: envelope.Batch[1].MetaData.CustomerId, ProjectId: envelope.Batch[1].MetaData.ProjectId, MetricId: envelope.Batch[1].MetaData.MetricId},
+		{CustomerId: envelope.Batch[2].MetaData.CustomerId, ProjectId: envelope.Batch[2].MetaData.ProjectId, MetricId: envelope.Batch[2].MetaData.MetricId},
+	})
+	if _, err := s.Process(context.Background(), eMsg); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+	for i := range envelope.Batch {
+		key := envelopeData.expectedBucketKeys[i]
+		expected := 5
+		if i == 1 {
+			expected = 0
+		}
+		storage.CheckNumObservations(t, store, &key, expected)
+	}
+	if counts := denylist.Get().Dropped; len(counts) != 3 {
+		t.Errorf("unexpected dropped counts: %v", counts)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// digest identifies the ciphertext of an EncryptedMessage.
+type digest [sha256.Size]byte
+
+// digestCacheEntry is an element of |digestCache.order|.
+type digestCacheEntry struct {
+	digest  digest
+	addedAt time.Time
+}
+
+// digestCache remembers the digests of the EncryptedMessages that were
+// successfully processed within the last |window|, up to |maxEntries| of the
+// most recent ones, as well as the digests of the EncryptedMessages that are
+// being processed. The ciphertexts of Cobalt's hybrid encryption scheme are
+// randomized, so a digest that is seen twice belongs to an Envelope that was
+// re-sent by the Encoder, typically after a failed response. digestCache is
+// safe for concurrent use.
+//
+// A digest is reserved with reserve() before its EncryptedMessage is
+// processed and is then either added with add() if the processing succeeds or
+// released with release() if it fails, so that two copies of an Envelope that
+// arrive concurrently are not both stored.
+type digestCache struct {
+	window     time.Duration
+	maxEntries int
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// The entries ordered from the most recently to the least recently added.
+	order   *list.List
+	entries map[digest]*list.Element
+	// The digests that are reserved but neither added nor released yet.
+	inFlight map[digest]bool
+	// The number of duplicates found by reserve().
+	numDuplicates uint64
+}
+
+// newDigestCache returns an empty digestCache. |window| and |maxEntries| must
+// be positive.
+func newDigestCache(window time.Duration, maxEntries int) *digestCache {
+	if window <= 0 || maxEntries <= 0 {
+		panic("window and maxEntries must be positive")
+	}
+
+	return &digestCache{
+		window:     window,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[digest]*list.Element),
+		inFlight:   make(map[digest]bool),
+	}
+}
+
+// computeDigest returns the digest of |ciphertext|.
+func computeDigest(ciphertext []byte) digest {
+	return sha256.Sum256(ciphertext)
+}
+
+// The outcomes of reserve().
+type reservation int
+
+const (
+	// The digest is reserved for the caller, who must add() or release() it.
+	digestReserved reservation = iota
+	// The digest was added within |window|.
+	digestProcessed
+	// The digest is reserved by another caller.
+	digestInFlight
+)
+
+// reserve reserves |d| for processing at |now| unless it was added within
+// |window| before |now| or is reserved already, in which case it is counted as
+// a duplicate.
+func (c *digestCache) reserve(d digest, now time.Time) reservation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	if _, ok := c.entries[d]; ok {
+		c.numDuplicates++
+		return digestProcessed
+	}
+	if c.inFlight[d] {
+		c.numDuplicates++
+		return digestInFlight
+	}
+	c.inFlight[d] = true
+	return digestReserved
+}
+
+// release releases the reservation of |d| after its EncryptedMessage failed to
+// be processed, so that it is processed again when it is re-sent.
+func (c *digestCache) release(d digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inFlight, d)
+}
+
+// add records that the EncryptedMessage with digest |d| was processed at
+// |now| and releases its reservation, evicting the least recently added entry
+// if the cache is full.
+func (c *digestCache) add(d digest, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inFlight, d)
+	c.expire(now)
+	if e, ok := c.entries[d]; ok {
+		e.Value.(*digestCacheEntry).addedAt = now
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[d] = c.order.PushFront(&digestCacheEntry{d, now})
+	if c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// duplicates returns the number of duplicates found so far.
+func (c *digestCache) duplicates() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.numDuplicates
+}
+
+// expire removes the entries that were added more than |window| before |now|.
+// The caller must hold |mu|.
+func (c *digestCache) expire(now time.Time) {
+	for e := c.order.Back(); e != nil && now.Sub(e.Value.(*digestCacheEntry).addedAt) > c.window; e = c.order.Back() {
+		c.remove(e)
+	}
+}
+
+// remove removes |e| from the cache. The caller must hold |mu|.
+func (c *digestCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*digestCacheEntry).digest)
+	c.order.Remove(e)
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	shufflerpb "cobalt"
+	"storage"
+	"util"
+)
+
+// Tests that digestCache forgets digests after the window and evicts the
+// least recently added digest when it is full.
+func TestDigestCache(t *testing.T) {
+	c := newDigestCache(time.Minute, 2)
+	start := time.Now()
+	a, b, d := computeDigest([]byte("a")), computeDigest([]byte("b")), computeDigest([]byte("d"))
+
+	c.add(a, start)
+	if r := c.reserve(a, start.Add(time.Minute)); r != digestProcessed {
+		t.Errorf("the digest is not found within the window")
+	}
+	if r := c.reserve(b, start); r != digestReserved {
+		t.Errorf("a digest that was not added is found")
+	}
+	c.release(b)
+	if r := c.reserve(a, start.Add(time.Minute+time.Second)); r != digestReserved {
+		t.Errorf("the digest is found after the window")
+	}
+
+	c.add(a, start)
+	c.add(b, start)
+	c.add(d, start)
+	if c.reserve(a, start) != digestReserved || c.reserve(b, start) != digestProcessed || c.reserve(d, start) != digestProcessed {
+		t.Errorf("expected only the least recently added digest to be evicted")
+	}
+	if n := c.duplicates(); n != 3 {
+		t.Errorf("got %d duplicates, expected 3", n)
+	}
+}
+
+// Tests that a reserved digest is in flight until it is added or released.
+func TestDigestCacheReservations(t *testing.T) {
+	c := newDigestCache(time.Minute, 10)
+	now := time.Now()
+	a := computeDigest([]byte("a"))
+
+	if r := c.reserve(a, now); r != digestReserved {
+		t.Fatalf("reserve() = %v, expected digestReserved", r)
+	}
+	if r := c.reserve(a, now); r != digestInFlight {
+		t.Errorf("reserve() of a reserved digest = %v, expected digestInFlight", r)
+	}
+	c.release(a)
+	if r := c.reserve(a, now); r != digestReserved {
+		t.Errorf("reserve() of a released digest = %v, expected digestReserved", r)
+	}
+	c.add(a, now)
+	if r := c.reserve(a, now); r != digestProcessed {
+		t.Errorf("reserve() of an added digest = %v, expected digestProcessed", r)
+	}
+}
+
+// Tests that Process() stores the Observations of a re-sent Envelope only once.
+func TestProcessDuplicateEnvelopes(t *testing.T) {
+	envelopeData := makeEnvelope(1, 5)
+	data, err := proto.Marshal(envelopeData.envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	eMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+
+	store := storage.NewMemStore()
+	s := &ShufflerServer{
+		store:     store,
+		decrypter: util.NewMessageDecrypter(""),
+		digests:   newDigestCache(time.Minute, 10),
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.Process(context.Background(), eMsg); err != nil {
+			t.Fatalf("Process() failed: %v", err)
+		}
+	}
+	storage.CheckNumObservations(t, store, &envelopeData.expectedBucketKeys[0], 5)
+	if n := s.NumDuplicateEnvelopes(); n != 2 {
+		t.Errorf("got %d duplicate envelopes, want 2", n)
+	}
+
+	// A rejected Envelope is processed again when it is re-sent.
+	data, err = proto.Marshal(makeEnvelope(0, 0).envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	rejected := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Process(context.Background(), rejected); err == nil {
+			t.Errorf("expected Process() to return an error for an empty envelope")
+		}
+	}
+	if n := s.NumDuplicateEnvelopes(); n != 2 {
+		t.Errorf("got %d duplicate envelopes, want 2", n)
+	}
+}
+
+// Tests that Process() rejects an Envelope while an identical one is being
+// processed, so that concurrent copies are not both stored.
+func TestProcessEnvelopeInFlight(t *testing.T) {
+	envelopeData := makeEnvelope(1, 5)
+	data, err := proto.Marshal(envelopeData.envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	eMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+
+	store := storage.NewMemStore()
+	s := &ShufflerServer{
+		store:     store,
+		decrypter: util.NewMessageDecrypter(""),
+		digests:   newDigestCache(time.Minute, 10),
+	}
+	d := computeDigest(data)
+	s.digests.reserve(d, time.Now())
+	if _, err := s.Process(context.Background(), eMsg); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Process() of an envelope in flight returned %v, expected Unavailable", err)
+	}
+	storage.CheckNumObservations(t, store, &envelopeData.expectedBucketKeys[0], 0)
+
+	s.digests.release(d)
+	if _, err := s.Process(context.Background(), eMsg); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+	storage.CheckNumObservations(t, store, &envelopeData.expectedBucketKeys[0], 5)
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+
+	"cobalt"
+	"shuffler"
+	"util/stackdriver"
+)
+
+const forwardFailed = "reciever-forward-failed"
+
+// ForwarderConfig specifies how a Forwarder relays EncryptedMessages to the
+// next Shufflers of a chain.
+type ForwarderConfig struct {
+	// Maps the hex encoded fingerprint of the public key of each next Shuffler
+	// to its <host>:<port>. An EncryptedMessage whose |public_key_fingerprint|
+	// is a key of |Routes| is relayed to that Shuffler.
+	Routes map[string]string
+	// The connections to the next Shufflers use TLS if true, with the root
+	// certificates in |CAFile| if it is not empty. If |TLSServerName| is not
+	// empty the certificates of the next Shufflers are verified for this name
+	// instead of the host in their address.
+	EnableTLS     bool
+	CAFile        string
+	TLSServerName string
+	// The deadline of each attempt to relay an EncryptedMessage.
+	Timeout time.Duration
+	// An EncryptedMessage is relayed in up to |MaxAttempts| attempts, which
+	// are |RetryInterval| apart, before the Encoder is returned the error of
+	// the last one.
+	MaxAttempts   int
+	RetryInterval time.Duration
+}
+
+// processClient is the part of shuffler.ShufflerClient used by the Forwarder.
+type processClient interface {
+	Process(ctx context.Context, in *cobalt.EncryptedMessage, opts ...grpc.CallOption) (*shuffler.ShufflerResponse, error)
+}
+
+// A Forwarder relays the EncryptedMessages that are intended for another
+// Shuffler to it, which lets Shufflers be chained. The recipient of an
+// EncryptedMessage is identified by the fingerprint of the public key it was
+// encrypted with, so the Envelope is never decrypted by this Shuffler: the
+// still-sealed EncryptedMessage is sent on by forward() while the request of
+// the Encoder waits, and the Encoder is returned the status of the next
+// Shuffler. An EncryptedMessage is therefore only acknowledged once the next
+// Shuffler has accepted it, and the Encoder retries it otherwise.
+type Forwarder struct {
+	config ForwarderConfig
+
+	// Connects to the Shuffler at the given address. Replaced in tests.
+	dial func(address string) (processClient, *grpc.ClientConn, error)
+
+	// The clients of the next Shufflers by address, and their connections.
+	// mu protects them.
+	mu      sync.Mutex
+	clients map[string]processClient
+	conns   []*grpc.ClientConn
+
+	// The numbers of EncryptedMessages relayed and that could not be relayed.
+	// Accessed atomically.
+	numForwarded uint64
+	numFailed    uint64
+}
+
+// NewForwarder returns a Forwarder configured by |config|.
+func NewForwarder(config ForwarderConfig) *Forwarder {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+	f := &Forwarder{
+		config:  config,
+		clients: make(map[string]processClient),
+	}
+	f.dial = f.dialShuffler
+	return f
+}
+
+// route returns the address of the Shuffler to which |encryptedMessage| must
+// be relayed, or false if it is intended for this Shuffler.
+func (f *Forwarder) route(encryptedMessage *cobalt.EncryptedMessage) (string, bool) {
+	fingerprint := encryptedMessage.GetPublicKeyFingerprint()
+	if len(fingerprint) == 0 {
+		return "", false
+	}
+	address, ok := f.config.Routes[hex.EncodeToString(fingerprint)]
+	return address, ok
+}
+
+// forward sends |encryptedMessage| to the Shuffler at |address| within |ctx|,
+// the context of the request of the Encoder. The attempts that fail with
+// Unavailable or DeadlineExceeded are retried up to |MaxAttempts| attempts in
+// total, as long as |ctx| is not done. Returns the error of the last attempt,
+// which is the status of the next Shuffler, or Unavailable if it cannot be
+// reached.
+func (f *Forwarder) forward(ctx context.Context, address string, encryptedMessage *cobalt.EncryptedMessage) error {
+	var err error
+	for attempt := 1; attempt <= f.config.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return f.failed(address, err)
+			case <-time.After(f.config.RetryInterval):
+			}
+		}
+		var client processClient
+		if client, err = f.client(address); err != nil {
+			glog.V(3).Infof("Attempt %d to connect to %s failed: %v", attempt, address, err)
+			err = grpc.Errorf(codes.Unavailable, "Unable to connect to the next Shuffler: %v", err)
+			continue
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, f.config.Timeout)
+		_, err = client.Process(attemptCtx, encryptedMessage)
+		cancel()
+		if err == nil {
+			atomic.AddUint64(&f.numForwarded, 1)
+			return nil
+		}
+		glog.V(3).Infof("Attempt %d to forward an envelope to %s failed: %v", attempt, address, err)
+		if code := grpc.Code(err); code != codes.Unavailable && code != codes.DeadlineExceeded {
+			break
+		}
+	}
+	return f.failed(address, err)
+}
+
+// failed counts an EncryptedMessage that could not be relayed to the Shuffler
+// at |address| because of |err|, and returns |err|.
+func (f *Forwarder) failed(address string, err error) error {
+	atomic.AddUint64(&f.numFailed, 1)
+	stackdriver.LogCountMetricf(forwardFailed, "Unable to forward an envelope to %s: %v", address, err)
+	return err
+}
+
+// client returns the client of the Shuffler at |address|, connecting to it
+// first if needed.
+func (f *Forwarder) client(address string) (processClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if client, ok := f.clients[address]; ok {
+		return client, nil
+	}
+	client, conn, err := f.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	f.clients[address] = client
+	if conn != nil {
+		f.conns = append(f.conns, conn)
+	}
+	return client, nil
+}
+
+// transportCredentials returns the TLS credentials of the connections to the
+// next Shufflers.
+func (f *Forwarder) transportCredentials() (credentials.TransportCredentials, error) {
+	if f.config.CAFile != "" {
+		creds, err := credentials.NewClientTLSFromFile(f.config.CAFile, f.config.TLSServerName)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Failed to create TLS credentials %v", err)
+		}
+		return creds, nil
+	}
+	return credentials.NewClientTLSFromCert(nil, f.config.TLSServerName), nil
+}
+
+// dialShuffler connects to the Shuffler at |address|.
+func (f *Forwarder) dialShuffler(address string) (processClient, *grpc.ClientConn, error) {
+	var opts []grpc.DialOption
+	if f.config.EnableTLS {
+		creds, err := f.transportCredentials()
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, nil, grpc.Errorf(codes.Internal, "Error in establishing connection to Shuffler [%v]: %v", address, err)
+	}
+	return shuffler.NewShufflerClient(conn), conn, nil
+}
+
+// Close closes the connections to the next Shufflers. It must be invoked
+// once the receiver has stopped, since the EncryptedMessages that are being
+// relayed would fail.
+func (f *Forwarder) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.clients = make(map[string]processClient)
+	f.conns = nil
+}
+
+// NumForwarded returns the number of EncryptedMessages that have been relayed
+// to the next Shufflers.
+func (f *Forwarder) NumForwarded() uint64 {
+	return atomic.LoadUint64(&f.numForwarded)
+}
+
+// NumFailed returns the number of EncryptedMessages that could not be relayed,
+// whose Encoders were returned an error.
+func (f *Forwarder) NumFailed() uint64 {
+	return atomic.LoadUint64(&f.numFailed)
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	shufflerpb "cobalt"
+	"shuffler"
+	"storage"
+)
+
+// fakeShufflerClient records the EncryptedMessages relayed to a Shuffler. The
+// first |numFailures| calls fail with |code|, or Unavailable if it is not set.
+type fakeShufflerClient struct {
+	mu          sync.Mutex
+	numFailures int
+	code        codes.Code
+	numCalls    int
+	messages    []*shufflerpb.EncryptedMessage
+}
+
+func (c *fakeShufflerClient) Process(ctx context.Context, in *shufflerpb.EncryptedMessage, opts ...grpc.CallOption) (*shuffler.ShufflerResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.numCalls++
+	if c.numFailures > 0 {
+		c.numFailures--
+		if c.code != codes.OK {
+			return nil, grpc.Errorf(c.code, "failed")
+		}
+		return nil, grpc.Errorf(codes.Unavailable, "unavailable")
+	}
+	c.messages = append(c.messages, in)
+	return &shuffler.ShufflerResponse{}, nil
+}
+
+func (c *fakeShufflerClient) numMessages() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.messages)
+}
+
+var (
+	nextShufflerFingerprint = []byte{1, 2, 3}
+	otherFingerprint        = []byte{4, 5, 6}
+)
+
+// newTestForwarder returns a Forwarder that relays the EncryptedMessages with
+// |nextShufflerFingerprint| to |client|.
+func newTestForwarder(client *fakeShufflerClient, maxAttempts int) *Forwarder {
+	f := NewForwarder(ForwarderConfig{
+		Routes:        map[string]string{hex.EncodeToString(nextShufflerFingerprint): "next:50051"},
+		Timeout:       time.Second,
+		MaxAttempts:   maxAttempts,
+		RetryInterval: time.Millisecond,
+	})
+	f.dial = func(address string) (processClient, *grpc.ClientConn, error) {
+		if address != "next:50051" {
+			return nil, nil, errors.New("unknown address " + address)
+		}
+		return client, nil, nil
+	}
+	return f
+}
+
+// Tests that Process() relays the EncryptedMessages intended for the next
+// Shuffler without decrypting them and processes the others.
+func TestProcessForwardsEnvelopes(t *testing.T) {
+	client := &fakeShufflerClient{}
+	f := newTestForwarder(client, 1)
+	store := storage.NewMemStore()
+	// Without a decrypter, an EncryptedMessage that is not forwarded fails with
+	// Internal.
+	s := &ShufflerServer{
+		store:  store,
+		config: ServerConfig{Forwarder: f},
+	}
+
+	sealed := &shufflerpb.EncryptedMessage{
+		Scheme:               shufflerpb.EncryptedMessage_HYBRID_ECDH_V1,
+		PublicKeyFingerprint: nextShufflerFingerprint,
+		Ciphertext:           []byte("sealed"),
+	}
+	if _, err := s.Process(context.Background(), sealed); err != nil {
+		t.Fatalf("Process() of an envelope for the next Shuffler: got error %v", err)
+	}
+	if _, err := s.Process(context.Background(), &shufflerpb.EncryptedMessage{
+		Scheme:               shufflerpb.EncryptedMessage_HYBRID_ECDH_V1,
+		PublicKeyFingerprint: otherFingerprint,
+		Ciphertext:           []byte("sealed"),
+	}); grpc.Code(err) != codes.Internal {
+		t.Errorf("Process() of an envelope for this Shuffler: got error %v, expected Internal", err)
+	}
+
+	if client.numMessages() != 1 || client.messages[0] != sealed {
+		t.Errorf("Got relayed messages %v, expected %v", client.messages, sealed)
+	}
+	if f.NumForwarded() != 1 || f.NumFailed() != 0 {
+		t.Errorf("Got %d forwarded and %d failed, expected 1 and 0", f.NumForwarded(), f.NumFailed())
+	}
+}
+
+// Tests that the attempts to relay an EncryptedMessage that fail with
+// Unavailable are retried, and that the Encoder is returned Unavailable once
+// |MaxAttempts| attempts have failed.
+func TestForwarderRetries(t *testing.T) {
+	client := &fakeShufflerClient{numFailures: 4}
+	f := newTestForwarder(client, 3)
+	s := &ShufflerServer{config: ServerConfig{Forwarder: f}}
+	sealed := &shufflerpb.EncryptedMessage{PublicKeyFingerprint: nextShufflerFingerprint}
+
+	// The first message fails three times, the second one succeeds at its
+	// second attempt.
+	if _, err := s.Process(context.Background(), sealed); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Process() failing %d times: got error %v, expected Unavailable", 3, err)
+	}
+	if _, err := s.Process(context.Background(), sealed); err != nil {
+		t.Errorf("Process() failing once: got error %v", err)
+	}
+	if client.numCalls != 5 || client.numMessages() != 1 {
+		t.Errorf("Got %d calls and %d relayed messages, expected 5 and 1", client.numCalls, client.numMessages())
+	}
+	if f.NumForwarded() != 1 || f.NumFailed() != 1 {
+		t.Errorf("Got %d forwarded and %d failed, expected 1 and 1", f.NumForwarded(), f.NumFailed())
+	}
+}
+
+// Tests that the Encoder is returned the errors of the next Shuffler other
+// than Unavailable and DeadlineExceeded without retrying.
+func TestForwarderReturnsStatus(t *testing.T) {
+	client := &fakeShufflerClient{numFailures: 1, code: codes.ResourceExhausted}
+	f := newTestForwarder(client, 3)
+	s := &ShufflerServer{config: ServerConfig{Forwarder: f}}
+	sealed := &shufflerpb.EncryptedMessage{PublicKeyFingerprint: nextShufflerFingerprint}
+
+	if _, err := s.Process(context.Background(), sealed); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Process(): got error %v, expected ResourceExhausted", err)
+	}
+	if client.numCalls != 1 {
+		t.Errorf("Got %d calls, expected 1", client.numCalls)
+	}
+}
+
+// Tests that the Encoder is returned Unavailable if the next Shuffler cannot
+// be reached, and that the retries stop once the request is cancelled.
+func TestForwarderUnreachable(t *testing.T) {
+	f := newTestForwarder(&fakeShufflerClient{}, 3)
+	f.config.Routes[hex.EncodeToString(otherFingerprint)] = "unknown:50051"
+	s := &ShufflerServer{config: ServerConfig{Forwarder: f}}
+	sealed := &shufflerpb.EncryptedMessage{PublicKeyFingerprint: otherFingerprint}
+
+	if _, err := s.Process(context.Background(), sealed); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Process(): got error %v, expected Unavailable", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.config.MaxAttempts = 1000
+	f.config.RetryInterval = time.Hour
+	if _, err := s.Process(ctx, sealed); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Process() with a cancelled request: got error %v, expected Unavailable", err)
+	}
+	if f.NumFailed() != 2 {
+		t.Errorf("Got %d failed, expected 2", f.NumFailed())
+	}
+}
+
+// Tests that route() only selects the EncryptedMessages whose fingerprint is
+// routed.
+func TestForwarderRoute(t *testing.T) {
+	f := newTestForwarder(&fakeShufflerClient{}, 1)
+	for _, test := range []struct {
+		fingerprint []byte
+		address     string
+		ok          bool
+	}{
+		{nextShufflerFingerprint, "next:50051", true},
+		{otherFingerprint, "", false},
+		{nil, "", false},
+	} {
+		address, ok := f.route(&shufflerpb.EncryptedMessage{PublicKeyFingerprint: test.fingerprint})
+		if address != test.address || ok != test.ok {
+			t.Errorf("route(%x): got (%q, %v), expected (%q, %v)", test.fingerprint, address, ok, test.address, test.ok)
+		}
+	}
+}
+
+// Tests that the certificates of the next Shufflers are verified for
+// |TLSServerName|.
+func TestForwarderTLSServerName(t *testing.T) {
+	f := NewForwarder(ForwarderConfig{EnableTLS: true, TLSServerName: "shuffler.example.com"})
+	creds, err := f.transportCredentials()
+	if err != nil {
+		t.Fatalf("transportCredentials() failed: %v", err)
+	}
+	if name := creds.Info().ServerName; name != "shuffler.example.com" {
+		t.Errorf("got server name %q, expected shuffler.example.com", name)
+	}
+}
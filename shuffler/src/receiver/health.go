@@ -0,0 +1,134 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"util/stackdriver"
+)
+
+const (
+	startHealthServerFailed = "reciever-start-health-server-failed"
+
+	// The name of the Shuffler service in the health service.
+	shufflerServiceName = "cobalt.shuffler.Shuffler"
+)
+
+// Health reports whether the Shuffler is ready to serve, for the liveness and
+// readiness checks of Kubernetes. It implements the standard
+// grpc.health.v1.Health service, which is registered on the server started by
+// Run(), and a /healthz HTTP handler for simple probes.
+//
+// The Shuffler is reported as NOT_SERVING until both its store is initialized
+// and its dispatcher has started, and again once it is shutting down.
+type Health struct {
+	server *health.Server
+
+	// mu protects the fields below.
+	mu                sync.Mutex
+	storeReady        bool
+	dispatcherStarted bool
+	shuttingDown      bool
+}
+
+// NewHealth returns a Health that reports NOT_SERVING.
+func NewHealth() *Health {
+	h := &Health{server: health.NewServer()}
+	h.update()
+	return h
+}
+
+// SetStoreReady records that the store of the Shuffler is initialized.
+func (h *Health) SetStoreReady() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.storeReady = true
+	h.update()
+}
+
+// SetDispatcherStarted records that the dispatcher of the Shuffler has
+// started.
+func (h *Health) SetDispatcherStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dispatcherStarted = true
+	h.update()
+}
+
+// SetShuttingDown records that the Shuffler is shutting down, after which it
+// is reported as NOT_SERVING so that no new requests are routed to it.
+func (h *Health) SetShuttingDown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shuttingDown = true
+	h.update()
+}
+
+// Serving returns whether the Shuffler is ready to serve.
+func (h *Health) Serving() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.serving()
+}
+
+// serving implements Serving(). |h.mu| must be held.
+func (h *Health) serving() bool {
+	return h.storeReady && h.dispatcherStarted && !h.shuttingDown
+}
+
+// update sets the status reported by the health service for the server as a
+// whole and for the Shuffler service. |h.mu| must be held.
+func (h *Health) update() {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if h.serving() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	h.server.SetServingStatus("", status)
+	h.server.SetServingStatus(shufflerServiceName, status)
+}
+
+// register registers the health service on |grpcServer|.
+func (h *Health) register(grpcServer *grpc.Server) {
+	healthpb.RegisterHealthServer(grpcServer, h.server)
+}
+
+// ServeHTTP responds with 200 if the Shuffler is ready to serve and with 503
+// otherwise.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.Serving() {
+		http.Error(w, "not serving", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// RunHTTP serves /healthz on |port| and blocks until a fatal error occurs in
+// the network layer.
+func (h *Health) RunHTTP(port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	glog.Infof("Serving /healthz on port %d.", port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
+		stackdriver.LogCountMetric(startHealthServerFailed, "Unable to serve /healthz on port [", port, "]:", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// checkHealth checks the status reported by |h| for the server as a whole and
+// for the Shuffler service over gRPC, and by /healthz.
+func checkHealth(t *testing.T, h *Health, serving bool) {
+	expectedStatus := healthpb.HealthCheckResponse_NOT_SERVING
+	expectedCode := http.StatusServiceUnavailable
+	if serving {
+		expectedStatus = healthpb.HealthCheckResponse_SERVING
+		expectedCode = http.StatusOK
+	}
+
+	for _, service := range []string{"", shufflerServiceName} {
+		response, err := h.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Check(%q): got error %v", service, err)
+		}
+		if response.Status != expectedStatus {
+			t.Errorf("Check(%q): got %v, expected %v", service, response.Status, expectedStatus)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != expectedCode {
+		t.Errorf("/healthz: got status %d, expected %d", recorder.Code, expectedCode)
+	}
+}
+
+// Tests that the Shuffler is reported as serving only once the store is ready
+// and the dispatcher has started, and until it is shutting down.
+func TestHealth(t *testing.T) {
+	h := NewHealth()
+	checkHealth(t, h, false)
+
+	h.SetDispatcherStarted()
+	checkHealth(t, h, false)
+
+	h.SetStoreReady()
+	checkHealth(t, h, true)
+
+	h.SetShuttingDown()
+	checkHealth(t, h, false)
+}
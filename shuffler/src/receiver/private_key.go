@@ -0,0 +1,72 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	"util"
+	"util/stackdriver"
+)
+
+const (
+	reloadPrivateKeyFailed = "reciever-reload-private-key-failed"
+)
+
+// pollPrivateKey invokes reloadPrivateKey() once every
+// |s.config.PrivateKeyPollInterval|. It never returns.
+func (s *ShufflerServer) pollPrivateKey() {
+	for {
+		time.Sleep(s.config.PrivateKeyPollInterval)
+		s.reloadPrivateKey()
+	}
+}
+
+// reloadPrivateKey fetches the private key from |s.config.PrivateKeySource| and
+// replaces the decrypter if the key has changed. The new decrypter holds the
+// previous key as well, so that Envelopes that Encoders encrypted for the
+// previous public key can still be decrypted. If the key cannot be fetched or
+// parsed the current decrypter is kept.
+func (s *ShufflerServer) reloadPrivateKey() {
+	if s.config.PrivateKeySource == nil {
+		panic("PrivateKeySource is nil")
+	}
+
+	privateKeyPem, err := s.config.PrivateKeySource.PrivateKeyPem()
+	if err != nil {
+		stackdriver.LogCountMetricf(reloadPrivateKeyFailed, "Unable to fetch the private key, keeping the current one: %v", err)
+		return
+	}
+
+	s.decrypterMu.Lock()
+	defer s.decrypterMu.Unlock()
+
+	if privateKeyPem == s.privateKeyPem {
+		return
+	}
+	if _, err := util.ParseECPrivateKeyPem(privateKeyPem); err != nil {
+		stackdriver.LogCountMetricf(reloadPrivateKeyFailed, "Unable to parse the new private key, keeping the current one: %v", err)
+		return
+	}
+	glog.Infoln("The private key has changed. Using the new private key.")
+	privateKeyPems := []string{privateKeyPem}
+	if s.privateKeyPem != "" {
+		privateKeyPems = append(privateKeyPems, s.privateKeyPem)
+	}
+	s.decrypter = util.NewMultiKeyMessageDecrypter(privateKeyPems)
+	s.privateKeyPem = privateKeyPem
+}
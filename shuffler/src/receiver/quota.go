@@ -0,0 +1,152 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+	"util/stackdriver"
+)
+
+const quotaExceeded = "reciever-quota-exceeded"
+
+// quotaUsage counts the Envelopes accepted in the current hour and the
+// Observations accepted in the current day for the metrics of a quota.
+type quotaUsage struct {
+	quota *shuffler.Quota
+
+	hour            time.Time
+	numEnvelopes    uint32
+	dayIndex        uint32
+	numObservations uint64
+
+	// The number of Envelopes rejected because of this quota.
+	numRejected uint64
+}
+
+// Quotas limits the rate at which the receiver accepts Observations for the
+// metrics of customers and projects as specified by the |quotas| of the
+// ShufflerConfig. It is safe for concurrent use.
+type Quotas struct {
+	// mu protects the usages.
+	mu sync.Mutex
+	// Keyed by customer and project, with a metric id of zero. The project id
+	// of a customer quota is zero as well.
+	usages map[metricKey]*quotaUsage
+}
+
+// NewQuotas returns the Quotas given by |quotas|. Entries without a customer
+// or without a positive limit are ignored.
+func NewQuotas(quotas []*shuffler.Quota) *Quotas {
+	q := &Quotas{
+		usages: make(map[metricKey]*quotaUsage),
+	}
+	for _, quota := range quotas {
+		if quota.CustomerId == 0 || (quota.MaxEnvelopesPerHour == 0 && quota.MaxObservationsPerDay == 0) {
+			continue
+		}
+		q.usages[metricKey{quota.CustomerId, quota.ProjectId, 0}] = &quotaUsage{quota: quota}
+	}
+	return q
+}
+
+// charge counts the Envelope containing |batches|, which arrived at
+// |arrivalTime|, against the quotas of the customers and projects of its
+// metrics. If this would exceed any of the quotas nothing is counted and a
+// ResourceExhausted error is returned.
+func (q *Quotas) charge(batches []*cobalt.ObservationBatch, arrivalTime time.Time) error {
+	if len(q.usages) == 0 {
+		return nil
+	}
+
+	// The number of Observations in the Envelope for each quota.
+	numObservations := make(map[*quotaUsage]uint64)
+	for _, b := range batches {
+		m := b.GetMetaData()
+		for _, k := range []metricKey{{m.GetCustomerId(), 0, 0}, {m.GetCustomerId(), m.GetProjectId(), 0}} {
+			if u, ok := q.usages[k]; ok {
+				numObservations[u] += uint64(len(b.GetEncryptedObservation()))
+			}
+		}
+	}
+	if len(numObservations) == 0 {
+		return nil
+	}
+
+	hour := arrivalTime.UTC().Truncate(time.Hour)
+	dayIndex := storage.GetDayIndexUtc(arrivalTime)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for u, n := range numObservations {
+		u.advance(hour, dayIndex)
+		if limit := u.quota.MaxEnvelopesPerHour; limit > 0 && u.numEnvelopes >= limit {
+			return q.reject(u, uint64(limit), "Envelopes per hour")
+		}
+		if limit := u.quota.MaxObservationsPerDay; limit > 0 && u.numObservations+n > limit {
+			return q.reject(u, limit, "Observations per day")
+		}
+	}
+	for u, n := range numObservations {
+		u.numEnvelopes++
+		u.numObservations += n
+	}
+	return nil
+}
+
+// advance resets the counts of |u| if |hour| or |dayIndex| is a new window.
+func (u *quotaUsage) advance(hour time.Time, dayIndex uint32) {
+	if !hour.Equal(u.hour) {
+		u.hour = hour
+		u.numEnvelopes = 0
+	}
+	if dayIndex != u.dayIndex {
+		u.dayIndex = dayIndex
+		u.numObservations = 0
+	}
+}
+
+// reject counts an Envelope rejected because of the quota of |u| and returns
+// the error for it. The exceeded limit is |limit| |unit|.
+func (q *Quotas) reject(u *quotaUsage, limit uint64, unit string) error {
+	u.numRejected++
+	if u.quota.ProjectId == 0 {
+		stackdriver.LogCountMetricf(quotaExceeded, "Rejected an Envelope for customer %d, which is limited to %d %s.", u.quota.CustomerId, limit, unit)
+		return grpc.Errorf(codes.ResourceExhausted, "Customer %d is limited to %d %s.", u.quota.CustomerId, limit, unit)
+	}
+	stackdriver.LogCountMetricf(quotaExceeded, "Rejected an Envelope for customer %d, project %d, which is limited to %d %s.",
+		u.quota.CustomerId, u.quota.ProjectId, limit, unit)
+	return grpc.Errorf(codes.ResourceExhausted, "Customer %d, project %d is limited to %d %s.", u.quota.CustomerId, u.quota.ProjectId, limit, unit)
+}
+
+// NumRejectedEnvelopes returns the number of Envelopes that have been rejected
+// because of the quota of |customerId| and |projectId|, which is zero for a
+// customer quota.
+func (q *Quotas) NumRejectedEnvelopes(customerId uint32, projectId uint32) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u, ok := q.usages[metricKey{customerId, projectId, 0}]; ok {
+		return u.numRejected
+	}
+	return 0
+}
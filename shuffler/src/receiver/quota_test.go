@@ -0,0 +1,122 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	shufflerpb "cobalt"
+	"shuffler"
+	"storage"
+	"util"
+)
+
+// makeQuotaBatch returns an ObservationBatch of |num| Observations for metric
+// 1 of |customerId| and |projectId|.
+func makeQuotaBatch(customerId uint32, projectId uint32, num int) *shufflerpb.ObservationBatch {
+	return &shufflerpb.ObservationBatch{
+		MetaData:             &shufflerpb.ObservationMetadata{CustomerId: customerId, ProjectId: projectId, MetricId: 1},
+		EncryptedObservation: storage.MakeRandomEncryptedMsgs(num),
+	}
+}
+
+// Tests that the Envelopes for a project are limited per hour.
+func TestQuotasEnvelopesPerHour(t *testing.T) {
+	q := NewQuotas([]*shuffler.Quota{{CustomerId: 1, ProjectId: 1, MaxEnvelopesPerHour: 2}})
+	now := time.Date(2018, 3, 1, 10, 30, 0, 0, time.UTC)
+	limited := []*shufflerpb.ObservationBatch{makeQuotaBatch(1, 1, 5)}
+	for i := 0; i < 2; i++ {
+		if err := q.charge(limited, now); err != nil {
+			t.Fatalf("charge() failed for Envelope %d: %v", i, err)
+		}
+	}
+	if err := q.charge(limited, now); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("charge() returned %v, expected ResourceExhausted", err)
+	}
+	if n := q.NumRejectedEnvelopes(1, 1); n != 1 {
+		t.Errorf("got %d rejected Envelopes, expected 1", n)
+	}
+
+	// Other projects are not limited.
+	if err := q.charge([]*shufflerpb.ObservationBatch{makeQuotaBatch(1, 2, 5)}, now); err != nil {
+		t.Errorf("charge() failed for another project: %v", err)
+	}
+	// The quota is reset in the next hour.
+	if err := q.charge(limited, now.Add(30*time.Minute)); err != nil {
+		t.Errorf("charge() failed in the next hour: %v", err)
+	}
+}
+
+// Tests that a customer quota limits the Observations of all projects of the
+// customer per day, and that a rejected Envelope is not counted.
+func TestQuotasObservationsPerDay(t *testing.T) {
+	q := NewQuotas([]*shuffler.Quota{
+		{CustomerId: 1, MaxObservationsPerDay: 10},
+		{CustomerId: 1, ProjectId: 1, MaxEnvelopesPerHour: 3},
+	})
+	now := time.Date(2018, 3, 1, 10, 30, 0, 0, time.UTC)
+	for _, projectId := range []uint32{1, 2} {
+		if err := q.charge([]*shufflerpb.ObservationBatch{makeQuotaBatch(1, projectId, 4)}, now); err != nil {
+			t.Fatalf("charge() failed for project %d: %v", projectId, err)
+		}
+	}
+	if err := q.charge([]*shufflerpb.ObservationBatch{makeQuotaBatch(1, 1, 3)}, now); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("charge() returned %v, expected ResourceExhausted", err)
+	}
+	if n := q.NumRejectedEnvelopes(1, 0); n != 1 {
+		t.Errorf("got %d rejected Envelopes for the customer, expected 1", n)
+	}
+	// The rejected Envelope did not count towards the project quota.
+	for i := 0; i < 2; i++ {
+		if err := q.charge([]*shufflerpb.ObservationBatch{makeQuotaBatch(1, 1, 1)}, now); err != nil {
+			t.Fatalf("charge() failed for Envelope %d: %v", i, err)
+		}
+	}
+	if err := q.charge([]*shufflerpb.ObservationBatch{makeQuotaBatch(1, 1, 3)}, now.Add(24*time.Hour)); err != nil {
+		t.Errorf("charge() failed on the next day: %v", err)
+	}
+}
+
+// Tests that Process() rejects Envelopes exceeding a quota without storing
+// their Observations.
+func TestProcessWithQuotas(t *testing.T) {
+	envelope := &shufflerpb.Envelope{Batch: []*shufflerpb.ObservationBatch{makeQuotaBatch(1, 1, 3)}}
+	key := *envelope.Batch[0].MetaData
+	store := storage.NewMemStore()
+	s := &ShufflerServer{
+		store:     store,
+		config:    ServerConfig{Quotas: NewQuotas([]*shuffler.Quota{{CustomerId: 1, MaxEnvelopesPerHour: 1}})},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	encryptedMessage := &shufflerpb.EncryptedMessage{Ciphertext: data, Scheme: shufflerpb.EncryptedMessage_NONE}
+
+	if _, err := s.Process(context.Background(), encryptedMessage); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+	if _, err := s.Process(context.Background(), encryptedMessage); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Process() returned %v, expected ResourceExhausted", err)
+	}
+	storage.CheckNumObservations(t, store, &key, 3)
+}
@@ -13,9 +13,9 @@
 // limitations under the License.
 
 /*
-Package implementing a simple gRPC server that performs unary RPC to
-implement shuffler service whose definition can be found in
-shuffler/shuffler.proto.
+Package implementing a simple gRPC server that performs unary and
+client-streaming RPCs to implement shuffler service whose definition can be
+found in shuffler/shuffler.proto.
 
 A shuffler listens to incoming requests from Encoders (end users),
 strips the user metadata like IP-address, timestamps etc before buffering
@@ -25,8 +25,11 @@ them locally based on the metadata information provided in the request.
 package receiver
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -35,6 +38,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 
 	"cobalt"
 	"shuffler"
@@ -46,6 +50,7 @@ import (
 const (
 	startServerFailed     = "reciever-start-server-failed"
 	decryptEnvelopeFailed = "reciever-decrypt-envelope-failed"
+	auditLogFailed        = "reciever-audit-log-failed"
 )
 
 var shufflerServerSingleton *ShufflerServer
@@ -55,6 +60,23 @@ type ShufflerServer struct {
 	store     storage.Store
 	config    ServerConfig
 	decrypter *util.MessageDecrypter
+
+	// decrypterMu protects |decrypter| and |privateKeyPem|, the PEM of the
+	// current key of |config.PrivateKeySource|, which are replaced when the
+	// private key is rotated. See private_key.go.
+	decrypterMu   sync.RWMutex
+	privateKeyPem string
+
+	// If not nil, a record is written to |auditLog| for each incoming Envelope.
+	auditLog *auditLog
+
+	// The number of empty Envelopes accepted as keep-alives. Accessed
+	// atomically.
+	numEmptyEnvelopes uint64
+
+	// If not nil, the digests of recently processed EncryptedMessages, used to
+	// detect Envelopes that are re-sent by Encoders.
+	digests *digestCache
 }
 
 // ServerConfig specifies the configuration options for setting up a Grpc
@@ -66,37 +88,180 @@ type ServerConfig struct {
 	CertFile string
 	// The TLS key file
 	KeyFile string
+	// If positive, |CertFile| and |KeyFile| are checked for changes this often
+	// and a changed certificate is used for new connections without a restart.
+	CertPollInterval time.Duration
 	// The server port
 	Port int
-	// A PEM encoding of the Shuffler's private key for use in Cobalt's custom
-	// hybrid encryption scheme.
-	// TODO(rudominer) Support key rotation: Rather than a single private key
-	// this should be a set of (public-key-hash, private-key) pairs.
-	PrivateKeyPem string
+	// PEM encodings of the Shuffler's private keys for use in Cobalt's custom
+	// hybrid encryption scheme. Each EncryptedMessage is decrypted with the
+	// key that matches its public key fingerprint, so that Encoders may use
+	// the public key of any of them while the key pair is rotated.
+	PrivateKeyPems []string
+	// If not nil, the private key is reloaded from |PrivateKeySource| every
+	// |PrivateKeyPollInterval| so that a rotated key takes effect without a
+	// restart. |PrivateKeyPems| holds the single key that is used until then.
+	PrivateKeySource       util.PrivateKeySource
+	PrivateKeyPollInterval time.Duration
+	// If non-empty, the directory in which the ingestion audit log is written.
+	// See audit_log.go.
+	AuditLogDir string
+	// The size in bytes at which a new audit log file is started.
+	AuditLogMaxFileSize int64
+	// If positive, the maximum number of audit log files to keep.
+	AuditLogMaxFiles int
+	// If not nil, incoming Observations for the metrics on this denylist are
+	// counted and discarded.
+	MetricDenylist *MetricDenylist
+	// If not nil, Envelopes containing an Observation whose ciphertext exceeds
+	// the limit of its metric are rejected with InvalidArgument.
+	CiphertextSizeLimits *CiphertextSizeLimits
+	// If not nil, the ciphertext sizes of incoming Observations are recorded in
+	// |ObservationSizes|.
+	ObservationSizes *util.ObservationSizes
+	// Identifies this Shuffler instance. It is stored with each incoming
+	// Observation.
+	ShufflerInstanceId string
+	// If true, Envelopes without any ObservationBatch are treated as keep-alives
+	// from Encoders: they are counted and OK is returned. Otherwise they are
+	// rejected with InvalidArgument.
+	AcceptEmptyEnvelopes bool
+	// If positive, an EncryptedMessage identical to one that was successfully
+	// processed within the last |DuplicateWindow| is acknowledged without
+	// being stored again. The digests of at most |DuplicateCacheSize|
+	// EncryptedMessages are kept.
+	DuplicateWindow    time.Duration
+	DuplicateCacheSize int
+	// If not nil, incoming Envelopes are rejected with Unavailable while the
+	// backlog of Observations in the store is too large. Run() starts
+	// measuring the backlog.
+	Backpressure *Backpressure
+	// If positive, the maximum size in bytes of a request that is accepted.
+	// Otherwise gRPC's default of 4 MiB applies.
+	MaxRecvMsgSize int
+	// If positive, the maximum total size in bytes of the ciphertexts of the
+	// EncryptedMessages sent in a single ProcessStream call, which are held in
+	// memory until the stream is complete.
+	MaxStreamSize int
+	// If positive, the maximum number of concurrent streams on a single client
+	// connection. Otherwise the number is not limited.
+	MaxConcurrentStreams uint32
+	// If positive, clients that send keepalive pings more often than
+	// |KeepaliveMinTime| are disconnected. If |KeepalivePermitWithoutStream| is
+	// false, so are clients that send keepalive pings without any active
+	// stream.
+	KeepaliveMinTime             time.Duration
+	KeepalivePermitWithoutStream bool
+	// If not nil, the Observations that are persisted are counted per project
+	// for usage accounting.
+	UsageMeter *storage.UsageMeter
+	// If not nil, Envelopes that would exceed the quota of the customer or the
+	// project of their metrics are rejected with ResourceExhausted.
+	Quotas *Quotas
+	// If not nil, the processed EncryptedMessages and the decryption failures
+	// are counted in |Stats|.
+	Stats *ReceiverStats
+	// If not nil, EncryptedMessages intended for another Shuffler are relayed
+	// to it by |Forwarder| without being decrypted.
+	Forwarder *Forwarder
+	// If not nil, the grpc.health.v1.Health service reporting |Health| is
+	// served alongside the Shuffler service.
+	Health *Health
 }
 
 // Process processes the incoming encoder requests and persists them locally in
 // a random order. During dispatching, the records get sent to Analyzer and
 // deleted from Shuffler.
+//
+// If duplicate detection is enabled, an EncryptedMessage that is identical to
+// one that was successfully processed recently is not processed again and OK
+// is returned, so that Encoders retrying after a lost response do not store
+// their Observations twice. If an identical EncryptedMessage is still being
+// processed, Unavailable is returned so that the Encoder retries once its
+// outcome is known.
+//
+// If backpressure is enabled and ingestion is throttled, Unavailable is
+// returned without processing the EncryptedMessage.
+//
+// If forwarding is enabled and the EncryptedMessage is intended for another
+// Shuffler, it is relayed to that Shuffler and its status is returned, so that
+// the Encoder retries until the next Shuffler has accepted it.
 func (s *ShufflerServer) Process(ctx context.Context,
 	encryptedMessage *cobalt.EncryptedMessage) (*shuffler.ShufflerResponse, error) {
 	glog.V(4).Infoln("Process() is invoked.")
+	if forwarded, err := s.forward(ctx, encryptedMessage); forwarded {
+		if err != nil {
+			return nil, err
+		}
+		return &shuffler.ShufflerResponse{}, nil
+	}
+	if s.config.Backpressure != nil {
+		if err := s.config.Backpressure.check(unaryTrailer{ctx}); err != nil {
+			return nil, err
+		}
+	}
+	arrivalTime := time.Now()
+	if s.digests == nil {
+		return s.process(arrivalTime, encryptedMessage)
+	}
+
+	d := computeDigest(encryptedMessage.GetCiphertext())
+	switch s.digests.reserve(d, arrivalTime) {
+	case digestProcessed:
+		glog.V(4).Infoln("Process() received a duplicate envelope, returning OK.")
+		return &shuffler.ShufflerResponse{}, nil
+	case digestInFlight:
+		return nil, grpc.Errorf(codes.Unavailable, "An identical envelope is being processed, retry later.")
+	}
+	response, err := s.process(arrivalTime, encryptedMessage)
+	if err != nil {
+		s.digests.release(d)
+		return nil, err
+	}
+	s.digests.add(d, arrivalTime)
+	return response, nil
+}
+
+// process decrypts |encryptedMessage|, which arrived at |arrivalTime|, and
+// persists the Observations it contains.
+func (s *ShufflerServer) process(arrivalTime time.Time,
+	encryptedMessage *cobalt.EncryptedMessage) (*shuffler.ShufflerResponse, error) {
+	arrival := storage.NewArrival(arrivalTime, s.config.ShufflerInstanceId)
+	batches, err := s.extractBatches(arrivalTime, encryptedMessage)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.persist(batches, arrival); err != nil {
+		return nil, err
+	}
+
+	glog.V(4).Infoln("Process() done, returning OK.")
+	return &shuffler.ShufflerResponse{}, nil
+}
+
+// extractBatches decrypts |encryptedMessage|, which arrived at |arrivalTime|,
+// and returns the ObservationBatches of the Envelope it contains that are to
+// be persisted, which may be none. An error is returned if the Envelope is
+// rejected.
+func (s *ShufflerServer) extractBatches(arrivalTime time.Time,
+	encryptedMessage *cobalt.EncryptedMessage) ([]*cobalt.ObservationBatch, error) {
 	envelope, err := s.decryptEnvelope(encryptedMessage)
+	s.audit(arrivalTime, encryptedMessage, envelope, err)
+	if s.config.Stats != nil {
+		s.config.Stats.record(err)
+	}
 	if err != nil {
 		return nil, err
 	}
 	if len(envelope.GetBatch()) == 0 {
+		if s.config.AcceptEmptyEnvelopes {
+			atomic.AddUint64(&s.numEmptyEnvelopes, 1)
+			glog.V(4).Infoln("Accepted an empty envelope.")
+			return nil, nil
+		}
 		return nil, grpc.Errorf(codes.InvalidArgument, "Empty envelope.")
 	}
 
-	// TODO(ukode): Some notes here for future development:
-	// Check the recipient first. If the request is intended for another Shuffler
-	// do not open the envelope and route it to the next Shuffler directly using
-	// a forwarder thread. Forward the request to the next Shuffler in chain for
-	// further processing. This will be implemented by queueing the request in
-	// a channel that the forwarder can consume and dispatch to the next
-	// Shuffler |envelope.RecipientUrl|.
-
 	// Extract the Observation from the sealed envelope, save it in Shuffler
 	// data store for dispatcher to consume and forward to Analyzer based on
 	// some dispatch criteria. The data store shuffles the order of the
@@ -118,18 +283,84 @@ func (s *ShufflerServer) Process(ctx context.Context,
 			}
 		}
 	}
-	if err := s.store.AddAllObservations(batches, storage.GetDayIndexUtc(time.Now())); err != nil {
-		return nil, err
+	if s.config.MetricDenylist != nil {
+		// The denylist is an emergency kill switch. We return OK so that clients
+		// do not retry sending the dropped Observations.
+		if batches = s.config.MetricDenylist.filter(batches); len(batches) == 0 {
+			glog.V(4).Infoln("Dropped all Observations of the envelope.")
+			return nil, nil
+		}
+	}
+	if s.config.CiphertextSizeLimits != nil {
+		if err := s.config.CiphertextSizeLimits.check(batches); err != nil {
+			return nil, err
+		}
+	}
+	if s.config.Quotas != nil {
+		if err := s.config.Quotas.charge(batches, arrivalTime); err != nil {
+			return nil, err
+		}
 	}
+	if s.config.ObservationSizes != nil {
+		for _, b := range batches {
+			for _, o := range b.GetEncryptedObservation() {
+				s.config.ObservationSizes.Add(b.GetMetaData(), len(o.GetCiphertext()))
+			}
+		}
+	}
+	return batches, nil
+}
 
-	glog.V(4).Infoln("Process() done, returning OK.")
-	return &shuffler.ShufflerResponse{}, nil
+// forward relays |encryptedMessage| to another Shuffler within |ctx| if
+// forwarding is enabled and it is intended for that Shuffler, which is
+// determined without decrypting it. It returns whether |encryptedMessage| is
+// forwarded and, if so, the error of the next Shuffler if it was not accepted.
+func (s *ShufflerServer) forward(ctx context.Context, encryptedMessage *cobalt.EncryptedMessage) (bool, error) {
+	if s.config.Forwarder == nil {
+		return false, nil
+	}
+	address, ok := s.config.Forwarder.route(encryptedMessage)
+	if !ok {
+		return false, nil
+	}
+	glog.V(4).Infof("Forwarding an envelope to %s.", address)
+	return true, s.config.Forwarder.forward(ctx, address, encryptedMessage)
 }
 
-// Run serves incoming encoder requests and blocks forever unless a fatal error
-// occurs in the network layer. Run is invoked by the main() function in
-// shuffler_main and will result in a fatal error if invoked twice within the
-// same process.
+// persist adds the Observations in |batches| to the store in a single write
+// with the given |arrival|.
+func (s *ShufflerServer) persist(batches []*cobalt.ObservationBatch, arrival storage.Arrival) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	if err := s.store.AddAllObservations(batches, arrival); err != nil {
+		return err
+	}
+	if s.config.UsageMeter != nil {
+		s.config.UsageMeter.AddReceived(batches, arrival.DayIndex)
+	}
+	return nil
+}
+
+// NumEmptyEnvelopes returns the number of empty Envelopes that have been
+// accepted as keep-alives since the server was started.
+func (s *ShufflerServer) NumEmptyEnvelopes() uint64 {
+	return atomic.LoadUint64(&s.numEmptyEnvelopes)
+}
+
+// NumDuplicateEnvelopes returns the number of duplicate EncryptedMessages that
+// have been acknowledged without being processed since the server was started.
+func (s *ShufflerServer) NumDuplicateEnvelopes() uint64 {
+	if s.digests == nil {
+		return 0
+	}
+	return s.digests.duplicates()
+}
+
+// Run serves incoming encoder requests and blocks until Shutdown() is invoked
+// or a fatal error occurs in the network layer. Run is invoked by the main()
+// function in shuffler_main and will result in a fatal error if invoked twice
+// within the same process.
 func Run(dataStore storage.Store, config *ServerConfig) {
 	if dataStore == nil {
 		glog.Fatal("Invalid data store handle, exiting.")
@@ -143,11 +374,38 @@ func Run(dataStore storage.Store, config *ServerConfig) {
 		glog.Fatal("Run() must not be invoked twice, exiting.")
 	}
 
+	var log *auditLog
+	if config.AuditLogDir != "" {
+		var err error
+		if log, err = newAuditLog(config.AuditLogDir, config.AuditLogMaxFileSize, config.AuditLogMaxFiles); err != nil {
+			glog.Fatalf("Unable to open the audit log in %s: %v", config.AuditLogDir, err)
+		}
+		defer log.close()
+		glog.Infof("Writing the ingestion audit log to %s.", config.AuditLogDir)
+	}
+
 	// Start shuffler service
 	shufflerServerSingleton = &ShufflerServer{
 		store:     dataStore,
 		config:    *config,
-		decrypter: util.NewMessageDecrypter(config.PrivateKeyPem),
+		decrypter: util.NewMultiKeyMessageDecrypter(config.PrivateKeyPems),
+		auditLog:  log,
+	}
+	if config.PrivateKeySource != nil && len(config.PrivateKeyPems) > 0 {
+		shufflerServerSingleton.privateKeyPem = config.PrivateKeyPems[0]
+	}
+	if config.DuplicateWindow > 0 {
+		glog.Infof("Detecting duplicate envelopes within %v.", config.DuplicateWindow)
+		shufflerServerSingleton.digests = newDigestCache(config.DuplicateWindow, config.DuplicateCacheSize)
+	}
+	if config.PrivateKeySource != nil {
+		go shufflerServerSingleton.pollPrivateKey()
+	}
+	if config.Backpressure != nil {
+		config.Backpressure.Start()
+	}
+	if config.Forwarder != nil {
+		glog.Infof("Forwarding envelopes to %d other Shufflers.", len(config.Forwarder.config.Routes))
 	}
 	shufflerServerSingleton.startServer()
 }
@@ -160,21 +418,33 @@ func (s *ShufflerServer) startServer() {
 		stackdriver.LogCountMetric(startServerFailed, "Grpc: Error in accepting connections on port [", s.config.Port, "]:", err)
 		return
 	}
-	var opts []grpc.ServerOption
+	opts := serverOptions(&s.config)
 	using_tls := false
 	if s.config.EnableTLS {
 		using_tls = true
 		glog.Infof("Reading tls cert file %s and tls key file %s.", s.config.CertFile, s.config.KeyFile)
-		creds, err := credentials.NewServerTLSFromFile(s.config.CertFile, s.config.KeyFile)
+		certs, err := newCertReloader(s.config.CertFile, s.config.KeyFile)
 		if err != nil {
 			stackdriver.LogCountMetric(startServerFailed, "Grpc: Failed to create TLS credentials from files:", err)
 			return
 		}
-		opts = []grpc.ServerOption{grpc.Creds(creds)}
+		if s.config.CertPollInterval > 0 {
+			go certs.poll(s.config.CertPollInterval)
+		}
+		creds := credentials.NewTLS(&tls.Config{GetCertificate: certs.getCertificate})
+		opts = append(opts, grpc.Creds(creds))
 	}
 
 	grpcServer := grpc.NewServer(opts...)
 	shuffler.RegisterShufflerServer(grpcServer, s)
+	if s.config.Health != nil {
+		s.config.Health.register(grpcServer)
+	}
+	if !setRunningServer(grpcServer) {
+		lis.Close()
+		glog.Infoln("The Shuffler is shutting down, not serving.")
+		return
+	}
 	tls_message := "."
 	if using_tls {
 		tls_message = " using TLS."
@@ -184,15 +454,52 @@ func (s *ShufflerServer) startServer() {
 	grpcServer.Serve(lis)
 }
 
+// serverOptions returns the options of the grpc server other than its
+// credentials as specified by |config|.
+func serverOptions(config *ServerConfig) []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if config.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(config.MaxRecvMsgSize))
+	}
+	if config.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(config.MaxConcurrentStreams))
+	}
+	if config.KeepaliveMinTime > 0 {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             config.KeepaliveMinTime,
+			PermitWithoutStream: config.KeepalivePermitWithoutStream,
+		}))
+	}
+	return opts
+}
+
 // decryptEnvelope decrypts the incoming EncryptedMessage and returns an Envelope or an error.
 func (s *ShufflerServer) decryptEnvelope(encryptedMessage *cobalt.EncryptedMessage) (*cobalt.Envelope, error) {
-	if s.decrypter == nil {
+	s.decrypterMu.RLock()
+	decrypter := s.decrypter
+	s.decrypterMu.RUnlock()
+	if decrypter == nil {
 		return nil, grpc.Errorf(codes.Internal, "s.decrypter is nil")
 	}
 	envelope := new(cobalt.Envelope)
-	if err := s.decrypter.DecryptMessage(encryptedMessage, envelope); err != nil {
+	if err := decrypter.DecryptMessage(encryptedMessage, envelope); err != nil {
 		stackdriver.LogCountMetricf(decryptEnvelopeFailed, "Decryption failed: %v", err)
 		return nil, err
 	}
 	return envelope, nil
 }
+
+// audit writes a record of the incoming |encryptedMessage| to the audit log if
+// it is enabled. |envelope| and |decryptErr| are the result of decrypting
+// |encryptedMessage|. Failure to write the audit log is logged but does not
+// fail the request.
+func (s *ShufflerServer) audit(arrivalTime time.Time, encryptedMessage *cobalt.EncryptedMessage,
+	envelope *cobalt.Envelope, decryptErr error) {
+	if s.auditLog == nil {
+		return
+	}
+	record := newAuditRecord(arrivalTime, proto.Size(encryptedMessage), envelope, decryptErr)
+	if err := s.auditLog.write(record); err != nil {
+		stackdriver.LogCountMetricf(auditLogFailed, "Writing the audit log failed: %v", err)
+	}
+}
@@ -17,6 +17,7 @@ package receiver
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -118,11 +119,14 @@ func doTestProcess(t *testing.T, envelope *shufflerpb.Envelope,
 			CertFile:  "",
 			KeyFile:   "",
 			Port:      0,
+
+			ShufflerInstanceId: "shuffler-1",
 		},
 		decrypter: util.NewMessageDecrypter(""),
 	}
 
 	expectErr := len(envelope.GetBatch()) == 0
+	arrivalTime := time.Now().Unix()
 	_, err = shuffler.Process(context.Background(), eMsg)
 
 	if expectErr && err == nil {
@@ -142,8 +146,157 @@ func doTestProcess(t *testing.T, envelope *shufflerpb.Envelope,
 		key := expectedBucketKeys[i]
 		storage.CheckNumObservations(t, shuffler.store, &key, numObservations)
 		storage.CheckGetObservations(t, shuffler.store, &key, batch.GetEncryptedObservation())
+
+		// check the arrival metadata of the stored observations
+		for _, obVal := range storage.CheckObservations(t, shuffler.store, &key, numObservations) {
+			if obVal.ShufflerInstanceId != "shuffler-1" {
+				t.Errorf("got shuffler_instance_id [%v], want [shuffler-1]", obVal.ShufflerInstanceId)
+			}
+			if obVal.ArrivalTimeSeconds < arrivalTime {
+				t.Errorf("got arrival_time_seconds [%d], want at least [%d]", obVal.ArrivalTimeSeconds, arrivalTime)
+			}
+		}
 	}
 
 	// clear store contents before testing a new envelope
 	storage.ResetStoreForTesting(store, true)
 }
+
+func TestProcessAcceptEmptyEnvelopes(t *testing.T) {
+	data, err := proto.Marshal(makeEnvelope(0, 0).envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	eMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+
+	store := storage.NewMemStore()
+	s := &ShufflerServer{
+		store:     store,
+		config:    ServerConfig{AcceptEmptyEnvelopes: true},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.Process(context.Background(), eMsg); err != nil {
+			t.Fatalf("Process() failed for an empty envelope: %v", err)
+		}
+	}
+	if n := s.NumEmptyEnvelopes(); n != 3 {
+		t.Errorf("got %d empty envelopes, want 3", n)
+	}
+	if keys, err := store.GetKeys(); err != nil || len(keys) != 0 {
+		t.Errorf("got keys %v and error %v, want an empty store", keys, err)
+	}
+
+	// Without the option empty envelopes are rejected and not counted.
+	s.config.AcceptEmptyEnvelopes = false
+	if _, err := s.Process(context.Background(), eMsg); err == nil {
+		t.Errorf("expected Process() to return an error for an empty envelope")
+	}
+	if n := s.NumEmptyEnvelopes(); n != 3 {
+		t.Errorf("got %d empty envelopes, want 3", n)
+	}
+}
+
+// Tests that the Observations that are persisted are counted by the
+// UsageMeter.
+func TestProcessMetersUsage(t *testing.T) {
+	envelope := makeEnvelope(2, 3).envelope
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	eMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+
+	store := storage.NewMemStore()
+	s := &ShufflerServer{
+		store:     store,
+		config:    ServerConfig{UsageMeter: storage.NewUsageMeter(store)},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	if _, err := s.Process(context.Background(), eMsg); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+	if err := s.config.UsageMeter.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+
+	var numObservations, numBytes uint64
+	for _, batch := range envelope.GetBatch() {
+		for _, o := range batch.GetEncryptedObservation() {
+			numObservations++
+			numBytes += uint64(len(o.GetCiphertext()))
+		}
+	}
+	usages, err := store.GetUsage()
+	if err != nil {
+		t.Fatalf("GetUsage() failed: %v", err)
+	}
+	var gotObservations, gotBytes uint64
+	for _, usage := range usages {
+		for _, record := range usage.Records {
+			gotObservations += record.NumObservationsReceived
+			gotBytes += record.NumBytesReceived
+		}
+	}
+	if gotObservations != numObservations || gotBytes != numBytes {
+		t.Errorf("got %d observations and %d bytes received, want %d and %d", gotObservations, gotBytes, numObservations, numBytes)
+	}
+}
+
+// Tests that the processed EncryptedMessages and the decryption failures are
+// counted in the ReceiverStats.
+func TestProcessCountsStats(t *testing.T) {
+	data, err := proto.Marshal(makeEnvelope(2, 3).envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	eMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_NONE,
+	}
+	// Without a private key HYBRID_ECDH_V1 messages cannot be decrypted.
+	encryptedMsg := &shufflerpb.EncryptedMessage{
+		Ciphertext: data,
+		Scheme:     shufflerpb.EncryptedMessage_HYBRID_ECDH_V1,
+	}
+
+	s := &ShufflerServer{
+		store:     storage.NewMemStore(),
+		config:    ServerConfig{Stats: &ReceiverStats{}},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Process(context.Background(), eMsg); err != nil {
+			t.Fatalf("Process() failed: %v", err)
+		}
+	}
+	if _, err := s.Process(context.Background(), encryptedMsg); err == nil {
+		t.Errorf("expected Process() to fail without a private key")
+	}
+	if n := s.config.Stats.NumEnvelopes(); n != 3 {
+		t.Errorf("got %d envelopes, want 3", n)
+	}
+	if n := s.config.Stats.NumDecryptionFailures(); n != 1 {
+		t.Errorf("got %d decryption failures, want 1", n)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	if opts := serverOptions(&ServerConfig{}); len(opts) != 0 {
+		t.Errorf("got %d server options for the default config, want 0", len(opts))
+	}
+	opts := serverOptions(&ServerConfig{
+		MaxRecvMsgSize:       16 * 1024 * 1024,
+		MaxConcurrentStreams: 100,
+		KeepaliveMinTime:     time.Minute,
+	})
+	if len(opts) != 3 {
+		t.Errorf("got %d server options, want 3", len(opts))
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+)
+
+var (
+	// serverMu protects |runningServer|, the server started by Run(), and
+	// |shuttingDown|, which is set by Shutdown().
+	serverMu      sync.Mutex
+	runningServer *grpc.Server
+	shuttingDown  bool
+)
+
+// setRunningServer records |server| as the server started by Run(). It returns
+// false if Shutdown() has already been invoked, in which case |server| must
+// not be started.
+func setRunningServer(server *grpc.Server) bool {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+	if shuttingDown {
+		return false
+	}
+	runningServer = server
+	return true
+}
+
+// Shutdown stops the server started by Run(), which then returns. New
+// connections and RPCs are refused at once, while the pending RPCs are given
+// |timeout| to complete before they are cancelled. Shutdown blocks until the
+// server has stopped. If it is invoked before Run() has started the server,
+// Run() returns without serving.
+func Shutdown(timeout time.Duration) {
+	serverMu.Lock()
+	shuttingDown = true
+	server := runningServer
+	serverMu.Unlock()
+	if server == nil {
+		return
+	}
+
+	glog.Infof("Stopping the receiver, draining pending requests for up to %v.", timeout)
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		glog.Warningf("Pending requests did not complete within %v, cancelling them.", timeout)
+		server.Stop()
+		<-stopped
+	}
+	glog.Infoln("The receiver has stopped.")
+}
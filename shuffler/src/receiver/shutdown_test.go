@@ -0,0 +1,64 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that Shutdown() makes startServer() return, and that a server is not
+// started once Shutdown() has been invoked.
+func TestShutdown(t *testing.T) {
+	defer func() {
+		runningServer = nil
+		shuttingDown = false
+	}()
+
+	s := &ShufflerServer{config: ServerConfig{Port: 0}}
+	stopped := make(chan struct{})
+	go func() {
+		s.startServer()
+		close(stopped)
+	}()
+	for {
+		serverMu.Lock()
+		started := runningServer != nil
+		serverMu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	Shutdown(time.Second)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("startServer() did not return after Shutdown()")
+	}
+
+	runningServer = nil
+	stopped = make(chan struct{})
+	go func() {
+		s.startServer()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("startServer() served after Shutdown()")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+	"util/stackdriver"
+)
+
+const oversizeObservation = "reciever-oversize-observation"
+
+// CiphertextSizeLimits holds the largest ciphertext size the receiver accepts
+// for the Observations of each metric. Only the sizes of the ciphertexts are
+// checked; the receiver cannot inspect the plaintexts of Observations.
+type CiphertextSizeLimits struct {
+	limits map[metricKey]int
+}
+
+// NewCiphertextSizeLimits returns the CiphertextSizeLimits given by |limits|.
+// Entries without a metric or without a positive size are ignored.
+func NewCiphertextSizeLimits(limits *shuffler.CiphertextSizeLimits) *CiphertextSizeLimits {
+	l := &CiphertextSizeLimits{
+		limits: make(map[metricKey]int),
+	}
+	for _, limit := range limits.GetLimits() {
+		k := limit.GetMetric()
+		if k == nil || limit.MaxCiphertextSize == 0 {
+			continue
+		}
+		l.limits[metricKey{k.CustomerId, k.ProjectId, k.MetricId}] = int(limit.MaxCiphertextSize)
+	}
+	return l
+}
+
+// check returns an InvalidArgument error describing the first Observation in
+// |batches| whose ciphertext exceeds the limit of its metric, or nil if there
+// is no such Observation.
+func (l *CiphertextSizeLimits) check(batches []*cobalt.ObservationBatch) error {
+	if len(l.limits) == 0 {
+		return nil
+	}
+
+	for _, b := range batches {
+		m := b.GetMetaData()
+		k := metricKey{m.GetCustomerId(), m.GetProjectId(), m.GetMetricId()}
+		limit, ok := l.limits[k]
+		if !ok {
+			continue
+		}
+		for _, o := range b.GetEncryptedObservation() {
+			if size := len(o.GetCiphertext()); size > limit {
+				stackdriver.LogCountMetricf(oversizeObservation,
+					"Rejected an Envelope with a ciphertext of %d bytes for metric %v, which is limited to %d bytes.", size, k, limit)
+				return grpc.Errorf(codes.InvalidArgument,
+					"The ciphertext of an Observation for customer %d, project %d, metric %d has %d bytes but at most %d are allowed.",
+					k.customerId, k.projectId, k.metricId, size, limit)
+			}
+		}
+	}
+	return nil
+}
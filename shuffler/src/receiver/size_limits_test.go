@@ -0,0 +1,92 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	shufflerpb "cobalt"
+	"shuffler"
+	"storage"
+	"util"
+)
+
+// Tests that Process() rejects Envelopes containing an Observation whose
+// ciphertext exceeds the limit of its metric and stores the others.
+func TestProcessWithCiphertextSizeLimits(t *testing.T) {
+	envelopeData := makeEnvelope(2, 3)
+	envelope := envelopeData.envelope
+	// MakeRandomEncryptedMsgs() makes ciphertexts of 10 bytes.
+	limited := envelope.Batch[1].MetaData
+	limits := NewCiphertextSizeLimits(&shuffler.CiphertextSizeLimits{
+		Limits: []*shuffler.CiphertextSizeLimit{{
+			Metric: &shuffler.MetricKey{
+				CustomerId: limited.CustomerId,
+				ProjectId:  limited.ProjectId,
+				MetricId:   limited.MetricId,
+			},
+			MaxCiphertextSize: 10,
+		}},
+	})
+
+	store := storage.NewMemStore()
+	s := &ShufflerServer{
+		store:     store,
+		config:    ServerConfig{CiphertextSizeLimits: limits},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	process := func() error {
+		data, err := proto.Marshal(envelope)
+		if err != nil {
+			t.Fatalf("Error in marshalling envelope data: %v", err)
+		}
+		_, err = s.Process(context.Background(), &shufflerpb.EncryptedMessage{
+			Ciphertext: data,
+			Scheme:     shufflerpb.EncryptedMessage_NONE,
+		})
+		return err
+	}
+
+	// Ciphertexts at the limit are accepted.
+	if err := process(); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+	for i := range envelope.Batch {
+		key := envelopeData.expectedBucketKeys[i]
+		storage.CheckNumObservations(t, store, &key, 3)
+	}
+
+	// A single oversize ciphertext rejects the whole Envelope.
+	envelope.Batch[1].EncryptedObservation[2].Ciphertext = make([]byte, 11)
+	if err := process(); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Process() returned %v, expected InvalidArgument", err)
+	}
+	for i := range envelope.Batch {
+		key := envelopeData.expectedBucketKeys[i]
+		storage.CheckNumObservations(t, store, &key, 3)
+	}
+
+	// Metrics without a limit are not checked.
+	envelope.Batch[1].EncryptedObservation[2].Ciphertext = make([]byte, 10)
+	envelope.Batch[0].EncryptedObservation[0].Ciphertext = make([]byte, 1000)
+	if err := process(); err != nil {
+		t.Fatalf("Process() failed: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync/atomic"
+)
+
+// ReceiverStats counts the EncryptedMessages processed by the receiver since
+// the Shuffler started. It is shared with the admin service, which reports the
+// counts. The zero value is ready to use.
+type ReceiverStats struct {
+	// Accessed atomically.
+	numEnvelopes          uint64
+	numDecryptionFailures uint64
+}
+
+// NumEnvelopes returns the number of EncryptedMessages that have been
+// processed. Duplicates and EncryptedMessages rejected because of backpressure
+// are not processed.
+func (r *ReceiverStats) NumEnvelopes() uint64 {
+	return atomic.LoadUint64(&r.numEnvelopes)
+}
+
+// NumDecryptionFailures returns the number of processed EncryptedMessages that
+// could not be decrypted.
+func (r *ReceiverStats) NumDecryptionFailures() uint64 {
+	return atomic.LoadUint64(&r.numDecryptionFailures)
+}
+
+// record counts an EncryptedMessage that has been processed. |decryptErr| is
+// the result of its decryption.
+func (r *ReceiverStats) record(decryptErr error) {
+	atomic.AddUint64(&r.numEnvelopes, 1)
+	if decryptErr != nil {
+		atomic.AddUint64(&r.numDecryptionFailures, 1)
+	}
+}
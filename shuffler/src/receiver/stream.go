@@ -0,0 +1,149 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+)
+
+// ProcessStream processes the EncryptedMessages sent in the EnvelopeChunks of
+// |stream|. The chunks of each EncryptedMessage are reassembled and the
+// Envelope it contains is handled as by Process(), except that the
+// Observations of all the Envelopes are persisted together in a single write
+// once the stream is complete. If any of the Envelopes is rejected the stream
+// fails and none of its Observations are persisted, although the quotas
+// charged for the Envelopes that preceded it are not refunded.
+//
+// If duplicate detection is enabled, EncryptedMessages that are identical to
+// one that was successfully processed recently, or to an earlier one of the
+// stream, are skipped. The stream is rejected with Unavailable if an identical
+// EncryptedMessage is still being processed.
+//
+// If |MaxStreamSize| is set, a stream whose EncryptedMessages exceed it is
+// rejected with ResourceExhausted.
+//
+// If forwarding is enabled, the EncryptedMessages intended for another
+// Shuffler are relayed to it as soon as they are reassembled, and the stream
+// fails with the status of the next Shuffler if one is not accepted. The
+// EncryptedMessages relayed before a stream fails are relayed again when the
+// Encoder retries it, and are skipped by the next Shuffler if it detects
+// duplicates.
+func (s *ShufflerServer) ProcessStream(stream shuffler.Shuffler_ProcessStreamServer) error {
+	glog.V(4).Infoln("ProcessStream() is invoked.")
+	if s.config.Backpressure != nil {
+		if err := s.config.Backpressure.check(stream); err != nil {
+			return err
+		}
+	}
+	arrivalTime := time.Now()
+	arrival := storage.NewArrival(arrivalTime, s.config.ShufflerInstanceId)
+
+	var batches []*cobalt.ObservationBatch
+	// The digests reserved for this stream, which are released if it fails.
+	var digests []digest
+	defer func() {
+		for _, d := range digests {
+			s.digests.release(d)
+		}
+	}()
+	seen := make(map[digest]bool)
+	numMessages := 0
+	streamSize := 0
+
+	// The EncryptedMessage whose chunks are being received, if any.
+	var pending *cobalt.EncryptedMessage
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		m := chunk.GetEncryptedMessage()
+		streamSize += len(m.GetCiphertext())
+		if s.config.MaxStreamSize > 0 && streamSize > s.config.MaxStreamSize {
+			return grpc.Errorf(codes.ResourceExhausted, "The stream exceeds the limit of %d bytes.", s.config.MaxStreamSize)
+		}
+		if pending == nil {
+			pending = &cobalt.EncryptedMessage{
+				Scheme:               m.GetScheme(),
+				PublicKeyFingerprint: m.GetPublicKeyFingerprint(),
+			}
+		}
+		pending.Ciphertext = append(pending.Ciphertext, m.GetCiphertext()...)
+		if !chunk.GetLastChunk() {
+			continue
+		}
+
+		encryptedMessage := pending
+		pending = nil
+		numMessages++
+		if forwarded, err := s.forward(stream.Context(), encryptedMessage); forwarded {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if s.digests != nil {
+			d := computeDigest(encryptedMessage.GetCiphertext())
+			if seen[d] {
+				glog.V(4).Infoln("ProcessStream() received a duplicate envelope, skipping it.")
+				continue
+			}
+			switch s.digests.reserve(d, arrivalTime) {
+			case digestProcessed:
+				glog.V(4).Infoln("ProcessStream() received a duplicate envelope, skipping it.")
+				continue
+			case digestInFlight:
+				return grpc.Errorf(codes.Unavailable, "An identical envelope is being processed, retry later.")
+			}
+			seen[d] = true
+			digests = append(digests, d)
+		}
+		envelopeBatches, err := s.extractBatches(arrivalTime, encryptedMessage)
+		if err != nil {
+			return err
+		}
+		batches = append(batches, envelopeBatches...)
+	}
+
+	if pending != nil {
+		return grpc.Errorf(codes.InvalidArgument, "The stream ended before the last chunk of an EncryptedMessage.")
+	}
+	if numMessages == 0 {
+		return grpc.Errorf(codes.InvalidArgument, "The stream contains no EncryptedMessage.")
+	}
+	if err := s.persist(batches, arrival); err != nil {
+		return err
+	}
+	for _, d := range digests {
+		s.digests.add(d, arrivalTime)
+	}
+	digests = nil
+
+	glog.V(4).Infof("ProcessStream() done with %d envelopes, returning OK.", numMessages)
+	return stream.SendAndClose(&shuffler.ShufflerResponse{})
+}
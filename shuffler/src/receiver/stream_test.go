@@ -0,0 +1,246 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"cobalt"
+	"shuffler"
+	"storage"
+	"util"
+)
+
+// fakeProcessStream is a Shuffler_ProcessStreamServer that returns |chunks|
+// and then io.EOF.
+type fakeProcessStream struct {
+	grpc.ServerStream
+	chunks   []*shuffler.EnvelopeChunk
+	response *shuffler.ShufflerResponse
+	trailer  metadata.MD
+}
+
+func (f *fakeProcessStream) Context() context.Context {
+	return context.Background()
+}
+
+func (f *fakeProcessStream) Recv() (*shuffler.EnvelopeChunk, error) {
+	if len(f.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := f.chunks[0]
+	f.chunks = f.chunks[1:]
+	return chunk, nil
+}
+
+func (f *fakeProcessStream) SetTrailer(md metadata.MD) {
+	f.trailer = metadata.Join(f.trailer, md)
+}
+
+func (f *fakeProcessStream) SendAndClose(response *shuffler.ShufflerResponse) error {
+	f.response = response
+	return nil
+}
+
+// makeChunks returns the EnvelopeChunks of an unencrypted EncryptedMessage
+// containing |envelope|, with ciphertexts of at most |chunkSize| bytes.
+func makeChunks(t *testing.T, envelope *cobalt.Envelope, chunkSize int) []*shuffler.EnvelopeChunk {
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Error in marshalling envelope data: %v", err)
+	}
+	var chunks []*shuffler.EnvelopeChunk
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, &shuffler.EnvelopeChunk{
+			EncryptedMessage: &cobalt.EncryptedMessage{
+				Ciphertext: data[:n],
+				Scheme:     cobalt.EncryptedMessage_NONE,
+			},
+			LastChunk: n == len(data),
+		})
+		data = data[n:]
+	}
+	return chunks
+}
+
+// countObservations returns the total number of Observations in |store|.
+func countObservations(t *testing.T, store storage.Store) int {
+	keys, err := store.GetKeys()
+	if err != nil {
+		t.Fatalf("GetKeys() failed: %v", err)
+	}
+	total := 0
+	for _, key := range keys {
+		n, err := store.GetNumObservations(key)
+		if err != nil {
+			t.Fatalf("GetNumObservations() failed: %v", err)
+		}
+		total += n
+	}
+	return total
+}
+
+// Tests that the chunks of several Envelopes sent with ProcessStream() are
+// reassembled and that all of their Observations are persisted.
+func TestProcessStream(t *testing.T) {
+	stream := &fakeProcessStream{}
+	stream.chunks = append(makeChunks(t, makeEnvelope(2, 3).envelope, 100), makeChunks(t, makeEnvelope(3, 4).envelope, 1000000)...)
+	if len(stream.chunks) < 3 {
+		t.Fatalf("got %d chunks, expected the first envelope to be split", len(stream.chunks))
+	}
+
+	s := &ShufflerServer{
+		store:     storage.NewMemStore(),
+		config:    ServerConfig{Stats: &ReceiverStats{}},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	if err := s.ProcessStream(stream); err != nil {
+		t.Fatalf("ProcessStream() failed: %v", err)
+	}
+	if stream.response == nil {
+		t.Errorf("expected a response")
+	}
+	if n := countObservations(t, s.store); n != 2*3+3*4 {
+		t.Errorf("got %d observations, want %d", n, 2*3+3*4)
+	}
+	if n := s.config.Stats.NumEnvelopes(); n != 2 {
+		t.Errorf("got %d envelopes, want 2", n)
+	}
+}
+
+// Tests that no Observations are persisted if any Envelope of the stream is
+// rejected or the stream is incomplete.
+func TestProcessStreamIsTransactional(t *testing.T) {
+	valid := makeChunks(t, makeEnvelope(2, 3).envelope, 1000000)
+	empty := makeChunks(t, makeEnvelope(0, 0).envelope, 1000000)
+	incomplete := makeChunks(t, makeEnvelope(1, 1).envelope, 10)
+	incomplete = incomplete[:len(incomplete)-1]
+
+	for _, test := range []struct {
+		name   string
+		chunks []*shuffler.EnvelopeChunk
+		code   codes.Code
+	}{
+		{"rejected envelope", append(append([]*shuffler.EnvelopeChunk{}, valid...), empty...), codes.InvalidArgument},
+		{"incomplete envelope", append(append([]*shuffler.EnvelopeChunk{}, valid...), incomplete...), codes.InvalidArgument},
+		{"no envelope", nil, codes.InvalidArgument},
+	} {
+		s := &ShufflerServer{
+			store:     storage.NewMemStore(),
+			decrypter: util.NewMessageDecrypter(""),
+		}
+		err := s.ProcessStream(&fakeProcessStream{chunks: test.chunks})
+		if grpc.Code(err) != test.code {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.code)
+		}
+		if n := countObservations(t, s.store); n != 0 {
+			t.Errorf("%s: got %d observations, want none", test.name, n)
+		}
+	}
+}
+
+// Tests that streams exceeding MaxStreamSize are rejected.
+func TestProcessStreamMaxStreamSize(t *testing.T) {
+	chunks := makeChunks(t, makeEnvelope(2, 3).envelope, 50)
+	size := 0
+	for _, c := range chunks {
+		size += len(c.EncryptedMessage.Ciphertext)
+	}
+
+	s := &ShufflerServer{
+		store:     storage.NewMemStore(),
+		config:    ServerConfig{MaxStreamSize: size - 1},
+		decrypter: util.NewMessageDecrypter(""),
+	}
+	if err := s.ProcessStream(&fakeProcessStream{chunks: chunks}); grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got error %v, want %v", err, codes.ResourceExhausted)
+	}
+
+	s.config.MaxStreamSize = size
+	if err := s.ProcessStream(&fakeProcessStream{chunks: chunks}); err != nil {
+		t.Errorf("ProcessStream() failed: %v", err)
+	}
+}
+
+// Tests that duplicate EncryptedMessages within a stream and across streams
+// are persisted only once.
+func TestProcessStreamSkipsDuplicates(t *testing.T) {
+	chunks := makeChunks(t, makeEnvelope(2, 3).envelope, 1000000)
+	s := &ShufflerServer{
+		store:     storage.NewMemStore(),
+		decrypter: util.NewMessageDecrypter(""),
+		digests:   newDigestCache(time.Hour, 100),
+	}
+	if err := s.ProcessStream(&fakeProcessStream{chunks: append(append([]*shuffler.EnvelopeChunk{}, chunks...), chunks...)}); err != nil {
+		t.Fatalf("ProcessStream() failed: %v", err)
+	}
+	if err := s.ProcessStream(&fakeProcessStream{chunks: chunks}); err != nil {
+		t.Fatalf("ProcessStream() failed: %v", err)
+	}
+	if n := countObservations(t, s.store); n != 2*3 {
+		t.Errorf("got %d observations, want %d", n, 2*3)
+	}
+	if n := s.NumDuplicateEnvelopes(); n != 1 {
+		t.Errorf("got %d duplicates, want 1", n)
+	}
+}
+
+// Tests that the digests reserved by a stream are released if it fails and
+// that a stream is rejected while an identical envelope is being processed.
+func TestProcessStreamReleasesDigests(t *testing.T) {
+	chunks := makeChunks(t, makeEnvelope(2, 3).envelope, 1000000)
+	var ciphertext []byte
+	for _, c := range chunks {
+		ciphertext = append(ciphertext, c.GetEncryptedMessage().GetCiphertext()...)
+	}
+	s := &ShufflerServer{
+		store:     storage.NewMemStore(),
+		decrypter: util.NewMessageDecrypter(""),
+		digests:   newDigestCache(time.Hour, 100),
+	}
+
+	rejected := makeChunks(t, makeEnvelope(0, 0).envelope, 1000000)
+	if err := s.ProcessStream(&fakeProcessStream{chunks: append(append([]*shuffler.EnvelopeChunk{}, chunks...), rejected...)}); err == nil {
+		t.Fatalf("expected ProcessStream() to fail for an empty envelope")
+	}
+
+	d := computeDigest(ciphertext)
+	if r := s.digests.reserve(d, time.Now()); r != digestReserved {
+		t.Fatalf("the digest of the failed stream was not released: got %v", r)
+	}
+	if err := s.ProcessStream(&fakeProcessStream{chunks: chunks}); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("ProcessStream() of an envelope in flight returned %v, expected Unavailable", err)
+	}
+	s.digests.release(d)
+
+	if err := s.ProcessStream(&fakeProcessStream{chunks: chunks}); err != nil {
+		t.Fatalf("ProcessStream() failed: %v", err)
+	}
+	if n := countObservations(t, s.store); n != 2*3 {
+		t.Errorf("got %d observations, want %d", n, 2*3)
+	}
+}
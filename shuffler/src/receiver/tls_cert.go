@@ -0,0 +1,116 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"util/stackdriver"
+)
+
+const (
+	reloadTLSCertFailed = "reciever-reload-tls-cert-failed"
+)
+
+// certReloader serves the TLS certificate read from |certFile| and |keyFile|
+// and reloads it when either file changes, so that a renewed certificate takes
+// effect for new connections without restarting the Shuffler.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	// mu protects the fields below.
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// The modification times of |certFile| and |keyFile| when |cert| was read.
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// newCertReloader returns a certReloader for the certificate in |certFile|
+// and its private key in |keyFile|, or an error if they cannot be read.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// getCertificate returns the current certificate. It is used as the
+// GetCertificate callback of the server's tls.Config.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload reads the certificate and key files again if either of them has been
+// modified since they were last read. It returns true if the certificate was
+// replaced. If the files cannot be read or do not contain a valid key pair the
+// current certificate is kept and an error is returned.
+func (r *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
+
+// poll invokes reload() once every |interval|. It never returns.
+func (r *certReloader) poll(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		replaced, err := r.reload()
+		if err != nil {
+			stackdriver.LogCountMetricf(reloadTLSCertFailed, "Unable to reload the TLS cert file %s and key file %s, keeping the current certificate: %v",
+				r.certFile, r.keyFile, err)
+			continue
+		}
+		if replaced {
+			glog.Infof("The TLS cert file %s or key file %s has changed. Using the new certificate.", r.certFile, r.keyFile)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a new self-signed certificate for |commonName|
+// and its private key to |certFile| and |keyFile| and sets their modification
+// time to |modTime|.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() failed: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() failed: %v", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// commonName returns the common name of the certificate currently served by
+// |r|.
+func commonName(t *testing.T, r *certReloader) string {
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("getCertificate() failed: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() failed: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receiver_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+
+	writeSelfSignedCert(t, certFile, keyFile, "first", start)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader() failed: %v", err)
+	}
+	if got := commonName(t, r); got != "first" {
+		t.Errorf("got certificate for [%s], want [first]", got)
+	}
+
+	// Nothing changed.
+	if replaced, err := r.reload(); replaced || err != nil {
+		t.Errorf("reload() returned (%v, %v), want (false, nil)", replaced, err)
+	}
+
+	// A renewed certificate is picked up.
+	writeSelfSignedCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	if replaced, err := r.reload(); !replaced || err != nil {
+		t.Errorf("reload() returned (%v, %v), want (true, nil)", replaced, err)
+	}
+	if got := commonName(t, r); got != "second" {
+		t.Errorf("got certificate for [%s], want [second]", got)
+	}
+
+	// A broken key pair is rejected and the current certificate is kept.
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if replaced, err := r.reload(); replaced || err == nil {
+		t.Errorf("reload() returned (%v, %v), want (false, error)", replaced, err)
+	}
+	if got := commonName(t, r); got != "second" {
+		t.Errorf("got certificate for [%s], want [second]", got)
+	}
+
+	// Missing files are an error.
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Errorf("newCertReloader() succeeded for a missing cert file")
+	}
+}
@@ -20,8 +20,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 
 	"shuffler"
@@ -29,6 +32,8 @@ import (
 
 // LoadConfig reads Shuffler configuration params from a text file
 // |configFileName|, deserializes them to |ShufflerConfig| proto and returns it.
+// The file is in the JSON format if its name ends in ".json" and in the text
+// format otherwise.
 func LoadConfig(configFileName string) (*shuffler.ShufflerConfig, error) {
 	if configFileName == "" {
 		return nil, errors.New("Provide a valid Shuffler config file")
@@ -40,16 +45,147 @@ func LoadConfig(configFileName string) (*shuffler.ShufflerConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	config := &shuffler.ShufflerConfig{}
 	serializedBytes, err := ioutil.ReadFile(configFileName)
 	if err != nil {
+		return &shuffler.ShufflerConfig{}, err
+	}
+	if strings.ToLower(filepath.Ext(configFileName)) == ".json" {
+		return parseConfig(string(serializedBytes), jsonFormat)
+	}
+	return parseConfig(string(serializedBytes), textFormat)
+}
+
+// LoadConfigFromEnv reads Shuffler configuration params from the environment
+// variable |name|, which holds a |ShufflerConfig| proto in the JSON format if
+// its value starts with "{" and in the text format otherwise, and returns it.
+// This allows deployment tooling to pass the config without writing a file.
+func LoadConfigFromEnv(name string) (*shuffler.ShufflerConfig, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("The environment variable %s is not set", name)
+	}
+	glog.Info("Will read Shuffler configuration from the environment variable ", name, ".")
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		return parseConfig(value, jsonFormat)
+	}
+	return parseConfig(value, textFormat)
+}
+
+// The serialization formats of a |ShufflerConfig|.
+type configFormat int
+
+const (
+	textFormat configFormat = iota
+	jsonFormat
+)
+
+// parseConfig deserializes |serialized| in |format| to a |ShufflerConfig|
+// proto and checks it. All formats are subject to the same checks: fields that
+// are not part of a |ShufflerConfig| are rejected, the |global_config| must
+// be set and the |policy_overrides| and the |quotas| must be valid.
+func parseConfig(serialized string, format configFormat) (*shuffler.ShufflerConfig, error) {
+	config := &shuffler.ShufflerConfig{}
+	var err error
+	switch format {
+	case jsonFormat:
+		err = jsonpb.UnmarshalString(serialized, config)
+	default:
+		err = proto.UnmarshalText(serialized, config)
+	}
+	if err != nil {
+		return config, err
+	}
+	if config.GlobalConfig == nil {
+		return config, errors.New("The Shuffler config has no global_config")
+	}
+	if err := checkPolicyOverrides(config); err != nil {
 		return config, err
 	}
-	err = proto.UnmarshalText(string(serializedBytes), config)
-	if err == nil {
-		glog.Info("Successfully read the following configuration: ", toString(config))
+	if err := checkQuotas(config); err != nil {
+		return config, err
+	}
+	if err := CheckAnalyzerRetryPolicy(config.GlobalConfig.AnalyzerRetryPolicy); err != nil {
+		return config, err
+	}
+	glog.Info("Successfully read the following configuration: ", toString(config))
+	return config, nil
+}
+
+// checkPolicyOverrides checks that each of the |policy_overrides| in |config|
+// has a policy and identifies a customer, a project or a metric, and that
+// there is at most one override for each of them.
+func checkPolicyOverrides(config *shuffler.ShufflerConfig) error {
+	seen := make(map[[3]uint32]bool)
+	for _, o := range config.PolicyOverrides {
+		m := o.GetMetrics()
+		if m == nil || m.CustomerId == 0 || (m.ProjectId == 0 && m.MetricId != 0) {
+			return fmt.Errorf("The policy override for [%v] does not identify a customer, a project or a metric", m)
+		}
+		if o.Policy == nil {
+			return fmt.Errorf("The policy override for [%v] has no policy", m)
+		}
+		key := [3]uint32{m.CustomerId, m.ProjectId, m.MetricId}
+		if seen[key] {
+			return fmt.Errorf("There are several policy overrides for [%v]", m)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// checkQuotas checks that each of the |quotas| in |config| identifies a
+// customer or a project and has a positive limit, and that there is at most
+// one quota for each of them.
+func checkQuotas(config *shuffler.ShufflerConfig) error {
+	seen := make(map[[2]uint32]bool)
+	for _, q := range config.Quotas {
+		if q.CustomerId == 0 {
+			return fmt.Errorf("The quota [%v] does not identify a customer or a project", q)
+		}
+		if q.MaxEnvelopesPerHour == 0 && q.MaxObservationsPerDay == 0 {
+			return fmt.Errorf("The quota [%v] has no limit", q)
+		}
+		key := [2]uint32{q.CustomerId, q.ProjectId}
+		if seen[key] {
+			return fmt.Errorf("There are several quotas for customer %d, project %d", q.CustomerId, q.ProjectId)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// CheckAnalyzerRetryPolicy checks that |policy|, which may be nil, has a
+// |backoff_multiplier| of at least 1.0 if set and a |jitter| in the range
+// [0.0, 1.0].
+func CheckAnalyzerRetryPolicy(policy *shuffler.AnalyzerRetryPolicy) error {
+	if m := policy.GetBackoffMultiplier(); m != 0 && m < 1 {
+		return fmt.Errorf("The backoff_multiplier %v of the analyzer retry policy is smaller than 1.0", m)
+	}
+	if j := policy.GetJitter(); j < 0 || j > 1 {
+		return fmt.Errorf("The jitter %v of the analyzer retry policy is not in the range [0.0, 1.0]", j)
+	}
+	return nil
+}
+
+// LoadCiphertextSizeLimits reads the ciphertext size limits enforced by the
+// receiver from a text file |fileName| and deserializes them to a
+// |CiphertextSizeLimits| proto.
+func LoadCiphertextSizeLimits(fileName string) (*shuffler.CiphertextSizeLimits, error) {
+	if fileName == "" {
+		return nil, errors.New("Provide a valid ciphertext size limits file")
+	}
+
+	glog.Info("Will read the ciphertext size limits from ", fileName, ".")
+	serializedBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	limits := &shuffler.CiphertextSizeLimits{}
+	if err := proto.UnmarshalText(string(serializedBytes), limits); err != nil {
+		return nil, err
 	}
-	return config, err
+	glog.Infof("Successfully read the ciphertext size limits of %d metrics.", len(limits.Limits))
+	return limits, nil
 }
 
 func toString(config *shuffler.ShufflerConfig) string {
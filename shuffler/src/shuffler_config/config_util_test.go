@@ -23,6 +23,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+
 	"shuffler"
 )
 
@@ -155,3 +157,199 @@ func TestLoadConfigWithInvalidTestConfig(t *testing.T) {
 		t.Errorf("Error expected for invalid config data.")
 	}
 }
+
+// TestLoadCiphertextSizeLimits validates loading of a ciphertext size limits
+// file.
+func TestLoadCiphertextSizeLimits(t *testing.T) {
+	fileName := getTmpFile()
+	defer os.Remove(fileName)
+
+	in := &shuffler.CiphertextSizeLimits{
+		Limits: []*shuffler.CiphertextSizeLimit{{
+			Metric:            &shuffler.MetricKey{CustomerId: 1, ProjectId: 2, MetricId: 3},
+			MaxCiphertextSize: 512,
+		}},
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("Error creating the limits file: %v", err)
+	}
+	if err := proto.MarshalText(f, in); err != nil {
+		t.Fatalf("Error writing the limits file: %v", err)
+	}
+	f.Close()
+
+	out, err := LoadCiphertextSizeLimits(fileName)
+	if err != nil {
+		t.Fatalf("Error loading the limits file: %v", err)
+	}
+	if !proto.Equal(out, in) {
+		t.Errorf("Got response: %v, expecting: %v", out, in)
+	}
+
+	if _, err := LoadCiphertextSizeLimits(filepath.Join(os.TempDir(), "no_such_cobalt_limits.txt")); err == nil {
+		t.Errorf("Loaded a missing limits file")
+	}
+}
+
+// TestLoadJSONConfig validates loading of a config file in the JSON format.
+func TestLoadJSONConfig(t *testing.T) {
+	configFileName := strings.TrimSuffix(getTmpFile(), ".txt") + ".json"
+	defer os.Remove(configFileName)
+
+	f, err := os.Create(configFileName)
+	if err != nil {
+		t.Fatalf("Error creating the config file: %v", err)
+	}
+	f.WriteString(`{"globalConfig": {"frequencyInHours": 2, "threshold": 200, "analyzer_url": "localhost"}}`)
+	f.Close()
+
+	got, err := LoadConfig(configFileName)
+	if err != nil {
+		t.Fatalf("Error loading the config file: %v", err)
+	}
+	want := &shuffler.ShufflerConfig{
+		GlobalConfig: &shuffler.Policy{
+			FrequencyInHours: 2,
+			Threshold:        200,
+			AnalyzerUrl:      "localhost",
+		},
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("Got response: %v, expecting: %v", got, want)
+	}
+}
+
+// TestLoadConfigFromEnv validates loading of a config in the JSON and the text
+// format from an environment variable and that the same checks apply to both.
+func TestLoadConfigFromEnv(t *testing.T) {
+	const name = "COBALT_SHUFFLER_CONFIG_TEST"
+	defer os.Unsetenv(name)
+
+	want := &shuffler.ShufflerConfig{
+		GlobalConfig: &shuffler.Policy{FrequencyInHours: 24, Threshold: 10, DisposalAgeDays: 4},
+	}
+	for _, value := range []string{
+		` {"globalConfig": {"frequencyInHours": 24, "threshold": 10, "disposalAgeDays": 4}}`,
+		`global_config: { frequency_in_hours: 24 threshold: 10 disposal_age_days: 4 }`,
+	} {
+		os.Setenv(name, value)
+		got, err := LoadConfigFromEnv(name)
+		if err != nil {
+			t.Errorf("Error loading the config [%s]: %v", value, err)
+		} else if !proto.Equal(got, want) {
+			t.Errorf("Got response: %v, expecting: %v", got, want)
+		}
+	}
+
+	for _, value := range []string{
+		`{"globalConfig": {"frequencyInHours": "often"}}`,
+		`{"globalConfig": {"frequencyInHours": 24}, "unknownField": 1}`,
+		`{}`,
+		`global_config: { unknown_field: 1 }`,
+		`metric_denylist: {}`,
+	} {
+		os.Setenv(name, value)
+		if _, err := LoadConfigFromEnv(name); err == nil {
+			t.Errorf("Error expected for the invalid config [%s].", value)
+		}
+	}
+
+	os.Unsetenv(name)
+	if _, err := LoadConfigFromEnv(name); err == nil {
+		t.Errorf("Error expected for an unset environment variable.")
+	}
+}
+
+// TestLoadConfigWithPolicyOverrides validates that valid policy overrides are
+// loaded and that invalid ones are rejected.
+func TestLoadConfigWithPolicyOverrides(t *testing.T) {
+	const name = "COBALT_SHUFFLER_CONFIG_TEST"
+	defer os.Unsetenv(name)
+
+	const global = `global_config: { frequency_in_hours: 24 threshold: 10 } `
+	os.Setenv(name, global+`
+policy_overrides: { metrics: { customer_id: 1 } policy: { threshold: 20 } }
+policy_overrides: { metrics: { customer_id: 1 project_id: 2 } policy: { threshold: 30 } }
+policy_overrides: { metrics: { customer_id: 1 project_id: 2 metric_id: 3 } policy: { frequency_in_hours: 1 threshold: 100 } }`)
+	config, err := LoadConfigFromEnv(name)
+	if err != nil {
+		t.Fatalf("Error loading the config: %v", err)
+	}
+	if n := len(config.PolicyOverrides); n != 3 {
+		t.Errorf("Got %d policy overrides, expecting 3", n)
+	}
+
+	for _, overrides := range []string{
+		`policy_overrides: { policy: { threshold: 20 } }`,
+		`policy_overrides: { metrics: { project_id: 2 } policy: { threshold: 20 } }`,
+		`policy_overrides: { metrics: { customer_id: 1 metric_id: 3 } policy: { threshold: 20 } }`,
+		`policy_overrides: { metrics: { customer_id: 1 } }`,
+		`policy_overrides: { metrics: { customer_id: 1 } policy: { threshold: 20 } }
+policy_overrides: { metrics: { customer_id: 1 } policy: { threshold: 30 } }`,
+	} {
+		os.Setenv(name, global+overrides)
+		if _, err := LoadConfigFromEnv(name); err == nil {
+			t.Errorf("Error expected for the invalid policy overrides [%s].", overrides)
+		}
+	}
+}
+
+// TestLoadConfigWithQuotas validates that valid quotas are loaded and that
+// invalid ones are rejected.
+func TestLoadConfigWithQuotas(t *testing.T) {
+	const name = "COBALT_SHUFFLER_CONFIG_TEST"
+	defer os.Unsetenv(name)
+
+	const global = `global_config: { frequency_in_hours: 24 threshold: 10 } `
+	os.Setenv(name, global+`
+quotas: { customer_id: 1 max_observations_per_day: 1000000 }
+quotas: { customer_id: 1 project_id: 2 max_envelopes_per_hour: 1000 }`)
+	config, err := LoadConfigFromEnv(name)
+	if err != nil {
+		t.Fatalf("Error loading the config: %v", err)
+	}
+	if n := len(config.Quotas); n != 2 {
+		t.Errorf("Got %d quotas, expecting 2", n)
+	}
+
+	for _, quotas := range []string{
+		`quotas: { project_id: 2 max_envelopes_per_hour: 1000 }`,
+		`quotas: { customer_id: 1 }`,
+		`quotas: { customer_id: 1 max_envelopes_per_hour: 1000 }
+quotas: { customer_id: 1 max_observations_per_day: 1000 }`,
+	} {
+		os.Setenv(name, global+quotas)
+		if _, err := LoadConfigFromEnv(name); err == nil {
+			t.Errorf("Error expected for the invalid quotas [%s].", quotas)
+		}
+	}
+}
+
+// TestLoadConfigWithAnalyzerRetryPolicy validates that a valid analyzer retry
+// policy is loaded and that invalid ones are rejected.
+func TestLoadConfigWithAnalyzerRetryPolicy(t *testing.T) {
+	const name = "COBALT_SHUFFLER_CONFIG_TEST"
+	defer os.Unsetenv(name)
+
+	os.Setenv(name, `global_config: { frequency_in_hours: 24 threshold: 10
+analyzer_retry_policy: { max_attempts: 6 backoff_multiplier: 1.5 jitter: 0.2 circuit_breaker_threshold: 10 } }`)
+	config, err := LoadConfigFromEnv(name)
+	if err != nil {
+		t.Fatalf("Error loading the config: %v", err)
+	}
+	if p := config.GlobalConfig.AnalyzerRetryPolicy; p.GetMaxAttempts() != 6 || p.GetCircuitBreakerThreshold() != 10 {
+		t.Errorf("Got analyzer retry policy [%v]", p)
+	}
+
+	for _, policy := range []string{
+		`analyzer_retry_policy: { backoff_multiplier: 0.5 }`,
+		`analyzer_retry_policy: { jitter: -0.1 }`,
+		`analyzer_retry_policy: { jitter: 1.5 }`,
+	} {
+		os.Setenv(name, `global_config: { frequency_in_hours: 24 threshold: 10 `+policy+` }`)
+		if _, err := LoadConfigFromEnv(name); err == nil {
+			t.Errorf("Error expected for the invalid analyzer retry policy [%s].", policy)
+		}
+	}
+}
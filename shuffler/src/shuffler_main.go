@@ -15,19 +15,34 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"receiver"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"admin"
+	"cobalt"
 	"dispatcher"
 	"shuffler"
 	"shuffler_config"
+	"snapshot"
 	"storage"
+	"util"
 	"util/stackdriver"
 
 	"github.com/golang/glog"
+	"github.com/gomodule/redigo/redis"
+	_ "github.com/lib/pq"
 )
 
 var (
@@ -40,40 +55,229 @@ var (
 	keyFile  = flag.String("key_file", "", "The TLS key file")
 	port     = flag.Int("port", 50051, "The server port")
 
+	certPollMinutes = flag.Int("cert_poll_minutes", 0, "If positive and -tls is set, -cert_file and -key_file are checked for a renewed certificate this often")
+
+	ciphertextSizeLimitsFile = flag.String("ciphertext_size_limits_file", "", "If specified, a text file containing a "+
+		"CiphertextSizeLimits proto. Envelopes containing an Observation whose ciphertext exceeds the limit of its metric are rejected.")
+
+	acceptEmptyEnvelopes = flag.Bool("accept_empty_envelopes", false, "If true, Envelopes without Observations are accepted as keep-alives from Encoders instead of being rejected")
+
+	// duplicate envelope detection flags
+	duplicateWindowSeconds = flag.Int("duplicate_window_seconds", 0, "If positive, an Envelope that is re-sent with an identical ciphertext within this many seconds of being stored is acknowledged without being stored again")
+	duplicateCacheSize     = flag.Int("duplicate_cache_size", 100000, "The number of recent Envelope digests kept for -duplicate_window_seconds")
+
+	// ingestion backpressure flags
+	backpressureMaxObservations    = flag.Int64("backpressure_max_observations", 0, "If positive, incoming Envelopes are rejected with UNAVAILABLE once the store holds this many Observations")
+	backpressureResumeObservations = flag.Int64("backpressure_resume_observations", 0, "Ingestion resumes once the store holds fewer than this many Observations. Defaults to 90% of -backpressure_max_observations")
+	backpressureMaxDiskMB          = flag.Int64("backpressure_max_disk_mb", 0, "If positive, incoming Envelopes are rejected with UNAVAILABLE once the persistent stores take up this many megabytes on disk")
+	backpressureResumeDiskMB       = flag.Int64("backpressure_resume_disk_mb", 0, "Ingestion resumes once the persistent stores take up fewer than this many megabytes. Defaults to 90% of -backpressure_max_disk_mb")
+	backpressurePollSeconds        = flag.Int("backpressure_poll_seconds", 30, "How often the backlog of the store is measured for -backpressure_max_observations and -backpressure_max_disk_mb")
+	backpressureRetryAfterSeconds  = flag.Int("backpressure_retry_after_seconds", 600, "The number of seconds after which throttled Encoders are asked to retry")
+
+	// grpc server option flags
+	maxRecvMsgSize               = flag.Int("max_recv_msg_size", 0, "If positive, the maximum size in bytes of an incoming request. Defaults to gRPC's limit of 4 MiB")
+	maxStreamSize                = flag.Int("max_stream_size", 64*1024*1024, "If positive, the maximum total size in bytes of the envelopes sent in a single ProcessStream call")
+	maxConcurrentStreams         = flag.Uint("max_concurrent_streams", 0, "If positive, the maximum number of concurrent streams on a single client connection")
+	keepaliveMinTimeSeconds      = flag.Int("keepalive_min_time_seconds", 0, "If positive, clients that send keepalive pings more often than this are disconnected")
+	keepalivePermitWithoutStream = flag.Bool("keepalive_permit_without_stream", false, "If true, clients may send keepalive pings without an active stream. Used with -keepalive_min_time_seconds only")
+
+	// Identifies this Shuffler process in the data store
+	instanceId = flag.String("instance_id", "", "Identifies this Shuffler instance in the metadata of stored Observations. Defaults to the host name.")
+
+	// shuffler ingestion audit log flags
+	auditLogDir         = flag.String("audit_log_dir", "", "If specified, a record of each incoming Envelope, excluding ciphertexts and user data, is appended to a log in this directory")
+	auditLogMaxFileSize = flag.Int64("audit_log_max_file_size", 100*1024*1024, "The size in bytes at which a new audit log file is started")
+	auditLogMaxFiles    = flag.Int("audit_log_max_files", 0, "If positive, only this many of the most recent audit log files are kept")
+
+	// observation size monitoring flags
+	observationSizeMinutes     = flag.Int("observation_size_minutes", 60, "How often the ciphertext size distribution of each metric is logged by the receiver and the dispatcher. If zero the sizes are not monitored.")
+	observationSizeShiftFactor = flag.Float64("observation_size_shift_factor", 2.0, "An anomaly is logged if the median ciphertext size of a metric changes by more than this factor between two intervals.")
+
+	// encryption scheme monitoring flags
+	encryptionStatsMinutes = flag.Int("encryption_stats_minutes", 60, "How often the number of Observations sent to the analyzer with each encryption scheme is logged for each metric. If zero the distribution is not logged, but plaintext Observations of metrics that require encryption are still reported.")
+
+	// usage accounting flags
+	usageFlushSeconds = flag.Int("usage_flush_seconds", 300, "How often the number of Observations and bytes received and dispatched for each project are added to the store, from which they can be queried with the GetUsage admin RPC. If zero usage is not metered.")
+
+	// shuffle audit flags, for testing that dispatching breaks the arrival order
+	shuffleAuditFile = flag.String("shuffle_audit_file", "", "If specified, a transcript of the order in which Observations are dispatched is appended to this file. Requires -shuffle_audit_key.")
+	shuffleAuditKey  = flag.String("shuffle_audit_key", "", "The hex encoded HMAC key used to identify Observations in the -shuffle_audit_file transcript")
+
+	// shuffler admin service configuration flags
+	adminPort = flag.Int("admin_port", 0, "The port of the ShufflerAdmin service. If zero the admin service is not started. "+
+		"Requires -admin_token_file or -admin_client_ca_file.")
+	adminHost = flag.String("admin_host", "localhost", "The host name or IP address on which the ShufflerAdmin service listens. "+
+		"Only set it to a non-loopback address if the callers are authenticated with TLS client certificates or the token is sent over TLS.")
+	adminTokenFile = flag.String("admin_token_file", "", "If specified, the path to a file holding the token that callers of the ShufflerAdmin "+
+		"service must send as a bearer token in the authorization metadata")
+	adminExportLocation = flag.String("admin_export_location", "", "If specified, the local directory or the Cloud Storage path of the form "+
+		"gs://<bucket>[/<prefix>] below which the ExportBucket admin RPC writes. If empty, exports are disabled.")
+	adminClientCAFile = flag.String("admin_client_ca_file", "", "If specified, callers of the ShufflerAdmin service must present a TLS client "+
+		"certificate signed by a CA in this file. Requires -tls.")
+
+	// health check flags
+	healthPort = flag.Int("health_port", 0, "If not zero, the port on which /healthz is served over HTTP. It responds with 200 once the store is initialized and "+
+		"the dispatcher has started, and with 503 otherwise. The grpc.health.v1.Health service is always served on -port.")
+
 	privateKeyPemFile = flag.String("private_key_pem_file", "",
 		"Path to a file containing a PEM encoding of the private key of "+
-			"the Shuffler used for Cobalt's internal encryption scheme. If "+
-			"not specified then the Shuffler will not support encrypted Envelopes.")
+			"the Shuffler used for Cobalt's internal encryption scheme. To "+
+			"rotate the key pair, a comma-separated list of files or a directory "+
+			"whose *.pem files are read may be given instead, and each "+
+			"EncryptedMessage is decrypted with the key that matches its public "+
+			"key fingerprint. If not specified then the Shuffler will not "+
+			"support encrypted Envelopes.")
+	privateKeyKMSKey = flag.String("private_key_kms_key", "",
+		"The resource name of a Google Cloud KMS CryptoKey of the form "+
+			"projects/*/locations/*/keyRings/*/cryptoKeys/*. If specified, the "+
+			"private key is obtained by decrypting -private_key_ciphertext_file "+
+			"with this CryptoKey instead of reading -private_key_pem_file.")
+	privateKeyCiphertextFile = flag.String("private_key_ciphertext_file", "",
+		"Path to a file containing the PEM encoding of the private key of the "+
+			"Shuffler encrypted with -private_key_kms_key.")
+	privateKeyPollMinutes = flag.Int("private_key_poll_minutes", 10,
+		"If -private_key_kms_key is specified, -private_key_ciphertext_file is "+
+			"checked for a rotated key this often.")
+
+	// chained shuffler flags
+	forwardRoutes = flag.String("forward_routes", "", "If specified, a comma-separated list of <public key PEM file>=<host>:<port> "+
+		"pairs. Envelopes encrypted with one of these public keys are relayed, still sealed, to the Shuffler at the paired address "+
+		"instead of being processed")
+	forwardMaxAttempts     = flag.Int("forward_max_attempts", 3, "The largest number of attempts to relay an envelope to the next Shuffler before the Encoder is returned an error")
+	forwardRetryIntervalMs = flag.Int("forward_retry_interval_ms", 500, "The number of milliseconds between two attempts to relay an envelope")
+	tlsToNextShuffler      = flag.Bool("tls_to_next_shuffler", false, "Use TLS to connect to the Shufflers of -forward_routes, with the root certificate in -ca_file if specified")
 
 	// shuffler client configuration flags to connect to analyzer
 	caFile      = flag.String("ca_file", "", "The file containing the CA root certificate")
 	timeout     = flag.Int("timeout", 30, "Grpc connection timeout in seconds")
 	analyzerURL = flag.String("analyzer_uri", "", "The URL for analyzer service")
 
+	tlsServerName = flag.String("tls_server_name", "", "If specified, the TLS certificates of the analyzer and of the Shufflers of -forward_routes are verified "+
+		"for this name instead of the host in their address, e.g. when connecting through a load balancer whose certificate names differ from the dialed address")
+
+	analyzerPublicKeyPemFile = flag.String("analyzer_public_key_pem_file", "",
+		"Path to a file containing a PEM encoding of the public key of the "+
+			"Analyzer. Required if pad_escalated_buckets is set in the Shuffler "+
+			"config, to encrypt the dummy Observations that pad escalated buckets.")
+
 	// shuffler dispatch configuration flags
-	configFile = flag.String("config_file", "", "The Shuffler config file")
-	batchSize  = flag.Int("batch_size", 1000, "The size of ObservationBatch to be sent to Analyzer")
+	configFile      = flag.String("config_file", "", "The Shuffler config file, in the JSON format if its name ends in .json and in the text format otherwise")
+	batchSize       = flag.Int("batch_size", 1000, "The size of ObservationBatch to be sent to Analyzer")
+	deleteChunkSize = flag.Int("delete_chunk_size", dispatcher.DefaultDeleteChunkSize,
+		"The largest number of Observations deleted from the store in a single write after they have been sent to the Analyzer "+
+			"or during disposal. Smaller values avoid latency spikes in the receiver.")
+
+	disposalIntervalMinutes = flag.Int("disposal_interval_minutes", int(dispatcher.DefaultDisposalInterval/time.Minute),
+		"How often Observations older than disposal_age_days are deleted from the store. The first disposal runs at startup.")
+	disposalDelayMs = flag.Int("disposal_delay_ms", int(dispatcher.DefaultDisposalDelay/time.Millisecond),
+		"How long the disposal of stale Observations sleeps between buckets and between delete batches, which limits its load on the store")
+
+	configEnv = flag.String("config_env", "", "If specified, the name of an environment variable holding the Shuffler config in the JSON or the text format. Cannot be used with -config_file")
+
+	dispatchStartJitterMinutes = flag.Int("dispatch_start_jitter_minutes", 0, "If positive, the first dispatch after startup is delayed by a random number of minutes up to this value, so that Shufflers restarted together do not dispatch at the same times")
+	dispatchPhaseMinutes       = flag.Int("dispatch_phase_minutes", -1, "If not negative, dispatches occur this many minutes past the start of each dispatch interval, counted from midnight UTC, instead of immediately after startup")
+	dispatchConcurrency        = flag.Int("dispatch_concurrency", 0, "If positive, the number of buckets dispatched to the analyzer concurrently, overriding dispatch_concurrency in the Shuffler config")
+
+	// Each of these flags overrides the field of analyzer_retry_policy in the
+	// Shuffler config of the same name if it is positive.
+	analyzerMaxAttempts                = flag.Int("analyzer_max_attempts", 0, "If positive, the largest number of attempts to send a batch to the analyzer")
+	analyzerInitialBackoffMs           = flag.Int("analyzer_initial_backoff_ms", 0, "If positive, the delay before the first retry of a batch sent to the analyzer")
+	analyzerBackoffMultiplier          = flag.Float64("analyzer_backoff_multiplier", 0, "If positive, the factor by which the delay between retries grows, at least 1.0")
+	analyzerMaxBackoffMs               = flag.Int("analyzer_max_backoff_ms", 0, "If positive, the longest delay between two attempts to send a batch to the analyzer")
+	analyzerBackoffJitter              = flag.Float64("analyzer_backoff_jitter", 0, "If positive, the random fraction of each delay between retries, at most 1.0")
+	analyzerCircuitBreakerThreshold    = flag.Int("analyzer_circuit_breaker_threshold", 0, "If positive, the number of consecutive batches that failed after which no batches are sent to the analyzer for the cool-down")
+	analyzerCircuitBreakerCooldownSecs = flag.Int("analyzer_circuit_breaker_cooldown_seconds", 0, "If positive, how long no batches are sent to the analyzer once the circuit breaker opens")
 
 	// shuffler db configuration flags
-	useMemStore   = flag.Bool("use_memstore", false, "Shuffler uses in memory store if true, else persistent store")
-	dbDir         = flag.String("db_dir", "", "Path to the Shuffler local datastore")
+	useMemStore = flag.Bool("use_memstore", false, "Shuffler uses in memory store if true, else persistent store")
+	dbBackend   = flag.String("db_backend", "",
+		"The Shuffler datastore: memstore, leveldb, postgres or redis. Defaults to memstore if -use_memstore is set and to leveldb otherwise. "+
+			"A postgres or redis datastore may be shared by several Shuffler instances. The Observations in a redis datastore expire one day "+
+			"after their disposal_age_days.")
+	dbDir       = flag.String("db_dir", "", "Path to the Shuffler local datastore")
+	postgresURL = flag.String("postgres_url", "",
+		"The connection string of the PostgreSQL database used with -db_backend=postgres, e.g. postgres://<user>:<password>@<host>/<database>")
+	redisAddr     = flag.String("redis_addr", "", "The <host>:<port> address of the Redis server used with -db_backend=redis")
 	deleteAllData = flag.Bool("danger_danger_delete_all_data_at_startup", false,
 		"If true then upon startup all data from previous executions of the Shuffler will be deleted. "+
 			"This should not be set true in normal shuffler operation.")
+	reshuffleBatchSize = flag.Int("reshuffle_batch_size", 0,
+		"If positive, the Observations of a bucket in the persistent store, which are ordered by random row keys, "+
+			"are shuffled again in batches of this size when they are dispatched.")
+	writeCoalescingDelayMs = flag.Int("write_coalescing_delay_ms", 0,
+		"If positive, incoming Envelopes that arrive within this many milliseconds of each other are written to the "+
+			"persistent store in a single synced write, which increases the throughput under high ingest.")
+	writeCoalescingMaxBytes = flag.Int("write_coalescing_max_bytes", 4*1024*1024,
+		"A coalesced write is committed early once it holds this many bytes. See -write_coalescing_delay_ms.")
+	levelDBWriteBufferMB = flag.Int("leveldb_write_buffer_mb", 0,
+		"If positive, the size in MiB of the in-memory write buffer of each LevelDB store. Larger buffers absorb "+
+			"bursts of incoming Envelopes with fewer compactions. If zero the LevelDB default of 4 MiB is used.")
+	levelDBBlockCacheMB = flag.Int("leveldb_block_cache_mb", 0,
+		"If positive, the size in MiB of the block cache of each LevelDB store. If zero the LevelDB default of 8 MiB "+
+			"is used.")
+	levelDBBloomFilterBits = flag.Int("leveldb_bloom_filter_bits", 0,
+		"If positive, each LevelDB table file has a bloom filter with this many bits per key, e.g. 10.")
+	levelDBSyncWrites = flag.Bool("leveldb_sync_writes", true,
+		"If true, incoming Envelopes are synced to disk before they are acknowledged. If false they may be lost "+
+			"in a crash of the machine, in exchange for a higher ingest throughput.")
+	levelDBEncryptionKeyFile = flag.String("leveldb_encryption_key_file", "",
+		"If specified, the Observations in the LevelDB stores are encrypted at rest with the hex encoded 16-byte AES "+
+			"key in this file. Observations written without encryption remain readable.")
+	levelDBRepairBucketCounts = flag.Bool("leveldb_repair_bucket_counts", false,
+		"If true, the sizes of the buckets in the LevelDB stores are recounted from their Observations at startup, "+
+			"which reads every Observation, instead of being read from the stored bucket counts.")
+	tenantDbDirs = flag.String("tenant_db_dirs", "",
+		"A comma separated list of entries <customer>[:<project>]=<path>. The Observations of each listed customer, "+
+			"or of a single project of the customer, are kept in a separate persistent store at <path> instead of -db_dir.")
+
+	// shuffler db snapshot flags
+	snapshotLocation = flag.String("snapshot_location", "",
+		"If specified, snapshots of the persistent stores are written below this local directory or Cloud Storage path "+
+			"of the form gs://<bucket>/<path>, periodically and upon the CreateSnapshot admin RPC.")
+	snapshotIntervalMinutes = flag.Int("snapshot_interval_minutes", 60,
+		"How often a snapshot is written to -snapshot_location. If zero snapshots are only written upon request.")
+	snapshotRetention = flag.Int("snapshot_retention", 7,
+		"The number of most recent snapshots kept in -snapshot_location. Older snapshots are deleted.")
+	restoreSnapshotURI = flag.String("restore_snapshot_uri", "",
+		"If specified, the persistent stores that do not exist yet are restored at startup from this snapshot, "+
+			"or from the most recent snapshot if it is a -snapshot_location.")
+
+	// graceful shutdown flags
+	shutdownDrainTimeoutSeconds = flag.Int("shutdown_drain_timeout_seconds", 30,
+		"Upon SIGINT or SIGTERM the Shuffler stops accepting requests and waits this many seconds for the pending "+
+			"requests to complete and for the dispatcher to finish its current buckets before it closes the "+
+			"persistent stores and exits.")
 )
 
 const (
 	readPrivateKeyPemFileFailure = "shuffler-main-read-private-key-pem-file-failure"
+	loadPrivateKeyFromKMSFailure = "shuffler-main-load-private-key-from-kms-failure"
 )
 
 func main() {
 	flag.Parse()
 
+	glog.Infof("Starting the Shuffler, %s.", util.BuildInfo())
+
+	// Report the Shuffler as not serving until it is ready, so that probes
+	// succeed only once the store is initialized and the dispatcher has started
+	health := receiver.NewHealth()
+	if *healthPort != 0 {
+		go health.RunHTTP(*healthPort)
+	}
+
 	// Initialize Shuffler configuration
 	var sConfig *shuffler.ShufflerConfig
 	var err error
-	if *configFile == "" {
-		glog.Warning("Using Shuffler default configuration. Pass -config_file to specify custom config options.")
+	if *configFile != "" && *configEnv != "" {
+		glog.Fatal("-config_file and -config_env cannot be used together.")
+	}
+	if *configEnv != "" {
+		if sConfig, err = shuffler_config.LoadConfigFromEnv(*configEnv); err != nil {
+			glog.Fatal("Error loading shuffler config from the environment variable [", *configEnv, "]: ", err)
+		}
+	} else if *configFile == "" {
+		glog.Warning("Using Shuffler default configuration. Pass -config_file or -config_env to specify custom config options.")
 		// Use the default config
 		sConfig = &shuffler.ShufflerConfig{}
 		sConfig.GlobalConfig = &shuffler.Policy{
@@ -88,42 +292,154 @@ func main() {
 		}
 	}
 
-	// Read the private key PEM file
-	privateKeyPem := ""
-	if *privateKeyPemFile != "" {
-		if fileContents, err := ioutil.ReadFile(*privateKeyPemFile); err != nil {
-			stackdriver.LogCountMetricf(readPrivateKeyPemFileFailure,
-				"Error attempting to read private key PEM file %s: %v. "+
-					"The shuffler will not be able to decrypt EncryptedMessages.", *privateKeyPemFile, err)
+	// Read the private key PEM files or decrypt the private key using Cloud KMS
+	var privateKeyPems []string
+	var privateKeySource util.PrivateKeySource
+	if *privateKeyKMSKey != "" {
+		if *privateKeyCiphertextFile == "" || *privateKeyPemFile != "" {
+			glog.Fatal("-private_key_kms_key requires -private_key_ciphertext_file and cannot be used with -private_key_pem_file.")
+		}
+		source, err := util.NewKMSKeySource(*privateKeyKMSKey, *privateKeyCiphertextFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if privateKeyPem, err := source.PrivateKeyPem(); err != nil {
+			stackdriver.LogCountMetricf(loadPrivateKeyFromKMSFailure,
+				"Error attempting to load the private key using Cloud KMS: %v. "+
+					"The shuffler will not be able to decrypt EncryptedMessages until it succeeds.", err)
 		} else {
-			glog.Infof("Successfully read private key PEM file %s.", *privateKeyPemFile)
-			privateKeyPem = string(fileContents)
+			privateKeyPems = []string{privateKeyPem}
 		}
+		privateKeySource = source
+	} else if *privateKeyPemFile != "" {
+		privateKeyPems = readPrivateKeyPemFiles(*privateKeyPemFile)
 	} else {
 		glog.Warning("The flag -private_key_pem_file was not provided. The shuffler will not be able to decrypt EncryptedMessages.")
 	}
 
 	// Initialize Shuffler data store
 	var store storage.Store
-	if *useMemStore {
+	var storeDirs []string
+	var namedStores []snapshot.NamedStore
+	var levelDBStores []*storage.LevelDBStore
+	var storeClosers []io.Closer
+	backend := *dbBackend
+	if backend == "" {
+		backend = levelDBBackend
+		if *useMemStore {
+			backend = memStoreBackend
+		}
+	} else if *useMemStore && backend != memStoreBackend {
+		glog.Fatal("-use_memstore cannot be used with -db_backend=", backend, ".")
+	}
+	if backend != levelDBBackend {
+		if *tenantDbDirs != "" {
+			glog.Fatal("-tenant_db_dirs can only be used with -db_backend=leveldb.")
+		}
+		if *snapshotLocation != "" || *restoreSnapshotURI != "" {
+			glog.Fatal("-snapshot_location and -restore_snapshot_uri can only be used with -db_backend=leveldb.")
+		}
+		if *levelDBEncryptionKeyFile != "" {
+			glog.Fatal("-leveldb_encryption_key_file can only be used with -db_backend=leveldb.")
+		}
+	}
+	switch backend {
+	case memStoreBackend:
 		glog.Warning("Using MemStore--data will not be persistent. All data will be lost when the Shufler restarts!")
 		store = storage.NewMemStore()
-	} else {
+	case postgresBackend:
+		if *postgresURL == "" {
+			glog.Fatal("-postgres_url is required with -db_backend=postgres.")
+		}
+		postgresStore := newPostgresStore(*postgresURL)
+		if *deleteAllData {
+			glog.Warning("*** WARNING: DELETING ALL DATA FROM SHUFFLER'S DATA STORE!!! ***")
+			glog.Warning("The flag -danger_danger_delete_all_data_at_startup was passed.")
+			if err := postgresStore.EraseAllData(); err != nil {
+				glog.Fatal("Unable to delete the data of the shuffler datastore: ", err)
+			}
+		}
+		store = postgresStore
+		storeClosers = append(storeClosers, postgresStore)
+	case redisBackend:
+		if *redisAddr == "" {
+			glog.Fatal("-redis_addr is required with -db_backend=redis.")
+		}
+		redisStore := newRedisStore(*redisAddr, sConfig)
+		if *deleteAllData {
+			glog.Warning("*** WARNING: DELETING ALL DATA FROM SHUFFLER'S DATA STORE!!! ***")
+			glog.Warning("The flag -danger_danger_delete_all_data_at_startup was passed.")
+			if err := redisStore.EraseAllData(); err != nil {
+				glog.Fatal("Unable to delete the data of the shuffler datastore: ", err)
+			}
+		}
+		store = redisStore
+		storeClosers = append(storeClosers, redisStore)
+	case levelDBBackend:
 		if *dbDir == "" {
 			glog.Fatal("Either -use_memstore or -db_dir are required.")
 		}
-		observationsDBpath, err := filepath.Abs(filepath.Join(*dbDir, "observations_db"))
-		if err != nil {
-			glog.Fatal("%v", err)
+		if *restoreSnapshotURI != "" {
+			if *deleteAllData {
+				glog.Fatal("-restore_snapshot_uri cannot be used with -danger_danger_delete_all_data_at_startup.")
+			}
+			if restoreFrom, err = snapshot.ResolveSnapshot(*restoreSnapshotURI); err != nil {
+				glog.Fatal("Unable to find the snapshot to restore: ", err)
+			}
+			glog.Infof("Restoring the stores that do not exist yet from the snapshot %s.", restoreFrom)
+		}
+		if *levelDBEncryptionKeyFile != "" {
+			if levelDBEncryptionKey, err = readEncryptionKey(*levelDBEncryptionKeyFile); err != nil {
+				glog.Fatal("Invalid -leveldb_encryption_key_file: ", err)
+			}
 		}
-		glog.Infof("Using LevelDB store located at %s.", observationsDBpath)
-		if store, err = storage.NewLevelDBStore(observationsDBpath); err != nil || store == nil {
-			glog.Fatal("Error initializing shuffler datastore: [", *dbDir, "]: ", err)
+		levelDBStores = append(levelDBStores, newLevelDBStore(defaultStoreName, *dbDir))
+		namedStores = append(namedStores, snapshot.NamedStore{Name: defaultStoreName, Store: levelDBStores[0]})
+		store = levelDBStores[0]
+		storeDirs = append(storeDirs, *dbDir)
+		if *tenantDbDirs != "" {
+			dirs, err := parseTenantDbDirs(*tenantDbDirs)
+			if err != nil {
+				glog.Fatal("Invalid -tenant_db_dirs: ", err)
+			}
+			tenantStores := make(map[storage.Tenant]storage.Store)
+			for tenant, dir := range dirs {
+				glog.Infof("Using a separate store for customer %d, project %d.", tenant.CustomerId, tenant.ProjectId)
+				levelDBStore := newLevelDBStore(tenantStoreName(tenant), dir)
+				namedStores = append(namedStores, snapshot.NamedStore{Name: tenantStoreName(tenant), Store: levelDBStore})
+				storeDirs = append(storeDirs, dir)
+				levelDBStores = append(levelDBStores, levelDBStore)
+				tenantStores[tenant] = levelDBStore
+			}
+			store = storage.NewRoutingStore(store, tenantStores)
 		}
 		if *deleteAllData {
 			glog.Warning("*** WARNING: DELETING ALL DATA FROM SHUFFLER'S DATA STORE!!! ***")
 			glog.Warning("The flag -danger_danger_delete_all_data_at_startup was passed.")
-			store.(*storage.LevelDBStore).EraseAllData()
+			for _, levelDBStore := range levelDBStores {
+				levelDBStore.EraseAllData()
+			}
+		}
+		for _, levelDBStore := range levelDBStores {
+			storeClosers = append(storeClosers, levelDBStore)
+		}
+	default:
+		glog.Fatal("Invalid -db_backend: ", backend, ". Expected memstore, leveldb, postgres or redis.")
+	}
+
+	health.SetStoreReady()
+
+	// Back up the persistent stores
+	var snapshotter *snapshot.Snapshotter
+	if *snapshotLocation != "" {
+		if *snapshotRetention <= 0 {
+			glog.Fatal("-snapshot_retention must be positive.")
+		}
+		if snapshotter, err = snapshot.NewSnapshotter(namedStores, *snapshotLocation, *snapshotRetention); err != nil {
+			glog.Fatal("Unable to set up snapshots: ", err)
+		}
+		if *snapshotIntervalMinutes > 0 {
+			go snapshotter.Run(time.Duration(*snapshotIntervalMinutes) * time.Minute)
 		}
 	}
 
@@ -134,21 +450,588 @@ func main() {
 	}
 
 	grpcAnalyzerClient := dispatcher.NewGrpcAnalyzerTransport(&dispatcher.GrpcClientConfig{
-		EnableTLS: *tls_to_analyzer,
-		CAFile:    *caFile,
-		Timeout:   time.Duration(*timeout) * time.Second,
-		URL:       url,
+		EnableTLS:     *tls_to_analyzer,
+		CAFile:        *caFile,
+		TLSServerName: *tlsServerName,
+		Timeout:       time.Duration(*timeout) * time.Second,
+		URL:           url,
 	})
 
+	// The metric denylist is shared by the receiver and the admin service
+	denylist := receiver.NewMetricDenylist(sConfig.MetricDenylist)
+
+	var sizeLimits *receiver.CiphertextSizeLimits
+	if *ciphertextSizeLimitsFile != "" {
+		limits, err := shuffler_config.LoadCiphertextSizeLimits(*ciphertextSizeLimitsFile)
+		if err != nil {
+			glog.Fatal("Error loading the ciphertext size limits file: [", *ciphertextSizeLimitsFile, "]: ", err)
+		}
+		sizeLimits = receiver.NewCiphertextSizeLimits(limits)
+	}
+
+	// Limit the rate of ingestion per customer and project as specified by the
+	// quotas
+	var quotas *receiver.Quotas
+	if len(sConfig.Quotas) > 0 {
+		glog.Infof("Enforcing %d ingestion quotas.", len(sConfig.Quotas))
+		quotas = receiver.NewQuotas(sConfig.Quotas)
+	}
+
+	// Monitor the ciphertext sizes at ingest and at dispatch
+	var receivedSizes, dispatchedSizes *util.ObservationSizes
+	if *observationSizeMinutes > 0 {
+		interval := time.Duration(*observationSizeMinutes) * time.Minute
+		receivedSizes = util.NewObservationSizes("receiver", *observationSizeShiftFactor)
+		dispatchedSizes = util.NewObservationSizes("dispatcher", *observationSizeShiftFactor)
+		go receivedSizes.Run(interval)
+		go dispatchedSizes.Run(interval)
+	}
+
+	// Count the Observations received and dispatched for each project
+	var usageMeter *storage.UsageMeter
+	if *usageFlushSeconds > 0 {
+		usageMeter = storage.NewUsageMeter(store)
+		go usageMeter.Run(time.Duration(*usageFlushSeconds) * time.Second)
+	}
+
 	// Start dispatcher and keep polling for dispatch events
-	go dispatcher.Start(sConfig, store, *batchSize, grpcAnalyzerClient)
+	d := dispatcher.NewDispatcher(sConfig, store, *batchSize, grpcAnalyzerClient, dispatchedSizes)
+	if usageMeter != nil {
+		d.EnableUsageMetering(usageMeter)
+	}
+	encryptionStats := dispatcher.NewEncryptionStats(sConfig)
+	d.EnableEncryptionStats(encryptionStats)
+	if *encryptionStatsMinutes > 0 {
+		go encryptionStats.Run(time.Duration(*encryptionStatsMinutes) * time.Minute)
+	}
+	if *deleteChunkSize <= 0 {
+		glog.Fatal("-delete_chunk_size must be positive.")
+	}
+	d.SetDeleteChunkSize(*deleteChunkSize)
+	if *disposalIntervalMinutes <= 0 {
+		glog.Fatal("-disposal_interval_minutes must be positive.")
+	}
+	if *disposalDelayMs < 0 {
+		glog.Fatal("-disposal_delay_ms must not be negative.")
+	}
+	d.SetDisposalSchedule(time.Duration(*disposalIntervalMinutes)*time.Minute, time.Duration(*disposalDelayMs)*time.Millisecond)
+	if *dispatchStartJitterMinutes < 0 {
+		glog.Fatal("-dispatch_start_jitter_minutes must not be negative.")
+	}
+	d.SetStartSchedule(time.Duration(*dispatchStartJitterMinutes)*time.Minute, time.Duration(*dispatchPhaseMinutes)*time.Minute)
+	if *dispatchConcurrency < 0 {
+		glog.Fatal("-dispatch_concurrency must not be negative.")
+	} else if *dispatchConcurrency > 0 {
+		d.SetDispatchConcurrency(*dispatchConcurrency)
+	}
+	if retryPolicy := analyzerRetryPolicy(sConfig.GetGlobalConfig().GetAnalyzerRetryPolicy()); retryPolicy != nil {
+		d.SetRetryPolicy(retryPolicy)
+	}
+	if sConfig.GetGlobalConfig().PadEscalatedBuckets {
+		if *analyzerPublicKeyPemFile == "" {
+			glog.Fatal("pad_escalated_buckets in the Shuffler config requires -analyzer_public_key_pem_file.")
+		}
+		publicKeyPem, err := ioutil.ReadFile(*analyzerPublicKeyPemFile)
+		if err != nil {
+			glog.Fatal("Unable to read the analyzer public key PEM file: ", err)
+		}
+		dummyEncrypter := util.NewEncryptedMessageMaker(string(publicKeyPem), cobalt.EncryptedMessage_HYBRID_ECDH_V1)
+		if dummyEncrypter == nil {
+			glog.Fatal("Invalid analyzer public key PEM file: ", *analyzerPublicKeyPemFile)
+		}
+		d.SetDummyEncrypter(dummyEncrypter)
+	}
+	if *shuffleAuditFile != "" {
+		key, err := hex.DecodeString(*shuffleAuditKey)
+		if err != nil || len(key) == 0 {
+			glog.Fatal("-shuffle_audit_file requires a hex encoded -shuffle_audit_key.")
+		}
+		f, err := os.OpenFile(*shuffleAuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			glog.Fatal("Unable to open the shuffle audit file: ", err)
+		}
+		glog.Warning("Writing a shuffle audit transcript to ", *shuffleAuditFile, ".")
+		d.EnableShuffleAudit(key, f)
+	}
+	go d.Start()
+	go func() {
+		<-d.Started()
+		health.SetDispatcherStarted()
+	}()
+
+	// Start the admin service so operators can inspect the effective config,
+	// the dispatch history and the stats of the receiver and the Dispatcher
+	receiverStats := &receiver.ReceiverStats{}
+	if *adminPort != 0 {
+		if *adminTokenFile == "" && *adminClientCAFile == "" {
+			glog.Fatal("-admin_port requires -admin_token_file or -admin_client_ca_file to authenticate the callers of the admin service.")
+		}
+		if *adminClientCAFile != "" && !*tls {
+			glog.Fatal("-admin_client_ca_file requires -tls.")
+		}
+		var adminToken string
+		if *adminTokenFile != "" {
+			if adminToken, err = admin.ReadTokenFile(*adminTokenFile); err != nil {
+				glog.Fatalf("Unable to read -admin_token_file: %v", err)
+			}
+		}
+		go admin.Run(&admin.ServerConfig{
+			EnableTLS:      *tls,
+			CertFile:       *certFile,
+			KeyFile:        *keyFile,
+			Host:           *adminHost,
+			Port:           *adminPort,
+			Token:          adminToken,
+			ClientCAFile:   *adminClientCAFile,
+			ExportLocation: *adminExportLocation,
+			Snapshotter:    snapshotter,
+			ReceiverStats:  receiverStats,
+		}, sConfig, *analyzerURL, *batchSize, d, denylist, store)
+	}
+
+	// Throttle ingestion while the backlog in the store is too large
+	var backpressure *receiver.Backpressure
+	if *backpressureMaxObservations > 0 || *backpressureMaxDiskMB > 0 {
+		if *backpressureMaxDiskMB > 0 && backend != levelDBBackend {
+			glog.Fatal("-backpressure_max_disk_mb can only be used with -db_backend=leveldb.")
+		}
+		if *backpressurePollSeconds <= 0 {
+			glog.Fatal("-backpressure_poll_seconds must be positive.")
+		}
+		config := receiver.BackpressureConfig{
+			MaxObservations:    *backpressureMaxObservations,
+			ResumeObservations: *backpressureResumeObservations,
+			Dirs:               storeDirs,
+			MaxDiskBytes:       *backpressureMaxDiskMB * 1024 * 1024,
+			ResumeDiskBytes:    *backpressureResumeDiskMB * 1024 * 1024,
+			PollInterval:       time.Duration(*backpressurePollSeconds) * time.Second,
+			RetryAfter:         time.Duration(*backpressureRetryAfterSeconds) * time.Second,
+		}
+		if config.ResumeObservations == 0 {
+			config.ResumeObservations = config.MaxObservations / 10 * 9
+		}
+		if config.ResumeDiskBytes == 0 {
+			config.ResumeDiskBytes = config.MaxDiskBytes / 10 * 9
+		}
+		if config.ResumeObservations > config.MaxObservations || config.ResumeDiskBytes > config.MaxDiskBytes {
+			glog.Fatal("The backpressure resume watermarks must not be larger than the maximums.")
+		}
+		backpressure = receiver.NewBackpressure(config, store)
+	}
+
+	shufflerInstanceId := *instanceId
+	if shufflerInstanceId == "" {
+		var err error
+		if shufflerInstanceId, err = os.Hostname(); err != nil {
+			glog.Fatal("Unable to determine the host name, use -instance_id: ", err)
+		}
+	}
+
+	if *duplicateWindowSeconds > 0 && *duplicateCacheSize <= 0 {
+		glog.Fatal("-duplicate_cache_size must be positive.")
+	}
+
+	// Relay the envelopes intended for the next Shufflers of the chain
+	var forwarder *receiver.Forwarder
+	if *forwardRoutes != "" {
+		routes, err := parseForwardRoutes(*forwardRoutes)
+		if err != nil {
+			glog.Fatal("Invalid -forward_routes: ", err)
+		}
+		if *forwardMaxAttempts <= 0 || *forwardRetryIntervalMs < 0 {
+			glog.Fatal("-forward_max_attempts must be positive and -forward_retry_interval_ms must not be negative.")
+		}
+		forwarder = receiver.NewForwarder(receiver.ForwarderConfig{
+			Routes:        routes,
+			EnableTLS:     *tlsToNextShuffler,
+			CAFile:        *caFile,
+			TLSServerName: *tlsServerName,
+			Timeout:       time.Duration(*timeout) * time.Second,
+			MaxAttempts:   *forwardMaxAttempts,
+			RetryInterval: time.Duration(*forwardRetryIntervalMs) * time.Millisecond,
+		})
+	}
+
+	// Shut down gracefully upon SIGINT and SIGTERM
+	if *shutdownDrainTimeoutSeconds < 0 {
+		glog.Fatal("-shutdown_drain_timeout_seconds must not be negative.")
+	}
+	shutdown := newGracefulShutdown(d, forwarder, backpressure, health, storeClosers, time.Duration(*shutdownDrainTimeoutSeconds)*time.Second)
+	go shutdown.run()
 
 	// Start listening on receiver for incoming requests from Encoder
 	receiver.Run(store, &receiver.ServerConfig{
-		EnableTLS:     *tls,
-		CertFile:      *certFile,
-		KeyFile:       *keyFile,
-		Port:          *port,
-		PrivateKeyPem: privateKeyPem,
+		EnableTLS:              *tls,
+		CertFile:               *certFile,
+		KeyFile:                *keyFile,
+		CertPollInterval:       time.Duration(*certPollMinutes) * time.Minute,
+		Port:                   *port,
+		PrivateKeyPems:         privateKeyPems,
+		PrivateKeySource:       privateKeySource,
+		PrivateKeyPollInterval: time.Duration(*privateKeyPollMinutes) * time.Minute,
+		AuditLogDir:            *auditLogDir,
+		AuditLogMaxFileSize:    *auditLogMaxFileSize,
+		AuditLogMaxFiles:       *auditLogMaxFiles,
+		MetricDenylist:         denylist,
+		CiphertextSizeLimits:   sizeLimits,
+		ObservationSizes:       receivedSizes,
+		ShufflerInstanceId:     shufflerInstanceId,
+		AcceptEmptyEnvelopes:   *acceptEmptyEnvelopes,
+		DuplicateWindow:        time.Duration(*duplicateWindowSeconds) * time.Second,
+		DuplicateCacheSize:     *duplicateCacheSize,
+		Backpressure:           backpressure,
+		UsageMeter:             usageMeter,
+		Quotas:                 quotas,
+		Stats:                  receiverStats,
+		Forwarder:              forwarder,
+		Health:                 health,
+
+		MaxRecvMsgSize:               *maxRecvMsgSize,
+		MaxStreamSize:                *maxStreamSize,
+		MaxConcurrentStreams:         uint32(*maxConcurrentStreams),
+		KeepaliveMinTime:             time.Duration(*keepaliveMinTimeSeconds) * time.Second,
+		KeepalivePermitWithoutStream: *keepalivePermitWithoutStream,
 	})
+	shutdown.wait()
+}
+
+// parseForwardRoutes parses the value of -forward_routes and returns the
+// addresses of the next Shufflers by the hex encoded fingerprint of their
+// public keys.
+func parseForwardRoutes(value string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, route := range strings.Split(value, ",") {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected <public key PEM file>=<host>:<port> instead of %q", route)
+		}
+		publicKeyPem, err := ioutil.ReadFile(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		fingerprint, err := util.PublicKeyFingerprint(string(publicKeyPem))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key in %s: %v", parts[0], err)
+		}
+		routes[hex.EncodeToString(fingerprint)] = parts[1]
+	}
+	return routes, nil
+}
+
+// gracefulShutdown stops the Shuffler when it receives SIGINT or SIGTERM.
+type gracefulShutdown struct {
+	dispatcher   *dispatcher.Dispatcher
+	forwarder    *receiver.Forwarder
+	backpressure *receiver.Backpressure
+	health       *receiver.Health
+	stores       []io.Closer
+	drainTimeout time.Duration
+
+	// |started| is closed when a signal is received and |done| once the
+	// Shuffler has been shut down.
+	started chan struct{}
+	done    chan struct{}
+}
+
+func newGracefulShutdown(d *dispatcher.Dispatcher, forwarder *receiver.Forwarder, backpressure *receiver.Backpressure, health *receiver.Health, stores []io.Closer, drainTimeout time.Duration) *gracefulShutdown {
+	return &gracefulShutdown{
+		dispatcher:   d,
+		forwarder:    forwarder,
+		backpressure: backpressure,
+		health:       health,
+		stores:       stores,
+		drainTimeout: drainTimeout,
+		started:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// run waits for SIGINT or SIGTERM and then reports the Shuffler as not
+// serving, stops the receiver, letting the pending requests complete, closes
+// the connections to the next Shufflers, stops measuring the backlog, stops the
+// dispatcher after its current buckets and closes the stores, all within
+// |drainTimeout|. If the dispatcher does not stop in time the stores are left
+// open, since LevelDB recovers from its journal at the next start. A second
+// signal terminates the process at once.
+func (s *gracefulShutdown) run() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	glog.Infof("Received %v, shutting down.", <-signals)
+	signal.Stop(signals)
+	close(s.started)
+	defer close(s.done)
+
+	deadline := time.Now().Add(s.drainTimeout)
+	s.health.SetShuttingDown()
+	receiver.Shutdown(s.drainTimeout)
+	if s.forwarder != nil {
+		s.forwarder.Close()
+	}
+	if s.backpressure != nil {
+		s.backpressure.Stop()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.dispatcher.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(deadline.Sub(time.Now())):
+		glog.Warningf("The dispatcher did not stop within %v, exiting without closing the stores.", s.drainTimeout)
+		return
+	}
+
+	for _, store := range s.stores {
+		if err := store.Close(); err != nil {
+			glog.Errorf("Unable to close the shuffler datastore: %v", err)
+		}
+	}
+	for _, lock := range storeDirLocks {
+		if err := lock.Unlock(); err != nil {
+			glog.Errorf("Unable to unlock the shuffler datastore: %v", err)
+		}
+	}
+	glog.Infoln("The Shuffler has shut down.")
+}
+
+// wait blocks until the Shuffler has been shut down if a signal has been
+// received, and returns at once otherwise.
+func (s *gracefulShutdown) wait() {
+	select {
+	case <-s.started:
+		<-s.done
+	default:
+	}
+	glog.Flush()
+}
+
+// The locks on the directories of the LevelDB stores, which are held until the
+// Shuffler shuts down.
+var storeDirLocks []*storage.DirLock
+
+// The URI of the snapshot from which the LevelDB stores that do not exist yet
+// are restored, or empty.
+var restoreFrom string
+
+// The key with which the Observations in the LevelDB stores are encrypted, or
+// nil.
+var levelDBEncryptionKey []byte
+
+// The values of -db_backend.
+const (
+	memStoreBackend = "memstore"
+	levelDBBackend  = "leveldb"
+	postgresBackend = "postgres"
+	redisBackend    = "redis"
+)
+
+// The name of the store in -db_dir in snapshots.
+const defaultStoreName = "default"
+
+// tenantStoreName returns the name of the separate store of |tenant| in
+// snapshots.
+func tenantStoreName(tenant storage.Tenant) string {
+	if tenant.ProjectId == 0 {
+		return fmt.Sprintf("customer_%d", tenant.CustomerId)
+	}
+	return fmt.Sprintf("customer_%d_project_%d", tenant.CustomerId, tenant.ProjectId)
+}
+
+// newPostgresStore opens the PostgreSQL store in the database specified by the
+// connection string |url|, or exits.
+func newPostgresStore(url string) *storage.PostgresStore {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		glog.Fatal("Unable to open the PostgreSQL database: ", err)
+	}
+	glog.Info("Using a PostgreSQL store.")
+	postgresStore, err := storage.NewPostgresStoreWithShuffleStrategy(db, storage.NewSecureShuffleStrategy(), *reshuffleBatchSize)
+	if err != nil {
+		glog.Fatal("Error initializing shuffler datastore: ", err)
+	}
+	return postgresStore
+}
+
+// newRedisStore opens the Redis store on the server at |addr|, or exits. The
+// Observations of a bucket expire one day after the |disposal_age_days| of its
+// policy in |config|, so that they are only lost if the dispatcher did not
+// dispose of them.
+func newRedisStore(addr string, config *shuffler.ShufflerConfig) *storage.RedisStore {
+	pool := &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	ttl := func(om *cobalt.ObservationMetadata) time.Duration {
+		return time.Duration(dispatcher.PolicyFor(config, om).GetDisposalAgeDays()+1) * 24 * time.Hour
+	}
+	glog.Infof("Using a Redis store at %s.", addr)
+	redisStore, err := storage.NewRedisStoreWithShuffleStrategy(pool, ttl, storage.NewSecureShuffleStrategy(), *reshuffleBatchSize)
+	if err != nil {
+		glog.Fatal("Error initializing shuffler datastore: ", err)
+	}
+	return redisStore
+}
+
+// newLevelDBStore locks |dir| and opens the LevelDB store in it using the
+// store options given by the flags. If -restore_snapshot_uri is set and the
+// store does not exist yet it is first restored from the snapshot of the store
+// |name|.
+func newLevelDBStore(name string, dir string) *storage.LevelDBStore {
+	lock, err := storage.LockDir(dir)
+	if err != nil {
+		glog.Fatal("Unable to lock the shuffler datastore: ", err)
+	}
+	storeDirLocks = append(storeDirLocks, lock)
+
+	observationsDBpath, err := filepath.Abs(filepath.Join(dir, "observations_db"))
+	if err != nil {
+		glog.Fatal("%v", err)
+	}
+	if restoreFrom != "" {
+		if _, err := snapshot.Restore(restoreFrom, name, observationsDBpath); err != nil {
+			glog.Fatal("Error restoring the shuffler datastore: [", dir, "]: ", err)
+		}
+	}
+	glog.Infof("Using LevelDB store located at %s.", observationsDBpath)
+	options := storage.LevelDBOptions{
+		WriteBufferSize:    *levelDBWriteBufferMB * 1024 * 1024,
+		BlockCacheSize:     *levelDBBlockCacheMB * 1024 * 1024,
+		BloomFilterBits:    *levelDBBloomFilterBits,
+		SyncWrites:         *levelDBSyncWrites,
+		EncryptionKey:      levelDBEncryptionKey,
+		RepairBucketCounts: *levelDBRepairBucketCounts,
+	}
+	levelDBStore, err := storage.NewLevelDBStoreWithOptions(observationsDBpath, storage.NewSecureShuffleStrategy(), *reshuffleBatchSize, options)
+	if err != nil || levelDBStore == nil {
+		glog.Fatal("Error initializing shuffler datastore: [", dir, "]: ", err)
+	}
+	if *writeCoalescingDelayMs > 0 {
+		levelDBStore.EnableWriteCoalescing(time.Duration(*writeCoalescingDelayMs)*time.Millisecond, *writeCoalescingMaxBytes)
+	}
+	return levelDBStore
+}
+
+// readEncryptionKey returns the hex encoded key in |file|.
+func readEncryptionKey(file string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("the key is not hex encoded: %v", err)
+	}
+	return key, nil
+}
+
+// analyzerRetryPolicy returns |configured|, the analyzer retry policy of the
+// Shuffler config, with the fields overridden by the -analyzer_* flags that are
+// positive, or nil if none of those flags is set.
+func analyzerRetryPolicy(configured *shuffler.AnalyzerRetryPolicy) *shuffler.AnalyzerRetryPolicy {
+	if *analyzerMaxAttempts <= 0 && *analyzerInitialBackoffMs <= 0 && *analyzerBackoffMultiplier <= 0 && *analyzerMaxBackoffMs <= 0 &&
+		*analyzerBackoffJitter <= 0 && *analyzerCircuitBreakerThreshold <= 0 && *analyzerCircuitBreakerCooldownSecs <= 0 {
+		return nil
+	}
+	policy := &shuffler.AnalyzerRetryPolicy{
+		MaxAttempts:                   configured.GetMaxAttempts(),
+		InitialBackoffMs:              configured.GetInitialBackoffMs(),
+		BackoffMultiplier:             configured.GetBackoffMultiplier(),
+		MaxBackoffMs:                  configured.GetMaxBackoffMs(),
+		Jitter:                        configured.GetJitter(),
+		CircuitBreakerThreshold:       configured.GetCircuitBreakerThreshold(),
+		CircuitBreakerCooldownSeconds: configured.GetCircuitBreakerCooldownSeconds(),
+	}
+	if *analyzerMaxAttempts > 0 {
+		policy.MaxAttempts = uint32(*analyzerMaxAttempts)
+	}
+	if *analyzerInitialBackoffMs > 0 {
+		policy.InitialBackoffMs = uint32(*analyzerInitialBackoffMs)
+	}
+	if *analyzerBackoffMultiplier > 0 {
+		policy.BackoffMultiplier = float32(*analyzerBackoffMultiplier)
+	}
+	if *analyzerMaxBackoffMs > 0 {
+		policy.MaxBackoffMs = uint32(*analyzerMaxBackoffMs)
+	}
+	if *analyzerBackoffJitter > 0 {
+		policy.Jitter = float32(*analyzerBackoffJitter)
+	}
+	if *analyzerCircuitBreakerThreshold > 0 {
+		policy.CircuitBreakerThreshold = uint32(*analyzerCircuitBreakerThreshold)
+	}
+	if *analyzerCircuitBreakerCooldownSecs > 0 {
+		policy.CircuitBreakerCooldownSeconds = uint32(*analyzerCircuitBreakerCooldownSecs)
+	}
+	if err := shuffler_config.CheckAnalyzerRetryPolicy(policy); err != nil {
+		glog.Fatal("Invalid -analyzer_* flags: ", err)
+	}
+	return policy
+}
+
+// parseTenantDbDirs parses the value of the -tenant_db_dirs flag into a map
+// from Tenants to the directories of their stores.
+func parseTenantDbDirs(value string) (map[storage.Tenant]string, error) {
+	dirs := make(map[storage.Tenant]string)
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("expected <customer>[:<project>]=<path>, got [%s]", entry)
+		}
+		ids := strings.SplitN(parts[0], ":", 2)
+		var tenant storage.Tenant
+		customerId, err := strconv.ParseUint(ids[0], 10, 32)
+		if err != nil || customerId == 0 {
+			return nil, fmt.Errorf("invalid customer id in [%s]", entry)
+		}
+		tenant.CustomerId = uint32(customerId)
+		if len(ids) == 2 {
+			projectId, err := strconv.ParseUint(ids[1], 10, 32)
+			if err != nil || projectId == 0 {
+				return nil, fmt.Errorf("invalid project id in [%s]", entry)
+			}
+			tenant.ProjectId = uint32(projectId)
+		}
+		if _, ok := dirs[tenant]; ok {
+			return nil, fmt.Errorf("customer %d, project %d is listed twice", tenant.CustomerId, tenant.ProjectId)
+		}
+		dirs[tenant] = parts[1]
+	}
+	return dirs, nil
+}
+
+// readPrivateKeyPemFiles reads the private key PEM files given by the value of
+// the -private_key_pem_file flag, a comma-separated list of files or
+// directories. All *.pem files in a directory are read. Files that cannot be
+// read are logged and skipped.
+func readPrivateKeyPemFiles(value string) []string {
+	var files []string
+	for _, path := range strings.Split(value, ",") {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			pemFiles, _ := filepath.Glob(filepath.Join(path, "*.pem"))
+			if len(pemFiles) == 0 {
+				glog.Warningf("The private key directory %s contains no *.pem files.", path)
+			}
+			files = append(files, pemFiles...)
+		} else {
+			files = append(files, path)
+		}
+	}
+
+	var privateKeyPems []string
+	for _, file := range files {
+		if fileContents, err := ioutil.ReadFile(file); err != nil {
+			stackdriver.LogCountMetricf(readPrivateKeyPemFileFailure,
+				"Error attempting to read private key PEM file %s: %v. "+
+					"The shuffler will not be able to decrypt EncryptedMessages for this key.", file, err)
+		} else {
+			glog.Infof("Successfully read private key PEM file %s.", file)
+			privateKeyPems = append(privateKeyPems, string(fileContents))
+		}
+	}
+	return privateKeyPems
 }
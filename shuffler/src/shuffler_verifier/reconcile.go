@@ -0,0 +1,142 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"shuffler"
+)
+
+// metricKey is the comparable form of a shuffler.MetricKey.
+type metricKey struct {
+	customerId uint32
+	projectId  uint32
+	metricId   uint32
+}
+
+func (k metricKey) String() string {
+	return fmt.Sprintf("%d/%d/%d", k.customerId, k.projectId, k.metricId)
+}
+
+// dayRange is an inclusive range of day indices.
+type dayRange struct {
+	start uint32
+	end   uint32
+}
+
+func (r dayRange) contains(dayIndex uint32) bool {
+	return r.start <= dayIndex && dayIndex <= r.end
+}
+
+// Status values of a reconciliation.
+const (
+	statusOK         = "OK"
+	statusLost       = "LOST"
+	statusDuplicated = "DUPLICATED"
+)
+
+// reconciliation holds the number of Observations of a metric that the
+// Shuffler instances sent to the Analyzer and the number the Analyzer stored.
+type reconciliation struct {
+	metric      metricKey
+	numSent     uint64
+	numReceived uint64
+}
+
+func (r *reconciliation) status() string {
+	switch {
+	case r.numReceived < r.numSent:
+		return statusLost
+	case r.numReceived > r.numSent:
+		return statusDuplicated
+	default:
+		return statusOK
+	}
+}
+
+// difference returns the absolute difference between the sent and the
+// received counts.
+func (r *reconciliation) difference() uint64 {
+	if r.numReceived < r.numSent {
+		return r.numSent - r.numReceived
+	}
+	return r.numReceived - r.numSent
+}
+
+// addSentCounts adds to |counts| the number of Observations successfully sent
+// to the Analyzer according to |histories| for each metric, counting only the
+// buckets whose day index is in |days|.
+func addSentCounts(counts map[metricKey]uint64, histories []*shuffler.DispatchHistory, days dayRange) {
+	for _, history := range histories {
+		bucket := history.GetBucket()
+		if !days.contains(bucket.GetDayIndex()) {
+			continue
+		}
+		k := metricKey{bucket.GetCustomerId(), bucket.GetProjectId(), bucket.GetMetricId()}
+		for _, record := range history.GetRecords() {
+			counts[k] += uint64(record.NumObservationsSent)
+		}
+	}
+}
+
+// reconcile returns the reconciliations of the metrics in |sent| and
+// |received| sorted by metric. A metric missing from one of the maps has a
+// count of zero there.
+func reconcile(sent, received map[metricKey]uint64) []*reconciliation {
+	metrics := make(map[metricKey]bool)
+	for k := range sent {
+		metrics[k] = true
+	}
+	for k := range received {
+		metrics[k] = true
+	}
+
+	var results []*reconciliation
+	for k := range metrics {
+		results = append(results, &reconciliation{
+			metric:      k,
+			numSent:     sent[k],
+			numReceived: received[k],
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i].metric, results[j].metric
+		if a.customerId != b.customerId {
+			return a.customerId < b.customerId
+		}
+		if a.projectId != b.projectId {
+			return a.projectId < b.projectId
+		}
+		return a.metricId < b.metricId
+	})
+	return results
+}
+
+// printReconciliations writes |results| to |w| as a table and returns the
+// number of metrics with a discrepancy.
+func printReconciliations(w io.Writer, results []*reconciliation) int {
+	numDiscrepancies := 0
+	fmt.Fprintf(w, "%-16s %12s %12s %12s  %s\n", "metric", "sent", "received", "difference", "status")
+	for _, r := range results {
+		fmt.Fprintf(w, "%-16s %12d %12d %12d  %s\n", r.metric, r.numSent, r.numReceived, r.difference(), r.status())
+		if r.status() != statusOK {
+			numDiscrepancies++
+		}
+	}
+	return numDiscrepancies
+}
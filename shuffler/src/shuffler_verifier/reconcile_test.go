@@ -0,0 +1,123 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"cobalt"
+	"shuffler"
+)
+
+// Tests that addSentCounts() sums the Observations sent per metric for the
+// buckets in the day range.
+func TestAddSentCounts(t *testing.T) {
+	histories := []*shuffler.DispatchHistory{
+		{
+			Bucket: &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 100},
+			Records: []*shuffler.DispatchRecord{
+				{NumObservationsSent: 10, Result: shuffler.DispatchRecord_PARTIALLY_FAILED},
+				{NumObservationsSent: 5},
+			},
+		},
+		{
+			Bucket:  &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 101},
+			Records: []*shuffler.DispatchRecord{{NumObservationsSent: 7}},
+		},
+		{
+			Bucket:  &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 1, DayIndex: 102},
+			Records: []*shuffler.DispatchRecord{{NumObservationsSent: 100}},
+		},
+		{
+			Bucket:  &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 2, DayIndex: 100},
+			Records: []*shuffler.DispatchRecord{{Result: shuffler.DispatchRecord_FAILED}},
+		},
+	}
+
+	counts := make(map[metricKey]uint64)
+	addSentCounts(counts, histories, dayRange{100, 101})
+	// The counts of multiple Shuffler instances are added.
+	addSentCounts(counts, histories[1:2], dayRange{100, 101})
+
+	expected := map[metricKey]uint64{
+		{1, 1, 1}: 29,
+		{1, 1, 2}: 0,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("got counts %v, expected %v", counts, expected)
+	}
+}
+
+// Tests that reconcile() classifies and sorts the metrics.
+func TestReconcile(t *testing.T) {
+	sent := map[metricKey]uint64{
+		{1, 2, 1}: 10,
+		{1, 1, 2}: 10,
+		{1, 1, 1}: 10,
+	}
+	received := map[metricKey]uint64{
+		{1, 1, 1}: 10,
+		{1, 1, 2}: 12,
+		{2, 1, 1}: 3,
+	}
+
+	results := reconcile(sent, received)
+	expected := []struct {
+		metric     metricKey
+		status     string
+		difference uint64
+	}{
+		{metricKey{1, 1, 1}, statusOK, 0},
+		{metricKey{1, 1, 2}, statusDuplicated, 2},
+		{metricKey{1, 2, 1}, statusLost, 10},
+		{metricKey{2, 1, 1}, statusDuplicated, 3},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("got %d results, expected %d", len(results), len(expected))
+	}
+	for i, r := range results {
+		if r.metric != expected[i].metric || r.status() != expected[i].status || r.difference() != expected[i].difference {
+			t.Errorf("got result %v with status %s and difference %d at position %d, expected %v", r.metric, r.status(),
+				r.difference(), i, expected[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if n := printReconciliations(&buf, results); n != 3 {
+		t.Errorf("printReconciliations() returned %d discrepancies, expected 3", n)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("1/2/1")) {
+		t.Errorf("the printed table does not contain metric 1/2/1:\n%s", buf.String())
+	}
+}
+
+// Tests that parseMetrics() accepts lists of metrics and rejects malformed
+// entries.
+func TestParseMetrics(t *testing.T) {
+	keys, err := parseMetrics("1/2/3,4/5/6")
+	if err != nil || !reflect.DeepEqual(keys, []metricKey{{1, 2, 3}, {4, 5, 6}}) {
+		t.Errorf("got %v and error %v, expected metrics 1/2/3 and 4/5/6", keys, err)
+	}
+	if keys, err := parseMetrics(""); err != nil || len(keys) != 0 {
+		t.Errorf("got %v and error %v, expected no metrics", keys, err)
+	}
+	for _, list := range []string{"1/2", "1/2/x", "1/2/3,"} {
+		if _, err := parseMetrics(list); err == nil {
+			t.Errorf("parseMetrics(%q) succeeded, expected an error", list)
+		}
+	}
+}
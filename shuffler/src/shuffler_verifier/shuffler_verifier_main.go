@@ -0,0 +1,240 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This file contains a program that reconciles the number of Observations the
+Shuffler sent to the Analyzer with the number of Observations the Analyzer
+stored, per metric and over a range of day indices. It is meant to be run after
+an incident to find out whether Observations were lost or duplicated between
+the two.
+
+The sent counts are read from the dispatch histories returned by the
+ShufflerAdmin service of each Shuffler instance listed in -shuffler_admin_uris.
+The received counts are obtained by invoking the query_observations binary
+given by -observation_querier_path for each metric.
+
+For each metric the program prints the two counts and whether Observations
+were lost or duplicated. It exits with status 3 if there is a discrepancy.
+
+Note that the Shuffler keeps only the most recent dispatch attempts of each
+bucket, and only for a limited time, so the range should cover recent days. If
+the Shuffler rewrites the day index of the Observations it sends, see
+DayIndexNormalization, the range should cover whole weeks.
+*/
+
+package main
+
+import (
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"admin"
+	"shuffler"
+)
+
+var (
+	shufflerAdminURIs = flag.String("shuffler_admin_uris", "", "A comma-separated list of the hostname:port of the ShufflerAdmin service of each Shuffler instance.")
+	tls               = flag.Bool("tls", false, "The connections to the ShufflerAdmin services use TLS if true, else plain TCP.")
+	caFile            = flag.String("ca_file", "", "The file containing the root CA certificate for TLS. The system roots are used if empty.")
+	timeout           = flag.Int("timeout", 30, "The timeout in seconds of each request to a ShufflerAdmin service.")
+	adminTokenFile    = flag.String("admin_token_file", "", "If specified, the path to a file holding the token sent to the ShufflerAdmin services. See -admin_token_file of the Shuffler.")
+	clientCertFile    = flag.String("client_cert_file", "", "If specified, the TLS client certificate presented to the ShufflerAdmin services. Requires -tls and -client_key_file.")
+	clientKeyFile     = flag.String("client_key_file", "", "The private key of -client_cert_file.")
+
+	observationQuerierPath = flag.String("observation_querier_path", "", "The full path to the query_observations binary.")
+	bigtableProjectName    = flag.String("bigtable_project_name", "", "The Cloud project of the Analyzer's Bigtable instance, passed to query_observations.")
+	bigtableInstanceId     = flag.String("bigtable_instance_id", "", "The Analyzer's Bigtable instance, passed to query_observations.")
+	maxNum                 = flag.Uint("max_num", 100000000, "The largest number of Observations counted in the Analyzer per metric.")
+
+	startDayIndex = flag.Uint("start_day_index", 0, "The first day index of the range over which the counts are reconciled.")
+	endDayIndex   = flag.Uint("end_day_index", 0, "The last day index of the range over which the counts are reconciled.")
+	metrics       = flag.String("metrics", "", "An optional comma-separated list of metrics of the form <customer>/<project>/<metric> "+
+		"that are reconciled in addition to the metrics found in the dispatch histories.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *shufflerAdminURIs == "" || *observationQuerierPath == "" {
+		glog.Exit("-shuffler_admin_uris and -observation_querier_path are required.")
+	}
+	if *startDayIndex == 0 || *endDayIndex < *startDayIndex {
+		glog.Exit("-start_day_index and -end_day_index are required and must form a range.")
+	}
+	days := dayRange{uint32(*startDayIndex), uint32(*endDayIndex)}
+	if *clientCertFile != "" && (!*tls || *clientKeyFile == "") {
+		glog.Exit("-client_cert_file requires -tls and -client_key_file.")
+	}
+	var adminToken string
+	if *adminTokenFile != "" {
+		var err error
+		if adminToken, err = admin.ReadTokenFile(*adminTokenFile); err != nil {
+			glog.Exit("Unable to read -admin_token_file: ", err)
+		}
+	}
+
+	extraMetrics, err := parseMetrics(*metrics)
+	if err != nil {
+		glog.Exit("Invalid -metrics: ", err)
+	}
+	sent := make(map[metricKey]uint64)
+	for _, k := range extraMetrics {
+		sent[k] = 0
+	}
+	for _, uri := range strings.Split(*shufflerAdminURIs, ",") {
+		histories, err := getDispatchHistories(uri, adminToken)
+		if err != nil {
+			glog.Exitf("Unable to read the dispatch history from %s: %v", uri, err)
+		}
+		addSentCounts(sent, histories, days)
+	}
+
+	received := make(map[metricKey]uint64)
+	for k := range sent {
+		num, err := getNumReceived(k, days)
+		if err != nil {
+			glog.Exitf("Unable to count the Observations of metric %v in the Analyzer: %v", k, err)
+		}
+		received[k] = num
+	}
+
+	fmt.Printf("Reconciliation of day indices %d to %d:\n", days.start, days.end)
+	if n := printReconciliations(os.Stdout, reconcile(sent, received)); n > 0 {
+		fmt.Printf("Found discrepancies for %d metrics.\n", n)
+		os.Exit(3)
+	}
+}
+
+// parseMetrics parses a comma-separated list of metrics of the form
+// <customer>/<project>/<metric>.
+func parseMetrics(list string) ([]metricKey, error) {
+	var keys []metricKey
+	if list == "" {
+		return keys, nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.Split(entry, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("expected <customer>/<project>/<metric>, got %q", entry)
+		}
+		var ids [3]uint32
+		for i, part := range parts {
+			id, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id %q in %q", part, entry)
+			}
+			ids[i] = uint32(id)
+		}
+		keys = append(keys, metricKey{ids[0], ids[1], ids[2]})
+	}
+	return keys, nil
+}
+
+// getDispatchHistories returns the dispatch histories of all buckets from the
+// ShufflerAdmin service at |uri|, sending |token| if it is not empty.
+func getDispatchHistories(uri string, token string) ([]*shuffler.DispatchHistory, error) {
+	var opts []grpc.DialOption
+	if *tls {
+		tlsConfig := &cryptotls.Config{}
+		if *caFile != "" {
+			pem, err := ioutil.ReadFile(*caFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", *caFile)
+			}
+		}
+		if *clientCertFile != "" {
+			cert, err := cryptotls.LoadX509KeyPair(*clientCertFile, *clientKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []cryptotls.Certificate{cert}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(admin.NewTokenCredentials(token)))
+	}
+
+	conn, err := grpc.Dial(uri, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*timeout)*time.Second)
+	defer cancel()
+	response, err := shuffler.NewShufflerAdminClient(conn).GetDispatchHistory(ctx, &shuffler.GetDispatchHistoryRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return response.GetBuckets(), nil
+}
+
+// getNumReceived invokes the query_observations binary to count the
+// Observations of metric |k| with a day index in |days| stored by the
+// Analyzer.
+func getNumReceived(k metricKey, days dayRange) (uint64, error) {
+	arguments := []string{
+		"-nointeractive",
+		"-logtostderr",
+		"-customer", strconv.Itoa(int(k.customerId)),
+		"-project", strconv.Itoa(int(k.projectId)),
+		"-metric", strconv.Itoa(int(k.metricId)),
+		"-start_day_index", strconv.Itoa(int(days.start)),
+		"-end_day_index", strconv.Itoa(int(days.end)),
+		"-max_num", strconv.Itoa(int(*maxNum)),
+	}
+	if *bigtableProjectName != "" {
+		arguments = append(arguments, "-bigtable_project_name", *bigtableProjectName)
+	}
+	if *bigtableInstanceId != "" {
+		arguments = append(arguments, "-bigtable_instance_id", *bigtableInstanceId)
+	}
+	cmd := exec.Command(*observationQuerierPath, arguments...)
+	out, err := cmd.Output()
+	if err != nil {
+		stdErrMessage := ""
+		if exitError, ok := err.(*exec.ExitError); ok {
+			stdErrMessage = string(exitError.Stderr)
+		}
+		return 0, fmt.Errorf("Error returned from query_observations process: [%v] %s", err, stdErrMessage)
+	}
+	num, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse output of query_observations as an integer: error=[%v] output=[%s]", err, out)
+	}
+	if num >= uint64(*maxNum) {
+		glog.Warningf("The count of metric %v in the Analyzer reached -max_num and is a lower bound.", k)
+	}
+	return num, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"util/gcs"
+)
+
+// The base URL of the Cloud Storage JSON API.
+const gcsAPIEndpoint = "https://www.googleapis.com/storage/v1/"
+
+// errObjectNotFound is returned by objectStore.get() for objects that do not
+// exist.
+var errObjectNotFound = fmt.Errorf("object not found")
+
+// An objectStore holds the objects that make up snapshots. Object names are
+// paths relative to the location of the objectStore, separated by "/".
+type objectStore interface {
+	// put writes the object |name| with the contents read from |r|, replacing
+	// the object if it exists.
+	put(name string, r io.Reader) error
+
+	// get returns a reader for the contents of the object |name|, which the
+	// caller must close, or errObjectNotFound.
+	get(name string) (io.ReadCloser, error)
+
+	// list returns the names of all objects.
+	list() ([]string, error)
+
+	// remove deletes the object |name|.
+	remove(name string) error
+}
+
+// newObjectStore returns the objectStore at |location|, which is either a
+// local directory or a Cloud Storage path of the form gs://<bucket>[/<path>].
+func newObjectStore(location string) (objectStore, error) {
+	if !strings.HasPrefix(location, gcs.Prefix) {
+		return &dirObjectStore{dir: location}, nil
+	}
+
+	bucket, prefix, err := gcs.ParsePath(location)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	return &gcsObjectStore{
+		client:      client,
+		uploader:    gcs.NewUploader(client, ""),
+		apiEndpoint: gcsAPIEndpoint,
+		bucket:      bucket,
+		prefix:      prefix,
+	}, nil
+}
+
+// dirObjectStore is an objectStore that keeps the objects as files below a
+// local directory.
+type dirObjectStore struct {
+	dir string
+}
+
+func (s *dirObjectStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// put writes the object to a temporary file first, so that the object either
+// exists entirely or not at all.
+func (s *dirObjectStore) put(name string, r io.Reader) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *dirObjectStore) get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return f, err
+}
+
+func (s *dirObjectStore) list() ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.dir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		name, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	return names, err
+}
+
+// remove deletes the file of the object and its directory if it is left
+// empty.
+func (s *dirObjectStore) remove(name string) error {
+	path := s.path(name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != filepath.Clean(s.dir) {
+		// Fails if the directory is not empty.
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// gcsObjectStore is an objectStore that keeps the objects in a Cloud Storage
+// bucket, with names starting with |prefix|. Objects are written with
+// |uploader| and read, listed and deleted with |client|.
+type gcsObjectStore struct {
+	client      *http.Client
+	uploader    *gcs.Uploader
+	apiEndpoint string
+	bucket      string
+	prefix      string
+}
+
+func (s *gcsObjectStore) objectURL(name string) string {
+	return fmt.Sprintf("%sb/%s/o/%s", s.apiEndpoint, url.PathEscape(s.bucket), url.PathEscape(s.prefix+name))
+}
+
+// put streams the contents of the object, so that snapshots larger than the
+// available memory can be uploaded.
+func (s *gcsObjectStore) put(name string, r io.Reader) error {
+	return s.uploader.Upload(context.Background(), s.bucket, s.prefix+name, r, "application/octet-stream", "")
+}
+
+func (s *gcsObjectStore) get(name string) (io.ReadCloser, error) {
+	resp, err := s.client.Get(s.objectURL(name) + "?alt=media")
+	if err != nil {
+		return nil, fmt.Errorf("Cloud Storage download request failed: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, checkResponse(resp, http.StatusOK)
+	}
+	return resp.Body, nil
+}
+
+func (s *gcsObjectStore) list() ([]string, error) {
+	var names []string
+	pageToken := ""
+	for {
+		listURL := fmt.Sprintf("%sb/%s/o?prefix=%s&fields=items(name),nextPageToken", s.apiEndpoint, url.PathEscape(s.bucket), url.QueryEscape(s.prefix))
+		if pageToken != "" {
+			listURL += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		resp, err := s.client.Get(listURL)
+		if err != nil {
+			return nil, fmt.Errorf("Cloud Storage list request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, checkResponse(resp, http.StatusOK)
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the Cloud Storage list response: %v", err)
+		}
+		for _, item := range page.Items {
+			names = append(names, strings.TrimPrefix(item.Name, s.prefix))
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (s *gcsObjectStore) remove(name string) error {
+	req, err := http.NewRequest("DELETE", s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Cloud Storage delete request failed: %v", err)
+	}
+	return checkResponse(resp, http.StatusNoContent)
+}
+
+// checkResponse closes the body of |resp| and returns an error if its status
+// is not |expectedStatus|.
+func checkResponse(resp *http.Response, expectedStatus int) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Cloud Storage request failed with status %s: %s", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snapshot backs up the LevelDB stores of the Shuffler, so that the
+// Observations buffered on a Shuffler that is lost can be restored on its
+// replacement instead of being lost with it.
+//
+// A snapshot is a set of objects below a location, which is either a local
+// directory or a Google Cloud Storage path of the form gs://<bucket>/<path>.
+// Each snapshot is identified by the UTC time at which it was started and
+// consists of the objects
+//
+//	<location>/<id>/<store name>.snapshot
+//	<location>/<id>/MANIFEST
+//
+// The MANIFEST lists the names of the stores, one per line, and is written
+// last, so that a snapshot without one is incomplete and is never restored.
+// The URI of a snapshot is <location>/<id>.
+package snapshot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"shuffler"
+	"storage"
+	"util/stackdriver"
+)
+
+const snapshotFailed = "snapshotter-snapshot-failed"
+
+// The name of the object that marks a snapshot as complete.
+const manifestName = "MANIFEST"
+
+// The suffix of the names of the objects holding the snapshot of a store.
+const storeSuffix = ".snapshot"
+
+// The format of the ids of snapshots, which sort in chronological order.
+const idFormat = "20060102T150405.000Z"
+
+// A Store can write a consistent snapshot of its contents, which is restored
+// by storage.RestoreSnapshot. *storage.LevelDBStore implements Store.
+type Store interface {
+	WriteSnapshot(w io.Writer) (numRows uint64, err error)
+}
+
+// A NamedStore is a Store and the name under which it is backed up. The name
+// identifies the store when a snapshot is restored, so it must not change
+// across restarts.
+type NamedStore struct {
+	Name  string
+	Store Store
+}
+
+// A Snapshotter writes snapshots of a set of stores to a location and keeps
+// only the most recent ones.
+type Snapshotter struct {
+	stores    []NamedStore
+	location  string
+	objects   objectStore
+	retention int
+
+	// mu serializes the snapshots.
+	mu sync.Mutex
+}
+
+// NewSnapshotter returns a Snapshotter that writes snapshots of |stores| to
+// |location|, which is either a local directory or a Cloud Storage path of the
+// form gs://<bucket>/<path>, and deletes all but the |retention| most recent
+// complete snapshots.
+func NewSnapshotter(stores []NamedStore, location string, retention int) (*Snapshotter, error) {
+	if len(stores) == 0 {
+		panic("stores is empty")
+	}
+	if retention <= 0 {
+		panic("retention must be positive")
+	}
+	names := make(map[string]bool)
+	for _, s := range stores {
+		if s.Name == "" || strings.ContainsAny(s.Name, "/\n") || names[s.Name] {
+			return nil, fmt.Errorf("invalid or repeated store name [%s]", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	objects, err := newObjectStore(location)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshotter{
+		stores:    stores,
+		location:  strings.TrimRight(location, "/"),
+		objects:   objects,
+		retention: retention,
+	}, nil
+}
+
+// Snapshot writes a snapshot of all stores and then deletes the snapshots
+// beyond the retention. The snapshots of the individual stores are consistent
+// but are taken one after the other. Returns the URI and the size of the new
+// snapshot.
+func (s *Snapshotter) Snapshot() (*shuffler.SnapshotInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := time.Now().UTC()
+	id := start.Format(idFormat)
+	info := &shuffler.SnapshotInfo{
+		Uri:         s.location + "/" + id,
+		TimeSeconds: start.Unix(),
+	}
+	manifest := ""
+	for _, store := range s.stores {
+		numRows, numBytes, err := s.putStore(id+"/"+store.Name+storeSuffix, store.Store)
+		if err != nil {
+			return nil, fmt.Errorf("unable to write the snapshot of store %s: %v", store.Name, err)
+		}
+		info.NumRows += numRows
+		info.NumBytes += numBytes
+		manifest += store.Name + "\n"
+	}
+	if err := s.objects.put(id+"/"+manifestName, strings.NewReader(manifest)); err != nil {
+		return nil, fmt.Errorf("unable to write the manifest of the snapshot: %v", err)
+	}
+	glog.Infof("Wrote the snapshot %s of %d rows and %d bytes in %v.", info.Uri, info.NumRows, info.NumBytes, time.Since(start))
+
+	if err := s.prune(); err != nil {
+		glog.Warningf("Unable to delete old snapshots: %v", err)
+	}
+	return info, nil
+}
+
+// putStore streams the snapshot of |store| to the object |name|. Returns the
+// number of rows and bytes written.
+func (s *Snapshotter) putStore(name string, store Store) (numRows uint64, numBytes uint64, err error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		numRows, err = store.WriteSnapshot(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	counter := &countingReader{r: pr}
+	err = s.objects.put(name, counter)
+	// Unblocks the writer if the object store stopped reading early.
+	pr.CloseWithError(fmt.Errorf("the upload of the snapshot ended"))
+	if writeErr := <-done; writeErr != nil {
+		return 0, 0, writeErr
+	}
+	return numRows, counter.n, err
+}
+
+// countingReader counts the bytes read from |r|.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// Run writes a snapshot every |interval|. It blocks forever.
+func (s *Snapshotter) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if _, err := s.Snapshot(); err != nil {
+			stackdriver.LogCountMetricf(snapshotFailed, "Unable to write a snapshot of the store: %v", err)
+		}
+	}
+}
+
+// prune deletes all snapshots, complete or not, that are older than the
+// |retention| most recent complete snapshots.
+func (s *Snapshotter) prune() error {
+	names, err := s.objects.list()
+	if err != nil {
+		return err
+	}
+	complete := completeSnapshots(names)
+	if len(complete) <= s.retention {
+		return nil
+	}
+	oldestKept := complete[len(complete)-s.retention]
+	for _, name := range names {
+		id := strings.SplitN(name, "/", 2)[0]
+		if id >= oldestKept {
+			continue
+		}
+		if err := s.objects.remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeSnapshots returns the ids of the snapshots among the objects
+// |names| that have a manifest, in chronological order.
+func completeSnapshots(names []string) []string {
+	var ids []string
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) != 2 || parts[1] != manifestName {
+			continue
+		}
+		if _, err := time.Parse(idFormat, parts[0]); err == nil {
+			ids = append(ids, parts[0])
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ResolveSnapshot returns |uri| if it is the URI of a complete snapshot.
+// Otherwise |uri| must be the location of snapshots and the URI of the most
+// recent complete snapshot in it is returned.
+func ResolveSnapshot(uri string) (string, error) {
+	uri = strings.TrimRight(uri, "/")
+	objects, err := newObjectStore(uri)
+	if err != nil {
+		return "", err
+	}
+	if r, err := objects.get(manifestName); err == nil {
+		r.Close()
+		return uri, nil
+	} else if err != errObjectNotFound {
+		return "", err
+	}
+
+	names, err := objects.list()
+	if err != nil {
+		return "", err
+	}
+	complete := completeSnapshots(names)
+	if len(complete) == 0 {
+		return "", fmt.Errorf("%s is neither a complete snapshot nor contains one", uri)
+	}
+	return uri + "/" + complete[len(complete)-1], nil
+}
+
+// Restore creates the LevelDB database at |dbDirPath| from the snapshot of the
+// store |name| in the complete snapshot at |uri|. Returns false without
+// changing anything if the database already exists or if the snapshot does
+// not include the store, which happens for stores that were added later.
+func Restore(uri string, name string, dbDirPath string) (bool, error) {
+	if _, err := os.Stat(dbDirPath); !os.IsNotExist(err) {
+		glog.Infof("Not restoring store %s from the snapshot %s since %s exists.", name, uri, dbDirPath)
+		return false, nil
+	}
+
+	objects, err := newObjectStore(uri)
+	if err != nil {
+		return false, err
+	}
+	manifest, err := objects.get(manifestName)
+	if err != nil {
+		return false, fmt.Errorf("unable to read the manifest of the snapshot %s: %v", uri, err)
+	}
+	found := false
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		found = found || scanner.Text() == name
+	}
+	err = scanner.Err()
+	manifest.Close()
+	if err != nil {
+		return false, fmt.Errorf("unable to read the manifest of the snapshot %s: %v", uri, err)
+	}
+	if !found {
+		glog.Warningf("The snapshot %s does not include the store %s, which starts empty.", uri, name)
+		return false, nil
+	}
+
+	r, err := objects.get(name + storeSuffix)
+	if err != nil {
+		return false, fmt.Errorf("unable to read the snapshot of store %s: %v", name, err)
+	}
+	defer r.Close()
+	numRows, err := storage.RestoreSnapshot(dbDirPath, r)
+	if err != nil {
+		return false, fmt.Errorf("unable to restore store %s from the snapshot %s: %v", name, uri, err)
+	}
+	glog.Infof("Restored %d rows of store %s from the snapshot %s.", numRows, name, uri)
+	return true, nil
+}
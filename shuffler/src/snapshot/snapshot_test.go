@@ -0,0 +1,231 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"storage"
+	"util/gcs"
+)
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("TempDir: got error %v", err)
+	}
+	return dir
+}
+
+// Tests that Snapshot() keeps the |retention| most recent complete snapshots
+// and that the most recent one is restored.
+func TestSnapshotAndRestore(t *testing.T) {
+	tmpDir := makeTempDir(t)
+	defer os.RemoveAll(tmpDir)
+	location := filepath.Join(tmpDir, "snapshots")
+
+	store, err := storage.NewLevelDBStore(filepath.Join(tmpDir, "store"))
+	if err != nil {
+		t.Fatalf("NewLevelDBStore: got error %v", err)
+	}
+	defer storage.ResetStoreForTesting(store, true)
+	s, err := NewSnapshotter([]NamedStore{{Name: "default", Store: store}}, location, 2)
+	if err != nil {
+		t.Fatalf("NewSnapshotter: got error %v", err)
+	}
+
+	// An incomplete snapshot older than the retained ones is deleted.
+	if err := os.MkdirAll(filepath.Join(location, "20180101T000000.000Z"), 0700); err != nil {
+		t.Fatalf("MkdirAll: got error %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(location, "20180101T000000.000Z", "default.snapshot"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile: got error %v", err)
+	}
+
+	var uris []string
+	numObservations := 0
+	batches := storage.MakeObservationBatches(3)
+	for i, batch := range batches {
+		if err := store.AddAllObservations(batches[i:i+1], storage.NewArrival(time.Now(), "shuffler-1")); err != nil {
+			t.Fatalf("AddAllObservations: got error %v", err)
+		}
+		numObservations += len(batch.EncryptedObservation)
+		info, err := s.Snapshot()
+		if err != nil {
+			t.Fatalf("Snapshot: got error %v", err)
+		}
+		// The Observations and the count of each bucket.
+		if info.NumRows != uint64(numObservations+i+1) || info.NumBytes == 0 {
+			t.Errorf("Snapshot: got info [%v] for a store of %d Observations in %d buckets", info, numObservations, i+1)
+		}
+		uris = append(uris, info.Uri)
+		// The ids of the snapshots have a resolution of a millisecond.
+		time.Sleep(2 * time.Millisecond)
+	}
+	entries, err := ioutil.ReadDir(location)
+	if err != nil {
+		t.Fatalf("ReadDir: got error %v", err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.Name())
+	}
+	sort.Strings(ids)
+	expected := []string{filepath.Base(uris[1]), filepath.Base(uris[2])}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("got snapshots %v, expected %v", ids, expected)
+	}
+
+	latest, err := ResolveSnapshot(location)
+	if err != nil || latest != uris[2] {
+		t.Errorf("ResolveSnapshot(%s): got %s and error %v, expected %s", location, latest, err, uris[2])
+	}
+	if resolved, err := ResolveSnapshot(uris[1]); err != nil || resolved != uris[1] {
+		t.Errorf("ResolveSnapshot(%s): got %s and error %v, expected it unchanged", uris[1], resolved, err)
+	}
+
+	dbDir := filepath.Join(tmpDir, "restored")
+	if restored, err := Restore(latest, "default", dbDir); err != nil || !restored {
+		t.Fatalf("Restore: got %v and error %v, expected the store to be restored", restored, err)
+	}
+	restoredStore, err := storage.NewLevelDBStore(dbDir)
+	if err != nil {
+		t.Fatalf("NewLevelDBStore: got error %v for the restored store", err)
+	}
+	defer storage.ResetStoreForTesting(restoredStore, true)
+	for _, batch := range batches {
+		storage.CheckGetObservations(t, restoredStore, batch.MetaData, batch.EncryptedObservation)
+	}
+
+	// Existing databases and stores missing from the snapshot are skipped.
+	if restored, err := Restore(latest, "default", dbDir); err != nil || restored {
+		t.Errorf("Restore: got %v and error %v for an existing database, expected it to be skipped", restored, err)
+	}
+	if restored, err := Restore(latest, "customer_1", filepath.Join(tmpDir, "customer_1")); err != nil || restored {
+		t.Errorf("Restore: got %v and error %v for a missing store, expected it to be skipped", restored, err)
+	}
+}
+
+// Tests that a location without a complete snapshot cannot be restored.
+func TestResolveSnapshotWithoutSnapshots(t *testing.T) {
+	tmpDir := makeTempDir(t)
+	defer os.RemoveAll(tmpDir)
+	if uri, err := ResolveSnapshot(tmpDir); err == nil {
+		t.Errorf("ResolveSnapshot: got %s for an empty location, expected an error", uri)
+	}
+}
+
+// Tests that invalid and repeated store names are rejected.
+func TestNewSnapshotterInvalidNames(t *testing.T) {
+	for _, names := range [][]string{{""}, {"a/b"}, {"a", "a"}} {
+		var stores []NamedStore
+		for _, name := range names {
+			stores = append(stores, NamedStore{Name: name})
+		}
+		if _, err := NewSnapshotter(stores, "/unused", 1); err == nil {
+			t.Errorf("NewSnapshotter: got success for store names %v", names)
+		}
+	}
+}
+
+// fakeGCS is a minimal in-memory implementation of the Cloud Storage JSON API
+// for the bucket "bucket".
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const objectsPath = "/b/bucket/o"
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/upload"+objectsPath:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Query().Get("name")] = body
+	case r.Method == "GET" && r.URL.Path == objectsPath:
+		var items []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				items = append(items, `{"name":"`+name+`"}`)
+			}
+		}
+		w.Write([]byte(`{"items":[` + strings.Join(items, ",") + `]}`))
+	case strings.HasPrefix(r.URL.Path, objectsPath+"/"):
+		name := strings.TrimPrefix(r.URL.Path, objectsPath+"/")
+		body, ok := f.objects[name]
+		if !ok {
+			http.NotFound(w, r)
+		} else if r.Method == "DELETE" {
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.Write(body)
+		}
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// Tests the requests of gcsObjectStore against a fake Cloud Storage.
+func TestGCSObjectStore(t *testing.T) {
+	fake := &fakeGCS{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	objects := &gcsObjectStore{
+		client:      server.Client(),
+		uploader:    gcs.NewUploader(server.Client(), server.URL+"/upload/"),
+		apiEndpoint: server.URL + "/",
+		bucket:      "bucket",
+		prefix:      "snapshots/",
+	}
+
+	if err := objects.put("id/default.snapshot", strings.NewReader("rows")); err != nil {
+		t.Fatalf("put: got error %v", err)
+	}
+	if _, ok := fake.objects["snapshots/id/default.snapshot"]; !ok {
+		t.Errorf("put: got objects %v, expected snapshots/id/default.snapshot", fake.objects)
+	}
+	r, err := objects.get("id/default.snapshot")
+	if err != nil {
+		t.Fatalf("get: got error %v", err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(body) != "rows" {
+		t.Errorf("get: got %q, expected \"rows\"", body)
+	}
+	if _, err := objects.get("id/MANIFEST"); err != errObjectNotFound {
+		t.Errorf("get: got error %v for a missing object, expected errObjectNotFound", err)
+	}
+	if names, err := objects.list(); err != nil || len(names) != 1 || names[0] != "id/default.snapshot" {
+		t.Errorf("list: got %v and error %v, expected [id/default.snapshot]", names, err)
+	}
+	if err := objects.remove("id/default.snapshot"); err != nil {
+		t.Errorf("remove: got error %v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("remove: got objects %v, expected none", fake.objects)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Rows holding the number of ObservationVals in a bucket have keys of the form
+// <bucketCountKeyPrefix><BKey>. A count row is written in the same batch as
+// the rows it counts, so that the counts survive a crash exactly.
+const bucketCountKeyPrefix = "#count_"
+
+// bucketCountKey returns the key of the row holding the count of the bucket
+// |bKey|.
+func bucketCountKey(bKey string) []byte {
+	return []byte(bucketCountKeyPrefix + bKey)
+}
+
+// encodeBucketCount returns the value of a count row holding |count|.
+func encodeBucketCount(count int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutVarint(buf, count)]
+}
+
+// decodeBucketCount returns the count held in the value |val| of a count row.
+func decodeBucketCount(val []byte) (int64, error) {
+	count, n := binary.Varint(val)
+	if n <= 0 || n != len(val) || count < 0 {
+		return 0, fmt.Errorf("invalid bucket count %x", val)
+	}
+	return count, nil
+}
+
+// updateBucketCounts adds to |batch| the writes of the count rows of the
+// buckets whose sizes change by |deltas|, keyed by BKey, and returns their new
+// sizes, which must be stored in |bucketSizes| by setBucketSizes() once
+// |batch| is committed. The count row of an empty bucket is deleted.
+// |store.countMu| must be held until then.
+func (store *LevelDBStore) updateBucketCounts(batch *leveldb.Batch, deltas map[string]int64) map[string]int64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	sizes := make(map[string]int64, len(deltas))
+	for bKey, delta := range deltas {
+		size := store.bucketSizes[bKey] + delta
+		if size < 0 {
+			// Only the rows that were counted are deleted, so this is a bug.
+			glog.Errorf("The size of bucket [%s] would become %d. Setting it to 0.", bKey, size)
+			size = 0
+		}
+		if size == 0 {
+			batch.Delete(bucketCountKey(bKey))
+		} else {
+			batch.Put(bucketCountKey(bKey), encodeBucketCount(size))
+		}
+		sizes[bKey] = size
+	}
+	return sizes
+}
+
+// deleteExistingRows adds to |batch| the deletes of the rows in |rowKeys| that
+// exist, and returns their number. |store.countMu| must be held until |batch|
+// is committed, so that no other write deletes them meanwhile.
+func (store *LevelDBStore) deleteExistingRows(batch *leveldb.Batch, rowKeys [][]byte) (int, error) {
+	n := 0
+	for _, rowKey := range rowKeys {
+		ok, err := store.db.Has(rowKey, nil)
+		if err != nil {
+			return 0, grpc.Errorf(codes.Internal, "LevelDB read error: [%v]", err)
+		}
+		if ok {
+			batch.Delete(rowKey)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// setBucketSizes stores the bucket sizes returned by updateBucketCounts() in
+// |bucketSizes|.
+func (store *LevelDBStore) setBucketSizes(sizes map[string]int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for bKey, size := range sizes {
+		store.numObservations += size - store.bucketSizes[bKey]
+		store.bucketSizes[bKey] = size
+	}
+}
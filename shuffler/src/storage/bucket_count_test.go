@@ -0,0 +1,34 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+)
+
+func TestEncodeBucketCount(t *testing.T) {
+	for _, count := range []int64{0, 1, 127, 128, 1 << 40} {
+		got, err := decodeBucketCount(encodeBucketCount(count))
+		if err != nil || got != count {
+			t.Errorf("decodeBucketCount(encodeBucketCount(%d)): got (%d, %v)", count, got, err)
+		}
+	}
+
+	for _, val := range [][]byte{nil, {0x80}, append(encodeBucketCount(5), 0), encodeBucketCount(-1)} {
+		if _, err := decodeBucketCount(val); err == nil {
+			t.Errorf("decodeBucketCount(%x): got success, expected an error", val)
+		}
+	}
+}
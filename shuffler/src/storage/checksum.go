@@ -0,0 +1,70 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/golang/protobuf/proto"
+
+	"shuffler"
+)
+
+// The rows of LevelDBStore holding an ObservationVal have values of the form
+// <checksumMarker><CRC32C of the serialized ObservationVal, big-endian>
+// <serialized ObservationVal>. Rows written before checksums were introduced
+// hold only the serialized ObservationVal. The two are told apart by the
+// first byte: the serialization of a protocol buffer never starts with a zero
+// byte since zero is not a valid field number.
+const checksumMarker = 0x00
+
+// The length of the prefix of a checksummed value.
+const checksumPrefixLen = 1 + crc32.Size
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// addChecksum returns |valBytes|, a serialized ObservationVal, prefixed with
+// its checksum.
+func addChecksum(valBytes []byte) []byte {
+	val := make([]byte, checksumPrefixLen+len(valBytes))
+	val[0] = checksumMarker
+	binary.BigEndian.PutUint32(val[1:checksumPrefixLen], crc32.Checksum(valBytes, castagnoliTable))
+	copy(val[checksumPrefixLen:], valBytes)
+	return val
+}
+
+// parseDBVal verifies the checksum of |val|, the value of a row holding an
+// ObservationVal, if it has one, and returns the parsed ObservationVal. An
+// error is returned if the value is corrupted.
+func parseDBVal(val []byte) (*shuffler.ObservationVal, error) {
+	if len(val) > 0 && val[0] == checksumMarker {
+		if len(val) < checksumPrefixLen {
+			return nil, fmt.Errorf("truncated checksum")
+		}
+		expected := binary.BigEndian.Uint32(val[1:checksumPrefixLen])
+		val = val[checksumPrefixLen:]
+		if actual := crc32.Checksum(val, castagnoliTable); actual != expected {
+			return nil, fmt.Errorf("checksum mismatch: got %08x, expected %08x", actual, expected)
+		}
+	}
+
+	obVal := &shuffler.ObservationVal{}
+	if err := proto.Unmarshal(val, obVal); err != nil {
+		return nil, fmt.Errorf("unable to parse the ObservationVal: %v", err)
+	}
+	return obVal, nil
+}
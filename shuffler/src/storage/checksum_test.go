@@ -0,0 +1,49 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Tests that parseDBVal accepts checksummed and legacy values and rejects
+// corrupted ones.
+func TestParseDBVal(t *testing.T) {
+	obVal := NewObservationVal(MakeRandomEncryptedMsgs(1)[0], "id", Arrival{DayIndex: 3})
+	valBytes, err := proto.Marshal(obVal)
+	if err != nil {
+		t.Fatalf("Marshal: got error %v", err)
+	}
+
+	for _, val := range [][]byte{addChecksum(valBytes), valBytes} {
+		got, err := parseDBVal(val)
+		if err != nil {
+			t.Errorf("parseDBVal: got error %v, expected success", err)
+		} else if !proto.Equal(got, obVal) {
+			t.Errorf("parseDBVal: got [%v], expected [%v]", got, obVal)
+		}
+	}
+
+	corrupted := addChecksum(valBytes)
+	corrupted[checksumPrefixLen] ^= 0x80
+	truncated := addChecksum(valBytes)[:checksumPrefixLen-1]
+	for _, val := range [][]byte{corrupted, truncated, {0x0a, 0xff}} {
+		if _, err := parseDBVal(val); err == nil {
+			t.Errorf("parseDBVal: got success for corrupted value %v", val)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The name of the lock file in a directory locked by LockDir().
+const dirLockFileName = "shuffler.lock"
+
+// A DirLock is an exclusive lock on a store directory held by the current
+// process. See LockDir().
+type DirLock struct {
+	dir  string
+	file *os.File
+}
+
+// LockDir acquires an exclusive lock on |dir|, the directory of a store, so
+// that a second Shuffler process started against the same directory fails
+// fast instead of contending with the first one for the LevelDB databases in
+// it. The directory is created if it does not exist.
+//
+// The lock is an advisory lock on the file shuffler.lock in |dir|, which the
+// operating system releases when the process exits, so that a process that
+// crashed does not leave the directory locked. The file records the host name
+// and pid of the owner, which are included in the error returned if the lock
+// is held by another process.
+//
+// The lock must be held for as long as the store is in use: the caller must
+// keep a reference to the DirLock as the lock is released when it is garbage
+// collected.
+func LockDir(dir string) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, dirLockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		owner, _ := ioutil.ReadAll(file)
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("the store in %s is in use by another Shuffler process (%s)", dir, strings.TrimSpace(string(owner)))
+		}
+		return nil, fmt.Errorf("unable to lock %s: %v", path, err)
+	}
+
+	// The lock file still names the previous owner if it did not exit cleanly.
+	if previousOwner, err := ioutil.ReadAll(file); err == nil && len(previousOwner) > 0 {
+		glog.Warningf("The store in %s was not unlocked by its previous owner (%s).", dir, strings.TrimSpace(string(previousOwner)))
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown host"
+	}
+	owner := fmt.Sprintf("pid %d on %s since %s\n", os.Getpid(), hostname, time.Now().UTC().Format(time.RFC3339))
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(owner), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to record the owner in %s: %v", path, err)
+	}
+	return &DirLock{dir: dir, file: file}, nil
+}
+
+// Unlock clears the owner recorded in the lock file and releases the lock.
+func (l *DirLock) Unlock() error {
+	if err := l.file.Truncate(0); err != nil {
+		glog.Warningf("Unable to clear the owner of the store in %s: %v", l.dir, err)
+	}
+	return l.file.Close()
+}
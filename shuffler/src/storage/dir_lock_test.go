@@ -0,0 +1,58 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests that a locked directory cannot be locked again until it is unlocked.
+func TestLockDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dir_lock")
+	if err != nil {
+		t.Fatalf("TempDir: got error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dir := filepath.Join(tmpDir, "store")
+
+	lock, err := LockDir(dir)
+	if err != nil {
+		t.Fatalf("LockDir: got error %v, expected success", err)
+	}
+	owner := fmt.Sprintf("pid %d", os.Getpid())
+
+	// flock(2) locks of separate open files conflict even within a process.
+	_, err = LockDir(dir)
+	if err == nil {
+		t.Fatalf("LockDir: got success for a locked directory")
+	}
+	if !strings.Contains(err.Error(), owner) {
+		t.Errorf("LockDir: got error [%v], expected it to name the owner [%s]", err, owner)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock: got error %v", err)
+	}
+	lock, err = LockDir(dir)
+	if err != nil {
+		t.Fatalf("LockDir: got error %v after Unlock()", err)
+	}
+	lock.Unlock()
+}
@@ -19,13 +19,11 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"strings"
 
 	"github.com/golang/protobuf/proto"
 
 	shufflerpb "cobalt"
-	randutil "util"
 )
 
 // NewRowKey takes the base64 encoding of a serialized ObservationMetada |bKey|
@@ -35,11 +33,11 @@ import (
 //   - BKey is the base64 encoding of the serialization of a |om|, which is also
 //     used as an index into Persistent store's bucketSizes map.
 //   - Random_id is the base64 encoding of a random 64-bit unsigned integer
-//     generated using |SecureRandom|. This random id is also used for
+//     generated using |shuffleStrategy|. This random id is also used for
 //     shuffling the entries written to leveldb persistent store by the
 //     underlying leveldb sort process.
 // Panics if input |ObservationMetadata| is nil.
-func NewRowKey(bKey string) (rowKey []byte, randStr string, err error) {
+func NewRowKey(bKey string, shuffleStrategy ShuffleStrategy) (rowKey []byte, randStr string, err error) {
 	if bKey == "" {
 		panic("bKey is empty")
 	}
@@ -48,8 +46,7 @@ func NewRowKey(bKey string) (rowKey []byte, randStr string, err error) {
 	// shuffling. Leveldb uses this random value to sort the keys as it saves the
 	// entries in the backend db file, thereby shuffling the new entries as they
 	// come in.
-	randGenerator := &randutil.SecureRandom{}
-	randID, err := randGenerator.RandomUint63(math.MaxInt64)
+	randID, err := shuffleStrategy.NewID()
 	if err != nil {
 		return []byte(""), "", err
 	}
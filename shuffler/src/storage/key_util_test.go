@@ -67,7 +67,7 @@ func TestPKey(t *testing.T) {
 		t.Errorf("got error [%v], want bKey for metadata [%v]", err, om)
 	}
 
-	key, id, _ := NewRowKey(bKey)
+	key, id, _ := NewRowKey(bKey, NewSecureShuffleStrategy())
 	verify(t, key, id)
 }
 
@@ -108,7 +108,7 @@ func TestExtractBKey(t *testing.T) {
 	if err != nil {
 		t.Errorf("got error [%v], want bKey for metadata [%v]", err, om)
 	}
-	key, _, _ := NewRowKey(bKey1)
+	key, _, _ := NewRowKey(bKey1, NewSecureShuffleStrategy())
 	bKey2, err := ExtractBKey(string(key))
 	if err != nil {
 		t.Errorf("got [%v] in extractBKey()", err)
@@ -0,0 +1,69 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// A bucketLease is held by |owner| until |expiry|.
+type bucketLease struct {
+	owner  string
+	expiry time.Time
+}
+
+// memLeases holds the bucket leases of a store whose data is only accessed by
+// a single process, such as a MemStore or a LevelDBStore, in memory. The
+// buckets are identified by their keys in the store.
+type memLeases struct {
+	leases map[string]bucketLease
+
+	// mu protects |leases|.
+	mu sync.Mutex
+}
+
+// newMemLeases returns an empty set of bucket leases.
+func newMemLeases() *memLeases {
+	return &memLeases{
+		leases: make(map[string]bucketLease),
+	}
+}
+
+// tryLease acquires or renews the lease on the bucket |bucket| for |owner|
+// until |ttl| has elapsed and returns true, or returns false if another owner
+// holds an unexpired lease on it.
+func (l *memLeases) tryLease(bucket string, owner string, ttl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if lease, ok := l.leases[bucket]; ok && lease.owner != owner && now.Before(lease.expiry) {
+		return false
+	}
+	l.leases[bucket] = bucketLease{owner: owner, expiry: now.Add(ttl)}
+	return true
+}
+
+// releaseLease releases the lease on the bucket |bucket| if it is held by
+// |owner|.
+func (l *memLeases) releaseLease(bucket string, owner string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lease, ok := l.leases[bucket]; ok && lease.owner == owner {
+		delete(l.leases, bucket)
+	}
+}
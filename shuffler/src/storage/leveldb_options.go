@@ -0,0 +1,78 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// LevelDBOptions tunes the LevelDB database of a LevelDBStore for the load of
+// a Shuffler. Fields that are zero select the defaults of LevelDB.
+type LevelDBOptions struct {
+	// The size in bytes of the in-memory table that buffers writes before they
+	// are sorted into a table file. Larger buffers absorb bursts of incoming
+	// Envelopes with fewer compactions, at the cost of memory and of a longer
+	// recovery at startup.
+	WriteBufferSize int
+
+	// The size in bytes of the cache of uncompressed blocks read from table
+	// files, which serves the reads of the dispatcher.
+	BlockCacheSize int
+
+	// If positive, a bloom filter with this many bits per key is kept for each
+	// table file, which saves disk reads for the lookups of keys that do not
+	// exist. Ten bits per key yield a false positive rate of about 1%.
+	BloomFilterBits int
+
+	// If true, the writes of AddAllObservations() are synced to disk before
+	// they are acknowledged, so that an accepted Envelope survives a crash of
+	// the machine. If false they may be lost in a crash of the machine, but not
+	// in a crash of the process.
+	SyncWrites bool
+
+	// If set, the rows holding an ObservationVal are encrypted with this
+	// 16-byte AES key before they are written, and decrypted as they are read.
+	// Rows written without encryption remain readable. A database holding
+	// encrypted rows cannot be opened without the key with which they were
+	// encrypted. An encrypted row is bound to its bucket and id: if it is
+	// copied to another row on disk it is treated as corrupted, i.e. skipped
+	// as the bucket is read and deleted by Scrub().
+	EncryptionKey []byte
+
+	// If true, the sizes of the buckets are recounted from the rows of the
+	// database as it is opened, and the count rows that do not match are
+	// rewritten. Otherwise they are read from the count rows, and recounted
+	// only if those are corrupted or missing. Recounting reads every row of
+	// the database.
+	RepairBucketCounts bool
+}
+
+// DefaultLevelDBOptions returns the options used by NewLevelDBStore().
+func DefaultLevelDBOptions() LevelDBOptions {
+	return LevelDBOptions{SyncWrites: true}
+}
+
+// openOptions returns the options with which the database is opened.
+func (o LevelDBOptions) openOptions() *opt.Options {
+	options := &opt.Options{
+		WriteBuffer:        o.WriteBufferSize,
+		BlockCacheCapacity: o.BlockCacheSize,
+	}
+	if o.BloomFilterBits > 0 {
+		options.Filter = filter.NewBloomFilter(o.BloomFilterBits)
+	}
+	return options
+}
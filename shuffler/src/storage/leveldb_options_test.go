@@ -0,0 +1,60 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+)
+
+// Tests that the LevelDBOptions are translated into the options of LevelDB.
+func TestLevelDBOpenOptions(t *testing.T) {
+	options := DefaultLevelDBOptions().openOptions()
+	if options.WriteBuffer != 0 || options.BlockCacheCapacity != 0 || options.Filter != nil {
+		t.Errorf("got options %+v for the defaults, expected the defaults of LevelDB", options)
+	}
+
+	options = LevelDBOptions{
+		WriteBufferSize: 16 << 20,
+		BlockCacheSize:  64 << 20,
+		BloomFilterBits: 10,
+	}.openOptions()
+	if options.WriteBuffer != 16<<20 {
+		t.Errorf("got write buffer %d, expected %d", options.WriteBuffer, 16<<20)
+	}
+	if options.BlockCacheCapacity != 64<<20 {
+		t.Errorf("got block cache capacity %d, expected %d", options.BlockCacheCapacity, 64<<20)
+	}
+	if options.Filter == nil {
+		t.Errorf("got no filter, expected a bloom filter")
+	}
+}
+
+// Tests a LevelDBStore whose database is tuned and whose writes are not
+// synced.
+func TestAddGetAndDeleteObservationsForTunedLevelDBStore(t *testing.T) {
+	s, err := NewLevelDBStoreWithOptions("/tmp/shuffler_db", NewSecureShuffleStrategy(), 0, LevelDBOptions{
+		WriteBufferSize: 1 << 20,
+		BlockCacheSize:  1 << 20,
+		BloomFilterBits: 10,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a persistent store instance: %v", err)
+	}
+	if s.syncWrites {
+		t.Errorf("got synced writes, expected unsynced writes")
+	}
+	doTestAddGetAndDeleteObservations(t, s)
+	ResetStoreForTesting(s, true)
+}
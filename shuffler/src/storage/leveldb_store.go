@@ -20,6 +20,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
@@ -35,10 +36,33 @@ import (
 )
 
 const (
-	initializeFailed         = "leveldb-store-initialize-failed"
-	addAllObservationsFailed = "leveldb-store-add-all-observations-failed"
+	initializeFailed          = "leveldb-store-initialize-failed"
+	addAllObservationsFailed  = "leveldb-store-add-all-observations-failed"
+	corruptedObservationFound = "leveldb-store-corrupted-observation-found"
 )
 
+// The largest number of corrupted rows deleted by Scrub() in a single write.
+const scrubDeleteChunkSize = 1000
+
+// Rows holding a serialized DispatchHistory have keys of the form
+// <dispatchHistoryKeyPrefix><BKey>. The prefix cannot occur at the start of a
+// BKey as "#" is not in the base64 alphabet.
+const dispatchHistoryKeyPrefix = "#dispatch_history_"
+
+// Rows holding a serialized DropAudit have keys of the form
+// <dropAuditKeyPrefix><BKey>.
+const dropAuditKeyPrefix = "#drop_audit_"
+
+// Rows holding a serialized ProjectUsage have keys of the form
+// <usageKeyPrefix><customer_id>_<project_id>.
+const usageKeyPrefix = "#usage_"
+
+// isAuxiliaryRow returns true if |dbKey| is the key of a row that does not hold
+// an ObservationVal.
+func isAuxiliaryRow(dbKey string) bool {
+	return strings.HasPrefix(dbKey, dispatchHistoryKeyPrefix) || strings.HasPrefix(dbKey, dropAuditKeyPrefix) || strings.HasPrefix(dbKey, usageKeyPrefix) || strings.HasPrefix(dbKey, bucketCountKeyPrefix)
+}
+
 // LevelDBStore is an persistent store implementation of the Store interface.
 type LevelDBStore struct {
 	// Path to leveldb database folder
@@ -55,25 +79,84 @@ type LevelDBStore struct {
 	// ObservationMetadata. Note that a single bucket is represented by many rows
 	// of |db|.
 	//
-	// We use a signed integer to represent bucket sizes because it is possible
-	// for the value to temporarily be negative. This might occur in the
-	// following situation:
-	// (a) Thread 1 adds Observations to the Store.
-	// (b) Thread 2 reads these Observations from the Store, deletes them, and
-	//     decrements the bucketSizes value.
-	// (c) Thread 1 increments the bucketSizes value.
-	// Between (b) and (c) the value may be negative.
+	// The size of each non-empty bucket is also held in a count row of |db|,
+	// which is updated in the same batch as the rows of the bucket. See
+	// bucket_count.go. |bucketSizes| is updated once the batch is committed,
+	// so it is never negative and it only exceeds the number of rows in |db|
+	// while the rows deleted by DeleteValues() or Scrub() are being committed.
 	bucketSizes map[string]int64
 
+	// numObservations is the sum of |bucketSizes|.
+	numObservations int64
+
 	// mu is the global mutex that protects all elements of |bucketSizes| in-memory
-	// map.
+	// map, and |numObservations|.
 	mu sync.RWMutex
+
+	// countMu serializes the writes that add or delete ObservationVals, so that
+	// each of them updates the count rows from the sizes committed by the
+	// previous one.
+	countMu sync.Mutex
+
+	// historyMu serializes the read-modify-write of DispatchHistory, DropAudit
+	// and ProjectUsage rows.
+	historyMu sync.Mutex
+
+	// shuffleStrategy generates the random identifiers in the row keys and, if
+	// |reshuffleBatchSize| is positive, additionally shuffles the ObservationVals
+	// returned by GetObservations() in batches of that size.
+	shuffleStrategy    ShuffleStrategy
+	reshuffleBatchSize int
+
+	// If not nil, the writes of AddAllObservations() are committed in groups by
+	// |writeCoalescer|. See EnableWriteCoalescing().
+	writeCoalescer *writeCoalescer
+
+	// If true, the writes of AddAllObservations() are synced to disk. See
+	// LevelDBOptions.
+	syncWrites bool
+
+	// If not nil, the rows holding an ObservationVal are encrypted by |cipher|.
+	// See LevelDBOptions.
+	cipher *valueCipher
+
+	// leases holds the bucket leases, keyed by BKey. They are not persisted
+	// since the database is only opened by a single process at a time.
+	leases *memLeases
 }
 
 // NewLevelDBStore returns an implementation of store using LevelDB
-// (https://github.com/google/leveldb).
+// (https://github.com/google/leveldb) and the default ShuffleStrategy.
 func NewLevelDBStore(dbDirPath string) (*LevelDBStore, error) {
-	db, err := leveldb.OpenFile(dbDirPath, nil)
+	return NewLevelDBStoreWithShuffleStrategy(dbDirPath, NewSecureShuffleStrategy(), 0)
+}
+
+// NewLevelDBStoreWithShuffleStrategy returns an implementation of store using
+// LevelDB that uses |shuffleStrategy|. If |reshuffleBatchSize| is positive,
+// the ObservationVals of a bucket, which are ordered by their random
+// identifiers, are shuffled again in batches of |reshuffleBatchSize| as they
+// are read by GetObservations().
+func NewLevelDBStoreWithShuffleStrategy(dbDirPath string, shuffleStrategy ShuffleStrategy, reshuffleBatchSize int) (*LevelDBStore, error) {
+	return NewLevelDBStoreWithOptions(dbDirPath, shuffleStrategy, reshuffleBatchSize, DefaultLevelDBOptions())
+}
+
+// NewLevelDBStoreWithOptions returns an implementation of store using LevelDB
+// as NewLevelDBStoreWithShuffleStrategy() does, whose database is tuned by
+// |options|.
+func NewLevelDBStoreWithOptions(dbDirPath string, shuffleStrategy ShuffleStrategy, reshuffleBatchSize int, options LevelDBOptions) (*LevelDBStore, error) {
+	if shuffleStrategy == nil {
+		panic("shuffleStrategy is nil")
+	}
+
+	var cipher *valueCipher
+	if options.EncryptionKey != nil {
+		var err error
+		if cipher, err = newValueCipher(options.EncryptionKey); err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %v", err)
+		}
+	}
+
+	db, err := leveldb.OpenFile(dbDirPath, options.openOptions())
 	if err != nil {
 		if db != nil {
 			db.Close()
@@ -85,20 +168,104 @@ func NewLevelDBStore(dbDirPath string) (*LevelDBStore, error) {
 		dbDir:       dbDirPath,
 		db:          db,
 		bucketSizes: make(map[string]int64),
+
+		shuffleStrategy:    shuffleStrategy,
+		reshuffleBatchSize: reshuffleBatchSize,
+		syncWrites:         options.SyncWrites,
+		cipher:             cipher,
+		leases:             newMemLeases(),
 	}
-	if err := store.initialize(); err != nil {
+	if err := store.initialize(options.RepairBucketCounts); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return store, nil
 }
 
-// initialize populates in-memory metadata_db map by parsing rows from existing
-// leveldb store.
-func (store *LevelDBStore) initialize() error {
+// initialize populates in-memory metadata_db map from the count rows of the
+// existing leveldb store. The bucket sizes are instead recounted from the rows
+// of the store by repairBucketCounts() if |repair| is true, or if the count
+// rows cannot be trusted: if one of them is corrupted, or if there are none
+// but the store holds ObservationVals, as a database written before count rows
+// were introduced does. It then fails if the store holds encrypted rows and it
+// has no encryption key, or none of them can be decrypted with its key: the
+// rows would otherwise be skipped by GetObservations() and deleted by Scrub().
+func (store *LevelDBStore) initialize(repair bool) error {
+	loaded := false
+	if !repair {
+		var err error
+		if loaded, err = store.loadBucketCounts(); err != nil {
+			return err
+		}
+	}
+	if !loaded {
+		if err := store.repairBucketCounts(); err != nil {
+			return err
+		}
+	}
+	for _, size := range store.bucketSizes {
+		store.numObservations += size
+	}
+	return store.checkEncryptionKey()
+}
+
+// loadBucketCounts populates |bucketSizes| from the count rows, and returns
+// false if they cannot be trusted.
+func (store *LevelDBStore) loadBucketCounts() (bool, error) {
+	iter := store.db.NewIterator(leveldb_util.BytesPrefix([]byte(bucketCountKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		dbKey := string(iter.Key())
+		count, err := decodeBucketCount(iter.Value())
+		if err != nil {
+			stackdriver.LogCountMetricln(initializeFailed, "Existing count row [", dbKey, "] found corrupted: ", err)
+			return false, nil
+		}
+		store.bucketSizes[strings.TrimPrefix(dbKey, bucketCountKeyPrefix)] = count
+	}
+	if err := iter.Error(); err != nil {
+		return false, err
+	}
+	if len(store.bucketSizes) > 0 {
+		return true, nil
+	}
+
+	// The auxiliary rows sort before the rows holding an ObservationVal, so
+	// this reads only up to the first of those.
+	rows := store.db.NewIterator(nil, nil)
+	defer rows.Release()
+	for rows.Next() {
+		if !isAuxiliaryRow(string(rows.Key())) {
+			return false, nil
+		}
+	}
+	return true, rows.Error()
+}
+
+// repairBucketCounts populates |bucketSizes| by counting the rows of the
+// store, and rewrites the count rows that do not match. It reads every row of
+// the store.
+func (store *LevelDBStore) repairBucketCounts() error {
+	store.bucketSizes = make(map[string]int64)
+
+	// The bucket sizes held in the count rows.
+	storedCounts := make(map[string]int64)
+
 	iter := store.db.NewIterator(nil, nil)
 	for iter.Next() {
 		dbKey := string(iter.Key())
+		if strings.HasPrefix(dbKey, bucketCountKeyPrefix) {
+			count, err := decodeBucketCount(iter.Value())
+			if err != nil {
+				continue
+			}
+			storedCounts[strings.TrimPrefix(dbKey, bucketCountKeyPrefix)] = count
+			continue
+		}
+		if isAuxiliaryRow(dbKey) {
+			continue
+		}
 		bKey, err := ExtractBKey(dbKey)
 		if err != nil {
 			stackdriver.LogCountMetricln(initializeFailed, "Existing DB key [", dbKey, "] found corrupted: ", err)
@@ -111,9 +278,57 @@ func (store *LevelDBStore) initialize() error {
 		return err
 	}
 
+	batch := new(leveldb.Batch)
+	for bKey := range storedCounts {
+		if _, ok := store.bucketSizes[bKey]; !ok {
+			batch.Delete(bucketCountKey(bKey))
+		}
+	}
+	for bKey, size := range store.bucketSizes {
+		if count, ok := storedCounts[bKey]; !ok || count != size {
+			batch.Put(bucketCountKey(bKey), encodeBucketCount(size))
+		}
+	}
+	if batch.Len() > 0 {
+		glog.Warningf("Rewriting %d bucket counts that do not match the rows of the database in %s.", batch.Len(), store.dbDir)
+		if err := store.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// checkEncryptionKey returns an error if the first row of a bucket is
+// encrypted and the store has no encryption key, or if the first rows of all
+// buckets that are encrypted cannot be decrypted with its key.
+func (store *LevelDBStore) checkEncryptionKey() error {
+	numEncrypted := 0
+	for bKey := range store.bucketSizes {
+		iter := store.db.NewIterator(leveldb_util.BytesPrefix([]byte(bKey+"_")), nil)
+		if iter.Next() && isEncrypted(iter.Value()) {
+			numEncrypted++
+			if store.cipher != nil {
+				if _, err := store.cipher.decrypt(iter.Key(), iter.Value()); err == nil {
+					iter.Release()
+					return nil
+				}
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+
+	if numEncrypted == 0 {
+		return nil
+	}
+	if store.cipher == nil {
+		return fmt.Errorf("the database in %s holds encrypted Observations but no encryption key was given", store.dbDir)
+	}
+	return fmt.Errorf("none of the %d encrypted Observations checked in the database in %s can be decrypted with the given encryption key", numEncrypted, store.dbDir)
+}
+
 // close closes the database files and unlocks any resources used by
 // leveldb.
 func (store *LevelDBStore) close() error {
@@ -127,6 +342,15 @@ func (store *LevelDBStore) close() error {
 	return nil
 }
 
+// Close closes the database when the Shuffler shuts down. The Observations
+// added by the AddAllObservations() calls that have returned are on disk. The
+// store must not be used after Close() has been invoked.
+func (store *LevelDBStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.close()
+}
+
 // rowKeyPrefix returns the leveldb |prefixRange| for the given
 // ObservationMetadata |om| or an error. RowKey prefix is used in generating
 // unique row keys and also as an index into |bucketSizes| map for LevelDBStore.
@@ -146,29 +370,31 @@ func rowKeyPrefix(om *cobalt.ObservationMetadata) (prefixRange *leveldb_util.Ran
 }
 
 // makeDBVal returns a serialized |ObservationVal| generated from the given
-// |encryptedObservation|, |id| and |arrivalDayIndex|.
-func makeDBVal(encryptedObservation *cobalt.EncryptedMessage, id string, arrivalDayIndex uint32) ([]byte, error) {
+// |encryptedObservation|, |id| and |arrival|, prefixed with its checksum. See
+// checksum.go.
+func makeDBVal(encryptedObservation *cobalt.EncryptedMessage, id string, arrival Arrival) ([]byte, error) {
 	if encryptedObservation == nil {
 		panic("encryptedObservation is nil")
 	}
 
-	valBytes, err := proto.Marshal(NewObservationVal(encryptedObservation, id, arrivalDayIndex))
+	valBytes, err := proto.Marshal(NewObservationVal(encryptedObservation, id, arrival))
 	if err != nil {
 		return []byte(""), err
 	}
-	return valBytes, nil
+	return addChecksum(valBytes), nil
 }
 
 // AddAllObservations adds all of the encrypted observations in all of the
 // ObservationBatches in |envelopeBatch| to the store. New |ObservationVal|s
-// are created to hold the values and the given |arrivalDayIndex|. Returns a
+// are created to hold the values and the given |arrival| metadata. Returns a
 // non-nil error if the arguments are invalid or the operation fails.
-func (store *LevelDBStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrivalDayIndex uint32) error {
-	dbBatch := new(leveldb.Batch)
-
-	tmpBucketSizes := make(map[string]int64)
+//
+// If write coalescing is enabled the Observations may be committed together
+// with those of concurrent invocations. See EnableWriteCoalescing().
+func (store *LevelDBStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrival Arrival) error {
+	w := newPendingWrite()
 
-	// process all observations into a tmp |dbBatch|
+	// process all observations into a tmp |pendingWrite|
 	for _, batch := range envelopeBatch {
 		if batch == nil {
 			return grpc.Errorf(codes.InvalidArgument, "One of the ObservationBatches in the Envelope is not set.")
@@ -191,32 +417,72 @@ func (store *LevelDBStore) AddAllObservations(envelopeBatch []*cobalt.Observatio
 			}
 
 			// generate a new random key for each encrypted observation
-			key, id, err := NewRowKey(bKey)
+			key, id, err := NewRowKey(bKey, store.shuffleStrategy)
 			if err != nil {
 				stackdriver.LogCountMetricln(addAllObservationsFailed, "AddAllObservations() failed in generating PKey for metadata [", om, "]: ", err)
 				return grpc.Errorf(codes.Internal, "Error in processing observation metadata for batch [%v]", om)
 			}
 
 			// generate |ObservationVal| for each encrypted observation
-			val, err := makeDBVal(encryptedObservation, id, arrivalDayIndex)
+			val, err := makeDBVal(encryptedObservation, id, arrival)
 			if err != nil {
 				stackdriver.LogCountMetricln(addAllObservationsFailed, "AddAllObservations() failed in parsing observation value for metadata [", *om, "]: ", err)
 				return grpc.Errorf(codes.Internal, "Error in processing one of the observations for metadata [%v]", *om)
 			}
+			if store.cipher != nil {
+				if val, err = store.cipher.encrypt(key, val); err != nil {
+					stackdriver.LogCountMetricln(addAllObservationsFailed, "AddAllObservations() failed in encrypting observation value for metadata [", om, "]: ", err)
+					return grpc.Errorf(codes.Internal, "Error in processing one of the observations for metadata [%v]", om)
+				}
+			}
 
-			dbBatch.Put(key, val)
-			tmpBucketSizes[bKey]++
+			w.add(bKey, key, val)
 		}
 	}
 
+	if store.writeCoalescer != nil {
+		return store.writeCoalescer.submit(w)
+	}
+	return store.commitWrites([]*pendingWrite{w})
+}
+
+// EnableWriteCoalescing makes AddAllObservations() commit the Observations of
+// concurrent invocations together in a single synced write. A group of
+// invocations is committed once |maxDelay| has passed since the first of them
+// or once it holds at least |maxBatchBytes| bytes, whichever happens first. If
+// |maxBatchBytes| is not positive only |maxDelay| bounds a group. Must be
+// invoked before the store is used.
+func (store *LevelDBStore) EnableWriteCoalescing(maxDelay time.Duration, maxBatchBytes int) {
+	store.writeCoalescer = newWriteCoalescer(maxDelay, maxBatchBytes, store.commitWrites)
+}
+
+// commitWrites writes the rows of all of |writes| and the updated counts of
+// their buckets to the database in a single atomic batch and then updates the
+// bucket sizes.
+func (store *LevelDBStore) commitWrites(writes []*pendingWrite) error {
+	dbBatch := new(leveldb.Batch)
+	deltas := make(map[string]int64)
+	for _, w := range writes {
+		for _, row := range w.rows {
+			dbBatch.Put(row.key, row.val)
+		}
+		for bKey, n := range w.bucketSizes {
+			deltas[bKey] += n
+		}
+	}
+
+	store.countMu.Lock()
+	defer store.countMu.Unlock()
+	sizes := store.updateBucketCounts(dbBatch, deltas)
+
 	// Set db write options |Sync| to sync underlying writes from the OS buffer
-	// cache through to actual disk immediately and |NoWriteMerge| to disable
-	// write merge on concurrent access. Setting Sync can result in slower writes.
-	// If same key is specified twice, it will get overwritten by the most recent
-	// update.
+	// cache through to actual disk immediately unless disabled by the
+	// LevelDBOptions, and |NoWriteMerge| to disable write merge on concurrent
+	// access. Setting Sync can result in slower writes. If same key is
+	// specified twice, it will get overwritten by the most recent update.
 	woptions := &opt.WriteOptions{
 		NoWriteMerge: false,
-		Sync:         true,
+		Sync:         store.syncWrites,
 	}
 
 	// commit |dbBatch|
@@ -225,13 +491,7 @@ func (store *LevelDBStore) AddAllObservations(envelopeBatch []*cobalt.Observatio
 		return grpc.Errorf(codes.Internal, "Internal error in processing the ObservationBatch.")
 	}
 
-	// update counts for all keys
-	store.mu.Lock()
-	defer store.mu.Unlock()
-	for k := range tmpBucketSizes {
-		store.bucketSizes[k] += tmpBucketSizes[k]
-	}
-
+	store.setBucketSizes(sizes)
 	return nil
 }
 
@@ -248,8 +508,14 @@ func (store *LevelDBStore) GetObservations(om *cobalt.ObservationMetadata) (Iter
 		return nil, grpc.Errorf(codes.InvalidArgument, "Error in generating rowkey prefix for observation metadata [%v]: [%v]", *om, err)
 	}
 
-	iter := store.db.NewIterator(keyPrefix, nil)
-	return NewLevelDBStoreIterator(iter), nil
+	var iter Iterator = &LevelDBStoreIterator{
+		iter:   store.db.NewIterator(keyPrefix, nil),
+		cipher: store.cipher,
+	}
+	if store.reshuffleBatchSize > 0 {
+		iter = newReshufflingIterator(iter, store.shuffleStrategy, store.reshuffleBatchSize)
+	}
+	return iter, nil
 }
 
 // GetKeys returns the list of all |ObservationMetadata| keys stored in the
@@ -269,6 +535,30 @@ func (store *LevelDBStore) GetKeys() ([]*cobalt.ObservationMetadata, error) {
 	return keys, nil
 }
 
+// ForEachKey invokes |f| for each |ObservationMetadata| key stored in the data
+// store until |f| returns false, or returns an error.
+func (store *LevelDBStore) ForEachKey(f func(om *cobalt.ObservationMetadata) bool) error {
+	// Only the serialized bucket keys are copied while holding the lock so that
+	// |f| is free to call back into the store.
+	store.mu.RLock()
+	bKeys := make([]string, 0, len(store.bucketSizes))
+	for bKey := range store.bucketSizes {
+		bKeys = append(bKeys, bKey)
+	}
+	store.mu.RUnlock()
+
+	for _, bKey := range bKeys {
+		om, err := UnmarshalBKey(bKey)
+		if err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing observation metadata for bucket key [%v]: [%v]", bKey, err)
+		}
+		if !f(om) {
+			break
+		}
+	}
+	return nil
+}
+
 // DeleteValues deletes the given |ObservationVal|s for |ObservationMetadata|
 // key from the data store or returns an error.
 func (store *LevelDBStore) DeleteValues(om *cobalt.ObservationMetadata, obVals []*shuffler.ObservationVal) error {
@@ -280,34 +570,152 @@ func (store *LevelDBStore) DeleteValues(om *cobalt.ObservationMetadata, obVals [
 		return nil
 	}
 
-	batch := new(leveldb.Batch)
-	for _, obVal := range obVals {
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	rowKeys := make([][]byte, len(obVals))
+	for i, obVal := range obVals {
 		rowKey, err := RowKeyFromMetadata(om, obVal.Id)
 		if err != nil {
 			return grpc.Errorf(codes.InvalidArgument, "Error in making rowkey from observation metadata [%v]: [%v]", om, err)
 		}
-		batch.Delete([]byte(rowKey))
+		rowKeys[i] = []byte(rowKey)
 	}
 
+	// The count of the bucket is updated in the same batch as the deleted rows.
+	// Only the rows that still exist are counted, so that ObservationVals
+	// deleted twice, e.g. by a retried dispatch, are not subtracted twice.
+	store.countMu.Lock()
+	defer store.countMu.Unlock()
+	batch := new(leveldb.Batch)
+	numDeleted, err := store.deleteExistingRows(batch, rowKeys)
+	if err != nil {
+		return err
+	}
+	if numDeleted == 0 {
+		return nil
+	}
+	sizes := store.updateBucketCounts(batch, map[string]int64{bKey: -int64(numDeleted)})
 	if err := store.db.Write(batch, nil); err != nil {
 		return grpc.Errorf(codes.Internal, "LevelDB write error: [%v]", err)
 	}
+	store.setBucketSizes(sizes)
+
+	return nil
+}
+
+// TryLease acquires or renews the lease on the bucket for the given
+// |ObservationMetadata| key for |owner| until |ttl| has elapsed, and returns
+// true, or returns false if another owner holds an unexpired lease on it.
+func (store *LevelDBStore) TryLease(om *cobalt.ObservationMetadata, owner string, ttl time.Duration) (bool, error) {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
 
-	// update bucketSizes map for the deleted rows
-	store.mu.Lock()
-	defer store.mu.Unlock()
 	bKey, err := BKey(om)
 	if err != nil {
-		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+		return false, grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
 	}
+	return store.leases.tryLease(bKey, owner, ttl), nil
+}
 
-	// Note that this decrement may cause the value of bucketSizes[bKey] to,
-	// temporarily, be negative. See explanation of how this might occur above.
-	store.bucketSizes[bKey] -= int64(len(obVals))
+// ReleaseLease releases the lease on the bucket for the given
+// |ObservationMetadata| key if it is held by |owner|, or returns an error.
+func (store *LevelDBStore) ReleaseLease(om *cobalt.ObservationMetadata, owner string) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
 
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+	store.leases.releaseLease(bKey, owner)
 	return nil
 }
 
+// Scrub verifies the checksums of all ObservationVals in the data store and
+// deletes those that are corrupted. Returns the number of ObservationVals that
+// were checked and deleted, or an error. Rows written before checksums were
+// introduced are deleted only if they cannot be parsed.
+//
+// Scrub may run concurrently with the dispatcher: it deletes only rows that
+// GetObservations() skips and that are therefore never dispatched or deleted
+// by anyone else.
+func (store *LevelDBStore) Scrub() (numChecked int, numDeleted int, err error) {
+	iter := store.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	// The keys of the corrupted rows to delete, by BKey.
+	corrupted := make(map[string][][]byte)
+	numCorrupted := 0
+	flush := func() error {
+		if numCorrupted == 0 {
+			return nil
+		}
+
+		store.countMu.Lock()
+		defer store.countMu.Unlock()
+		batch := new(leveldb.Batch)
+		deltas := make(map[string]int64, len(corrupted))
+		for bKey, rowKeys := range corrupted {
+			n, err := store.deleteExistingRows(batch, rowKeys)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				deltas[bKey] = -int64(n)
+			}
+		}
+		sizes := store.updateBucketCounts(batch, deltas)
+		if err := store.db.Write(batch, nil); err != nil {
+			return grpc.Errorf(codes.Internal, "LevelDB write error: [%v]", err)
+		}
+		store.setBucketSizes(sizes)
+
+		for _, n := range deltas {
+			numDeleted -= int(n)
+		}
+		corrupted = make(map[string][][]byte)
+		numCorrupted = 0
+		return nil
+	}
+
+	for iter.Next() {
+		dbKey := string(iter.Key())
+		if isAuxiliaryRow(dbKey) {
+			continue
+		}
+		numChecked++
+		_, parseErr := parseStoredVal(iter.Key(), iter.Value(), store.cipher)
+		if parseErr == nil {
+			continue
+		}
+		bKey, err := ExtractBKey(dbKey)
+		if err != nil {
+			// The row was not counted by repairBucketCounts() either.
+			continue
+		}
+		stackdriver.LogCountMetricf(corruptedObservationFound, "Scrub() is deleting the corrupted row [%s]: %v", dbKey, parseErr)
+		corrupted[bKey] = append(corrupted[bKey], append([]byte(nil), iter.Key()...))
+		numCorrupted++
+		if numCorrupted == scrubDeleteChunkSize {
+			if err := flush(); err != nil {
+				return numChecked, numDeleted, err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return numChecked, numDeleted, grpc.Errorf(codes.Internal, "LevelDB iterator error: [%v]", err)
+	}
+	if err := flush(); err != nil {
+		return numChecked, numDeleted, err
+	}
+	return numChecked, numDeleted, nil
+}
+
 // GetNumObservations returns the total count of ObservationVals in the data
 // store for the given |ObservationMmetadata| key or returns an error.
 func (store *LevelDBStore) GetNumObservations(om *cobalt.ObservationMetadata) (int, error) {
@@ -330,6 +738,265 @@ func (store *LevelDBStore) GetNumObservations(om *cobalt.ObservationMetadata) (i
 	return int(count), nil
 }
 
+// GetTotalNumObservations returns the total count of ObservationVals in the
+// data store.
+func (store *LevelDBStore) GetTotalNumObservations() (int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.numObservations, nil
+}
+
+// dispatchHistoryKey returns the key of the row holding the DispatchHistory
+// for the given ObservationMetadata |om|.
+func dispatchHistoryKey(om *cobalt.ObservationMetadata) ([]byte, error) {
+	bKey, err := BKey(om)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(dispatchHistoryKeyPrefix + bKey), nil
+}
+
+// AddDispatchRecord appends |record| to the DispatchHistory of the bucket for
+// the given |ObservationMetadata| key, keeping only the |maxRecords| most
+// recent records.
+func (store *LevelDBStore) AddDispatchRecord(om *cobalt.ObservationMetadata, record *shuffler.DispatchRecord, maxRecords int) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	if record == nil {
+		panic("record is nil")
+	}
+
+	key, err := dispatchHistoryKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	store.historyMu.Lock()
+	defer store.historyMu.Unlock()
+
+	history := &shuffler.DispatchHistory{}
+	val, err := store.db.Get(key, nil)
+	switch err {
+	case nil:
+		if err := proto.Unmarshal(val, history); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the dispatch history for metadata [%v]: [%v]", om, err)
+		}
+	case leveldb.ErrNotFound:
+		history.Bucket = om
+	default:
+		return grpc.Errorf(codes.Internal, "LevelDB read error: [%v]", err)
+	}
+	appendDispatchRecord(history, record, maxRecords)
+
+	val, err = proto.Marshal(history)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Error in serializing the dispatch history for metadata [%v]: [%v]", om, err)
+	}
+	if err := store.db.Put(key, val, nil); err != nil {
+		return grpc.Errorf(codes.Internal, "LevelDB write error: [%v]", err)
+	}
+
+	return nil
+}
+
+// GetDispatchHistories returns the DispatchHistories of all buckets or returns
+// an error.
+func (store *LevelDBStore) GetDispatchHistories() ([]*shuffler.DispatchHistory, error) {
+	histories := []*shuffler.DispatchHistory{}
+	iter := store.db.NewIterator(leveldb_util.BytesPrefix([]byte(dispatchHistoryKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		history := &shuffler.DispatchHistory{}
+		if err := proto.Unmarshal(iter.Value(), history); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the dispatch history in row [%s]: [%v]", iter.Key(), err)
+		}
+		histories = append(histories, history)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "LevelDB read error: [%v]", err)
+	}
+
+	return histories, nil
+}
+
+// DeleteDispatchHistory deletes the DispatchHistory of the bucket for the given
+// |ObservationMetadata| key or returns an error.
+func (store *LevelDBStore) DeleteDispatchHistory(om *cobalt.ObservationMetadata) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	key, err := dispatchHistoryKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	store.historyMu.Lock()
+	defer store.historyMu.Unlock()
+	if err := store.db.Delete(key, nil); err != nil {
+		return grpc.Errorf(codes.Internal, "LevelDB write error: [%v]", err)
+	}
+
+	return nil
+}
+
+// dropAuditKey returns the key of the row holding the DropAudit for the given
+// ObservationMetadata |om|.
+func dropAuditKey(om *cobalt.ObservationMetadata) ([]byte, error) {
+	bKey, err := BKey(om)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(dropAuditKeyPrefix + bKey), nil
+}
+
+// AddDropCount adds |numObservations| to the DropRecord for |arrivalDayIndex|
+// and |reason| in the DropAudit of the bucket for the given
+// |ObservationMetadata| key.
+func (store *LevelDBStore) AddDropCount(om *cobalt.ObservationMetadata, arrivalDayIndex uint32, reason shuffler.DropRecord_Reason, numObservations uint64) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	key, err := dropAuditKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	store.historyMu.Lock()
+	defer store.historyMu.Unlock()
+
+	audit := &shuffler.DropAudit{}
+	val, err := store.db.Get(key, nil)
+	switch err {
+	case nil:
+		if err := proto.Unmarshal(val, audit); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the drop audit for metadata [%v]: [%v]", om, err)
+		}
+	case leveldb.ErrNotFound:
+		audit.Bucket = om
+	default:
+		return grpc.Errorf(codes.Internal, "LevelDB read error: [%v]", err)
+	}
+	addDropCount(audit, arrivalDayIndex, reason, numObservations)
+
+	val, err = proto.Marshal(audit)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Error in serializing the drop audit for metadata [%v]: [%v]", om, err)
+	}
+	if err := store.db.Put(key, val, nil); err != nil {
+		return grpc.Errorf(codes.Internal, "LevelDB write error: [%v]", err)
+	}
+
+	return nil
+}
+
+// GetDropAudits returns the DropAudits of all buckets or returns an error.
+func (store *LevelDBStore) GetDropAudits() ([]*shuffler.DropAudit, error) {
+	audits := []*shuffler.DropAudit{}
+	iter := store.db.NewIterator(leveldb_util.BytesPrefix([]byte(dropAuditKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		audit := &shuffler.DropAudit{}
+		if err := proto.Unmarshal(iter.Value(), audit); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the drop audit in row [%s]: [%v]", iter.Key(), err)
+		}
+		audits = append(audits, audit)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "LevelDB read error: [%v]", err)
+	}
+
+	return audits, nil
+}
+
+// DeleteDropAudit deletes the DropAudit of the bucket for the given
+// |ObservationMetadata| key or returns an error.
+func (store *LevelDBStore) DeleteDropAudit(om *cobalt.ObservationMetadata) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	key, err := dropAuditKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	store.historyMu.Lock()
+	defer store.historyMu.Unlock()
+	if err := store.db.Delete(key, nil); err != nil {
+		return grpc.Errorf(codes.Internal, "LevelDB write error: [%v]", err)
+	}
+
+	return nil
+}
+
+// usageKey returns the key of the row holding the ProjectUsage of the given
+// project.
+func usageKey(customerId uint32, projectId uint32) []byte {
+	return []byte(fmt.Sprintf("%s%d_%d", usageKeyPrefix, customerId, projectId))
+}
+
+// AddUsage adds the counts in |record| to the UsageRecord for
+// |record.DayIndex| in the ProjectUsage of the given project.
+func (store *LevelDBStore) AddUsage(customerId uint32, projectId uint32, record *shuffler.UsageRecord) error {
+	if record == nil {
+		panic("record is nil")
+	}
+
+	key := usageKey(customerId, projectId)
+
+	store.historyMu.Lock()
+	defer store.historyMu.Unlock()
+
+	usage := &shuffler.ProjectUsage{}
+	val, err := store.db.Get(key, nil)
+	switch err {
+	case nil:
+		if err := proto.Unmarshal(val, usage); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the usage of project (%d, %d): [%v]", customerId, projectId, err)
+		}
+	case leveldb.ErrNotFound:
+		usage.CustomerId = customerId
+		usage.ProjectId = projectId
+	default:
+		return grpc.Errorf(codes.Internal, "LevelDB read error: [%v]", err)
+	}
+	addUsage(usage, record)
+
+	val, err = proto.Marshal(usage)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Error in serializing the usage of project (%d, %d): [%v]", customerId, projectId, err)
+	}
+	if err := store.db.Put(key, val, nil); err != nil {
+		return grpc.Errorf(codes.Internal, "LevelDB write error: [%v]", err)
+	}
+
+	return nil
+}
+
+// GetUsage returns the ProjectUsages of all projects or returns an error.
+func (store *LevelDBStore) GetUsage() ([]*shuffler.ProjectUsage, error) {
+	usages := []*shuffler.ProjectUsage{}
+	iter := store.db.NewIterator(leveldb_util.BytesPrefix([]byte(usageKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		usage := &shuffler.ProjectUsage{}
+		if err := proto.Unmarshal(iter.Value(), usage); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the usage in row [%s]: [%v]", iter.Key(), err)
+		}
+		usages = append(usages, usage)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "LevelDB read error: [%v]", err)
+	}
+
+	return usages, nil
+}
+
 // Reset clears any in-memory caches and deletes all data permanently from
 // the |store| if |destroy| is set to true.
 func (store *LevelDBStore) Reset(destroy bool) {
@@ -337,6 +1004,7 @@ func (store *LevelDBStore) Reset(destroy bool) {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 	store.bucketSizes = make(map[string]int64)
+	store.numObservations = 0
 
 	// clear and reset db instance
 	store.close()
@@ -15,18 +15,24 @@
 package storage
 
 import (
-	"github.com/golang/protobuf/proto"
 	leveldb_iter "github.com/syndtr/goleveldb/leveldb/iterator"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 
 	"shuffler"
+	"util/stackdriver"
 )
 
 // LevelDBStoreIterator provides an iterator to parse the result set pointed to
 // by an underlying leveldb iterator object.
 type LevelDBStoreIterator struct {
 	iter leveldb_iter.Iterator
+
+	// The ObservationVal of the current entry, parsed by Next().
+	obVal *shuffler.ObservationVal
+
+	// If not nil, decrypts the encrypted entries.
+	cipher *valueCipher
 }
 
 // NewLevelDBStoreIterator builds and initializes a new |LevelDBStoreIterator|
@@ -48,32 +54,41 @@ func (li *LevelDBStoreIterator) Get() (*shuffler.ObservationVal, error) {
 		panic("LevelDBStore Iterator is nil.")
 	}
 
-	if li.iter == nil || !li.iter.Valid() {
+	if li.iter == nil || li.obVal == nil {
 		return nil, grpc.Errorf(codes.Internal, "Invalid iterator")
 	}
 
-	obVal := &shuffler.ObservationVal{}
-	if err := proto.Unmarshal(li.iter.Value(), obVal); err != nil {
-		return nil, grpc.Errorf(codes.Internal, "Error in parsing observation value from datastore: [%v]", err)
-	}
-
-	return obVal, nil
+	return li.obVal, nil
 }
 
 // Next advances the iterator to the next entry and returns whether or not
 // the iterator is still valid. The Get() method may only be invoked on a
 // valid iterator. A newly obtained iterator starts before the first valid
 // entry so Next() must be invoked before Get().
+//
+// Entries whose checksum does not match or that cannot be parsed are counted
+// and skipped, so that a corrupted row does not prevent the rest of the
+// bucket from being read. They are deleted by LevelDBStore.Scrub().
 func (li *LevelDBStoreIterator) Next() bool {
 	if li == nil {
 		panic("LevelDBStore Iterator is nil.")
 	}
 
+	li.obVal = nil
 	if li.iter == nil {
 		return false
 	}
 
-	return li.iter.Next()
+	for li.iter.Next() {
+		obVal, err := parseStoredVal(li.iter.Key(), li.iter.Value(), li.cipher)
+		if err != nil {
+			stackdriver.LogCountMetricf(corruptedObservationFound, "Skipping the corrupted row [%s]: %v", li.iter.Key(), err)
+			continue
+		}
+		li.obVal = obVal
+		return true
+	}
+	return false
 }
 
 // Release releases the iterator after use.
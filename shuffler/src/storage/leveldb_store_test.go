@@ -18,9 +18,13 @@ package storage
 
 import (
 	"cobalt"
+	"shuffler"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // makeLevelDBTestStore creates leveldb |TestStore|.
@@ -44,6 +48,51 @@ func TestShuffleObservationsForLevelDBStore(t *testing.T) {
 	ResetStoreForTesting(s, true)
 }
 
+func TestShuffleObservationsForLevelDBStoreWithReshuffling(t *testing.T) {
+	s, err := NewLevelDBStoreWithShuffleStrategy("/tmp/shuffler_db", NewSecureShuffleStrategy(), 30)
+	if err != nil {
+		t.Fatalf("Failed to create a persistent store instance: %v", err)
+	}
+	doTestShuffle(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestForEachKeyForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	doTestForEachKey(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDispatchHistoryForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	doTestDispatchHistory(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDropAuditForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	doTestDropAudit(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestUsageForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	doTestUsage(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDeleteValuesInChunksForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	doTestDeleteValuesInChunks(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestLeasesForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	doTestLeases(t, s)
+	ResetStoreForTesting(s, true)
+}
+
 func TestLevelDBInitialization(t *testing.T) {
 	s1 := makeLevelDBTestStore(t)
 
@@ -53,7 +102,7 @@ func TestLevelDBInitialization(t *testing.T) {
 	om := NewObservationMetaData(501)
 	batch := NewObservationBatchForMetadata(om, numMsgs)
 	if err := s1.AddAllObservations([]*cobalt.ObservationBatch{batch},
-		arrivalDayIndex); err != nil {
+		Arrival{DayIndex: arrivalDayIndex}); err != nil {
 		t.Errorf("AddAllObservations: got error %v, expected success", err)
 	}
 
@@ -64,6 +113,11 @@ func TestLevelDBInitialization(t *testing.T) {
 
 	// close existing db handle and clear only in-memory state, but do not destroy
 	// the persistent DB state
+	// A dispatch history row must not be mistaken for a bucket.
+	if err := s1.AddDispatchRecord(NewObservationMetaData(502), &shuffler.DispatchRecord{}, 1); err != nil {
+		t.Errorf("AddDispatchRecord: got error %v, expected success", err)
+	}
+
 	ResetStoreForTesting(s1, false)
 
 	// check to see if initialization succeeds reading from the existing DB.
@@ -83,7 +137,7 @@ func TestLevelDBStoreIterator(t *testing.T) {
 	const numBatches = 10
 	const arrivalDayIndex = 16
 	batches := MakeObservationBatches(numBatches)
-	if err := s.AddAllObservations(batches, arrivalDayIndex); err != nil {
+	if err := s.AddAllObservations(batches, Arrival{DayIndex: arrivalDayIndex}); err != nil {
 		t.Errorf("AddAllObservations: got error %v, expected success", err)
 	}
 
@@ -116,3 +170,280 @@ func TestLevelDBStoreIterator(t *testing.T) {
 		}
 	}
 }
+
+// Tests that corrupted rows are skipped by GetObservations() and deleted by
+// Scrub(), and that rows written without a checksum can still be read.
+func TestLevelDBStoreCorruptedObservations(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	defer ResetStoreForTesting(s, true)
+
+	const numMsgs = 10
+	om := NewObservationMetaData(701)
+	batch := NewObservationBatchForMetadata(om, numMsgs)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	obVals := CheckObservations(t, s, om, numMsgs)
+
+	// Flip a bit in the ciphertext of the first row and rewrite the second row
+	// without a checksum.
+	for i, obVal := range obVals[:2] {
+		rowKey, err := RowKeyFromMetadata(om, obVal.Id)
+		if err != nil {
+			t.Fatalf("RowKeyFromMetadata: got error %v", err)
+		}
+		val, err := s.db.Get([]byte(rowKey), nil)
+		if err != nil {
+			t.Fatalf("Get: got error %v", err)
+		}
+		if i == 0 {
+			val[len(val)-1] ^= 1
+		} else {
+			val = val[checksumPrefixLen:]
+		}
+		if err := s.db.Put([]byte(rowKey), val, nil); err != nil {
+			t.Fatalf("Put: got error %v", err)
+		}
+	}
+
+	iter, err := s.GetObservations(om)
+	if err != nil {
+		t.Fatalf("GetObservations: got error %v", err)
+	}
+	if gotObVals := CheckIterator(t, iter); len(gotObVals) != numMsgs-1 {
+		t.Errorf("got %d ObservationVals, expected %d", len(gotObVals), numMsgs-1)
+	}
+
+	numChecked, numDeleted, err := s.Scrub()
+	if err != nil || numChecked != numMsgs || numDeleted != 1 {
+		t.Errorf("Scrub: got (%d, %d, %v), expected (%d, 1, nil)", numChecked, numDeleted, err, numMsgs)
+	}
+	CheckNumObservations(t, s, om, numMsgs-1)
+	CheckObservations(t, s, om, numMsgs-1)
+}
+
+func TestAddGetAndDeleteObservationsForLevelDBStoreWithWriteCoalescing(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	s.EnableWriteCoalescing(time.Millisecond, 1<<20)
+	doTestAddGetAndDeleteObservations(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+// TestConcurrentAddsWithWriteCoalescing tests that the Observations of
+// concurrent invocations of AddAllObservations() are all stored and counted
+// when their writes are coalesced.
+func TestConcurrentAddsWithWriteCoalescing(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	defer ResetStoreForTesting(s, true)
+	s.EnableWriteCoalescing(10*time.Millisecond, 1<<20)
+
+	const numEnvelopes = 50
+	const numMsgs = 4
+	om := NewObservationMetaData(502)
+	var wg sync.WaitGroup
+	errs := make(chan error, numEnvelopes)
+	for i := 0; i < numEnvelopes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := NewObservationBatchForMetadata(om, numMsgs)
+			errs <- s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 10})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("AddAllObservations: got error %v, expected success", err)
+		}
+	}
+	CheckNumObservations(t, s, om, numEnvelopes*numMsgs)
+
+	// An invalid envelope fails on its own.
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{nil}, Arrival{DayIndex: 10}); err == nil {
+		t.Errorf("AddAllObservations: got success for an invalid envelope, expected an error")
+	}
+	CheckNumObservations(t, s, om, numEnvelopes*numMsgs)
+}
+
+// checkBucketCount checks that the count row of the bucket for |om| holds
+// |expected|, or that there is none if |expected| is 0.
+func checkBucketCount(t *testing.T, s *LevelDBStore, om *cobalt.ObservationMetadata, expected int64) {
+	bKey, err := BKey(om)
+	if err != nil {
+		t.Fatalf("BKey: got error %v", err)
+	}
+	val, err := s.db.Get(bucketCountKey(bKey), nil)
+	if expected == 0 {
+		if err != leveldb.ErrNotFound {
+			t.Errorf("got count row %x and error %v, expected none", val, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Get: got error %v", err)
+	}
+	if count, err := decodeBucketCount(val); err != nil || count != expected {
+		t.Errorf("got count (%d, %v), expected %d", count, err, expected)
+	}
+}
+
+// Tests that the count rows are updated with the rows they count, that the
+// bucket sizes are read from them when the store is reopened, and that the
+// counts that do not match the rows are rewritten when the store is reopened
+// with LevelDBOptions.RepairBucketCounts.
+func TestBucketCountsForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	om1 := NewObservationMetaData(505)
+	om2 := NewObservationMetaData(506)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{
+		NewObservationBatchForMetadata(om1, 10),
+		NewObservationBatchForMetadata(om2, 3),
+	}, Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	checkBucketCount(t, s, om1, 10)
+	checkBucketCount(t, s, om2, 3)
+
+	obVals := CheckObservations(t, s, om1, 10)
+	if err := s.DeleteValues(om1, obVals[:4]); err != nil {
+		t.Fatalf("DeleteValues: got error %v, expected success", err)
+	}
+	checkBucketCount(t, s, om1, 6)
+	if err := s.DeleteValues(om2, CheckObservations(t, s, om2, 3)); err != nil {
+		t.Fatalf("DeleteValues: got error %v, expected success", err)
+	}
+	checkBucketCount(t, s, om2, 0)
+	CheckNumObservations(t, s, om2, 0)
+
+	// Make the count of |om1| wrong and add a count for the empty bucket |om2|.
+	bKey1, _ := BKey(om1)
+	bKey2, _ := BKey(om2)
+	if err := s.db.Put(bucketCountKey(bKey1), encodeBucketCount(2), nil); err != nil {
+		t.Fatalf("Put: got error %v", err)
+	}
+	if err := s.db.Put(bucketCountKey(bKey2), encodeBucketCount(7), nil); err != nil {
+		t.Fatalf("Put: got error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: got error %v, expected success", err)
+	}
+
+	// The counts are trusted when the store is reopened.
+	s = makeLevelDBTestStore(t)
+	CheckNumObservations(t, s, om1, 2)
+	CheckNumObservations(t, s, om2, 7)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: got error %v, expected success", err)
+	}
+
+	options := DefaultLevelDBOptions()
+	options.RepairBucketCounts = true
+	s, err := NewLevelDBStoreWithOptions("/tmp/shuffler_db", NewSecureShuffleStrategy(), 0, options)
+	if err != nil {
+		t.Fatalf("NewLevelDBStoreWithOptions: got error %v, expected success", err)
+	}
+	defer ResetStoreForTesting(s, true)
+	CheckNumObservations(t, s, om1, 6)
+	checkBucketCount(t, s, om1, 6)
+	checkBucketCount(t, s, om2, 0)
+	if _, err := s.GetNumObservations(om2); err == nil {
+		t.Errorf("GetNumObservations: got success for an empty bucket after reopening, expected an error")
+	}
+}
+
+// Tests that the bucket sizes are recounted when a store without count rows,
+// as written before count rows were introduced, is reopened.
+func TestMissingBucketCountsForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	om := NewObservationMetaData(507)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{NewObservationBatchForMetadata(om, 5)}, Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	bKey, _ := BKey(om)
+	if err := s.db.Delete(bucketCountKey(bKey), nil); err != nil {
+		t.Fatalf("Delete: got error %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: got error %v, expected success", err)
+	}
+
+	s = makeLevelDBTestStore(t)
+	defer ResetStoreForTesting(s, true)
+	CheckNumObservations(t, s, om, 5)
+	checkBucketCount(t, s, om, 5)
+}
+
+// Tests that ObservationVals deleted twice are counted once.
+func TestDeleteValuesTwiceForLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	defer ResetStoreForTesting(s, true)
+	om := NewObservationMetaData(508)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{NewObservationBatchForMetadata(om, 5)}, Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	obVals := CheckObservations(t, s, om, 5)
+	for i := 0; i < 2; i++ {
+		if err := s.DeleteValues(om, obVals[:2]); err != nil {
+			t.Fatalf("DeleteValues: got error %v, expected success", err)
+		}
+	}
+	if err := s.DeleteValues(om, obVals[1:3]); err != nil {
+		t.Fatalf("DeleteValues: got error %v, expected success", err)
+	}
+	CheckNumObservations(t, s, om, 2)
+	checkBucketCount(t, s, om, 2)
+	CheckObservations(t, s, om, 2)
+}
+
+// Tests that the Observations in a LevelDBStore are kept when it is closed and
+// reopened.
+func TestCloseLevelDBStore(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	om := NewObservationMetaData(504)
+	batch := NewObservationBatchForMetadata(om, 5)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: got error %v, expected success", err)
+	}
+
+	s = makeLevelDBTestStore(t)
+	defer ResetStoreForTesting(s, true)
+	CheckNumObservations(t, s, om, 5)
+}
+
+// benchmarkConcurrentAdds measures the throughput of concurrent invocations of
+// AddAllObservations(), each adding a single small envelope. If |maxDelay| is
+// positive write coalescing is enabled.
+func benchmarkConcurrentAdds(b *testing.B, maxDelay time.Duration) {
+	s, err := NewLevelDBStore("/tmp/shuffler_bench_db")
+	if err != nil {
+		b.Fatalf("Failed to create a persistent store instance: %v", err)
+	}
+	defer ResetStoreForTesting(s, true)
+	if maxDelay > 0 {
+		s.EnableWriteCoalescing(maxDelay, 1<<20)
+	}
+
+	om := NewObservationMetaData(503)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			batch := NewObservationBatchForMetadata(om, 5)
+			if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 10}); err != nil {
+				b.Errorf("AddAllObservations: got error %v, expected success", err)
+			}
+		}
+	})
+}
+
+func BenchmarkConcurrentAddsForLevelDBStore(b *testing.B) {
+	benchmarkConcurrentAdds(b, 0)
+}
+
+func BenchmarkConcurrentAddsForLevelDBStoreWithWriteCoalescing(b *testing.B) {
+	benchmarkConcurrentAdds(b, 2*time.Millisecond)
+}
@@ -16,9 +16,9 @@ package storage
 
 import (
 	"fmt"
-	"math/rand"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
@@ -27,11 +27,8 @@ import (
 
 	"cobalt"
 	"shuffler"
-	rand_util "util"
 )
 
-var randGen rand_util.Random
-
 // MemStore is an in-memory implementation of the Store interface.
 type MemStore struct {
 	// ObservationsMap is a map for storing observations. Map keys are serialized
@@ -41,16 +38,54 @@ type MemStore struct {
 	// represent the |ObservationVal| in the data store.
 	observationsMap map[string]map[string]*shuffler.ObservationVal
 
+	// numObservations is the total number of |ObservationVal|s in
+	// |observationsMap|.
+	numObservations int64
+
+	// dispatchHistories is a map from serialized |ObservationMetadata| strings
+	// to the DispatchHistory of the corresponding bucket.
+	dispatchHistories map[string]*shuffler.DispatchHistory
+
+	// dropAudits is a map from serialized |ObservationMetadata| strings to the
+	// DropAudit of the corresponding bucket.
+	dropAudits map[string]*shuffler.DropAudit
+
+	// usage is a map from Tenants to the ProjectUsage of the corresponding
+	// project.
+	usage map[Tenant]*shuffler.ProjectUsage
+
+	// shuffleStrategy generates the identifiers of new ObservationVals and
+	// shuffles the ObservationVals returned by GetObservations().
+	shuffleStrategy ShuffleStrategy
+
+	// leases holds the bucket leases, keyed by serialized
+	// |ObservationMetadata| strings.
+	leases *memLeases
+
 	// mu is the global mutex that protects all elements of the store
 	mu sync.RWMutex
 }
 
-// NewMemStore creates an empty MemStore.
+// NewMemStore creates an empty MemStore that uses the default
+// ShuffleStrategy.
 func NewMemStore() *MemStore {
-	randGen = rand_util.NewDeterministicRandom(int64(1))
+	return NewMemStoreWithShuffleStrategy(NewSecureShuffleStrategy())
+}
+
+// NewMemStoreWithShuffleStrategy creates an empty MemStore that uses
+// |shuffleStrategy|.
+func NewMemStoreWithShuffleStrategy(shuffleStrategy ShuffleStrategy) *MemStore {
+	if shuffleStrategy == nil {
+		panic("shuffleStrategy is nil")
+	}
 
 	return &MemStore{
-		observationsMap: make(map[string]map[string]*shuffler.ObservationVal),
+		observationsMap:   make(map[string]map[string]*shuffler.ObservationVal),
+		dispatchHistories: make(map[string]*shuffler.DispatchHistory),
+		dropAudits:        make(map[string]*shuffler.DropAudit),
+		usage:             make(map[Tenant]*shuffler.ProjectUsage),
+		shuffleStrategy:   shuffleStrategy,
+		leases:            newMemLeases(),
 	}
 }
 
@@ -63,27 +98,11 @@ func key(om *cobalt.ObservationMetadata) string {
 	return proto.CompactTextString(om)
 }
 
-// shuffle returns a random ordering of input ObservationVals.
-func shuffle(obVals []*shuffler.ObservationVal) []*shuffler.ObservationVal {
-	numObservations := len(obVals)
-
-	// Get a random ordering for all messages. We assume that the random
-	// number generator is appropriately seeded.
-	perm := rand.Perm(numObservations)
-
-	shuffledObservations := make([]*shuffler.ObservationVal, numObservations)
-	for i, rnd := range perm {
-		shuffledObservations[i] = obVals[rnd]
-	}
-
-	return shuffledObservations
-}
-
 // AddAllObservations adds all of the encrypted observations in all of the
 // ObservationBatches in |envelopeBatch| to the store. New |ObservationVal|s
-// are created to hold the values and the given |arrivalDayIndex|. Returns a
+// are created to hold the values and the given |arrival| metadata. Returns a
 // non-nil error if the arguments are invalid or the operation fails.
-func (store *MemStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, dayIndex uint32) error {
+func (store *MemStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrival Arrival) error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
@@ -99,7 +118,7 @@ func (store *MemStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBat
 					return grpc.Errorf(codes.InvalidArgument, "The ObservationBatch with key %v contained a Null encrypted_observation", om)
 				}
 
-				id, err := randGen.RandomUint63(1<<63 - 1)
+				id, err := store.shuffleStrategy.NewID()
 				if err != nil {
 					return grpc.Errorf(codes.Internal, "Error in generating unique identifier for key [%v]: %v", om, err)
 				}
@@ -110,7 +129,8 @@ func (store *MemStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBat
 					store.observationsMap[key(om)] = valMap
 				}
 				idStr := strconv.Itoa(int(id))
-				valMap[idStr] = NewObservationVal(encryptedObservation, idStr, dayIndex)
+				valMap[idStr] = NewObservationVal(encryptedObservation, idStr, arrival)
+				store.numObservations++
 			}
 		}
 	}
@@ -144,9 +164,12 @@ func (store *MemStore) GetObservations(om *cobalt.ObservationMetadata) (Iterator
 	// Shuffler data store layer guarantees that the list returned on Get() call
 	// is always shuffled. In memstore, this is acheieved by shuffling the
 	// |ObservationVal| result set.
-	iter := NewMemStoreIterator(shuffle(obVals))
+	shuffled, err := store.shuffleStrategy.Shuffle(obVals)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Error in shuffling observations for key [%v]: %v", om, err)
+	}
 
-	return iter, nil
+	return NewMemStoreIterator(shuffled), nil
 }
 
 // GetKeys returns the list of all |ObservationMetadata| keys stored in the
@@ -167,6 +190,30 @@ func (store *MemStore) GetKeys() ([]*cobalt.ObservationMetadata, error) {
 	return keys, nil
 }
 
+// ForEachKey invokes |f| for each |ObservationMetadata| key stored in the data
+// store until |f| returns false, or returns an error.
+func (store *MemStore) ForEachKey(f func(om *cobalt.ObservationMetadata) bool) error {
+	// Only the text keys are copied while holding the lock so that |f| is free
+	// to call back into the store.
+	store.mu.RLock()
+	textKeys := make([]string, 0, len(store.observationsMap))
+	for k := range store.observationsMap {
+		textKeys = append(textKeys, k)
+	}
+	store.mu.RUnlock()
+
+	for _, k := range textKeys {
+		om := &cobalt.ObservationMetadata{}
+		if err := proto.UnmarshalText(k, om); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing keys: %v", err)
+		}
+		if !f(om) {
+			break
+		}
+	}
+	return nil
+}
+
 // DeleteValues deletes the given |ObservationVal|s for |ObservationMetadata|
 // key from the data store or returns an error.
 func (store *MemStore) DeleteValues(om *cobalt.ObservationMetadata, deleteObVals []*shuffler.ObservationVal) error {
@@ -183,7 +230,10 @@ func (store *MemStore) DeleteValues(om *cobalt.ObservationMetadata, deleteObVals
 	}
 
 	for _, obVal := range deleteObVals {
-		delete(valMap, obVal.Id)
+		if _, ok := valMap[obVal.Id]; ok {
+			delete(valMap, obVal.Id)
+			store.numObservations--
+		}
 	}
 
 	if len(valMap) == 0 {
@@ -193,6 +243,28 @@ func (store *MemStore) DeleteValues(om *cobalt.ObservationMetadata, deleteObVals
 	return nil
 }
 
+// TryLease acquires or renews the lease on the bucket for the given
+// |ObservationMetadata| key for |owner| until |ttl| has elapsed, and returns
+// true, or returns false if another owner holds an unexpired lease on it.
+func (store *MemStore) TryLease(om *cobalt.ObservationMetadata, owner string, ttl time.Duration) (bool, error) {
+	if om == nil {
+		panic("om is nil")
+	}
+
+	return store.leases.tryLease(key(om), owner, ttl), nil
+}
+
+// ReleaseLease releases the lease on the bucket for the given
+// |ObservationMetadata| key if it is held by |owner|.
+func (store *MemStore) ReleaseLease(om *cobalt.ObservationMetadata, owner string) error {
+	if om == nil {
+		panic("om is nil")
+	}
+
+	store.leases.releaseLease(key(om), owner)
+	return nil
+}
+
 // GetNumObservations returns the total count of ObservationVals in the data
 // store for the given |ObservationMmetadata| key or returns an error.
 func (store *MemStore) GetNumObservations(om *cobalt.ObservationMetadata) (int, error) {
@@ -211,10 +283,167 @@ func (store *MemStore) GetNumObservations(om *cobalt.ObservationMetadata) (int,
 	return len(valMap), nil
 }
 
+// GetTotalNumObservations returns the total count of ObservationVals in the
+// data store.
+func (store *MemStore) GetTotalNumObservations() (int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.numObservations, nil
+}
+
+// Scrub returns the number of ObservationVals in the data store. MemStore
+// holds parsed ObservationVals, so none of them are corrupted.
+func (store *MemStore) Scrub() (numChecked int, numDeleted int, err error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, valMap := range store.observationsMap {
+		numChecked += len(valMap)
+	}
+	return numChecked, 0, nil
+}
+
+// AddDispatchRecord appends |record| to the DispatchHistory of the bucket for
+// the given |ObservationMetadata| key, keeping only the |maxRecords| most
+// recent records.
+func (store *MemStore) AddDispatchRecord(om *cobalt.ObservationMetadata, record *shuffler.DispatchRecord, maxRecords int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if om == nil {
+		panic("om is nil")
+	}
+
+	if record == nil {
+		panic("record is nil")
+	}
+
+	history, present := store.dispatchHistories[key(om)]
+	if !present {
+		history = &shuffler.DispatchHistory{Bucket: om}
+		store.dispatchHistories[key(om)] = history
+	}
+	appendDispatchRecord(history, record, maxRecords)
+
+	return nil
+}
+
+// GetDispatchHistories returns the DispatchHistories of all buckets.
+func (store *MemStore) GetDispatchHistories() ([]*shuffler.DispatchHistory, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	histories := []*shuffler.DispatchHistory{}
+	for _, history := range store.dispatchHistories {
+		histories = append(histories, proto.Clone(history).(*shuffler.DispatchHistory))
+	}
+	return histories, nil
+}
+
+// DeleteDispatchHistory deletes the DispatchHistory of the bucket for the given
+// |ObservationMetadata| key.
+func (store *MemStore) DeleteDispatchHistory(om *cobalt.ObservationMetadata) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if om == nil {
+		panic("om is nil")
+	}
+
+	delete(store.dispatchHistories, key(om))
+	return nil
+}
+
+// AddDropCount adds |numObservations| to the DropRecord for |arrivalDayIndex|
+// and |reason| in the DropAudit of the bucket for the given
+// |ObservationMetadata| key.
+func (store *MemStore) AddDropCount(om *cobalt.ObservationMetadata, arrivalDayIndex uint32, reason shuffler.DropRecord_Reason, numObservations uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if om == nil {
+		panic("om is nil")
+	}
+
+	audit, present := store.dropAudits[key(om)]
+	if !present {
+		audit = &shuffler.DropAudit{Bucket: om}
+		store.dropAudits[key(om)] = audit
+	}
+	addDropCount(audit, arrivalDayIndex, reason, numObservations)
+
+	return nil
+}
+
+// GetDropAudits returns the DropAudits of all buckets.
+func (store *MemStore) GetDropAudits() ([]*shuffler.DropAudit, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	audits := []*shuffler.DropAudit{}
+	for _, audit := range store.dropAudits {
+		audits = append(audits, proto.Clone(audit).(*shuffler.DropAudit))
+	}
+	return audits, nil
+}
+
+// DeleteDropAudit deletes the DropAudit of the bucket for the given
+// |ObservationMetadata| key.
+func (store *MemStore) DeleteDropAudit(om *cobalt.ObservationMetadata) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if om == nil {
+		panic("om is nil")
+	}
+
+	delete(store.dropAudits, key(om))
+	return nil
+}
+
+// AddUsage adds the counts in |record| to the UsageRecord for
+// |record.DayIndex| in the ProjectUsage of the given project.
+func (store *MemStore) AddUsage(customerId uint32, projectId uint32, record *shuffler.UsageRecord) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if record == nil {
+		panic("record is nil")
+	}
+
+	tenant := Tenant{customerId, projectId}
+	usage, present := store.usage[tenant]
+	if !present {
+		usage = &shuffler.ProjectUsage{CustomerId: customerId, ProjectId: projectId}
+		store.usage[tenant] = usage
+	}
+	addUsage(usage, record)
+
+	return nil
+}
+
+// GetUsage returns the ProjectUsages of all projects.
+func (store *MemStore) GetUsage() ([]*shuffler.ProjectUsage, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	usages := []*shuffler.ProjectUsage{}
+	for _, usage := range store.usage {
+		usages = append(usages, proto.Clone(usage).(*shuffler.ProjectUsage))
+	}
+	return usages, nil
+}
+
 // Reset clears the existing in-memory state for |store|.
 func (store *MemStore) Reset() {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
 	store.observationsMap = make(map[string]map[string]*shuffler.ObservationVal)
+	store.numObservations = 0
+	store.dispatchHistories = make(map[string]*shuffler.DispatchHistory)
+	store.dropAudits = make(map[string]*shuffler.DropAudit)
+	store.usage = make(map[Tenant]*shuffler.ProjectUsage)
+	store.leases = newMemLeases()
 }
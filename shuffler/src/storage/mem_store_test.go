@@ -37,7 +37,44 @@ func TestShuffleObservationsForMemStore(t *testing.T) {
 	ResetStoreForTesting(s, true)
 }
 
-// TestShuffle is an unit test on shuffle() method.
+func TestForEachKeyForMemStore(t *testing.T) {
+	s := NewMemStore()
+	doTestForEachKey(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDispatchHistoryForMemStore(t *testing.T) {
+	s := NewMemStore()
+	doTestDispatchHistory(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDropAuditForMemStore(t *testing.T) {
+	s := NewMemStore()
+	doTestDropAudit(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestUsageForMemStore(t *testing.T) {
+	s := NewMemStore()
+	doTestUsage(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDeleteValuesInChunksForMemStore(t *testing.T) {
+	s := NewMemStore()
+	doTestDeleteValuesInChunks(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestLeasesForMemStore(t *testing.T) {
+	s := NewMemStore()
+	doTestLeases(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+// TestShuffle is an unit test on the Shuffle() method of the default
+// ShuffleStrategy.
 func TestShuffle(t *testing.T) {
 	num := 10
 	// Create the input test ObservationVals.
@@ -48,7 +85,10 @@ func TestShuffle(t *testing.T) {
 	testObVals[1] = MakeRandomObservationVals(num)
 
 	for _, testObVal := range testObVals {
-		shuffledObVal := shuffle(testObVal)
+		shuffledObVal, err := NewSecureShuffleStrategy().Shuffle(testObVal)
+		if err != nil {
+			t.Fatalf("Shuffle() failed: %v", err)
+		}
 
 		// Check that basic shuffling occurred.
 		if reflect.DeepEqual(shuffledObVal, testObVal) {
@@ -78,7 +118,7 @@ func TestMemStoreConcurrency(t *testing.T) {
 			batch := NewObservationBatchForMetadata(om, index /*numMsgs*/)
 
 			if err := store.AddAllObservations([]*cobalt.ObservationBatch{batch},
-				arrivalDayIndex); err != nil {
+				Arrival{DayIndex: arrivalDayIndex}); err != nil {
 				t.Errorf("AddAllObservations: got error %v, expected success", err)
 			}
 		}(store, i, t)
@@ -0,0 +1,810 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/lib/pq"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+	"util/stackdriver"
+)
+
+const (
+	postgresAddAllObservationsFailed  = "postgres-store-add-all-observations-failed"
+	postgresCorruptedObservationFound = "postgres-store-corrupted-observation-found"
+)
+
+// The tables of a PostgresStore. The observations table has a row for each
+// ObservationVal, holding the BKey of its bucket, its random identifier and
+// its value as written by makeDBVal(). The leases table has a row for each
+// bucket lease, holding the BKey of the bucket, the owner of the lease and its
+// expiry. The other tables have a row for each DispatchHistory, DropAudit and
+// ProjectUsage, holding its key and its serialization.
+const (
+	observationsTable      = "shuffler_observations"
+	leasesTable            = "shuffler_leases"
+	dispatchHistoriesTable = "shuffler_dispatch_histories"
+	dropAuditsTable        = "shuffler_drop_audits"
+	projectUsageTable      = "shuffler_project_usage"
+)
+
+// The largest number of rows read, inserted or deleted by a single statement of
+// a PostgresStore. An INSERT has three parameters per row, well below the limit
+// of 65535 parameters of a PostgreSQL statement.
+const postgresPageSize = 1000
+
+// PostgresStore is an implementation of the Store interface backed by a
+// PostgreSQL database.
+//
+// A PostgresStore may be shared by several Shuffler instances: their
+// dispatchers claim each bucket with a lease in the leases table before they
+// send it, and delete its ObservationVals only once the Analyzer has
+// acknowledged them.
+type PostgresStore struct {
+	db *sql.DB
+
+	// shuffleStrategy generates the random identifiers of the ObservationVals
+	// and, if |reshuffleBatchSize| is positive, additionally shuffles the
+	// ObservationVals returned by GetObservations() in batches of that size.
+	shuffleStrategy    ShuffleStrategy
+	reshuffleBatchSize int
+}
+
+// NewPostgresStore returns an implementation of store using the PostgreSQL
+// database |db| and the default ShuffleStrategy. The tables of the store are
+// created if they do not exist. The store takes ownership of |db|.
+func NewPostgresStore(db *sql.DB) (*PostgresStore, error) {
+	return NewPostgresStoreWithShuffleStrategy(db, NewSecureShuffleStrategy(), 0)
+}
+
+// NewPostgresStoreWithShuffleStrategy returns an implementation of store using
+// the PostgreSQL database |db| that uses |shuffleStrategy|. If
+// |reshuffleBatchSize| is positive, the ObservationVals of a bucket, which are
+// ordered by their random identifiers, are shuffled again in batches of
+// |reshuffleBatchSize| as they are read by GetObservations().
+func NewPostgresStoreWithShuffleStrategy(db *sql.DB, shuffleStrategy ShuffleStrategy, reshuffleBatchSize int) (*PostgresStore, error) {
+	if db == nil {
+		panic("db is nil")
+	}
+
+	store := &PostgresStore{
+		db:                 db,
+		shuffleStrategy:    shuffleStrategy,
+		reshuffleBatchSize: reshuffleBatchSize,
+	}
+	if err := store.createTables(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// createTables creates the tables of the store that do not exist.
+func (store *PostgresStore) createTables() error {
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			bucket TEXT NOT NULL,
+			id TEXT NOT NULL,
+			val BYTEA NOT NULL,
+			PRIMARY KEY (bucket, id))`, observationsTable),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			bucket TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expiry TIMESTAMPTZ NOT NULL)`, leasesTable),
+	}
+	for _, table := range []string{dispatchHistoriesTable, dropAuditsTable, projectUsageTable} {
+		statements = append(statements, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			key TEXT PRIMARY KEY,
+			val BYTEA NOT NULL)`, table))
+	}
+
+	for _, statement := range statements {
+		if _, err := store.db.Exec(statement); err != nil {
+			return fmt.Errorf("unable to create the tables of the PostgreSQL store: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database of the store. The store must not be used after
+// Close() has been invoked.
+func (store *PostgresStore) Close() error {
+	return store.db.Close()
+}
+
+// AddAllObservations adds all of the encrypted observations in all of the
+// ObservationBatches in |envelopeBatch| to the store in a single transaction.
+// New |ObservationVal|s are created to hold the values and the given |arrival|
+// metadata. Returns a non-nil error if the arguments are invalid or the
+// operation fails.
+func (store *PostgresStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrival Arrival) error {
+	type row struct {
+		bKey, id string
+		val      []byte
+	}
+	var rows []row
+
+	for _, batch := range envelopeBatch {
+		if batch == nil {
+			return grpc.Errorf(codes.InvalidArgument, "One of the ObservationBatches in the Envelope is not set.")
+		}
+
+		om := batch.GetMetaData()
+		if om == nil {
+			return grpc.Errorf(codes.InvalidArgument, "The meta_data field is unset for one of the ObservationBatches.")
+		}
+
+		bKey, err := BKey(om)
+		if err != nil {
+			return grpc.Errorf(codes.Internal, "Error in making bucket key for metadata [%v]: [%v]", om, err)
+		}
+
+		glog.V(3).Infof("Received a batch of %d encrypted Observations.", len(batch.GetEncryptedObservation()))
+		for _, encryptedObservation := range batch.GetEncryptedObservation() {
+			if encryptedObservation == nil {
+				return grpc.Errorf(codes.InvalidArgument, "One of the encrypted_observations in one of the ObservationBatches with metadata [%v] was null", om)
+			}
+
+			_, id, err := NewRowKey(bKey, store.shuffleStrategy)
+			if err != nil {
+				stackdriver.LogCountMetricln(postgresAddAllObservationsFailed, "AddAllObservations() failed in generating an id for metadata [", om, "]: ", err)
+				return grpc.Errorf(codes.Internal, "Error in processing observation metadata for batch [%v]", om)
+			}
+
+			val, err := makeDBVal(encryptedObservation, id, arrival)
+			if err != nil {
+				stackdriver.LogCountMetricln(postgresAddAllObservationsFailed, "AddAllObservations() failed in parsing observation value for metadata [", om, "]: ", err)
+				return grpc.Errorf(codes.Internal, "Error in processing one of the observations for metadata [%v]", om)
+			}
+
+			rows = append(rows, row{bKey, id, val})
+		}
+	}
+
+	err := store.inTransaction(func(tx *sql.Tx) error {
+		for start := 0; start < len(rows); start += postgresPageSize {
+			end := start + postgresPageSize
+			if end > len(rows) {
+				end = len(rows)
+			}
+			args := make([]interface{}, 0, 3*(end-start))
+			for _, r := range rows[start:end] {
+				args = append(args, r.bKey, r.id, r.val)
+			}
+			if _, err := tx.Exec(insertObservationsQuery(end-start), args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		stackdriver.LogCountMetricln(postgresAddAllObservationsFailed, "AddAllObservations failed with error:", err)
+		return grpc.Errorf(codes.Internal, "Internal error in processing the ObservationBatch.")
+	}
+	return nil
+}
+
+// insertObservationsQuery returns the statement inserting |numRows| rows into
+// the observations table, whose parameters are the bucket, the id and the
+// value of each row in turn.
+func insertObservationsQuery(numRows int) string {
+	values := make([]string, numRows)
+	for i := range values {
+		values[i] = fmt.Sprintf("($%d, $%d, $%d)", 3*i+1, 3*i+2, 3*i+3)
+	}
+	return fmt.Sprintf("INSERT INTO %s (bucket, id, val) VALUES %s", observationsTable, strings.Join(values, ", "))
+}
+
+// GetObservations returns an Iterator to iterate through the shuffled list of
+// ObservationVals from the data store for the given |ObservationMetadata| key
+// or returns an error. The ObservationVals are read in pages as the iterator
+// advances.
+func (store *PostgresStore) GetObservations(om *cobalt.ObservationMetadata) (Iterator, error) {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	var iter Iterator = &postgresStoreIterator{db: store.db, bKey: bKey, current: -1}
+	if store.reshuffleBatchSize > 0 {
+		iter = newReshufflingIterator(iter, store.shuffleStrategy, store.reshuffleBatchSize)
+	}
+	return iter, nil
+}
+
+// GetKeys returns the list of all |ObservationMetadata| keys stored in the
+// data store or returns an error.
+func (store *PostgresStore) GetKeys() ([]*cobalt.ObservationMetadata, error) {
+	keys := []*cobalt.ObservationMetadata{}
+	err := store.ForEachKey(func(om *cobalt.ObservationMetadata) bool {
+		keys = append(keys, om)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ForEachKey invokes |f| for each |ObservationMetadata| key stored in the data
+// store until |f| returns false, or returns an error. The keys are read in
+// pages, and no query is in progress while |f| runs.
+func (store *PostgresStore) ForEachKey(f func(om *cobalt.ObservationMetadata) bool) error {
+	query := fmt.Sprintf("SELECT DISTINCT bucket FROM %s WHERE bucket > $1 ORDER BY bucket LIMIT $2", observationsTable)
+	last := ""
+	for {
+		rows, err := store.db.Query(query, last, postgresPageSize)
+		if err != nil {
+			return grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+		}
+		var bKeys []string
+		for rows.Next() {
+			var bKey string
+			if err := rows.Scan(&bKey); err != nil {
+				rows.Close()
+				return grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+			}
+			bKeys = append(bKeys, bKey)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+		}
+
+		for _, bKey := range bKeys {
+			om, err := UnmarshalBKey(bKey)
+			if err != nil {
+				return grpc.Errorf(codes.Internal, "Error in parsing observation metadata for bucket key [%v]: [%v]", bKey, err)
+			}
+			if !f(om) {
+				return nil
+			}
+		}
+		if len(bKeys) < postgresPageSize {
+			return nil
+		}
+		last = bKeys[len(bKeys)-1]
+	}
+}
+
+// DeleteValues deletes the given |ObservationVal|s for |ObservationMetadata|
+// key from the data store in a single transaction or returns an error.
+func (store *PostgresStore) DeleteValues(om *cobalt.ObservationMetadata, obVals []*shuffler.ObservationVal) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	if len(obVals) == 0 {
+		return nil
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE bucket = $1 AND id = ANY($2)", observationsTable)
+	err = store.inTransaction(func(tx *sql.Tx) error {
+		for start := 0; start < len(obVals); start += postgresPageSize {
+			end := start + postgresPageSize
+			if end > len(obVals) {
+				end = len(obVals)
+			}
+			ids := make([]string, 0, end-start)
+			for _, obVal := range obVals[start:end] {
+				ids = append(ids, obVal.Id)
+			}
+			if _, err := tx.Exec(query, bKey, pq.Array(ids)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+	}
+	return nil
+}
+
+// TryLease acquires or renews the lease on the bucket for the given
+// |ObservationMetadata| key for |owner| until |ttl| has elapsed, and returns
+// true, or returns false if another owner holds an unexpired lease on it. The
+// expiry is measured by the clock of the database, which is shared by all
+// Shufflers using it.
+func (store *PostgresStore) TryLease(om *cobalt.ObservationMetadata, owner string, ttl time.Duration) (bool, error) {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return false, grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	// The existing row of the bucket is only updated if the lease is held by
+	// |owner| or has expired, and so is unaffected otherwise.
+	result, err := store.db.Exec(fmt.Sprintf(`INSERT INTO %[1]s (bucket, owner, expiry)
+		VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+		ON CONFLICT (bucket) DO UPDATE SET owner = EXCLUDED.owner, expiry = EXCLUDED.expiry
+		WHERE %[1]s.owner = EXCLUDED.owner OR %[1]s.expiry <= now()`, leasesTable),
+		bKey, owner, int64(ttl/time.Millisecond))
+	if err != nil {
+		return false, grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return false, grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+	}
+	return numRows == 1, nil
+}
+
+// ReleaseLease releases the lease on the bucket for the given
+// |ObservationMetadata| key if it is held by |owner|, or returns an error.
+func (store *PostgresStore) ReleaseLease(om *cobalt.ObservationMetadata, owner string) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	if _, err := store.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE bucket = $1 AND owner = $2", leasesTable), bKey, owner); err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+	}
+	return nil
+}
+
+// GetNumObservations returns the total count of ObservationVals in the data
+// store for the given |ObservationMmetadata| key or returns an error.
+func (store *PostgresStore) GetNumObservations(om *cobalt.ObservationMetadata) (int, error) {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return 0, grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	var count int
+	if err := store.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE bucket = $1", observationsTable), bKey).Scan(&count); err != nil {
+		return 0, grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+	}
+	if count == 0 {
+		return 0, grpc.Errorf(codes.InvalidArgument, "Observation metadata [%v] not found.", om)
+	}
+
+	return count, nil
+}
+
+// GetTotalNumObservations returns the total count of ObservationVals in the
+// data store or returns an error.
+func (store *PostgresStore) GetTotalNumObservations() (int64, error) {
+	var count int64
+	if err := store.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", observationsTable)).Scan(&count); err != nil {
+		return 0, grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+	}
+	return count, nil
+}
+
+// Scrub verifies the checksums of all ObservationVals in the data store and
+// deletes those that are corrupted. Returns the number of ObservationVals that
+// were checked and deleted, or an error.
+func (store *PostgresStore) Scrub() (numChecked int, numDeleted int, err error) {
+	query := fmt.Sprintf("SELECT bucket, id, val FROM %s WHERE (bucket, id) > ($1, $2) ORDER BY bucket, id LIMIT $3", observationsTable)
+	lastBKey, lastID := "", ""
+	for {
+		rows, err := store.db.Query(query, lastBKey, lastID, postgresPageSize)
+		if err != nil {
+			return numChecked, numDeleted, grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+		}
+		numRows := 0
+		var corrupted [][2]string
+		for rows.Next() {
+			var val []byte
+			if err := rows.Scan(&lastBKey, &lastID, &val); err != nil {
+				rows.Close()
+				return numChecked, numDeleted, grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+			}
+			numRows++
+			if _, parseErr := parseDBVal(val); parseErr != nil {
+				stackdriver.LogCountMetricf(postgresCorruptedObservationFound, "Scrub() is deleting the corrupted row [%s_%s]: %v", lastBKey, lastID, parseErr)
+				corrupted = append(corrupted, [2]string{lastBKey, lastID})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return numChecked, numDeleted, grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+		}
+		numChecked += numRows
+
+		for _, key := range corrupted {
+			if _, err := store.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE bucket = $1 AND id = $2", observationsTable), key[0], key[1]); err != nil {
+				return numChecked, numDeleted, grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+			}
+			numDeleted++
+		}
+		if numRows < postgresPageSize {
+			return numChecked, numDeleted, nil
+		}
+	}
+}
+
+// AddDispatchRecord appends |record| to the DispatchHistory of the bucket for
+// the given |ObservationMetadata| key, keeping only the |maxRecords| most
+// recent records.
+func (store *PostgresStore) AddDispatchRecord(om *cobalt.ObservationMetadata, record *shuffler.DispatchRecord, maxRecords int) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	if record == nil {
+		panic("record is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.readModifyWrite(dispatchHistoriesTable, bKey, func(val []byte) ([]byte, error) {
+		history := &shuffler.DispatchHistory{}
+		if err := proto.Unmarshal(val, history); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the dispatch history for metadata [%v]: [%v]", om, err)
+		}
+		if len(val) == 0 {
+			history.Bucket = om
+		}
+		appendDispatchRecord(history, record, maxRecords)
+
+		val, err := proto.Marshal(history)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in serializing the dispatch history for metadata [%v]: [%v]", om, err)
+		}
+		return val, nil
+	})
+}
+
+// GetDispatchHistories returns the DispatchHistories of all buckets or returns
+// an error.
+func (store *PostgresStore) GetDispatchHistories() ([]*shuffler.DispatchHistory, error) {
+	histories := []*shuffler.DispatchHistory{}
+	err := store.forEachValue(dispatchHistoriesTable, func(key string, val []byte) error {
+		history := &shuffler.DispatchHistory{}
+		if err := proto.Unmarshal(val, history); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the dispatch history of bucket [%s]: [%v]", key, err)
+		}
+		histories = append(histories, history)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return histories, nil
+}
+
+// DeleteDispatchHistory deletes the DispatchHistory of the bucket for the given
+// |ObservationMetadata| key or returns an error.
+func (store *PostgresStore) DeleteDispatchHistory(om *cobalt.ObservationMetadata) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.deleteValue(dispatchHistoriesTable, bKey)
+}
+
+// AddDropCount adds |numObservations| to the DropRecord for |arrivalDayIndex|
+// and |reason| in the DropAudit of the bucket for the given
+// |ObservationMetadata| key.
+func (store *PostgresStore) AddDropCount(om *cobalt.ObservationMetadata, arrivalDayIndex uint32, reason shuffler.DropRecord_Reason, numObservations uint64) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.readModifyWrite(dropAuditsTable, bKey, func(val []byte) ([]byte, error) {
+		audit := &shuffler.DropAudit{}
+		if err := proto.Unmarshal(val, audit); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the drop audit for metadata [%v]: [%v]", om, err)
+		}
+		if len(val) == 0 {
+			audit.Bucket = om
+		}
+		addDropCount(audit, arrivalDayIndex, reason, numObservations)
+
+		val, err := proto.Marshal(audit)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in serializing the drop audit for metadata [%v]: [%v]", om, err)
+		}
+		return val, nil
+	})
+}
+
+// GetDropAudits returns the DropAudits of all buckets or returns an error.
+func (store *PostgresStore) GetDropAudits() ([]*shuffler.DropAudit, error) {
+	audits := []*shuffler.DropAudit{}
+	err := store.forEachValue(dropAuditsTable, func(key string, val []byte) error {
+		audit := &shuffler.DropAudit{}
+		if err := proto.Unmarshal(val, audit); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the drop audit of bucket [%s]: [%v]", key, err)
+		}
+		audits = append(audits, audit)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return audits, nil
+}
+
+// DeleteDropAudit deletes the DropAudit of the bucket for the given
+// |ObservationMetadata| key or returns an error.
+func (store *PostgresStore) DeleteDropAudit(om *cobalt.ObservationMetadata) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.deleteValue(dropAuditsTable, bKey)
+}
+
+// AddUsage adds the counts in |record| to the UsageRecord for
+// |record.DayIndex| in the ProjectUsage of the given project.
+func (store *PostgresStore) AddUsage(customerId uint32, projectId uint32, record *shuffler.UsageRecord) error {
+	if record == nil {
+		panic("record is nil")
+	}
+
+	key := fmt.Sprintf("%d_%d", customerId, projectId)
+	return store.readModifyWrite(projectUsageTable, key, func(val []byte) ([]byte, error) {
+		usage := &shuffler.ProjectUsage{}
+		if err := proto.Unmarshal(val, usage); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the usage of project (%d, %d): [%v]", customerId, projectId, err)
+		}
+		if len(val) == 0 {
+			usage.CustomerId = customerId
+			usage.ProjectId = projectId
+		}
+		addUsage(usage, record)
+
+		val, err := proto.Marshal(usage)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in serializing the usage of project (%d, %d): [%v]", customerId, projectId, err)
+		}
+		return val, nil
+	})
+}
+
+// GetUsage returns the ProjectUsages of all projects or returns an error.
+func (store *PostgresStore) GetUsage() ([]*shuffler.ProjectUsage, error) {
+	usages := []*shuffler.ProjectUsage{}
+	err := store.forEachValue(projectUsageTable, func(key string, val []byte) error {
+		usage := &shuffler.ProjectUsage{}
+		if err := proto.Unmarshal(val, usage); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the usage of project [%s]: [%v]", key, err)
+		}
+		usages = append(usages, usage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usages, nil
+}
+
+// EraseAllData deletes all rows of the tables of the store.
+func (store *PostgresStore) EraseAllData() error {
+	if _, err := store.db.Exec(fmt.Sprintf("TRUNCATE %s, %s, %s, %s, %s", observationsTable, leasesTable, dispatchHistoriesTable, dropAuditsTable, projectUsageTable)); err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+	}
+	return nil
+}
+
+// inTransaction invokes |f| in a transaction that is committed if |f|
+// succeeds and rolled back otherwise.
+func (store *PostgresStore) inTransaction(f func(tx *sql.Tx) error) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// readModifyWrite replaces the value of the row of |table| with the key |key|
+// by the value returned by |modify|, which is passed the current value, or an
+// empty value if there is no such row. The row is locked during the
+// transaction so that concurrent updates are not lost.
+func (store *PostgresStore) readModifyWrite(table string, key string, modify func(val []byte) ([]byte, error)) error {
+	var modifyErr error
+	err := store.inTransaction(func(tx *sql.Tx) error {
+		// Insert an empty row first, so that there is a row to lock.
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (key, val) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING", table), key, []byte{}); err != nil {
+			return err
+		}
+		var val []byte
+		if err := tx.QueryRow(fmt.Sprintf("SELECT val FROM %s WHERE key = $1 FOR UPDATE", table), key).Scan(&val); err != nil {
+			return err
+		}
+		if val, modifyErr = modify(val); modifyErr != nil {
+			return modifyErr
+		}
+		_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET val = $2 WHERE key = $1", table), key, val)
+		return err
+	})
+	if modifyErr != nil {
+		return modifyErr
+	}
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+	}
+	return nil
+}
+
+// forEachValue invokes |f| for the key and the value of each row of |table|
+// until |f| returns an error, which is then returned.
+func (store *PostgresStore) forEachValue(table string, f func(key string, val []byte) error) error {
+	rows, err := store.db.Query(fmt.Sprintf("SELECT key, val FROM %s", table))
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var val []byte
+		if err := rows.Scan(&key, &val); err != nil {
+			return grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+		}
+		if err := f(key, val); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", err)
+	}
+	return nil
+}
+
+// deleteValue deletes the row of |table| with the key |key|, if any.
+func (store *PostgresStore) deleteValue(table string, key string) error {
+	if _, err := store.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE key = $1", table), key); err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL write error: [%v]", err)
+	}
+	return nil
+}
+
+// postgresStoreIterator iterates over the ObservationVals of a bucket of a
+// PostgresStore, in the order of their random identifiers. The
+// ObservationVals are read in pages of |postgresPageSize|, each starting after
+// the last identifier of the previous page, so that ObservationVals deleted
+// during the iteration do not cause others to be skipped.
+type postgresStoreIterator struct {
+	db   *sql.DB
+	bKey string
+
+	// The current page and the index of the current entry in it.
+	page    []*shuffler.ObservationVal
+	current int
+
+	// The identifier of the last row read, and whether the last page has been
+	// read.
+	lastID string
+	done   bool
+
+	// The error that ended the iteration, if any, returned by Release().
+	err error
+}
+
+// Get returns the current entry the Iterator is pointing to or an error if the
+// iterator is invalid.
+func (pi *postgresStoreIterator) Get() (*shuffler.ObservationVal, error) {
+	if pi.current < 0 || pi.current >= len(pi.page) {
+		return nil, grpc.Errorf(codes.Internal, "Invalid iterator")
+	}
+	return pi.page[pi.current], nil
+}
+
+// Next advances the iterator to the next entry and returns whether or not
+// the iterator is still valid. Entries whose checksum does not match or that
+// cannot be parsed are counted and skipped. They are deleted by
+// PostgresStore.Scrub().
+func (pi *postgresStoreIterator) Next() bool {
+	pi.current++
+	for pi.current >= len(pi.page) {
+		if pi.done {
+			return false
+		}
+		if pi.err = pi.readPage(); pi.err != nil {
+			pi.done = true
+			pi.page = nil
+			return false
+		}
+		pi.current = 0
+	}
+	return true
+}
+
+// readPage reads the next page of ObservationVals.
+func (pi *postgresStoreIterator) readPage() error {
+	rows, err := pi.db.Query(fmt.Sprintf("SELECT id, val FROM %s WHERE bucket = $1 AND id > $2 ORDER BY id LIMIT $3", observationsTable),
+		pi.bKey, pi.lastID, postgresPageSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pi.page = nil
+	numRows := 0
+	for rows.Next() {
+		var val []byte
+		if err := rows.Scan(&pi.lastID, &val); err != nil {
+			return err
+		}
+		numRows++
+		obVal, err := parseDBVal(val)
+		if err != nil {
+			stackdriver.LogCountMetricf(postgresCorruptedObservationFound, "Skipping the corrupted row [%s_%s]: %v", pi.bKey, pi.lastID, err)
+			continue
+		}
+		pi.page = append(pi.page, obVal)
+	}
+	pi.done = numRows < postgresPageSize
+	return rows.Err()
+}
+
+// Release releases the iterator after use and returns the error that ended
+// the iteration, if any.
+func (pi *postgresStoreIterator) Release() error {
+	pi.page = nil
+	pi.done = true
+	if pi.err != nil {
+		return grpc.Errorf(codes.Internal, "PostgreSQL read error: [%v]", pi.err)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// PostgresStore tests. They require a PostgreSQL database, whose connection
+// string is given by the environment variable SHUFFLER_TEST_POSTGRES_URL, and
+// are skipped otherwise. All data in the tables of the store is deleted.
+
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	"cobalt"
+	"shuffler"
+)
+
+// makePostgresTestStore returns an empty PostgresStore, or skips the test if
+// no database is available.
+func makePostgresTestStore(t *testing.T) *PostgresStore {
+	url := os.Getenv("SHUFFLER_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("SHUFFLER_TEST_POSTGRES_URL is not set.")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	s, err := NewPostgresStore(db)
+	if err != nil {
+		t.Fatalf("Failed to create a PostgreSQL store instance: %v", err)
+	}
+	if err := s.EraseAllData(); err != nil {
+		t.Fatalf("Failed to erase the PostgreSQL store: %v", err)
+	}
+	return s
+}
+
+func TestAddGetAndDeleteObservationsForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestAddGetAndDeleteObservations(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestShuffleObservationsForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestShuffle(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestForEachKeyForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestForEachKey(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDispatchHistoryForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestDispatchHistory(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDropAuditForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestDropAudit(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestUsageForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestUsage(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDeleteValuesInChunksForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestDeleteValuesInChunks(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestLeasesForPostgresStore(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+	doTestLeases(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+// Tests that the ObservationVals of a bucket spanning several pages are all
+// returned, and that those deleted during the iteration do not cause others to
+// be skipped.
+func TestPostgresStoreIteratorPages(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+
+	const numMsgs = 2*postgresPageSize + 10
+	om := NewObservationMetaData(7)
+	batch := NewObservationBatchForMetadata(om, numMsgs)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+
+	iter, err := s.GetObservations(om)
+	if err != nil {
+		t.Fatalf("GetObservations: got error %v, expected success", err)
+	}
+	seen := make(map[string]bool)
+	for iter.Next() {
+		obVal, err := iter.Get()
+		if err != nil {
+			t.Fatalf("Get: got error %v, expected success", err)
+		}
+		seen[obVal.Id] = true
+		if err := s.DeleteValues(om, []*shuffler.ObservationVal{obVal}); err != nil {
+			t.Fatalf("DeleteValues: got error %v, expected success", err)
+		}
+	}
+	if err := iter.Release(); err != nil {
+		t.Errorf("Release: got error %v, expected success", err)
+	}
+	if len(seen) != numMsgs {
+		t.Errorf("got %d ObservationVals, expected %d", len(seen), numMsgs)
+	}
+	if _, err := s.GetNumObservations(om); err == nil {
+		t.Errorf("GetNumObservations: expected an error for the empty bucket")
+	}
+}
+
+// Tests that Scrub() deletes the corrupted ObservationVals and that
+// GetObservations() skips them.
+func TestPostgresStoreCorruptedObservations(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+
+	om := NewObservationMetaData(3)
+	batch := NewObservationBatchForMetadata(om, 10)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	bKey, _ := BKey(om)
+	if _, err := s.db.Exec("UPDATE "+observationsTable+" SET val = $2 WHERE bucket = $1 AND id = (SELECT MIN(id) FROM "+observationsTable+" WHERE bucket = $1)",
+		bKey, []byte{checksumMarker, 1, 2, 3, 4, 5}); err != nil {
+		t.Fatalf("Failed to corrupt a row: %v", err)
+	}
+
+	CheckObservations(t, s, om, 9)
+	numChecked, numDeleted, err := s.Scrub()
+	if err != nil || numChecked != 10 || numDeleted != 1 {
+		t.Errorf("Scrub: got (%d, %d, %v), expected (10, 1, nil)", numChecked, numDeleted, err)
+	}
+	CheckNumObservations(t, s, om, 9)
+}
+
+func TestInsertObservationsQuery(t *testing.T) {
+	expected := "INSERT INTO " + observationsTable + " (bucket, id, val) VALUES ($1, $2, $3), ($4, $5, $6)"
+	if query := insertObservationsQuery(2); query != expected {
+		t.Errorf("got query %q, expected %q", query, expected)
+	}
+}
+
+// Tests that the ObservationVals added and deleted by a single call spanning
+// several statements are all written.
+func TestPostgresStoreBatchedWrites(t *testing.T) {
+	s := makePostgresTestStore(t)
+	defer s.Close()
+
+	const numMsgs = 2*postgresPageSize + 10
+	om := NewObservationMetaData(8)
+	batch := NewObservationBatchForMetadata(om, numMsgs)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	CheckNumObservations(t, s, om, numMsgs)
+
+	iter, err := s.GetObservations(om)
+	if err != nil {
+		t.Fatalf("GetObservations: got error %v, expected success", err)
+	}
+	var obVals []*shuffler.ObservationVal
+	for iter.Next() {
+		obVal, err := iter.Get()
+		if err != nil {
+			t.Fatalf("Get: got error %v, expected success", err)
+		}
+		obVals = append(obVals, obVal)
+	}
+	if err := iter.Release(); err != nil {
+		t.Errorf("Release: got error %v, expected success", err)
+	}
+	if err := s.DeleteValues(om, obVals[1:]); err != nil {
+		t.Fatalf("DeleteValues: got error %v, expected success", err)
+	}
+	CheckNumObservations(t, s, om, 1)
+}
@@ -0,0 +1,864 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/gomodule/redigo/redis"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+	"util/stackdriver"
+)
+
+const (
+	redisAddAllObservationsFailed  = "redis-store-add-all-observations-failed"
+	redisCorruptedObservationFound = "redis-store-corrupted-observation-found"
+)
+
+// The keys of a RedisStore. The bucket with the BKey <bKey> is held in two
+// keys: a sorted set <redisIdsKeyPrefix><bKey> of the random identifiers of
+// its ObservationVals, all with the score zero so that they are ordered by
+// the identifiers themselves, and a hash <redisValsKeyPrefix><bKey> from the
+// identifiers to the values written by makeDBVal(). The set |redisBucketsKey|
+// holds the BKeys of all buckets, and the hashes |redisDispatchHistoriesKey|,
+// |redisDropAuditsKey| and |redisUsageKey| hold the serialized
+// DispatchHistories, DropAudits and ProjectUsages. The lease on a bucket is a
+// string <redisLeaseKeyPrefix><bKey> holding its owner, which expires with the
+// lease.
+const (
+	redisBucketsKey           = "shuffler:buckets"
+	redisIdsKeyPrefix         = "shuffler:ids:"
+	redisValsKeyPrefix        = "shuffler:vals:"
+	redisLeaseKeyPrefix       = "shuffler:lease:"
+	redisDispatchHistoriesKey = "shuffler:dispatch_histories"
+	redisDropAuditsKey        = "shuffler:drop_audits"
+	redisUsageKey             = "shuffler:usage"
+)
+
+// The largest number of ObservationVals read by a single command of a
+// RedisStore.
+const redisPageSize = 1000
+
+// redisDeleteScript deletes the ObservationVals with the identifiers
+// ARGV[2..] from the bucket with the BKey ARGV[1], held in KEYS[1] and
+// KEYS[2], and removes the bucket from KEYS[3] once it is empty.
+var redisDeleteScript = redis.NewScript(3, `
+for i = 2, #ARGV do
+	redis.call("ZREM", KEYS[1], ARGV[i])
+	redis.call("HDEL", KEYS[2], ARGV[i])
+end
+if redis.call("ZCARD", KEYS[1]) == 0 then
+	redis.call("SREM", KEYS[3], ARGV[1])
+end
+return 0
+`)
+
+// redisPruneScript removes the bucket with the BKey ARGV[1] from KEYS[2] if
+// its sorted set KEYS[1] no longer exists, because it has expired.
+var redisPruneScript = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("SREM", KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// redisTryLeaseScript sets the owner of the lease KEYS[1] to ARGV[1] for ARGV[2]
+// milliseconds and returns 1, unless it is held by another owner, in which case
+// it returns 0.
+var redisTryLeaseScript = redis.NewScript(1, `
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// redisReleaseLeaseScript deletes the lease KEYS[1] if it is held by ARGV[1].
+var redisReleaseLeaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisStore is an implementation of the Store interface backed by Redis. It
+// keeps the Observations out of the memory of the Shuffler, but they are lost
+// if Redis restarts without persistence. The keys of each bucket expire after
+// the TTL of the bucket has passed since Observations were last added to it.
+type RedisStore struct {
+	pool *redis.Pool
+
+	// ttl returns the TTL of the bucket for an ObservationMetadata, or zero if
+	// the bucket does not expire.
+	ttl func(om *cobalt.ObservationMetadata) time.Duration
+
+	// historyMu serializes the read-modify-write of DispatchHistories,
+	// DropAudits and ProjectUsages.
+	historyMu sync.Mutex
+
+	// shuffleStrategy generates the random identifiers of the ObservationVals
+	// and, if |reshuffleBatchSize| is positive, additionally shuffles the
+	// ObservationVals returned by GetObservations() in batches of that size.
+	shuffleStrategy    ShuffleStrategy
+	reshuffleBatchSize int
+}
+
+// NewRedisStore returns an implementation of store using the Redis server
+// reached through |pool| and the default ShuffleStrategy. The keys of the
+// bucket for an ObservationMetadata |om| expire after |ttl(om)|, unless |ttl|
+// is nil or returns zero. Returns an error if the server cannot be reached.
+// The store takes ownership of |pool|.
+func NewRedisStore(pool *redis.Pool, ttl func(om *cobalt.ObservationMetadata) time.Duration) (*RedisStore, error) {
+	return NewRedisStoreWithShuffleStrategy(pool, ttl, NewSecureShuffleStrategy(), 0)
+}
+
+// NewRedisStoreWithShuffleStrategy returns an implementation of store using
+// the Redis server reached through |pool| that uses |shuffleStrategy|. If
+// |reshuffleBatchSize| is positive, the ObservationVals of a bucket, which are
+// ordered by their random identifiers, are shuffled again in batches of
+// |reshuffleBatchSize| as they are read by GetObservations(). See
+// NewRedisStore() for |ttl|.
+func NewRedisStoreWithShuffleStrategy(pool *redis.Pool, ttl func(om *cobalt.ObservationMetadata) time.Duration, shuffleStrategy ShuffleStrategy, reshuffleBatchSize int) (*RedisStore, error) {
+	if pool == nil {
+		panic("pool is nil")
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, fmt.Errorf("unable to reach the Redis server: %v", err)
+	}
+
+	return &RedisStore{
+		pool:               pool,
+		ttl:                ttl,
+		shuffleStrategy:    shuffleStrategy,
+		reshuffleBatchSize: reshuffleBatchSize,
+	}, nil
+}
+
+// Close closes the connections of the store. The store must not be used after
+// Close() has been invoked.
+func (store *RedisStore) Close() error {
+	return store.pool.Close()
+}
+
+// AddAllObservations adds all of the encrypted observations in all of the
+// ObservationBatches in |envelopeBatch| to the store in a single transaction
+// and resets the TTLs of their buckets. New |ObservationVal|s are created to
+// hold the values and the given |arrival| metadata. Returns a non-nil error if
+// the arguments are invalid or the operation fails.
+func (store *RedisStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrival Arrival) error {
+	type row struct {
+		bKey, id string
+		val      []byte
+	}
+	var rows []row
+	ttls := make(map[string]time.Duration)
+
+	for _, batch := range envelopeBatch {
+		if batch == nil {
+			return grpc.Errorf(codes.InvalidArgument, "One of the ObservationBatches in the Envelope is not set.")
+		}
+
+		om := batch.GetMetaData()
+		if om == nil {
+			return grpc.Errorf(codes.InvalidArgument, "The meta_data field is unset for one of the ObservationBatches.")
+		}
+
+		bKey, err := BKey(om)
+		if err != nil {
+			return grpc.Errorf(codes.Internal, "Error in making bucket key for metadata [%v]: [%v]", om, err)
+		}
+		if len(batch.GetEncryptedObservation()) > 0 {
+			ttls[bKey] = 0
+			if store.ttl != nil {
+				ttls[bKey] = store.ttl(om)
+			}
+		}
+
+		glog.V(3).Infof("Received a batch of %d encrypted Observations.", len(batch.GetEncryptedObservation()))
+		for _, encryptedObservation := range batch.GetEncryptedObservation() {
+			if encryptedObservation == nil {
+				return grpc.Errorf(codes.InvalidArgument, "One of the encrypted_observations in one of the ObservationBatches with metadata [%v] was null", om)
+			}
+
+			_, id, err := NewRowKey(bKey, store.shuffleStrategy)
+			if err != nil {
+				stackdriver.LogCountMetricln(redisAddAllObservationsFailed, "AddAllObservations() failed in generating an id for metadata [", om, "]: ", err)
+				return grpc.Errorf(codes.Internal, "Error in processing observation metadata for batch [%v]", om)
+			}
+
+			val, err := makeDBVal(encryptedObservation, id, arrival)
+			if err != nil {
+				stackdriver.LogCountMetricln(redisAddAllObservationsFailed, "AddAllObservations() failed in parsing observation value for metadata [", om, "]: ", err)
+				return grpc.Errorf(codes.Internal, "Error in processing one of the observations for metadata [%v]", om)
+			}
+
+			rows = append(rows, row{bKey, id, val})
+		}
+	}
+
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	// The commands are buffered by the connection and sent with the EXEC.
+	conn.Send("MULTI")
+	for _, r := range rows {
+		conn.Send("ZADD", redisIdsKeyPrefix+r.bKey, 0, r.id)
+		conn.Send("HSET", redisValsKeyPrefix+r.bKey, r.id, r.val)
+	}
+	for bKey, ttl := range ttls {
+		conn.Send("SADD", redisBucketsKey, bKey)
+		if ttl > 0 {
+			conn.Send("PEXPIRE", redisIdsKeyPrefix+bKey, int64(ttl/time.Millisecond))
+			conn.Send("PEXPIRE", redisValsKeyPrefix+bKey, int64(ttl/time.Millisecond))
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == nil {
+		err = firstRedisError(replies)
+	}
+	if err != nil {
+		stackdriver.LogCountMetricln(redisAddAllObservationsFailed, "AddAllObservations failed with error:", err)
+		return grpc.Errorf(codes.Internal, "Internal error in processing the ObservationBatch.")
+	}
+	return nil
+}
+
+// firstRedisError returns the first error among the |replies| of a
+// transaction, or nil.
+func firstRedisError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetObservations returns an Iterator to iterate through the shuffled list of
+// ObservationVals from the data store for the given |ObservationMetadata| key
+// or returns an error. The ObservationVals are read in pages as the iterator
+// advances.
+func (store *RedisStore) GetObservations(om *cobalt.ObservationMetadata) (Iterator, error) {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	var iter Iterator = &redisStoreIterator{store: store, bKey: bKey, current: -1}
+	if store.reshuffleBatchSize > 0 {
+		iter = newReshufflingIterator(iter, store.shuffleStrategy, store.reshuffleBatchSize)
+	}
+	return iter, nil
+}
+
+// readPage returns the identifiers and the values of the ObservationVals of
+// the bucket |bKey| that follow the identifier |lastID|, or the first ones if
+// |lastID| is empty, up to |redisPageSize| of them. The value of an
+// ObservationVal deleted since its identifier was read is nil. |more| is false
+// if there are no more ObservationVals.
+func (store *RedisStore) readPage(bKey string, lastID string) (ids []string, vals [][]byte, more bool, err error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	min := "-"
+	if lastID != "" {
+		min = "(" + lastID
+	}
+	ids, err = redis.Strings(conn.Do("ZRANGEBYLEX", redisIdsKeyPrefix+bKey, min, "+", "LIMIT", 0, redisPageSize))
+	if err != nil || len(ids) == 0 {
+		return nil, nil, false, err
+	}
+
+	args := redis.Args{}.Add(redisValsKeyPrefix + bKey).AddFlat(ids)
+	if vals, err = redis.ByteSlices(conn.Do("HMGET", args...)); err != nil {
+		return nil, nil, false, err
+	}
+	return ids, vals, len(ids) == redisPageSize, nil
+}
+
+// GetKeys returns the list of all |ObservationMetadata| keys stored in the
+// data store or returns an error.
+func (store *RedisStore) GetKeys() ([]*cobalt.ObservationMetadata, error) {
+	keys := []*cobalt.ObservationMetadata{}
+	err := store.ForEachKey(func(om *cobalt.ObservationMetadata) bool {
+		keys = append(keys, om)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ForEachKey invokes |f| for each |ObservationMetadata| key stored in the data
+// store until |f| returns false, or returns an error. The buckets that have
+// expired are removed from the set of buckets and skipped.
+func (store *RedisStore) ForEachKey(f func(om *cobalt.ObservationMetadata) bool) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	bKeys, err := redis.Strings(conn.Do("SMEMBERS", redisBucketsKey))
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+
+	for _, bKey := range bKeys {
+		pruned, err := redis.Int(redisPruneScript.Do(conn, redisIdsKeyPrefix+bKey, redisBucketsKey, bKey))
+		if err != nil {
+			return grpc.Errorf(codes.Internal, "Redis write error: [%v]", err)
+		}
+		if pruned == 1 {
+			glog.V(4).Infof("The bucket [%s] has expired.", bKey)
+			continue
+		}
+
+		om, err := UnmarshalBKey(bKey)
+		if err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing observation metadata for bucket key [%v]: [%v]", bKey, err)
+		}
+		if !f(om) {
+			break
+		}
+	}
+	return nil
+}
+
+// DeleteValues deletes the given |ObservationVal|s for |ObservationMetadata|
+// key from the data store or returns an error.
+func (store *RedisStore) DeleteValues(om *cobalt.ObservationMetadata, obVals []*shuffler.ObservationVal) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	if len(obVals) == 0 {
+		return nil
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	ids := make([]string, len(obVals))
+	for i, obVal := range obVals {
+		ids[i] = obVal.Id
+	}
+	return store.deleteIds(bKey, ids)
+}
+
+// deleteIds deletes the ObservationVals with the identifiers |ids| from the
+// bucket |bKey|.
+func (store *RedisStore) deleteIds(bKey string, ids []string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(redisIdsKeyPrefix+bKey, redisValsKeyPrefix+bKey, redisBucketsKey, bKey).AddFlat(ids)
+	if _, err := redisDeleteScript.Do(conn, args...); err != nil {
+		return grpc.Errorf(codes.Internal, "Redis write error: [%v]", err)
+	}
+	return nil
+}
+
+// TryLease acquires or renews the lease on the bucket for the given
+// |ObservationMetadata| key for |owner| until |ttl| has elapsed, and returns
+// true, or returns false if another owner holds an unexpired lease on it.
+func (store *RedisStore) TryLease(om *cobalt.ObservationMetadata, owner string, ttl time.Duration) (bool, error) {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return false, grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	conn := store.pool.Get()
+	defer conn.Close()
+	acquired, err := redis.Bool(redisTryLeaseScript.Do(conn, redisLeaseKeyPrefix+bKey, owner, int64(ttl/time.Millisecond)))
+	if err != nil {
+		return false, grpc.Errorf(codes.Internal, "Redis write error: [%v]", err)
+	}
+	return acquired, nil
+}
+
+// ReleaseLease releases the lease on the bucket for the given
+// |ObservationMetadata| key if it is held by |owner|, or returns an error.
+func (store *RedisStore) ReleaseLease(om *cobalt.ObservationMetadata, owner string) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	conn := store.pool.Get()
+	defer conn.Close()
+	if _, err := redisReleaseLeaseScript.Do(conn, redisLeaseKeyPrefix+bKey, owner); err != nil {
+		return grpc.Errorf(codes.Internal, "Redis write error: [%v]", err)
+	}
+	return nil
+}
+
+// GetNumObservations returns the total count of ObservationVals in the data
+// store for the given |ObservationMmetadata| key or returns an error.
+func (store *RedisStore) GetNumObservations(om *cobalt.ObservationMetadata) (int, error) {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return 0, grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	conn := store.pool.Get()
+	defer conn.Close()
+	count, err := redis.Int(conn.Do("ZCARD", redisIdsKeyPrefix+bKey))
+	if err != nil {
+		return 0, grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+	if count == 0 {
+		return 0, grpc.Errorf(codes.InvalidArgument, "Observation metadata [%v] not found.", om)
+	}
+
+	return count, nil
+}
+
+// GetTotalNumObservations returns the total count of ObservationVals in the
+// data store or returns an error. The sizes of all buckets are read in a
+// single round trip.
+func (store *RedisStore) GetTotalNumObservations() (int64, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	bKeys, err := redis.Strings(conn.Do("SMEMBERS", redisBucketsKey))
+	if err != nil {
+		return 0, grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+
+	// The commands are buffered by the connection and sent with the Flush.
+	for _, bKey := range bKeys {
+		conn.Send("ZCARD", redisIdsKeyPrefix+bKey)
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+	var total int64
+	for range bKeys {
+		count, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return 0, grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// Scrub verifies the checksums of all ObservationVals in the data store and
+// deletes those that are corrupted. Returns the number of ObservationVals that
+// were checked and deleted, or an error.
+func (store *RedisStore) Scrub() (numChecked int, numDeleted int, err error) {
+	conn := store.pool.Get()
+	bKeys, err := redis.Strings(conn.Do("SMEMBERS", redisBucketsKey))
+	conn.Close()
+	if err != nil {
+		return 0, 0, grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+
+	for _, bKey := range bKeys {
+		lastID := ""
+		for more := true; more; {
+			var ids []string
+			var vals [][]byte
+			if ids, vals, more, err = store.readPage(bKey, lastID); err != nil {
+				return numChecked, numDeleted, grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+			}
+			var corrupted []string
+			for i, id := range ids {
+				if vals[i] == nil {
+					continue
+				}
+				numChecked++
+				if _, parseErr := parseDBVal(vals[i]); parseErr != nil {
+					stackdriver.LogCountMetricf(redisCorruptedObservationFound, "Scrub() is deleting the corrupted ObservationVal [%s_%s]: %v", bKey, id, parseErr)
+					corrupted = append(corrupted, id)
+				}
+			}
+			if len(corrupted) > 0 {
+				if err := store.deleteIds(bKey, corrupted); err != nil {
+					return numChecked, numDeleted, err
+				}
+				numDeleted += len(corrupted)
+			}
+			if len(ids) > 0 {
+				lastID = ids[len(ids)-1]
+			}
+		}
+	}
+	return numChecked, numDeleted, nil
+}
+
+// AddDispatchRecord appends |record| to the DispatchHistory of the bucket for
+// the given |ObservationMetadata| key, keeping only the |maxRecords| most
+// recent records.
+func (store *RedisStore) AddDispatchRecord(om *cobalt.ObservationMetadata, record *shuffler.DispatchRecord, maxRecords int) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	if record == nil {
+		panic("record is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.readModifyWrite(redisDispatchHistoriesKey, bKey, func(val []byte) ([]byte, error) {
+		history := &shuffler.DispatchHistory{}
+		if err := proto.Unmarshal(val, history); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the dispatch history for metadata [%v]: [%v]", om, err)
+		}
+		if val == nil {
+			history.Bucket = om
+		}
+		appendDispatchRecord(history, record, maxRecords)
+
+		val, err := proto.Marshal(history)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in serializing the dispatch history for metadata [%v]: [%v]", om, err)
+		}
+		return val, nil
+	})
+}
+
+// GetDispatchHistories returns the DispatchHistories of all buckets or returns
+// an error.
+func (store *RedisStore) GetDispatchHistories() ([]*shuffler.DispatchHistory, error) {
+	histories := []*shuffler.DispatchHistory{}
+	err := store.forEachValue(redisDispatchHistoriesKey, func(field string, val []byte) error {
+		history := &shuffler.DispatchHistory{}
+		if err := proto.Unmarshal(val, history); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the dispatch history of bucket [%s]: [%v]", field, err)
+		}
+		histories = append(histories, history)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return histories, nil
+}
+
+// DeleteDispatchHistory deletes the DispatchHistory of the bucket for the given
+// |ObservationMetadata| key or returns an error.
+func (store *RedisStore) DeleteDispatchHistory(om *cobalt.ObservationMetadata) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.deleteValue(redisDispatchHistoriesKey, bKey)
+}
+
+// AddDropCount adds |numObservations| to the DropRecord for |arrivalDayIndex|
+// and |reason| in the DropAudit of the bucket for the given
+// |ObservationMetadata| key.
+func (store *RedisStore) AddDropCount(om *cobalt.ObservationMetadata, arrivalDayIndex uint32, reason shuffler.DropRecord_Reason, numObservations uint64) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.readModifyWrite(redisDropAuditsKey, bKey, func(val []byte) ([]byte, error) {
+		audit := &shuffler.DropAudit{}
+		if err := proto.Unmarshal(val, audit); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the drop audit for metadata [%v]: [%v]", om, err)
+		}
+		if val == nil {
+			audit.Bucket = om
+		}
+		addDropCount(audit, arrivalDayIndex, reason, numObservations)
+
+		val, err := proto.Marshal(audit)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in serializing the drop audit for metadata [%v]: [%v]", om, err)
+		}
+		return val, nil
+	})
+}
+
+// GetDropAudits returns the DropAudits of all buckets or returns an error.
+func (store *RedisStore) GetDropAudits() ([]*shuffler.DropAudit, error) {
+	audits := []*shuffler.DropAudit{}
+	err := store.forEachValue(redisDropAuditsKey, func(field string, val []byte) error {
+		audit := &shuffler.DropAudit{}
+		if err := proto.Unmarshal(val, audit); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the drop audit of bucket [%s]: [%v]", field, err)
+		}
+		audits = append(audits, audit)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return audits, nil
+}
+
+// DeleteDropAudit deletes the DropAudit of the bucket for the given
+// |ObservationMetadata| key or returns an error.
+func (store *RedisStore) DeleteDropAudit(om *cobalt.ObservationMetadata) error {
+	if om == nil {
+		panic("observation metadata is nil")
+	}
+
+	bKey, err := BKey(om)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Error in parsing observation metadata [%v]: [%v]", om, err)
+	}
+
+	return store.deleteValue(redisDropAuditsKey, bKey)
+}
+
+// AddUsage adds the counts in |record| to the UsageRecord for
+// |record.DayIndex| in the ProjectUsage of the given project.
+func (store *RedisStore) AddUsage(customerId uint32, projectId uint32, record *shuffler.UsageRecord) error {
+	if record == nil {
+		panic("record is nil")
+	}
+
+	field := fmt.Sprintf("%d_%d", customerId, projectId)
+	return store.readModifyWrite(redisUsageKey, field, func(val []byte) ([]byte, error) {
+		usage := &shuffler.ProjectUsage{}
+		if err := proto.Unmarshal(val, usage); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in parsing the usage of project (%d, %d): [%v]", customerId, projectId, err)
+		}
+		if val == nil {
+			usage.CustomerId = customerId
+			usage.ProjectId = projectId
+		}
+		addUsage(usage, record)
+
+		val, err := proto.Marshal(usage)
+		if err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Error in serializing the usage of project (%d, %d): [%v]", customerId, projectId, err)
+		}
+		return val, nil
+	})
+}
+
+// GetUsage returns the ProjectUsages of all projects or returns an error.
+func (store *RedisStore) GetUsage() ([]*shuffler.ProjectUsage, error) {
+	usages := []*shuffler.ProjectUsage{}
+	err := store.forEachValue(redisUsageKey, func(field string, val []byte) error {
+		usage := &shuffler.ProjectUsage{}
+		if err := proto.Unmarshal(val, usage); err != nil {
+			return grpc.Errorf(codes.Internal, "Error in parsing the usage of project [%s]: [%v]", field, err)
+		}
+		usages = append(usages, usage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usages, nil
+}
+
+// EraseAllData deletes all keys of the store.
+func (store *RedisStore) EraseAllData() error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	bKeys, err := redis.Strings(conn.Do("SMEMBERS", redisBucketsKey))
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+	keys := redis.Args{}.Add(redisBucketsKey, redisDispatchHistoriesKey, redisDropAuditsKey, redisUsageKey)
+	for _, bKey := range bKeys {
+		keys = keys.Add(redisIdsKeyPrefix+bKey, redisValsKeyPrefix+bKey, redisLeaseKeyPrefix+bKey)
+	}
+	if _, err := conn.Do("DEL", keys...); err != nil {
+		return grpc.Errorf(codes.Internal, "Redis write error: [%v]", err)
+	}
+	return nil
+}
+
+// readModifyWrite replaces the value of the field |field| of the hash |key| by
+// the value returned by |modify|, which is passed the current value, or nil if
+// the field does not exist.
+func (store *RedisStore) readModifyWrite(key string, field string, modify func(val []byte) ([]byte, error)) error {
+	store.historyMu.Lock()
+	defer store.historyMu.Unlock()
+
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	val, err := redis.Bytes(conn.Do("HGET", key, field))
+	if err == redis.ErrNil {
+		val, err = nil, nil
+	}
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+	if val, err = modify(val); err != nil {
+		return err
+	}
+	if _, err := conn.Do("HSET", key, field, val); err != nil {
+		return grpc.Errorf(codes.Internal, "Redis write error: [%v]", err)
+	}
+	return nil
+}
+
+// forEachValue invokes |f| for each field and value of the hash |key| until
+// |f| returns an error, which is then returned.
+func (store *RedisStore) forEachValue(key string, f func(field string, val []byte) error) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("HGETALL", key))
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Redis read error: [%v]", err)
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		if err := f(string(values[i]), values[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteValue deletes the field |field| of the hash |key|, if any.
+func (store *RedisStore) deleteValue(key string, field string) error {
+	store.historyMu.Lock()
+	defer store.historyMu.Unlock()
+
+	conn := store.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HDEL", key, field); err != nil {
+		return grpc.Errorf(codes.Internal, "Redis write error: [%v]", err)
+	}
+	return nil
+}
+
+// redisStoreIterator iterates over the ObservationVals of a bucket of a
+// RedisStore, in the order of their random identifiers. The ObservationVals
+// are read in pages of |redisPageSize|, each starting after the last
+// identifier of the previous page, so that ObservationVals deleted during the
+// iteration do not cause others to be skipped.
+type redisStoreIterator struct {
+	store *RedisStore
+	bKey  string
+
+	// The current page and the index of the current entry in it.
+	page    []*shuffler.ObservationVal
+	current int
+
+	// The identifier of the last ObservationVal read, and whether the last
+	// page has been read.
+	lastID string
+	done   bool
+
+	// The error that ended the iteration, if any, returned by Release().
+	err error
+}
+
+// Get returns the current entry the Iterator is pointing to or an error if the
+// iterator is invalid.
+func (ri *redisStoreIterator) Get() (*shuffler.ObservationVal, error) {
+	if ri.current < 0 || ri.current >= len(ri.page) {
+		return nil, grpc.Errorf(codes.Internal, "Invalid iterator")
+	}
+	return ri.page[ri.current], nil
+}
+
+// Next advances the iterator to the next entry and returns whether or not
+// the iterator is still valid. Entries whose checksum does not match or that
+// cannot be parsed are counted and skipped. They are deleted by
+// RedisStore.Scrub().
+func (ri *redisStoreIterator) Next() bool {
+	ri.current++
+	for ri.current >= len(ri.page) {
+		if ri.done {
+			return false
+		}
+		ids, vals, more, err := ri.store.readPage(ri.bKey, ri.lastID)
+		if err != nil {
+			ri.err = err
+			ri.done = true
+			ri.page = nil
+			return false
+		}
+		ri.done = !more
+		ri.page = nil
+		ri.current = 0
+		for i, id := range ids {
+			if vals[i] == nil {
+				// Deleted since its identifier was read.
+				continue
+			}
+			obVal, err := parseDBVal(vals[i])
+			if err != nil {
+				stackdriver.LogCountMetricf(redisCorruptedObservationFound, "Skipping the corrupted ObservationVal [%s_%s]: %v", ri.bKey, id, err)
+				continue
+			}
+			ri.page = append(ri.page, obVal)
+		}
+		if len(ids) > 0 {
+			ri.lastID = ids[len(ids)-1]
+		}
+	}
+	return true
+}
+
+// Release releases the iterator after use and returns the error that ended
+// the iteration, if any.
+func (ri *redisStoreIterator) Release() error {
+	ri.page = nil
+	ri.done = true
+	if ri.err != nil {
+		return grpc.Errorf(codes.Internal, "Redis read error: [%v]", ri.err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// RedisStore tests. They require a Redis server, whose address is given by
+// the environment variable SHUFFLER_TEST_REDIS_ADDR, and are skipped
+// otherwise. All keys of the store are deleted.
+
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"cobalt"
+	"shuffler"
+)
+
+// makeRedisTestStore returns an empty RedisStore whose buckets expire after
+// |ttl|, or skips the test if no server is available.
+func makeRedisTestStore(t *testing.T, ttl time.Duration) *RedisStore {
+	addr := os.Getenv("SHUFFLER_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("SHUFFLER_TEST_REDIS_ADDR is not set.")
+	}
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	s, err := NewRedisStore(pool, func(om *cobalt.ObservationMetadata) time.Duration { return ttl })
+	if err != nil {
+		t.Fatalf("Failed to create a Redis store instance: %v", err)
+	}
+	if err := s.EraseAllData(); err != nil {
+		t.Fatalf("Failed to erase the Redis store: %v", err)
+	}
+	return s
+}
+
+func TestAddGetAndDeleteObservationsForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestAddGetAndDeleteObservations(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestShuffleObservationsForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestShuffle(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestForEachKeyForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestForEachKey(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDispatchHistoryForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestDispatchHistory(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDropAuditForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestDropAudit(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestUsageForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestUsage(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDeleteValuesInChunksForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestDeleteValuesInChunks(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestLeasesForRedisStore(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+	doTestLeases(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+// Tests that the ObservationVals of a bucket spanning several pages are all
+// returned, and that those deleted during the iteration do not cause others to
+// be skipped.
+func TestRedisStoreIteratorPages(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+
+	const numMsgs = 2*redisPageSize + 10
+	om := NewObservationMetaData(7)
+	batch := NewObservationBatchForMetadata(om, numMsgs)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+
+	iter, err := s.GetObservations(om)
+	if err != nil {
+		t.Fatalf("GetObservations: got error %v, expected success", err)
+	}
+	seen := make(map[string]bool)
+	for iter.Next() {
+		obVal, err := iter.Get()
+		if err != nil {
+			t.Fatalf("Get: got error %v, expected success", err)
+		}
+		seen[obVal.Id] = true
+		if err := s.DeleteValues(om, []*shuffler.ObservationVal{obVal}); err != nil {
+			t.Fatalf("DeleteValues: got error %v, expected success", err)
+		}
+	}
+	if err := iter.Release(); err != nil {
+		t.Errorf("Release: got error %v, expected success", err)
+	}
+	if len(seen) != numMsgs {
+		t.Errorf("got %d ObservationVals, expected %d", len(seen), numMsgs)
+	}
+	CheckKeys(t, s, nil)
+}
+
+// Tests that the keys of the buckets expire after the TTL and that expired
+// buckets are skipped.
+func TestRedisStoreTTL(t *testing.T) {
+	s := makeRedisTestStore(t, time.Hour)
+	defer s.Close()
+
+	batches := MakeObservationBatches(2)
+	if err := s.AddAllObservations(batches, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	for _, batch := range batches {
+		bKey, _ := BKey(batch.GetMetaData())
+		for _, key := range []string{redisIdsKeyPrefix + bKey, redisValsKeyPrefix + bKey} {
+			ttl, err := redis.Int64(conn.Do("PTTL", key))
+			if err != nil || ttl <= 0 || ttl > int64(time.Hour/time.Millisecond) {
+				t.Errorf("PTTL %s: got (%d, %v), expected a TTL of at most an hour", key, ttl, err)
+			}
+		}
+	}
+
+	// Expire the first bucket.
+	bKey, _ := BKey(batches[0].GetMetaData())
+	if _, err := conn.Do("DEL", redisIdsKeyPrefix+bKey, redisValsKeyPrefix+bKey); err != nil {
+		t.Fatalf("DEL: got error %v", err)
+	}
+	CheckKeys(t, s, []*cobalt.ObservationMetadata{batches[1].GetMetaData()})
+	if isMember, _ := redis.Bool(conn.Do("SISMEMBER", redisBucketsKey, bKey)); isMember {
+		t.Errorf("Expected the expired bucket to be removed from the set of buckets")
+	}
+}
+
+// Tests that Scrub() deletes the corrupted ObservationVals and that
+// GetObservations() skips them.
+func TestRedisStoreCorruptedObservations(t *testing.T) {
+	s := makeRedisTestStore(t, 0)
+	defer s.Close()
+
+	om := NewObservationMetaData(3)
+	batch := NewObservationBatchForMetadata(om, 10)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	bKey, _ := BKey(om)
+	conn := s.pool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("ZRANGEBYLEX", redisIdsKeyPrefix+bKey, "-", "+", "LIMIT", 0, 1))
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("ZRANGEBYLEX: got (%v, %v)", ids, err)
+	}
+	if _, err := conn.Do("HSET", redisValsKeyPrefix+bKey, ids[0], []byte{checksumMarker, 1, 2, 3, 4, 5}); err != nil {
+		t.Fatalf("Failed to corrupt an ObservationVal: %v", err)
+	}
+
+	CheckObservations(t, s, om, 9)
+	numChecked, numDeleted, err := s.Scrub()
+	if err != nil || numChecked != 10 || numDeleted != 1 {
+		t.Errorf("Scrub: got (%d, %d, %v), expected (10, 1, nil)", numChecked, numDeleted, err)
+	}
+	CheckNumObservations(t, s, om, 9)
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"shuffler"
+)
+
+// reshufflingIterator wraps an Iterator and returns its entries in an order
+// that is shuffled again, in consecutive batches of |batchSize| entries, using
+// |shuffleStrategy|.
+type reshufflingIterator struct {
+	iter            Iterator
+	shuffleStrategy ShuffleStrategy
+	batchSize       int
+
+	// batch holds the shuffled entries of the current batch that have not been
+	// consumed yet. The current entry is batch[0].
+	batch []*shuffler.ObservationVal
+
+	// If not nil, |err| is returned by Get() for the current entry instead of
+	// batch[0].
+	err error
+
+	started bool
+}
+
+// newReshufflingIterator returns an Iterator over the entries of |iter|,
+// shuffled in batches of |batchSize| using |shuffleStrategy|.
+func newReshufflingIterator(iter Iterator, shuffleStrategy ShuffleStrategy, batchSize int) Iterator {
+	if iter == nil {
+		panic("iter is nil")
+	}
+	if batchSize <= 0 {
+		panic("batchSize must be positive.")
+	}
+
+	return &reshufflingIterator{
+		iter:            iter,
+		shuffleStrategy: shuffleStrategy,
+		batchSize:       batchSize,
+	}
+}
+
+// fill reads the next batch from |ri.iter| and shuffles it. Entries that
+// cannot be read are skipped and the first such error is returned.
+func (ri *reshufflingIterator) fill() error {
+	var firstErr error
+	var batch []*shuffler.ObservationVal
+	for len(batch) < ri.batchSize && ri.iter.Next() {
+		obVal, err := ri.iter.Get()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		batch = append(batch, obVal)
+	}
+
+	shuffled, err := ri.shuffleStrategy.Shuffle(batch)
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "Error in shuffling a batch of observations: %v", err)
+	}
+	ri.batch = shuffled
+	return firstErr
+}
+
+// Get returns the current entry the Iterator is pointing to or an error if the
+// iterator is invalid or if the entry could not be read.
+func (ri *reshufflingIterator) Get() (*shuffler.ObservationVal, error) {
+	if ri.err != nil {
+		return nil, ri.err
+	}
+	if !ri.started || len(ri.batch) == 0 {
+		return nil, grpc.Errorf(codes.Internal, "Invalid iterator")
+	}
+	return ri.batch[0], nil
+}
+
+// Next advances the iterator to the next entry and returns whether or not
+// the iterator is still valid.
+func (ri *reshufflingIterator) Next() bool {
+	if ri.started && ri.err == nil && len(ri.batch) > 0 {
+		ri.batch = ri.batch[1:]
+	}
+	ri.started = true
+	ri.err = nil
+	if len(ri.batch) == 0 {
+		ri.err = ri.fill()
+	}
+	return ri.err != nil || len(ri.batch) > 0
+}
+
+// Release releases the underlying iterator.
+func (ri *reshufflingIterator) Release() error {
+	ri.batch = nil
+	return ri.iter.Release()
+}
@@ -0,0 +1,295 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"cobalt"
+	"shuffler"
+)
+
+// Tenant identifies the Observations of a customer's project. A Tenant with a
+// zero |ProjectId| stands for all projects of the customer that do not have a
+// Tenant of their own.
+type Tenant struct {
+	CustomerId uint32
+	ProjectId  uint32
+}
+
+// RoutingStore is an implementation of the Store interface that keeps the
+// Observations of selected Tenants in separate Stores, for example LevelDB
+// databases on separate disks, so that a noisy tenant cannot exhaust the disk
+// of the others and each tenant can be backed up and restored independently.
+// Each method is forwarded to the Store of the Tenant of its
+// |ObservationMetadata| key, or of its project for AddUsage. GetKeys,
+// ForEachKey, GetDispatchHistories, GetDropAudits and GetUsage combine the
+// results of all Stores.
+//
+// The assignment of Tenants to Stores must not change while a Store holds
+// Observations of a Tenant that is moved elsewhere, or those Observations are
+// no longer dispatched.
+type RoutingStore struct {
+	defaultStore Store
+	tenantStores map[Tenant]Store
+
+	// The distinct Stores in |defaultStore| and |tenantStores|.
+	stores []Store
+}
+
+// NewRoutingStore returns a RoutingStore that keeps the Observations of each
+// Tenant in |tenantStores| in its Store and all other Observations in
+// |defaultStore|. A Store may be shared by several Tenants.
+func NewRoutingStore(defaultStore Store, tenantStores map[Tenant]Store) *RoutingStore {
+	if defaultStore == nil {
+		panic("defaultStore is nil")
+	}
+
+	s := &RoutingStore{
+		defaultStore: defaultStore,
+		tenantStores: make(map[Tenant]Store, len(tenantStores)),
+		stores:       []Store{defaultStore},
+	}
+	for tenant, store := range tenantStores {
+		if store == nil {
+			panic("tenant store is nil")
+		}
+		s.tenantStores[tenant] = store
+		if !s.contains(store) {
+			s.stores = append(s.stores, store)
+		}
+	}
+	return s
+}
+
+// contains returns true if |store| is one of the distinct Stores of |s|.
+func (s *RoutingStore) contains(store Store) bool {
+	for _, other := range s.stores {
+		if other == store {
+			return true
+		}
+	}
+	return false
+}
+
+// storeFor returns the Store for the bucket with key |om|. The Store of the
+// project is preferred over the Store of the customer.
+func (s *RoutingStore) storeFor(om *cobalt.ObservationMetadata) Store {
+	if om == nil {
+		return s.defaultStore
+	}
+	if store, ok := s.tenantStores[Tenant{om.CustomerId, om.ProjectId}]; ok {
+		return store
+	}
+	if store, ok := s.tenantStores[Tenant{om.CustomerId, 0}]; ok {
+		return store
+	}
+	return s.defaultStore
+}
+
+// AddAllObservations adds the ObservationBatches in |envelopeBatch| to the
+// Stores of their Tenants. The Stores are written one after the other, so if
+// one of them fails the Observations may already have been added to the
+// others.
+func (s *RoutingStore) AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrival Arrival) error {
+	batches := make(map[Store][]*cobalt.ObservationBatch)
+	for _, batch := range envelopeBatch {
+		if batch == nil {
+			continue
+		}
+		if batch.GetMetaData() == nil {
+			return grpc.Errorf(codes.InvalidArgument, "One of the ObservationBatches did not have meta_data set")
+		}
+		store := s.storeFor(batch.GetMetaData())
+		batches[store] = append(batches[store], batch)
+	}
+
+	// Iterate over |s.stores| rather than |batches| so that the Stores are
+	// always written in the same order.
+	for _, store := range s.stores {
+		if storeBatches, ok := batches[store]; ok {
+			if err := store.AddAllObservations(storeBatches, arrival); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetObservations returns the ObservationVals of the bucket with key |om| from
+// the Store of its Tenant.
+func (s *RoutingStore) GetObservations(om *cobalt.ObservationMetadata) (Iterator, error) {
+	return s.storeFor(om).GetObservations(om)
+}
+
+// TryLease acquires or renews the lease on the bucket with the given
+// ObservationMetadata in the Store of its Tenant.
+func (s *RoutingStore) TryLease(om *cobalt.ObservationMetadata, owner string, ttl time.Duration) (bool, error) {
+	return s.storeFor(om).TryLease(om, owner, ttl)
+}
+
+// ReleaseLease releases the lease on the bucket with the given
+// ObservationMetadata in the Store of its Tenant.
+func (s *RoutingStore) ReleaseLease(om *cobalt.ObservationMetadata, owner string) error {
+	return s.storeFor(om).ReleaseLease(om, owner)
+}
+
+// GetNumObservations returns the number of ObservationVals of the bucket with
+// key |om| in the Store of its Tenant.
+func (s *RoutingStore) GetNumObservations(om *cobalt.ObservationMetadata) (int, error) {
+	return s.storeFor(om).GetNumObservations(om)
+}
+
+// GetKeys returns the keys of all buckets in all Stores.
+func (s *RoutingStore) GetKeys() ([]*cobalt.ObservationMetadata, error) {
+	var keys []*cobalt.ObservationMetadata
+	for _, store := range s.stores {
+		storeKeys, err := store.GetKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, storeKeys...)
+	}
+	return keys, nil
+}
+
+// ForEachKey invokes |f| for the key of each bucket in each of the Stores
+// until |f| returns false.
+func (s *RoutingStore) ForEachKey(f func(om *cobalt.ObservationMetadata) bool) error {
+	done := false
+	for _, store := range s.stores {
+		err := store.ForEachKey(func(om *cobalt.ObservationMetadata) bool {
+			done = !f(om)
+			return !done
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteValues deletes |obVals| from the bucket with key |om| in the Store of
+// its Tenant.
+func (s *RoutingStore) DeleteValues(om *cobalt.ObservationMetadata, obVals []*shuffler.ObservationVal) error {
+	return s.storeFor(om).DeleteValues(om, obVals)
+}
+
+// AddDispatchRecord appends |record| to the DispatchHistory of the bucket with
+// key |om| in the Store of its Tenant.
+func (s *RoutingStore) AddDispatchRecord(om *cobalt.ObservationMetadata, record *shuffler.DispatchRecord, maxRecords int) error {
+	return s.storeFor(om).AddDispatchRecord(om, record, maxRecords)
+}
+
+// GetDispatchHistories returns the DispatchHistories of all buckets in all
+// Stores.
+func (s *RoutingStore) GetDispatchHistories() ([]*shuffler.DispatchHistory, error) {
+	var histories []*shuffler.DispatchHistory
+	for _, store := range s.stores {
+		storeHistories, err := store.GetDispatchHistories()
+		if err != nil {
+			return nil, err
+		}
+		histories = append(histories, storeHistories...)
+	}
+	return histories, nil
+}
+
+// DeleteDispatchHistory deletes the DispatchHistory of the bucket with key
+// |om| from the Store of its Tenant.
+func (s *RoutingStore) DeleteDispatchHistory(om *cobalt.ObservationMetadata) error {
+	return s.storeFor(om).DeleteDispatchHistory(om)
+}
+
+// AddDropCount adds |numObservations| to the DropAudit of the bucket with key
+// |om| in the Store of its Tenant.
+func (s *RoutingStore) AddDropCount(om *cobalt.ObservationMetadata, arrivalDayIndex uint32, reason shuffler.DropRecord_Reason, numObservations uint64) error {
+	return s.storeFor(om).AddDropCount(om, arrivalDayIndex, reason, numObservations)
+}
+
+// GetDropAudits returns the DropAudits of all buckets in all Stores.
+func (s *RoutingStore) GetDropAudits() ([]*shuffler.DropAudit, error) {
+	var audits []*shuffler.DropAudit
+	for _, store := range s.stores {
+		storeAudits, err := store.GetDropAudits()
+		if err != nil {
+			return nil, err
+		}
+		audits = append(audits, storeAudits...)
+	}
+	return audits, nil
+}
+
+// DeleteDropAudit deletes the DropAudit of the bucket with key |om| from the
+// Store of its Tenant.
+func (s *RoutingStore) DeleteDropAudit(om *cobalt.ObservationMetadata) error {
+	return s.storeFor(om).DeleteDropAudit(om)
+}
+
+// AddUsage adds the counts in |record| to the ProjectUsage of the given
+// project in the Store of its Tenant.
+func (s *RoutingStore) AddUsage(customerId uint32, projectId uint32, record *shuffler.UsageRecord) error {
+	om := &cobalt.ObservationMetadata{CustomerId: customerId, ProjectId: projectId}
+	return s.storeFor(om).AddUsage(customerId, projectId, record)
+}
+
+// GetUsage returns the ProjectUsages of all projects in all Stores.
+func (s *RoutingStore) GetUsage() ([]*shuffler.ProjectUsage, error) {
+	var usages []*shuffler.ProjectUsage
+	for _, store := range s.stores {
+		storeUsages, err := store.GetUsage()
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, storeUsages...)
+	}
+	return usages, nil
+}
+
+// GetTotalNumObservations returns the total count of ObservationVals in all
+// Stores.
+func (s *RoutingStore) GetTotalNumObservations() (int64, error) {
+	var total int64
+	for _, store := range s.stores {
+		n, err := store.GetTotalNumObservations()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Scrub scrubs each of the Stores of |s| and returns the total number of
+// ObservationVals that were checked and deleted.
+func (s *RoutingStore) Scrub() (numChecked int, numDeleted int, err error) {
+	for _, store := range s.stores {
+		storeChecked, storeDeleted, err := store.Scrub()
+		numChecked += storeChecked
+		numDeleted += storeDeleted
+		if err != nil {
+			return numChecked, numDeleted, err
+		}
+	}
+	return numChecked, numDeleted, nil
+}
+
+// Stores returns the distinct Stores of |s|, starting with the default Store.
+func (s *RoutingStore) Stores() []Store {
+	return s.stores
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+
+	"cobalt"
+	"shuffler"
+)
+
+// newTestRoutingStore returns a RoutingStore whose Tenants (1, 1) and (2, *)
+// have Stores of their own, and those Stores.
+func newTestRoutingStore() (s *RoutingStore, defaultStore, store1, store2 *MemStore) {
+	defaultStore = NewMemStore()
+	store1 = NewMemStore()
+	store2 = NewMemStore()
+	s = NewRoutingStore(defaultStore, map[Tenant]Store{
+		Tenant{1, 1}: store1,
+		Tenant{2, 0}: store2,
+	})
+	return
+}
+
+func TestAddGetAndDeleteObservationsForRoutingStore(t *testing.T) {
+	s, _, _, _ := newTestRoutingStore()
+	doTestAddGetAndDeleteObservations(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestForEachKeyForRoutingStore(t *testing.T) {
+	s, _, _, _ := newTestRoutingStore()
+	doTestForEachKey(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDispatchHistoryForRoutingStore(t *testing.T) {
+	s, _, _, _ := newTestRoutingStore()
+	doTestDispatchHistory(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestDropAuditForRoutingStore(t *testing.T) {
+	s, _, _, _ := newTestRoutingStore()
+	doTestDropAudit(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestUsageForRoutingStore(t *testing.T) {
+	s, _, _, _ := newTestRoutingStore()
+	doTestUsage(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+func TestLeasesForRoutingStore(t *testing.T) {
+	s, _, _, _ := newTestRoutingStore()
+	doTestLeases(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+// Tests that Observations are added to the Store of their Tenant.
+func TestRoutingStoreRoutesByTenant(t *testing.T) {
+	s, defaultStore, store1, store2 := newTestRoutingStore()
+
+	om11 := &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 1}
+	om12 := &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 2, MetricId: 1}
+	om23 := &cobalt.ObservationMetadata{CustomerId: 2, ProjectId: 3, MetricId: 1}
+	batches := []*cobalt.ObservationBatch{
+		NewObservationBatchForMetadata(om11, 1),
+		NewObservationBatchForMetadata(om12, 2),
+		NewObservationBatchForMetadata(om23, 3),
+	}
+	if err := s.AddAllObservations(batches, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+
+	CheckKeys(t, store1, []*cobalt.ObservationMetadata{om11})
+	CheckKeys(t, defaultStore, []*cobalt.ObservationMetadata{om12})
+	CheckKeys(t, store2, []*cobalt.ObservationMetadata{om23})
+	CheckKeys(t, s, []*cobalt.ObservationMetadata{om11, om12, om23})
+	CheckNumObservations(t, s, om23, 3)
+
+	record := &shuffler.DispatchRecord{DispatchTimeSeconds: 1}
+	if err := s.AddDispatchRecord(om23, record, 1); err != nil {
+		t.Fatalf("AddDispatchRecord: got error %v, expected success", err)
+	}
+	if histories, err := store2.GetDispatchHistories(); err != nil || len(histories) != 1 {
+		t.Errorf("GetDispatchHistories: got %v and error %v, expected the history of [%v]", histories, err, om23)
+	}
+
+	// A batch without metadata is rejected before anything is written.
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batches[0], &cobalt.ObservationBatch{}}, Arrival{}); err == nil {
+		t.Errorf("AddAllObservations: got success for a batch without metadata, expected an error")
+	}
+	CheckNumObservations(t, s, om11, 1)
+}
+
+// Tests that a Store shared by several Tenants is visited once.
+func TestRoutingStoreSharedStore(t *testing.T) {
+	shared := NewMemStore()
+	s := NewRoutingStore(shared, map[Tenant]Store{Tenant{1, 0}: shared})
+	if len(s.Stores()) != 1 {
+		t.Errorf("got %d stores, expected 1", len(s.Stores()))
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"shuffler"
+	"util"
+)
+
+// A ShuffleStrategy determines the order in which a Store returns the
+// ObservationVals of a bucket. Breaking the link between the arrival order and
+// the dispatch order of Observations is what provides the privacy guarantees
+// of the Shuffler, so every random choice that affects this order is made by
+// the ShuffleStrategy of the Store.
+type ShuffleStrategy interface {
+	// NewID returns a random identifier for a new ObservationVal. The
+	// LevelDBStore sorts the rows of a bucket by this identifier, which shuffles
+	// Observations as they are added.
+	NewID() (uint64, error)
+
+	// Shuffle returns a random permutation of |obVals| or an error if the
+	// underlying source of entropy fails.
+	Shuffle(obVals []*shuffler.ObservationVal) ([]*shuffler.ObservationVal, error)
+}
+
+// RandomShuffleStrategy is a ShuffleStrategy that draws identifiers and
+// permutations from |rand|.
+type RandomShuffleStrategy struct {
+	rand util.Random
+}
+
+// NewSecureShuffleStrategy returns the default ShuffleStrategy, which uses the
+// crypto/rand PRNG.
+func NewSecureShuffleStrategy() *RandomShuffleStrategy {
+	return &RandomShuffleStrategy{rand: &util.SecureRandom{}}
+}
+
+// NewDeterministicShuffleStrategy returns a ShuffleStrategy that uses a
+// "math/rand" PRNG seeded with |seed|. It must only be used in tests.
+func NewDeterministicShuffleStrategy(seed int64) *RandomShuffleStrategy {
+	return &RandomShuffleStrategy{rand: util.NewDeterministicRandom(seed)}
+}
+
+// NewID returns a uniformly random, 63-bit identifier.
+func (s *RandomShuffleStrategy) NewID() (uint64, error) {
+	return s.rand.RandomUint63(1<<63 - 1)
+}
+
+// Shuffle returns a uniformly random permutation of |obVals| computed using
+// the Fisher-Yates shuffle. |obVals| is not modified.
+func (s *RandomShuffleStrategy) Shuffle(obVals []*shuffler.ObservationVal) ([]*shuffler.ObservationVal, error) {
+	shuffled := make([]*shuffler.ObservationVal, len(obVals))
+	copy(shuffled, obVals)
+	for i := len(shuffled) - 1; i > 0; i-- {
+		j, err := s.rand.RandomUint63(uint64(i + 1))
+		if err != nil {
+			return nil, err
+		}
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return shuffled, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"cobalt"
+	"shuffler"
+)
+
+// reversingShuffleStrategy is a ShuffleStrategy that reverses its input and
+// records the sizes of the lists it is asked to shuffle.
+type reversingShuffleStrategy struct {
+	nextID uint64
+	sizes  []int
+}
+
+func (s *reversingShuffleStrategy) NewID() (uint64, error) {
+	s.nextID++
+	return s.nextID, nil
+}
+
+func (s *reversingShuffleStrategy) Shuffle(obVals []*shuffler.ObservationVal) ([]*shuffler.ObservationVal, error) {
+	s.sizes = append(s.sizes, len(obVals))
+	reversed := make([]*shuffler.ObservationVal, len(obVals))
+	for i, obVal := range obVals {
+		reversed[len(obVals)-1-i] = obVal
+	}
+	return reversed, nil
+}
+
+// TestRandomShuffleStrategy tests that Shuffle() returns a permutation of its
+// input, leaves the input unmodified and is reproducible for a deterministic
+// seed.
+func TestRandomShuffleStrategy(t *testing.T) {
+	obVals := MakeRandomObservationVals(50)
+	input := append([]*shuffler.ObservationVal{}, obVals...)
+
+	shuffled, err := NewDeterministicShuffleStrategy(7).Shuffle(obVals)
+	if err != nil {
+		t.Fatalf("Shuffle() failed: %v", err)
+	}
+	if !reflect.DeepEqual(obVals, input) {
+		t.Errorf("Shuffle() modified its input")
+	}
+	if reflect.DeepEqual(shuffled, obVals) {
+		t.Errorf("Shuffle() did not change the order of 50 observations")
+	}
+	seen := make(map[*shuffler.ObservationVal]bool)
+	for _, obVal := range shuffled {
+		seen[obVal] = true
+	}
+	if len(shuffled) != len(obVals) || len(seen) != len(obVals) {
+		t.Errorf("got %v, expected a permutation of %v", shuffled, obVals)
+	}
+
+	again, _ := NewDeterministicShuffleStrategy(7).Shuffle(obVals)
+	if !reflect.DeepEqual(shuffled, again) {
+		t.Errorf("got different permutations for the same seed")
+	}
+
+	if empty, err := NewSecureShuffleStrategy().Shuffle(nil); err != nil || empty == nil || len(empty) != 0 {
+		t.Errorf("got (%v, %v) for an empty list, expected an empty list", empty, err)
+	}
+}
+
+// TestReshufflingIterator tests that a reshufflingIterator shuffles the
+// entries of the underlying iterator in consecutive batches.
+func TestReshufflingIterator(t *testing.T) {
+	obVals := MakeRandomObservationVals(10)
+	strategy := &reversingShuffleStrategy{}
+	iter := newReshufflingIterator(NewMemStoreIterator(obVals), strategy, 4)
+
+	var got []*shuffler.ObservationVal
+	for iter.Next() {
+		obVal, err := iter.Get()
+		if err != nil {
+			t.Fatalf("Get() failed: %v", err)
+		}
+		got = append(got, obVal)
+	}
+	if err := iter.Release(); err != nil {
+		t.Errorf("Release() failed: %v", err)
+	}
+
+	expected := []*shuffler.ObservationVal{
+		obVals[3], obVals[2], obVals[1], obVals[0],
+		obVals[7], obVals[6], obVals[5], obVals[4],
+		obVals[9], obVals[8],
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	if !reflect.DeepEqual(strategy.sizes, []int{4, 4, 2, 0}) {
+		t.Errorf("got batch sizes %v, expected [4 4 2 0]", strategy.sizes)
+	}
+}
+
+// TestMemStoreShuffleStrategy tests that the MemStore uses its
+// ShuffleStrategy for identifiers and for shuffling.
+func TestMemStoreShuffleStrategy(t *testing.T) {
+	strategy := &reversingShuffleStrategy{}
+	store := NewMemStoreWithShuffleStrategy(strategy)
+	om := NewObservationMetaData(5)
+	if err := store.AddAllObservations([]*cobalt.ObservationBatch{NewObservationBatchForMetadata(om, 3)},
+		Arrival{DayIndex: 10}); err != nil {
+		t.Fatalf("AddAllObservations() failed: %v", err)
+	}
+	obVals := CheckObservations(t, store, om, 3)
+	ids := make(map[string]bool)
+	for _, obVal := range obVals {
+		ids[obVal.Id] = true
+	}
+	if !reflect.DeepEqual(ids, map[string]bool{"1": true, "2": true, "3": true}) {
+		t.Errorf("got ids %v, expected the ids 1, 2 and 3 from the ShuffleStrategy", ids)
+	}
+	if len(strategy.sizes) == 0 || strategy.sizes[len(strategy.sizes)-1] != 3 {
+		t.Errorf("got shuffled sizes %v, expected the 3 observations to be shuffled", strategy.sizes)
+	}
+}
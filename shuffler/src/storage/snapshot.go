@@ -0,0 +1,145 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The first bytes of a snapshot written by WriteSnapshot.
+const snapshotHeader = "cobalt-shuffler-leveldb-snapshot-v1\n"
+
+// The largest number of rows written in a single batch by RestoreSnapshot.
+const restoreBatchSize = 1000
+
+// WriteSnapshot writes all rows of |store|, including the bucket counts,
+// dispatch histories, drop audits and usage records, to |w| as they are at a
+// single point in time. Writes that happen concurrently are either entirely
+// included or entirely excluded. Returns the number of rows written.
+//
+// The snapshot consists of a header followed by the key and the value of each
+// row, each preceded by its size as an unsigned varint.
+func (store *LevelDBStore) WriteSnapshot(w io.Writer) (numRows uint64, err error) {
+	snapshot, err := store.db.GetSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Release()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotHeader); err != nil {
+		return 0, err
+	}
+	iter := snapshot.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		for _, b := range [][]byte{iter.Key(), iter.Value()} {
+			if _, err := bw.Write(proto.EncodeVarint(uint64(len(b)))); err != nil {
+				return numRows, err
+			}
+			if _, err := bw.Write(b); err != nil {
+				return numRows, err
+			}
+		}
+		numRows++
+	}
+	if err := iter.Error(); err != nil {
+		return numRows, fmt.Errorf("LevelDB read error: [%v]", err)
+	}
+	return numRows, bw.Flush()
+}
+
+// RestoreSnapshot creates the LevelDB database at |dbDirPath| from the
+// snapshot read from |r|, which was written by WriteSnapshot. A database must
+// not exist at |dbDirPath| yet. The database is closed when RestoreSnapshot
+// returns, so that it can be opened with NewLevelDBStore. Returns the number
+// of rows restored.
+//
+// If an error is returned the partially restored database is deleted.
+func RestoreSnapshot(dbDirPath string, r io.Reader) (numRows uint64, err error) {
+	if _, err := os.Stat(dbDirPath); !os.IsNotExist(err) {
+		return 0, fmt.Errorf("unable to restore a snapshot to %s: the database exists", dbDirPath)
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotHeader))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != snapshotHeader {
+		return 0, fmt.Errorf("the data is not a Shuffler store snapshot")
+	}
+
+	db, err := leveldb.OpenFile(dbDirPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.RemoveAll(dbDirPath)
+		}
+	}()
+
+	batch := new(leveldb.Batch)
+	for {
+		key, err := readSnapshotField(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return numRows, fmt.Errorf("unable to read the key of row %d: %v", numRows, err)
+		}
+		val, err := readSnapshotField(br)
+		if err != nil {
+			return numRows, fmt.Errorf("unable to read the value of row %d: %v", numRows, err)
+		}
+		batch.Put(key, val)
+		numRows++
+		if batch.Len() == restoreBatchSize {
+			if err := db.Write(batch, nil); err != nil {
+				return numRows, fmt.Errorf("LevelDB write error: [%v]", err)
+			}
+			batch.Reset()
+		}
+	}
+	if err := db.Write(batch, nil); err != nil {
+		return numRows, fmt.Errorf("LevelDB write error: [%v]", err)
+	}
+	return numRows, nil
+}
+
+// readSnapshotField reads a field preceded by its size as an unsigned varint
+// from |r|. Returns io.EOF if |r| is at its end.
+func readSnapshotField(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, size)
+	if _, err := io.ReadFull(r, field); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return field, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cobalt"
+	"shuffler"
+)
+
+// Tests that a store restored from a snapshot holds the same Observations,
+// drop audits and usage as the original.
+func TestWriteAndRestoreSnapshot(t *testing.T) {
+	store := makeLevelDBTestStore(t)
+	defer ResetStoreForTesting(store, true)
+
+	batches := MakeObservationBatches(3)
+	if err := store.AddAllObservations(batches, NewArrival(time.Now(), "shuffler-1")); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	if err := store.AddDropCount(batches[0].MetaData, 10, shuffler.DropRecord_RANDOM_DROP, 3); err != nil {
+		t.Fatalf("AddDropCount: got error %v, expected success", err)
+	}
+	if err := store.AddUsage(1, 1, &shuffler.UsageRecord{DayIndex: 10, NumObservationsReceived: 5}); err != nil {
+		t.Fatalf("AddUsage: got error %v, expected success", err)
+	}
+
+	var buf bytes.Buffer
+	numRows, err := store.WriteSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("WriteSnapshot: got error %v, expected success", err)
+	}
+	numObservations := 0
+	for _, batch := range batches {
+		numObservations += len(batch.EncryptedObservation)
+	}
+	// The Observations, the count of each bucket, the drop audit and the usage.
+	expectedRows := numObservations + len(batches) + 2
+	if numRows != uint64(expectedRows) {
+		t.Errorf("WriteSnapshot: got %d rows, expected %d", numRows, expectedRows)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("TempDir: got error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dbDir := filepath.Join(tmpDir, "observations_db")
+
+	if _, err := RestoreSnapshot(dbDir, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("RestoreSnapshot: got error %v, expected success", err)
+	}
+	restored, err := NewLevelDBStore(dbDir)
+	if err != nil {
+		t.Fatalf("NewLevelDBStore: got error %v for the restored database", err)
+	}
+	defer restored.close()
+
+	var keys []*cobalt.ObservationMetadata
+	for _, batch := range batches {
+		keys = append(keys, batch.MetaData)
+		CheckGetObservations(t, restored, batch.MetaData, batch.EncryptedObservation)
+	}
+	CheckKeys(t, restored, keys)
+	if audits, err := restored.GetDropAudits(); err != nil || len(audits) != 1 {
+		t.Errorf("GetDropAudits: got %v and error %v, expected a single audit", audits, err)
+	}
+	if usages, err := restored.GetUsage(); err != nil || len(usages) != 1 {
+		t.Errorf("GetUsage: got %v and error %v, expected a single project", usages, err)
+	}
+
+	// An existing database is not overwritten.
+	if _, err := RestoreSnapshot(dbDir, bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("RestoreSnapshot: got success for an existing database")
+	}
+}
+
+// Tests that invalid and truncated snapshots are rejected and leave no
+// database behind.
+func TestRestoreInvalidSnapshot(t *testing.T) {
+	store := makeLevelDBTestStore(t)
+	defer ResetStoreForTesting(store, true)
+	if err := store.AddAllObservations(MakeObservationBatches(1), NewArrival(time.Now(), "shuffler-1")); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	var buf bytes.Buffer
+	if _, err := store.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: got error %v, expected success", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("TempDir: got error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dbDir := filepath.Join(tmpDir, "observations_db")
+
+	for _, data := range [][]byte{
+		[]byte("not a snapshot"),
+		buf.Bytes()[:buf.Len()-1],
+	} {
+		_, err := RestoreSnapshot(dbDir, bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("RestoreSnapshot: got success for an invalid snapshot")
+		}
+		if _, statErr := os.Stat(dbDir); !os.IsNotExist(statErr) {
+			t.Errorf("RestoreSnapshot: the database exists after error [%v]", err)
+		}
+	}
+
+	if _, err := RestoreSnapshot(dbDir, strings.NewReader(snapshotHeader)); err != nil {
+		t.Errorf("RestoreSnapshot: got error %v for an empty snapshot", err)
+	}
+}
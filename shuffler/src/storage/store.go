@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"sort"
 	"time"
 
 	"cobalt"
@@ -28,9 +29,9 @@ import (
 type Store interface {
 	// AddAllObservations adds all of the encrypted observations in all of the
 	// ObservationBatches in |envelopeBatch| to the store. New |ObservationVal|s
-	// are created to hold the values and the given |arrivalDayIndex|. Returns a
+	// are created to hold the values and the given |arrival| metadata. Returns a
 	// non-nil error if the arguments are invalid or the operation fails.
-	AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrivalDayIndex uint32) error
+	AddAllObservations(envelopeBatch []*cobalt.ObservationBatch, arrival Arrival) error
 
 	// GetObservations returns a storage.Iterator to iterate through the shuffled
 	// list of ObservationVals from the data store for the given
@@ -41,13 +42,98 @@ type Store interface {
 	// store for the given |ObservationMmetadata| key or returns an error.
 	GetNumObservations(metadata *cobalt.ObservationMetadata) (int, error)
 
+	// GetTotalNumObservations returns the total count of ObservationVals in the
+	// data store over all |ObservationMetadata| keys or returns an error.
+	GetTotalNumObservations() (int64, error)
+
 	// GetKeys returns the list of all |ObservationMetadata| keys stored in the
 	// data store or returns an error.
 	GetKeys() ([]*cobalt.ObservationMetadata, error)
 
+	// ForEachKey invokes |f| for each |ObservationMetadata| key stored in the
+	// data store until |f| returns false. Unlike GetKeys, the keys are parsed
+	// one at a time so that they are never all held in memory at once. The
+	// store is not locked while |f| runs, so |f| may invoke other methods of the
+	// store. Keys that are added or deleted during the iteration may or may not
+	// be visited. Returns an error if a key cannot be parsed.
+	ForEachKey(f func(metadata *cobalt.ObservationMetadata) bool) error
+
 	// DeleteValues deletes the given |ObservationVal|s for |ObservationMetadata|
 	// key from the data store or returns an error.
 	DeleteValues(metadata *cobalt.ObservationMetadata, obVals []*shuffler.ObservationVal) error
+
+	// TryLease acquires or renews the lease on the bucket for the given
+	// |ObservationMetadata| key for |owner| until |ttl| has elapsed, and
+	// returns true, or returns false if another owner holds an unexpired lease
+	// on the bucket. Leases make the dispatchers of all Shufflers sharing the
+	// data store work on each bucket one at a time. A lease that is not
+	// released, e.g. because its owner crashed, expires after |ttl|.
+	TryLease(metadata *cobalt.ObservationMetadata, owner string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease releases the lease on the bucket for the given
+	// |ObservationMetadata| key if it is held by |owner|, or returns an error.
+	ReleaseLease(metadata *cobalt.ObservationMetadata, owner string) error
+
+	// AddDispatchRecord appends |record| to the DispatchHistory of the bucket
+	// for the given |ObservationMetadata| key. Only the |maxRecords| most recent
+	// records are kept. Dispatch histories are independent of the
+	// |ObservationVal|s in the data store and outlive the buckets they describe.
+	AddDispatchRecord(metadata *cobalt.ObservationMetadata, record *shuffler.DispatchRecord, maxRecords int) error
+
+	// GetDispatchHistories returns the DispatchHistories of all buckets or
+	// returns an error.
+	GetDispatchHistories() ([]*shuffler.DispatchHistory, error)
+
+	// DeleteDispatchHistory deletes the DispatchHistory of the bucket for the
+	// given |ObservationMetadata| key or returns an error.
+	DeleteDispatchHistory(metadata *cobalt.ObservationMetadata) error
+
+	// AddDropCount adds |numObservations| to the DropRecord for
+	// |arrivalDayIndex| and |reason| in the DropAudit of the bucket for the
+	// given |ObservationMetadata| key. Like dispatch histories, drop audits are
+	// independent of the |ObservationVal|s in the data store.
+	AddDropCount(metadata *cobalt.ObservationMetadata, arrivalDayIndex uint32, reason shuffler.DropRecord_Reason, numObservations uint64) error
+
+	// GetDropAudits returns the DropAudits of all buckets or returns an error.
+	GetDropAudits() ([]*shuffler.DropAudit, error)
+
+	// DeleteDropAudit deletes the DropAudit of the bucket for the given
+	// |ObservationMetadata| key or returns an error.
+	DeleteDropAudit(metadata *cobalt.ObservationMetadata) error
+
+	// AddUsage adds the counts in |record| to the UsageRecord for
+	// |record.DayIndex| in the ProjectUsage of the given project. Like drop
+	// audits, usage is independent of the |ObservationVal|s in the data store.
+	AddUsage(customerId uint32, projectId uint32, record *shuffler.UsageRecord) error
+
+	// GetUsage returns the ProjectUsages of all projects or returns an error.
+	GetUsage() ([]*shuffler.ProjectUsage, error)
+
+	// Scrub verifies the integrity of all |ObservationVal|s in the data store
+	// and deletes those that are corrupted. Returns the number of
+	// |ObservationVal|s that were checked and deleted, or an error.
+	Scrub() (numChecked int, numDeleted int, err error)
+}
+
+// Arrival describes when and where a set of Observations arrived at the
+// Shuffler.
+type Arrival struct {
+	// The day index of the arrival time in the UTC time zone.
+	DayIndex uint32
+	// The arrival time in seconds since the Unix epoch, or zero if unknown.
+	TimeSeconds int64
+	// Identifies the Shuffler instance that received the Observations.
+	ShufflerInstanceId string
+}
+
+// NewArrival returns the Arrival for Observations that arrived at time |t| at
+// the Shuffler instance identified by |shufflerInstanceId|.
+func NewArrival(t time.Time, shufflerInstanceId string) Arrival {
+	return Arrival{
+		DayIndex:           GetDayIndexUtc(t),
+		TimeSeconds:        t.Unix(),
+		ShufflerInstanceId: shufflerInstanceId,
+	}
 }
 
 // GetDayIndexUtc returns the day_index corresponding to the given Time |t|
@@ -58,17 +144,104 @@ func GetDayIndexUtc(t time.Time) uint32 {
 }
 
 // NewObservationVal constructs an ObservationVal from the given
-// |encryptedMessage|, |arrivalDayIndex| and |id| which should be a unique
-// identifier for the new |ObservationVal|. Panics if |encryptedMessage|
-// is nil.
-func NewObservationVal(encryptedMessage *cobalt.EncryptedMessage, id string, arrivalDayIndex uint32) *shuffler.ObservationVal {
+// |encryptedMessage|, |arrival| and |id| which should be a unique identifier
+// for the new |ObservationVal|. Panics if |encryptedMessage| is nil.
+func NewObservationVal(encryptedMessage *cobalt.EncryptedMessage, id string, arrival Arrival) *shuffler.ObservationVal {
 	if encryptedMessage == nil {
 		panic("invalid encrypted message")
 	}
 
 	return &shuffler.ObservationVal{
 		Id:                   id,
-		ArrivalDayIndex:      arrivalDayIndex,
+		ArrivalDayIndex:      arrival.DayIndex,
 		EncryptedObservation: encryptedMessage,
+		ArrivalTimeSeconds:   arrival.TimeSeconds,
+		ShufflerInstanceId:   arrival.ShufflerInstanceId,
+	}
+}
+
+// appendDispatchRecord appends |record| to the records of |history| and
+// discards the oldest records so that at most |maxRecords| remain.
+func appendDispatchRecord(history *shuffler.DispatchHistory, record *shuffler.DispatchRecord, maxRecords int) {
+	if maxRecords <= 0 {
+		panic("maxRecords must be positive")
+	}
+
+	history.Records = append(history.Records, record)
+	if len(history.Records) > maxRecords {
+		history.Records = history.Records[len(history.Records)-maxRecords:]
+	}
+}
+
+// addDropCount adds |numObservations| to the record of |audit| for
+// |arrivalDayIndex| and |reason|, inserting a new record in order if there is
+// none.
+func addDropCount(audit *shuffler.DropAudit, arrivalDayIndex uint32, reason shuffler.DropRecord_Reason, numObservations uint64) {
+	i := sort.Search(len(audit.Records), func(i int) bool {
+		r := audit.Records[i]
+		return r.ArrivalDayIndex > arrivalDayIndex || (r.ArrivalDayIndex == arrivalDayIndex && r.Reason >= reason)
+	})
+	if i < len(audit.Records) && audit.Records[i].ArrivalDayIndex == arrivalDayIndex && audit.Records[i].Reason == reason {
+		audit.Records[i].NumObservations += numObservations
+		return
+	}
+
+	record := &shuffler.DropRecord{
+		ArrivalDayIndex: arrivalDayIndex,
+		Reason:          reason,
+		NumObservations: numObservations,
+	}
+	audit.Records = append(audit.Records, nil)
+	copy(audit.Records[i+1:], audit.Records[i:])
+	audit.Records[i] = record
+}
+
+// addUsage adds the counts in |record| to the record of |usage| for
+// |record.DayIndex|, inserting a new record in order if there is none.
+func addUsage(usage *shuffler.ProjectUsage, record *shuffler.UsageRecord) {
+	i := sort.Search(len(usage.Records), func(i int) bool {
+		return usage.Records[i].DayIndex >= record.DayIndex
+	})
+	if i < len(usage.Records) && usage.Records[i].DayIndex == record.DayIndex {
+		r := usage.Records[i]
+		r.NumObservationsReceived += record.NumObservationsReceived
+		r.NumBytesReceived += record.NumBytesReceived
+		r.NumObservationsDispatched += record.NumObservationsDispatched
+		r.NumBytesDispatched += record.NumBytesDispatched
+		return
+	}
+
+	usage.Records = append(usage.Records, nil)
+	copy(usage.Records[i+1:], usage.Records[i:])
+	usage.Records[i] = &shuffler.UsageRecord{
+		DayIndex:                  record.DayIndex,
+		NumObservationsReceived:   record.NumObservationsReceived,
+		NumBytesReceived:          record.NumBytesReceived,
+		NumObservationsDispatched: record.NumObservationsDispatched,
+		NumBytesDispatched:        record.NumBytesDispatched,
+	}
+}
+
+// DeleteValuesInChunks deletes |obVals| from the bucket for the given
+// |ObservationMetadata| key by invoking DeleteValues on |store| for at most
+// |chunkSize| ObservationVals at a time. Deleting a large batch at once creates
+// a single large write in the LevelDBStore, which stalls concurrent writes of
+// the receiver. Returns the first error, in which case the remaining chunks
+// are not deleted.
+func DeleteValuesInChunks(store Store, metadata *cobalt.ObservationMetadata, obVals []*shuffler.ObservationVal, chunkSize int) error {
+	if chunkSize <= 0 {
+		panic("chunkSize must be positive")
+	}
+
+	for len(obVals) > 0 {
+		n := chunkSize
+		if n > len(obVals) {
+			n = len(obVals)
+		}
+		if err := store.DeleteValues(metadata, obVals[:n]); err != nil {
+			return err
+		}
+		obVals = obVals[n:]
 	}
+	return nil
 }
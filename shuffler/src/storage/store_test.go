@@ -21,7 +21,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+
 	shufflerpb "cobalt"
+	"shuffler"
 )
 
 // TestGetDayIndexUtc tests the utility function that computes day index for the
@@ -83,8 +86,9 @@ func TestNewObservationVal(t *testing.T) {
 		Scheme:     shufflerpb.EncryptedMessage_NONE,
 		Ciphertext: []byte("ciphertext"),
 	}
-	testDayIndex := uint32(17201)
-	val := NewObservationVal(eMsg, "test", testDayIndex)
+	arrivalTime := time.Date(2017, time.February, 5, 13, 30, 0, 0, time.UTC)
+	testDayIndex := uint32(17202)
+	val := NewObservationVal(eMsg, "test", NewArrival(arrivalTime, "shuffler-1"))
 	if val == nil {
 		t.Error("got empty ObservationVal")
 	}
@@ -94,6 +98,14 @@ func TestNewObservationVal(t *testing.T) {
 		t.Errorf("got day_index [%d], want day_index [%d]", val.ArrivalDayIndex, testDayIndex)
 	}
 
+	// test arrival time and shuffler instance
+	if val.ArrivalTimeSeconds != arrivalTime.Unix() {
+		t.Errorf("got arrival_time_seconds [%d], want arrival_time_seconds [%d]", val.ArrivalTimeSeconds, arrivalTime.Unix())
+	}
+	if val.ShufflerInstanceId != "shuffler-1" {
+		t.Errorf("got shuffler_instance_id [%v], want shuffler_instance_id [shuffler-1]", val.ShufflerInstanceId)
+	}
+
 	// test encrypted message
 	if eMsg != val.EncryptedObservation {
 		t.Errorf("got encrypted_message [%v], want encrypted_message [%v]", val.EncryptedObservation, eMsg)
@@ -106,19 +118,26 @@ func TestNewObservationVal(t *testing.T) {
 }
 
 // doTestAddGetAndDeleteObservations tests the Store methods
-// AddAllObservations, GetObservations, GetNumObservations, GetKeys and
-// DeleteValues.
+// AddAllObservations, GetObservations, GetNumObservations,
+// GetTotalNumObservations, GetKeys and DeleteValues.
 func doTestAddGetAndDeleteObservations(t *testing.T, store Store) {
 	const numBatches = 10
 	const arrivalDayIndex = 16
 
 	// add observations for different metrics
 	batches := MakeObservationBatches(numBatches)
-	if err := store.AddAllObservations(batches, arrivalDayIndex); err != nil {
+	if err := store.AddAllObservations(batches, Arrival{DayIndex: arrivalDayIndex}); err != nil {
 		t.Errorf("AddAllObservations: got error %v, expected success", err)
 	}
 
+	checkTotal := func(expected int) {
+		if total, err := store.GetTotalNumObservations(); err != nil || total != int64(expected) {
+			t.Errorf("GetTotalNumObservations: got (%d, %v), expected %d", total, err, expected)
+		}
+	}
+
 	var keys []*shufflerpb.ObservationMetadata
+	numVals := 0
 
 	// verify each metadata bucket
 	for _, batch := range batches {
@@ -127,9 +146,11 @@ func doTestAddGetAndDeleteObservations(t *testing.T, store Store) {
 
 		encMsgList := batch.GetEncryptedObservation()
 		CheckNumObservations(t, store, om, len(encMsgList))
+		numVals += len(encMsgList)
 
 		CheckGetObservations(t, store, om, encMsgList)
 	}
+	checkTotal(numVals)
 
 	// verify all keys
 	CheckKeys(t, store, keys)
@@ -157,6 +178,14 @@ func doTestAddGetAndDeleteObservations(t *testing.T, store Store) {
 	CheckNumObservations(t, store, om, numValsAfterDeletion)
 	CheckDeleteObservations(t, store, om, numValsAfterDeletion, deleteObVals)
 	CheckGetObservations(t, store, om, undeletedEMsgs)
+	checkTotal(numVals - len(deleteObVals))
+
+	// ObservationVals that are deleted again are not counted again.
+	if err := store.DeleteValues(om, deleteObVals); err != nil {
+		t.Errorf("DeleteValues: got error %v, expected success for deleted obVals for metadata [%v]", err, om)
+	}
+	CheckNumObservations(t, store, om, numValsAfterDeletion)
+	checkTotal(numVals - len(deleteObVals))
 }
 
 // doTestShuffle tests that the store returns shuffled observations for each
@@ -169,7 +198,7 @@ func doTestShuffle(t *testing.T, store Store) {
 	om := NewObservationMetaData(501)
 	batch := NewObservationBatchForMetadata(om, numMsgs)
 	if err := store.AddAllObservations([]*shufflerpb.ObservationBatch{batch},
-		arrivalDayIndex); err != nil {
+		Arrival{DayIndex: arrivalDayIndex}); err != nil {
 		t.Errorf("AddAllObservations: got error %v, expected success", err)
 	}
 
@@ -201,3 +230,324 @@ func doTestShuffle(t *testing.T, store Store) {
 		t.Logf("got [%v] shuffled observations out of [%d] total observations", shuffledCount, numMsgs)
 	}
 }
+
+// doTestForEachKey tests the Store method ForEachKey.
+func doTestForEachKey(t *testing.T, store Store) {
+	const numBatches = 5
+	batches := MakeObservationBatches(numBatches)
+	if err := store.AddAllObservations(batches, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+
+	// Every key is visited exactly once, and |f| may call back into the store.
+	visited := make(map[string]int)
+	err := store.ForEachKey(func(om *shufflerpb.ObservationMetadata) bool {
+		visited[proto.CompactTextString(om)]++
+		if _, err := store.GetNumObservations(om); err != nil {
+			t.Errorf("GetNumObservations: got error %v for metadata [%v]", err, om)
+		}
+		return true
+	})
+	if err != nil {
+		t.Errorf("ForEachKey: got error %v, expected success", err)
+	}
+	if len(visited) != numBatches {
+		t.Errorf("ForEachKey: visited %d keys, expected %d", len(visited), numBatches)
+	}
+	for _, batch := range batches {
+		if n := visited[proto.CompactTextString(batch.GetMetaData())]; n != 1 {
+			t.Errorf("ForEachKey: visited key [%v] %d times, expected once", batch.GetMetaData(), n)
+		}
+	}
+
+	// The iteration stops as soon as |f| returns false.
+	numCalls := 0
+	err = store.ForEachKey(func(om *shufflerpb.ObservationMetadata) bool {
+		numCalls++
+		return false
+	})
+	if err != nil {
+		t.Errorf("ForEachKey: got error %v, expected success", err)
+	}
+	if numCalls != 1 {
+		t.Errorf("ForEachKey: |f| was invoked %d times, expected once", numCalls)
+	}
+}
+
+// doTestDispatchHistory tests the Store methods AddDispatchRecord,
+// GetDispatchHistories and DeleteDispatchHistory.
+func doTestDispatchHistory(t *testing.T, store Store) {
+	const maxRecords = 3
+	om1 := NewObservationMetaData(1)
+	om2 := NewObservationMetaData(2)
+
+	for i := 1; i <= 5; i++ {
+		record := &shuffler.DispatchRecord{
+			DispatchTimeSeconds: int64(i),
+			NumObservationsSent: uint32(i),
+		}
+		if err := store.AddDispatchRecord(om1, record, maxRecords); err != nil {
+			t.Fatalf("AddDispatchRecord: got error %v, expected success", err)
+		}
+	}
+	failed := &shuffler.DispatchRecord{
+		DispatchTimeSeconds: 10,
+		Result:              shuffler.DispatchRecord_FAILED,
+		Error:               "unavailable",
+	}
+	if err := store.AddDispatchRecord(om2, failed, maxRecords); err != nil {
+		t.Fatalf("AddDispatchRecord: got error %v, expected success", err)
+	}
+
+	// Dispatch histories are not buckets.
+	CheckKeys(t, store, []*shufflerpb.ObservationMetadata{})
+
+	histories, err := store.GetDispatchHistories()
+	if err != nil {
+		t.Fatalf("GetDispatchHistories: got error %v, expected success", err)
+	}
+	if len(histories) != 2 {
+		t.Fatalf("GetDispatchHistories: got %d histories, expected 2", len(histories))
+	}
+	for _, history := range histories {
+		switch {
+		case proto.Equal(history.Bucket, om1):
+			// Only the most recent records are kept.
+			if len(history.Records) != maxRecords || history.Records[0].DispatchTimeSeconds != 3 ||
+				history.Records[maxRecords-1].DispatchTimeSeconds != 5 {
+				t.Errorf("got records %v for bucket [%v], expected records 3 to 5", history.Records, om1)
+			}
+		case proto.Equal(history.Bucket, om2):
+			if len(history.Records) != 1 || !proto.Equal(history.Records[0], failed) {
+				t.Errorf("got records %v for bucket [%v], expected [%v]", history.Records, om2, failed)
+			}
+		default:
+			t.Errorf("got unexpected bucket [%v]", history.Bucket)
+		}
+	}
+
+	if err := store.DeleteDispatchHistory(om1); err != nil {
+		t.Fatalf("DeleteDispatchHistory: got error %v, expected success", err)
+	}
+	histories, err = store.GetDispatchHistories()
+	if err != nil {
+		t.Fatalf("GetDispatchHistories: got error %v, expected success", err)
+	}
+	if len(histories) != 1 || !proto.Equal(histories[0].Bucket, om2) {
+		t.Errorf("got histories %v after deletion, expected only bucket [%v]", histories, om2)
+	}
+}
+
+// doTestDropAudit tests the Store methods AddDropCount, GetDropAudits and
+// DeleteDropAudit.
+func doTestDropAudit(t *testing.T, store Store) {
+	om1 := NewObservationMetaData(1)
+	om2 := NewObservationMetaData(2)
+
+	counts := []struct {
+		om              *shufflerpb.ObservationMetadata
+		arrivalDayIndex uint32
+		numObservations uint64
+	}{
+		{om1, 12, 3},
+		{om1, 10, 1},
+		{om1, 12, 4},
+		{om1, 11, 2},
+		{om2, 10, 5},
+	}
+	for _, c := range counts {
+		if err := store.AddDropCount(c.om, c.arrivalDayIndex, shuffler.DropRecord_RANDOM_DROP, c.numObservations); err != nil {
+			t.Fatalf("AddDropCount: got error %v, expected success", err)
+		}
+	}
+
+	// Drop audits are not buckets.
+	CheckKeys(t, store, []*shufflerpb.ObservationMetadata{})
+
+	audits, err := store.GetDropAudits()
+	if err != nil {
+		t.Fatalf("GetDropAudits: got error %v, expected success", err)
+	}
+	if len(audits) != 2 {
+		t.Fatalf("GetDropAudits: got %d audits, expected 2", len(audits))
+	}
+	for _, audit := range audits {
+		switch {
+		case proto.Equal(audit.Bucket, om1):
+			// The counts of each day are summed and the records are ordered
+			// by day.
+			expected := []*shuffler.DropRecord{
+				{ArrivalDayIndex: 10, NumObservations: 1},
+				{ArrivalDayIndex: 11, NumObservations: 2},
+				{ArrivalDayIndex: 12, NumObservations: 7},
+			}
+			if len(audit.Records) != len(expected) {
+				t.Fatalf("got records %v for bucket [%v], expected %v", audit.Records, om1, expected)
+			}
+			for i, record := range audit.Records {
+				if !proto.Equal(record, expected[i]) {
+					t.Errorf("got record [%v] at position %d for bucket [%v], expected [%v]", record, i, om1, expected[i])
+				}
+			}
+		case proto.Equal(audit.Bucket, om2):
+			if len(audit.Records) != 1 || audit.Records[0].NumObservations != 5 {
+				t.Errorf("got records %v for bucket [%v], expected a single record of 5 observations", audit.Records, om2)
+			}
+		default:
+			t.Errorf("got unexpected bucket [%v]", audit.Bucket)
+		}
+	}
+
+	if err := store.DeleteDropAudit(om1); err != nil {
+		t.Fatalf("DeleteDropAudit: got error %v, expected success", err)
+	}
+	audits, err = store.GetDropAudits()
+	if err != nil {
+		t.Fatalf("GetDropAudits: got error %v, expected success", err)
+	}
+	if len(audits) != 1 || !proto.Equal(audits[0].Bucket, om2) {
+		t.Errorf("got audits %v after deletion, expected only bucket [%v]", audits, om2)
+	}
+}
+
+// doTestUsage tests the Store methods AddUsage and GetUsage.
+func doTestUsage(t *testing.T, store Store) {
+	records := []struct {
+		customerId uint32
+		projectId  uint32
+		record     *shuffler.UsageRecord
+	}{
+		{1, 1, &shuffler.UsageRecord{DayIndex: 12, NumObservationsReceived: 3, NumBytesReceived: 300}},
+		{1, 1, &shuffler.UsageRecord{DayIndex: 10, NumObservationsReceived: 1, NumBytesReceived: 100}},
+		{1, 1, &shuffler.UsageRecord{DayIndex: 12, NumObservationsDispatched: 2, NumBytesDispatched: 200}},
+		{1, 2, &shuffler.UsageRecord{DayIndex: 10, NumObservationsReceived: 5, NumBytesReceived: 500}},
+	}
+	for _, r := range records {
+		if err := store.AddUsage(r.customerId, r.projectId, r.record); err != nil {
+			t.Fatalf("AddUsage: got error %v, expected success", err)
+		}
+	}
+
+	// Usage rows are not buckets.
+	CheckKeys(t, store, []*shufflerpb.ObservationMetadata{})
+
+	usages, err := store.GetUsage()
+	if err != nil {
+		t.Fatalf("GetUsage: got error %v, expected success", err)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("GetUsage: got %d projects, expected 2", len(usages))
+	}
+	for _, usage := range usages {
+		switch {
+		case usage.CustomerId == 1 && usage.ProjectId == 1:
+			// The counts of each day are summed and the records are ordered
+			// by day.
+			expected := []*shuffler.UsageRecord{
+				{DayIndex: 10, NumObservationsReceived: 1, NumBytesReceived: 100},
+				{DayIndex: 12, NumObservationsReceived: 3, NumBytesReceived: 300, NumObservationsDispatched: 2, NumBytesDispatched: 200},
+			}
+			if len(usage.Records) != len(expected) {
+				t.Fatalf("got records %v for project (1, 1), expected %v", usage.Records, expected)
+			}
+			for i, record := range usage.Records {
+				if !proto.Equal(record, expected[i]) {
+					t.Errorf("got record [%v] at position %d for project (1, 1), expected [%v]", record, i, expected[i])
+				}
+			}
+		case usage.CustomerId == 1 && usage.ProjectId == 2:
+			if len(usage.Records) != 1 || usage.Records[0].NumObservationsReceived != 5 {
+				t.Errorf("got records %v for project (1, 2), expected a single record of 5 observations", usage.Records)
+			}
+		default:
+			t.Errorf("got unexpected project (%d, %d)", usage.CustomerId, usage.ProjectId)
+		}
+	}
+
+	// The records passed to AddUsage are not modified.
+	if records[0].record.NumObservationsDispatched != 0 {
+		t.Errorf("AddUsage modified its argument: %v", records[0].record)
+	}
+}
+
+// chunkCountingStore is a Store that records the sizes of the DeleteValues
+// calls made on it.
+type chunkCountingStore struct {
+	Store
+	deleteSizes []int
+}
+
+func (s *chunkCountingStore) DeleteValues(om *shufflerpb.ObservationMetadata, obVals []*shuffler.ObservationVal) error {
+	s.deleteSizes = append(s.deleteSizes, len(obVals))
+	return s.Store.DeleteValues(om, obVals)
+}
+
+// doTestDeleteValuesInChunks tests that DeleteValuesInChunks deletes all
+// values in chunks of at most the given size.
+func doTestDeleteValuesInChunks(t *testing.T, store Store) {
+	const numMsgs = 25
+	om := NewObservationMetaData(601)
+	batch := NewObservationBatchForMetadata(om, numMsgs)
+	if err := store.AddAllObservations([]*shufflerpb.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	vals := CheckObservations(t, store, om, numMsgs)
+
+	// Delete all but the last value in chunks of 10.
+	countingStore := &chunkCountingStore{Store: store}
+	if err := DeleteValuesInChunks(countingStore, om, vals[:numMsgs-1], 10); err != nil {
+		t.Fatalf("DeleteValuesInChunks: got error %v, expected success", err)
+	}
+	if expected := []int{10, 10, 4}; !reflect.DeepEqual(countingStore.deleteSizes, expected) {
+		t.Errorf("DeleteValuesInChunks: got DeleteValues calls of sizes %v, expected %v", countingStore.deleteSizes, expected)
+	}
+	CheckNumObservations(t, store, om, 1)
+	CheckDeleteObservations(t, store, om, 1, vals[:numMsgs-1])
+
+	// Nothing is deleted for an empty list.
+	countingStore.deleteSizes = nil
+	if err := DeleteValuesInChunks(countingStore, om, nil, 10); err != nil {
+		t.Fatalf("DeleteValuesInChunks: got error %v, expected success", err)
+	}
+	if len(countingStore.deleteSizes) != 0 {
+		t.Errorf("DeleteValuesInChunks: got DeleteValues calls of sizes %v, expected none", countingStore.deleteSizes)
+	}
+	CheckNumObservations(t, store, om, 1)
+}
+
+// doTestLeases tests the Store methods TryLease and ReleaseLease.
+func doTestLeases(t *testing.T, store Store) {
+	om1 := NewObservationMetaData(701)
+	om2 := NewObservationMetaData(702)
+	tryLease := func(om *shufflerpb.ObservationMetadata, owner string, ttl time.Duration, expected bool) {
+		if acquired, err := store.TryLease(om, owner, ttl); err != nil || acquired != expected {
+			t.Errorf("TryLease(%v, %s): got (%v, %v), expected %v", om, owner, acquired, err, expected)
+		}
+	}
+	releaseLease := func(om *shufflerpb.ObservationMetadata, owner string) {
+		if err := store.ReleaseLease(om, owner); err != nil {
+			t.Errorf("ReleaseLease(%v, %s): got error %v, expected success", om, owner, err)
+		}
+	}
+
+	tryLease(om1, "a", time.Minute, true)
+	tryLease(om1, "b", time.Minute, false)
+	// The owner of a lease renews it, and leases on distinct buckets are
+	// independent.
+	tryLease(om1, "a", time.Minute, true)
+	tryLease(om2, "b", time.Minute, true)
+
+	// A lease is only released by its owner.
+	releaseLease(om1, "b")
+	tryLease(om1, "b", time.Minute, false)
+	releaseLease(om1, "a")
+	tryLease(om1, "b", time.Minute, true)
+	releaseLease(om1, "b")
+
+	// A lease that is not released expires.
+	tryLease(om2, "b", 50*time.Millisecond, true)
+	tryLease(om2, "a", time.Minute, false)
+	time.Sleep(100 * time.Millisecond)
+	tryLease(om2, "a", time.Minute, true)
+	releaseLease(om2, "a")
+}
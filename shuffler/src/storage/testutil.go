@@ -54,7 +54,7 @@ func MakeRandomObservationVals(numMsgs int) []*shuffler.ObservationVal {
 	var vals []*shuffler.ObservationVal
 	eMsgList := MakeRandomEncryptedMsgs(numMsgs)
 	for i := 0; i < numMsgs; i++ {
-		vals = append(vals, NewObservationVal(eMsgList[i], strconv.Itoa(i), 999))
+		vals = append(vals, NewObservationVal(eMsgList[i], strconv.Itoa(i), Arrival{DayIndex: 999}))
 	}
 
 	return vals
@@ -274,6 +274,18 @@ func ResetStoreForTesting(store Store, destroy bool) {
 		s.Reset()
 	case *LevelDBStore:
 		s.Reset(destroy)
+	case *PostgresStore:
+		if destroy {
+			s.EraseAllData()
+		}
+	case *RedisStore:
+		if destroy {
+			s.EraseAllData()
+		}
+	case *RoutingStore:
+		for _, store := range s.Stores() {
+			ResetStoreForTesting(store, destroy)
+		}
 	default:
 		panic("unsupported store type")
 	}
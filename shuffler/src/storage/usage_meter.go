@@ -0,0 +1,141 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"cobalt"
+	"shuffler"
+	"util/stackdriver"
+)
+
+const flushUsageFailed = "usage-meter-flush-failed"
+
+// usageDay identifies the UsageRecord of a project for a day.
+type usageDay struct {
+	tenant   Tenant
+	dayIndex uint32
+}
+
+// A UsageMeter counts the Observations of each project that the Shuffler
+// receives and dispatches, and the total size of their ciphertexts, so that
+// the cost of shared Shuffler infrastructure can be attributed to projects.
+// The counts are accumulated in memory and added to the ProjectUsages in the
+// store by Flush(), so that metering does not add a write to the store for
+// every request.
+type UsageMeter struct {
+	store Store
+
+	mu      sync.Mutex
+	pending map[usageDay]*shuffler.UsageRecord
+}
+
+// NewUsageMeter returns a UsageMeter that flushes the counts to |store|.
+func NewUsageMeter(store Store) *UsageMeter {
+	if store == nil {
+		panic("store is nil")
+	}
+
+	return &UsageMeter{
+		store:   store,
+		pending: make(map[usageDay]*shuffler.UsageRecord),
+	}
+}
+
+// AddReceived counts the Observations of |batches| as received on the day
+// with index |dayIndex|.
+func (m *UsageMeter) AddReceived(batches []*cobalt.ObservationBatch, dayIndex uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, batch := range batches {
+		record := m.record(tenantOf(batch.GetMetaData()), dayIndex)
+		for _, o := range batch.GetEncryptedObservation() {
+			record.NumObservationsReceived++
+			record.NumBytesReceived += uint64(len(o.GetCiphertext()))
+		}
+	}
+}
+
+// AddDispatched counts the Observations of |batch| as dispatched on the day
+// with index |dayIndex|.
+func (m *UsageMeter) AddDispatched(batch *cobalt.ObservationBatch, dayIndex uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record := m.record(tenantOf(batch.GetMetaData()), dayIndex)
+	for _, o := range batch.GetEncryptedObservation() {
+		record.NumObservationsDispatched++
+		record.NumBytesDispatched += uint64(len(o.GetCiphertext()))
+	}
+}
+
+// tenantOf returns the Tenant of the project of |om|.
+func tenantOf(om *cobalt.ObservationMetadata) Tenant {
+	return Tenant{om.GetCustomerId(), om.GetProjectId()}
+}
+
+// record returns the pending UsageRecord for |tenant| and the day with index
+// |dayIndex|. The caller must hold |m.mu|.
+func (m *UsageMeter) record(tenant Tenant, dayIndex uint32) *shuffler.UsageRecord {
+	day := usageDay{tenant, dayIndex}
+	record, ok := m.pending[day]
+	if !ok {
+		record = &shuffler.UsageRecord{DayIndex: dayIndex}
+		m.pending[day] = record
+	}
+	return record
+}
+
+// Flush adds the pending counts to the store. The counts that could not be
+// added are kept and retried by the next Flush(). Returns the first error.
+func (m *UsageMeter) Flush() error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[usageDay]*shuffler.UsageRecord)
+	m.mu.Unlock()
+
+	var firstErr error
+	for day, record := range pending {
+		err := m.store.AddUsage(day.tenant.CustomerId, day.tenant.ProjectId, record)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		m.mu.Lock()
+		restored := m.record(day.tenant, day.dayIndex)
+		restored.NumObservationsReceived += record.NumObservationsReceived
+		restored.NumBytesReceived += record.NumBytesReceived
+		restored.NumObservationsDispatched += record.NumObservationsDispatched
+		restored.NumBytesDispatched += record.NumBytesDispatched
+		m.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Run flushes the pending counts to the store every |interval|. It blocks
+// forever.
+func (m *UsageMeter) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := m.Flush(); err != nil {
+			stackdriver.LogCountMetricf(flushUsageFailed, "Unable to add the usage counts to the store: %v", err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"cobalt"
+	"shuffler"
+)
+
+// failingUsageStore is a Store whose AddUsage fails while |fail| is set.
+type failingUsageStore struct {
+	Store
+	fail bool
+}
+
+func (s *failingUsageStore) AddUsage(customerId uint32, projectId uint32, record *shuffler.UsageRecord) error {
+	if s.fail {
+		return errors.New("AddUsage failed")
+	}
+	return s.Store.AddUsage(customerId, projectId, record)
+}
+
+func makeUsageTestBatch(customerId uint32, projectId uint32, ciphertextSizes ...int) *cobalt.ObservationBatch {
+	batch := &cobalt.ObservationBatch{
+		MetaData: &cobalt.ObservationMetadata{CustomerId: customerId, ProjectId: projectId, MetricId: 1},
+	}
+	for _, size := range ciphertextSizes {
+		batch.EncryptedObservation = append(batch.EncryptedObservation, &cobalt.EncryptedMessage{Ciphertext: make([]byte, size)})
+	}
+	return batch
+}
+
+// Tests that the counts of a UsageMeter are added to the store by Flush() and
+// kept if the store fails.
+func TestUsageMeter(t *testing.T) {
+	store := &failingUsageStore{Store: NewMemStore()}
+	m := NewUsageMeter(store)
+
+	m.AddReceived([]*cobalt.ObservationBatch{
+		makeUsageTestBatch(1, 1, 10, 20),
+		makeUsageTestBatch(1, 1, 30),
+		makeUsageTestBatch(1, 2, 5),
+	}, 100)
+	m.AddDispatched(makeUsageTestBatch(1, 1, 10, 20), 101)
+
+	store.fail = true
+	if err := m.Flush(); err == nil {
+		t.Errorf("Flush: got success, expected an error from the store")
+	}
+	if usages, _ := store.GetUsage(); len(usages) != 0 {
+		t.Errorf("got usage %v after a failed Flush(), expected none", usages)
+	}
+
+	m.AddReceived([]*cobalt.ObservationBatch{makeUsageTestBatch(1, 2, 5)}, 100)
+	store.fail = false
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush: got error %v, expected success", err)
+	}
+
+	usages, err := store.GetUsage()
+	if err != nil {
+		t.Fatalf("GetUsage: got error %v, expected success", err)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("GetUsage: got %d projects, expected 2", len(usages))
+	}
+	expected := map[Tenant][]*shuffler.UsageRecord{
+		{1, 1}: {
+			{DayIndex: 100, NumObservationsReceived: 3, NumBytesReceived: 60},
+			{DayIndex: 101, NumObservationsDispatched: 2, NumBytesDispatched: 30},
+		},
+		{1, 2}: {
+			{DayIndex: 100, NumObservationsReceived: 2, NumBytesReceived: 10},
+		},
+	}
+	for _, usage := range usages {
+		records := expected[Tenant{usage.CustomerId, usage.ProjectId}]
+		if len(usage.Records) != len(records) {
+			t.Fatalf("got records %v for project (%d, %d), expected %v", usage.Records, usage.CustomerId, usage.ProjectId, records)
+		}
+		for i, record := range usage.Records {
+			if !proto.Equal(record, records[i]) {
+				t.Errorf("got record [%v] for project (%d, %d), expected [%v]", record, usage.CustomerId, usage.ProjectId, records[i])
+			}
+		}
+	}
+
+	// Nothing is pending after a successful Flush().
+	if err := m.Flush(); err != nil {
+		t.Fatalf("Flush: got error %v, expected success", err)
+	}
+	if usages, _ := store.GetUsage(); len(usages) != 2 || len(usages[0].Records)+len(usages[1].Records) != 3 {
+		t.Errorf("got usage %v after flushing nothing", usages)
+	}
+}
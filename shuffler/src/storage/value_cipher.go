@@ -0,0 +1,109 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"shuffler"
+	"util"
+)
+
+// If a LevelDBStore has an encryption key, the rows holding an ObservationVal
+// have values of the form <encryptedMarker><nonce><ciphertext>, where the
+// ciphertext is the value described in checksum.go encrypted with
+// util.SymmetricCipher under the random nonce, with the key of the row as the
+// associated data. The key of a row is made up of the BKey of its bucket and
+// the id of its ObservationVal, so that a value only decrypts in the row it was
+// written to. The marker is told apart from
+// the other values by the first byte, as checksumMarker is: the serialization
+// of a protocol buffer never starts with it since it encodes the field number
+// zero.
+const encryptedMarker = 0x01
+
+// valueCipher encrypts and decrypts the values of the rows holding an
+// ObservationVal.
+type valueCipher struct {
+	cipher *util.SymmetricCipher
+}
+
+// newValueCipher returns a valueCipher using |key|, which must be 16 bytes
+// long, or an error.
+func newValueCipher(key []byte) (*valueCipher, error) {
+	cipher, err := util.NewSymmetricCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &valueCipher{cipher: cipher}, nil
+}
+
+// encrypt returns |val|, the value of the row with key |rowKey|, encrypted
+// under a new random nonce.
+func (c *valueCipher) encrypt(rowKey []byte, val []byte) ([]byte, error) {
+	nonce := make([]byte, util.SymmetricCipherNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext, err := c.cipher.Encrypt(val, nonce, rowKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, 0, 1+len(nonce)+len(ciphertext))
+	encrypted = append(encrypted, encryptedMarker)
+	encrypted = append(encrypted, nonce...)
+	return append(encrypted, ciphertext...), nil
+}
+
+// decrypt returns the value encrypted in |encrypted|, the value of the row with
+// key |rowKey|, or an error if it was not encrypted with the key of |c| for
+// that row or has been tampered with.
+func (c *valueCipher) decrypt(rowKey []byte, encrypted []byte) ([]byte, error) {
+	if len(encrypted) < 1+util.SymmetricCipherNonceSize {
+		return nil, fmt.Errorf("truncated encrypted value")
+	}
+	nonce := encrypted[1 : 1+util.SymmetricCipherNonceSize]
+	val, err := c.cipher.Decrypt(encrypted[1+util.SymmetricCipherNonceSize:], nonce, rowKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the value: %v", err)
+	}
+	return val, nil
+}
+
+// isEncrypted returns true if |val| is an encrypted value.
+func isEncrypted(val []byte) bool {
+	return len(val) > 0 && val[0] == encryptedMarker
+}
+
+// parseStoredVal returns the ObservationVal in |val|, the value of the row with
+// key |rowKey| holding an ObservationVal, decrypting it with |c| first if it
+// is encrypted.
+// Values that are not encrypted are parsed as they are even if |c| is not nil,
+// so that the rows written before encryption was enabled remain readable. An
+// error is returned if the value is corrupted, or if it is encrypted and |c|
+// is nil.
+func parseStoredVal(rowKey []byte, val []byte, c *valueCipher) (*shuffler.ObservationVal, error) {
+	if isEncrypted(val) {
+		if c == nil {
+			return nil, fmt.Errorf("the value is encrypted but there is no encryption key")
+		}
+		var err error
+		if val, err = c.decrypt(rowKey, val); err != nil {
+			return nil, err
+		}
+	}
+	return parseDBVal(val)
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"cobalt"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef")
+
+// makeEncryptedLevelDBTestStore creates a LevelDBStore whose Observations are
+// encrypted with |key|.
+func makeEncryptedLevelDBTestStore(t *testing.T, key []byte) *LevelDBStore {
+	options := DefaultLevelDBOptions()
+	options.EncryptionKey = key
+	s, err := NewLevelDBStoreWithOptions("/tmp/shuffler_db", NewSecureShuffleStrategy(), 0, options)
+	if err != nil {
+		t.Fatalf("Failed to create a persistent store instance: %v", err)
+	}
+	return s
+}
+
+// Tests that an encrypted value is decrypted with the same key and in the same
+// row only.
+func TestValueCipher(t *testing.T) {
+	c, err := newValueCipher(testEncryptionKey)
+	if err != nil {
+		t.Fatalf("newValueCipher: got error %v", err)
+	}
+	rowKey := []byte(makeupRowKey("bucket", "id"))
+	val := []byte("some value")
+	encrypted, err := c.encrypt(rowKey, val)
+	if err != nil {
+		t.Fatalf("encrypt: got error %v", err)
+	}
+	if !isEncrypted(encrypted) || bytes.Contains(encrypted, val) {
+		t.Errorf("got %v, expected an encrypted value", encrypted)
+	}
+	if again, _ := c.encrypt(rowKey, val); bytes.Equal(again, encrypted) {
+		t.Errorf("got the same encrypted value twice, expected a random nonce")
+	}
+	if decrypted, err := c.decrypt(rowKey, encrypted); err != nil || !bytes.Equal(decrypted, val) {
+		t.Errorf("decrypt: got (%v, %v), expected (%v, nil)", decrypted, err, val)
+	}
+	for _, otherRowKey := range []string{makeupRowKey("bucket", "other"), makeupRowKey("other", "id")} {
+		if _, err := c.decrypt([]byte(otherRowKey), encrypted); err == nil {
+			t.Errorf("decrypt in the row [%s]: got success, expected an error", otherRowKey)
+		}
+	}
+
+	other, _ := newValueCipher([]byte("fedcba9876543210"))
+	if _, err := other.decrypt(rowKey, encrypted); err == nil {
+		t.Errorf("decrypt with another key: got success, expected an error")
+	}
+	if _, err := c.decrypt(rowKey, encrypted[:5]); err == nil {
+		t.Errorf("decrypt of a truncated value: got success, expected an error")
+	}
+	if _, err := newValueCipher([]byte("short")); err == nil {
+		t.Errorf("newValueCipher with a short key: got success, expected an error")
+	}
+}
+
+func TestAddGetAndDeleteObservationsForEncryptedLevelDBStore(t *testing.T) {
+	s := makeEncryptedLevelDBTestStore(t, testEncryptionKey)
+	doTestAddGetAndDeleteObservations(t, s)
+	ResetStoreForTesting(s, true)
+}
+
+// Tests that the Observations of an encrypted LevelDBStore are encrypted on
+// disk, and that the store cannot be opened without its key.
+func TestEncryptedLevelDBStore(t *testing.T) {
+	s := makeEncryptedLevelDBTestStore(t, testEncryptionKey)
+	const numMsgs = 5
+	om := NewObservationMetaData(801)
+	batch := NewObservationBatchForMetadata(om, numMsgs)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	for _, obVal := range CheckObservations(t, s, om, numMsgs) {
+		rowKey, err := RowKeyFromMetadata(om, obVal.Id)
+		if err != nil {
+			t.Fatalf("RowKeyFromMetadata: got error %v", err)
+		}
+		val, err := s.db.Get([]byte(rowKey), nil)
+		if err != nil {
+			t.Fatalf("Get: got error %v", err)
+		}
+		if !isEncrypted(val) || bytes.Contains(val, obVal.EncryptedObservation.Ciphertext) {
+			t.Errorf("got row [%v], expected it to be encrypted", val)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: got error %v, expected success", err)
+	}
+
+	if _, err := NewLevelDBStore("/tmp/shuffler_db"); err == nil {
+		t.Errorf("NewLevelDBStore without a key: got success, expected an error")
+	}
+	if _, err := NewLevelDBStoreWithOptions("/tmp/shuffler_db", NewSecureShuffleStrategy(), 0, LevelDBOptions{EncryptionKey: []byte("fedcba9876543210")}); err == nil {
+		t.Errorf("NewLevelDBStoreWithOptions with another key: got success, expected an error")
+	}
+
+	s = makeEncryptedLevelDBTestStore(t, testEncryptionKey)
+	defer ResetStoreForTesting(s, true)
+	CheckNumObservations(t, s, om, numMsgs)
+	if numChecked, numDeleted, err := s.Scrub(); err != nil || numChecked != numMsgs || numDeleted != 0 {
+		t.Errorf("Scrub: got (%d, %d, %v), expected (%d, 0, nil)", numChecked, numDeleted, err, numMsgs)
+	}
+	CheckObservations(t, s, om, numMsgs)
+}
+
+// Tests that an encrypted Observation copied on disk into another bucket is
+// not read from that bucket, and is deleted by Scrub().
+func TestEncryptedLevelDBStoreTransplantedObservation(t *testing.T) {
+	s := makeEncryptedLevelDBTestStore(t, testEncryptionKey)
+	defer ResetStoreForTesting(s, true)
+	const numMsgs = 3
+	om := NewObservationMetaData(803)
+	otherOm := NewObservationMetaData(804)
+	for _, m := range []*cobalt.ObservationMetadata{om, otherOm} {
+		if err := s.AddAllObservations([]*cobalt.ObservationBatch{NewObservationBatchForMetadata(m, numMsgs)}, Arrival{DayIndex: 1}); err != nil {
+			t.Fatalf("AddAllObservations: got error %v, expected success", err)
+		}
+	}
+
+	// Copy the value of a row of |om| into a row of |otherOm| with the same id,
+	// and into another row of |om|.
+	obVals := CheckObservations(t, s, om, numMsgs)
+	rowKey, err := RowKeyFromMetadata(om, obVals[0].Id)
+	if err != nil {
+		t.Fatalf("RowKeyFromMetadata: got error %v", err)
+	}
+	val, err := s.db.Get([]byte(rowKey), nil)
+	if err != nil {
+		t.Fatalf("Get: got error %v", err)
+	}
+	otherRowKey, err := RowKeyFromMetadata(otherOm, obVals[0].Id)
+	if err != nil {
+		t.Fatalf("RowKeyFromMetadata: got error %v", err)
+	}
+	sameBucketRowKey, err := RowKeyFromMetadata(om, obVals[1].Id)
+	if err != nil {
+		t.Fatalf("RowKeyFromMetadata: got error %v", err)
+	}
+	for _, key := range []string{otherRowKey, sameBucketRowKey} {
+		if err := s.db.Put([]byte(key), val, nil); err != nil {
+			t.Fatalf("Put: got error %v", err)
+		}
+	}
+
+	CheckObservations(t, s, om, numMsgs-1)
+	for _, obVal := range CheckObservations(t, s, otherOm, numMsgs) {
+		if obVal.Id == obVals[0].Id {
+			t.Errorf("got the transplanted ObservationVal %v in bucket [%v]", obVal, otherOm)
+		}
+	}
+	if numChecked, numDeleted, err := s.Scrub(); err != nil || numChecked != 2*numMsgs+1 || numDeleted != 2 {
+		t.Errorf("Scrub: got (%d, %d, %v), expected (%d, 2, nil)", numChecked, numDeleted, err, 2*numMsgs+1)
+	}
+}
+
+// Tests that the Observations written before encryption was enabled remain
+// readable.
+func TestEnableLevelDBStoreEncryption(t *testing.T) {
+	s := makeLevelDBTestStore(t)
+	om := NewObservationMetaData(802)
+	batch := NewObservationBatchForMetadata(om, 3)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: got error %v, expected success", err)
+	}
+
+	s = makeEncryptedLevelDBTestStore(t, testEncryptionKey)
+	defer ResetStoreForTesting(s, true)
+	batch = NewObservationBatchForMetadata(om, 4)
+	if err := s.AddAllObservations([]*cobalt.ObservationBatch{batch}, Arrival{DayIndex: 1}); err != nil {
+		t.Fatalf("AddAllObservations: got error %v, expected success", err)
+	}
+	CheckNumObservations(t, s, om, 7)
+	CheckObservations(t, s, om, 7)
+}
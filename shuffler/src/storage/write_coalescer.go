@@ -0,0 +1,125 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+)
+
+// dbRow is a single row to be written to the LevelDB database.
+type dbRow struct {
+	key []byte
+	val []byte
+}
+
+// pendingWrite holds the rows written by a single invocation of
+// AddAllObservations() until they are committed.
+type pendingWrite struct {
+	rows []dbRow
+
+	// The number of rows added to each bucket, keyed by BKey.
+	bucketSizes map[string]int64
+
+	// The total size in bytes of the keys and values of |rows|.
+	numBytes int
+
+	// Receives the result of the commit.
+	done chan error
+}
+
+// newPendingWrite returns an empty pendingWrite.
+func newPendingWrite() *pendingWrite {
+	return &pendingWrite{
+		bucketSizes: make(map[string]int64),
+		done:        make(chan error, 1),
+	}
+}
+
+// add appends a row with |key| and |val| for the bucket |bKey| to |w|.
+func (w *pendingWrite) add(bKey string, key []byte, val []byte) {
+	w.rows = append(w.rows, dbRow{key, val})
+	w.bucketSizes[bKey]++
+	w.numBytes += len(key) + len(val)
+}
+
+// writeCoalescer groups the pendingWrites submitted concurrently within a
+// short window so that they are committed with a single synced write. Syncing
+// dominates the cost of small writes, so under high ingest this trades a
+// bounded amount of latency for throughput.
+//
+// The group is committed once |maxDelay| has passed since its first
+// pendingWrite was submitted or once it holds at least |maxBytes| bytes,
+// whichever happens first. Since a group is committed atomically, either all
+// of its pendingWrites succeed or all of them receive the error.
+type writeCoalescer struct {
+	maxDelay time.Duration
+	maxBytes int
+
+	// commit writes a group of pendingWrites to the database.
+	commit func(writes []*pendingWrite) error
+
+	requests chan *pendingWrite
+}
+
+// newWriteCoalescer returns a writeCoalescer that commits groups using
+// |commit| and starts its goroutine.
+func newWriteCoalescer(maxDelay time.Duration, maxBytes int, commit func(writes []*pendingWrite) error) *writeCoalescer {
+	if commit == nil {
+		panic("commit is nil")
+	}
+
+	c := &writeCoalescer{
+		maxDelay: maxDelay,
+		maxBytes: maxBytes,
+		commit:   commit,
+		requests: make(chan *pendingWrite),
+	}
+	go c.run()
+	return c
+}
+
+// submit adds |w| to the current group and blocks until the group has been
+// committed. It returns the result of the commit.
+func (c *writeCoalescer) submit(w *pendingWrite) error {
+	c.requests <- w
+	return <-w.done
+}
+
+// run collects and commits groups of pendingWrites. It never returns.
+func (c *writeCoalescer) run() {
+	for {
+		first := <-c.requests
+		group := []*pendingWrite{first}
+		numBytes := first.numBytes
+
+		timer := time.NewTimer(c.maxDelay)
+	collect:
+		for c.maxBytes <= 0 || numBytes < c.maxBytes {
+			select {
+			case w := <-c.requests:
+				group = append(group, w)
+				numBytes += w.numBytes
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		err := c.commit(group)
+		for _, w := range group {
+			w.done <- err
+		}
+	}
+}
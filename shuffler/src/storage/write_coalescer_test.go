@@ -0,0 +1,95 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// submitConcurrently submits |n| pendingWrites of a single 10 byte row each
+// to |c| concurrently and returns the errors returned by submit().
+func submitConcurrently(c *writeCoalescer, n int) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := newPendingWrite()
+			w.add("bucket", []byte("key01"), []byte("val01"))
+			errs[i] = c.submit(w)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestWriteCoalescerGroupsWrites(t *testing.T) {
+	var mu sync.Mutex
+	var groupSizes []int
+	commit := func(writes []*pendingWrite) error {
+		mu.Lock()
+		defer mu.Unlock()
+		groupSizes = append(groupSizes, len(writes))
+		return nil
+	}
+
+	// A long delay lets all writes join a few groups.
+	c := newWriteCoalescer(time.Second, 0, commit)
+	for _, err := range submitConcurrently(c, 20) {
+		if err != nil {
+			t.Errorf("submit() failed: %v", err)
+		}
+	}
+	total := 0
+	for _, n := range groupSizes {
+		total += n
+	}
+	if total != 20 || len(groupSizes) >= 20 {
+		t.Errorf("got group sizes %v, expected 20 writes in fewer than 20 groups", groupSizes)
+	}
+
+	// A group is committed as soon as it reaches the size limit.
+	groupSizes = nil
+	c = newWriteCoalescer(time.Hour, 10, commit)
+	submitConcurrently(c, 5)
+	if len(groupSizes) != 5 {
+		t.Errorf("got group sizes %v, expected 5 groups of a single write", groupSizes)
+	}
+}
+
+func TestWriteCoalescerPropagatesErrors(t *testing.T) {
+	c := newWriteCoalescer(10*time.Millisecond, 0, func(writes []*pendingWrite) error {
+		return fmt.Errorf("disk full")
+	})
+	for _, err := range submitConcurrently(c, 5) {
+		if err == nil {
+			t.Errorf("submit() succeeded, expected an error")
+		}
+	}
+}
+
+func TestPendingWrite(t *testing.T) {
+	w := newPendingWrite()
+	w.add("a", []byte("k1"), []byte("value"))
+	w.add("a", []byte("k2"), []byte("value"))
+	w.add("b", []byte("k3"), []byte("v"))
+	if len(w.rows) != 3 || w.bucketSizes["a"] != 2 || w.bucketSizes["b"] != 1 || w.numBytes != 17 {
+		t.Errorf("got rows %v, bucket sizes %v and %d bytes", w.rows, w.bucketSizes, w.numBytes)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// Version and Commit identify the build of the Shuffler binary so that
+// operators can tell which binary is running where. They are set at link
+// time, for example with
+//
+//	go build -ldflags "-X util.Version=1.2.0 -X util.Commit=$(git rev-parse HEAD)"
+var (
+	Version = "unknown"
+	Commit  = "unknown"
+)
+
+// StartTime is the time at which the process started.
+var StartTime = time.Now()
+
+// BuildInfo returns a human-readable description of the build of the binary.
+func BuildInfo() string {
+	return fmt.Sprintf("version %s, commit %s", Version, Commit)
+}
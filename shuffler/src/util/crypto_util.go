@@ -19,6 +19,7 @@ import (
 	"crypto/cipher"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"fmt"
 	"io"
@@ -40,6 +41,10 @@ const symmetricCipherKeySize = 128 / 8
 // symmetricCipherNonceSize is the size in bytes of the nonce used by SymmetricCipher.
 const symmetricCipherNonceSize = 96 / 8
 
+// SymmetricCipherNonceSize is the size in bytes of the nonces passed to
+// SymmetricCipher.Encrypt() and SymmetricCipher.Decrypt().
+const SymmetricCipherNonceSize = symmetricCipherNonceSize
+
 const hybridCipherSaltSize = 128 / 8 // Salt for HKDF
 
 var allZeroNonce []byte
@@ -83,11 +88,13 @@ func NewSymmetricCipher(key []byte) (*SymmetricCipher, error) {
 // SymmetricCipher. |nonce| must have length |symmetricCipherNonceSize|. It is
 // essential that the same (key, nonce) pair never be used to encrypt two
 // different plain texts. If re-using the same key multiple times you *must*
-// change the nonce or the resulting encryption will not be secure. Returns
-// encrypted |ciphertext| on success or an error on failure.
+// change the nonce or the resulting encryption will not be secure.
+// |associatedData|, which may be nil, is authenticated but not encrypted: the
+// same data must be passed to Decrypt(). Returns encrypted |ciphertext| on
+// success or an error on failure.
 //
 // Panics if SymmetricCipher |c| is nil.
-func (c *SymmetricCipher) Encrypt(plaintext []byte, nonce []byte) (ciphertext []byte, err error) {
+func (c *SymmetricCipher) Encrypt(plaintext []byte, nonce []byte, associatedData []byte) (ciphertext []byte, err error) {
 	if c == nil {
 		panic("SymmetricCipher is nil")
 	}
@@ -107,16 +114,17 @@ func (c *SymmetricCipher) Encrypt(plaintext []byte, nonce []byte) (ciphertext []
 		return
 	}
 
-	ciphertext = c.aesgcm.Seal(nil, nonce, plaintext, nil)
+	ciphertext = c.aesgcm.Seal(nil, nonce, plaintext, associatedData)
 	return
 }
 
 // Decrypt performs AEAD decryption on the given |ciphertext| using
-// SymmetricCipher. |nonce| must have length |symmetricCipherNonceSize|.Returns
-// decrypted |plaintext| on success or an error on failure.
+// SymmetricCipher. |nonce| must have length |symmetricCipherNonceSize|.
+// Decryption fails unless |associatedData| is the data passed to Encrypt().
+// Returns decrypted |plaintext| on success or an error on failure.
 //
 // Panics if SymmetricCipher |c| is nil.
-func (c *SymmetricCipher) Decrypt(ciphertext []byte, nonce []byte) (plaintext []byte, err error) {
+func (c *SymmetricCipher) Decrypt(ciphertext []byte, nonce []byte, associatedData []byte) (plaintext []byte, err error) {
 	if c == nil {
 		panic("SymmetricCipher is nil")
 	}
@@ -136,7 +144,7 @@ func (c *SymmetricCipher) Decrypt(ciphertext []byte, nonce []byte) (plaintext []
 		return
 	}
 
-	plaintext, err = c.aesgcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err = c.aesgcm.Open(nil, nonce, ciphertext, associatedData)
 	return
 }
 
@@ -192,6 +200,19 @@ func NewHybridCipher(privateKey, publicKey []byte) *HybridCipher {
 	}
 }
 
+// publicKeyFingerprint returns the SHA256 fingerprint of the public key of
+// this HybridCipher, or nil if it has no public key. As in the C++
+// HybridCipher, the fingerprint is the hash of the compressed X9.62
+// serialization of the public key. The Encoder sends it in the
+// |public_key_fingerprint| field of EncryptedMessage.
+func (c *HybridCipher) publicKeyFingerprint() []byte {
+	if c.publicKeyX == nil || c.publicKeyY == nil {
+		return nil
+	}
+	fingerprint := sha256.Sum256(MarshalCompressed(ellipticCurve, c.publicKeyX, c.publicKeyY))
+	return fingerprint[:]
+}
+
 // generateECKey generates a new key pair of the form
 // (privateKey, publicKey) = (alpha, g^alpha). Here g^alpha is an element of
 // the elliptic curve group, g is a generator of the group, and alpha is
@@ -270,7 +291,7 @@ func (c *HybridCipher) Encrypt(plaintext []byte) (hybridCiphertext []byte, err e
 
 	// For hybrid mode, we can fix the nonce to all zeroes without losing
 	// security. See: https://goto.google.com/aes-gcm-zero-nonce-security
-	symmetricCiphertext, err := symmetricCipher.Encrypt(plaintext, allZeroNonce)
+	symmetricCiphertext, err := symmetricCipher.Encrypt(plaintext, allZeroNonce, nil)
 	if err != nil {
 		return
 	}
@@ -319,6 +340,6 @@ func (c *HybridCipher) Decrypt(hybridCiphertext []byte) (plaintext []byte, err e
 	if err != nil {
 		return
 	}
-	plaintext, err = symmetricCipher.Decrypt(symmetricCiphertext, allZeroNonce)
+	plaintext, err = symmetricCipher.Decrypt(symmetricCiphertext, allZeroNonce, nil)
 	return
 }
@@ -56,7 +56,7 @@ func TestSymmetricCipher(t *testing.T) {
 		}
 
 		// test encrypt
-		ciphertext, err := c.Encrypt(plaintext, nonce)
+		ciphertext, err := c.Encrypt(plaintext, nonce, nil)
 		if err != nil {
 			t.Errorf("got encryption error:%v", err)
 			return
@@ -67,7 +67,7 @@ func TestSymmetricCipher(t *testing.T) {
 		}
 
 		// test decrypt
-		decryptedtext, err := c.Decrypt(ciphertext, nonce)
+		decryptedtext, err := c.Decrypt(ciphertext, nonce, nil)
 		if err != nil {
 			t.Errorf("got decryption error:%v", err)
 			return
@@ -79,6 +79,28 @@ func TestSymmetricCipher(t *testing.T) {
 	}
 }
 
+func TestSymmetricCipherAssociatedData(t *testing.T) {
+	c, err := NewSymmetricCipher([]byte("AES256Key-16Char"))
+	if err != nil {
+		t.Fatalf("Unable to initialize test SymmetricCipher: %v", err)
+	}
+	plaintext := []byte("plaintext")
+	nonce := make([]byte, SymmetricCipherNonceSize)
+
+	ciphertext, err := c.Encrypt(plaintext, nonce, []byte("bucket-1"))
+	if err != nil {
+		t.Fatalf("got encryption error: %v", err)
+	}
+	if decryptedtext, err := c.Decrypt(ciphertext, nonce, []byte("bucket-1")); err != nil || string(decryptedtext) != string(plaintext) {
+		t.Errorf("got (%s, %v) after decryption, want %s", decryptedtext, err, plaintext)
+	}
+	for _, associatedData := range [][]byte{nil, []byte("bucket-2")} {
+		if _, err := c.Decrypt(ciphertext, nonce, associatedData); err == nil {
+			t.Errorf("decryption with the associated data [%s] succeeded, want an error", associatedData)
+		}
+	}
+}
+
 func TestHybridCipher(t *testing.T) {
 	privateKey, publicKey, _, _, err := generateECKey()
 	if err != nil {
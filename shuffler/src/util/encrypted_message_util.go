@@ -15,6 +15,8 @@
 package util
 
 import (
+	"encoding/hex"
+
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
@@ -40,8 +42,14 @@ const (
 // EncryptedMessageMaker is used only in tests. The C++ version of EncryptedMessageMaker
 // is used by the Encoder client to build EncryptedMessages to send to the Shuffler
 // and the Analyzer.
+//
+// An EncryptedMessageMaker may have multiple recipients. This allows test tools
+// and the forwarding path to address both the current and the next Shuffler or
+// Analyzer during key or topology transitions.
 type EncryptedMessageMaker struct {
-	hybridCipher     *HybridCipher
+	// One HybridCipher per recipient. The entries are nil if
+	// |encryptionScheme| is EncryptedMessage_NONE.
+	hybridCiphers    []*HybridCipher
 	encryptionScheme cobalt.EncryptedMessage_EncryptionScheme
 }
 
@@ -64,31 +72,94 @@ type EncryptedMessageMaker struct {
 // encoding of a public key appropriate for that scheme.
 func NewEncryptedMessageMaker(publicKeyPem string,
 	scheme cobalt.EncryptedMessage_EncryptionScheme) *EncryptedMessageMaker {
-	var cipher *HybridCipher
+	return NewMultiRecipientEncryptedMessageMaker([]string{publicKeyPem}, scheme)
+}
+
+// Constructs and returns a new EncryptedMessageMaker with one recipient per
+// element of |publicKeyPems|, or nil if |publicKeyPems| is empty or if any of
+// its elements cannot be parsed. See NewEncryptedMessageMaker for the meaning
+// of |scheme|.
+func NewMultiRecipientEncryptedMessageMaker(publicKeyPems []string,
+	scheme cobalt.EncryptedMessage_EncryptionScheme) *EncryptedMessageMaker {
+	if len(publicKeyPems) == 0 {
+		stackdriver.LogCountMetricln(newEncryptedMessageMakerFailed, "No recipients specified.")
+		return nil
+	}
+	ciphers := make([]*HybridCipher, len(publicKeyPems))
 	if scheme == cobalt.EncryptedMessage_HYBRID_ECDH_V1 {
-		publicKey, err := ParseECPublicKeyPem(publicKeyPem)
-		if err != nil {
-			stackdriver.LogCountMetricf(newEncryptedMessageMakerFailed, "Failed to decode public key PEM: %v.", err)
-			return nil
-		}
-		cipher = NewHybridCipher(nil, publicKey)
-		if cipher == nil {
-			stackdriver.LogCountMetricln(newEncryptedMessageMakerFailed, "Failed to construct a HybridCipher.")
-			return nil
+		for i, publicKeyPem := range publicKeyPems {
+			publicKey, err := ParseECPublicKeyPem(publicKeyPem)
+			if err != nil {
+				stackdriver.LogCountMetricf(newEncryptedMessageMakerFailed, "Failed to decode public key PEM of recipient %d: %v.", i, err)
+				return nil
+			}
+			ciphers[i] = NewHybridCipher(nil, publicKey)
+			if ciphers[i] == nil {
+				stackdriver.LogCountMetricln(newEncryptedMessageMakerFailed, "Failed to construct a HybridCipher.")
+				return nil
+			}
 		}
 	}
 	return &EncryptedMessageMaker{
-		hybridCipher:     cipher,
+		hybridCiphers:    ciphers,
 		encryptionScheme: scheme,
 	}
 }
 
-// Encrypts a protocol buffer |message|. Returns an EncryptedMessage and nil on success
-// or nil and an error on failure.
+// PublicKeyFingerprint returns the fingerprint of the public key in
+// |publicKeyPem|, which is sent by the Encoders in the
+// |public_key_fingerprint| field of the EncryptedMessages encrypted with it.
+func PublicKeyFingerprint(publicKeyPem string) ([]byte, error) {
+	publicKey, err := ParseECPublicKeyPem(publicKeyPem)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := NewHybridCipher(nil, publicKey).publicKeyFingerprint()
+	if fingerprint == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Public key PEM does not contain a point of the curve.")
+	}
+	return fingerprint, nil
+}
+
+// Encrypts a protocol buffer |message| for the first recipient. Returns an
+// EncryptedMessage and nil on success or nil and an error on failure.
 func (m *EncryptedMessageMaker) Encrypt(message proto.Message) (*cobalt.EncryptedMessage, error) {
 	if m == nil {
 		return nil, grpc.Errorf(codes.InvalidArgument, "EncryptedMessageMaker is nil")
 	}
+	serializedMessage, err := serialize(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.hybridCiphers) == 0 {
+		return nil, grpc.Errorf(codes.Internal, "EncryptedMessageMaker has no recipients")
+	}
+	return m.encryptFor(serializedMessage, m.hybridCiphers[0])
+}
+
+// Encrypts a protocol buffer |message| once for each recipient. Returns a slice
+// containing one EncryptedMessage per recipient, in the order in which the
+// recipients' public keys were passed to the constructor, and nil on success
+// or nil and an error on failure.
+func (m *EncryptedMessageMaker) EncryptForAllRecipients(message proto.Message) ([]*cobalt.EncryptedMessage, error) {
+	if m == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "EncryptedMessageMaker is nil")
+	}
+	serializedMessage, err := serialize(message)
+	if err != nil {
+		return nil, err
+	}
+	encryptedMessages := make([]*cobalt.EncryptedMessage, len(m.hybridCiphers))
+	for i, cipher := range m.hybridCiphers {
+		if encryptedMessages[i], err = m.encryptFor(serializedMessage, cipher); err != nil {
+			return nil, err
+		}
+	}
+	return encryptedMessages, nil
+}
+
+// serialize returns the serialization of |message| or an error.
+func serialize(message proto.Message) ([]byte, error) {
 	if message == nil {
 		return nil, grpc.Errorf(codes.InvalidArgument, "message is nil")
 	}
@@ -96,7 +167,12 @@ func (m *EncryptedMessageMaker) Encrypt(message proto.Message) (*cobalt.Encrypte
 	if err != nil {
 		return nil, grpc.Errorf(codes.InvalidArgument, "message could not be serialized: %v", err)
 	}
+	return serializedMessage, nil
+}
 
+// encryptFor encrypts |serializedMessage| for the recipient whose HybridCipher
+// is |hybridCipher|.
+func (m *EncryptedMessageMaker) encryptFor(serializedMessage []byte, hybridCipher *HybridCipher) (*cobalt.EncryptedMessage, error) {
 	var encryptedMessage cobalt.EncryptedMessage
 	encryptedMessage.Scheme = m.encryptionScheme
 
@@ -110,21 +186,31 @@ func (m *EncryptedMessageMaker) Encrypt(message proto.Message) (*cobalt.Encrypte
 		return nil, grpc.Errorf(codes.Internal, "Unexpected encryption scheme: %v", m.encryptionScheme)
 	}
 
-	if m.hybridCipher == nil {
-		return nil, grpc.Errorf(codes.Internal, "m.hybridCipher is nil")
+	if hybridCipher == nil {
+		return nil, grpc.Errorf(codes.Internal, "hybridCipher is nil")
 	}
-	ciphertext, err := m.hybridCipher.Encrypt(serializedMessage)
+	ciphertext, err := hybridCipher.Encrypt(serializedMessage)
 	if err != nil {
 		return nil, err
 	}
 	encryptedMessage.Ciphertext = ciphertext
-	// TODO(rudominer) Set encryptedMessage.PublicKeyFingerprint
+	encryptedMessage.PublicKeyFingerprint = hybridCipher.publicKeyFingerprint()
 
 	return &encryptedMessage, nil
 }
 
+// A MessageDecrypter holds one or more private keys. Holding several keys
+// allows the Shuffler to rotate its key pair: while Encoders are switching to
+// the new public key, EncryptedMessages for either key can be decrypted.
 type MessageDecrypter struct {
-	hybridCipher *HybridCipher
+	// One HybridCipher per private key, in the order in which the keys were
+	// passed to the constructor. Each HybridCipher holds the public key that
+	// corresponds to its private key so that its fingerprint can be computed.
+	hybridCiphers []*HybridCipher
+
+	// The SHA256 fingerprints of the public keys, as hex strings, mapped to
+	// the corresponding elements of |hybridCiphers|.
+	hybridCiphersByFingerprint map[string]*HybridCipher
 }
 
 // Constructs a new MessageDecrypter. If |privateKeyPem| is a valid PEM
@@ -132,29 +218,59 @@ type MessageDecrypter struct {
 // resulting MessageDecrypter will be able to decrypt messages that use the
 // HYBRID_ECDH_V1 scheme. Otherwise the resulting MessageDecrypter will only
 // be able to decrypt EncryptedMessages that use the NONE scheme.
-//
-// TODO(rudominer) For key-rotation support this constructor
-// should accept multiple (public, private) key pairs and use the
-// fingerprint field of EncryptedMessage to select the appropriate private
-// key.
 func NewMessageDecrypter(privateKeyPem string) *MessageDecrypter {
-	var hybridCipher *HybridCipher
 	if privateKeyPem == "" {
+		return NewMultiKeyMessageDecrypter(nil)
+	}
+	return NewMultiKeyMessageDecrypter([]string{privateKeyPem})
+}
+
+// Constructs a new MessageDecrypter that holds the private key of each element
+// of |privateKeyPems| that is a valid PEM encoding of a private key for
+// Cobalt's hybrid encryption scheme. Invalid elements are logged and skipped.
+// An EncryptedMessage that uses the HYBRID_ECDH_V1 scheme is decrypted with
+// the private key whose public key has the fingerprint given in the message.
+// If the message has no fingerprint each private key is tried in turn.
+func NewMultiKeyMessageDecrypter(privateKeyPems []string) *MessageDecrypter {
+	m := &MessageDecrypter{
+		hybridCiphersByFingerprint: make(map[string]*HybridCipher),
+	}
+	if len(privateKeyPems) == 0 {
 		// We use glog.V() here becuase we don't want to print an error message if the
 		// Shuffler is being used in a test without encryption.
 		glog.V(3).Infoln("No privateKeyPem provided. Shuffler will not be able to decrypt EncryptedMessages.")
-	} else {
+		return m
+	}
+	for i, privateKeyPem := range privateKeyPems {
 		privateKey, err := ParseECPrivateKeyPem(privateKeyPem)
 		if err != nil {
-			stackdriver.LogCountMetricf(newMessageDecrypterFailed, "Failed to decode private key PEM: %v, Shuffler will not be able to decrypt EncryptedMessages.", err)
-		} else {
-			hybridCipher = NewHybridCipher(privateKey, nil)
-			glog.Infoln("Successfully parsed the private key PEM file.")
+			stackdriver.LogCountMetricf(newMessageDecrypterFailed, "Failed to decode private key PEM %d: %v, Shuffler will not be able to decrypt EncryptedMessages for this key.", i, err)
+			continue
 		}
+		publicX, publicY := ellipticCurve.ScalarBaseMult(privateKey)
+		hybridCipher := &HybridCipher{
+			privateKey: privateKey,
+			publicKeyX: publicX,
+			publicKeyY: publicY,
+		}
+		fingerprint := hex.EncodeToString(hybridCipher.publicKeyFingerprint())
+		if _, ok := m.hybridCiphersByFingerprint[fingerprint]; ok {
+			glog.Warningf("Private key PEM %d duplicates an earlier key with public key fingerprint %s.", i, fingerprint)
+			continue
+		}
+		m.hybridCiphers = append(m.hybridCiphers, hybridCipher)
+		m.hybridCiphersByFingerprint[fingerprint] = hybridCipher
+		glog.Infof("Successfully parsed the private key PEM for public key fingerprint %s.", fingerprint)
 	}
-	return &MessageDecrypter{
-		hybridCipher: hybridCipher,
+	return m
+}
+
+// NumKeys returns the number of private keys held by the MessageDecrypter.
+func (m *MessageDecrypter) NumKeys() int {
+	if m == nil {
+		return 0
 	}
+	return len(m.hybridCiphers)
 }
 
 // Decrypts |encryptedMessage| and deserializes the result into the provided |outMessage|. Return a non-nil error if and only if this fails.
@@ -179,12 +295,12 @@ func (m *MessageDecrypter) DecryptMessage(encryptedMessage *cobalt.EncryptedMess
 		// HYBRID_ECDH_V1 is the only other scheme we know about.
 		return grpc.Errorf(codes.InvalidArgument, "Unrecognized encryption scheme specified in EncryptedMessage: %v", encryptedMessage.Scheme)
 	}
-	if m.hybridCipher == nil {
+	if len(m.hybridCiphers) == 0 {
 		return grpc.Errorf(codes.Internal, "Cannot decrypt: Decryption was not successfully initialized.")
 	}
-	recoveredText, err := m.hybridCipher.Decrypt(encryptedMessage.Ciphertext)
+	recoveredText, err := m.decrypt(encryptedMessage)
 	if err != nil {
-		return grpc.Errorf(codes.InvalidArgument, "Decryption error: %v", err)
+		return err
 	}
 	if err = proto.Unmarshal(recoveredText, outMessage); err != nil {
 		return grpc.Errorf(codes.InvalidArgument, "Unable to unmarshal decrypted text: %v", err)
@@ -193,3 +309,32 @@ func (m *MessageDecrypter) DecryptMessage(encryptedMessage *cobalt.EncryptedMess
 	return nil
 
 }
+
+// decrypt returns the plaintext of |encryptedMessage|, which must use the
+// HYBRID_ECDH_V1 scheme, using the private key selected by its public key
+// fingerprint.
+func (m *MessageDecrypter) decrypt(encryptedMessage *cobalt.EncryptedMessage) ([]byte, error) {
+	if len(encryptedMessage.PublicKeyFingerprint) > 0 {
+		fingerprint := hex.EncodeToString(encryptedMessage.PublicKeyFingerprint)
+		hybridCipher, ok := m.hybridCiphersByFingerprint[fingerprint]
+		if !ok {
+			return nil, grpc.Errorf(codes.InvalidArgument, "No private key for public key fingerprint %s", fingerprint)
+		}
+		recoveredText, err := hybridCipher.Decrypt(encryptedMessage.Ciphertext)
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "Decryption error: %v", err)
+		}
+		return recoveredText, nil
+	}
+
+	// Without a fingerprint we rely on the authentication of the symmetric
+	// ciphertext to detect the wrong key.
+	var err error
+	for _, hybridCipher := range m.hybridCiphers {
+		var recoveredText []byte
+		if recoveredText, err = hybridCipher.Decrypt(encryptedMessage.Ciphertext); err == nil {
+			return recoveredText, nil
+		}
+	}
+	return nil, grpc.Errorf(codes.InvalidArgument, "Decryption error: %v", err)
+}
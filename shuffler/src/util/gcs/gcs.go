@@ -0,0 +1,139 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcs uploads objects to Google Cloud Storage with its JSON API. It
+// is shared by the Shuffler and the tools that write to Cloud Storage.
+package gcs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+// The prefix of paths that name a Cloud Storage bucket or object.
+const Prefix = "gs://"
+
+// The OAuth scope required to read, write and delete objects in Google Cloud
+// Storage.
+const ReadWriteScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// The base URL of the Cloud Storage JSON API for uploads.
+const UploadEndpoint = "https://www.googleapis.com/upload/storage/v1/"
+
+// ParsePath splits |path| of the form gs://<bucket>[/<prefix>] into the
+// bucket and the prefix of the names of the objects. A non-empty prefix is
+// terminated with "/" so that it names a folder.
+func ParsePath(path string) (bucket, prefix string, err error) {
+	if !strings.HasPrefix(path, Prefix) {
+		return "", "", fmt.Errorf("The Cloud Storage path %s does not start with %s", path, Prefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, Prefix), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("The Cloud Storage path %s does not name a bucket", path)
+	}
+	if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+		prefix = strings.Trim(parts[1], "/") + "/"
+	}
+	return parts[0], prefix, nil
+}
+
+// ParseObject splits |path| of the form gs://<bucket>/<object> into the
+// bucket and the name of the object.
+func ParseObject(path string) (bucket, object string, err error) {
+	if !strings.HasPrefix(path, Prefix) {
+		return "", "", fmt.Errorf("The Cloud Storage path %s does not start with %s", path, Prefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, Prefix), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("The Cloud Storage path %s does not name a bucket", path)
+	}
+	if len(parts) < 2 || parts[1] == "" || strings.HasSuffix(parts[1], "/") {
+		return "", "", fmt.Errorf("The Cloud Storage path %s does not name an object", path)
+	}
+	return parts[0], parts[1], nil
+}
+
+// NewClient returns an HTTP client that is authorized with the application
+// default credentials to read, write and delete objects in Cloud Storage.
+func NewClient() (*http.Client, error) {
+	client, err := google.DefaultClient(context.Background(), ReadWriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create a Cloud Storage client: %v", err)
+	}
+	return client, nil
+}
+
+// An Uploader uploads objects to Google Cloud Storage.
+type Uploader struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewUploader returns an Uploader that sends its requests with |client| to
+// the upload API at |endpoint|, or at UploadEndpoint if |endpoint| is empty.
+func NewUploader(client *http.Client, endpoint string) *Uploader {
+	if endpoint == "" {
+		endpoint = UploadEndpoint
+	}
+	return &Uploader{
+		client:   client,
+		endpoint: endpoint,
+	}
+}
+
+// NewDefaultUploader returns an Uploader that uses the application default
+// credentials.
+func NewDefaultUploader() (*Uploader, error) {
+	client, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+	return NewUploader(client, ""), nil
+}
+
+// Upload writes the contents read from |r| to the object |object| in the
+// bucket |bucket| with the content type |contentType|, replacing the object if
+// it exists. The contents are streamed, so that they need not fit in memory.
+// If |contentEncoding| is not empty, e.g. "gzip", the contents are stored with
+// that encoding and Cloud Storage decodes them for the clients that do not
+// accept it.
+func (u *Uploader) Upload(ctx context.Context, bucket, object string, r io.Reader, contentType, contentEncoding string) error {
+	uploadURL := fmt.Sprintf("%sb/%s/o?uploadType=media&name=%s", u.endpoint, url.PathEscape(bucket), url.QueryEscape(object))
+	if contentEncoding != "" {
+		uploadURL += "&contentEncoding=" + url.QueryEscape(contentEncoding)
+	}
+	request, err := http.NewRequest("POST", uploadURL, r)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	resp, err := u.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Cloud Storage upload request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Cloud Storage upload request failed with status %s: %s", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestParsePath(t *testing.T) {
+	var tests = []struct {
+		path, bucket, prefix string
+	}{
+		{"gs://bucket", "bucket", ""},
+		{"gs://bucket/", "bucket", ""},
+		{"gs://bucket/reports", "bucket", "reports/"},
+		{"gs://bucket/daily/reports/", "bucket", "daily/reports/"},
+	}
+	for _, tt := range tests {
+		bucket, prefix, err := ParsePath(tt.path)
+		if err != nil || bucket != tt.bucket || prefix != tt.prefix {
+			t.Errorf("ParsePath(%s) = %q, %q, %v", tt.path, bucket, prefix, err)
+		}
+	}
+	for _, path := range []string{"gs:///reports", "/tmp/reports"} {
+		if _, _, err := ParsePath(path); err == nil {
+			t.Errorf("ParsePath(%s) succeeded", path)
+		}
+	}
+}
+
+func TestParseObject(t *testing.T) {
+	bucket, object, err := ParseObject("gs://bucket/daily/report.csv")
+	if err != nil || bucket != "bucket" || object != "daily/report.csv" {
+		t.Errorf("ParseObject() = %q, %q, %v", bucket, object, err)
+	}
+	for _, path := range []string{"/tmp/report.csv", "gs://bucket", "gs://bucket/", "gs://bucket/daily/", "gs:///report.csv"} {
+		if _, _, err := ParseObject(path); err == nil {
+			t.Errorf("ParseObject(%s) succeeded", path)
+		}
+	}
+}
+
+// fakeGCSAPI records the last upload made to the Cloud Storage API.
+type fakeGCSAPI struct {
+	request     string
+	contentType string
+	body        []byte
+	status      int
+}
+
+func (f *fakeGCSAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.request = r.Method + " " + r.URL.RequestURI()
+	f.contentType = r.Header.Get("Content-Type")
+	f.body, _ = ioutil.ReadAll(r.Body)
+	w.WriteHeader(f.status)
+	w.Write([]byte("{}"))
+}
+
+func TestUpload(t *testing.T) {
+	fake := &fakeGCSAPI{status: http.StatusOK}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	u := NewUploader(server.Client(), server.URL+"/")
+
+	if err := u.Upload(context.Background(), "bucket", "daily/report.csv", strings.NewReader("a,b\n"), "text/csv", ""); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	if expected := "POST /b/bucket/o?uploadType=media&name=daily%2Freport.csv"; fake.request != expected {
+		t.Errorf("Got request %s, expected %s", fake.request, expected)
+	}
+	if fake.contentType != "text/csv" || string(fake.body) != "a,b\n" {
+		t.Errorf("Got content type %s and body %q", fake.contentType, fake.body)
+	}
+
+	if err := u.Upload(context.Background(), "bucket", "report.json", strings.NewReader("{}"), "application/json", "gzip"); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	if expected := "POST /b/bucket/o?uploadType=media&name=report.json&contentEncoding=gzip"; fake.request != expected {
+		t.Errorf("Got request %s, expected %s", fake.request, expected)
+	}
+
+	fake.status = http.StatusForbidden
+	if err := u.Upload(context.Background(), "bucket", "report.csv", strings.NewReader("a,b\n"), "text/csv", ""); err == nil {
+		t.Errorf("Upload() succeeded with status 403")
+	}
+}
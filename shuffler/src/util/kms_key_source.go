@@ -0,0 +1,151 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+// The OAuth scope required to use the Cloud KMS API.
+const cloudKMSScope = "https://www.googleapis.com/auth/cloudkms"
+
+// The base URL of the Cloud KMS REST API.
+const cloudKMSEndpoint = "https://cloudkms.googleapis.com/v1/"
+
+// PrivateKeySource provides the PEM encoding of the Shuffler's private key for
+// Cobalt's hybrid encryption scheme.
+type PrivateKeySource interface {
+	// PrivateKeyPem returns the current PEM encoding of the private key or an
+	// error.
+	PrivateKeyPem() (string, error)
+}
+
+// KMSKeySource is a PrivateKeySource for a private key that is stored
+// encrypted with a Google Cloud KMS CryptoKey, so that the plaintext PEM never
+// has to be written to disk. The ciphertext is read from |ciphertextFile| and
+// decrypted by the Cloud KMS API.
+//
+// The decrypted key is cached. The Cloud KMS API is only called again when
+// the contents of |ciphertextFile| change, for example because the key has
+// been rotated.
+type KMSKeySource struct {
+	// The resource name of the CryptoKey, of the form
+	// projects/*/locations/*/keyRings/*/cryptoKeys/*
+	cryptoKeyName  string
+	ciphertextFile string
+
+	// The HTTP client used to call the Cloud KMS API at |endpoint|.
+	client   *http.Client
+	endpoint string
+
+	// mu protects |ciphertext| and |privateKeyPem| which hold the most recently
+	// decrypted ciphertext and its plaintext.
+	mu            sync.Mutex
+	ciphertext    []byte
+	privateKeyPem string
+}
+
+// NewKMSKeySource returns a KMSKeySource for the private key stored in
+// |ciphertextFile| encrypted with the Cloud KMS CryptoKey |cryptoKeyName|.
+// The Cloud KMS API is called using the application default credentials.
+func NewKMSKeySource(cryptoKeyName, ciphertextFile string) (*KMSKeySource, error) {
+	client, err := google.DefaultClient(context.Background(), cloudKMSScope)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create a Cloud KMS client: %v", err)
+	}
+	return &KMSKeySource{
+		cryptoKeyName:  cryptoKeyName,
+		ciphertextFile: ciphertextFile,
+		client:         client,
+		endpoint:       cloudKMSEndpoint,
+	}, nil
+}
+
+// PrivateKeyPem reads the ciphertext file and returns the decrypted PEM
+// encoding of the private key or an error.
+func (s *KMSKeySource) PrivateKeyPem() (string, error) {
+	if s == nil {
+		panic("s is nil")
+	}
+
+	ciphertext, err := ioutil.ReadFile(s.ciphertextFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the private key ciphertext file %s: %v", s.ciphertextFile, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ciphertext != nil && bytes.Equal(ciphertext, s.ciphertext) {
+		return s.privateKeyPem, nil
+	}
+
+	plaintext, err := s.decrypt(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	glog.Infof("Decrypted the private key in %s using Cloud KMS key %s.", s.ciphertextFile, s.cryptoKeyName)
+	s.ciphertext = ciphertext
+	s.privateKeyPem = string(plaintext)
+	return s.privateKeyPem, nil
+}
+
+// decrypt invokes the decrypt method of the Cloud KMS API for |ciphertext|
+// and returns the plaintext or an error.
+func (s *KMSKeySource) decrypt(ciphertext []byte) ([]byte, error) {
+	request, err := json.Marshal(map[string]string{
+		"ciphertext": base64.StdEncoding.EncodeToString(ciphertext),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := s.endpoint + s.cryptoKeyName + ":decrypt"
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("Cloud KMS decrypt request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the Cloud KMS decrypt response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cloud KMS decrypt request failed with status %s: %s", resp.Status, body)
+	}
+
+	var response struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("Unable to parse the Cloud KMS decrypt response: %v", err)
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode the decrypted private key: %v", err)
+	}
+	return plaintext, nil
+}
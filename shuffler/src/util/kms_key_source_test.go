@@ -0,0 +1,110 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testCryptoKeyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+// newFakeKMSServer returns a fake Cloud KMS API whose decrypt method returns
+// the ciphertext prefixed with "plain-". The number of decrypt requests is
+// counted in |numRequests|.
+func newFakeKMSServer(t *testing.T, numRequests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*numRequests++
+		if r.URL.Path != "/"+testCryptoKeyName+":decrypt" {
+			t.Errorf("Unexpected request path: %s", r.URL.Path)
+		}
+		var request struct {
+			Ciphertext string `json:"ciphertext"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Unable to parse the decrypt request: %v", err)
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(request.Ciphertext)
+		if err != nil {
+			t.Errorf("Unable to decode the ciphertext: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"plaintext": base64.StdEncoding.EncodeToString(append([]byte("plain-"), ciphertext...)),
+		})
+	}))
+}
+
+func TestKMSKeySource(t *testing.T) {
+	numRequests := 0
+	server := newFakeKMSServer(t, &numRequests)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kms_key_source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ciphertextFile := filepath.Join(dir, "private_key.enc")
+
+	s := &KMSKeySource{
+		cryptoKeyName:  testCryptoKeyName,
+		ciphertextFile: ciphertextFile,
+		client:         server.Client(),
+		endpoint:       server.URL + "/",
+	}
+
+	// The ciphertext file does not exist yet.
+	if _, err := s.PrivateKeyPem(); err == nil {
+		t.Errorf("Expected an error for a missing ciphertext file")
+	}
+
+	if err := ioutil.WriteFile(ciphertextFile, []byte("key1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		pem, err := s.PrivateKeyPem()
+		if err != nil {
+			t.Fatalf("PrivateKeyPem() failed: %v", err)
+		}
+		if pem != "plain-key1" {
+			t.Errorf("Got %q, expected %q", pem, "plain-key1")
+		}
+	}
+	// The second call used the cached key.
+	if numRequests != 1 {
+		t.Errorf("Got %d decrypt requests, expected 1", numRequests)
+	}
+
+	// A rotated key is decrypted again.
+	if err := ioutil.WriteFile(ciphertextFile, []byte("key2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pem, err := s.PrivateKeyPem()
+	if err != nil {
+		t.Fatalf("PrivateKeyPem() failed: %v", err)
+	}
+	if pem != "plain-key2" {
+		t.Errorf("Got %q, expected %q", pem, "plain-key2")
+	}
+	if numRequests != 2 {
+		t.Errorf("Got %d decrypt requests, expected 2", numRequests)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cobalt"
+	"util/stackdriver"
+)
+
+const (
+	observationSizeMedian  = "observation-size-median"
+	observationSizeShifted = "observation-size-median-shifted"
+)
+
+// sizeMetricKey identifies the metric of an Observation.
+type sizeMetricKey struct {
+	customerId uint32
+	projectId  uint32
+	metricId   uint32
+}
+
+// sizeSummary summarizes the ciphertext sizes of the Observations for one
+// metric during one interval.
+type sizeSummary struct {
+	key    sizeMetricKey
+	count  uint64
+	median int
+
+	// The median of the previous interval in which Observations for the metric
+	// were seen, or zero if there was none.
+	previousMedian int
+
+	// |histogram| counts the sizes in power-of-two buckets. Bucket i holds the
+	// sizes s with 2^(i-1) <= s < 2^i, bucket 0 holds the size 0.
+	histogram []uint64
+
+	// Whether |median| differs from |previousMedian| by more than the shift
+	// factor.
+	shifted bool
+}
+
+// ObservationSizes tracks the distribution of the ciphertext sizes of the
+// Observations for each metric that pass through one stage of the Shuffler.
+// Once per interval the distributions are logged as Stackdriver metrics and
+// the median size of each metric is compared with its median in the previous
+// interval. A median that changes by more than a factor of |shiftFactor| is
+// logged as an anomaly since it usually indicates a bug in the encoding of the
+// metric on the client.
+type ObservationSizes struct {
+	// The name of the Shuffler stage, used in log messages.
+	stage string
+
+	// If not greater than 1 anomalies are not detected.
+	shiftFactor float64
+
+	// mu protects |counts| and |medians|.
+	mu sync.Mutex
+
+	// The number of Observations of each ciphertext size seen for each metric
+	// in the current interval.
+	counts map[sizeMetricKey]map[int]uint64
+
+	// The median size for each metric in the most recent interval in which
+	// Observations for that metric were seen.
+	medians map[sizeMetricKey]int
+}
+
+// NewObservationSizes returns an ObservationSizes for the Shuffler stage
+// |stage|, such as "receiver" or "dispatcher", that detects median sizes that
+// change by more than a factor of |shiftFactor|.
+func NewObservationSizes(stage string, shiftFactor float64) *ObservationSizes {
+	return &ObservationSizes{
+		stage:       stage,
+		shiftFactor: shiftFactor,
+		counts:      make(map[sizeMetricKey]map[int]uint64),
+		medians:     make(map[sizeMetricKey]int),
+	}
+}
+
+// Add records an Observation of ciphertext size |size| for the metric in
+// |metadata|.
+func (s *ObservationSizes) Add(metadata *cobalt.ObservationMetadata, size int) {
+	if metadata == nil {
+		panic("metadata is nil")
+	}
+
+	key := sizeMetricKey{metadata.CustomerId, metadata.ProjectId, metadata.MetricId}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts[key] == nil {
+		s.counts[key] = make(map[int]uint64)
+	}
+	s.counts[key][size]++
+}
+
+// Run invokes Flush() once every |interval|. It never returns.
+func (s *ObservationSizes) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.Flush()
+	}
+}
+
+// Flush logs the size distributions of the current interval and any anomalies
+// and starts a new interval.
+func (s *ObservationSizes) Flush() {
+	for _, summary := range s.summarize() {
+		k := summary.key
+		stackdriver.LogIntStackdriverMetricf(observationSizeMedian, summary.median,
+			"Stage: %s Metric: %d/%d/%d Count: %d Sizes: %s",
+			s.stage, k.customerId, k.projectId, k.metricId, summary.count, formatSizeHistogram(summary.histogram))
+		if summary.shifted {
+			stackdriver.LogCountMetricf(observationSizeShifted,
+				"Stage: %s Metric: %d/%d/%d The median ciphertext size changed from %d to %d bytes.",
+				s.stage, k.customerId, k.projectId, k.metricId, summary.previousMedian, summary.median)
+		}
+	}
+}
+
+// summarize returns the summaries of the current interval sorted by metric
+// and starts a new interval.
+func (s *ObservationSizes) summarize() []sizeSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summaries := make([]sizeSummary, 0, len(s.counts))
+	for key, counts := range s.counts {
+		summary := summarizeSizes(counts)
+		summary.key = key
+		summary.previousMedian = s.medians[key]
+		summary.shifted = s.isShift(summary.previousMedian, summary.median)
+		s.medians[key] = summary.median
+		summaries = append(summaries, summary)
+	}
+	s.counts = make(map[sizeMetricKey]map[int]uint64)
+
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i].key, summaries[j].key
+		if a.customerId != b.customerId {
+			return a.customerId < b.customerId
+		}
+		if a.projectId != b.projectId {
+			return a.projectId < b.projectId
+		}
+		return a.metricId < b.metricId
+	})
+	return summaries
+}
+
+// isShift returns true if |median| differs from |previousMedian| by more than
+// the shift factor. There is no shift if there is no previous median.
+func (s *ObservationSizes) isShift(previousMedian, median int) bool {
+	if s.shiftFactor <= 1 || previousMedian == 0 {
+		return false
+	}
+	ratio := float64(median) / float64(previousMedian)
+	return ratio > s.shiftFactor || ratio < 1/s.shiftFactor
+}
+
+// summarizeSizes returns the count, median and histogram of the sizes
+// counted in |counts|.
+func summarizeSizes(counts map[int]uint64) (summary sizeSummary) {
+	sizes := make([]int, 0, len(counts))
+	for size, n := range counts {
+		sizes = append(sizes, size)
+		summary.count += n
+		bucket := bits.Len(uint(size))
+		for len(summary.histogram) <= bucket {
+			summary.histogram = append(summary.histogram, 0)
+		}
+		summary.histogram[bucket] += n
+	}
+	sort.Ints(sizes)
+
+	var seen uint64
+	for _, size := range sizes {
+		seen += counts[size]
+		if 2*seen >= summary.count {
+			summary.median = size
+			break
+		}
+	}
+	return summary
+}
+
+// formatSizeHistogram returns a human-readable representation of the
+// non-empty buckets of |histogram|.
+func formatSizeHistogram(histogram []uint64) string {
+	var buckets []string
+	for i, n := range histogram {
+		if n == 0 {
+			continue
+		}
+		if i == 0 {
+			buckets = append(buckets, fmt.Sprintf("0:%d", n))
+		} else {
+			buckets = append(buckets, fmt.Sprintf("[%d,%d):%d", 1<<uint(i-1), 1<<uint(i), n))
+		}
+	}
+	return strings.Join(buckets, " ")
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	"cobalt"
+)
+
+func TestSummarizeSizes(t *testing.T) {
+	summary := summarizeSizes(map[int]uint64{0: 1, 100: 2, 120: 3, 300: 1})
+	if summary.count != 7 {
+		t.Errorf("Got count %d, expected 7", summary.count)
+	}
+	if summary.median != 120 {
+		t.Errorf("Got median %d, expected 120", summary.median)
+	}
+	expectedHistogram := []uint64{1, 0, 0, 0, 0, 0, 0, 5, 0, 1}
+	if !reflect.DeepEqual(summary.histogram, expectedHistogram) {
+		t.Errorf("Got histogram %v, expected %v", summary.histogram, expectedHistogram)
+	}
+	if s := formatSizeHistogram(summary.histogram); s != "0:1 [64,128):5 [256,512):1" {
+		t.Errorf("Got formatted histogram %q", s)
+	}
+}
+
+func TestObservationSizesShift(t *testing.T) {
+	metric1 := &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 1}
+	metric2 := &cobalt.ObservationMetadata{CustomerId: 1, ProjectId: 1, MetricId: 2}
+	s := NewObservationSizes("test", 2.0)
+
+	// The first interval establishes the medians.
+	for i := 0; i < 10; i++ {
+		s.Add(metric1, 100)
+		s.Add(metric2, 100)
+	}
+	for _, summary := range s.summarize() {
+		if summary.shifted {
+			t.Errorf("Unexpected shift in the first interval for %v", summary.key)
+		}
+	}
+
+	// The median size of metric 1 grows by a factor of 3. That of metric 2
+	// grows by a factor of 1.5.
+	for i := 0; i < 10; i++ {
+		s.Add(metric1, 300)
+		s.Add(metric2, 150)
+	}
+	summaries := s.summarize()
+	if len(summaries) != 2 {
+		t.Fatalf("Got %d summaries, expected 2", len(summaries))
+	}
+	if !summaries[0].shifted || summaries[0].previousMedian != 100 || summaries[0].median != 300 {
+		t.Errorf("Expected a shift from 100 to 300 for metric 1, got %+v", summaries[0])
+	}
+	if summaries[1].shifted {
+		t.Errorf("Unexpected shift for metric 2: %+v", summaries[1])
+	}
+
+	// A metric without Observations in an interval is not summarized.
+	if summaries := s.summarize(); len(summaries) != 0 {
+		t.Errorf("Got %d summaries for an empty interval, expected none", len(summaries))
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file contains the client side of project-level access control. The
+// ReportMaster enforces per-project authorization. Shared report tooling that
+// operates across many projects may send the headers below to tell the
+// ReportMaster on whose behalf, and in the scope of which project, a request
+// is made. The client never makes authorization decisions itself.
+
+package report_client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// The gRPC metadata key for the identity to impersonate.
+	impersonateHeader = "x-cobalt-impersonate"
+	// The gRPC metadata key for the project scope of a request.
+	projectScopeHeader = "x-cobalt-project-scope"
+	// The JWT claim from which the project scope is read if it is not
+	// explicitly specified.
+	projectScopeClaim = "cobalt_project_scope"
+)
+
+// AccessOptions specifies the access control headers sent with each request
+// to the ReportMaster.
+type AccessOptions struct {
+	// If non-empty, the identity on whose behalf requests are made. The
+	// ReportMaster only honors this if the authenticated user is allowed to
+	// impersonate that identity.
+	Impersonate string
+
+	// If non-empty, the project scope of requests. If empty and OAuth is used,
+	// the value of the |cobalt_project_scope| claim of the ID token is used, if
+	// present.
+	ProjectScope string
+}
+
+// accessCredentials implements grpc.credentials.PerRPCCredentials by attaching
+// the headers specified by |options| to each request.
+type accessCredentials struct {
+	options AccessOptions
+
+	// If not nil, the source of the ID tokens from which the project scope
+	// claim is read.
+	tokenSource oauth2.TokenSource
+}
+
+func (c *accessCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	md := map[string]string{}
+	if c.options.Impersonate != "" {
+		md[impersonateHeader] = c.options.Impersonate
+	}
+
+	projectScope := c.options.ProjectScope
+	if projectScope == "" && c.tokenSource != nil {
+		t, err := c.tokenSource.Token()
+		if err != nil {
+			return nil, err
+		}
+		if projectScope, err = jwtClaim(t.AccessToken, projectScopeClaim); err != nil {
+			return nil, err
+		}
+	}
+	if projectScope != "" {
+		md[projectScopeHeader] = projectScope
+	}
+	return md, nil
+}
+
+func (c *accessCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// jwtClaim returns the value of the string claim |name| in the payload of the
+// JSON Web Token |jwt|, or the empty string if there is no such claim. The
+// signature of |jwt| is not verified; that is the job of the server.
+func jwtClaim(jwt string, name string) (string, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("Malformed JSON Web Token: expected 3 parts, found %d.", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("Malformed JSON Web Token payload: %v", err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("Malformed JSON Web Token claims: %v", err)
+	}
+
+	value, ok := claims[name]
+	if !ok {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("The JSON Web Token claim %s is not a string.", name)
+	}
+	return s, nil
+}
+
+// PermissionDeniedError is returned by the methods of ReportClient when the
+// ReportMaster rejected a request with the status PERMISSION_DENIED.
+type PermissionDeniedError struct {
+	CustomerId uint32
+	ProjectId  uint32
+	Access     AccessOptions
+
+	// The error returned by the gRPC stub.
+	Err error
+}
+
+func (e *PermissionDeniedError) Error() string {
+	var via string
+	if e.Access.Impersonate != "" {
+		via = fmt.Sprintf(" while impersonating %s", e.Access.Impersonate)
+	}
+	if e.Access.ProjectScope != "" {
+		via = fmt.Sprintf("%s with project scope %s", via, e.Access.ProjectScope)
+	}
+	return fmt.Sprintf("The ReportMaster denied access to customer %d, project %d%s: %v. "+
+		"Ask an owner of the project to grant your account access to it, or check that the "+
+		"impersonation and project scope settings are correct.",
+		e.CustomerId, e.ProjectId, via, grpc.ErrorDesc(e.Err))
+}
+
+// checkAccessError returns a *PermissionDeniedError wrapping |err| if |err|
+// has the status PERMISSION_DENIED, and |err| otherwise.
+func (c *ReportClient) checkAccessError(err error) error {
+	if err == nil || grpc.Code(err) != codes.PermissionDenied {
+		return err
+	}
+	return &PermissionDeniedError{
+		CustomerId: c.CustomerId,
+		ProjectId:  c.ProjectId,
+		Access:     c.access,
+		Err:        err,
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// fakeTokenSource returns a fixed token.
+type fakeTokenSource struct {
+	token oauth2.Token
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	return &f.token, nil
+}
+
+// makeJwt returns an unsigned JSON Web Token with the given JSON payload.
+func makeJwt(payload string) string {
+	return "header." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+}
+
+// Tests that the access control headers are taken from the options first and
+// from the ID token otherwise.
+func TestAccessCredentials(t *testing.T) {
+	tokenSource := &fakeTokenSource{
+		token: oauth2.Token{AccessToken: makeJwt(`{"email":"a@b.c","cobalt_project_scope":"1/2"}`)},
+	}
+
+	cases := []struct {
+		credentials accessCredentials
+		expected    map[string]string
+	}{
+		{accessCredentials{}, map[string]string{}},
+		{accessCredentials{options: AccessOptions{Impersonate: "x@y.z", ProjectScope: "3/4"}},
+			map[string]string{impersonateHeader: "x@y.z", projectScopeHeader: "3/4"}},
+		{accessCredentials{tokenSource: tokenSource},
+			map[string]string{projectScopeHeader: "1/2"}},
+		{accessCredentials{options: AccessOptions{ProjectScope: "3/4"}, tokenSource: tokenSource},
+			map[string]string{projectScopeHeader: "3/4"}},
+		{accessCredentials{tokenSource: &fakeTokenSource{token: oauth2.Token{AccessToken: makeJwt(`{"email":"a@b.c"}`)}}},
+			map[string]string{}},
+	}
+
+	for _, c := range cases {
+		md, err := c.credentials.GetRequestMetadata(context.Background())
+		if err != nil {
+			t.Errorf("GetRequestMetadata() failed for %v: %v", c.credentials.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(md, c.expected) {
+			t.Errorf("got %v, expected %v", md, c.expected)
+		}
+	}
+}
+
+func TestJwtClaimMalformed(t *testing.T) {
+	for _, jwt := range []string{"", "a.b", "a.!!!.c", makeJwt("not json"), makeJwt(`{"cobalt_project_scope":1}`)} {
+		if _, err := jwtClaim(jwt, projectScopeClaim); err == nil {
+			t.Errorf("expected an error for [%s]", jwt)
+		}
+	}
+}
+
+// Tests that PERMISSION_DENIED errors are surfaced as PermissionDeniedErrors
+// and that other errors are passed through.
+func TestPermissionDenied(t *testing.T) {
+	reportClient, fakeStub := makeFakeClient()
+	reportClient.access = AccessOptions{ProjectScope: "1/2"}
+
+	fakeStub.err = grpc.Errorf(codes.PermissionDenied, "no access")
+	_, err := reportClient.StartReport(context.Background(), reportConfigId, firstDayIndex, lastDayIndex)
+	permissionDenied, ok := err.(*PermissionDeniedError)
+	if !ok {
+		t.Fatalf("StartReport() returned %v, expected a PermissionDeniedError", err)
+	}
+	if permissionDenied.CustomerId != customerId || permissionDenied.ProjectId != projectId {
+		t.Errorf("CustomerId=%v ProjectId=%v", permissionDenied.CustomerId, permissionDenied.ProjectId)
+	}
+	if !strings.Contains(err.Error(), "project scope 1/2") || !strings.Contains(err.Error(), "no access") {
+		t.Errorf("Error()=%s", err.Error())
+	}
+
+	if _, err = reportClient.GetReport(context.Background(), "my-report-id", 0); err == nil {
+		t.Errorf("GetReport() succeeded")
+	} else if _, ok := err.(*PermissionDeniedError); !ok {
+		t.Errorf("GetReport() returned %v, expected a PermissionDeniedError", err)
+	}
+
+	fakeStub.err = grpc.Errorf(codes.Unavailable, "unavailable")
+	if _, err = reportClient.StartReport(context.Background(), reportConfigId, firstDayIndex, lastDayIndex); err != fakeStub.err {
+		t.Errorf("StartReport() returned %v, expected %v", err, fakeStub.err)
+	}
+}
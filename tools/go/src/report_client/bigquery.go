@@ -0,0 +1,362 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"analyzer/report_master"
+	"cobalt"
+)
+
+// The OAuth scope required to create BigQuery tables and to insert rows.
+const bigQueryScope = "https://www.googleapis.com/auth/bigquery"
+
+// The base URL of the BigQuery REST API.
+const bigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2/"
+
+// The largest number of rows sent in a single insertAll request. BigQuery
+// recommends at most 500.
+const bigQueryMaxRowsPerInsert = 500
+
+// The columns of a BigQuery table that describe the report, which precede the
+// columns of its variables.
+var bigQueryMetadataColumns = []bigQueryField{
+	{Name: "report_id", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "report_config_id", Type: "INTEGER", Mode: "REQUIRED"},
+	{Name: "first_day", Type: "DATE", Mode: "NULLABLE"},
+	{Name: "last_day", Type: "DATE", Mode: "NULLABLE"},
+	{Name: "exported_at", Type: "TIMESTAMP", Mode: "REQUIRED"},
+}
+
+// The columns of a BigQuery table that follow the columns of the variables of
+// the report.
+var bigQueryRowColumns = []bigQueryField{
+	{Name: "os", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "arch", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "board_name", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "count_estimate", Type: "FLOAT", Mode: "REQUIRED"},
+	{Name: "std_error", Type: "FLOAT", Mode: "NULLABLE"},
+}
+
+// The characters that may not appear in the name of a BigQuery column.
+var invalidColumnChars = regexp.MustCompile("[^A-Za-z0-9_]")
+
+// bigQueryField is a column in the schema of a BigQuery table.
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// A BigQueryExporter streams the rows of completed reports into a BigQuery
+// table, which is created if it does not exist.
+type BigQueryExporter struct {
+	client    *http.Client
+	endpoint  string
+	projectId string
+	datasetId string
+	tableId   string
+}
+
+// NewBigQueryExporter returns a BigQueryExporter for the table |tableId| of
+// the dataset |datasetId| in the Google Cloud project |projectId|, using the
+// application default credentials. If |projectId| is empty the project of
+// those credentials is used.
+func NewBigQueryExporter(projectId, datasetId, tableId string) (*BigQueryExporter, error) {
+	if datasetId == "" || tableId == "" {
+		return nil, fmt.Errorf("The BigQuery dataset and table must be specified")
+	}
+	ctx := context.Background()
+	credentials, err := google.FindDefaultCredentials(ctx, bigQueryScope)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create a BigQuery client: %v", err)
+	}
+	if projectId == "" {
+		if credentials.ProjectID == "" {
+			return nil, fmt.Errorf("The application default credentials do not name a project. Specify the BigQuery project.")
+		}
+		projectId = credentials.ProjectID
+	}
+	return &BigQueryExporter{
+		client:    oauth2.NewClient(ctx, credentials.TokenSource),
+		endpoint:  bigQueryEndpoint,
+		projectId: projectId,
+		datasetId: datasetId,
+		tableId:   tableId,
+	}, nil
+}
+
+// TableName returns the name of the table in the form project:dataset.table.
+func (e *BigQueryExporter) TableName() string {
+	return fmt.Sprintf("%s:%s.%s", e.projectId, e.datasetId, e.tableId)
+}
+
+// Export creates the table with the schema returned by bigQuerySchema() for
+// |report| if it does not exist, and then appends the rows of |report|,
+// exported at time |t|, to the table. The rows are those written by
+// WriteCSVReport, and the std errors are set only if |includeStdErr| is true.
+// Returns the number of rows inserted.
+//
+// The rows of a table are expected to come from reports of a single
+// ReportConfig, whose variables are the same.
+func (e *BigQueryExporter) Export(report *report_master.Report, includeStdErr bool, t time.Time) (int, error) {
+	if err := e.createTableIfNotExists(bigQuerySchema(report.GetMetadata())); err != nil {
+		return 0, fmt.Errorf("Unable to create the table %s: %v", e.TableName(), err)
+	}
+
+	rows := bigQueryRows(report, includeStdErr, t)
+	for start := 0; start < len(rows); start += bigQueryMaxRowsPerInsert {
+		end := start + bigQueryMaxRowsPerInsert
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err := e.insertRows(report.GetMetadata().GetReportId(), start, rows[start:end]); err != nil {
+			return start, fmt.Errorf("Unable to insert rows into the table %s: %v", e.TableName(), err)
+		}
+	}
+	return len(rows), nil
+}
+
+// bigQueryVariableColumns returns the names of the columns that hold the
+// values of the variables of the report with the given |metadata|, which are
+// derived from the names of its metric parts. A report with two variables has
+// two such columns.
+func bigQueryVariableColumns(metadata *report_master.ReportMetadata) []string {
+	parts := metadata.GetMetricParts()
+	if len(parts) == 0 {
+		parts = []string{"value"}
+	}
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+
+	reserved := map[string]bool{}
+	for _, field := range append(bigQueryMetadataColumns, bigQueryRowColumns...) {
+		reserved[field.Name] = true
+	}
+	var columns []string
+	for _, part := range parts {
+		column := invalidColumnChars.ReplaceAllString(part, "_")
+		if column == "" || (column[0] >= '0' && column[0] <= '9') {
+			column = "_" + column
+		}
+		// Column names are case insensitive.
+		for reserved[strings.ToLower(column)] {
+			column += "_value"
+		}
+		reserved[strings.ToLower(column)] = true
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// bigQuerySchema returns the fields of the table to which the report with the
+// given |metadata| is exported: the ID, ReportConfig ID and days of the
+// report, the time of the export, a STRING column for each variable of the
+// report holding the label or the value of each row, the fields of the
+// SystemProfile of each row, its count estimate and its std error.
+func bigQuerySchema(metadata *report_master.ReportMetadata) []bigQueryField {
+	fields := append([]bigQueryField{}, bigQueryMetadataColumns...)
+	for i, column := range bigQueryVariableColumns(metadata) {
+		mode := "REQUIRED"
+		if i > 0 {
+			mode = "NULLABLE"
+		}
+		fields = append(fields, bigQueryField{Name: column, Type: "STRING", Mode: mode})
+	}
+	return append(fields, bigQueryRowColumns...)
+}
+
+// bigQueryRows returns the rows of |report|, exported at time |t|, as the
+// values of the columns of the table described by bigQuerySchema(). The rows
+// are those written by WriteCSVReport, in the same order.
+func bigQueryRows(report *report_master.Report, includeStdErr bool, t time.Time) []map[string]interface{} {
+	metadata := report.GetMetadata()
+	columns := bigQueryVariableColumns(metadata)
+	rows := []map[string]interface{}{}
+	for _, row := range ReportRowsSortedByValues(report, includeStdErr) {
+		histogramRow := row.GetHistogram()
+		if histogramRow == nil {
+			continue
+		}
+		rowStrings := HistogramReportRowToStrings(histogramRow)
+		if rowStrings.isEmpty {
+			continue
+		}
+
+		values := map[string]interface{}{
+			"report_id":        metadata.GetReportId(),
+			"report_config_id": metadata.GetReportConfigId(),
+			"first_day":        bigQueryDate(metadata.GetFirstDayIndex(), 0),
+			"last_day":         bigQueryDate(metadata.GetLastDayIndex(), math.MaxUint32),
+			"exported_at":      t.UTC().Format(time.RFC3339),
+			columns[0]:         rowStrings.rowKey,
+			"count_estimate":   math.Max(0, float32ToFloat64(histogramRow.CountEstimate)),
+		}
+		if len(columns) > 1 && rowStrings.hasRowKey2 {
+			values[columns[1]] = rowStrings.rowKey2
+		}
+		if profile := histogramRow.GetSystemProfile(); profile != nil {
+			if profile.Os != cobalt.SystemProfile_UNKNOWN_OS {
+				values["os"] = profile.Os.String()
+			}
+			if profile.Arch != cobalt.SystemProfile_UNKNOWN_ARCH {
+				values["arch"] = profile.Arch.String()
+			}
+			if profile.BoardName != "" {
+				values["board_name"] = profile.BoardName
+			}
+		}
+		if includeStdErr {
+			values["std_error"] = float32ToFloat64(histogramRow.StdError)
+		}
+		rows = append(rows, values)
+	}
+	return rows
+}
+
+// bigQueryDate returns the UTC date of the day with index |dayIndex| as a
+// BigQuery DATE, or nil if it is |unbounded|.
+func bigQueryDate(dayIndex uint32, unbounded uint32) interface{} {
+	if dayIndex == unbounded {
+		return nil
+	}
+	return dayIndexToDate(dayIndex, unbounded)
+}
+
+// tableURL returns the URL of the table, or of the tables of the dataset if
+// |table| is false.
+func (e *BigQueryExporter) tableURL(table bool) string {
+	u := fmt.Sprintf("%sprojects/%s/datasets/%s/tables", e.endpoint, url.PathEscape(e.projectId), url.PathEscape(e.datasetId))
+	if table {
+		u += "/" + url.PathEscape(e.tableId)
+	}
+	return u
+}
+
+// createTableIfNotExists creates the table with the columns |fields| if it
+// does not exist. The schema of an existing table is left unchanged.
+func (e *BigQueryExporter) createTableIfNotExists(fields []bigQueryField) error {
+	status, _, err := e.call("GET", e.tableURL(true), nil)
+	if err == nil {
+		return nil
+	}
+	if status != http.StatusNotFound {
+		return err
+	}
+
+	request := map[string]interface{}{
+		"tableReference": map[string]interface{}{
+			"projectId": e.projectId,
+			"datasetId": e.datasetId,
+			"tableId":   e.tableId,
+		},
+		"schema": map[string]interface{}{"fields": fields},
+	}
+	status, _, err = e.call("POST", e.tableURL(false), request)
+	// The table may have been created concurrently.
+	if status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// insertRows appends |rows|, the rows of the report |reportId| starting at
+// index |start|, to the table. Each row is given an insert ID made of the
+// report ID and its index, so that BigQuery discards the duplicates if the
+// rows of a report are exported again shortly afterwards.
+func (e *BigQueryExporter) insertRows(reportId string, start int, rows []map[string]interface{}) error {
+	var insertRows []map[string]interface{}
+	for i, row := range rows {
+		insertRows = append(insertRows, map[string]interface{}{
+			"insertId": fmt.Sprintf("%s-%d", reportId, start+i),
+			"json":     row,
+		})
+	}
+	request := map[string]interface{}{
+		"kind": "bigquery#tableDataInsertAllRequest",
+		"rows": insertRows,
+	}
+	_, response, err := e.call("POST", e.tableURL(true)+"/insertAll", request)
+	if err != nil {
+		return err
+	}
+
+	var insertResponse struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := json.Unmarshal(response, &insertResponse); err != nil {
+		return fmt.Errorf("Unable to parse the response of BigQuery: %v", err)
+	}
+	if len(insertResponse.InsertErrors) > 0 {
+		first := insertResponse.InsertErrors[0]
+		message := ""
+		if len(first.Errors) > 0 {
+			message = first.Errors[0].Reason + ": " + first.Errors[0].Message
+		}
+		return fmt.Errorf("%d rows were rejected, the first one, %d, with %s", len(insertResponse.InsertErrors), start+first.Index, message)
+	}
+	return nil
+}
+
+// call sends |request|, if not nil, encoded as JSON to |requestURL| and
+// returns the status and the body of the response. An error is returned if
+// the BigQuery API does not respond with success.
+func (e *BigQueryExporter) call(method string, requestURL string, request interface{}) (int, []byte, error) {
+	var body []byte
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return 0, nil, err
+		}
+	}
+	req, err := http.NewRequest(method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, response, fmt.Errorf("the BigQuery API returned %s: %s", resp.Status, strings.TrimSpace(string(response)))
+	}
+	return resp.StatusCode, response, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"analyzer/report_master"
+)
+
+// fakeBigQueryAPI records the requests made to the BigQuery API. The table
+// exists if |tableExists| is true, and the rows are rejected with
+// |insertErrors| if it is not empty.
+type fakeBigQueryAPI struct {
+	requests     []string
+	bodies       []map[string]interface{}
+	tableExists  bool
+	insertErrors string
+}
+
+func (f *fakeBigQueryAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.bodies = append(f.bodies, body)
+	switch {
+	case r.Method == "GET" && !f.tableExists:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{}"))
+	case strings.HasSuffix(r.URL.Path, "/insertAll") && f.insertErrors != "":
+		w.Write([]byte(f.insertErrors))
+	default:
+		w.Write([]byte("{}"))
+	}
+}
+
+func newTestBigQueryExporter(server *httptest.Server) *BigQueryExporter {
+	return &BigQueryExporter{
+		client:    server.Client(),
+		endpoint:  server.URL + "/",
+		projectId: "my-project",
+		datasetId: "cobalt",
+		tableId:   "reports",
+	}
+}
+
+func TestBigQueryVariableColumns(t *testing.T) {
+	var tests = []struct {
+		metricParts []string
+		columns     []string
+	}{
+		{nil, []string{"value"}},
+		{[]string{"url"}, []string{"url"}},
+		{[]string{"Module name", "2nd part"}, []string{"Module_name", "_2nd_part"}},
+		{[]string{"OS", "count_estimate"}, []string{"OS_value", "count_estimate_value"}},
+		{[]string{"value", "value"}, []string{"value", "value_value"}},
+	}
+	for _, tt := range tests {
+		columns := bigQueryVariableColumns(&report_master.ReportMetadata{MetricParts: tt.metricParts})
+		if !reflect.DeepEqual(columns, tt.columns) {
+			t.Errorf("bigQueryVariableColumns(%v) = %v, expected %v", tt.metricParts, columns, tt.columns)
+		}
+	}
+}
+
+func TestBigQueryExport(t *testing.T) {
+	fake := &fakeBigQueryAPI{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	e := newTestBigQueryExporter(server)
+	if e.TableName() != "my-project:cobalt.reports" {
+		t.Errorf("Got table name %s", e.TableName())
+	}
+
+	report := successfulReport
+	report.Metadata = &report_master.ReportMetadata{
+		ReportId:       "report-id",
+		ReportConfigId: reportConfigId,
+		FirstDayIndex:  17532,
+		LastDayIndex:   17533,
+		MetricParts:    []string{"url"},
+	}
+	numRows, err := e.Export(&report, true, time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	if numRows != 6 {
+		t.Errorf("Export() inserted %d rows, expected 6", numRows)
+	}
+
+	expectedRequests := []string{
+		"GET /projects/my-project/datasets/cobalt/tables/reports",
+		"POST /projects/my-project/datasets/cobalt/tables",
+		"POST /projects/my-project/datasets/cobalt/tables/reports/insertAll",
+	}
+	if !reflect.DeepEqual(fake.requests, expectedRequests) {
+		t.Fatalf("Got requests %v, expected %v", fake.requests, expectedRequests)
+	}
+
+	var names []string
+	for _, field := range fake.bodies[1]["schema"].(map[string]interface{})["fields"].([]interface{}) {
+		names = append(names, field.(map[string]interface{})["name"].(string))
+	}
+	expectedNames := []string{"report_id", "report_config_id", "first_day", "last_day", "exported_at", "url",
+		"os", "arch", "board_name", "count_estimate", "std_error"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Got columns %v, expected %v", names, expectedNames)
+	}
+
+	// The rows are those written by WriteCSVReport.
+	rows := fake.bodies[2]["rows"].([]interface{})
+	if len(rows) != 6 {
+		t.Fatalf("Got %d rows, expected 6", len(rows))
+	}
+	first := rows[0].(map[string]interface{})
+	if first["insertId"] != "report-id-0" {
+		t.Errorf("Got insert ID %v", first["insertId"])
+	}
+	expectedRow := map[string]interface{}{
+		"report_id":        "report-id",
+		"report_config_id": float64(reportConfigId),
+		"first_day":        "2018-01-01",
+		"last_day":         "2018-01-02",
+		"exported_at":      "2018-01-02T03:04:05Z",
+		"url":              "String Value 11",
+		"count_estimate":   103.3,
+		"std_error":        3.14,
+	}
+	if !reflect.DeepEqual(first["json"], expectedRow) {
+		t.Errorf("Got row %v, expected %v", first["json"], expectedRow)
+	}
+
+	// An existing table is not created again.
+	fake.requests = nil
+	fake.tableExists = true
+	if _, err := e.Export(&report, false, time.Now()); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	if len(fake.requests) != 2 || fake.requests[1] != expectedRequests[2] {
+		t.Errorf("Got requests %v", fake.requests)
+	}
+	if _, ok := fake.bodies[len(fake.bodies)-1]["rows"].([]interface{})[0].(map[string]interface{})["json"].(map[string]interface{})["std_error"]; ok {
+		t.Errorf("The std error is set although it is not included")
+	}
+}
+
+func TestBigQueryExportInsertErrors(t *testing.T) {
+	fake := &fakeBigQueryAPI{
+		tableExists:  true,
+		insertErrors: `{"insertErrors": [{"index": 2, "errors": [{"reason": "invalid", "message": "no such field: url"}]}]}`,
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	e := newTestBigQueryExporter(server)
+
+	report := successfulReport
+	report.Metadata = &report_master.ReportMetadata{ReportId: "report-id", MetricParts: []string{"url"}}
+	_, err := e.Export(&report, false, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "no such field: url") {
+		t.Errorf("Export() returned %v, expected the insert errors", err)
+	}
+}
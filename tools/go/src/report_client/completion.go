@@ -0,0 +1,110 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"config"
+)
+
+// The commands of the interactive mode of the report client that take no
+// arguments or whose first argument is a keyword.
+var commandKeywords = map[string][]string{
+	"":    {"fetch", "get", "help", "list", "quit", "run"},
+	"run": {"full", "range"},
+}
+
+// A Completer completes the commands of the interactive mode of the report
+// client: the command keywords, the ReportConfig IDs of the project and the
+// trailing 'errs' token.
+type Completer struct {
+	reportConfigIds []string
+}
+
+// NewCompleter returns a Completer that offers |reportConfigIds| wherever a
+// ReportConfig ID is expected.
+func NewCompleter(reportConfigIds []uint32) *Completer {
+	ids := make([]string, len(reportConfigIds))
+	for i, id := range reportConfigIds {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return &Completer{reportConfigIds: ids}
+}
+
+// Complete returns the lines that complete the last word of |line|, which is
+// the part of the input line before the cursor.
+func (c *Completer) Complete(line string) []string {
+	words := strings.Fields(line)
+	prefix := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		prefix = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	var candidates []string
+	switch {
+	case len(words) == 0:
+		candidates = commandKeywords[""]
+	case len(words) == 1 && words[0] == "run":
+		candidates = commandKeywords["run"]
+	case len(words) == 2 && words[0] == "run" && words[1] == "full",
+		len(words) == 4 && words[0] == "run" && words[1] == "range",
+		len(words) == 1 && words[0] == "list":
+		candidates = c.reportConfigIds
+	case len(words) == 3 && words[0] == "run" && words[1] == "full",
+		len(words) == 5 && words[0] == "run" && words[1] == "range",
+		len(words) == 2 && (words[0] == "fetch" || words[0] == "get"):
+		candidates = []string{"errs"}
+	}
+
+	head := strings.TrimSuffix(line, prefix)
+	var completions []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			completions = append(completions, head+candidate+" ")
+		}
+	}
+	return completions
+}
+
+// LoadReportConfigIds returns the sorted IDs of the ReportConfigs of the
+// project with |customerId| and |projectId| in the file at |path|, which holds
+// a serialized CobaltConfig such as the output of the config parser.
+func LoadReportConfigIds(path string, customerId, projectId uint32) ([]uint32, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cobaltConfig := &config.CobaltConfig{}
+	if err := proto.Unmarshal(data, cobaltConfig); err != nil {
+		return nil, fmt.Errorf("%s does not hold a serialized CobaltConfig: %v", path, err)
+	}
+
+	var ids []uint32
+	for _, reportConfig := range cobaltConfig.GetReportConfigs() {
+		if reportConfig.GetCustomerId() == customerId && reportConfig.GetProjectId() == projectId {
+			ids = append(ids, reportConfig.GetId())
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
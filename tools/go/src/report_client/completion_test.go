@@ -0,0 +1,100 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"config"
+)
+
+func TestComplete(t *testing.T) {
+	completer := NewCompleter([]uint32{1, 2, 12})
+	for _, test := range []struct {
+		line string
+		want []string
+	}{
+		{"", []string{"fetch ", "get ", "help ", "list ", "quit ", "run "}},
+		{"r", []string{"run "}},
+		{"  q", []string{"  quit "}},
+		{"run ", []string{"run full ", "run range "}},
+		{"run f", []string{"run full "}},
+		{"run full ", []string{"run full 1 ", "run full 2 ", "run full 12 "}},
+		{"run full 1", []string{"run full 1 ", "run full 12 "}},
+		{"run full 12 ", []string{"run full 12 errs "}},
+		{"run range -2 -1 2", []string{"run range -2 -1 2 "}},
+		{"run range -2 -1 2 e", []string{"run range -2 -1 2 errs "}},
+		{"run range -2 ", nil},
+		{"fetch abc ", []string{"fetch abc errs "}},
+		{"fetch ", nil},
+		{"get abc e", []string{"get abc errs "}},
+		{"list ", []string{"list 1 ", "list 2 ", "list 12 "}},
+		{"list 2 ", nil},
+		{"x", nil},
+		{"help ", nil},
+	} {
+		if got := completer.Complete(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Complete(%q): got %q, expected %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestLoadReportConfigIds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report_client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := proto.Marshal(&config.CobaltConfig{
+		ReportConfigs: []*config.ReportConfig{
+			{CustomerId: 1, ProjectId: 2, Id: 7},
+			{CustomerId: 1, ProjectId: 3, Id: 5},
+			{CustomerId: 1, ProjectId: 2, Id: 3},
+			{CustomerId: 2, ProjectId: 2, Id: 4},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.bin")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := LoadReportConfigIds(path, 1, 2)
+	if err != nil {
+		t.Fatalf("LoadReportConfigIds: got error %v", err)
+	}
+	if want := []uint32{3, 7}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, expected %v", ids, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not a proto"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadReportConfigIds(path, 1, 2); err == nil {
+		t.Errorf("LoadReportConfigIds of a corrupted file: got success, expected an error")
+	}
+	if _, err := LoadReportConfigIds(filepath.Join(dir, "missing"), 1, 2); err == nil {
+		t.Errorf("LoadReportConfigIds of a missing file: got success, expected an error")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"strings"
+
+	"analyzer/report_master"
+)
+
+// A ReportRowDelta describes how the count estimate of a report row changed
+// between two runs of the same report.
+type ReportRowDelta struct {
+	// The row key followed by the SystemProfile fields that are set, as in
+	// ReportToStrings.
+	Key []string
+
+	// The count estimates in the two runs. A row missing from a run has a count
+	// estimate of zero.
+	Previous float64
+	Current  float64
+}
+
+// reportRowCounts returns the keys of the rows of |report| sorted by value
+// and a map from the joined keys to the count estimates.
+func reportRowCounts(report *report_master.Report) (keys [][]string, counts map[string]float64) {
+	counts = make(map[string]float64)
+	for _, row := range ReportRowsSortedByValues(report, false) {
+		histogramRow := row.GetHistogram()
+		if histogramRow == nil {
+			continue
+		}
+		rowStrings := HistogramReportRowToStrings(histogramRow)
+		key := rowStrings.keyFields()
+		keys = append(keys, key)
+		counts[strings.Join(key, "\x00")] = math.Max(0, float64(histogramRow.CountEstimate))
+	}
+	return keys, counts
+}
+
+// ReportDelta returns the rows whose count estimate differs between the
+// |previous| and the |current| run of a report. The rows of |current| come
+// first, sorted by value, followed by the rows that only appear in |previous|.
+func ReportDelta(previous, current *report_master.Report) []ReportRowDelta {
+	previousKeys, previousCounts := reportRowCounts(previous)
+	currentKeys, currentCounts := reportRowCounts(current)
+
+	var deltas []ReportRowDelta
+	for _, key := range currentKeys {
+		k := strings.Join(key, "\x00")
+		if delta := (ReportRowDelta{key, previousCounts[k], currentCounts[k]}); delta.Previous != delta.Current {
+			deltas = append(deltas, delta)
+		}
+	}
+	for _, key := range previousKeys {
+		k := strings.Join(key, "\x00")
+		if _, ok := currentCounts[k]; !ok && previousCounts[k] != 0 {
+			deltas = append(deltas, ReportRowDelta{key, previousCounts[k], 0})
+		}
+	}
+	return deltas
+}
+
+// WriteCSVReportDelta writes a comma-separated values representation of
+// |deltas| to the given |writer|. Each line contains the row key, the
+// previous and current count estimates and the difference between them.
+func WriteCSVReportDelta(w io.Writer, deltas []ReportRowDelta) error {
+	csvWriter := csv.NewWriter(w)
+	for _, delta := range deltas {
+		line := append([]string{}, delta.Key...)
+		difference := numberFormat.Format(delta.Current - delta.Previous)
+		if !strings.HasPrefix(difference, "-") {
+			difference = "+" + difference
+		}
+		line = append(line, numberFormat.Format(delta.Previous), numberFormat.Format(delta.Current), difference)
+		if err := csvWriter.Write(line); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
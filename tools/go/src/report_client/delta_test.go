@@ -0,0 +1,69 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"testing"
+
+	"analyzer/report_master"
+	"cobalt"
+)
+
+func makeHistogramReport(counts map[string]float32) *report_master.Report {
+	report := &report_master.Report{
+		Metadata: &report_master.ReportMetadata{
+			State: report_master.ReportState_COMPLETED_SUCCESSFULLY,
+		},
+		Rows: &report_master.ReportRows{},
+	}
+	for value, count := range counts {
+		report.Rows.Rows = append(report.Rows.Rows, &report_master.ReportRow{
+			RowType: &report_master.ReportRow_Histogram{
+				Histogram: &report_master.HistogramReportRow{
+					Value: &cobalt.ValuePart{
+						Data: &cobalt.ValuePart_StringValue{StringValue: value},
+					},
+					CountEstimate: count,
+				},
+			},
+		})
+	}
+	return report
+}
+
+func TestReportDelta(t *testing.T) {
+	previous := makeHistogramReport(map[string]float32{"a": 1, "b": 2, "c": 3})
+	current := makeHistogramReport(map[string]float32{"a": 1, "b": 5, "d": 4})
+
+	deltas := ReportDelta(previous, current)
+	var buffer bytes.Buffer
+	if err := WriteCSVReportDelta(&buffer, deltas); err != nil {
+		t.Fatalf("Error returned from WriteCSVReportDelta: %v", err)
+	}
+	expected := "b,2.000,5.000,+3.000\n" +
+		"d,0.000,4.000,+4.000\n" +
+		"c,3.000,0.000,-3.000\n"
+	if buffer.String() != expected {
+		t.Errorf("Got CSV [%s], expected [%s]", buffer.String(), expected)
+	}
+}
+
+func TestReportDeltaNoChanges(t *testing.T) {
+	report := makeHistogramReport(map[string]float32{"a": 1, "b": 2})
+	if deltas := ReportDelta(report, report); len(deltas) != 0 {
+		t.Errorf("Got deltas %v, expected none", deltas)
+	}
+}
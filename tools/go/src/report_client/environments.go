@@ -0,0 +1,80 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	yaml "github.com/go-yaml/yaml"
+)
+
+// An Environment is a named bundle of the connection settings of a
+// ReportMaster, e.g. "prod", "staging" or "local".
+type Environment struct {
+	ReportMasterURI string `yaml:"report_master_uri"`
+	TLS             bool   `yaml:"tls"`
+	CAFile          string `yaml:"ca_file"`
+	TLSServerName   string `yaml:"tls_server_name"`
+	SkipOauth       bool   `yaml:"skip_oauth"`
+}
+
+// LoadEnvironment reads the environment named |name| from the YAML file at
+// |path|. The file maps the names of the environments to their settings, e.g.
+//
+//	staging:
+//	  report_master_uri: reportmaster.staging.example.com:443
+//	  ca_file: /etc/ssl/staging_ca.pem
+//	tunnel:
+//	  report_master_uri: localhost:8443
+//	  tls: true
+//	  tls_server_name: reportmaster.staging.example.com
+//	local:
+//	  report_master_uri: localhost:7001
+//	  skip_oauth: true
+//
+// An error is returned if the file cannot be read or parsed, or if it does not
+// specify a report_master_uri for the environment.
+func LoadEnvironment(path, name string) (Environment, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Environment{}, err
+	}
+	return parseEnvironment(contents, name)
+}
+
+// parseEnvironment returns the environment named |name| from |yamlEnvs|, the
+// contents of an environments file.
+func parseEnvironment(yamlEnvs []byte, name string) (Environment, error) {
+	envs := map[string]Environment{}
+	if err := yaml.UnmarshalStrict(yamlEnvs, &envs); err != nil {
+		return Environment{}, fmt.Errorf("Invalid environments file: %v", err)
+	}
+	env, ok := envs[name]
+	if !ok {
+		names := make([]string, 0, len(envs))
+		for n := range envs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Environment{}, fmt.Errorf("Unknown environment %q. Known environments: [%s]", name, strings.Join(names, ", "))
+	}
+	if env.ReportMasterURI == "" {
+		return Environment{}, fmt.Errorf("The environment %q does not specify a report_master_uri", name)
+	}
+	return env, nil
+}
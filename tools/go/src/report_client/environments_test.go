@@ -0,0 +1,95 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testEnvironments = `
+prod:
+  report_master_uri: reportmaster.cobalt-api.fuchsia.com:443
+staging:
+  report_master_uri: reportmaster.staging.example.com:8443
+  tls: true
+  ca_file: /etc/ssl/staging_ca.pem
+  tls_server_name: reportmaster.staging.internal
+local:
+  report_master_uri: localhost:7001
+  skip_oauth: true
+nouri:
+  tls: true
+`
+
+func TestParseEnvironment(t *testing.T) {
+	env, err := parseEnvironment([]byte(testEnvironments), "staging")
+	if err != nil {
+		t.Fatalf("parseEnvironment failed: %v", err)
+	}
+	expected := Environment{
+		ReportMasterURI: "reportmaster.staging.example.com:8443",
+		TLS:             true,
+		CAFile:          "/etc/ssl/staging_ca.pem",
+		TLSServerName:   "reportmaster.staging.internal",
+	}
+	if env != expected {
+		t.Errorf("Got environment %+v, expected %+v", env, expected)
+	}
+
+	env, err = parseEnvironment([]byte(testEnvironments), "local")
+	if err != nil {
+		t.Fatalf("parseEnvironment failed: %v", err)
+	}
+	expected = Environment{ReportMasterURI: "localhost:7001", SkipOauth: true}
+	if env != expected {
+		t.Errorf("Got environment %+v, expected %+v", env, expected)
+	}
+
+	for _, name := range []string{"dev", "nouri"} {
+		if _, err := parseEnvironment([]byte(testEnvironments), name); err == nil {
+			t.Errorf("parseEnvironment succeeded for the environment %s", name)
+		}
+	}
+
+	if _, err := parseEnvironment([]byte("prod:\n  report_master_url: localhost:7001\n"), "prod"); err == nil {
+		t.Errorf("parseEnvironment succeeded for an unknown field")
+	}
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	f, err := ioutil.TempFile("", "environments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(testEnvironments); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	env, err := LoadEnvironment(f.Name(), "prod")
+	if err != nil {
+		t.Fatalf("LoadEnvironment failed: %v", err)
+	}
+	if env.ReportMasterURI != "reportmaster.cobalt-api.fuchsia.com:443" {
+		t.Errorf("Got report_master_uri %s", env.ReportMasterURI)
+	}
+
+	if _, err := LoadEnvironment(f.Name()+".missing", "prod"); err == nil {
+		t.Errorf("LoadEnvironment succeeded for a missing file")
+	}
+}
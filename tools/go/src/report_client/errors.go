@@ -0,0 +1,100 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// The errors returned by the methods of ReportClient may be classified with
+// errors.Is() using the following values. Errors that do not match any of
+// them are returned as received from the gRPC stub.
+var (
+	// The ReportMaster does not know the requested report or report
+	// configuration.
+	ErrReportNotFound = errors.New("report not found")
+
+	// The deadline of a request to the ReportMaster expired. Retrying may
+	// succeed.
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+	// The ReportMaster denied access to the project. The error is a
+	// *PermissionDeniedError.
+	ErrPermission = errors.New("permission denied")
+)
+
+// grpcError wraps an error returned by the gRPC stub so that it matches
+// |kind| in errors.Is().
+type grpcError struct {
+	kind error
+	err  error
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, grpc.ErrorDesc(e.err))
+}
+
+func (e *grpcError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *grpcError) Unwrap() error {
+	return e.err
+}
+
+// Is makes a *PermissionDeniedError match ErrPermission.
+func (e *PermissionDeniedError) Is(target error) bool {
+	return target == ErrPermission
+}
+
+func (e *PermissionDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// ReportTerminatedError is returned by GetReport(), together with the report,
+// when the ReportMaster terminated the report without completing it.
+type ReportTerminatedError struct {
+	ReportId string
+
+	// The messages describing why the report was terminated.
+	Messages []string
+}
+
+func (e *ReportTerminatedError) Error() string {
+	return fmt.Sprintf("The report %s was terminated: %s", e.ReportId, strings.Join(e.Messages, "; "))
+}
+
+// checkError classifies an error returned by the gRPC stub as described at
+// ErrReportNotFound. |err| is returned unchanged if it does not match any of
+// the classes.
+func (c *ReportClient) checkError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch grpc.Code(err) {
+	case codes.NotFound:
+		return &grpcError{ErrReportNotFound, err}
+	case codes.DeadlineExceeded:
+		return &grpcError{ErrDeadlineExceeded, err}
+	case codes.PermissionDenied:
+		return c.checkAccessError(err)
+	}
+	return err
+}
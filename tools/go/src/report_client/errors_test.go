@@ -0,0 +1,85 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Tests that errors from the stub are classified.
+func TestErrorClassification(t *testing.T) {
+	reportClient, fakeStub := makeFakeClient()
+
+	cases := []struct {
+		code     codes.Code
+		expected error
+	}{
+		{codes.NotFound, ErrReportNotFound},
+		{codes.DeadlineExceeded, ErrDeadlineExceeded},
+		{codes.PermissionDenied, ErrPermission},
+	}
+	for _, c := range cases {
+		fakeStub.err = grpc.Errorf(c.code, "oops")
+		_, err := reportClient.GetReport(context.Background(), "my-report-id", 0)
+		if !errors.Is(err, c.expected) {
+			t.Errorf("GetReport() returned %v for %v, expected %v", err, c.code, c.expected)
+		}
+		if grpc.Code(errors.Unwrap(err)) != c.code {
+			t.Errorf("The error %v for %v does not wrap the gRPC error", err, c.code)
+		}
+		_, err = reportClient.StartReport(context.Background(), reportConfigId, firstDayIndex, lastDayIndex)
+		if !errors.Is(err, c.expected) {
+			t.Errorf("StartReport() returned %v for %v, expected %v", err, c.code, c.expected)
+		}
+	}
+
+	var permissionDenied *PermissionDeniedError
+	fakeStub.err = grpc.Errorf(codes.PermissionDenied, "no access")
+	if _, err := reportClient.GetReport(context.Background(), "my-report-id", 0); !errors.As(err, &permissionDenied) {
+		t.Errorf("GetReport() returned %v, expected a PermissionDeniedError", err)
+	}
+
+	// Other errors are passed through.
+	fakeStub.err = grpc.Errorf(codes.Unavailable, "unavailable")
+	if _, err := reportClient.GetReport(context.Background(), "my-report-id", 0); err != fakeStub.err {
+		t.Errorf("GetReport() returned %v, expected %v", err, fakeStub.err)
+	}
+}
+
+// Tests that GetReport() returns a terminated report together with a
+// ReportTerminatedError.
+func TestGetReportTerminated(t *testing.T) {
+	reportClient, fakeStub := makeFakeClient()
+	fakeStub.report = &failedReportAssociated
+	report, err := reportClient.GetReport(context.Background(), "my-report-id", 0)
+	if report != &failedReportAssociated {
+		t.Errorf("report != failedReportAssociated")
+	}
+
+	var terminated *ReportTerminatedError
+	if !errors.As(err, &terminated) {
+		t.Fatalf("GetReport() returned %v, expected a ReportTerminatedError", err)
+	}
+	expected := []string{"Error message associated line 1", "Error message associated line 2"}
+	if terminated.ReportId != "my-report-id" || !reflect.DeepEqual(terminated.Messages, expected) {
+		t.Errorf("Got %v, expected the messages %v of my-report-id", terminated, expected)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"analyzer/report_master"
+)
+
+// UnfinalizedDays returns the interval [first, last] of the day indices
+// covered by the report with the given |metadata| that the ReportMaster does
+// not yet consider finalized on the day with index |currentDayIndex| in UTC.
+// The results of a report for those days may still change as more Observations
+// arrive. Days after |currentDayIndex| are not included in the interval. If all
+// of the covered days are finalized then |ok| is false.
+func UnfinalizedDays(metadata *report_master.ReportMetadata, currentDayIndex uint32) (first uint32, last uint32, ok bool) {
+	// The ReportMaster considers day d to be finalized if
+	// d <= currentDayIndex - report_finalization_days.
+	first = metadata.FirstDayIndex
+	if finalizationDays := metadata.ReportFinalizationDays; currentDayIndex >= finalizationDays &&
+		first <= currentDayIndex-finalizationDays {
+		first = currentDayIndex - finalizationDays + 1
+	}
+	last = metadata.LastDayIndex
+	if last > currentDayIndex {
+		last = currentDayIndex
+	}
+	return first, last, first <= last
+}
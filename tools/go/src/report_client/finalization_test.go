@@ -0,0 +1,58 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"math"
+	"testing"
+
+	"analyzer/report_master"
+)
+
+func TestUnfinalizedDays(t *testing.T) {
+	const today = 100
+	testCases := []struct {
+		firstDayIndex, lastDayIndex, finalizationDays uint32
+		expectedFirst, expectedLast                   uint32
+		expectedOk                                    bool
+	}{
+		// All days are finalized.
+		{90, 95, 3, 90, 95, false},
+		{90, 97, 3, 90, 97, false},
+		// The last days are not finalized.
+		{90, 98, 3, 98, 98, true},
+		{90, 100, 3, 98, 100, true},
+		// Days after today are not included.
+		{0, math.MaxUint32, 3, 98, 100, true},
+		// No day is finalized.
+		{99, 100, 3, 99, 100, true},
+		{0, 10, 200, 0, 10, true},
+		// Without a finalization period only future days are not finalized.
+		{90, 100, 0, 90, 100, false},
+	}
+	for _, tc := range testCases {
+		metadata := &report_master.ReportMetadata{
+			FirstDayIndex:          tc.firstDayIndex,
+			LastDayIndex:           tc.lastDayIndex,
+			ReportFinalizationDays: tc.finalizationDays,
+		}
+		first, last, ok := UnfinalizedDays(metadata, today)
+		if ok != tc.expectedOk || (ok && (first != tc.expectedFirst || last != tc.expectedLast)) {
+			t.Errorf("UnfinalizedDays([%d, %d], %d days): got (%d, %d, %v), expected (%d, %d, %v)",
+				tc.firstDayIndex, tc.lastDayIndex, tc.finalizationDays, first, last, ok,
+				tc.expectedFirst, tc.expectedLast, tc.expectedOk)
+		}
+	}
+}
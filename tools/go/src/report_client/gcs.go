@@ -0,0 +1,84 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	"golang.org/x/net/context"
+
+	"util/gcs"
+)
+
+// A GCSOutput uploads reports to Google Cloud Storage.
+type GCSOutput struct {
+	uploader *gcs.Uploader
+	bucket   string
+	object   string
+	compress bool
+}
+
+// NewGCSOutput returns a GCSOutput that uploads reports to the object named by
+// |path| of the form gs://<bucket>/<object>, using the application default
+// credentials. If |compress| is true the reports are compressed with gzip.
+func NewGCSOutput(path string, compress bool) (*GCSOutput, error) {
+	bucket, object, err := gcs.ParseObject(path)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := gcs.NewDefaultUploader()
+	if err != nil {
+		return nil, err
+	}
+	return &GCSOutput{
+		uploader: uploader,
+		bucket:   bucket,
+		object:   object,
+		compress: compress,
+	}, nil
+}
+
+// Object returns the name of the object given to NewGCSOutput(). The names of
+// the objects to which other reports are uploaded may be derived from it, e.g.
+// with ReportConfigFileName().
+func (o *GCSOutput) Object() string {
+	return o.object
+}
+
+// URL returns the gs:// URL of |object| in the bucket of |o|.
+func (o *GCSOutput) URL(object string) string {
+	return gcs.Prefix + o.bucket + "/" + object
+}
+
+// Upload writes |data| with the content type |contentType| to |object| in the
+// bucket of |o|, replacing the object if it exists. If |o| compresses the
+// reports the object is stored compressed with gzip and its content encoding
+// is set accordingly, so that Cloud Storage decompresses it for the clients
+// that do not accept gzip.
+func (o *GCSOutput) Upload(ctx context.Context, object string, data []byte, contentType string) error {
+	if !o.compress {
+		return o.uploader.Upload(ctx, o.bucket, object, bytes.NewReader(data), contentType, "")
+	}
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+	return o.uploader.Upload(ctx, o.bucket, object, &buffer, contentType, "gzip")
+}
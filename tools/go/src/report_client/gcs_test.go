@@ -0,0 +1,88 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"util/gcs"
+)
+
+// fakeGCSAPI records the last upload made to the Cloud Storage API.
+type fakeGCSAPI struct {
+	request     string
+	contentType string
+	body        []byte
+	status      int
+}
+
+func (f *fakeGCSAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.request = r.Method + " " + r.URL.RequestURI()
+	f.contentType = r.Header.Get("Content-Type")
+	f.body, _ = ioutil.ReadAll(r.Body)
+	w.WriteHeader(f.status)
+	w.Write([]byte("{}"))
+}
+
+func TestGCSOutputUpload(t *testing.T) {
+	fake := &fakeGCSAPI{status: http.StatusOK}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	o := &GCSOutput{
+		uploader: gcs.NewUploader(server.Client(), server.URL+"/"),
+		bucket:   "bucket",
+		object:   "daily/report.csv",
+	}
+	if o.URL(o.Object()) != "gs://bucket/daily/report.csv" {
+		t.Errorf("Got URL %s", o.URL(o.Object()))
+	}
+
+	if err := o.Upload(context.Background(), o.Object(), []byte("a,b\n"), "text/csv"); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	if expected := "POST /b/bucket/o?uploadType=media&name=daily%2Freport.csv"; fake.request != expected {
+		t.Errorf("Got request %s, expected %s", fake.request, expected)
+	}
+	if fake.contentType != "text/csv" || string(fake.body) != "a,b\n" {
+		t.Errorf("Got content type %s and body %q", fake.contentType, fake.body)
+	}
+
+	o.compress = true
+	if err := o.Upload(context.Background(), "report.json", []byte("{}"), "application/json"); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	if expected := "POST /b/bucket/o?uploadType=media&name=report.json&contentEncoding=gzip"; fake.request != expected {
+		t.Errorf("Got request %s, expected %s", fake.request, expected)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(fake.body))
+	if err != nil {
+		t.Fatalf("The uploaded object is not compressed: %v", err)
+	}
+	if data, err := ioutil.ReadAll(reader); err != nil || string(data) != "{}" || fake.contentType != "application/json" {
+		t.Errorf("Got content type %s and decompressed body %q, %v", fake.contentType, data, err)
+	}
+
+	fake.status = http.StatusForbidden
+	if err := o.Upload(context.Background(), o.Object(), []byte("a,b\n"), "text/csv"); err == nil {
+		t.Errorf("Upload() succeeded with status 403")
+	}
+}
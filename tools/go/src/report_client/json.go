@@ -0,0 +1,135 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+
+	"analyzer/report_master"
+)
+
+// A JSONReport is the representation of a report written by WriteJSONReport.
+type JSONReport struct {
+	Metadata JSONReportMetadata `json:"metadata"`
+	Rows     []JSONReportRow    `json:"rows"`
+}
+
+// JSONReportMetadata describes a report in a JSONReport.
+type JSONReportMetadata struct {
+	ReportId       string `json:"report_id"`
+	CustomerId     uint32 `json:"customer_id"`
+	ProjectId      uint32 `json:"project_id"`
+	ReportConfigId uint32 `json:"report_config_id"`
+	State          string `json:"state"`
+
+	FirstDayIndex uint32 `json:"first_day_index"`
+	LastDayIndex  uint32 `json:"last_day_index"`
+
+	// The UTC dates of the first and the last day of the report in the form
+	// 2006-01-02, or "unbounded".
+	FirstDay string `json:"first_day"`
+	LastDay  string `json:"last_day"`
+}
+
+// A JSONReportRow is a row of a report in a JSONReport. Its fields are those
+// of a row written by WriteCSVReport, except that the count estimate and the
+// std error are numbers rather than formatted strings.
+type JSONReportRow struct {
+	Key           string   `json:"key"`
+	Key2          string   `json:"key2,omitempty"`
+	SystemProfile []string `json:"system_profile,omitempty"`
+	CountEstimate float64  `json:"count_estimate"`
+
+	// Set only if the std error is included.
+	StdError *float64 `json:"std_error,omitempty"`
+}
+
+// NewJSONReport returns the JSONReport for |report|. Its rows are the rows
+// written by WriteCSVReport, in the same order.
+func NewJSONReport(report *report_master.Report, includeStdErr bool) JSONReport {
+	metadata := report.GetMetadata()
+	jsonReport := JSONReport{
+		Metadata: JSONReportMetadata{
+			ReportId:       metadata.GetReportId(),
+			CustomerId:     metadata.GetCustomerId(),
+			ProjectId:      metadata.GetProjectId(),
+			ReportConfigId: metadata.GetReportConfigId(),
+			State:          metadata.GetState().String(),
+			FirstDayIndex:  metadata.GetFirstDayIndex(),
+			LastDayIndex:   metadata.GetLastDayIndex(),
+			FirstDay:       dayIndexToDate(metadata.GetFirstDayIndex(), 0),
+			LastDay:        dayIndexToDate(metadata.GetLastDayIndex(), math.MaxUint32),
+		},
+		Rows: []JSONReportRow{},
+	}
+
+	for _, row := range ReportRowsSortedByValues(report, includeStdErr) {
+		histogramRow := row.GetHistogram()
+		if histogramRow == nil {
+			continue
+		}
+		rowStrings := HistogramReportRowToStrings(histogramRow)
+		if rowStrings.isEmpty {
+			continue
+		}
+		jsonRow := JSONReportRow{
+			Key:           rowStrings.rowKey,
+			Key2:          rowStrings.rowKey2,
+			SystemProfile: rowStrings.systemProfileFields,
+			CountEstimate: math.Max(0, float32ToFloat64(histogramRow.CountEstimate)),
+		}
+		if includeStdErr {
+			stdError := float32ToFloat64(histogramRow.StdError)
+			jsonRow.StdError = &stdError
+		}
+		jsonReport.Rows = append(jsonReport.Rows, jsonRow)
+	}
+	return jsonReport
+}
+
+// float32ToFloat64 returns the float64 with the shortest decimal
+// representation that rounds to |x|, e.g. 0.1 rather than 0.10000000149.
+func float32ToFloat64(x float32) float64 {
+	f, err := strconv.ParseFloat(strconv.FormatFloat(float64(x), 'g', -1, 32), 64)
+	if err != nil {
+		return float64(x)
+	}
+	return f
+}
+
+// WriteJSONReport writes the JSONReport for the given |report| to the given
+// |writer| as an indented JSON object followed by a newline.
+func WriteJSONReport(w io.Writer, report *report_master.Report, includeStdErr bool) error {
+	b, err := json.MarshalIndent(NewJSONReport(report, includeStdErr), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// WriteJSONReportToString returns the JSONReport for the given |report| as
+// written by WriteJSONReport.
+func WriteJSONReportToString(report *report_master.Report, includeStdErr bool) (string, error) {
+	var buffer bytes.Buffer
+	if err := WriteJSONReport(&buffer, report, includeStdErr); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"analyzer/report_master"
+)
+
+// Tests that WriteJSONReportToString writes the metadata and the rows of a
+// report in the order of WriteCSVReport.
+func TestWriteJSONReport(t *testing.T) {
+	report := successfulReport
+	report.Metadata = &report_master.ReportMetadata{
+		ReportId:       "report-id",
+		CustomerId:     customerId,
+		ProjectId:      projectId,
+		ReportConfigId: reportConfigId,
+		State:          report_master.ReportState_COMPLETED_SUCCESSFULLY,
+		FirstDayIndex:  17532,
+		LastDayIndex:   math.MaxUint32,
+	}
+
+	includeStdErr := true
+	s, err := WriteJSONReportToString(&report, includeStdErr)
+	if err != nil {
+		t.Fatalf("Error returned from WriteJSONReportToString: %v", err)
+	}
+	var jsonReport JSONReport
+	if err := json.Unmarshal([]byte(s), &jsonReport); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", s, err)
+	}
+
+	expectedMetadata := JSONReportMetadata{
+		ReportId:       "report-id",
+		CustomerId:     customerId,
+		ProjectId:      projectId,
+		ReportConfigId: reportConfigId,
+		State:          "COMPLETED_SUCCESSFULLY",
+		FirstDayIndex:  17532,
+		LastDayIndex:   math.MaxUint32,
+		FirstDay:       "2018-01-01",
+		LastDay:        "unbounded",
+	}
+	if jsonReport.Metadata != expectedMetadata {
+		t.Errorf("Got metadata %+v, expected %+v", jsonReport.Metadata, expectedMetadata)
+	}
+
+	expectedKeys := []string{"String Value 11", "String Value 2", "42", "43", "<index 1>", "Label-for-index-2"}
+	expectedCounts := []float64{103.3, 102.2, 101.1, 104.4, 103.4, 101.2}
+	if len(jsonReport.Rows) != len(expectedKeys) {
+		t.Fatalf("Got %d rows, expected %d: %s", len(jsonReport.Rows), len(expectedKeys), s)
+	}
+	for i, row := range jsonReport.Rows {
+		if row.Key != expectedKeys[i] || row.CountEstimate != expectedCounts[i] {
+			t.Errorf("Got row %d %+v, expected key %s and count estimate %v", i, row, expectedKeys[i], expectedCounts[i])
+		}
+		if row.StdError == nil || *row.StdError != 3.14 {
+			t.Errorf("Got std error %v in row %d, expected 3.14", row.StdError, i)
+		}
+	}
+
+	// Without the std error the field is omitted.
+	includeStdErr = false
+	jsonReport = NewJSONReport(&report, includeStdErr)
+	for i, row := range jsonReport.Rows {
+		if row.StdError != nil {
+			t.Errorf("Got std error %v in row %d, expected none", *row.StdError, i)
+		}
+	}
+}
+
+// Tests that a report without rows has an empty list of rows rather than null.
+func TestWriteJSONReportNoRows(t *testing.T) {
+	report := report_master.Report{Metadata: &report_master.ReportMetadata{}}
+	s, err := WriteJSONReportToString(&report, false)
+	if err != nil {
+		t.Fatalf("Error returned from WriteJSONReportToString: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &fields); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", s, err)
+	}
+	if rows, ok := fields["rows"].([]interface{}); !ok || len(rows) != 0 {
+		t.Errorf("Got rows %v, expected []", fields["rows"])
+	}
+	if _, ok := fields["metadata"].(map[string]interface{}); !ok {
+		t.Errorf("Got no metadata in %s", s)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"time"
+
+	"analyzer/report_master"
+)
+
+// ReportOutcome describes how waiting for a report in GetReport() ended.
+type ReportOutcome int
+
+const (
+	// The report completed successfully.
+	ReportCompleted ReportOutcome = iota
+	// The report was terminated by the ReportMaster, or an error occurred
+	// while starting or fetching it.
+	ReportFailed
+	// The report was still in progress when the maximum wait time elapsed.
+	ReportTimedOut
+)
+
+func (o ReportOutcome) String() string {
+	switch o {
+	case ReportCompleted:
+		return "completed"
+	case ReportFailed:
+		return "failed"
+	case ReportTimedOut:
+		return "timed_out"
+	}
+	return "unknown"
+}
+
+// ReportMetrics is an optional hook that allows a long-running service that
+// embeds a ReportClient to export metrics about the health of the report
+// pipeline to its own metrics registry. For example a Prometheus-backed
+// implementation would increment a counter in ReportStarted() and a counter
+// labeled by |outcome| and a histogram of |wait| in ReportFinished().
+//
+// The methods may be invoked concurrently if the ReportClient is used
+// concurrently.
+type ReportMetrics interface {
+	// ReportStarted is invoked each time a report is successfully started.
+	ReportStarted(reportConfigId uint32)
+
+	// ReportFinished is invoked each time StartReport() fails, in which case
+	// |wait| is zero, and each time GetReport() returns. |reportConfigId| is
+	// zero if it is not known because the report could not be fetched.
+	ReportFinished(reportConfigId uint32, outcome ReportOutcome, wait time.Duration)
+}
+
+// SetMetrics installs |metrics| as the ReportMetrics of |c|. Passing nil
+// disables metrics.
+func (c *ReportClient) SetMetrics(metrics ReportMetrics) {
+	c.metrics = metrics
+}
+
+// recordStarted notifies |c.metrics|, if set, that a report was started or
+// failed to start.
+func (c *ReportClient) recordStarted(reportConfigId uint32, err error) {
+	if c.metrics == nil {
+		return
+	}
+	if err != nil {
+		c.metrics.ReportFinished(reportConfigId, ReportFailed, 0)
+		return
+	}
+	c.metrics.ReportStarted(reportConfigId)
+}
+
+// recordFinished notifies |c.metrics|, if set, of the result of waiting for
+// |wait| for a report.
+func (c *ReportClient) recordFinished(report *report_master.Report, err error, wait time.Duration) {
+	if c.metrics == nil {
+		return
+	}
+	var reportConfigId uint32
+	if report != nil && report.Metadata != nil {
+		reportConfigId = report.Metadata.ReportConfigId
+	}
+
+	outcome := ReportFailed
+	if err == nil {
+		switch report.Metadata.State {
+		case report_master.ReportState_COMPLETED_SUCCESSFULLY:
+			outcome = ReportCompleted
+		case report_master.ReportState_IN_PROGRESS, report_master.ReportState_WAITING_TO_START:
+			outcome = ReportTimedOut
+		}
+	}
+	c.metrics.ReportFinished(reportConfigId, outcome, wait)
+}
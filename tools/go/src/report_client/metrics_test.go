@@ -0,0 +1,87 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"analyzer/report_master"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// fakeReportMetrics implements ReportMetrics by recording its invocations.
+type fakeReportMetrics struct {
+	started  []uint32
+	finished []ReportOutcome
+	waits    []time.Duration
+}
+
+func (f *fakeReportMetrics) ReportStarted(reportConfigId uint32) {
+	f.started = append(f.started, reportConfigId)
+}
+
+func (f *fakeReportMetrics) ReportFinished(reportConfigId uint32, outcome ReportOutcome, wait time.Duration) {
+	f.finished = append(f.finished, outcome)
+	f.waits = append(f.waits, wait)
+}
+
+// Tests that the ReportMetrics hook is notified of started and finished
+// reports.
+func TestReportMetrics(t *testing.T) {
+	reportClient, fakeStub := makeFakeClient()
+	metrics := &fakeReportMetrics{}
+	reportClient.SetMetrics(metrics)
+
+	if _, err := reportClient.StartReport(context.Background(), reportConfigId, firstDayIndex, lastDayIndex); err != nil {
+		t.Fatalf("Error returned from StartReport: %v", err)
+	}
+	if !reflect.DeepEqual(metrics.started, []uint32{reportConfigId}) {
+		t.Errorf("started=%v", metrics.started)
+	}
+
+	fakeStub.report = &successfulReport
+	reportClient.GetReport(context.Background(), "my-report-id", 0)
+
+	inProgressReport := report_master.Report{
+		Metadata: &report_master.ReportMetadata{
+			State: report_master.ReportState_IN_PROGRESS,
+		},
+	}
+	fakeStub.report = &inProgressReport
+	reportClient.GetReport(context.Background(), "my-report-id", 0)
+
+	// Fetching the associated reports is not recorded.
+	fakeStub.report = &failedReportAssociated
+	reportClient.ReportErrorsToStrings(context.Background(), &failedReportPrimary, true)
+
+	fakeStub.err = grpc.Errorf(codes.Unavailable, "unavailable")
+	reportClient.GetReport(context.Background(), "my-report-id", 0)
+	reportClient.StartReport(context.Background(), reportConfigId, firstDayIndex, lastDayIndex)
+
+	expected := []ReportOutcome{ReportCompleted, ReportTimedOut, ReportFailed, ReportFailed}
+	if !reflect.DeepEqual(metrics.finished, expected) {
+		t.Errorf("finished=%v, expected %v", metrics.finished, expected)
+	}
+	if len(metrics.started) != 1 {
+		t.Errorf("started=%v", metrics.started)
+	}
+	if metrics.waits[3] != 0 {
+		t.Errorf("wait for a failed StartReport=%v", metrics.waits[3])
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"analyzer/report_master"
+)
+
+// The maximum number of reports that RunReports() starts and polls at the
+// same time, so that running all the reports of a project does not overload
+// the ReportMaster.
+const maxConcurrentReports = 8
+
+// A ReportSpec specifies a report to be run by RunReports(): the ReportConfig
+// and the interval of day indices covered by the report.
+type ReportSpec struct {
+	ReportConfigId uint32
+	FirstDayIndex  uint32
+	LastDayIndex   uint32
+}
+
+// A ReportResult is the outcome of running a ReportSpec, as returned by
+// StartReport() and GetReport(). If the report was started but did not
+// complete within the deadline |Report| is in progress and |Err| is nil. If
+// the report was terminated both |Report| and a *ReportTerminatedError are
+// set.
+type ReportResult struct {
+	ReportId string
+	Report   *report_master.Report
+	Err      error
+}
+
+// RunReports starts the reports in |specs| concurrently and polls them until
+// each one is finished or until the shared deadline |wait| after the
+// invocation passes, whichever comes first. At most maxConcurrentReports
+// reports are in flight at the same time. Returns the result of each distinct
+// spec. All of the reports are abandoned if |ctx| is cancelled.
+func (c *ReportClient) RunReports(ctx context.Context, specs []ReportSpec, wait time.Duration) map[ReportSpec]*ReportResult {
+	deadline := time.Now().Add(wait)
+	results := map[ReportSpec]*ReportResult{}
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, maxConcurrentReports)
+
+	for _, spec := range specs {
+		if _, ok := results[spec]; ok {
+			continue
+		}
+		result := &ReportResult{}
+		results[spec] = result
+
+		wg.Add(1)
+		go func(spec ReportSpec, result *ReportResult) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			reportId, err := c.StartReport(ctx, spec.ReportConfigId, spec.FirstDayIndex, spec.LastDayIndex)
+			var report *report_master.Report
+			if err == nil {
+				remaining := time.Until(deadline)
+				if remaining < 0 {
+					remaining = 0
+				}
+				report, err = c.GetReport(ctx, reportId, remaining)
+			}
+
+			// Each goroutine writes only its own result.
+			result.ReportId = reportId
+			result.Report = report
+			result.Err = err
+		}(spec, result)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// ReportConfigFileName returns the name of the file to which the report for
+// the ReportConfig with |reportConfigId| is written if several reports are run
+// together and |fileName| is specified, e.g. "report.config-3.csv" for
+// "report.csv".
+func ReportConfigFileName(fileName string, reportConfigId uint32) string {
+	ext := filepath.Ext(fileName)
+	return fmt.Sprintf("%s.config-%d%s", strings.TrimSuffix(fileName, ext), reportConfigId, ext)
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"analyzer/report_master"
+)
+
+// concurrentReportMasterStub is a ReportMasterStub that may be used
+// concurrently. Reports of the ReportConfig |failingConfigId| fail to start
+// and reports of |slowConfigId| never complete. The other reports complete
+// successfully.
+type concurrentReportMasterStub struct {
+	failingConfigId uint32
+	slowConfigId    uint32
+
+	mu       sync.Mutex
+	started  int
+	inFlight int
+	maxIn    int
+}
+
+func (f *concurrentReportMasterStub) StartReport(ctx context.Context, request *report_master.StartReportRequest) (*report_master.StartReportResponse, error) {
+	f.mu.Lock()
+	f.started++
+	f.inFlight++
+	if f.inFlight > f.maxIn {
+		f.maxIn = f.inFlight
+	}
+	f.mu.Unlock()
+
+	if request.ReportConfigId == f.failingConfigId {
+		f.done()
+		return nil, errors.New("unavailable")
+	}
+	return &report_master.StartReportResponse{ReportId: fmt.Sprintf("report-%d", request.ReportConfigId)}, nil
+}
+
+func (f *concurrentReportMasterStub) GetReport(ctx context.Context, request *report_master.GetReportRequest) (*report_master.Report, error) {
+	state := report_master.ReportState_COMPLETED_SUCCESSFULLY
+	if request.ReportId == fmt.Sprintf("report-%d", f.slowConfigId) {
+		state = report_master.ReportState_IN_PROGRESS
+	} else {
+		f.done()
+	}
+	return &report_master.Report{Metadata: &report_master.ReportMetadata{ReportId: request.ReportId, State: state}}, nil
+}
+
+func (f *concurrentReportMasterStub) QueryReports(ctx context.Context, request *report_master.QueryReportsRequest) ([]*report_master.ReportMetadata, error) {
+	return nil, nil
+}
+
+func (f *concurrentReportMasterStub) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+}
+
+// Tests that RunReports() returns the result of each report.
+func TestRunReports(t *testing.T) {
+	stub := &concurrentReportMasterStub{failingConfigId: 2, slowConfigId: 3}
+	reportClient := &ReportClient{CustomerId: customerId, ProjectId: projectId, stub: stub}
+	reportClient.SetMaxPollInterval(10 * time.Millisecond)
+
+	specs := []ReportSpec{
+		{ReportConfigId: 1, FirstDayIndex: 10, LastDayIndex: 11},
+		{ReportConfigId: 2, FirstDayIndex: 10, LastDayIndex: 11},
+		{ReportConfigId: 3, FirstDayIndex: 10, LastDayIndex: 11},
+		{ReportConfigId: 1, FirstDayIndex: 10, LastDayIndex: 11},
+	}
+	results := reportClient.RunReports(context.Background(), specs, 50*time.Millisecond)
+
+	if len(results) != 3 || stub.started != 3 {
+		t.Fatalf("Got %d results for %d started reports, expected 3 for 3", len(results), stub.started)
+	}
+	if r := results[specs[0]]; r.Err != nil || r.Report.Metadata.State != report_master.ReportState_COMPLETED_SUCCESSFULLY {
+		t.Errorf("Got result %+v for report config 1, expected a completed report", r)
+	}
+	if r := results[specs[1]]; r.Err == nil || r.Report != nil {
+		t.Errorf("Got result %+v for report config 2, expected an error", r)
+	}
+	if r := results[specs[2]]; r.Err != nil || r.ReportId != "report-3" || r.Report.Metadata.State != report_master.ReportState_IN_PROGRESS {
+		t.Errorf("Got result %+v for report config 3, expected a report in progress", r)
+	}
+}
+
+// Tests that RunReports() limits the number of reports in flight.
+func TestRunReportsConcurrencyLimit(t *testing.T) {
+	stub := &concurrentReportMasterStub{}
+	reportClient := &ReportClient{CustomerId: customerId, ProjectId: projectId, stub: stub}
+
+	var specs []ReportSpec
+	for i := uint32(1); i <= 3*maxConcurrentReports; i++ {
+		specs = append(specs, ReportSpec{ReportConfigId: i})
+	}
+	results := reportClient.RunReports(context.Background(), specs, time.Second)
+
+	if len(results) != len(specs) {
+		t.Errorf("Got %d results, expected %d", len(results), len(specs))
+	}
+	if stub.maxIn > maxConcurrentReports {
+		t.Errorf("Got %d reports in flight, expected at most %d", stub.maxIn, maxConcurrentReports)
+	}
+}
+
+func TestReportConfigFileName(t *testing.T) {
+	if name := ReportConfigFileName("out/report.csv", 3); name != "out/report.config-3.csv" {
+		t.Errorf("Got %s", name)
+	}
+}
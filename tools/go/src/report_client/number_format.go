@@ -0,0 +1,72 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A NumberFormat specifies how the count estimates and standard errors of
+// report rows are formatted.
+type NumberFormat struct {
+	// The number of digits after the decimal separator.
+	Precision int
+
+	// Separates the integer part of a number from its fraction, e.g. "," for
+	// consumers in locales that expect comma decimals.
+	DecimalSeparator string
+
+	// If true, numbers without a fraction are formatted as integers
+	// regardless of |Precision|.
+	IntegersForWholeNumbers bool
+}
+
+// DefaultNumberFormat is the format used unless SetNumberFormat() is invoked.
+var DefaultNumberFormat = NumberFormat{
+	Precision:        3,
+	DecimalSeparator: ".",
+}
+
+var numberFormat = DefaultNumberFormat
+
+// SetNumberFormat sets the format of the numbers in the strings returned by
+// HistogramReportRowToStrings() and thereby of the reports written by this
+// package. It should be invoked before any report is formatted.
+func SetNumberFormat(format NumberFormat) {
+	if format.Precision < 0 {
+		panic("negative precision")
+	}
+	numberFormat = format
+}
+
+// Format returns |x| formatted according to |f|.
+func (f NumberFormat) Format(x float64) string {
+	precision := f.Precision
+	if f.IntegersForWholeNumbers && x == math.Trunc(x) {
+		precision = 0
+	}
+	s := strconv.FormatFloat(x, 'f', precision, 64)
+	if f.DecimalSeparator != "." {
+		s = strings.Replace(s, ".", f.DecimalSeparator, 1)
+	}
+	return s
+}
+
+// isZero returns true if |x| is zero when rounded to the precision of |f|.
+func (f NumberFormat) isZero(x float64) bool {
+	return strconv.FormatFloat(math.Abs(x), 'f', f.Precision, 64) == strconv.FormatFloat(0, 'f', f.Precision, 64)
+}
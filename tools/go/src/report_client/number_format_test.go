@@ -0,0 +1,68 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"testing"
+
+	"analyzer/report_master"
+)
+
+func TestNumberFormat(t *testing.T) {
+	cases := []struct {
+		format   NumberFormat
+		x        float64
+		expected string
+	}{
+		{DefaultNumberFormat, 101.1, "101.100"},
+		{DefaultNumberFormat, 7, "7.000"},
+		{NumberFormat{Precision: 1, DecimalSeparator: ","}, 3.14, "3,1"},
+		{NumberFormat{Precision: 0, DecimalSeparator: "."}, 2.5, "2"},
+		{NumberFormat{Precision: 2, DecimalSeparator: ".", IntegersForWholeNumbers: true}, 7, "7"},
+		{NumberFormat{Precision: 2, DecimalSeparator: ",", IntegersForWholeNumbers: true}, 7.25, "7,25"},
+	}
+	for _, c := range cases {
+		if got := c.format.Format(c.x); got != c.expected {
+			t.Errorf("%+v.Format(%v) = %q, expected %q", c.format, c.x, got, c.expected)
+		}
+	}
+}
+
+// Tests that HistogramReportRowToStrings() uses the format passed to
+// SetNumberFormat().
+func TestSetNumberFormat(t *testing.T) {
+	defer SetNumberFormat(DefaultNumberFormat)
+	SetNumberFormat(NumberFormat{Precision: 1, DecimalSeparator: ",", IntegersForWholeNumbers: true})
+
+	rowStrings := HistogramReportRowToStrings(&report_master.HistogramReportRow{
+		Label:         "label",
+		CountEstimate: 12,
+		StdError:      0.24,
+	})
+	if rowStrings.countEstimate != "12" || rowStrings.stdError != "0,2" {
+		t.Errorf("Got count estimate %q and std error %q, expected \"12\" and \"0,2\"",
+			rowStrings.countEstimate, rowStrings.stdError)
+	}
+
+	// A row that is empty by the heuristic of HistogramReportRowToStrings() is
+	// detected in any format.
+	rowStrings = HistogramReportRowToStrings(&report_master.HistogramReportRow{
+		Value:         &indexValuePart2,
+		CountEstimate: 0.01,
+	})
+	if !rowStrings.isEmpty {
+		t.Errorf("A row with an index and a count estimate of %q is not empty", rowStrings.countEstimate)
+	}
+}
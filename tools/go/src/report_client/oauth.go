@@ -34,6 +34,14 @@
 // from the tokens returned by the TokenSource and passes those on.
 //
 // This jwtSource is was is used by gRPC to authenticate the user.
+//
+// Google Sheets:
+// --------------
+//
+// Exporting reports to Google Sheets (see sheets.go) requires access to the
+// spreadsheets of the user, which is authorized separately by the same flow.
+// That refresh token is stored at ~/.cobalt_report_client_sheets_oauth_token_file
+// and the access tokens it yields are used directly rather than JWTs.
 package report_client
 
 import (
@@ -63,16 +71,28 @@ const (
 	clientSecret            = "0iEvP5a_yzI1q42c3LMxzKAj"
 	refreshTokenPathEnv     = "COBALT_REPORT_CLIENT_OAUTH_TOKEN_FILE"
 	refreshTokenPathDefault = ".cobalt_report_client_oauth_token_file"
+
+	sheetsRefreshTokenPathDefault = ".cobalt_report_client_sheets_oauth_token_file"
+	sheetsScope                   = "https://www.googleapis.com/auth/spreadsheets"
 )
 
 // Returns a TokenSource that vends JWT bearer tokens.
 func getTokenSource() oauth2.TokenSource {
 	c := getOauthConfig()
-	r := getRefreshToken(context.Background(), c)
+	r := getRefreshToken(context.Background(), c, getRefreshTokenFilePath())
 	s := c.TokenSource(context.Background(), r)
 	return jwtSource{s: s}
 }
 
+// Returns a TokenSource that vends access tokens for the Google Sheets API.
+func getSheetsTokenSource() oauth2.TokenSource {
+	c := getOauthConfig()
+	c.Scopes = []string{sheetsScope}
+	path := filepath.Join(os.Getenv("HOME"), sheetsRefreshTokenPathDefault)
+	r := getRefreshToken(context.Background(), c, path)
+	return c.TokenSource(context.Background(), r)
+}
+
 // getOauthConfig returns a pointer to a pre-defined oauth2.Config.
 func getOauthConfig() *oauth2.Config {
 	return &oauth2.Config{
@@ -83,11 +103,11 @@ func getOauthConfig() *oauth2.Config {
 	}
 }
 
-// getRefreshToken will try to get the refresh token stored on disk. If no such
-// token is to be found, it initiates the authorization flow.
-func getRefreshToken(ctx context.Context, c *oauth2.Config) *oauth2.Token {
+// getRefreshToken will try to get the refresh token stored on disk at |path|.
+// If no such token is to be found, it initiates the authorization flow.
+func getRefreshToken(ctx context.Context, c *oauth2.Config, path string) *oauth2.Token {
 	// First, we try to get the refresh token from disk.
-	t := getRefreshTokenFromFile()
+	t := getRefreshTokenFromFile(path)
 	if t != nil {
 		// We force the contained bearer token to expire immediately. This is because
 		// the id token is not stored alongside the bearer token and so we will want
@@ -102,7 +122,7 @@ func getRefreshToken(ctx context.Context, c *oauth2.Config) *oauth2.Token {
 
 	// Then, we store the new refresh token on disk for future usage.
 	// Refresh tokens do not expire.
-	f, err := os.OpenFile(getRefreshTokenFilePath(), os.O_RDWR|os.O_CREATE, 0600)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -112,10 +132,9 @@ func getRefreshToken(ctx context.Context, c *oauth2.Config) *oauth2.Token {
 	return t
 }
 
-// getRefreshTokenFromFile tries to read the refresh token stored on disk if
-// it can be found.
-func getRefreshTokenFromFile() *oauth2.Token {
-	path := getRefreshTokenFilePath()
+// getRefreshTokenFromFile tries to read the refresh token stored on disk at
+// |path| if it can be found.
+func getRefreshTokenFromFile(path string) *oauth2.Token {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil
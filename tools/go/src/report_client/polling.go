@@ -0,0 +1,66 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"time"
+
+	"analyzer/report_master"
+)
+
+// The interval between the first two polls of a report by GetReport().
+const initialPollInterval = 500 * time.Millisecond
+
+// DefaultMaxPollInterval is the longest interval between two polls of a report
+// by GetReport() unless SetMaxPollInterval() is invoked.
+const DefaultMaxPollInterval = 30 * time.Second
+
+// SetMaxPollInterval sets the longest interval between two polls of a report
+// by GetReport(). A non-positive |maxInterval| restores
+// DefaultMaxPollInterval.
+func (c *ReportClient) SetMaxPollInterval(maxInterval time.Duration) {
+	c.maxPollInterval = maxInterval
+}
+
+// nextPollInterval returns how long GetReport() sleeps before polling a report
+// again that was not complete at time |now| according to |metadata|, given
+// that it slept for |previous| before the last poll, or zero if it did not
+// sleep yet.
+//
+// The interval doubles after each poll so that waiting for a large report
+// does not load the ReportMaster. If the ReportMaster estimated when the
+// report will be complete the next poll is made at that time instead. The
+// interval never exceeds the maximum set with SetMaxPollInterval().
+func (c *ReportClient) nextPollInterval(previous time.Duration, metadata *report_master.ReportMetadata, now time.Time) time.Duration {
+	maxInterval := c.maxPollInterval
+	if maxInterval <= 0 {
+		maxInterval = DefaultMaxPollInterval
+	}
+
+	interval := 2 * previous
+	if interval < initialPollInterval {
+		interval = initialPollInterval
+	}
+	if estimate := metadata.GetEstimatedFinishTime(); estimate != nil {
+		if untilEstimate := time.Unix(estimate.Seconds, int64(estimate.Nanos)).Sub(now); untilEstimate > 0 {
+			interval = untilEstimate
+		}
+	}
+
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	return interval
+}
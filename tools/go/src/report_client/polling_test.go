@@ -0,0 +1,157 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"golang.org/x/net/context"
+
+	"analyzer/report_master"
+)
+
+// Tests that the poll interval backs off exponentially up to the maximum.
+func TestNextPollIntervalBackoff(t *testing.T) {
+	reportClient, _ := makeFakeClient()
+	reportClient.SetMaxPollInterval(3 * time.Second)
+	metadata := &report_master.ReportMetadata{State: report_master.ReportState_IN_PROGRESS}
+	now := time.Now()
+
+	expected := []time.Duration{
+		500 * time.Millisecond,
+		time.Second,
+		2 * time.Second,
+		3 * time.Second,
+		3 * time.Second,
+	}
+	var interval time.Duration
+	for i, e := range expected {
+		interval = reportClient.nextPollInterval(interval, metadata, now)
+		if interval != e {
+			t.Errorf("Poll %d: got interval %v, expected %v", i, interval, e)
+		}
+	}
+
+	// A non-positive maximum restores the default.
+	reportClient.SetMaxPollInterval(0)
+	if interval := reportClient.nextPollInterval(time.Hour, metadata, now); interval != DefaultMaxPollInterval {
+		t.Errorf("Got interval %v, expected %v", interval, DefaultMaxPollInterval)
+	}
+}
+
+// Tests that the poll interval honors the estimated finish time of a report.
+func TestNextPollIntervalEstimatedFinishTime(t *testing.T) {
+	reportClient, _ := makeFakeClient()
+	reportClient.SetMaxPollInterval(time.Minute)
+	now := time.Unix(1000, 0)
+	metadata := &report_master.ReportMetadata{
+		State:               report_master.ReportState_IN_PROGRESS,
+		EstimatedFinishTime: &timestamp.Timestamp{Seconds: 1020},
+	}
+
+	if interval := reportClient.nextPollInterval(0, metadata, now); interval != 20*time.Second {
+		t.Errorf("Got interval %v, expected 20s", interval)
+	}
+
+	// The estimate is capped by the maximum interval.
+	metadata.EstimatedFinishTime.Seconds = 2000
+	if interval := reportClient.nextPollInterval(0, metadata, now); interval != time.Minute {
+		t.Errorf("Got interval %v, expected 1m", interval)
+	}
+
+	// An estimate in the past is ignored.
+	metadata.EstimatedFinishTime.Seconds = 900
+	if interval := reportClient.nextPollInterval(time.Second, metadata, now); interval != 2*time.Second {
+		t.Errorf("Got interval %v, expected 2s", interval)
+	}
+}
+
+// blockingReportMasterStub implements ReportMasterStub by blocking each
+// request until its context is cancelled, like a ReportMaster that never
+// responds.
+type blockingReportMasterStub struct{}
+
+func (s blockingReportMasterStub) StartReport(ctx context.Context, request *report_master.StartReportRequest) (*report_master.StartReportResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s blockingReportMasterStub) GetReport(ctx context.Context, request *report_master.GetReportRequest) (*report_master.Report, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s blockingReportMasterStub) QueryReports(ctx context.Context, request *report_master.QueryReportsRequest) ([]*report_master.ReportMetadata, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// Tests that GetReport() returns promptly if its context is cancelled while it
+// waits between two polls of a report that is in progress.
+func TestGetReportCancelledBetweenPolls(t *testing.T) {
+	reportClient, fakeStub := makeFakeClient()
+	fakeStub.report = &report_master.Report{
+		Metadata: &report_master.ReportMetadata{State: report_master.ReportState_IN_PROGRESS},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	t0 := time.Now()
+	if _, err := reportClient.GetReport(ctx, "my-report-id", time.Hour); err != context.Canceled {
+		t.Errorf("Got error %v, expected %v", err, context.Canceled)
+	}
+	// The first poll interval is longer than this.
+	if elapsed := time.Since(t0); elapsed >= initialPollInterval {
+		t.Errorf("GetReport() returned after %v, expected it to return upon cancellation", elapsed)
+	}
+}
+
+// Tests that the methods of ReportClient return promptly if their context is
+// cancelled while a request to the ReportMaster is outstanding.
+func TestRequestsCancelled(t *testing.T) {
+	reportClient := ReportClient{
+		CustomerId: customerId,
+		ProjectId:  projectId,
+		stub:       blockingReportMasterStub{},
+	}
+	const timeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	t0 := time.Now()
+	if _, err := reportClient.StartReport(ctx, 1, 0, 1); err == nil {
+		t.Errorf("StartReport() succeeded, expected an error")
+	}
+	if _, err := reportClient.GetReport(ctx, "my-report-id", time.Hour); err == nil {
+		t.Errorf("GetReport() succeeded, expected an error")
+	}
+
+	// The associated reports cannot be fetched, so only the messages of the
+	// primary report are returned.
+	report := &report_master.Report{
+		Metadata: &report_master.ReportMetadata{
+			AssociatedReportIds: []string{"associated-id"},
+			InfoMessages:        []*report_master.InfoMessage{{Message: "primary"}},
+		},
+	}
+	if messages := reportClient.ReportErrorsToStrings(ctx, report, true); len(messages) != 1 || messages[0] != "primary" {
+		t.Errorf("Got messages %v, expected [primary]", messages)
+	}
+	if elapsed := time.Since(t0); elapsed > 10*timeout {
+		t.Errorf("The requests returned after %v, expected them to return upon cancellation", elapsed)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -31,17 +32,21 @@ import (
 	"analyzer/report_master"
 	"cobalt"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/oauth"
 )
 
 // The ReportMasterStub interface provides an abstraction layer that allows
-// us to mock out the gRPC stub in tests.
+// us to mock out the gRPC stub in tests. The methods must return promptly
+// once their context is cancelled.
 type ReportMasterStub interface {
-	StartReport(*report_master.StartReportRequest) (*report_master.StartReportResponse, error)
-	GetReport(*report_master.GetReportRequest) (*report_master.Report, error)
+	StartReport(context.Context, *report_master.StartReportRequest) (*report_master.StartReportResponse, error)
+	GetReport(context.Context, *report_master.GetReportRequest) (*report_master.Report, error)
+	QueryReports(context.Context, *report_master.QueryReportsRequest) ([]*report_master.ReportMetadata, error)
 }
 
 // gRPCReportMasterStub implements the interface ReportMasterStub by actually
@@ -50,12 +55,32 @@ type gRPCReportMasterStub struct {
 	grpcStub report_master.ReportMasterClient
 }
 
-func (s *gRPCReportMasterStub) StartReport(request *report_master.StartReportRequest) (*report_master.StartReportResponse, error) {
-	return s.grpcStub.StartReport(context.Background(), request)
+func (s *gRPCReportMasterStub) StartReport(ctx context.Context, request *report_master.StartReportRequest) (*report_master.StartReportResponse, error) {
+	return s.grpcStub.StartReport(ctx, request)
 }
 
-func (s *gRPCReportMasterStub) GetReport(request *report_master.GetReportRequest) (*report_master.Report, error) {
-	return s.grpcStub.GetReport(context.Background(), request)
+func (s *gRPCReportMasterStub) GetReport(ctx context.Context, request *report_master.GetReportRequest) (*report_master.Report, error) {
+	return s.grpcStub.GetReport(ctx, request)
+}
+
+// QueryReports returns the ReportMetadata of all the responses streamed by the
+// QueryReports method.
+func (s *gRPCReportMasterStub) QueryReports(ctx context.Context, request *report_master.QueryReportsRequest) ([]*report_master.ReportMetadata, error) {
+	stream, err := s.grpcStub.QueryReports(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	var reports []*report_master.ReportMetadata
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return reports, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, response.GetReports()...)
+	}
 }
 
 // An instance of ReportClient is used to communicate with the ReportMaster.
@@ -64,6 +89,15 @@ type ReportClient struct {
 	CustomerId uint32
 	ProjectId  uint32
 
+	// The access control headers sent with each request. See access.go.
+	access AccessOptions
+
+	// If not nil, notified of reports started and finished. See metrics.go.
+	metrics ReportMetrics
+
+	// The longest interval between two polls of a report. See polling.go.
+	maxPollInterval time.Duration
+
 	stub ReportMasterStub
 }
 
@@ -81,36 +115,78 @@ type ReportClient struct {
 //
 // Logs and crashes on any failure.
 func NewReportClient(customerId uint32, projectId uint32, uri string, tls bool, skipOauth bool, caFile string) *ReportClient {
+	return NewReportClientWithAccess(customerId, projectId, uri, tls, skipOauth, caFile, AccessOptions{})
+}
+
+// NewReportClientWithAccess is like NewReportClient but additionally sends the
+// access control headers specified by |access| with each request.
+func NewReportClientWithAccess(customerId uint32, projectId uint32, uri string, tls bool, skipOauth bool, caFile string,
+	access AccessOptions) *ReportClient {
+	return NewReportClientWithServiceConfig(customerId, projectId, uri, tls, skipOauth, caFile, access, "")
+}
+
+// NewReportClientWithServiceConfig is like NewReportClientWithAccess but
+// additionally configures the connection with the gRPC |serviceConfig| in the
+// JSON format, unless it is empty. This allows the retry or hedging policy of
+// each method to be specified. See LoadServiceConfig.
+func NewReportClientWithServiceConfig(customerId uint32, projectId uint32, uri string, tls bool, skipOauth bool, caFile string,
+	access AccessOptions, serviceConfig string) *ReportClient {
+	return NewReportClientWithTLSServerName(customerId, projectId, uri, tls, skipOauth, caFile, "", access, serviceConfig)
+}
+
+// NewReportClientWithTLSServerName is like NewReportClientWithServiceConfig
+// but additionally, if |tlsServerName| is not empty, verifies that the TLS
+// certificate of the server is valid for |tlsServerName| rather than for the
+// host name in |uri|. This is needed when connecting through a load balancer
+// or tunnel whose address differs from the names in the certificate.
+func NewReportClientWithTLSServerName(customerId uint32, projectId uint32, uri string, tls bool, skipOauth bool, caFile string,
+	tlsServerName string, access AccessOptions, serviceConfig string) *ReportClient {
 	grpcStubImpl := gRPCReportMasterStub{}
 
 	client := ReportClient{
 		CustomerId: customerId,
 		ProjectId:  projectId,
+		access:     access,
 		stub:       &grpcStubImpl,
 	}
 
+	// The source of OAuth tokens, if OAuth is used.
+	var tokenSource oauth2.TokenSource
+
 	var opts []grpc.DialOption
 	if tls {
 		var creds credentials.TransportCredentials
 		if caFile != "" {
 			var err error
-			creds, err = credentials.NewClientTLSFromFile(caFile, "")
+			creds, err = credentials.NewClientTLSFromFile(caFile, tlsServerName)
 			if err != nil {
 				glog.Fatalf("Failed to create TLS credentials: %v", err)
 			}
 		} else {
-			creds = credentials.NewClientTLSFromCert(nil, "")
+			creds = credentials.NewClientTLSFromCert(nil, tlsServerName)
 		}
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 
 		if !skipOauth {
 			// If TLS is enabled, we can also do authentication.
-			opts = append(opts, grpc.WithPerRPCCredentials(oauth.TokenSource{getTokenSource()}))
+			tokenSource = getTokenSource()
+			opts = append(opts, grpc.WithPerRPCCredentials(oauth.TokenSource{tokenSource}))
 		}
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
 
+	if access.Impersonate != "" || access.ProjectScope != "" || tokenSource != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(&accessCredentials{
+			options:     access,
+			tokenSource: tokenSource,
+		}))
+	}
+
+	if serviceConfig != "" {
+		opts = append(opts, grpc.WithDefaultServiceConfig(serviceConfig))
+	}
+
 	opts = append(opts, grpc.WithBlock())
 	opts = append(opts, grpc.WithTimeout(10*time.Second))
 
@@ -126,8 +202,8 @@ func NewReportClient(customerId uint32, projectId uint32, uri string, tls bool,
 
 // StartCompleteReport invokes StartReport using the infinite interval
 // of day indices.
-func (c *ReportClient) StartCompleteReport(reportConfigId uint32) (string, error) {
-	return c.StartReport(reportConfigId, 0, math.MaxUint32)
+func (c *ReportClient) StartCompleteReport(ctx context.Context, reportConfigId uint32) (string, error) {
+	return c.StartReport(ctx, reportConfigId, 0, math.MaxUint32)
 }
 
 // StartReportRelativeLocal invokes StartReport using the interval of days specified by firstDayOffset and lastDayOffset.
@@ -136,9 +212,9 @@ func (c *ReportClient) StartCompleteReport(reportConfigId uint32) (string, error
 // consisting of two-days-ago and yesterday invoke this method with firstDayOffset = -2 and lastDayOffset = -1.
 // The values of firstDayOffset and lastDayOffset should ordinarily be non-positive numbers since usually one would
 // like to run a report that covers time periods in the past.
-func (c *ReportClient) StartReportRelativeLocal(reportConfigId uint32, firstDayOffset int, lastDayOffset int) (string, error) {
+func (c *ReportClient) StartReportRelativeLocal(ctx context.Context, reportConfigId uint32, firstDayOffset int, lastDayOffset int) (string, error) {
 	today := CurrentDayIndexLocal()
-	return c.StartReport(reportConfigId, uint32(int(today)+firstDayOffset), uint32(int(today)+lastDayOffset))
+	return c.StartReport(ctx, reportConfigId, uint32(int(today)+firstDayOffset), uint32(int(today)+lastDayOffset))
 }
 
 // StartReportRelativeUtc invokes StartReport using the interval of days specified by firstDayOffset and lastDayOffset.
@@ -147,16 +223,16 @@ func (c *ReportClient) StartReportRelativeLocal(reportConfigId uint32, firstDayO
 // consisting of two-days-ago and yesterday invoke this method with firstDayOffset = -2 and lastDayOffset = -1.
 // The values of firstDayOffset and lastDayOffset should ordinarily be non-positive numbers since usually one would
 // like to run a report that covers time periods in the past.
-func (c *ReportClient) StartReportRelativeUtc(reportConfigId uint32, firstDayOffset int, lastDayOffset int) (string, error) {
+func (c *ReportClient) StartReportRelativeUtc(ctx context.Context, reportConfigId uint32, firstDayOffset int, lastDayOffset int) (string, error) {
 	today := CurrentDayIndexUtc()
-	return c.StartReport(reportConfigId, uint32(int(today)+firstDayOffset), uint32(int(today)+lastDayOffset))
+	return c.StartReport(ctx, reportConfigId, uint32(int(today)+firstDayOffset), uint32(int(today)+lastDayOffset))
 }
 
 // StartReport starts a report that covers the specified interval of day indices.
 // A report for the given |reportConfigId| is started. The
 // returned string is the unique report ID, which may be passed to GetReport(),
-// or a non-nil error.
-func (c *ReportClient) StartReport(reportConfigId uint32, firstDayIndex uint32, lastDayIndex uint32) (string, error) {
+// or a non-nil error. The request is abandoned if |ctx| is cancelled.
+func (c *ReportClient) StartReport(ctx context.Context, reportConfigId uint32, firstDayIndex uint32, lastDayIndex uint32) (string, error) {
 	request := report_master.StartReportRequest{
 		CustomerId:     c.CustomerId,
 		ProjectId:      c.ProjectId,
@@ -165,47 +241,75 @@ func (c *ReportClient) StartReport(reportConfigId uint32, firstDayIndex uint32,
 		LastDayIndex:   lastDayIndex,
 	}
 
-	response, err := c.stub.StartReport(&request)
+	response, err := c.stub.StartReport(ctx, &request)
+	c.recordStarted(reportConfigId, err)
 
 	if err != nil {
-		return "", err
+		return "", c.checkError(err)
 	}
 	return response.ReportId, nil
 }
 
 // GetReport queries for the report with the given |reportId|.
-// The report meta-data is fetched repeatedly until the report is finished,
-// or until the specified maximum |wait| time. The caller may inspect the
+// The report meta-data is fetched repeatedly, at increasing intervals (see
+// polling.go), until the report is finished, or until the specified maximum
+// |wait| time. The caller may inspect the
 // |State| of the |Metadata| of the returned report to see whether or not
-// the report is complete. Returns the Report or a non-nil error.
-func (c *ReportClient) GetReport(reportId string, wait time.Duration) (*report_master.Report, error) {
-	sleepDuration := 500 * time.Millisecond
-	if wait < time.Second {
-		sleepDuration = wait / 2
+// the report is complete. Returns the Report or a non-nil error. If the report
+// was terminated both the Report and a *ReportTerminatedError are returned.
+//
+// If |ctx| is cancelled GetReport returns promptly with an error, even while
+// it waits between two polls.
+func (c *ReportClient) GetReport(ctx context.Context, reportId string, wait time.Duration) (*report_master.Report, error) {
+	t0 := time.Now()
+	report, err := c.getReport(ctx, reportId, wait)
+	if err == nil && report.Metadata.State == report_master.ReportState_TERMINATED {
+		err = &ReportTerminatedError{
+			ReportId: reportId,
+			Messages: c.ReportErrorsToStrings(ctx, report, false),
+		}
 	}
+	c.recordFinished(report, err, time.Since(t0))
+	return report, err
+}
 
+// getReport implements GetReport() without notifying |c.metrics|.
+func (c *ReportClient) getReport(ctx context.Context, reportId string, wait time.Duration) (*report_master.Report, error) {
 	request := report_master.GetReportRequest{
 		ReportId: reportId,
 	}
 	t0 := time.Now()
+	var sleepDuration time.Duration
 	var report *report_master.Report
 	var err error
 	for {
-		report, err = c.stub.GetReport(&request)
+		report, err = c.stub.GetReport(ctx, &request)
 		if err != nil {
-			return nil, err
+			return nil, c.checkError(err)
 		}
 		if report.Metadata.State != report_master.ReportState_IN_PROGRESS &&
 			report.Metadata.State != report_master.ReportState_WAITING_TO_START {
 			break
 		}
 
+		// The last poll is made when |wait| has passed.
 		t1 := time.Now()
-		if (t1.Sub(t0))+sleepDuration >= wait {
+		remaining := wait - t1.Sub(t0)
+		if remaining <= 0 {
 			break
 		}
+		sleepDuration = c.nextPollInterval(sleepDuration, report.Metadata, t1)
+		if sleepDuration > remaining {
+			sleepDuration = remaining
+		}
 		glog.Info(fmt.Sprintf("Report not yet complete. Sleeping for %v.\n", sleepDuration))
-		time.Sleep(sleepDuration)
+		timer := time.NewTimer(sleepDuration)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
 	}
 
 	return report, nil
@@ -214,16 +318,16 @@ func (c *ReportClient) GetReport(reportId string, wait time.Duration) (*report_m
 // ReportErrorsToStrings returns the list of human-readable error messages associated with the given |report|
 // and, optionally, its associated reports. If |includeAssociatedReportErrors| is true and the given
 // report has associated reports, then the associated reports will first be fetched using the
-// GetReport() method. Any error messages from the associated reports will be listed before
-// the error messages for the given report.
-func (c *ReportClient) ReportErrorsToStrings(report *report_master.Report, includeAssociatedReportErrors bool) []string {
+// GetReport() method, unless |ctx| is cancelled. Any error messages from the associated reports
+// will be listed before the error messages for the given report.
+func (c *ReportClient) ReportErrorsToStrings(ctx context.Context, report *report_master.Report, includeAssociatedReportErrors bool) []string {
 	var result = []string{}
 	if includeAssociatedReportErrors {
 
 		for _, associatedId := range report.Metadata.AssociatedReportIds {
-			associatedReport, err := c.GetReport(associatedId, 0)
+			associatedReport, err := c.getReport(ctx, associatedId, 0)
 			if err == nil {
-				result = append(result, c.ReportErrorsToStrings(associatedReport, false)...)
+				result = append(result, c.ReportErrorsToStrings(ctx, associatedReport, false)...)
 			}
 		}
 
@@ -235,6 +339,62 @@ func (c *ReportClient) ReportErrorsToStrings(report *report_master.Report, inclu
 	return result
 }
 
+// GetAssociatedReports fetches the associated reports of |report|, for example
+// the one-way marginal reports of a joint two-variable report, in the order of
+// |report.Metadata.AssociatedReportIds|. Each associated report is waited for
+// at most |wait| as in GetReport(). The caller should inspect the |State| of
+// each returned report. Returns an error if any of them cannot be fetched or
+// |ctx| is cancelled.
+func (c *ReportClient) GetAssociatedReports(ctx context.Context, report *report_master.Report, wait time.Duration) ([]*report_master.Report, error) {
+	var result []*report_master.Report
+	for _, associatedId := range report.GetMetadata().GetAssociatedReportIds() {
+		associatedReport, err := c.getReport(ctx, associatedId, wait)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to fetch associated report %s: %v", associatedId, err)
+		}
+		result = append(result, associatedReport)
+	}
+	return result, nil
+}
+
+// ListReports returns the metadata of the reports for |reportConfigId| that
+// were created at or after |firstTimestamp| and before |lastTimestamp|, in
+// the chronological order of their creation. A zero time leaves the
+// corresponding end of the interval open. The request is abandoned if |ctx|
+// is cancelled.
+func (c *ReportClient) ListReports(ctx context.Context, reportConfigId uint32, firstTimestamp time.Time, lastTimestamp time.Time) ([]*report_master.ReportMetadata, error) {
+	request := report_master.QueryReportsRequest{
+		CustomerId:     c.CustomerId,
+		ProjectId:      c.ProjectId,
+		ReportConfigId: reportConfigId,
+		FirstTimestamp: timestampProto(firstTimestamp),
+		LimitTimestamp: timestampProto(lastTimestamp),
+	}
+
+	reports, err := c.stub.QueryReports(ctx, &request)
+	if err != nil {
+		return nil, c.checkError(err)
+	}
+	return reports, nil
+}
+
+// timestampProto returns |t| as a Timestamp, or nil if |t| is the zero time.
+func timestampProto(t time.Time) *timestamp.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return &timestamp.Timestamp{Seconds: t.Unix(), Nanos: int32(t.Nanosecond())}
+}
+
+// AssociatedReportFileName returns the name of the file to which the
+// associated report with the given 0-based |index| is written if the primary
+// report is written to |fileName|, e.g. "report.associated-1.csv" for
+// "report.csv" and index 0.
+func AssociatedReportFileName(fileName string, index int) string {
+	ext := filepath.Ext(fileName)
+	return fmt.Sprintf("%s.associated-%d%s", strings.TrimSuffix(fileName, ext), index+1, ext)
+}
+
 // valuePartToString returns a human-readable string representing the given ValuePart.
 func valuePartToString(val *cobalt.ValuePart) string {
 	if x, ok := val.GetData().(*cobalt.ValuePart_StringValue); ok {
@@ -259,6 +419,10 @@ type ReportRowStrings struct {
 	// The primary key for the row.
 	rowKey string
 
+	// The secondary key for the row. This is set only if hasRowKey2 is true.
+	rowKey2    string
+	hasRowKey2 bool
+
 	// The estimated count for the row.
 	countEstimate string
 
@@ -275,6 +439,16 @@ type ReportRowStrings struct {
 	isEmpty bool
 }
 
+// keyFields returns the fields that identify the row: its primary key, its
+// secondary key if it has one and the fields from its SystemProfile.
+func (s *ReportRowStrings) keyFields() []string {
+	fields := []string{s.rowKey}
+	if s.hasRowKey2 {
+		fields = append(fields, s.rowKey2)
+	}
+	return append(fields, s.systemProfileFields...)
+}
+
 // Returns a ReportRowStrings for the given ReportRow.
 func ReportRowToStrings(row *report_master.ReportRow) ReportRowStrings {
 	if histogramRow := row.GetHistogram(); histogramRow != nil {
@@ -313,18 +487,32 @@ func HistogramReportRowToStrings(row *report_master.HistogramReportRow) ReportRo
 		rowStrings.rowKey = "<missing value>"
 	}
 
-	rowStrings.countEstimate = fmt.Sprintf("%.3f", math.Max(0, float64(row.CountEstimate)))
-	rowStrings.stdError = fmt.Sprintf("%.3f", row.StdError)
+	if row.Label2 != "" {
+		rowStrings.rowKey2 = row.Label2
+		rowStrings.hasRowKey2 = true
+	} else if row.GetValue2() != nil {
+		rowStrings.rowKey2 = valuePartToString(row.Value2)
+		rowStrings.hasRowKey2 = true
+	}
+
+	countEstimate := math.Max(0, float64(row.CountEstimate))
+	rowStrings.countEstimate = numberFormat.Format(countEstimate)
+	rowStrings.stdError = numberFormat.Format(float64(row.StdError))
 
 	_, rowUsesIndex := row.Value.GetData().(*cobalt.ValuePart_IndexValue)
+	rowUsesUnlabeledIndex := rowUsesIndex && row.Label == ""
+	if _, value2UsesIndex := row.Value2.GetData().(*cobalt.ValuePart_IndexValue); value2UsesIndex && row.Label2 == "" {
+		rowUsesUnlabeledIndex = true
+	}
 
 	rowStrings.systemProfileFields = SystemProfileToStrings(row.SystemProfile)
 
 	// We use the following heuristic: If the rows is identified only by an index without
 	// an associated label and its count is zero then probably printing the row would
 	// give the user little useful information and so it may be better to not print
-	// the row. To indicate this we mark the row as "empty."
-	rowStrings.isEmpty = rowUsesIndex && row.Label == "" && rowStrings.countEstimate == "0.000"
+	// the row. To indicate this we mark the row as "empty." A row with two values is
+	// treated the same way if either of them is an index without a label.
+	rowStrings.isEmpty = rowUsesUnlabeledIndex && numberFormat.isZero(countEstimate)
 
 	return rowStrings
 }
@@ -453,11 +641,16 @@ func compareHistogramRows(a, b *report_master.HistogramReportRow) int {
 	if a == nil || b == nil {
 		return 1
 	}
-	// We just compare the two values.
+	// We compare the values and then the second values, so that the rows of a
+	// report with two values are sorted lexicographically by the pair.
 	val := CompareValueParts(a.GetValue(), b.GetValue())
 	if val != 0 {
 		return val
 	}
+	val = CompareValueParts(a.GetValue2(), b.GetValue2())
+	if val != 0 {
+		return val
+	}
 
 	return compareSystemProfile(a.GetSystemProfile(), b.GetSystemProfile())
 }
@@ -494,48 +687,68 @@ func ReportRowsSortedByValues(report *report_master.Report, includeStdErr bool)
 // ReportToStrings returns a sorted list of human-readable report rows.
 // Each element of the returned list represents  a row of the report.
 // The rows of are sorted in increasing order of their values.
-// Each row is itself a list of strings as specified by ReportRowToStrings.
+// Each row is itself a list of strings: the row's key, its second key if the
+// row has a second value, the fields of its SystemProfile, its count estimate
+// and, if |includeStdErr| is true, its std error.
 func ReportToStrings(report *report_master.Report, includeStdErr bool, supressEmptyRows bool) [][]string {
 	result := [][]string{}
-	rows := ReportRowsSortedByValues(report, includeStdErr)
-	if rows != nil {
-		for _, row := range rows {
-			rowStrings := ReportRowToStrings(row)
-			if supressEmptyRows && rowStrings.isEmpty {
-				continue
-			}
-			currentRow := []string{}
-			currentRow = append(currentRow, rowStrings.rowKey)
-			for _, field := range rowStrings.systemProfileFields {
-				currentRow = append(currentRow, field)
-			}
-			currentRow = append(currentRow, rowStrings.countEstimate)
-			if includeStdErr {
-				currentRow = append(currentRow, rowStrings.stdError)
-			}
-			result = append(result, currentRow)
+	forEachReportRow(report, includeStdErr, supressEmptyRows, func(row []string) error {
+		result = append(result, row)
+		return nil
+	})
+	return result
+}
 
+// forEachReportRow invokes |f| for each row of |report| in the order and
+// format described at ReportToStrings. If |f| returns an error the iteration
+// stops and the error is returned.
+func forEachReportRow(report *report_master.Report, includeStdErr bool, supressEmptyRows bool, f func(row []string) error) error {
+	rows := ReportRowsSortedByValues(report, includeStdErr)
+	for _, row := range rows {
+		rowStrings := ReportRowToStrings(row)
+		if supressEmptyRows && rowStrings.isEmpty {
+			continue
+		}
+		currentRow := rowStrings.keyFields()
+		currentRow = append(currentRow, rowStrings.countEstimate)
+		if includeStdErr {
+			currentRow = append(currentRow, rowStrings.stdError)
+		}
+		if err := f(currentRow); err != nil {
+			return err
 		}
 	}
-	return result
+	return nil
+}
+
+// WriteReportRows invokes |f| for each row of the given |report|, one row at a
+// time, with the same fields and in the same order as WriteCSVReport writes
+// them. Unlike ReportToStrings it does not build a list of all the rows, so it
+// may be used to stream the rows of a large report into another sink. If |f|
+// returns an error no further rows are passed to it and the error is returned.
+func WriteReportRows(report *report_master.Report, includeStdErr bool, f func(row []string) error) error {
+	supressEmptyRows := true
+	return forEachReportRow(report, includeStdErr, supressEmptyRows, f)
 }
 
 // WriteCSVReport writes a comma-separated values representation of the
 // given |report| to the given |writer|. Each line represents a row of the
-// report. The lines are sorted in increasing order by value. Each row
-// contains 2, 3 or 4 fields. The first two fields are the rows Value,
-// or its Value2, or both, depending on which of these is present.
-// The next field is the row's CountEstimate. If |includeStdErr| is true
-// the final field will be the row's StdErr.
+// report. The lines are sorted in increasing order by value, and then by
+// Value2. The first field is the row's Value, or its Label if it has one. If
+// the row has a Value2 the next field is its Value2, or its Label2 if it has
+// one. The next fields are those of the row's SystemProfile, followed by the
+// row's CountEstimate. If |includeStdErr| is true the final field will be the
+// row's StdErr.
 func WriteCSVReport(w io.Writer, report *report_master.Report, includeStdErr bool) error {
 	csvWriter := csv.NewWriter(w)
-	supressEmptyRows := true
-	err := csvWriter.WriteAll(ReportToStrings(report, includeStdErr, supressEmptyRows))
+	err := WriteReportRows(report, includeStdErr, func(row []string) error {
+		return csvWriter.Write(row)
+	})
 	if err != nil {
 		return err
 	}
 	csvWriter.Flush()
-	return nil
+	return csvWriter.Error()
 }
 
 // WriteCSVReportToString writes a comma-separated values representation of the
@@ -18,6 +18,8 @@ package report_client
 
 import (
 	"bytes"
+	"encoding/csv"
+	"fmt"
 	"math"
 	"reflect"
 	"testing"
@@ -25,6 +27,9 @@ import (
 
 	"analyzer/report_master"
 	"cobalt"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 const customerId = 1
@@ -177,18 +182,38 @@ type fakeReportMasterStub struct {
 
 	getReportRequest report_master.GetReportRequest
 	report           *report_master.Report
+
+	queryReportsRequest report_master.QueryReportsRequest
+	reportMetadata      []*report_master.ReportMetadata
+
+	// If not nil, returned from all methods instead of a response.
+	err error
 }
 
-func (f *fakeReportMasterStub) StartReport(request *report_master.StartReportRequest) (*report_master.StartReportResponse, error) {
+func (f *fakeReportMasterStub) StartReport(ctx context.Context, request *report_master.StartReportRequest) (*report_master.StartReportResponse, error) {
 	f.startReportRequest = *request
+	if f.err != nil {
+		return nil, f.err
+	}
 	return &f.startReportResponse, nil
 }
 
-func (f *fakeReportMasterStub) GetReport(request *report_master.GetReportRequest) (*report_master.Report, error) {
+func (f *fakeReportMasterStub) GetReport(ctx context.Context, request *report_master.GetReportRequest) (*report_master.Report, error) {
 	f.getReportRequest = *request
+	if f.err != nil {
+		return nil, f.err
+	}
 	return f.report, nil
 }
 
+func (f *fakeReportMasterStub) QueryReports(ctx context.Context, request *report_master.QueryReportsRequest) ([]*report_master.ReportMetadata, error) {
+	f.queryReportsRequest = *request
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.reportMetadata, nil
+}
+
 // Constructs a ReportClient that uses a fakeReportMasterStub as its
 // ReportMasterStub. Returns the ReportClient and the stub.
 func makeFakeClient() (reportClient ReportClient, fakeStub *fakeReportMasterStub) {
@@ -205,7 +230,7 @@ func makeFakeClient() (reportClient ReportClient, fakeStub *fakeReportMasterStub
 func TestStartCompleteReport(t *testing.T) {
 	reportClient, fakeStub := makeFakeClient()
 	fakeStub.startReportResponse.ReportId = "my-report-id"
-	reportId, err := reportClient.StartCompleteReport(reportConfigId)
+	reportId, err := reportClient.StartCompleteReport(context.Background(), reportConfigId)
 	if err != nil {
 		t.Errorf("Error returned from StartReport: %v", err)
 	}
@@ -233,7 +258,7 @@ func TestStartCompleteReport(t *testing.T) {
 func TestStartReport(t *testing.T) {
 	reportClient, fakeStub := makeFakeClient()
 	fakeStub.startReportResponse.ReportId = "my-report-id"
-	reportId, err := reportClient.StartReport(reportConfigId, firstDayIndex, lastDayIndex)
+	reportId, err := reportClient.StartReport(context.Background(), reportConfigId, firstDayIndex, lastDayIndex)
 	if err != nil {
 		t.Errorf("Error returned from StartReport: %v", err)
 	}
@@ -261,7 +286,7 @@ func TestStartReport(t *testing.T) {
 func TestGetReport(t *testing.T) {
 	reportClient, fakeStub := makeFakeClient()
 	fakeStub.report = &successfulReport
-	report, err := reportClient.GetReport("my-report-id", 0)
+	report, err := reportClient.GetReport(context.Background(), "my-report-id", 0)
 	if err != nil {
 		t.Errorf("Error returned from GetReport: %v", err)
 	}
@@ -286,10 +311,89 @@ func TestWriteCSVReport(t *testing.T) {
 	}
 }
 
+// Tests the function WriteReportRows
+func TestWriteReportRows(t *testing.T) {
+	includeStdErr := true
+	var rows [][]string
+	err := WriteReportRows(&successfulReport, includeStdErr, func(row []string) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Error returned from WriteReportRows: %v", err)
+	}
+	var buffer bytes.Buffer
+	csvWriter := csv.NewWriter(&buffer)
+	csvWriter.WriteAll(rows)
+	if buffer.String() != expectedCSVReportString {
+		t.Errorf("Got rows %v", rows)
+	}
+
+	// An error returned by the callback stops the iteration.
+	numRows := 0
+	err = WriteReportRows(&successfulReport, includeStdErr, func(row []string) error {
+		numRows++
+		return fmt.Errorf("sink is full")
+	})
+	if err == nil || numRows != 1 {
+		t.Errorf("Got error %v after %d rows, expected an error after 1 row", err, numRows)
+	}
+}
+
+// makeHistogramRow2 returns a ReportRow with two values.
+func makeHistogramRow2(value, value2 *cobalt.ValuePart, label2 string, countEstimate float32) *report_master.ReportRow {
+	return &report_master.ReportRow{
+		RowType: &report_master.ReportRow_Histogram{
+			Histogram: &report_master.HistogramReportRow{
+				Value:         value,
+				Value2:        value2,
+				Label2:        label2,
+				CountEstimate: countEstimate,
+				StdError:      1,
+			},
+		},
+	}
+}
+
+// Tests that the rows of a report with two values are written with both
+// values and sorted by the pair of values.
+func TestWriteCSVReportWithTwoValues(t *testing.T) {
+	report := report_master.Report{
+		Rows: &report_master.ReportRows{
+			Rows: []*report_master.ReportRow{
+				makeHistogramRow2(&stringValuePart2, &intValuePart1, "", 1),
+				makeHistogramRow2(&stringValuePart1, &intValuePart2, "", 2),
+				makeHistogramRow2(&stringValuePart2, &indexValuePart1, "Label-for-index-1", 3),
+				makeHistogramRow2(&stringValuePart1, &intValuePart1, "", 4),
+				// An empty row is not written.
+				makeHistogramRow2(&stringValuePart1, &indexValuePart2, "", 0),
+			},
+		},
+	}
+	expected := `String Value 11,42,4.000,1.000
+String Value 11,43,2.000,1.000
+String Value 2,42,1.000,1.000
+String Value 2,Label-for-index-1,3.000,1.000
+`
+	csv, err := WriteCSVReportToString(&report, true)
+	if err != nil {
+		t.Errorf("Error returned from WriteCSVReportToString: %v", err)
+	}
+	if csv != expected {
+		t.Errorf("Got CSV [%s]", csv)
+	}
+
+	// The empty row is returned if empty rows are not suppressed.
+	rows := ReportToStrings(&report, false, false)
+	if !reflect.DeepEqual(rows[2], []string{"String Value 11", "<index 2>", "0.000"}) {
+		t.Errorf("Got rows %v", rows)
+	}
+}
+
 func TestReportErrorToStrings(t *testing.T) {
 	reportClient, fakeStub := makeFakeClient()
 	fakeStub.report = &failedReportAssociated
-	errorStrings := reportClient.ReportErrorsToStrings(&failedReportPrimary, true)
+	errorStrings := reportClient.ReportErrorsToStrings(context.Background(), &failedReportPrimary, true)
 
 	if fakeStub.getReportRequest.ReportId != "associated-id" {
 		t.Errorf("ReportId=%s", fakeStub.getReportRequest.ReportId)
@@ -299,6 +403,80 @@ func TestReportErrorToStrings(t *testing.T) {
 	}
 }
 
+func TestGetAssociatedReports(t *testing.T) {
+	reportClient, fakeStub := makeFakeClient()
+	fakeStub.report = &failedReportAssociated
+	reports, err := reportClient.GetAssociatedReports(context.Background(), &failedReportPrimary, 0)
+	if err != nil {
+		t.Fatalf("Error returned from GetAssociatedReports: %v", err)
+	}
+
+	if fakeStub.getReportRequest.ReportId != "associated-id" {
+		t.Errorf("ReportId=%s", fakeStub.getReportRequest.ReportId)
+	}
+	if len(reports) != 1 || reports[0] != &failedReportAssociated {
+		t.Errorf("reports=%v", reports)
+	}
+
+	// A report without associated reports.
+	reports, err = reportClient.GetAssociatedReports(context.Background(), &failedReportAssociated, 0)
+	if err != nil || len(reports) != 0 {
+		t.Errorf("reports=%v, err=%v", reports, err)
+	}
+
+	fakeStub.err = fmt.Errorf("unavailable")
+	if _, err := reportClient.GetAssociatedReports(context.Background(), &failedReportPrimary, 0); err == nil {
+		t.Errorf("Expected an error from GetAssociatedReports")
+	}
+}
+
+// Tests that ListReports() queries the reports of the ReportConfig created in
+// the given interval and returns their metadata.
+func TestListReports(t *testing.T) {
+	reportClient, fakeStub := makeFakeClient()
+	fakeStub.reportMetadata = []*report_master.ReportMetadata{{ReportId: "report-1"}, {ReportId: "report-2"}}
+	first := time.Unix(1480647356, 5)
+	reports, err := reportClient.ListReports(context.Background(), reportConfigId, first, time.Time{})
+	if err != nil {
+		t.Fatalf("ListReports: got error %v", err)
+	}
+	if len(reports) != 2 || reports[0].ReportId != "report-1" || reports[1].ReportId != "report-2" {
+		t.Errorf("got reports %v, expected report-1 and report-2", reports)
+	}
+	request := fakeStub.queryReportsRequest
+	if request.CustomerId != customerId || request.ProjectId != projectId || request.ReportConfigId != reportConfigId {
+		t.Errorf("got request %v, expected the ReportConfig %d/%d/%d", request, customerId, projectId, reportConfigId)
+	}
+	if request.FirstTimestamp.GetSeconds() != 1480647356 || request.FirstTimestamp.GetNanos() != 5 {
+		t.Errorf("got first timestamp %v, expected %v", request.FirstTimestamp, first)
+	}
+	if request.LimitTimestamp != nil {
+		t.Errorf("got limit timestamp %v, expected none", request.LimitTimestamp)
+	}
+
+	fakeStub.err = grpc.Errorf(codes.Unavailable, "unavailable")
+	if _, err := reportClient.ListReports(context.Background(), reportConfigId, first, first); err != fakeStub.err {
+		t.Errorf("ListReports: got error %v, expected %v", err, fakeStub.err)
+	}
+}
+
+func TestAssociatedReportFileName(t *testing.T) {
+	testCases := []struct {
+		fileName string
+		index    int
+		expected string
+	}{
+		{"report.csv", 0, "report.associated-1.csv"},
+		{"/tmp/out/report.csv", 1, "/tmp/out/report.associated-2.csv"},
+		{"report", 0, "report.associated-1"},
+	}
+	for _, tc := range testCases {
+		if got := AssociatedReportFileName(tc.fileName, tc.index); got != tc.expected {
+			t.Errorf("AssociatedReportFileName(%q, %d)=%q, expected %q", tc.fileName, tc.index, got, tc.expected)
+		}
+	}
+}
+
 func TestDayIndex(t *testing.T) {
 	// This unix timestamp corresponds to Friday Dec 2, 2016 in UTC
 	// and Thursday Dec 1, 2016 in Pacific time.
@@ -0,0 +1,163 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule is a set of times specified in the five-field cron format
+// "minute hour day-of-month month day-of-week". See ParseSchedule.
+type Schedule struct {
+	// Bit i of each field is set if the value i matches.
+	minutes, hours, daysOfMonth, months, daysOfWeek uint64
+
+	// Whether the day-of-month and day-of-week fields are restricted, i.e. are
+	// not "*". As in cron, if both are restricted a day matches if either of
+	// them matches.
+	restrictedDaysOfMonth, restrictedDaysOfWeek bool
+}
+
+// The range of the values of each field of a Schedule.
+var scheduleFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseSchedule parses |spec| in the five-field cron format, e.g. "0 6 * * 1"
+// for 06:00 every Monday. Each field is a comma-separated list of items. An
+// item is "*", a value or a range of values "a-b", optionally followed by a
+// step "/n". Days of the week are numbered from 0 for Sunday to 6, and 7 is
+// also accepted for Sunday.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(scheduleFields) {
+		return nil, fmt.Errorf("The schedule %q has %d fields but must have %d: minute hour day-of-month month day-of-week",
+			spec, len(fields), len(scheduleFields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseScheduleField(field, scheduleFields[i].min, scheduleFields[i].max); err != nil {
+			return nil, fmt.Errorf("Invalid %s field %q in the schedule %q: %v", scheduleFields[i].name, field, spec, err)
+		}
+	}
+
+	// Sunday may be specified as 0 or 7.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minutes:               bits[0],
+		hours:                 bits[1],
+		daysOfMonth:           bits[2],
+		months:                bits[3],
+		daysOfWeek:            bits[4],
+		restrictedDaysOfMonth: fields[2] != "*",
+		restrictedDaysOfWeek:  fields[4] != "*",
+	}, nil
+}
+
+// parseScheduleField returns the set of values in [min, max] matched by
+// |field| as a bit set.
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeSpec, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			rangeSpec = item[:i]
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+		}
+
+		first, last := min, max
+		if rangeSpec != "*" {
+			bounds := strings.SplitN(rangeSpec, "-", 2)
+			var err error
+			if first, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", item)
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", item)
+				}
+			}
+			if first < min || last > max || first > last {
+				return 0, fmt.Errorf("%q is not within [%d, %d]", item, min, max)
+			}
+		}
+
+		for v := first; v <= last; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay returns true if the day of |t| matches the day-of-month and
+// day-of-week fields of |s|.
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dayOfMonth := s.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := s.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.restrictedDaysOfMonth && s.restrictedDaysOfWeek {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+// The number of years Next() searches for a matching time.
+const maxScheduleSearchYears = 5
+
+// Next returns the earliest time matching |s| that is strictly after |t|, in
+// the location of |t|. It returns the zero time if no time matches within
+// several years, e.g. for "0 0 30 2 *".
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(maxScheduleSearchYears, 0, 0)
+	for t.Before(end) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// A Monday.
+	start := time.Date(2018, 1, 1, 10, 30, 15, 0, time.UTC)
+	var tests = []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2018, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"0 6 * * *", time.Date(2018, 1, 2, 6, 0, 0, 0, time.UTC)},
+		{"45 10 * * *", time.Date(2018, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2018, 1, 1, 10, 40, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2018, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2018, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2018, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 3 *", time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// When both the day of month and the day of week are restricted either
+		// of them matches.
+		{"0 0 15 * 3", time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		schedule, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		if next := schedule.Next(start); !next.Equal(tt.expected) {
+			t.Errorf("Next(%v) for %q: got %v, expected %v", start, tt.spec, next, tt.expected)
+		}
+	}
+}
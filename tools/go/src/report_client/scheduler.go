@@ -0,0 +1,309 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"analyzer/report_master"
+	"util/gcs"
+)
+
+// A ReportPeriod is the range of days covered by a scheduled report relative
+// to the day on which the schedule fires.
+type ReportPeriod int
+
+const (
+	// The day before the schedule fires.
+	PreviousDay ReportPeriod = iota
+
+	// The seven days before the day on which the schedule fires.
+	PreviousWeek
+)
+
+// ParseReportPeriod returns the ReportPeriod named |name|, "day" or "week".
+func ParseReportPeriod(name string) (ReportPeriod, error) {
+	switch name {
+	case "day":
+		return PreviousDay, nil
+	case "week":
+		return PreviousWeek, nil
+	}
+	return 0, fmt.Errorf("Unknown report period %q, expected \"day\" or \"week\"", name)
+}
+
+// dayRange returns the first and last day indices covered by a report for
+// |period| whose schedule fired on the day with index |today|.
+func (period ReportPeriod) dayRange(today uint32) (first, last uint32) {
+	if period == PreviousWeek {
+		return today - 7, today - 1
+	}
+	return today - 1, today - 1
+}
+
+// ScheduledReport specifies a report that a ReportScheduler runs whenever its
+// schedule fires.
+type ScheduledReport struct {
+	ReportConfigId uint32
+
+	// The times at which the report is started, in UTC.
+	Schedule *Schedule
+
+	// The range of days covered by each report.
+	Period ReportPeriod
+
+	// The local directory or the Cloud Storage prefix of the form
+	// gs://<bucket>/<prefix> to which the CSV of each completed report is
+	// written. See ScheduledReportFileName.
+	Destination string
+
+	// Whether the CSV files include a standard error column.
+	IncludeStdErr bool
+
+	// How long to wait for each report to complete.
+	Wait time.Duration
+
+	// The maximum number of attempts to produce the report each time the
+	// schedule fires, and the interval between two attempts. A report that
+	// is still in progress after |Wait| is fetched again by the next attempt
+	// rather than started again.
+	MaxAttempts   int
+	RetryInterval time.Duration
+
+	// If not empty, the file in which the time at which the schedule last
+	// fired for a successful run is stored. If the schedule fired while the
+	// scheduler was not running, the most recent of those runs is made as
+	// soon as the scheduler starts.
+	StateFile string
+}
+
+// schedulerState is the content of ScheduledReport.StateFile.
+type schedulerState struct {
+	LastRunTimeSeconds int64 `json:"last_run_time_seconds"`
+}
+
+// A ReportScheduler runs a ScheduledReport.
+type ReportScheduler struct {
+	client *ReportClient
+	report ScheduledReport
+
+	// Writes a completed report to |name| in the destination.
+	write func(ctx context.Context, name string, data []byte) error
+
+	// The clock. Replaced in tests.
+	now   func() time.Time
+	after func(d time.Duration) <-chan time.Time
+}
+
+// NewReportScheduler returns a ReportScheduler that runs |report| using
+// |client|. Writing to Cloud Storage uses the application default credentials.
+func NewReportScheduler(client *ReportClient, report ScheduledReport) (*ReportScheduler, error) {
+	if report.Schedule == nil {
+		return nil, fmt.Errorf("The schedule is not set")
+	}
+	if report.Destination == "" {
+		return nil, fmt.Errorf("The destination is not set")
+	}
+	if report.MaxAttempts <= 0 {
+		report.MaxAttempts = 1
+	}
+
+	s := &ReportScheduler{
+		client: client,
+		report: report,
+		now:    time.Now,
+		after:  time.After,
+	}
+	if strings.HasPrefix(report.Destination, gcs.Prefix) {
+		bucket, prefix, err := gcs.ParsePath(report.Destination)
+		if err != nil {
+			return nil, err
+		}
+		uploader, err := gcs.NewDefaultUploader()
+		if err != nil {
+			return nil, err
+		}
+		s.write = func(ctx context.Context, name string, data []byte) error {
+			return uploader.Upload(ctx, bucket, prefix+name, bytes.NewReader(data), "text/csv", "")
+		}
+	} else {
+		s.write = func(ctx context.Context, name string, data []byte) error {
+			return ioutil.WriteFile(filepath.Join(report.Destination, name), data, 0644)
+		}
+	}
+	return s, nil
+}
+
+// ScheduledReportFileName returns the name of the file to which the report
+// with |reportConfigId| whose schedule fired at |fireTime| is written.
+func ScheduledReportFileName(reportConfigId uint32, fireTime time.Time) string {
+	return fmt.Sprintf("report-%d-%s.csv", reportConfigId, fireTime.UTC().Format("20060102-150405"))
+}
+
+// Run runs the report each time the schedule fires until |ctx| is cancelled,
+// and then returns the error of |ctx|. Runs that fail after all attempts are
+// logged and skipped.
+func (s *ReportScheduler) Run(ctx context.Context) error {
+	last, err := s.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Catch up with the most recent run that was missed.
+	if !last.IsZero() {
+		var missed time.Time
+		for t := s.report.Schedule.Next(last); !t.IsZero() && !t.After(s.now()); t = s.report.Schedule.Next(t) {
+			missed = t
+		}
+		if !missed.IsZero() {
+			glog.Infof("Running the report for %v which was missed.", missed)
+			s.runAndRecord(ctx, missed)
+		}
+	}
+
+	for ctx.Err() == nil {
+		next := s.report.Schedule.Next(s.now().UTC())
+		if next.IsZero() {
+			return fmt.Errorf("The schedule never fires")
+		}
+		glog.Infof("Running report config %d next at %v.", s.report.ReportConfigId, next)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.after(next.Sub(s.now())):
+		}
+		s.runAndRecord(ctx, next)
+	}
+	return ctx.Err()
+}
+
+// runAndRecord runs the report whose schedule fired at |fireTime| and records
+// it in the state file if it succeeds.
+func (s *ReportScheduler) runAndRecord(ctx context.Context, fireTime time.Time) {
+	name, err := s.RunOnce(ctx, fireTime)
+	if err != nil {
+		glog.Errorf("The report config %d scheduled at %v failed: %v", s.report.ReportConfigId, fireTime, err)
+		return
+	}
+	glog.Infof("Wrote the report config %d scheduled at %v to %s.", s.report.ReportConfigId, fireTime, name)
+	if err := s.saveState(fireTime); err != nil {
+		glog.Errorf("Unable to save the scheduler state: %v", err)
+	}
+}
+
+// RunOnce runs the report for the period preceding |fireTime|, retrying as
+// specified by the ScheduledReport, and writes its CSV to the destination.
+// Returns the name of the written file or the error of the last attempt.
+func (s *ReportScheduler) RunOnce(ctx context.Context, fireTime time.Time) (string, error) {
+	first, last := s.report.Period.dayRange(dayIndexUtc(fireTime))
+	name := ScheduledReportFileName(s.report.ReportConfigId, fireTime)
+
+	var reportId string
+	var err error
+	for attempt := 1; ; attempt++ {
+		if reportId, err = s.attempt(ctx, reportId, first, last, name); err == nil {
+			return name, nil
+		}
+		if attempt >= s.report.MaxAttempts {
+			return "", err
+		}
+		glog.Warningf("Attempt %d of %d for report config %d failed, retrying in %v: %v",
+			attempt, s.report.MaxAttempts, s.report.ReportConfigId, s.report.RetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-s.after(s.report.RetryInterval):
+		}
+	}
+}
+
+// attempt makes one attempt to produce the report covering the days
+// [first, last] and write it to |name|. If |reportId| is not empty that report
+// is fetched instead of starting a new one. Returns the ID of the report if it
+// is still in progress, so that the next attempt waits for it, and an error if
+// the attempt failed.
+func (s *ReportScheduler) attempt(ctx context.Context, reportId string, first, last uint32, name string) (string, error) {
+	if reportId == "" {
+		var err error
+		if reportId, err = s.client.StartReport(ctx, s.report.ReportConfigId, first, last); err != nil {
+			return "", err
+		}
+	}
+
+	report, err := s.client.GetReport(ctx, reportId, s.report.Wait)
+	if err != nil {
+		return "", err
+	}
+	if report.Metadata.State != report_master.ReportState_COMPLETED_SUCCESSFULLY {
+		return reportId, fmt.Errorf("The report %s is in state %v after %v", reportId, report.Metadata.State, s.report.Wait)
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteCSVReport(&buffer, report, s.report.IncludeStdErr); err != nil {
+		return "", err
+	}
+	if err := s.write(ctx, name, buffer.Bytes()); err != nil {
+		return "", fmt.Errorf("Unable to write %s: %v", name, err)
+	}
+	return "", nil
+}
+
+// loadState returns the time at which the schedule last fired for a successful
+// run according to the state file, or the zero time if it is unknown.
+func (s *ReportScheduler) loadState() (time.Time, error) {
+	if s.report.StateFile == "" {
+		return time.Time{}, nil
+	}
+	data, err := ioutil.ReadFile(s.report.StateFile)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	var state schedulerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return time.Time{}, fmt.Errorf("Unable to parse the state file %s: %v", s.report.StateFile, err)
+	}
+	return time.Unix(state.LastRunTimeSeconds, 0).UTC(), nil
+}
+
+// saveState records in the state file that the schedule fired at |fireTime|
+// for a successful run.
+func (s *ReportScheduler) saveState(fireTime time.Time) error {
+	if s.report.StateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(schedulerState{LastRunTimeSeconds: fireTime.Unix()})
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that the state is never truncated.
+	tmp := s.report.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.report.StateFile)
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"analyzer/report_master"
+)
+
+// flakyReportMasterStub fails the first |failures| calls of StartReport and
+// otherwise behaves like the embedded fakeReportMasterStub.
+type flakyReportMasterStub struct {
+	fakeReportMasterStub
+	failures     int
+	startReports int
+}
+
+func (f *flakyReportMasterStub) StartReport(ctx context.Context, request *report_master.StartReportRequest) (*report_master.StartReportResponse, error) {
+	f.startReports++
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("unavailable")
+	}
+	return f.fakeReportMasterStub.StartReport(ctx, request)
+}
+
+// makeTestScheduler returns a ReportScheduler that uses |stub| and whose
+// timers fire immediately, and the map of the files it writes.
+func makeTestScheduler(stub ReportMasterStub, report ScheduledReport) (*ReportScheduler, map[string]string) {
+	written := map[string]string{}
+	s := &ReportScheduler{
+		client: &ReportClient{CustomerId: customerId, ProjectId: projectId, stub: stub},
+		report: report,
+		write: func(ctx context.Context, name string, data []byte) error {
+			written[name] = string(data)
+			return nil
+		},
+		now: time.Now,
+		after: func(d time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			c <- time.Now()
+			return c
+		},
+	}
+	return s, written
+}
+
+func TestParseReportPeriod(t *testing.T) {
+	if period, err := ParseReportPeriod("week"); err != nil || period != PreviousWeek {
+		t.Errorf("ParseReportPeriod(week) = %v, %v", period, err)
+	}
+	if _, err := ParseReportPeriod("month"); err == nil {
+		t.Errorf("ParseReportPeriod(month) succeeded")
+	}
+}
+
+// Tests that RunOnce() runs the report for the period preceding the fire time
+// and writes its CSV.
+func TestRunOnce(t *testing.T) {
+	stub := &flakyReportMasterStub{}
+	stub.report = &successfulReport
+	stub.startReportResponse.ReportId = "report-id"
+	s, written := makeTestScheduler(stub, ScheduledReport{ReportConfigId: reportConfigId, Period: PreviousWeek, MaxAttempts: 1})
+
+	fireTime := time.Date(2018, 1, 8, 6, 0, 0, 0, time.UTC)
+	name, err := s.RunOnce(context.Background(), fireTime)
+	if err != nil {
+		t.Fatalf("RunOnce() failed: %v", err)
+	}
+	if name != "report-3-20180108-060000.csv" {
+		t.Errorf("Got file name %s", name)
+	}
+	today := dayIndexUtc(fireTime)
+	if stub.startReportRequest.FirstDayIndex != today-7 || stub.startReportRequest.LastDayIndex != today-1 {
+		t.Errorf("Got day range [%d, %d], expected [%d, %d]", stub.startReportRequest.FirstDayIndex,
+			stub.startReportRequest.LastDayIndex, today-7, today-1)
+	}
+	expected, err := WriteCSVReportToString(&successfulReport, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written[name] != expected {
+		t.Errorf("Got CSV %q, expected %q", written[name], expected)
+	}
+}
+
+// Tests that RunOnce() retries failed attempts up to the maximum.
+func TestRunOnceRetries(t *testing.T) {
+	stub := &flakyReportMasterStub{failures: 2}
+	stub.report = &successfulReport
+	s, written := makeTestScheduler(stub, ScheduledReport{ReportConfigId: reportConfigId, MaxAttempts: 3})
+	if _, err := s.RunOnce(context.Background(), time.Now()); err != nil {
+		t.Fatalf("RunOnce() failed: %v", err)
+	}
+	if stub.startReports != 3 || len(written) != 1 {
+		t.Errorf("Got %d attempts and %d files, expected 3 and 1", stub.startReports, len(written))
+	}
+
+	stub = &flakyReportMasterStub{failures: 3}
+	stub.report = &successfulReport
+	s, written = makeTestScheduler(stub, ScheduledReport{ReportConfigId: reportConfigId, MaxAttempts: 3})
+	if _, err := s.RunOnce(context.Background(), time.Now()); err == nil {
+		t.Errorf("RunOnce() succeeded after 3 failed attempts")
+	}
+	if len(written) != 0 {
+		t.Errorf("Got files %v after a failure", written)
+	}
+}
+
+// Tests that a report that is still in progress is fetched again rather than
+// started again.
+func TestRunOnceWaitsForReportInProgress(t *testing.T) {
+	stub := &flakyReportMasterStub{}
+	stub.report = &report_master.Report{Metadata: &report_master.ReportMetadata{State: report_master.ReportState_IN_PROGRESS}}
+	stub.startReportResponse.ReportId = "report-id"
+	s, _ := makeTestScheduler(stub, ScheduledReport{ReportConfigId: reportConfigId, MaxAttempts: 2})
+	if _, err := s.RunOnce(context.Background(), time.Now()); err == nil {
+		t.Errorf("RunOnce() succeeded for a report in progress")
+	}
+	if stub.startReports != 1 || stub.getReportRequest.ReportId != "report-id" {
+		t.Errorf("Got %d started reports and fetched %q, expected 1 and report-id", stub.startReports, stub.getReportRequest.ReportId)
+	}
+}
+
+// Tests that Run() catches up with a missed run and records the successful
+// runs in the state file.
+func TestRunCatchesUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduler_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state")
+	if err := ioutil.WriteFile(stateFile, []byte(`{"last_run_time_seconds": 1514786400}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	schedule, err := ParseSchedule("0 6 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &flakyReportMasterStub{}
+	stub.report = &successfulReport
+	s, written := makeTestScheduler(stub, ScheduledReport{
+		ReportConfigId: reportConfigId,
+		Schedule:       schedule,
+		MaxAttempts:    1,
+		StateFile:      stateFile,
+	})
+	// The schedule fired at 06:00 on 2018-01-02 and 2018-01-03 after the last
+	// run at 06:00 on 2018-01-01.
+	s.now = func() time.Time { return time.Date(2018, 1, 3, 12, 0, 0, 0, time.UTC) }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Run(ctx); err != context.Canceled {
+		t.Errorf("Run() returned %v, expected %v", err, context.Canceled)
+	}
+
+	if _, ok := written["report-3-20180103-060000.csv"]; !ok || len(written) != 1 {
+		t.Errorf("Got files %v, expected only the run of 2018-01-03", written)
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "1514959200") {
+		t.Errorf("Got state %s, expected the time of the run of 2018-01-03", data)
+	}
+}
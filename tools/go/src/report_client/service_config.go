@@ -0,0 +1,146 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+// The names of the status codes that may appear in a gRPC service config.
+var serviceConfigStatusCodes = map[string]bool{
+	"OK": true, "CANCELLED": true, "UNKNOWN": true, "INVALID_ARGUMENT": true,
+	"DEADLINE_EXCEEDED": true, "NOT_FOUND": true, "ALREADY_EXISTS": true,
+	"PERMISSION_DENIED": true, "RESOURCE_EXHAUSTED": true,
+	"FAILED_PRECONDITION": true, "ABORTED": true, "OUT_OF_RANGE": true,
+	"UNIMPLEMENTED": true, "INTERNAL": true, "UNAVAILABLE": true,
+	"DATA_LOSS": true, "UNAUTHENTICATED": true,
+}
+
+// Durations in a gRPC service config are JSON strings such as "0.5s".
+var serviceConfigDuration = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?s$`)
+
+// The parts of a gRPC service config that are checked by LoadServiceConfig.
+type serviceConfig struct {
+	MethodConfig []struct {
+		Name []struct {
+			Service string `json:"service"`
+			Method  string `json:"method"`
+		} `json:"name"`
+		RetryPolicy *struct {
+			MaxAttempts          int      `json:"maxAttempts"`
+			InitialBackoff       string   `json:"initialBackoff"`
+			MaxBackoff           string   `json:"maxBackoff"`
+			BackoffMultiplier    float64  `json:"backoffMultiplier"`
+			RetryableStatusCodes []string `json:"retryableStatusCodes"`
+		} `json:"retryPolicy"`
+		HedgingPolicy *struct {
+			MaxAttempts         int      `json:"maxAttempts"`
+			HedgingDelay        string   `json:"hedgingDelay"`
+			NonFatalStatusCodes []string `json:"nonFatalStatusCodes"`
+		} `json:"hedgingPolicy"`
+	} `json:"methodConfig"`
+}
+
+// LoadServiceConfig reads a gRPC service config in the JSON format from the
+// file at |path| and returns it. The service config may specify a retryPolicy
+// or a hedgingPolicy for the methods of the ReportMaster, whose service name is
+// "cobalt.analyzer.ReportMaster". Only GetReport is idempotent, so StartReport
+// should not be retried or hedged as that may start the same report twice. See
+// https://github.com/grpc/proposal/blob/master/A6-client-retries.md for the
+// format.
+//
+// An error is returned if the file cannot be read or if the retry and hedging
+// policies are not well-formed.
+func LoadServiceConfig(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if err := checkServiceConfig(contents); err != nil {
+		return "", fmt.Errorf("Invalid service config in %s: %v", path, err)
+	}
+	return string(contents), nil
+}
+
+// checkServiceConfig returns an error if |jsonConfig| is not a well-formed
+// gRPC service config.
+func checkServiceConfig(jsonConfig []byte) error {
+	var c serviceConfig
+	if err := json.Unmarshal(jsonConfig, &c); err != nil {
+		return err
+	}
+
+	for i, m := range c.MethodConfig {
+		if len(m.Name) == 0 {
+			return fmt.Errorf("methodConfig %d does not specify a name", i)
+		}
+		for _, name := range m.Name {
+			if name.Service == "" {
+				return fmt.Errorf("methodConfig %d has a name without a service", i)
+			}
+		}
+
+		if m.RetryPolicy != nil && m.HedgingPolicy != nil {
+			return fmt.Errorf("methodConfig %d specifies both a retryPolicy and a hedgingPolicy", i)
+		}
+
+		if p := m.RetryPolicy; p != nil {
+			if p.MaxAttempts < 2 {
+				return fmt.Errorf("the retryPolicy of methodConfig %d must have a maxAttempts of at least 2", i)
+			}
+			if !serviceConfigDuration.MatchString(p.InitialBackoff) || !serviceConfigDuration.MatchString(p.MaxBackoff) {
+				return fmt.Errorf("the retryPolicy of methodConfig %d must have an initialBackoff and a maxBackoff such as \"0.5s\"", i)
+			}
+			if p.BackoffMultiplier <= 0 {
+				return fmt.Errorf("the retryPolicy of methodConfig %d must have a positive backoffMultiplier", i)
+			}
+			if err := checkStatusCodes(p.RetryableStatusCodes); err != nil {
+				return fmt.Errorf("invalid retryableStatusCodes in methodConfig %d: %v", i, err)
+			}
+		}
+
+		if p := m.HedgingPolicy; p != nil {
+			if p.MaxAttempts < 2 {
+				return fmt.Errorf("the hedgingPolicy of methodConfig %d must have a maxAttempts of at least 2", i)
+			}
+			if p.HedgingDelay != "" && !serviceConfigDuration.MatchString(p.HedgingDelay) {
+				return fmt.Errorf("the hedgingPolicy of methodConfig %d has an invalid hedgingDelay %q", i, p.HedgingDelay)
+			}
+			for _, code := range p.NonFatalStatusCodes {
+				if !serviceConfigStatusCodes[code] {
+					return fmt.Errorf("unknown status code %q in the nonFatalStatusCodes of methodConfig %d", code, i)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkStatusCodes returns an error if |codes| is empty or contains an
+// unknown status code name.
+func checkStatusCodes(codes []string) error {
+	if len(codes) == 0 {
+		return fmt.Errorf("no status codes specified")
+	}
+	for _, code := range codes {
+		if !serviceConfigStatusCodes[code] {
+			return fmt.Errorf("unknown status code %q", code)
+		}
+	}
+	return nil
+}
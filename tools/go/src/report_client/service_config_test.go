@@ -0,0 +1,102 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const validServiceConfig = `{
+  "methodConfig": [{
+    "name": [{"service": "cobalt.analyzer.ReportMaster", "method": "GetReport"}],
+    "retryPolicy": {
+      "maxAttempts": 4,
+      "initialBackoff": "0.5s",
+      "maxBackoff": "10s",
+      "backoffMultiplier": 2,
+      "retryableStatusCodes": ["UNAVAILABLE", "DEADLINE_EXCEEDED"]
+    }
+  }]
+}`
+
+func TestCheckServiceConfig(t *testing.T) {
+	valid := []string{
+		`{}`,
+		validServiceConfig,
+		`{"methodConfig": [{
+		  "name": [{"service": "cobalt.analyzer.ReportMaster", "method": "GetReport"}],
+		  "hedgingPolicy": {"maxAttempts": 3, "hedgingDelay": "1s", "nonFatalStatusCodes": ["UNAVAILABLE"]}
+		}]}`,
+	}
+	for _, c := range valid {
+		if err := checkServiceConfig([]byte(c)); err != nil {
+			t.Errorf("Rejected valid service config %s: %v", c, err)
+		}
+	}
+
+	invalid := []string{
+		`not json`,
+		// No name.
+		`{"methodConfig": [{"retryPolicy": {"maxAttempts": 2, "initialBackoff": "1s", "maxBackoff": "1s",
+		  "backoffMultiplier": 1, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`,
+		// Too few attempts.
+		`{"methodConfig": [{"name": [{"service": "s"}], "retryPolicy": {"maxAttempts": 1, "initialBackoff": "1s",
+		  "maxBackoff": "1s", "backoffMultiplier": 1, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`,
+		// Backoff without a unit.
+		`{"methodConfig": [{"name": [{"service": "s"}], "retryPolicy": {"maxAttempts": 2, "initialBackoff": "1",
+		  "maxBackoff": "1s", "backoffMultiplier": 1, "retryableStatusCodes": ["UNAVAILABLE"]}}]}`,
+		// No retryable status codes.
+		`{"methodConfig": [{"name": [{"service": "s"}], "retryPolicy": {"maxAttempts": 2, "initialBackoff": "1s",
+		  "maxBackoff": "1s", "backoffMultiplier": 1}}]}`,
+		// Unknown status code.
+		`{"methodConfig": [{"name": [{"service": "s"}], "retryPolicy": {"maxAttempts": 2, "initialBackoff": "1s",
+		  "maxBackoff": "1s", "backoffMultiplier": 1, "retryableStatusCodes": ["Unavailable"]}}]}`,
+		// Both a retry and a hedging policy.
+		`{"methodConfig": [{"name": [{"service": "s"}], "retryPolicy": {"maxAttempts": 2, "initialBackoff": "1s",
+		  "maxBackoff": "1s", "backoffMultiplier": 1, "retryableStatusCodes": ["UNAVAILABLE"]},
+		  "hedgingPolicy": {"maxAttempts": 2}}]}`,
+	}
+	for _, c := range invalid {
+		if err := checkServiceConfig([]byte(c)); err == nil {
+			t.Errorf("Accepted invalid service config %s", c)
+		}
+	}
+}
+
+func TestLoadServiceConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "service_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(validServiceConfig); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	serviceConfig, err := LoadServiceConfig(f.Name())
+	if err != nil {
+		t.Fatalf("LoadServiceConfig failed: %v", err)
+	}
+	if serviceConfig != validServiceConfig {
+		t.Errorf("Got service config %s, expected %s", serviceConfig, validServiceConfig)
+	}
+
+	if _, err := LoadServiceConfig(f.Name() + ".missing"); err == nil {
+		t.Errorf("LoadServiceConfig succeeded for a missing file")
+	}
+}
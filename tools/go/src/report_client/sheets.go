@@ -0,0 +1,191 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"analyzer/report_master"
+)
+
+// The endpoint of the Google Sheets API.
+const sheetsAPIEndpoint = "https://sheets.googleapis.com/v4/spreadsheets/"
+
+// A SheetsExporter writes completed reports into a Google Sheets spreadsheet,
+// each one into a new sheet (tab).
+type SheetsExporter struct {
+	client        *http.Client
+	endpoint      string
+	spreadsheetId string
+}
+
+// NewSheetsExporter returns a SheetsExporter for the spreadsheet with the
+// given |spreadsheetId|, which is the part of its URL following
+// "/spreadsheets/d/". The user is asked to authorize access to their
+// spreadsheets using the OAuth flow described in oauth.go the first time.
+func NewSheetsExporter(spreadsheetId string) *SheetsExporter {
+	return &SheetsExporter{
+		client:        oauth2.NewClient(context.Background(), getSheetsTokenSource()),
+		endpoint:      sheetsAPIEndpoint,
+		spreadsheetId: spreadsheetId,
+	}
+}
+
+// SheetTitle returns the title of the sheet to which the report with the
+// given |metadata| is exported at time |t|.
+func SheetTitle(metadata *report_master.ReportMetadata, t time.Time) string {
+	return fmt.Sprintf("Report %d %s", metadata.ReportConfigId, t.Format("2006-01-02 15:04:05"))
+}
+
+// Export adds a sheet titled |title| to the spreadsheet and writes |report|
+// into it. The first rows of the sheet hold the metadata of the report and
+// the time |t| of the export. They are followed by an empty row and the rows
+// of the report with the same fields as those written by WriteCSVReport. The
+// count estimates and std errors are written as numbers and all other fields
+// as text.
+func (e *SheetsExporter) Export(report *report_master.Report, includeStdErr bool, title string, t time.Time) error {
+	values := metadataRows(report.Metadata, t)
+	values = append(values, []interface{}{})
+
+	numNumericFields := 1
+	if includeStdErr {
+		numNumericFields = 2
+	}
+	err := WriteReportRows(report, includeStdErr, func(row []string) error {
+		values = append(values, sheetRow(row, numNumericFields))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := e.addSheet(title); err != nil {
+		return fmt.Errorf("Unable to add the sheet %q: %v", title, err)
+	}
+	if err := e.updateValues(title, values); err != nil {
+		return fmt.Errorf("Unable to write the report to the sheet %q: %v", title, err)
+	}
+	return nil
+}
+
+// SpreadsheetURL returns the URL at which the spreadsheet can be viewed.
+func (e *SheetsExporter) SpreadsheetURL() string {
+	return "https://docs.google.com/spreadsheets/d/" + e.spreadsheetId
+}
+
+// metadataRows returns the header rows describing the report with the given
+// |metadata| exported at time |t|.
+func metadataRows(metadata *report_master.ReportMetadata, t time.Time) [][]interface{} {
+	return [][]interface{}{
+		{"Report ID", metadata.ReportId},
+		{"Customer ID", metadata.CustomerId},
+		{"Project ID", metadata.ProjectId},
+		{"Report config ID", metadata.ReportConfigId},
+		{"First day", dayIndexToDate(metadata.FirstDayIndex, 0)},
+		{"Last day", dayIndexToDate(metadata.LastDayIndex, math.MaxUint32)},
+		{"Exported at", t.Format(time.RFC3339)},
+	}
+}
+
+// dayIndexToDate returns the UTC date of the day with index |dayIndex|, or
+// "unbounded" if it is |unbounded|.
+func dayIndexToDate(dayIndex uint32, unbounded uint32) string {
+	if dayIndex == unbounded {
+		return "unbounded"
+	}
+	return time.Unix(int64(dayIndex)*unixSecondsPerDay, 0).UTC().Format("2006-01-02")
+}
+
+// sheetRow converts |row| to the values of a row of a sheet. The last
+// |numNumericFields| fields are converted to numbers if they can be parsed as
+// such, so that they can be used in formulas. The other fields are left as
+// text since they may be labels that merely look like numbers.
+func sheetRow(row []string, numNumericFields int) []interface{} {
+	values := make([]interface{}, len(row))
+	for i, field := range row {
+		values[i] = field
+		if i < len(row)-numNumericFields {
+			continue
+		}
+		if f, err := strconv.ParseFloat(strings.Replace(field, numberFormat.DecimalSeparator, ".", 1), 64); err == nil {
+			values[i] = f
+		}
+	}
+	return values
+}
+
+// addSheet adds a sheet titled |title| to the spreadsheet.
+func (e *SheetsExporter) addSheet(title string) error {
+	request := map[string]interface{}{
+		"requests": []interface{}{
+			map[string]interface{}{
+				"addSheet": map[string]interface{}{
+					"properties": map[string]interface{}{"title": title},
+				},
+			},
+		},
+	}
+	return e.call("POST", e.endpoint+url.PathEscape(e.spreadsheetId)+":batchUpdate", request)
+}
+
+// updateValues writes |values| into the sheet titled |title|, starting at its
+// top left cell. The values are stored as they are, without being parsed as
+// formulas or dates.
+func (e *SheetsExporter) updateValues(title string, values [][]interface{}) error {
+	// Sheet titles are quoted in A1 notation, with quotes doubled.
+	a1Range := "'" + strings.Replace(title, "'", "''", -1) + "'!A1"
+	request := map[string]interface{}{
+		"range":          a1Range,
+		"majorDimension": "ROWS",
+		"values":         values,
+	}
+	return e.call("PUT", e.endpoint+url.PathEscape(e.spreadsheetId)+"/values/"+url.PathEscape(a1Range)+"?valueInputOption=RAW", request)
+}
+
+// call sends |request| encoded as JSON to |requestURL| and returns an error if
+// the Sheets API does not respond with success.
+func (e *SheetsExporter) call(method string, requestURL string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("the Sheets API returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
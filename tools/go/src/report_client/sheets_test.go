@@ -0,0 +1,136 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"analyzer/report_master"
+)
+
+// fakeSheetsAPI records the requests made to the Sheets API.
+type fakeSheetsAPI struct {
+	requests []string
+	bodies   []map[string]interface{}
+	status   int
+}
+
+func (f *fakeSheetsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.bodies = append(f.bodies, body)
+	w.WriteHeader(f.status)
+	w.Write([]byte("{}"))
+}
+
+func TestSheetsExport(t *testing.T) {
+	fake := &fakeSheetsAPI{status: http.StatusOK}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	e := &SheetsExporter{
+		client:        server.Client(),
+		endpoint:      server.URL + "/",
+		spreadsheetId: "sheet-id",
+	}
+
+	report := successfulReport
+	report.Metadata = &report_master.ReportMetadata{
+		ReportId:       "report-id",
+		CustomerId:     customerId,
+		ProjectId:      projectId,
+		ReportConfigId: reportConfigId,
+		FirstDayIndex:  17532,
+		LastDayIndex:   17533,
+		State:          report_master.ReportState_COMPLETED_SUCCESSFULLY,
+	}
+	exportTime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	title := SheetTitle(report.Metadata, exportTime)
+	if title != "Report 3 2018-01-02 03:04:05" {
+		t.Errorf("Got title %s", title)
+	}
+	if err := e.Export(&report, true, "Bob's report", exportTime); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	expectedRequests := []string{
+		"POST /sheet-id:batchUpdate",
+		"PUT /sheet-id/values/%27Bob%27%27s%20report%27%21A1?valueInputOption=RAW",
+	}
+	if !reflect.DeepEqual(fake.requests, expectedRequests) {
+		t.Fatalf("Got requests %v, expected %v", fake.requests, expectedRequests)
+	}
+
+	addSheet := fake.bodies[0]["requests"].([]interface{})[0].(map[string]interface{})["addSheet"]
+	if title := addSheet.(map[string]interface{})["properties"].(map[string]interface{})["title"]; title != "Bob's report" {
+		t.Errorf("Got sheet title %v", title)
+	}
+
+	values := fake.bodies[1]["values"].([]interface{})
+	// 7 metadata rows, an empty row and 6 report rows.
+	if len(values) != 14 {
+		t.Fatalf("Got %d rows, expected 14: %v", len(values), values)
+	}
+	expectedRows := map[int][]interface{}{
+		0:  {"Report ID", "report-id"},
+		4:  {"First day", "2018-01-01"},
+		5:  {"Last day", "2018-01-02"},
+		6:  {"Exported at", "2018-01-02T03:04:05Z"},
+		7:  nil,
+		8:  {"String Value 11", 103.3, 3.14},
+		10: {"42", 101.1, 3.14},
+	}
+	for i, expected := range expectedRows {
+		got := values[i].([]interface{})
+		if expected == nil && len(got) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Got row %d %v, expected %v", i, got, expected)
+		}
+	}
+}
+
+func TestSheetsExportError(t *testing.T) {
+	fake := &fakeSheetsAPI{status: http.StatusForbidden}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	e := &SheetsExporter{
+		client:        server.Client(),
+		endpoint:      server.URL + "/",
+		spreadsheetId: "sheet-id",
+	}
+
+	if err := e.Export(&successfulReport, false, "title", time.Now()); err == nil {
+		t.Errorf("Export succeeded despite an error from the Sheets API")
+	}
+	if len(fake.requests) != 1 {
+		t.Errorf("Got requests %v after a failure to add the sheet", fake.requests)
+	}
+}
+
+func TestDayIndexToDate(t *testing.T) {
+	if date := dayIndexToDate(17532, 0); date != "2018-01-01" {
+		t.Errorf("Got %s", date)
+	}
+	if date := dayIndexToDate(0, 0); date != "unbounded" {
+		t.Errorf("Got %s", date)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"analyzer/report_master"
+)
+
+// A ReportSummary aggregates the rows of a report so that automated sanity
+// checks, e.g. comparing the total count estimate with that of the previous
+// day, do not have to parse the rows.
+type ReportSummary struct {
+	// The number of rows, excluding the empty rows that WriteCSVReport omits.
+	NumRows int
+
+	// The sum of the count estimates of the rows. Negative count estimates are
+	// counted as zero, as they are printed.
+	TotalCountEstimate float64
+
+	// The largest std error of any row.
+	MaxStdError float64
+}
+
+// Summary returns the ReportSummary of the rows of |report| that are written
+// by WriteCSVReport.
+func Summary(report *report_master.Report) ReportSummary {
+	var summary ReportSummary
+	for _, row := range report.GetRows().GetRows() {
+		histogramRow := row.GetHistogram()
+		if histogramRow == nil || HistogramReportRowToStrings(histogramRow).isEmpty {
+			continue
+		}
+		summary.NumRows++
+		summary.TotalCountEstimate += math.Max(0, float64(histogramRow.CountEstimate))
+		summary.MaxStdError = math.Max(summary.MaxStdError, float64(histogramRow.StdError))
+	}
+	return summary
+}
+
+// String returns a human-readable representation of |s| using the number
+// format set by SetNumberFormat().
+func (s ReportSummary) String() string {
+	return fmt.Sprintf("rows: %d, total count estimate: %s, max std error: %s",
+		s.NumRows, numberFormat.Format(s.TotalCountEstimate), numberFormat.Format(s.MaxStdError))
+}
+
+// WriteCSVSummary writes the ReportSummary of |report| to |w| as a comment
+// line starting with "#", which may be appended to the output of
+// WriteCSVReport.
+func WriteCSVSummary(w io.Writer, report *report_master.Report) error {
+	_, err := fmt.Fprintf(w, "# %v\n", Summary(report))
+	return err
+}
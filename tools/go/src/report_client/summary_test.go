@@ -0,0 +1,55 @@
+// Copyright 2018 The Fuchsia Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report_client
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"analyzer/report_master"
+	"cobalt"
+)
+
+func TestSummary(t *testing.T) {
+	summary := Summary(&successfulReport)
+	if summary.NumRows != 6 || math.Abs(summary.TotalCountEstimate-615.6) > 1e-3 || math.Abs(summary.MaxStdError-3.14) > 1e-6 {
+		t.Errorf("Got summary %+v", summary)
+	}
+
+	// Empty rows are not counted and negative count estimates count as zero.
+	unlabeledIndex := cobalt.ValuePart{Data: &cobalt.ValuePart_IndexValue{IndexValue: 7}}
+	report := report_master.Report{
+		Rows: &report_master.ReportRows{
+			Rows: []*report_master.ReportRow{
+				makeHistogramRow2(&intValuePart1, nil, "", 10),
+				makeHistogramRow2(&intValuePart2, nil, "", -5),
+				makeHistogramRow2(&unlabeledIndex, nil, "", 0),
+			},
+		},
+	}
+	expected := ReportSummary{NumRows: 2, TotalCountEstimate: 10, MaxStdError: 1}
+	if summary := Summary(&report); summary != expected {
+		t.Errorf("Got summary %+v, expected %+v", summary, expected)
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteCSVSummary(&buffer, &report); err != nil {
+		t.Fatalf("WriteCSVSummary failed: %v", err)
+	}
+	if line := buffer.String(); line != "# rows: 2, total count estimate: 10.000, max std error: 1.000\n" {
+		t.Errorf("Got summary line [%s]", line)
+	}
+}
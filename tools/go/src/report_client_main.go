@@ -18,32 +18,76 @@ The program may be used in two modes, specified by the boolean flag -interactive
 
 In interactive mode the program runs an interactive command loop that
 allows an operator to run multiple reports, specifying the ReportConfig id
-for each report.
+for each report. The command line can be edited, earlier commands are recalled
+with the arrow keys and kept in the file ~/.cobalt_report_client_history, and
+the tab key completes the commands and, if the flag -config_file is specified,
+the ReportConfig ids of the project.
 
 In non-interactive mode the program runs a single report using the
-ReportConfig id specified by the flag -report_config_id.
+ReportConfig id specified by the flag -report_config_id, or concurrently runs
+the reports of the comma-separated ReportConfig ids specified by the flag
+-report_config_ids. Alternatively, if the
+flag -report_id is specified, no new report is started and the program instead
+waits for the existing report with that id to complete, or, if the flag
+-deadline_seconds is 0, prints it in its current state. If the flag -list
+is specified the reports of the ReportConfig that were created during the range
+of days specified by -first_day and -last_day are listed. If the flag
+-watch_interval is specified the report is re-run periodically and the changes
+since the previous run are printed after each run.
+
+If the flag -schedule is specified in non-interactive mode the program
+instead runs a report for the previous day or week whenever the cron-style
+schedule fires, retries failed runs, and writes the CSV of each report to a
+timestamped file in the local directory or Cloud Storage location specified by
+the flag -schedule_destination.
+
+The flag -env selects a named bundle of the connection flags
+-report_master_uri, -tls, -ca_file, -tls_server_name and -skip_oauth, e.g. prod,
+staging or local, from the YAML file ~/.cobalt_report_client.yaml or the one
+specified by the flag -env_file. Connection flags that are set explicitly take
+precedence.
 
 In both cases the customer and project IDs are specified via the flags
 -customer_id and -project_id and the output of the report is written to
-CSV format to the console, or to the file specified by the flag -csv_file.
+the console, and to the file specified by the flag -csv_file if any. The
+output is in CSV format, or, if the flag -format=json is specified, a JSON
+object containing the metadata of the report, e.g. its ID, state and day
+range, alongside its rows. If the flag -gcs_output=gs://<bucket>/<object> is
+specified the output is also uploaded to that Google Cloud Storage object using
+the application default credentials, compressed with gzip if the flag
+-gcs_gzip is specified.
+
+If the flag -sheets_spreadsheet_id is specified each completed report is also
+written to a new sheet of that Google Sheets spreadsheet, preceded by rows
+describing the report. If the flags -bigquery_dataset and -bigquery_table are
+specified the rows of each completed report are also appended to that BigQuery
+table, which is created if needed with a column for each variable of the
+report, using the application default credentials.
+
+A warning is printed if the report covers days that the ReportMaster does not
+yet consider finalized. In non-interactive mode, if the flag -require_finalized
+is specified the program then exits with status 3.
 */
 
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"analyzer/report_master"
+	"github.com/peterh/liner"
+	"golang.org/x/net/context"
 	"report_client"
 )
 
@@ -52,85 +96,364 @@ var (
 	caFile    = flag.String("ca_file", "", "The file containning the root CA certificate.")
 	skipOauth = flag.Bool("skip_oauth", false, "Do not attempt to authenticate with the server using OAuth.")
 
+	tlsServerName = flag.String("tls_server_name", "", "If specified, the TLS certificate of the ReportMaster is verified for this name instead of the host in "+
+		"report_master_uri, e.g. when connecting through a load balancer or tunnel whose certificate names differ from the dialed address.")
+
+	impersonate  = flag.String("impersonate", "", "If specified, requests are made on behalf of this identity. The ReportMaster only honors this if you are allowed to impersonate it.")
+	projectScope = flag.String("project_scope", "", "If specified, the project scope sent with each request. Otherwise the cobalt_project_scope claim of the OAuth token is used, if present.")
+
 	reportMasterURI = flag.String("report_master_uri", "reportmaster.cobalt-api.fuchsia.com:443", "The hostname:port used to connect to the ReportMaster Service")
 
-	customerID     = flag.Uint("customer_id", 1, "The Cobalt customer ID.")
-	projectID      = flag.Uint("project_id", 1, "The Cobalt project ID.")
-	reportConfigID = flag.Uint("report_config_id", 1, "The ReportConfig ID. Used in non-interactive mode only.")
-	firstDay       = flag.Int64("first_day", math.MaxInt64, "If -first_day and -last_day are specified they should be (usually negative) "+
+	env = flag.String("env", "", "If specified, the name of an environment in -env_file, e.g. prod, staging or local, whose "+
+		"report_master_uri, tls, ca_file, tls_server_name and skip_oauth are used for the flags that are not set explicitly.")
+	envFile = flag.String("env_file", defaultEnvFile(), "The YAML file defining the environments that may be selected with -env.")
+
+	serviceConfigFile = flag.String("service_config_file", "", "If specified, a file containing a gRPC service config in the JSON format "+
+		"used for the connection to the ReportMaster. It may specify a retryPolicy or a hedgingPolicy for the method "+
+		"cobalt.analyzer.ReportMaster/GetReport.")
+
+	customerID      = flag.Uint("customer_id", 1, "The Cobalt customer ID.")
+	projectID       = flag.Uint("project_id", 1, "The Cobalt project ID.")
+	reportConfigID  = flag.Uint("report_config_id", 1, "The ReportConfig ID. Used in non-interactive mode only.")
+	reportConfigIDs = flag.String("report_config_ids", "", "If specified, a comma-separated list of ReportConfig IDs whose reports are run "+
+		"concurrently instead of that of -report_config_id, over the range of days specified by -first_day and -last_day if any. The reports "+
+		"share the deadline -deadline_seconds. If -csv_file is specified each report is written to a separate file, e.g. report.config-3.csv. "+
+		"Used in non-interactive mode only.")
+	firstDay = flag.Int64("first_day", math.MaxInt64, "If -first_day and -last_day are specified they should be (usually negative) "+
 		"offsets relative to today specifying a range of days over which the report should be run. Otherwise the range is unbounded.")
 	lastDay = flag.Int64("last_day", math.MaxInt64, "If -first_day and -last_day are specified they should be (usually negative) "+
 		"offsets relative to today specifying a range of days over which the report should be run. Otherwise the range is unbounded.")
 
+	list = flag.Bool("list", false, "If true, no new report is started. Instead the reports of -report_config_id that were created "+
+		"during the range of days specified by -first_day and -last_day, by default the last 30 days, are listed. Used in non-interactive mode only.")
+
+	reportID = flag.String("report_id", "", "If specified, no new report is started. Instead the existing report with this ID "+
+		"is fetched once it completes, or printed in its current state if -deadline_seconds=0. Used in non-interactive mode only.")
+
+	configFile = flag.String("config_file", "", "If specified, a file containing a serialized CobaltConfig, as written by the "+
+		"config parser, whose ReportConfig IDs for the project are offered by the tab completion of the interactive mode.")
+
 	interactive = flag.Bool("interactive", true, "If false then exuecute the command specified by the flags and exit.  "+
 		"Don't enter a command loop.")
 
+	includeAssociatedReports = flag.Bool("include_associated_reports", false, "If true and a report has associated reports, "+
+		"for example the one-way marginals of a joint report, their rows are printed after those of the report. If -csv_file "+
+		"is specified each associated report is written to a separate file next to it, e.g. report.associated-1.csv.")
+
 	includeStdErrColumn = flag.Bool("include_std_err_column", false, "Should a standard error column be included in the report? "+
 		"Used in non-interactive mode only.")
 
-	csvFile = flag.String("csv_file", "", "If specified then the CSV report will be written to that file. "+
+	csvFile = flag.String("csv_file", "", "If specified then the report will be written to that file in the format specified by "+
+		"-format. Used in non-interactive mode only.")
+
+	gcsOutput = flag.String("gcs_output", "", "If specified, a Cloud Storage object gs://<bucket>/<object> to which the report is "+
+		"also uploaded in the format specified by -format, using the application default credentials. With -report_config_ids "+
+		"or -include_associated_reports the names of the other objects are derived from it as for -csv_file. "+
 		"Used in non-interactive mode only.")
+	gcsGzip = flag.Bool("gcs_gzip", false, "If true, the objects uploaded to -gcs_output are compressed with gzip. Cloud Storage "+
+		"decompresses them for the clients that do not accept gzip.")
+
+	format = flag.String("format", formatCSV, fmt.Sprintf("The format in which reports are written: %q or %q.", formatCSV, formatJSON))
+
+	csvSummary = flag.Bool("csv_summary", false, "If true, a comment line starting with # with the number of rows, the total "+
+		"count estimate and the largest standard error is appended to the CSV report. Ignored if -format=json.")
+
+	sheetsSpreadsheetID = flag.String("sheets_spreadsheet_id", "", "If specified, each completed report is also exported to a new "+
+		"sheet of the Google Sheets spreadsheet with this ID, the part of its URL following /spreadsheets/d/. The first time, "+
+		"you are asked to authorize access to your spreadsheets.")
+
+	bigQueryProject = flag.String("bigquery_project", "", "The Google Cloud project of -bigquery_dataset. Defaults to the "+
+		"project of the application default credentials.")
+	bigQueryDataset = flag.String("bigquery_dataset", "", "If specified with -bigquery_table, the rows of each completed report "+
+		"are also appended to the BigQuery table -bigquery_table of this dataset, using the application default credentials.")
+	bigQueryTable = flag.String("bigquery_table", "", "The BigQuery table of -bigquery_dataset to which the rows of the reports "+
+		"are appended. If it does not exist it is created with columns for the report's ID, days and variables, the count "+
+		"estimate and the std error. The reports exported to a table should share their ReportConfig.")
 
 	deadlineSeconds = flag.Uint("deadline_seconds", 30, "Number of seconds to wait for a report to complete before failing.")
+
+	maxPollIntervalSeconds = flag.Uint("max_poll_interval_seconds", uint(report_client.DefaultMaxPollInterval/time.Second),
+		"The longest time to wait between two polls of a report that is not yet complete.")
+
+	watchInterval = flag.Uint("watch_interval", 0, "If positive, the report is re-run every this many minutes and the changes "+
+		"since the previous run are printed after each snapshot. Used in non-interactive mode only.")
+
+	schedule = flag.String("schedule", "", "If specified, a schedule in the five-field cron format \"minute hour day-of-month month "+
+		"day-of-week\", evaluated in UTC, e.g. \"0 6 * * *\". Each time it fires a report of -report_config_id covering the "+
+		"period specified by -schedule_period is run and its CSV is written to -schedule_destination. Used in non-interactive mode only.")
+	schedulePeriod      = flag.String("schedule_period", "day", "The period covered by each scheduled report: \"day\" for the previous day or \"week\" for the previous seven days.")
+	scheduleDestination = flag.String("schedule_destination", "", "The local directory or the Cloud Storage location gs://<bucket>/<prefix> "+
+		"to which the scheduled reports are written in timestamped files. Required with -schedule.")
+	scheduleMaxAttempts          = flag.Int("schedule_max_attempts", 3, "The maximum number of attempts to produce each scheduled report.")
+	scheduleRetryIntervalSeconds = flag.Uint("schedule_retry_interval_seconds", 300, "The number of seconds between two attempts to produce a scheduled report.")
+	scheduleStateFile            = flag.String("schedule_state_file", "", "If specified, the time of the last successful scheduled run is stored "+
+		"in this file, and the most recent run that was missed while the program was not running is made when it starts.")
+
+	requireFinalized = flag.Bool("require_finalized", false, fmt.Sprintf("If true and the report covers days that the ReportMaster "+
+		"does not yet consider finalized, exit with status %d. Used in non-interactive mode only.", exitCodeNotFinalized))
+
+	decimalPrecision = flag.Int("decimal_precision", report_client.DefaultNumberFormat.Precision,
+		"The number of digits after the decimal separator in count estimates and standard errors.")
+
+	decimalSeparator = flag.String("decimal_separator", report_client.DefaultNumberFormat.DecimalSeparator,
+		"Separates the integer part of count estimates and standard errors from their fraction, e.g. \",\".")
+
+	integersForWholeNumbers = flag.Bool("integers_for_whole_numbers", false, "If true, count estimates and standard errors "+
+		"without a fraction are printed as integers regardless of -decimal_precision.")
+
+	printVersion = flag.Bool("version", false, "Print the version of this binary and exit.")
+)
+
+// The version and source commit of this binary. They are set at link time with
+// -ldflags "-X main.version=<version> -X main.commit=<commit>".
+var (
+	version = "unknown"
+	commit  = "unknown"
+)
+
+// The values of -format.
+const (
+	formatCSV  = "csv"
+	formatJSON = "json"
 )
 
+// The number of days, ending today, during which the reports listed by the
+// list command were created if no interval is specified.
+const defaultListDays = 30
+
+// The exit status used in non-interactive mode if -require_finalized is
+// specified and the report covers days that are not yet finalized.
+const exitCodeNotFinalized = 3
+
 type ReportClientCLI struct {
 	report       *report_master.Report
 	reportClient *report_client.ReportClient
+
+	// If not empty, the file to which the current report is also written.
+	outputFile string
+
+	// If not nil, the current report is also uploaded to the object |gcsObject|
+	// in Cloud Storage.
+	gcsOutput *report_client.GCSOutput
+	gcsObject string
+
+	// Whether writing or uploading a report failed.
+	outputFailed bool
+
+	// If not nil, completed reports are exported to Google Sheets.
+	sheetsExporter *report_client.SheetsExporter
+
+	// If not nil, the rows of completed reports are exported to BigQuery.
+	bigQueryExporter *report_client.BigQueryExporter
+
+	// Whether the last report that completed successfully covers days that are
+	// not yet finalized.
+	notFinalized bool
+
+	// Completes the commands typed in interactive mode.
+	completer *report_client.Completer
+}
+
+func (c *ReportClientCLI) PrintReport(includeStdErr bool) error {
+	return c.printReport(c.report, includeStdErr, c.outputFile, c.gcsObject)
 }
 
-func (c *ReportClientCLI) PrintCSVReport(includeStdErr bool) error {
+// printReport prints |report| in the format specified by -format and, if
+// |fileName| is not empty, also writes it to that file. If -gcs_output is
+// specified it is also uploaded to the object |gcsObject|.
+func (c *ReportClientCLI) printReport(report *report_master.Report, includeStdErr bool, fileName string, gcsObject string) error {
 	var buffer bytes.Buffer
-	err := report_client.WriteCSVReport(&buffer, c.report, includeStdErr)
-	if err != nil {
-		return err
+	if *format == formatJSON {
+		if err := report_client.WriteJSONReport(&buffer, report, includeStdErr); err != nil {
+			return err
+		}
+	} else {
+		if err := report_client.WriteCSVReport(&buffer, report, includeStdErr); err != nil {
+			return err
+		}
+		if *csvSummary {
+			if err := report_client.WriteCSVSummary(&buffer, report); err != nil {
+				return err
+			}
+		}
 	}
 	fmt.Println(buffer.String())
-	if csvFile != nil && len(*csvFile) > 0 {
-		fmt.Printf("Writing CSV to file %s.\n", *csvFile)
-		return ioutil.WriteFile(*csvFile, buffer.Bytes(), os.ModePerm)
+	if len(fileName) > 0 {
+		fmt.Printf("Writing %s to file %s.\n", strings.ToUpper(*format), fileName)
+		if err := ioutil.WriteFile(fileName, buffer.Bytes(), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if c.gcsOutput != nil {
+		fmt.Printf("Uploading %s to %s.\n", strings.ToUpper(*format), c.gcsOutput.URL(gcsObject))
+		if err := c.gcsOutput.Upload(context.Background(), gcsObject, buffer.Bytes(), contentType()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (c *ReportClientCLI) PrintReportResults(includeStdErr bool) {
+// contentType returns the MIME type of the reports written in the format
+// specified by -format.
+func contentType() string {
+	if *format == formatJSON {
+		return "application/json"
+	}
+	return "text/csv"
+}
+
+// ExportToSheets exports the current report to a new sheet of the spreadsheet
+// specified by -sheets_spreadsheet_id, if any.
+func (c *ReportClientCLI) ExportToSheets(includeStdErr bool) {
+	if c.sheetsExporter == nil {
+		return
+	}
+	now := time.Now()
+	title := report_client.SheetTitle(c.report.Metadata, now)
+	if err := c.sheetsExporter.Export(c.report, includeStdErr, title, now); err != nil {
+		fmt.Printf("Error while exporting the report to Google Sheets: [%v]\n", err)
+		return
+	}
+	fmt.Printf("Exported the report to the sheet \"%s\" of %s.\n", title, c.sheetsExporter.SpreadsheetURL())
+	fmt.Println()
+}
+
+// ExportToBigQuery appends the rows of the current report to the BigQuery
+// table specified by -bigquery_dataset and -bigquery_table, if any.
+func (c *ReportClientCLI) ExportToBigQuery(includeStdErr bool) {
+	if c.bigQueryExporter == nil {
+		return
+	}
+	numRows, err := c.bigQueryExporter.Export(c.report, includeStdErr, time.Now())
+	if err != nil {
+		fmt.Printf("Error while exporting the report to BigQuery after %d rows: [%v]\n", numRows, err)
+		c.outputFailed = true
+		return
+	}
+	fmt.Printf("Exported %d rows to the BigQuery table %s.\n", numRows, c.bigQueryExporter.TableName())
+	fmt.Println()
+}
+
+// PrintAssociatedReports fetches the associated reports of the current report
+// and prints each of them in a separate section. If -csv_file is specified
+// each one is also written to a separate file next to the current report's.
+func (c *ReportClientCLI) PrintAssociatedReports(includeStdErr bool) {
+	associatedReports, err := c.reportClient.GetAssociatedReports(context.Background(), c.report, time.Duration(*deadlineSeconds)*time.Second)
+	if err != nil {
+		fmt.Printf("Error while fetching associated reports: [%v]\n", err)
+		return
+	}
+	for i, associatedReport := range associatedReports {
+		fmt.Printf("Associated Report %d of %d (ID %s)\n", i+1, len(associatedReports), associatedReport.Metadata.ReportId)
+		fmt.Println("=======")
+		if associatedReport.Metadata.State != report_master.ReportState_COMPLETED_SUCCESSFULLY {
+			fmt.Printf("The associated report is in state %v.\n", associatedReport.Metadata.State)
+			for _, message := range c.reportClient.ReportErrorsToStrings(context.Background(), associatedReport, false) {
+				fmt.Println(message)
+			}
+			fmt.Println()
+			continue
+		}
+		fileName := ""
+		if len(c.outputFile) > 0 {
+			fileName = report_client.AssociatedReportFileName(c.outputFile, i)
+		}
+		gcsObject := ""
+		if c.gcsOutput != nil {
+			gcsObject = report_client.AssociatedReportFileName(c.gcsObject, i)
+		}
+		if err := c.printReport(associatedReport, includeStdErr, fileName, gcsObject); err != nil {
+			fmt.Printf("Error while printing associated report: [%v]\n", err)
+			c.outputFailed = true
+		}
+		fmt.Println()
+	}
+}
+
+// PrintReportResults prints the current report, which was waited for during
+// |wait|, according to its state.
+func (c *ReportClientCLI) PrintReportResults(includeStdErr bool, wait time.Duration) {
 	switch c.report.Metadata.State {
 	case report_master.ReportState_WAITING_TO_START:
-		fmt.Printf("After %d seconds the report is still waiting to start.\n", *deadlineSeconds)
+		c.printNotDone("waiting to start", wait)
 		break
 
 	case report_master.ReportState_IN_PROGRESS:
-		fmt.Printf("After %d seconds the report is still in progress.\n", *deadlineSeconds)
+		c.printNotDone("in progress", wait)
 		break
 
 	case report_master.ReportState_COMPLETED_SUCCESSFULLY:
 		fmt.Println()
 		fmt.Println("Results")
 		fmt.Println("=======")
-		c.PrintCSVReport(includeStdErr)
+		if err := c.PrintReport(includeStdErr); err != nil {
+			fmt.Printf("Error while writing the report: [%v]\n", err)
+			c.outputFailed = true
+		}
 		fmt.Println()
+		c.ExportToSheets(includeStdErr)
+		c.ExportToBigQuery(includeStdErr)
+		if *includeAssociatedReports {
+			c.PrintAssociatedReports(includeStdErr)
+		}
+		c.CheckFinalized()
 		break
 
 	case report_master.ReportState_TERMINATED:
 		fmt.Println()
 		fmt.Println("Report Errors")
 		fmt.Println("=======")
-		for _, message := range c.reportClient.ReportErrorsToStrings(c.report, true) {
+		for _, message := range c.reportClient.ReportErrorsToStrings(context.Background(), c.report, true) {
 			fmt.Println(message)
 		}
 		fmt.Println()
 	}
 }
 
+// CheckFinalized prints a warning if the current report covers days that the
+// ReportMaster does not yet consider finalized.
+func (c *ReportClientCLI) CheckFinalized() {
+	today := report_client.CurrentDayIndexUtc()
+	first, last, ok := report_client.UnfinalizedDays(c.report.Metadata, today)
+	c.notFinalized = ok
+	if !ok {
+		return
+	}
+	fmt.Printf("Warning: The days [%d, %d] relative to today (UTC) covered by this report are not yet finalized.\n",
+		int64(first)-int64(today), int64(last)-int64(today))
+	fmt.Printf("The ReportMaster waits %d days for Observations to arrive. The results for those days may still change.\n",
+		c.report.Metadata.ReportFinalizationDays)
+	fmt.Println()
+}
+
+// printNotDone prints that the current report is still in |state| after
+// |wait| and how to resume waiting for it.
+func (c *ReportClientCLI) printNotDone(state string, wait time.Duration) {
+	if wait > 0 {
+		fmt.Printf("After %d seconds the report is still %s.\n", int64(wait/time.Second), state)
+	} else {
+		fmt.Printf("The report is still %s.\n", state)
+	}
+	c.printResumeHint()
+}
+
+// printResumeHint prints how to resume waiting for the current report, which
+// keeps running on the server after we stop waiting for it.
+func (c *ReportClientCLI) printResumeHint() {
+	reportId := c.report.Metadata.ReportId
+	fmt.Printf("The report ID is %s. To fetch it later use the command 'fetch %s' or 'get %s', or the flag -report_id=%s.\n",
+		reportId, reportId, reportId, reportId)
+}
+
 func (c *ReportClientCLI) startReport(complete bool,
 	firstDayOffset int, lastDayOffset int, reportConfigId uint32) (string, error) {
 	if complete {
 		fmt.Printf("Generating a new report for Report Configuration %d covering all days...\n", reportConfigId)
-		return c.reportClient.StartCompleteReport(reportConfigId)
+		return c.reportClient.StartCompleteReport(context.Background(), reportConfigId)
 	} else {
 		fmt.Printf("Generating a new report for Report Configuration %d covering the relative day interval [%d, %d]...\n",
 			reportConfigId, firstDayOffset, lastDayOffset)
-		return c.reportClient.StartReportRelativeUtc(reportConfigId, firstDayOffset, lastDayOffset)
+		return c.reportClient.StartReportRelativeUtc(context.Background(), reportConfigId, firstDayOffset, lastDayOffset)
 	}
 }
 
@@ -140,47 +463,96 @@ func (c *ReportClientCLI) RunReportAndPrint(complete bool,
 	reportId, err := c.startReport(complete, firstDayOffset, lastDayOffset, reportConfigId)
 	if err != nil {
 		fmt.Printf("Error while generating report: [%v]\n", err)
+		printPermissionDeniedHint(err)
 		return
 	}
 
+	c.FetchReportAndPrint(reportId, time.Duration(*deadlineSeconds)*time.Second, printErrorColumn)
+}
+
+// FetchReportAndPrint waits up to |wait| for the existing report with ID
+// |reportId| to complete and then prints it. If |wait| is zero the report is
+// fetched once and printed in its current state.
+func (c *ReportClientCLI) FetchReportAndPrint(reportId string, wait time.Duration, printErrorColumn bool) {
 	// Fetch the report repeatedly until it is done.
-	report, err := c.reportClient.GetReport(reportId, time.Duration(*deadlineSeconds)*time.Second)
+	report, err := c.reportClient.GetReport(context.Background(), reportId, wait)
 
-	if err != nil {
+	// The errors of a terminated report are printed below.
+	var terminated *report_client.ReportTerminatedError
+	if err != nil && !errors.As(err, &terminated) {
 		fmt.Printf("Error while fetching report: [%v]\n", err)
+		printPermissionDeniedHint(err)
 		return
 	}
 	c.report = report
 
 	// Print it
-	c.PrintReportResults(printErrorColumn)
+	c.PrintReportResults(printErrorColumn, wait)
+}
+
+// printPermissionDeniedHint prints the flags that control project-level access
+// if |err| is a PermissionDeniedError.
+func printPermissionDeniedHint(err error) {
+	if _, ok := err.(*report_client.PermissionDeniedError); !ok {
+		return
+	}
+	fmt.Println("Use -project_scope to change the project scope of requests or -impersonate to make requests on behalf of another identity.")
+	if *skipOauth {
+		fmt.Println("Note that -skip_oauth was passed so the ReportMaster does not know who you are.")
+	}
 }
 
 func (c *ReportClientCLI) PrintHelp() {
 	fmt.Println()
 	fmt.Println("Cobalt command-line report client")
+	if *env != "" {
+		fmt.Printf("Environment: %s\n", *env)
+	}
 	fmt.Printf("Report Master URI: %s\n", *reportMasterURI)
 	fmt.Printf("Using tls: %v\n", *tls)
 	if *tls && *caFile != "" {
 		fmt.Printf("root CA file: %s\n", *caFile)
 	}
+	if *tls && *tlsServerName != "" {
+		fmt.Printf("TLS server name: %s\n", *tlsServerName)
+	}
 	fmt.Printf("Project ID: %d\n", *projectID)
+	if *impersonate != "" {
+		fmt.Printf("Impersonating: %s\n", *impersonate)
+	}
+	if *projectScope != "" {
+		fmt.Printf("Project scope: %s\n", *projectScope)
+	}
 	fmt.Println("---------------------------------")
 	fmt.Printf("help                  \t Print this help message.\n")
 	fmt.Println()
 	fmt.Printf("run range <firstDay> <lastDay> <cID> [errs]\n")
 	fmt.Printf("                      \t Run a new report based on the ReportConfigId <cID> covering the specified interval of days.\n")
-	fmt.Printf("                      \t Wait for the report to complete and then print the results to the console in CSV format.\n")
+	fmt.Printf("                      \t Wait for the report to complete and then print the results to the console in the format specified by -format.\n")
 	fmt.Printf("                      \t The values <firstDay> and <lastDay> are (usually negative) integers specifying the day relative to\n")
 	fmt.Printf("                      \t the current day in the UTC timezone. Thus for example to generate a report that covers the two day period\n")
 	fmt.Printf("                      \t consisting of two days ago and yesterday, use <firstDay> = -2 and <lastDay> = -1.\n")
 	fmt.Printf("                      \t If the token 'errs' is appended to the command the report will include a standard error column\n")
 	fmt.Println()
 	fmt.Printf("run full <cID> [errs] \t Run a new report based on the ReportConfigId <cID>.\n")
-	fmt.Printf("                      \t Wait for the report to complete and then print the results to the console in CSV format.\n")
+	fmt.Printf("                      \t Wait for the report to complete and then print the results to the console in the format specified by -format.\n")
 	fmt.Printf("                      \t The report will cover all Observations ever collected that are associated to the report.\n")
 	fmt.Printf("                      \t If the token 'errs' is appended to the command the report will include a standard error column\n")
 	fmt.Println()
+	fmt.Printf("fetch <reportId> [errs]\t Do not run a new report. Instead wait for the existing report with ID <reportId>\n")
+	fmt.Printf("                      \t to complete and then print the results to the console in the format specified by -format.\n")
+	fmt.Printf("                      \t If the token 'errs' is appended to the command the report will include a standard error column\n")
+	fmt.Println()
+	fmt.Printf("get <reportId> [errs] \t Do not run a new report. Instead print the existing report with ID <reportId> without waiting for\n")
+	fmt.Printf("                      \t it: the results if it is complete, its errors if it failed and otherwise its state.\n")
+	fmt.Printf("                      \t If the token 'errs' is appended to the command the report will include a standard error column\n")
+	fmt.Println()
+	fmt.Printf("list <cID> [<firstDay> <lastDay>]\n")
+	fmt.Printf("                      \t List the reports based on the ReportConfigId <cID> that were created during the specified interval\n")
+	fmt.Printf("                      \t of days, with their IDs, states and creation times. The values <firstDay> and <lastDay> are interpreted\n")
+	fmt.Printf("                      \t as for 'run range'. By default the reports created during the last %d days are listed.\n", defaultListDays)
+	fmt.Printf("                      \t A listed report may be printed with 'get <reportId>'.\n")
+	fmt.Println()
 	fmt.Printf("quit                  \t Quit.\n")
 	fmt.Println()
 }
@@ -253,6 +625,102 @@ func (c *ReportClientCLI) processRunFullCommand(commandTokens []string) {
 	c.RunReportAndPrint(true, 0, 0, uint32(reportConfigId), printErrorColumn)
 }
 
+// FetchReport processes a command of the form: fetch <reportId> [errs]
+// or, if |wait| is false, of the form: get <reportId> [errs]
+func (c *ReportClientCLI) FetchReport(commandTokens []string, wait bool) {
+	if len(commandTokens) < 2 || len(commandTokens) > 3 {
+		fmt.Printf("Malformed %s command. Expected 1 or 2 arguments.\n", commandTokens[0])
+		return
+	}
+
+	printErrorColumn := false
+	if len(commandTokens) == 3 {
+		if commandTokens[2] == "errs" {
+			printErrorColumn = true
+		} else {
+			fmt.Printf("Expected 'errs' instead of %s.\n", commandTokens[2])
+			return
+		}
+	}
+
+	if !wait {
+		fmt.Printf("Getting the existing report %s...\n", commandTokens[1])
+		c.FetchReportAndPrint(commandTokens[1], 0, printErrorColumn)
+		return
+	}
+	fmt.Printf("Fetching the existing report %s...\n", commandTokens[1])
+	c.FetchReportAndPrint(commandTokens[1], time.Duration(*deadlineSeconds)*time.Second, printErrorColumn)
+}
+
+// ListReports processes a command of the form:
+// list <reportConfigId> [<firstDayOffset> <lastDayOffset>]
+func (c *ReportClientCLI) ListReports(commandTokens []string) {
+	if len(commandTokens) != 2 && len(commandTokens) != 4 {
+		fmt.Println("Malformed list command. Expected 1 or 3 arguments.")
+		return
+	}
+	reportConfigId, err := strconv.Atoi(commandTokens[1])
+	if err != nil || reportConfigId <= 0 {
+		fmt.Printf("Expected a positive integer instead of %s.\n", commandTokens[1])
+		return
+	}
+
+	firstDayOffset, lastDayOffset := 1-defaultListDays, 0
+	if len(commandTokens) == 4 {
+		if firstDayOffset, err = strconv.Atoi(commandTokens[2]); err != nil {
+			fmt.Printf("Expected an integer instead of %s.\n", commandTokens[2])
+			return
+		}
+		if lastDayOffset, err = strconv.Atoi(commandTokens[3]); err != nil {
+			fmt.Printf("Expected an integer instead of %s.\n", commandTokens[3])
+			return
+		}
+		if firstDayOffset > lastDayOffset {
+			fmt.Printf("Expected <firstDay> to be at most <lastDay>.\n")
+			return
+		}
+	}
+
+	c.ListReportsAndPrint(uint32(reportConfigId), firstDayOffset, lastDayOffset)
+}
+
+// ListReportsAndPrint prints the reports based on the ReportConfig with ID
+// |reportConfigId| that were created during the interval of days
+// [|firstDayOffset|, |lastDayOffset|] relative to the current day in UTC.
+func (c *ReportClientCLI) ListReportsAndPrint(reportConfigId uint32, firstDayOffset int, lastDayOffset int) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, firstDayOffset)
+	limit := today.AddDate(0, 0, lastDayOffset+1)
+	fmt.Printf("Listing the reports for Report Configuration %d created during the relative day interval [%d, %d]...\n",
+		reportConfigId, firstDayOffset, lastDayOffset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*deadlineSeconds)*time.Second)
+	defer cancel()
+	reports, err := c.reportClient.ListReports(ctx, reportConfigId, first, limit)
+	if err != nil {
+		fmt.Printf("Error while listing reports: [%v]\n", err)
+		printPermissionDeniedHint(err)
+		return
+	}
+	if len(reports) == 0 {
+		fmt.Println("No reports found.")
+		fmt.Println()
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("%-40s %-24s %-20s %s\n", "Report ID", "State", "Created (UTC)", "Days")
+	for _, metadata := range reports {
+		created := ""
+		if metadata.CreationTime != nil {
+			created = time.Unix(metadata.CreationTime.Seconds, int64(metadata.CreationTime.Nanos)).UTC().Format(time.RFC3339)
+		}
+		fmt.Printf("%-40s %-24v %-20s [%d, %d]\n", metadata.ReportId, metadata.State, created,
+			metadata.FirstDayIndex, metadata.LastDayIndex)
+	}
+	fmt.Println()
+}
+
 func (c *ReportClientCLI) RunReport(commandTokens []string) {
 	if len(commandTokens) < 3 || len(commandTokens) > 6 {
 		fmt.Println("Malformed run command. Expected between 2 and 5 arguments.")
@@ -286,6 +754,21 @@ func (c *ReportClientCLI) ProcessCommand(commandTokens []string) bool {
 		return true
 	}
 
+	if commandTokens[0] == "fetch" {
+		c.FetchReport(commandTokens, true)
+		return true
+	}
+
+	if commandTokens[0] == "get" {
+		c.FetchReport(commandTokens, false)
+		return true
+	}
+
+	if commandTokens[0] == "list" {
+		c.ListReports(commandTokens)
+		return true
+	}
+
 	if commandTokens[0] == "quit" {
 		return false
 	}
@@ -295,18 +778,51 @@ func (c *ReportClientCLI) ProcessCommand(commandTokens []string) bool {
 	return true
 }
 
+// CommandLoop reads and processes commands until the 'quit' command or the end
+// of the input. The commands are read with a line editor that keeps their
+// history in the file returned by historyFile() and completes them with
+// |completer|.
 func (c *ReportClientCLI) CommandLoop() {
-	scanner := bufio.NewScanner(os.Stdin)
+	editor := liner.NewLiner()
+	defer editor.Close()
+	editor.SetCtrlCAborts(true)
+	if c.completer != nil {
+		editor.SetCompleter(c.completer.Complete)
+	}
+
+	history := historyFile()
+	if history != "" {
+		if f, err := os.Open(history); err == nil {
+			editor.ReadHistory(f)
+			f.Close()
+		}
+		defer func() {
+			f, err := os.OpenFile(history, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				fmt.Printf("Could not save the command history: %v\n", err)
+				return
+			}
+			defer f.Close()
+			if _, err := editor.WriteHistory(f); err != nil {
+				fmt.Printf("Could not save the command history: %v\n", err)
+			}
+		}()
+	}
+
 	for {
-		fmt.Print("Command or 'help': ")
-		scanner.Scan()
-		line := scanner.Text()
-		lineScanner := bufio.NewScanner(strings.NewReader(line))
-		lineScanner.Split(bufio.ScanWords)
-		tokens := []string{}
-		for lineScanner.Scan() {
-			token := lineScanner.Text()
-			tokens = append(tokens, token)
+		line, err := editor.Prompt("Command or 'help': ")
+		if err == liner.ErrPromptAborted {
+			// Ctrl-C discards the current line.
+			continue
+		}
+		if err != nil {
+			// The end of the input.
+			fmt.Println()
+			break
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) > 0 {
+			editor.AppendHistory(strings.Join(tokens, " "))
 		}
 		if !c.ProcessCommand(tokens) {
 			break
@@ -316,7 +832,18 @@ func (c *ReportClientCLI) CommandLoop() {
 
 func (c *ReportClientCLI) ExecuteCommand() {
 	var command []string
-	if *firstDay != math.MaxInt64 && *lastDay != math.MaxInt64 {
+	if *list {
+		command = []string{"list", fmt.Sprintf("%d", *reportConfigID)}
+		if *firstDay != math.MaxInt64 && *lastDay != math.MaxInt64 {
+			command = append(command, fmt.Sprintf("%d", *firstDay), fmt.Sprintf("%d", *lastDay))
+		}
+		c.ProcessCommand(command)
+		return
+	}
+
+	if *reportID != "" {
+		command = []string{"fetch", *reportID}
+	} else if *firstDay != math.MaxInt64 && *lastDay != math.MaxInt64 {
 		command = []string{"run", "range", fmt.Sprintf("%d", *firstDay), fmt.Sprintf("%d", *lastDay), fmt.Sprintf("%d", *reportConfigID)}
 	} else {
 		command = []string{"run", "full", fmt.Sprintf("%d", *reportConfigID)}
@@ -327,9 +854,224 @@ func (c *ReportClientCLI) ExecuteCommand() {
 	c.ProcessCommand(command)
 }
 
+// parseReportConfigIds parses the comma-separated list of positive ReportConfig
+// IDs |list|.
+func parseReportConfigIds(list string) ([]uint32, error) {
+	var ids []uint32
+	for _, token := range strings.Split(list, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(token), 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("expected a positive integer instead of %q", token)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// RunReports runs the reports of the ReportConfigs specified by
+// -report_config_ids concurrently and then prints the results of each of them
+// in a separate section.
+func (c *ReportClientCLI) RunReports() {
+	ids, err := parseReportConfigIds(*reportConfigIDs)
+	if err != nil {
+		fmt.Println("Could not parse -report_config_ids:", err)
+		os.Exit(1)
+	}
+
+	firstDayIndex, lastDayIndex := uint32(0), uint32(math.MaxUint32)
+	if *firstDay != math.MaxInt64 && *lastDay != math.MaxInt64 {
+		today := int64(report_client.CurrentDayIndexUtc())
+		firstDayIndex, lastDayIndex = uint32(today+*firstDay), uint32(today+*lastDay)
+	}
+	var specs []report_client.ReportSpec
+	for _, id := range ids {
+		specs = append(specs, report_client.ReportSpec{ReportConfigId: id, FirstDayIndex: firstDayIndex, LastDayIndex: lastDayIndex})
+	}
+
+	fmt.Printf("Generating new reports for Report Configurations %s...\n", *reportConfigIDs)
+	results := c.reportClient.RunReports(context.Background(), specs, time.Duration(*deadlineSeconds)*time.Second)
+
+	numCompleted := 0
+	notFinalized := false
+	printed := map[report_client.ReportSpec]bool{}
+	for _, spec := range specs {
+		if printed[spec] {
+			continue
+		}
+		printed[spec] = true
+
+		fmt.Println()
+		fmt.Printf("Report Configuration %d\n", spec.ReportConfigId)
+		fmt.Println("=======")
+		result := results[spec]
+		var terminated *report_client.ReportTerminatedError
+		if result.Err != nil && !errors.As(result.Err, &terminated) {
+			fmt.Printf("Error while generating report: [%v]\n", result.Err)
+			printPermissionDeniedHint(result.Err)
+			continue
+		}
+
+		c.report = result.Report
+		c.outputFile = ""
+		if len(*csvFile) > 0 {
+			c.outputFile = report_client.ReportConfigFileName(*csvFile, spec.ReportConfigId)
+		}
+		if c.gcsOutput != nil {
+			c.gcsObject = report_client.ReportConfigFileName(c.gcsOutput.Object(), spec.ReportConfigId)
+		}
+		c.notFinalized = false
+		c.PrintReportResults(*includeStdErrColumn, time.Duration(*deadlineSeconds)*time.Second)
+		if result.Report.Metadata.State == report_master.ReportState_COMPLETED_SUCCESSFULLY {
+			numCompleted++
+		}
+		notFinalized = notFinalized || c.notFinalized
+	}
+	c.notFinalized = notFinalized
+	fmt.Printf("%d of %d reports completed successfully.\n", numCompleted, len(results))
+}
+
+// Watch runs the command specified by the flags every |interval|. After each
+// successful run the changes since the previous successful run are printed.
+// Watch never returns.
+func (c *ReportClientCLI) Watch(interval time.Duration) {
+	var previous *report_master.Report
+	for {
+		fmt.Printf("\nRunning the report at %s.\n", time.Now().Format(time.RFC1123))
+		c.report = nil
+		c.ExecuteCommand()
+		if c.report != nil && c.report.Metadata.State == report_master.ReportState_COMPLETED_SUCCESSFULLY {
+			if previous != nil {
+				c.PrintReportDelta(previous)
+			}
+			previous = c.report
+		}
+		fmt.Printf("Running the report again in %v.\n", interval)
+		time.Sleep(interval)
+	}
+}
+
+// RunSchedule runs the report specified by -report_config_id each time the
+// schedule specified by -schedule fires. RunSchedule never returns.
+func (c *ReportClientCLI) RunSchedule() {
+	parsedSchedule, err := report_client.ParseSchedule(*schedule)
+	if err != nil {
+		fmt.Println("Could not parse -schedule:", err)
+		os.Exit(1)
+	}
+	period, err := report_client.ParseReportPeriod(*schedulePeriod)
+	if err != nil {
+		fmt.Println("Could not parse -schedule_period:", err)
+		os.Exit(1)
+	}
+	scheduler, err := report_client.NewReportScheduler(c.reportClient, report_client.ScheduledReport{
+		ReportConfigId: uint32(*reportConfigID),
+		Schedule:       parsedSchedule,
+		Period:         period,
+		Destination:    *scheduleDestination,
+		IncludeStdErr:  *includeStdErrColumn,
+		Wait:           time.Duration(*deadlineSeconds) * time.Second,
+		MaxAttempts:    *scheduleMaxAttempts,
+		RetryInterval:  time.Duration(*scheduleRetryIntervalSeconds) * time.Second,
+		StateFile:      *scheduleStateFile,
+	})
+	if err != nil {
+		fmt.Println("Could not create the scheduler:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Running Report Configuration %d on the schedule \"%s\".\n", *reportConfigID, *schedule)
+	if err := scheduler.Run(context.Background()); err != nil {
+		fmt.Println("The scheduler stopped:", err)
+		os.Exit(1)
+	}
+}
+
+// PrintReportDelta prints the rows whose count estimate changed between
+// |previous| and the current report.
+func (c *ReportClientCLI) PrintReportDelta(previous *report_master.Report) {
+	fmt.Println("Changes since the previous run")
+	fmt.Println("=======")
+	deltas := report_client.ReportDelta(previous, c.report)
+	if len(deltas) == 0 {
+		fmt.Println("No changes.")
+		fmt.Println()
+		return
+	}
+	var buffer bytes.Buffer
+	if err := report_client.WriteCSVReportDelta(&buffer, deltas); err != nil {
+		fmt.Printf("Error while printing the changes: [%v]\n", err)
+		return
+	}
+	fmt.Println(buffer.String())
+}
+
+// defaultEnvFile returns the path of the environments file in the home
+// directory of the user.
+func defaultEnvFile() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".cobalt_report_client.yaml")
+}
+
+// historyFile returns the path of the file in the home directory of the user
+// in which the history of the commands of the interactive mode is kept.
+func historyFile() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".cobalt_report_client_history")
+}
+
+// applyEnvironment loads the environment |name| from |path| and sets the
+// connection flags that were not set explicitly on the command line to its
+// values.
+func applyEnvironment(path, name string) error {
+	if path == "" {
+		return errors.New("-env_file is not specified")
+	}
+	environment, err := report_client.LoadEnvironment(path, name)
+	if err != nil {
+		return err
+	}
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if !setFlags["report_master_uri"] {
+		*reportMasterURI = environment.ReportMasterURI
+	}
+	if !setFlags["tls"] {
+		*tls = environment.TLS
+	}
+	if !setFlags["ca_file"] {
+		*caFile = environment.CAFile
+	}
+	if !setFlags["tls_server_name"] {
+		*tlsServerName = environment.TLSServerName
+	}
+	if !setFlags["skip_oauth"] {
+		*skipOauth = environment.SkipOauth
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Printf("report_client version %s, commit %s\n", version, commit)
+		os.Exit(0)
+	}
+
+	if *env != "" {
+		if err := applyEnvironment(*envFile, *env); err != nil {
+			fmt.Println("Could not load -env:", err)
+			os.Exit(1)
+		}
+	}
+
 	_, port, err := net.SplitHostPort(*reportMasterURI)
 	if err != nil {
 		fmt.Println("Could not parse -report_master_uri:", err)
@@ -339,15 +1081,118 @@ func main() {
 		*tls = true
 	}
 
+	if *format != formatCSV && *format != formatJSON {
+		fmt.Printf("-format must be %q or %q.\n", formatCSV, formatJSON)
+		os.Exit(1)
+	}
+
+	if *decimalPrecision < 0 || *decimalSeparator == "" {
+		fmt.Println("-decimal_precision must not be negative and -decimal_separator must not be empty.")
+		os.Exit(1)
+	}
+	report_client.SetNumberFormat(report_client.NumberFormat{
+		Precision:               *decimalPrecision,
+		DecimalSeparator:        *decimalSeparator,
+		IntegersForWholeNumbers: *integersForWholeNumbers,
+	})
+
+	serviceConfig := ""
+	if *serviceConfigFile != "" {
+		if serviceConfig, err = report_client.LoadServiceConfig(*serviceConfigFile); err != nil {
+			fmt.Println("Could not load -service_config_file:", err)
+			os.Exit(1)
+		}
+	}
+
 	cli := ReportClientCLI{
-		reportClient: report_client.NewReportClient(uint32(*customerID), uint32(*projectID),
-			*reportMasterURI, *tls, *skipOauth, *caFile),
+		reportClient: report_client.NewReportClientWithTLSServerName(uint32(*customerID), uint32(*projectID),
+			*reportMasterURI, *tls, *skipOauth, *caFile, *tlsServerName, report_client.AccessOptions{
+				Impersonate:  *impersonate,
+				ProjectScope: *projectScope,
+			}, serviceConfig),
+	}
+	cli.outputFile = *csvFile
+	cli.reportClient.SetMaxPollInterval(time.Duration(*maxPollIntervalSeconds) * time.Second)
+	if *sheetsSpreadsheetID != "" {
+		cli.sheetsExporter = report_client.NewSheetsExporter(*sheetsSpreadsheetID)
+	}
+	if *interactive {
+		var ids []uint32
+		if *configFile != "" {
+			if ids, err = report_client.LoadReportConfigIds(*configFile, uint32(*customerID), uint32(*projectID)); err != nil {
+				fmt.Println("Could not load -config_file:", err)
+				os.Exit(1)
+			}
+		}
+		cli.completer = report_client.NewCompleter(ids)
+	}
+
+	if !*interactive && *reportID != "" && *watchInterval > 0 {
+		fmt.Println("-report_id and -watch_interval cannot be used together.")
+		os.Exit(1)
+	}
+
+	if !*interactive && *schedule != "" && (*reportID != "" || *watchInterval > 0) {
+		fmt.Println("-schedule cannot be used with -report_id or -watch_interval.")
+		os.Exit(1)
+	}
+
+	if !*interactive && *reportConfigIDs != "" && (*reportID != "" || *watchInterval > 0 || *schedule != "") {
+		fmt.Println("-report_config_ids cannot be used with -report_id, -watch_interval or -schedule.")
+		os.Exit(1)
+	}
+
+	if !*interactive && *list && (*reportID != "" || *reportConfigIDs != "" || *watchInterval > 0 || *schedule != "") {
+		fmt.Println("-list cannot be used with -report_id, -report_config_ids, -watch_interval or -schedule.")
+		os.Exit(1)
+	}
+
+	if !*interactive && *gcsOutput != "" && (*list || *schedule != "") {
+		fmt.Println("-gcs_output cannot be used with -list or -schedule. Use -schedule_destination to upload scheduled reports.")
+		os.Exit(1)
+	}
+
+	if !*interactive && *gcsOutput != "" {
+		if cli.gcsOutput, err = report_client.NewGCSOutput(*gcsOutput, *gcsGzip); err != nil {
+			fmt.Println("Could not use -gcs_output:", err)
+			os.Exit(1)
+		}
+		cli.gcsObject = cli.gcsOutput.Object()
+	}
+
+	if (*bigQueryDataset == "") != (*bigQueryTable == "") {
+		fmt.Println("-bigquery_dataset and -bigquery_table must be specified together.")
+		os.Exit(1)
+	}
+	if *bigQueryTable != "" {
+		if cli.bigQueryExporter, err = report_client.NewBigQueryExporter(*bigQueryProject, *bigQueryDataset, *bigQueryTable); err != nil {
+			fmt.Println("Could not export to BigQuery:", err)
+			os.Exit(1)
+		}
 	}
 
 	if *interactive {
 		cli.CommandLoop()
+	} else if *reportConfigIDs != "" {
+		cli.RunReports()
+		if cli.outputFailed {
+			os.Exit(1)
+		}
+		if *requireFinalized && cli.notFinalized {
+			os.Exit(exitCodeNotFinalized)
+		}
+	} else if *schedule != "" {
+		cli.RunSchedule()
+	} else if *watchInterval > 0 {
+		cli.Watch(time.Duration(*watchInterval) * time.Minute)
 	} else {
 		cli.ExecuteCommand()
+		if cli.outputFailed {
+			os.Exit(1)
+		}
+		if *requireFinalized && cli.notFinalized {
+			os.Exit(exitCodeNotFinalized)
+		}
 	}
 
 }
@@ -48,6 +48,12 @@ DEFINE_uint32(metric, 1,
 DEFINE_uint32(max_num, 100,
               "Maximum number of results to query for. Used in non-interactive "
               "mode only.");
+DEFINE_uint32(start_day_index, 0,
+              "Only Observations with a day index of at least this value are "
+              "counted. Used in non-interactive mode only.");
+DEFINE_uint32(end_day_index, INT32_MAX,
+              "Only Observations with a day index of at most this value are "
+              "counted. Used in non-interactive mode only.");
 
 namespace {
 // Given a |line| of text, breaks it into tokens separated by white space.
@@ -273,8 +279,9 @@ void ObservationQuerier::CommandLoop() {
   }
 }
 
-// Counts the number of Observations in the Observation store and writes the
-// count to std::cout. We iteratively query in batches of size up to 10000
+// Counts the number of Observations in the Observation store with a day index
+// between FLAGS_start_day_index and FLAGS_end_day_index and writes the count
+// to std::cout. We iteratively query in batches of size up to 10000
 // and stop counting when we have seen FLAGS_max_num observations. Thus the
 // result will be <= FLAGS_max_num.
 void ObservationQuerier::CountObservations() {
@@ -285,8 +292,9 @@ void ObservationQuerier::CountObservations() {
     SystemProfileFields fields;
     fields.Add(SystemProfileField::BOARD_NAME);
     auto query_response = observation_store_->QueryObservations(
-        customer_, project_, FLAGS_metric, 0, INT32_MAX,
-        std::vector<std::string>(), fields, batch_size, pagination_token);
+        customer_, project_, FLAGS_metric, FLAGS_start_day_index,
+        FLAGS_end_day_index, std::vector<std::string>(), fields, batch_size,
+        pagination_token);
     if (query_response.status != analyzer::store::kOK) {
       LOG(FATAL) << "Query failed with code: " << query_response.status;
       return;
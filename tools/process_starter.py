@@ -43,6 +43,7 @@ SHUFFLER_TMP_DB_DIR = os.path.join("/tmp/cobalt_shuffler")
 DEFAULT_SHUFFLER_PORT=5001
 DEFAULT_ANALYZER_SERVICE_PORT=6001
 DEFAULT_REPORT_MASTER_PORT=7001
+DEFAULT_FAKE_GCS_PORT=7090
 
 DEFAULT_ANALYZER_PUBLIC_KEY_PEM=os.path.join(SRC_ROOT_DIR,
                                              "analyzer_public.pem")
@@ -77,7 +78,7 @@ def kill_process(process, name):
     process.wait()
 
 
-def execute_command(cmd, wait):
+def execute_command(cmd, wait, env=None):
   """ Executes the given command and optionally waits for it to complete.
 
   command {list of strings} will be passed to Popen().
@@ -86,11 +87,16 @@ def execute_command(cmd, wait):
       the result code. If false we will return immediately and return an
       instance of Popen.
 
+  env {dict} If not None, environment variables that are set for the command
+      in addition to those of the current process.
+
   Returns:
     An instance of Popen if wait is false or an integer return code if
     wait is true.
   """
-  p = subprocess.Popen(cmd)
+  if env:
+    env = dict(os.environ, **env)
+  p = subprocess.Popen(cmd, env=env)
   if not wait:
     return p
   return_code = p.wait()
@@ -193,8 +199,19 @@ def start_report_master(port=DEFAULT_REPORT_MASTER_PORT,
                         use_tls=False,
                         tls_cert_file=LOCALHOST_TLS_CERT_FILE,
                         tls_key_file=LOCALHOST_TLS_KEY_FILE,
+                        report_scheduling_interval_seconds=0,
+                        gcs_emulator_url='',
                         verbose_count=0, vmodule=None,
                         wait=True):
+  """ Starts the ReportMaster.
+
+  If |report_scheduling_interval_seconds| is positive then report scheduling
+  is enabled and the scheduler wakes up this often. Only the reports for the
+  current day are scheduled in that case, since the scheduler is used by
+  tests that generate their data on the same day. If |gcs_emulator_url| is
+  not empty then reports are exported to the Google Cloud Storage emulator at
+  that URL instead of to Google Cloud Storage.
+  """
   print
   print "Starting the analyzer ReportMaster service..."
   print
@@ -216,11 +233,20 @@ def start_report_master(port=DEFAULT_REPORT_MASTER_PORT,
   else:
     print "Will connect to a local Bigtable Emulator instance."
     cmd.append("-for_testing_only_use_bigtable_emulator")
+  if report_scheduling_interval_seconds > 0:
+    cmd.append("-enable_report_scheduling")
+    cmd.append("-report_scheduling_interval_seconds=%d" %
+               report_scheduling_interval_seconds)
+    cmd.append("-daily_report_makeup_days=0")
+  env = None
+  if gcs_emulator_url:
+    print "Will export reports to the GCS emulator at %s." % gcs_emulator_url
+    env = {"COBALT_GCS_EMULATOR_URL": gcs_emulator_url}
   if verbose_count > 0:
     cmd.append("-v=%d"%verbose_count)
   if vmodule:
     cmd.append("-vmodule=%s"%vmodule)
-  return execute_command(cmd, wait)
+  return execute_command(cmd, wait, env=env)
 
 TEST_APP_PATH = os.path.abspath(os.path.join(OUT_DIR, 'tools', 'test_app',
                                 'cobalt_test_app'))
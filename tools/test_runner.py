@@ -39,6 +39,9 @@ E2E_TEST_SHUFFLER_PRIVATE_KEY_PEM = os.path.join(E2E_DIR,
     "shuffler_private_key.pem.e2e_test")
 E2E_TEST_SHUFFLER_PUBLIC_KEY_PEM = os.path.join(E2E_DIR,
     "shuffler_public_key.pem.e2e_test")
+# How often the Report Master schedules reports when the end-to-end test
+# checks the reports it exports.
+E2E_REPORT_SCHEDULING_INTERVAL_SECONDS = 5
 
 _logger = logging.getLogger()
 
@@ -52,6 +55,7 @@ def run_all_tests(test_dir,
                   bigtable_instance_id = '',
                   verbose_count=0,
                   vmodule=None,
+                  fake_gcs_port=0,
                   test_args=None):
   """ Runs the tests in the given directory.
 
@@ -84,6 +88,11 @@ def run_all_tests(test_dir,
       ReportMaster and so this flag is ignored unles start_cobatl_processes is
       True.
 
+      fake_gcs_port {int} This is ignored unless start_cobalt_processes=True.
+      In that case, if this is positive, the Report Master is started with
+      report scheduling enabled and exports its reports to the fake Google
+      Cloud Storage server that the tests run on this port.
+
       test_args {list of strings} These will be passed to each test executable.
 
     Returns: A list of strings indicating which tests failed. Returns None or
@@ -123,12 +132,21 @@ def run_all_tests(test_dir,
             verbose_count=verbose_count, vmodule=vmodule,
             wait=False)
         time.sleep(1)
+        report_scheduling_interval_seconds = 0
+        gcs_emulator_url = ''
+        if fake_gcs_port > 0:
+          report_scheduling_interval_seconds = (
+              E2E_REPORT_SCHEDULING_INTERVAL_SECONDS)
+          gcs_emulator_url = "http://localhost:%d/" % fake_gcs_port
         report_master_process=process_starter.start_report_master(
             use_tls=use_tls,
             tls_cert_file=tls_cert_file,
             tls_key_file=tls_key_file,
             bigtable_instance_id=bigtable_instance_id,
             bigtable_project_name=bigtable_project_name,
+            report_scheduling_interval_seconds=(
+                report_scheduling_interval_seconds),
+            gcs_emulator_url=gcs_emulator_url,
             verbose_count=verbose_count, vmodule=vmodule,
             wait=False)
         time.sleep(1)
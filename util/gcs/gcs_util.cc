@@ -15,6 +15,7 @@
 #include "third_party/google-api-cpp-client/src/googleapis/client/auth/oauth2_service_authorization.h"
 #include "third_party/google-api-cpp-client/src/googleapis/client/data/data_reader.h"
 #include "third_party/google-api-cpp-client/src/googleapis/client/transport/curl_http_transport.h"
+#include "third_party/google-api-cpp-client/src/googleapis/client/transport/http_authorization.h"
 #include "third_party/google-api-cpp-client/src/googleapis/client/transport/http_transport.h"
 #include "third_party/google-api-cpp-client/src/googleapis/strings/stringpiece.h"
 
@@ -24,6 +25,7 @@
 using google_storage_api::BucketsResource_GetMethod;
 using google_storage_api::ObjectsResource_InsertMethod;
 using google_storage_api::StorageService;
+using googleapis::client::AuthorizationCredential;
 using googleapis::client::CurlHttpTransportFactory;
 using googleapis::client::DataReader;
 using googleapis::client::HttpTransportLayerConfig;
@@ -48,6 +50,12 @@ struct GcsUtil::Impl {
   std::unique_ptr<google_storage_api::StorageService> storage_service_;
   std::unique_ptr<googleapis::client::OAuth2ServiceAccountFlow> oauth_flow_;
   std::unique_ptr<googleapis::client::HttpTransportLayerConfig> http_config_;
+  // Requests to an emulator are not authorized.
+  bool use_emulator_ = false;
+
+  AuthorizationCredential* credential() {
+    return use_emulator_ ? nullptr : &oauth_credential_;
+  }
 };
 
 GcsUtil::GcsUtil() : impl_(new Impl()) {}
@@ -55,6 +63,13 @@ GcsUtil::GcsUtil() : impl_(new Impl()) {}
 GcsUtil::~GcsUtil() {}
 
 bool GcsUtil::InitFromDefaultPaths() {
+  // The end-to-end tests set the environment variable
+  // "COBALT_GCS_EMULATOR_URL" in order to capture exported reports.
+  char* emulator_url = std::getenv("COBALT_GCS_EMULATOR_URL");
+  if (emulator_url) {
+    return InitForEmulator(emulator_url);
+  }
+
   // When ReportMaster is deployed to Google Container Engine, the environment
   // variable "GRPC_DEFAULT_SSL_ROOTS_FILE_PATH" is set in the file
   // //kubernetes/cobalt_common/Dockerfile
@@ -130,6 +145,33 @@ bool GcsUtil::Init(const std::string ca_certs_path,
   return true;
 }
 
+bool GcsUtil::InitForEmulator(const std::string& url) {
+  LOG(WARNING) << "Using the Google Cloud Storage emulator at " << url
+               << ". This must only be used in tests.";
+  impl_->http_config_.reset(new HttpTransportLayerConfig);
+  impl_->http_config_->ResetDefaultTransportFactory(
+      new CurlHttpTransportFactory(impl_->http_config_.get()));
+
+  googleapis::util::Status status;
+  impl_->storage_service_.reset(
+      new StorageService(impl_->http_config_->NewDefaultTransport(&status)));
+  if (!status.ok()) {
+    LOG_STACKDRIVER_COUNT_METRIC(ERROR, kInitFailure)
+        << "GcsUtil::InitForEmulator(). Error creating new Http transport: "
+        << status.ToString();
+    return false;
+  }
+  // The emulator serves the API under the same paths as Google Cloud Storage.
+  std::string url_root = url;
+  if (url_root.empty() || url_root.back() != '/') {
+    url_root += "/";
+  }
+  impl_->storage_service_->ChangeServiceUrl(url_root, "storage/v1/");
+  impl_->use_emulator_ = true;
+
+  return true;
+}
+
 bool GcsUtil::Upload(const std::string& bucket, const std::string& path,
                      const std::string mime_type, const char* data,
                      size_t num_bytes, uint32_t timeout_seconds) {
@@ -156,7 +198,7 @@ bool GcsUtil::Upload(const std::string& bucket, const std::string& path,
   // this takes ownership of |data_reader|.
   std::unique_ptr<ObjectsResource_InsertMethod> request(
       impl_->storage_service_->get_objects().NewInsertMethod(
-          &(impl_->oauth_credential_), bucket, nullptr, mime_type.c_str(),
+          impl_->credential(), bucket, nullptr, mime_type.c_str(),
           reinterpret_cast<DataReader*>(data_reader)));
   request->set_name(path);
 
@@ -179,7 +221,7 @@ bool GcsUtil::Ping(const std::string& bucket) {
   // Construct the request.
   std::unique_ptr<BucketsResource_GetMethod> request(
       impl_->storage_service_->get_buckets().NewGetMethod(
-          &(impl_->oauth_credential_), bucket));
+          impl_->credential(), bucket));
 
   // Execute the request.
   auto status = request->Execute();
@@ -40,6 +40,9 @@ class GcsUtil {
   // json file is read from the environment variable
   // "GOOGLE_APPLICATION_CREDENTIALS".
   //
+  // If instead the environment variable "COBALT_GCS_EMULATOR_URL" is set
+  // then this instance is initialized by InitForEmulator() with its value.
+  //
   // Returns true on success. On failure, logs an Error and returns false.
   // If this method returns false, do not continue to use this instance.
   // Discard this instance and try again.
@@ -60,6 +63,13 @@ class GcsUtil {
   bool Init(const std::string ca_certs_path,
             const std::string& service_account_json_path);
 
+  // Initializes this instance to send its requests without authorization to
+  // an emulator of the Google Cloud Storage JSON API whose root URL is |url|,
+  // for example "http://localhost:7090/". This must only be used in tests.
+  //
+  // Returns true on success. On failure, logs an Error and returns false.
+  bool InitForEmulator(const std::string& url);
+
   // Uploads a blob to Google Cloud Storage. |num_bytes| from |data| are
   // uploaded to the given |path| within the given |bucket|. This will succeed
   // only if the bucket already exists and the service account specified when